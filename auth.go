@@ -1,11 +1,22 @@
 package proxyme
 
 import (
-	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
 	"fmt"
 	"io"
+	"math/rand/v2"
+	"time"
+
+	"github.com/dblokhin/proxyme/wire"
 )
 
+// ErrInvalidCredentials is returned by authenticators on unknown username or wrong password,
+// see ErrUnknownUser and ErrBadPassword telling them apart.
+var ErrInvalidCredentials = errors.New("invalid credentials")
+
 // as defined http://www.ietf.org/rfc/rfc1928.txt
 // as defined http://www.ietf.org/rfc/rfc1929.txt
 
@@ -20,7 +31,9 @@ type authHandler interface {
 	// auth method according to rfc 1928
 	method() authMethod
 	// auth conducts auth on the connection (and returns upgraded conn if needed)
-	auth(conn io.ReadWriteCloser) (io.ReadWriteCloser, error)
+	// and returns the authenticated username if the method has one.
+	// The context is passed to the auth callbacks.
+	auth(ctx context.Context, conn io.ReadWriteCloser) (io.ReadWriteCloser, string, error)
 }
 
 type noAuth struct{}
@@ -29,87 +42,175 @@ func (a noAuth) method() authMethod {
 	return typeNoAuth
 }
 
-func (a noAuth) auth(conn io.ReadWriteCloser) (io.ReadWriteCloser, error) {
+func (a noAuth) auth(_ context.Context, conn io.ReadWriteCloser) (io.ReadWriteCloser, string, error) {
 	// no auth just returns conn itself
-	return conn, nil
+	return conn, "", nil
 }
 
 type usernameAuth struct {
-	authenticator func(user, pass []byte) error
+	authenticator func(ctx context.Context, user, pass []byte) error
+	policy        credentialPolicy
+	rejectDelay   time.Duration // max delay of the failure reply (see Options.AuthFailureDelay)
 }
 
 func (a usernameAuth) method() authMethod {
 	return typeLogin
 }
 
-func (a usernameAuth) auth(conn io.ReadWriteCloser) (io.ReadWriteCloser, error) {
+func (a usernameAuth) auth(ctx context.Context, conn io.ReadWriteCloser) (io.ReadWriteCloser, string, error) {
 	var req loginRequest
 	if _, err := req.ReadFrom(conn); err != nil {
-		return conn, fmt.Errorf("sock read: %w", err)
+		return conn, "", fmt.Errorf("sock read: %w", err)
 	}
 
-	if err := req.validate(); err != nil {
-		return conn, err
+	if err := req.validate(a.policy); err != nil {
+		return conn, "", fmt.Errorf("%w: %w", errMalformed, err)
 	}
 
-	resp := loginReply{success}
-	err := a.authenticator(req.username, req.password)
-	if err != nil {
-		resp.status = denied
+	if err := a.authenticator(ctx, req.username, req.password); err != nil {
+		// If the server returns a `failure' (STATUS value other than X'00') status,
+		// it MUST close the connection.
+		reject(conn, loginReply{denied}, a.rejectDelay)
+		return conn, "", err
 	}
 
 	// server response
-	if _, err := resp.WriteTo(conn); err != nil {
-		return conn, fmt.Errorf("sock write: %w", err)
+	if err := sendPipelined(conn, loginReply{success}); err != nil {
+		return conn, "", fmt.Errorf("sock write: %w", err)
+	}
+
+	return conn, string(req.username), nil
+}
+
+// reject sends failure reply of the auth method after random delay up to delay, so the reply timing
+// doesn't reveal which check has failed (see Options.AuthFailureDelay). The connection is closed
+// afterward, so write errors don't matter.
+func reject(conn io.Writer, reply io.WriterTo, delay time.Duration) {
+	time.Sleep(failureDelay(delay))
+	_ = send(conn, reply)
+}
+
+// maxFailureDelay is the longest time RFC 1928 allows to keep the connection after failure.
+const maxFailureDelay = 10 * time.Second
+
+// failureDelay returns random delay up to limit before the failure reply, so the failure timing
+// doesn't reveal which check has failed.
+func failureDelay(limit time.Duration) time.Duration {
+	if limit <= 0 {
+		return 0
+	}
+
+	return rand.N(limit + 1)
+}
+
+// EqualCredentials reports whether a and b are equal in constant time.
+// Unlike bytes.Equal the comparison time doesn't depend on the content nor the length
+// of arguments, so use it in Authenticate callbacks to compare secrets.
+func EqualCredentials(a, b []byte) bool {
+	// compare fixed size digests to hide lengths of the secrets
+	ha := sha256.Sum256(a)
+	hb := sha256.Sum256(b)
+
+	return subtle.ConstantTimeCompare(ha[:], hb[:]) == 1
+}
+
+// StaticCredentials returns Authenticate callback checking credentials against users map (username -> password).
+// Password is compared in constant time, unknown usernames take the same time as wrong passwords
+// to make username enumeration harder.
+func StaticCredentials(users map[string]string) func(username, password []byte) error {
+	// copy to protect from further modifications
+	db := make(map[string][]byte, len(users))
+	for user, pass := range users {
+		db[user] = []byte(pass)
 	}
 
-	// If the server returns a `failure' (STATUS value other than X'00') status,
-	// it MUST close the  connection.
-	// It will close if err != nil
-	return conn, err
+	return func(username, password []byte) error {
+		expected, ok := db[string(username)]
+		if !ok {
+			// compare anyway to keep timing the same
+			expected = nil
+		}
+
+		if !EqualCredentials(expected, password) || !ok {
+			if !ok {
+				return ErrUnknownUser
+			}
+			return ErrBadPassword
+		}
+
+		return nil
+	}
 }
 
 const (
-	gssMaxTokenSize = 1<<16 - 1
+	gssMaxTokenSize = wire.MaxTokenSize
 
 	// gssapi message types
-	gssAuthentication uint8 = 1
-	gssProtection     uint8 = 2
-	gssEncapsulation  uint8 = 3
+	gssAuthentication = wire.GSSAuthentication
+	gssProtection     = wire.GSSProtection
+	gssEncapsulation  = wire.GSSEncapsulation
+	gssAbort          = wire.GSSAbort
 )
 
+// necGSSAPIMethod is the private method code legacy clients of GSSAPI (NEC) variant propose.
+const necGSSAPIMethod = 0x86
+
 type gssapiAuth struct {
-	gssapi func() (GSSAPI, error)
+	gssapi       func(ctx context.Context) (GSSAPI, error)
+	maxTokenSize int           // max size of client tokens, 0 means gssMaxTokenSize
+	code         authMethod    // method code, 0 means typeGSSAPI
+	nec          bool          // tolerate GSSAPI (NEC) deviations (see Options.GSSAPINEC)
+	rejectDelay  time.Duration // max delay of the failure reply (see Options.AuthFailureDelay)
+}
+
+// read reads client message of messageType refusing oversized tokens.
+func (a gssapiAuth) read(conn io.ReadWriter, msg *gssapiMessage, messageType uint8) error {
+	msg.limit = a.maxTokenSize
+
+	if _, err := msg.ReadFrom(conn); err != nil {
+		if errors.Is(err, errInvalidTokenSize) {
+			reject(conn, gssapiAbort{}, 0)
+			return fmt.Errorf("%w: %w", errMalformed, err)
+		}
+		return fmt.Errorf("sock read: %w", err)
+	}
+
+	if err := msg.validate(messageType); err != nil {
+		return fmt.Errorf("%w: %w", errMalformed, err)
+	}
+
+	return nil
 }
 
 func (a gssapiAuth) method() authMethod {
+	if a.code != 0 {
+		return a.code
+	}
+
 	return typeGSSAPI
 }
 
 // auth authenticates and returns encapsulated conn.
 // encapsulated conn MUST be non nil.
-func (a gssapiAuth) auth(conn io.ReadWriteCloser) (io.ReadWriteCloser, error) {
-	gssapi, err := a.gssapi()
+func (a gssapiAuth) auth(ctx context.Context, conn io.ReadWriteCloser) (io.ReadWriteCloser, string, error) {
+	gssapi, err := a.gssapi(ctx)
 	if err != nil {
-		return conn, err
+		return conn, "", err
 	}
 
 	// authenticate state
 	if err := a.authenticate(gssapi, conn); err != nil {
-		return conn, err
+		return conn, "", err
 	}
 
 	// agreement message protection stage
 	if err := a.applyProtection(gssapi, conn); err != nil {
-		return conn, err
+		return conn, "", err
 	}
 
-	// make encapsulated conn
-	return gssConn{
-		raw:    conn,
-		gssapi: gssapi,
-		buffer: bytes.Buffer{},
-	}, nil
+	// make encapsulated conn over the raw one: session writes are buffered above encapsulation
+	// to get a single token per protocol message
+	return newBufferedConn(newGSSConn(unwrap(conn), gssapi, a.maxTokenSize)), "", nil
 }
 
 func (a gssapiAuth) authenticate(gssapi GSSAPI, conn io.ReadWriteCloser) error {
@@ -123,28 +224,27 @@ func (a gssapiAuth) authenticate(gssapi GSSAPI, conn io.ReadWriteCloser) error {
 		// to gss_accept_sec_context.
 
 		// 1. receive client initial token
-		if _, err := msg.ReadFrom(conn); err != nil {
-			return fmt.Errorf("sock read: %w", err)
-		}
-
-		if err := msg.validate(gssAuthentication); err != nil {
+		if err := a.read(conn, &msg, gssAuthentication); err != nil {
 			return err
 		}
 
 		// 2. gss accept context
 		complete, token, err := gssapi.AcceptContext(msg.token)
 		if err != nil {
-			// refuse the client's connection for any reason (GSS-API
-			// authentication failure or otherwise)
-			refuseMsg := []uint8{1, 0xff}
-			_, _ = conn.Write(refuseMsg) // nolint
+			// If the server refuses the client's connection for any reason (GSS-API
+			// authentication failure or otherwise), it will return the message of type X'FF'.
+			reject(conn, gssapiAbort{}, a.rejectDelay)
 
 			return fmt.Errorf("accept client context: %w", err)
 		}
 
-		// 3. reply
-		msg.token = token
-		if _, err := msg.WriteTo(conn); err != nil {
+		// 3. reply (don't reuse msg: its token buffer is reused on read)
+		reply := gssapiMessage{
+			version:     subnVersion,
+			messageType: gssAuthentication,
+			token:       token,
+		}
+		if err := send(conn, &reply); err != nil {
 			return fmt.Errorf("sock write: %w", err)
 		}
 
@@ -154,7 +254,7 @@ func (a gssapiAuth) authenticate(gssapi GSSAPI, conn io.ReadWriteCloser) error {
 		// If no token is returned, a zero length token should be sent by the
 		// server to signal to the client that it is ready to receive the
 		// client's request.
-		if complete || len(msg.token) == 0 {
+		if complete || len(token) == 0 {
 			break
 		}
 	}
@@ -166,22 +266,22 @@ func (a gssapiAuth) applyProtection(gssapi GSSAPI, conn io.ReadWriteCloser) erro
 	var msg gssapiMessage
 
 	// 1. receive client request
-	if _, err := msg.ReadFrom(conn); err != nil {
-		return fmt.Errorf("sock read: %w", err)
-	}
-
-	if err := msg.validate(gssProtection); err != nil {
+	if err := a.read(conn, &msg, gssProtection); err != nil {
 		return err
 	}
 
-	// 2. get payload
-	data, err := gssapi.Decode(msg.token)
-	if err != nil {
-		return err
+	// 2. get payload: NEC clients send the bare octet instead of gss_wrap() token, no real
+	// mechanism produces a single octet token
+	data, nec := msg.token, a.nec && len(msg.token) == 1
+	if !nec {
+		var err error
+		if data, err = gssapi.Decode(msg.token); err != nil {
+			return err
+		}
 	}
 
 	if len(data) != 1 {
-		return fmt.Errorf("client send invalid protection level")
+		return fmt.Errorf("%w: client send invalid protection level", errMalformed)
 	}
 
 	// 3. adjust protection lvl and takes security
@@ -191,15 +291,17 @@ func (a gssapiAuth) applyProtection(gssapi GSSAPI, conn io.ReadWriteCloser) erro
 		return err
 	}
 
-	// 4. encode result
-	token, err := gssapi.Encode([]byte{lvl})
-	if err != nil {
-		return err
+	// 4. encode result, NEC clients get the bare octet in kind
+	token := []byte{lvl}
+	if !nec {
+		if token, err = gssapi.Encode(token); err != nil {
+			return err
+		}
 	}
 
 	// 5. reply
 	msg.token = token
-	if _, err := msg.WriteTo(conn); err != nil {
+	if err := send(conn, &msg); err != nil {
 		return fmt.Errorf("sock write: %w", err)
 	}
 
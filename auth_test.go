@@ -2,12 +2,15 @@ package proxyme
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"net"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 )
 
 func Test_noAuth_method(t *testing.T) {
@@ -53,7 +56,7 @@ func Test_noAuth_auth(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			a := noAuth{}
-			got, err := a.auth(tt.args.conn)
+			got, _, err := a.auth(context.Background(), tt.args.conn)
 			if (err != nil) != tt.wantErr {
 				t.Errorf("auth() error = %v, wantErr %v", err, tt.wantErr)
 				return
@@ -67,7 +70,7 @@ func Test_noAuth_auth(t *testing.T) {
 
 func Test_usernameAuth_method(t *testing.T) {
 	type fields struct {
-		authenticator func(user, pass []byte) error
+		authenticator func(_ context.Context, user, pass []byte) error
 	}
 	tests := []struct {
 		name   string
@@ -103,7 +106,7 @@ func Test_usernameAuth_auth(t *testing.T) {
 	deniedReply := bytes.NewBuffer([]byte{0x01, 0xFF})
 
 	type fields struct {
-		authenticator func(user, pass []byte) error
+		authenticator func(_ context.Context, user, pass []byte) error
 	}
 	type args struct {
 		conn io.ReadWriteCloser
@@ -117,7 +120,7 @@ func Test_usernameAuth_auth(t *testing.T) {
 		{
 			name: "common valid",
 			fields: fields{
-				authenticator: func(user, pass []byte) error {
+				authenticator: func(_ context.Context, user, pass []byte) error {
 					// any is valid
 					return nil
 				},
@@ -151,7 +154,7 @@ func Test_usernameAuth_auth(t *testing.T) {
 		{
 			name: "read: network error",
 			fields: fields{
-				authenticator: func(user, pass []byte) error {
+				authenticator: func(_ context.Context, user, pass []byte) error {
 					// any is valid
 					return nil
 				},
@@ -179,7 +182,7 @@ func Test_usernameAuth_auth(t *testing.T) {
 		{
 			name: "write: network error",
 			fields: fields{
-				authenticator: func(user, pass []byte) error {
+				authenticator: func(_ context.Context, user, pass []byte) error {
 					// any is valid
 					return nil
 				},
@@ -207,7 +210,7 @@ func Test_usernameAuth_auth(t *testing.T) {
 		{
 			name: "invalid payload",
 			fields: fields{
-				authenticator: func(user, pass []byte) error {
+				authenticator: func(_ context.Context, user, pass []byte) error {
 					// any is valid
 					return nil
 				},
@@ -235,7 +238,7 @@ func Test_usernameAuth_auth(t *testing.T) {
 		{
 			name: "auth failed",
 			fields: fields{
-				authenticator: func(user, pass []byte) error {
+				authenticator: func(_ context.Context, user, pass []byte) error {
 					return errors.New("invalid login/pass")
 				},
 			},
@@ -272,7 +275,7 @@ func Test_usernameAuth_auth(t *testing.T) {
 			a := usernameAuth{
 				authenticator: tt.fields.authenticator,
 			}
-			got, err := a.auth(tt.args.conn)
+			got, _, err := a.auth(context.Background(), tt.args.conn)
 			if err := tt.check(tt.args.conn, got, err); err != nil {
 				t.Errorf("auth() error = %v", err)
 				return
@@ -281,9 +284,60 @@ func Test_usernameAuth_auth(t *testing.T) {
 	}
 }
 
+func TestEqualCredentials(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b []byte
+		want bool
+	}{
+		{name: "equal", a: []byte("secret"), b: []byte("secret"), want: true},
+		{name: "different", a: []byte("secret"), b: []byte("secreT"), want: false},
+		{name: "different length", a: []byte("secret"), b: []byte("secret1"), want: false},
+		{name: "empty", a: nil, b: []byte{}, want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := EqualCredentials(tt.a, tt.b); got != tt.want {
+				t.Errorf("EqualCredentials() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStaticCredentials(t *testing.T) {
+	users := map[string]string{
+		"user":  "pass",
+		"empty": "",
+	}
+	authenticate := StaticCredentials(users)
+	users["user"] = "changed" // must not affect authenticator
+
+	tests := []struct {
+		name     string
+		username string
+		password string
+		wantErr  error
+	}{
+		{name: "valid", username: "user", password: "pass", wantErr: nil},
+		{name: "wrong password", username: "user", password: "changed", wantErr: ErrInvalidCredentials},
+		{name: "unknown user", username: "nobody", password: "pass", wantErr: ErrInvalidCredentials},
+		{name: "unknown user with empty password", username: "nobody", password: "", wantErr: ErrInvalidCredentials},
+		{name: "empty password", username: "empty", password: "", wantErr: nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := authenticate([]byte(tt.username), []byte(tt.password))
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("StaticCredentials() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
 func Test_gssapiAuth_method(t *testing.T) {
 	type fields struct {
-		gssapi func() (GSSAPI, error)
+		gssapi func(context.Context) (GSSAPI, error)
+		code   authMethod
 	}
 	tests := []struct {
 		name   string
@@ -295,11 +349,17 @@ func Test_gssapiAuth_method(t *testing.T) {
 			fields: fields{},
 			want:   1, // rfc1928 gssapi method
 		},
+		{
+			name:   "nec private method",
+			fields: fields{code: necGSSAPIMethod},
+			want:   0x86,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			a := gssapiAuth{
 				gssapi: tt.fields.gssapi,
+				code:   tt.fields.code,
 			}
 			if got := a.method(); got != tt.want {
 				t.Errorf("method() = %v, want %v", got, tt.want)
@@ -307,3 +367,238 @@ func Test_gssapiAuth_method(t *testing.T) {
 		})
 	}
 }
+
+func Test_gssapiAuth_auth(t *testing.T) {
+	authMsg := func(token []byte) []byte {
+		var buf bytes.Buffer
+		msg := gssapiMessage{version: subnVersion, messageType: gssAuthentication, token: token}
+		_, _ = msg.WriteTo(&buf)
+		return buf.Bytes()
+	}
+	protectionMsg := func(lvl byte) []byte {
+		var buf bytes.Buffer
+		msg := gssapiMessage{version: subnVersion, messageType: gssProtection, token: xor([]byte{lvl})}
+		_, _ = msg.WriteTo(&buf)
+		return buf.Bytes()
+	}
+
+	tests := []struct {
+		name         string
+		input        []byte
+		maxTokenSize int
+		check        func(out []byte, conn io.ReadWriteCloser, err error) error
+	}{
+		{
+			name:  "common flow",
+			input: append(authMsg([]byte("token")), protectionMsg(1)...),
+			check: func(out []byte, conn io.ReadWriteCloser, err error) error {
+				if err != nil {
+					return fmt.Errorf("unexpected error: %w", err)
+				}
+				if _, ok := unwrap(conn).(*gssConn); !ok {
+					return fmt.Errorf("got %T, want encapsulated conn", conn)
+				}
+				return nil
+			},
+		},
+		{
+			name:         "token within limit",
+			input:        append(authMsg([]byte("token")), protectionMsg(1)...),
+			maxTokenSize: 5,
+			check: func(out []byte, conn io.ReadWriteCloser, err error) error {
+				if err != nil {
+					return fmt.Errorf("unexpected error: %w", err)
+				}
+				return nil
+			},
+		},
+		{
+			name:         "oversized token refused",
+			input:        authMsg([]byte("token")),
+			maxTokenSize: 4,
+			check: func(out []byte, conn io.ReadWriteCloser, err error) error {
+				if !errors.Is(err, errInvalidTokenSize) {
+					return fmt.Errorf("got error %v, want %v", err, errInvalidTokenSize)
+				}
+				if !bytes.Equal(out, []byte{subnVersion, gssAbort}) {
+					return fmt.Errorf("got reply %v, want abort message", out)
+				}
+				return nil
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			raw := &bufferConn{r: bytes.NewReader(tt.input)}
+			a := gssapiAuth{
+				gssapi: func(context.Context) (GSSAPI, error) {
+					return xorGSSAPI{}, nil
+				},
+				maxTokenSize: tt.maxTokenSize,
+			}
+			conn, _, err := a.auth(context.Background(), raw)
+			if err := tt.check(raw.w.Bytes(), conn, err); err != nil {
+				t.Errorf("auth() error = %v", err)
+			}
+		})
+	}
+}
+
+// wrapGSSAPI is fake GSSAPI wrapping tokens into a header as real mechanisms do.
+type wrapGSSAPI struct{}
+
+func (wrapGSSAPI) AcceptContext(token []byte) (bool, []byte, error) {
+	return true, nil, nil
+}
+
+func (wrapGSSAPI) AcceptProtectionLevel(lvl byte) (byte, error) {
+	return lvl, nil
+}
+
+func (wrapGSSAPI) Encode(data []byte) ([]byte, error) {
+	return append([]byte("wrap"), data...), nil
+}
+
+func (wrapGSSAPI) Decode(token []byte) ([]byte, error) {
+	data, ok := bytes.CutPrefix(token, []byte("wrap"))
+	if !ok {
+		return nil, errors.New("invalid token")
+	}
+	return data, nil
+}
+
+func TestSOCKS5_Handle_gssapiNEC(t *testing.T) {
+	const (
+		greetingNEC = "\x05\x01\x86"
+		greetingRFC = "\x05\x01\x01"
+		authToken   = "\x01\x01\x00\x05token"
+		authReply   = "\x01\x01\x00\x00"
+		bareLevel   = "\x01\x02\x00\x01\x02"
+		wrapLevel   = "\x01\x02\x00\x05wrap\x02"
+	)
+
+	// captured negotiations up to the request, which is never sent
+	tests := []struct {
+		name   string
+		nec    bool
+		client string
+		want   string
+	}{
+		{
+			name:   "nec client of private method",
+			nec:    true,
+			client: greetingNEC + authToken + bareLevel,
+			want:   "\x05\x86" + authReply + bareLevel,
+		},
+		{
+			name:   "nec client of gssapi method",
+			nec:    true,
+			client: greetingRFC + authToken + bareLevel,
+			want:   "\x05\x01" + authReply + bareLevel,
+		},
+		{
+			name:   "rfc client served as usual",
+			nec:    true,
+			client: greetingRFC + authToken + wrapLevel,
+			want:   "\x05\x01" + authReply + wrapLevel,
+		},
+		{
+			name:   "nec client refused by default",
+			client: greetingRFC + authToken + bareLevel,
+			want:   "\x05\x01" + authReply,
+		},
+		{
+			name:   "private method unknown by default",
+			client: greetingNEC,
+			want:   "\x05\xff",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			socks5, err := New(Options{
+				GSSAPI:    func() (GSSAPI, error) { return wrapGSSAPI{}, nil },
+				GSSAPINEC: tt.nec,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			conn := &bufferConn{r: strings.NewReader(tt.client)}
+			socks5.Handle(conn, nil)
+
+			if got := conn.w.String(); got != tt.want {
+				t.Errorf("got % x, want % x", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_failureDelay(t *testing.T) {
+	if got := failureDelay(0); got != 0 {
+		t.Fatalf("failureDelay(0) = %v, want 0", got)
+	}
+
+	const limit = 10 * time.Millisecond
+	seen := make(map[time.Duration]bool)
+	for i := 0; i < 100; i++ {
+		got := failureDelay(limit)
+		if got < 0 || got > limit {
+			t.Fatalf("failureDelay() = %v, want in [0, %v]", got, limit)
+		}
+		seen[got] = true
+	}
+
+	if len(seen) < 2 {
+		t.Fatalf("failureDelay() has no jitter: %v", seen)
+	}
+}
+
+func Test_usernameAuth_rejectDelay(t *testing.T) {
+	request := []byte{subnVersion, 1, 'u', 1, 'p'}
+
+	tests := []struct {
+		name        string
+		input       []byte
+		delay       time.Duration
+		wantReply   bool
+		wantElapsed time.Duration // upper bound of the auth time
+	}{
+		{name: "rejected credentials", input: request, delay: 50 * time.Millisecond, wantReply: true, wantElapsed: time.Second},
+		{name: "malformed request", input: []byte{subnVersion + 1, 1, 'u', 1, 'p'}, delay: 10 * time.Second, wantElapsed: time.Second},
+		{name: "client disconnect", input: request[:2], delay: 10 * time.Second, wantElapsed: time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			in := bytes.NewReader(tt.input)
+			var written time.Time
+			conn := fakeRWCloser{
+				fnRead: in.Read,
+				fnWrite: func(p []byte) (int, error) {
+					written = time.Now()
+					return len(p), nil
+				},
+			}
+			a := usernameAuth{
+				authenticator: func(context.Context, []byte, []byte) error { return ErrInvalidCredentials },
+				rejectDelay:   tt.delay,
+			}
+
+			start := time.Now()
+			if _, _, err := a.auth(context.Background(), conn); err == nil {
+				t.Fatal("auth() succeeded")
+			}
+			done := time.Now()
+
+			if elapsed := done.Sub(start); elapsed > tt.wantElapsed {
+				t.Errorf("auth() took %v, want up to %v", elapsed, tt.wantElapsed)
+			}
+			if written.IsZero() == tt.wantReply {
+				t.Fatalf("reply written %v, want %v", !written.IsZero(), tt.wantReply)
+			}
+			// the jitter goes before the reply, nothing is held after it
+			if tt.wantReply && done.Sub(written) > 10*time.Millisecond {
+				t.Errorf("auth() returned %v after the reply", done.Sub(written))
+			}
+		})
+	}
+}
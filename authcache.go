@@ -0,0 +1,83 @@
+package proxyme
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"github.com/dblokhin/proxyme/lru"
+)
+
+// defaultAuthCacheSize is the default number of client IPs remembered by the auth cache.
+const defaultAuthCacheSize = 4096
+
+// authCache remembers client IPs which have recently logged in.
+type authCache struct {
+	users *lru.Cache[string, string] // client ip -> username
+}
+
+func newAuthCache(ttl time.Duration, size int) *authCache {
+	if ttl <= 0 {
+		return nil
+	}
+	if size <= 0 {
+		size = defaultAuthCacheSize
+	}
+
+	return &authCache{users: lru.New(lru.Options[string, string]{Size: size, TTL: ttl})}
+}
+
+// lookup returns username of the recent login from the client IP.
+func (c *authCache) lookup(ip string) (string, bool) {
+	return c.users.Get(ip)
+}
+
+// remember remembers successful login from the client IP, cached sessions don't prolong it.
+func (c *authCache) remember(ip, username string) {
+	c.users.Set(ip, username)
+}
+
+// cachedAuth is 'NO AUTHENTICATION REQUIRED' method of the client of known identity: it has recently
+// logged in or has been authenticated by the embedder (see SOCKS5.HandleAuthenticated).
+type cachedAuth struct {
+	username string
+}
+
+func (a cachedAuth) method() authMethod {
+	return typeNoAuth
+}
+
+func (a cachedAuth) auth(_ context.Context, conn io.ReadWriteCloser) (io.ReadWriteCloser, string, error) {
+	return conn, a.username, nil
+}
+
+// cachedMethod returns auth method skipping authentication of the client which has recently logged in
+// and offers 'NO AUTHENTICATION REQUIRED' method.
+func (s *state) cachedMethod() (authHandler, bool) {
+	ip := addrIP(s.clientAddr)
+	if s.opts.authCache == nil || ip == nil {
+		return nil, false
+	}
+
+	for _, code := range s.methods {
+		if code != typeNoAuth {
+			continue
+		}
+
+		if username, ok := s.opts.authCache.lookup(ip.String()); ok {
+			return cachedAuth{username: username}, true
+		}
+	}
+
+	return nil, false
+}
+
+// rememberLogin puts successful username/password login of the client to the cache.
+func (s *state) rememberLogin() {
+	ip := addrIP(s.clientAddr)
+	if s.opts.authCache == nil || ip == nil || s.method.method() != typeLogin {
+		return
+	}
+
+	s.opts.authCache.remember(ip.String(), s.username)
+}
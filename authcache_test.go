@@ -0,0 +1,79 @@
+package proxyme
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func Test_state_cachedMethod(t *testing.T) {
+	client := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 5555}
+
+	tests := []struct {
+		name     string
+		ttl      time.Duration
+		login    string // ip of the login
+		methods  []authMethod
+		wantUser string
+		wantOk   bool
+	}{
+		{
+			name:     "recent login",
+			ttl:      time.Minute,
+			login:    "10.0.0.1",
+			methods:  []authMethod{typeLogin, typeNoAuth},
+			wantUser: "alice",
+			wantOk:   true,
+		},
+		{
+			name:    "noauth isn't offered",
+			ttl:     time.Minute,
+			login:   "10.0.0.1",
+			methods: []authMethod{typeLogin},
+		},
+		{
+			name:    "other ip",
+			ttl:     time.Minute,
+			login:   "10.0.0.2",
+			methods: []authMethod{typeNoAuth},
+		},
+		{
+			name:    "expired",
+			ttl:     time.Nanosecond,
+			login:   "10.0.0.1",
+			methods: []authMethod{typeNoAuth},
+		},
+		{
+			name:    "disabled",
+			methods: []authMethod{typeNoAuth},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cache := newAuthCache(tt.ttl, 0)
+			if cache != nil {
+				cache.remember(tt.login, "alice")
+				time.Sleep(time.Millisecond)
+			}
+
+			s := &state{
+				opts:       SOCKS5{authCache: cache},
+				clientAddr: client,
+				methods:    tt.methods,
+			}
+
+			method, ok := s.cachedMethod()
+			if ok != tt.wantOk {
+				t.Fatalf("cachedMethod() ok = %v, want %v", ok, tt.wantOk)
+			}
+			if !ok {
+				return
+			}
+
+			_, username, err := method.auth(nil, nil) // nolint
+			if err != nil || username != tt.wantUser || method.method() != typeNoAuth {
+				t.Errorf("got method %d of %q, %v, want noauth of %q", method.method(), username, err, tt.wantUser)
+			}
+		})
+	}
+}
@@ -0,0 +1,127 @@
+package proxyme
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync/atomic"
+	"syscall"
+)
+
+// Authenticate callbacks return (or wrap) these errors to tell the reason of the failure for
+// security monitoring (see AuthError), all of them wrap ErrInvalidCredentials. The client gets
+// the same failure reply whatever the reason is.
+var (
+	ErrUnknownUser = fmt.Errorf("%w: unknown user", ErrInvalidCredentials)
+	ErrBadPassword = fmt.Errorf("%w: bad password", ErrInvalidCredentials)
+	ErrLockedOut   = fmt.Errorf("%w: locked out", ErrInvalidCredentials)
+)
+
+// errMalformed marks client messages violating the authentication subnegotiation.
+var errMalformed = errors.New("malformed subnegotiation")
+
+// AuthReason is the reason code of the authentication failure, it's stable for log parsing.
+type AuthReason string
+
+const (
+	AuthUnknownUser        AuthReason = "unknown_user"        // ErrUnknownUser
+	AuthBadPassword        AuthReason = "bad_password"        // ErrBadPassword
+	AuthLockedOut          AuthReason = "locked_out"          // ErrLockedOut
+	AuthInvalidCredentials AuthReason = "invalid_credentials" // other ErrInvalidCredentials
+	AuthMalformed          AuthReason = "malformed"           // broken subnegotiation messages
+	AuthUnsupportedMethod  AuthReason = "unsupported_method"  // none of client methods is acceptable
+	AuthAborted            AuthReason = "aborted"             // the client has gone or timed out
+	AuthFailed             AuthReason = "failed"              // other errors (backend outages, GSSAPI)
+)
+
+// authReasons are all the reasons, see SOCKS5.AuthFailures.
+var authReasons = []AuthReason{
+	AuthUnknownUser, AuthBadPassword, AuthLockedOut, AuthInvalidCredentials,
+	AuthMalformed, AuthUnsupportedMethod, AuthAborted, AuthFailed,
+}
+
+// AuthError is the authentication failure reported to onError of Handle.
+type AuthError struct {
+	// Reason is the reason code of the failure.
+	Reason AuthReason
+
+	// Method is the authentication method (RFC 1928 METHOD), X'FF' if none is acceptable.
+	Method int
+
+	// Err is the failure.
+	Err error
+}
+
+func (e *AuthError) Error() string {
+	return fmt.Sprintf("authenticate: %s: %v", e.Reason, e.Err)
+}
+
+func (e *AuthError) Unwrap() error {
+	return e.Err
+}
+
+// newAuthError returns AuthError of the method failure.
+func newAuthError(method authMethod, err error) *AuthError {
+	return &AuthError{Reason: authReason(err), Method: int(method), Err: err}
+}
+
+// authReason returns reason code of the authentication error.
+func authReason(err error) AuthReason {
+	var netErr net.Error
+
+	switch {
+	case errors.Is(err, ErrUnknownUser):
+		return AuthUnknownUser
+	case errors.Is(err, ErrBadPassword):
+		return AuthBadPassword
+	case errors.Is(err, ErrLockedOut):
+		return AuthLockedOut
+	case errors.Is(err, ErrInvalidCredentials):
+		return AuthInvalidCredentials
+	case errors.Is(err, errMalformed), errors.Is(err, errNegotiationTooLarge):
+		return AuthMalformed
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, context.Canceled):
+		// the callback hasn't made it in time
+		return AuthFailed
+	case errors.Is(err, io.EOF),
+		errors.Is(err, io.ErrUnexpectedEOF),
+		errors.Is(err, os.ErrDeadlineExceeded),
+		errors.Is(err, net.ErrClosed),
+		errors.Is(err, syscall.ECONNRESET),
+		errors.As(err, &netErr):
+		return AuthAborted
+	}
+
+	return AuthFailed
+}
+
+// authFailureCounts counts authentication failures by reason, the map is read-only.
+type authFailureCounts map[AuthReason]*atomic.Int64
+
+func newAuthFailureCounts() authFailureCounts {
+	c := make(authFailureCounts, len(authReasons))
+	for _, reason := range authReasons {
+		c[reason] = &atomic.Int64{}
+	}
+
+	return c
+}
+
+func (c authFailureCounts) add(reason AuthReason) {
+	if n, ok := c[reason]; ok {
+		n.Add(1)
+	}
+}
+
+// AuthFailures returns numbers of authentication failures by reason.
+func (s SOCKS5) AuthFailures() map[AuthReason]int64 {
+	res := make(map[AuthReason]int64, len(s.authFailures))
+	for reason, n := range s.authFailures {
+		res[reason] = n.Load()
+	}
+
+	return res
+}
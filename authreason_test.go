@@ -0,0 +1,36 @@
+package proxyme
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"testing"
+)
+
+func Test_authReason(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want AuthReason
+	}{
+		{name: "unknown user", err: ErrUnknownUser, want: AuthUnknownUser},
+		{name: "wrapped bad password", err: fmt.Errorf("ldap: %w", ErrBadPassword), want: AuthBadPassword},
+		{name: "locked out", err: ErrLockedOut, want: AuthLockedOut},
+		{name: "invalid credentials", err: ErrInvalidCredentials, want: AuthInvalidCredentials},
+		{name: "malformed", err: fmt.Errorf("%w: invalid subnegotion version: 5", errMalformed), want: AuthMalformed},
+		{name: "negotiation too large", err: errNegotiationTooLarge, want: AuthMalformed},
+		{name: "client gone", err: fmt.Errorf("sock read: %w", io.ErrUnexpectedEOF), want: AuthAborted},
+		{name: "client timeout", err: fmt.Errorf("sock read: %w", os.ErrDeadlineExceeded), want: AuthAborted},
+		{name: "callback timeout", err: context.DeadlineExceeded, want: AuthFailed},
+		{name: "backend outage", err: errors.New("ldap: connection refused"), want: AuthFailed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := authReason(tt.err); got != tt.want {
+				t.Errorf("authReason() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,363 @@
+package proxyme
+
+import (
+	"errors"
+	"io"
+	"math"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// bandwidthTick is the period of sharing the bandwidth between waiting sessions.
+	bandwidthTick = 10 * time.Millisecond
+	// bandwidthBurst is the time of traffic token buckets hold at their rate.
+	bandwidthBurst = 100 * time.Millisecond
+)
+
+// errNoHalfClose is returned by CloseWrite of connections not supporting half-close.
+var errNoHalfClose = errors.New("half-close isn't supported")
+
+// Bandwidth is the bandwidth policy of the user (see Options.UserBandwidth).
+type Bandwidth struct {
+	// Weight is the share of the user relative to other users when Options.BandwidthLimit is
+	// saturated, 0 means 1.
+	Weight int
+
+	// Limit is the max bytes per second of all sessions of the user, 0 means unlimited.
+	Limit int64
+}
+
+// bucket is a token bucket of rate bytes per second holding up to bandwidthBurst of traffic,
+// zero rate means unlimited.
+type bucket struct {
+	rate   float64
+	tokens float64
+	last   time.Time // the last refill
+}
+
+func newBucket(rate int64, now time.Time) bucket {
+	b := bucket{rate: float64(rate), last: now}
+	b.tokens = b.size()
+
+	return b
+}
+
+func (b *bucket) size() float64 {
+	return b.rate * bandwidthBurst.Seconds()
+}
+
+// avail refills the bucket and returns available tokens, +Inf if unlimited.
+func (b *bucket) avail(now time.Time) float64 {
+	if b.rate == 0 {
+		return math.Inf(1)
+	}
+
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens = min(b.tokens+b.rate*elapsed.Seconds(), b.size())
+		b.last = now
+	}
+
+	return b.tokens
+}
+
+func (b *bucket) take(n float64) {
+	if b.rate != 0 {
+		b.tokens -= n
+	}
+}
+
+// scheduler shares relay bandwidth through the hierarchy of token buckets: global, user and
+// session ones. Sessions take tokens at once only while nobody waits, otherwise the available
+// bandwidth is shared every tick between waiting users by weight and then equally between
+// sessions of the user, so heavy sessions don't starve the others.
+type scheduler struct {
+	policy      func(username string) Bandwidth
+	sessionRate int64
+
+	mu      sync.Mutex
+	global  bucket
+	users   map[string]*bandwidthUser
+	waiting int  // writers waiting for tokens
+	running bool // tokens are shared by the ticking goroutine
+}
+
+// bandwidthUser is bandwidth of all sessions of the user.
+type bandwidthUser struct {
+	name     string
+	weight   float64
+	bucket   bucket
+	sessions map[*throttle]struct{}
+}
+
+// newScheduler returns the relay bandwidth scheduler, nil if bandwidth isn't limited.
+func newScheduler(opts Options) *scheduler {
+	if opts.BandwidthLimit == 0 && opts.SessionBandwidthLimit == 0 && opts.UserBandwidth == nil {
+		return nil
+	}
+
+	return &scheduler{
+		policy:      opts.UserBandwidth,
+		sessionRate: opts.SessionBandwidthLimit,
+		global:      newBucket(opts.BandwidthLimit, time.Now()),
+		users:       make(map[string]*bandwidthUser),
+	}
+}
+
+// open returns the throttle of the session of the user, close it once the session is over.
+func (s *scheduler) open(username string) *throttle {
+	var policy Bandwidth
+	if s.policy != nil {
+		policy = s.policy(username)
+	}
+
+	now := time.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, ok := s.users[username]
+	if !ok {
+		user = &bandwidthUser{
+			name:     username,
+			weight:   float64(max(policy.Weight, 1)),
+			bucket:   newBucket(max(policy.Limit, 0), now),
+			sessions: make(map[*throttle]struct{}),
+		}
+		s.users[username] = user
+	}
+
+	t := &throttle{sched: s, user: user, bucket: newBucket(s.sessionRate, now)}
+	t.cond.L = &s.mu
+	user.sessions[t] = struct{}{}
+
+	return t
+}
+
+// start runs the ticking goroutine sharing tokens unless it's running, the lock must be held.
+func (s *scheduler) start() {
+	if s.running {
+		return
+	}
+	s.running = true
+
+	go func() {
+		ticker := time.NewTicker(bandwidthTick)
+		defer ticker.Stop()
+
+		for now := range ticker.C {
+			s.mu.Lock()
+			if s.waiting == 0 {
+				s.running = false
+				s.mu.Unlock()
+				return
+			}
+			s.share(now)
+			s.mu.Unlock()
+		}
+	}()
+}
+
+// share grants available tokens to waiting sessions: users get shares by weight, sessions of
+// the user get equal shares, nobody gets more than it waits for or its buckets allow. The lock
+// must be held.
+func (s *scheduler) share(now time.Time) {
+	var (
+		users   []*bandwidthUser
+		needs   []float64
+		weights []float64
+	)
+	for _, user := range s.users {
+		var need float64
+		for t := range user.sessions {
+			need += t.need(now)
+		}
+		if need = min(need, user.bucket.avail(now)); need > 0 {
+			users, needs, weights = append(users, user), append(needs, need), append(weights, user.weight)
+		}
+	}
+
+	grants := fill(s.global.avail(now), needs, weights)
+	for i, user := range users {
+		var (
+			sessions []*throttle
+			needs    []float64
+			weights  []float64
+		)
+		for t := range user.sessions {
+			if need := t.need(now); need > 0 {
+				sessions, needs, weights = append(sessions, t), append(needs, need), append(weights, 1)
+			}
+		}
+
+		for j, g := range fill(grants[i], needs, weights) {
+			t := sessions[j]
+			t.grant(g)
+			user.bucket.take(g)
+			s.global.take(g)
+		}
+	}
+}
+
+// fill shares the total between claims by weight (water-filling): claims get shares proportional
+// to their weights up to their needs, the rest is shared between unsatisfied claims.
+func fill(total float64, needs, weights []float64) []float64 {
+	grants := make([]float64, len(needs))
+
+	for total > 0 {
+		var sum float64
+		for i := range needs {
+			if grants[i] < needs[i] {
+				sum += weights[i]
+			}
+		}
+		if sum == 0 {
+			break
+		}
+
+		var spent float64
+		for i := range needs {
+			if grants[i] < needs[i] {
+				g := min(total*weights[i]/sum, needs[i]-grants[i])
+				grants[i] += g
+				spent += g
+			}
+		}
+		if spent == 0 {
+			break
+		}
+		total -= spent
+	}
+
+	return grants
+}
+
+// throttle is the bandwidth of the session shared by both directions of the relay.
+type throttle struct {
+	sched  *scheduler
+	user   *bandwidthUser
+	bucket bucket    // limit of the session
+	cond   sync.Cond // signals granted tokens and closing, L is the scheduler lock
+
+	tokens float64 // granted bytes not written yet
+	demand float64 // bytes waiting writers want to write
+	closed bool
+}
+
+// need returns bytes the session is waiting for within its limit, the lock must be held.
+func (t *throttle) need(now time.Time) float64 {
+	if t.demand <= t.tokens {
+		return 0
+	}
+
+	return min(t.demand-t.tokens, t.bucket.avail(now))
+}
+
+// grant adds tokens to the session, the lock must be held.
+func (t *throttle) grant(n float64) {
+	t.tokens += n
+	t.bucket.take(n)
+	if t.tokens >= 1 {
+		t.cond.Broadcast()
+	}
+}
+
+// take waits until the session may write and returns the number of bytes up to n it may write
+// now. Waiting is interrupted by closing the throttle.
+func (t *throttle) take(n int) (int, error) {
+	s := t.sched
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// nobody waits, so the bandwidth isn't contended
+	if s.waiting == 0 && t.tokens < 1 && !t.closed {
+		now := time.Now()
+		avail := min(float64(n), s.global.avail(now), t.user.bucket.avail(now), t.bucket.avail(now))
+		if avail >= 1 {
+			avail = math.Floor(avail)
+			t.grant(avail)
+			t.user.bucket.take(avail)
+			s.global.take(avail)
+		}
+	}
+
+	for t.tokens < 1 && !t.closed {
+		want := float64(n)
+		t.demand += want
+		s.waiting++
+		s.start()
+
+		t.cond.Wait()
+
+		s.waiting--
+		t.demand -= want
+	}
+	if t.closed {
+		return 0, net.ErrClosed
+	}
+
+	k := min(n, int(t.tokens))
+	t.tokens -= float64(k)
+
+	return k, nil
+}
+
+// close releases the session and interrupts waiting writers.
+func (t *throttle) close() {
+	s := t.sched
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if t.closed {
+		return
+	}
+	t.closed = true
+	t.cond.Broadcast()
+
+	delete(t.user.sessions, t)
+	if len(t.user.sessions) == 0 && s.users[t.user.name] == t.user {
+		delete(s.users, t.user.name)
+	}
+}
+
+// throttledConn is a connection side writing within the bandwidth of the session.
+type throttledConn struct {
+	io.ReadWriteCloser
+	throttle *throttle
+}
+
+func (c throttledConn) Write(p []byte) (int, error) {
+	var written int
+	for len(p) > 0 {
+		n, err := c.throttle.take(len(p))
+		if err != nil {
+			return written, err
+		}
+
+		n, err = c.ReadWriteCloser.Write(p[:n])
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+
+	return written, nil
+}
+
+func (c throttledConn) Close() error {
+	c.throttle.close()
+	return c.ReadWriteCloser.Close()
+}
+
+// CloseWrite propagates half-close to connections supporting it.
+func (c throttledConn) CloseWrite() error {
+	if cw, ok := c.ReadWriteCloser.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+
+	return errNoHalfClose
+}
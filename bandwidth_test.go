@@ -0,0 +1,157 @@
+package proxyme
+
+import (
+	"errors"
+	"math"
+	"net"
+	"testing"
+	"time"
+)
+
+func Test_fill(t *testing.T) {
+	tests := []struct {
+		name    string
+		total   float64
+		needs   []float64
+		weights []float64
+		want    []float64
+	}{
+		{
+			name:    "shares by weight",
+			total:   100,
+			needs:   []float64{1000, 1000},
+			weights: []float64{3, 1},
+			want:    []float64{75, 25},
+		},
+		{
+			name:    "satisfied claims give way to others",
+			total:   100,
+			needs:   []float64{10, 1000, 1000},
+			weights: []float64{1, 1, 2},
+			want:    []float64{10, 30, 60},
+		},
+		{
+			name:    "total exceeds needs",
+			total:   100,
+			needs:   []float64{10, 20},
+			weights: []float64{1, 1},
+			want:    []float64{10, 20},
+		},
+		{
+			name:    "unlimited total",
+			total:   math.Inf(1),
+			needs:   []float64{10, 20},
+			weights: []float64{1, 5},
+			want:    []float64{10, 20},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := fill(tt.total, tt.needs, tt.weights)
+			for i := range got {
+				if math.Abs(got[i]-tt.want[i]) > 1e-6 {
+					t.Fatalf("fill() = %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func Test_scheduler_share(t *testing.T) {
+	weights := map[string]Bandwidth{
+		"heavy":   {Weight: 3},
+		"light":   {Weight: 1},
+		"limited": {Weight: 1, Limit: 10},
+	}
+
+	tests := []struct {
+		name     string
+		sessions []string // users of the waiting sessions
+		want     []float64
+	}{
+		{
+			name:     "users share by weight",
+			sessions: []string{"heavy", "light"},
+			want:     []float64{75, 25},
+		},
+		{
+			name:     "sessions of the user share equally",
+			sessions: []string{"heavy", "light", "light"},
+			want:     []float64{75, 12.5, 12.5},
+		},
+		{
+			name:     "user limit gives way to others",
+			sessions: []string{"limited", "light"},
+			want:     []float64{1, 99},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newScheduler(Options{
+				BandwidthLimit: 1000,
+				UserBandwidth:  func(username string) Bandwidth { return weights[username] },
+			})
+
+			var throttles []*throttle
+			for _, user := range tt.sessions {
+				th := s.open(user)
+				th.demand = 1000
+				throttles = append(throttles, th)
+			}
+
+			// buckets are full: 100ms of the rate
+			s.share(time.Now())
+
+			for i, th := range throttles {
+				if math.Abs(th.tokens-tt.want[i]) > 1e-6 {
+					t.Errorf("session %d of %s got %v tokens, want %v", i, tt.sessions[i], th.tokens, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func Test_throttle_take(t *testing.T) {
+	s := newScheduler(Options{SessionBandwidthLimit: 10000})
+	th := s.open("")
+
+	// the full bucket is taken at once
+	if n, err := th.take(5000); n != 1000 || err != nil {
+		t.Fatalf("take() = %d, %v, want 1000", n, err)
+	}
+
+	// the empty bucket is refilled over time
+	start := time.Now()
+	if n, err := th.take(500); n < 1 || err != nil {
+		t.Fatalf("take() = %d, %v", n, err)
+	}
+	if elapsed := time.Since(start); elapsed < bandwidthTick/2 {
+		t.Errorf("take() of the empty bucket returned in %v", elapsed)
+	}
+
+	// closing interrupts waiting
+	for {
+		if _, err := th.take(1 << 20); err != nil {
+			t.Fatalf("take() error = %v", err)
+		}
+		if th.tokens < 1 {
+			break
+		}
+	}
+	go func() {
+		time.Sleep(bandwidthTick)
+		th.close()
+	}()
+	for {
+		if _, err := th.take(1 << 20); err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				t.Fatalf("take() error = %v, want %v", err, net.ErrClosed)
+			}
+			break
+		}
+	}
+
+	if len(s.users) != 0 {
+		t.Errorf("got %d users after close, want 0", len(s.users))
+	}
+}
@@ -0,0 +1,217 @@
+//go:build linux && (amd64 || arm64)
+
+package proxyme
+
+import (
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"syscall"
+	"unsafe"
+)
+
+// batchSupported reports whether datagrams are read and written in batches (recvmmsg and sendmmsg).
+const batchSupported = true
+
+// mmsghdr is struct mmsghdr of recvmmsg(2) and sendmmsg(2).
+type mmsghdr struct {
+	hdr syscall.Msghdr
+	len uint32
+	_   [4]byte
+}
+
+// batchSys is scratch of recvmmsg and sendmmsg.
+type batchSys struct {
+	hdrs  []mmsghdr
+	iovs  []syscall.Iovec
+	names []syscall.RawSockaddrInet6 // fits both address families
+}
+
+func newBatchSys(size int) batchSys {
+	return batchSys{
+		hdrs:  make([]mmsghdr, size),
+		iovs:  make([]syscall.Iovec, size),
+		names: make([]syscall.RawSockaddrInet6, size),
+	}
+}
+
+// batchConn is udp socket reading and writing datagrams in batches.
+type batchConn struct {
+	*net.UDPConn
+	raw     syscall.RawConn
+	family  int // address family of the socket
+	batches *udpBatches
+}
+
+func newBatchConn(conn *net.UDPConn, batches *udpBatches) (*batchConn, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+
+	var family int
+	cerr := raw.Control(func(fd uintptr) {
+		family, err = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_DOMAIN)
+	})
+	if cerr != nil {
+		return nil, cerr
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &batchConn{UDPConn: conn, raw: raw, family: family, batches: batches}, nil
+}
+
+// read blocks until datagrams arrive and returns the batch of them, datagrams are read into
+// the buffers at off leaving room for headers. The batch is taken from the pool once datagrams
+// are ready, put it back when they are processed.
+func (c *batchConn) read(off int) (*udpBatch, error) {
+	var (
+		b     *udpBatch
+		n     int
+		errno syscall.Errno
+	)
+
+	err := c.raw.Read(func(fd uintptr) bool {
+		b = c.batches.get()
+		hdrs := b.sys.hdrs
+		for i := range hdrs {
+			b.sys.iovs[i].Base = &b.bufs[i][off]
+			b.sys.iovs[i].SetLen(len(b.bufs[i]) - off)
+			hdrs[i] = mmsghdr{hdr: syscall.Msghdr{
+				Name:    (*byte)(unsafe.Pointer(&b.sys.names[i])),
+				Namelen: syscall.SizeofSockaddrInet6,
+				Iov:     &b.sys.iovs[i],
+				Iovlen:  1,
+			}}
+		}
+
+		var r uintptr
+		for {
+			r, _, errno = syscall.Syscall6(sysRecvmmsg, fd, uintptr(unsafe.Pointer(&hdrs[0])), uintptr(len(hdrs)),
+				syscall.MSG_DONTWAIT, 0, 0)
+			if errno != syscall.EINTR {
+				break
+			}
+		}
+		if errno == syscall.EAGAIN {
+			// wait for datagrams without holding the buffers
+			c.batches.put(b)
+			b = nil
+			return false
+		}
+		n = int(r)
+
+		return true
+	})
+	if err == nil && errno != 0 {
+		err = errno
+	}
+	if err != nil {
+		if b != nil {
+			c.batches.put(b)
+		}
+		return nil, err
+	}
+
+	for i := range n {
+		b.msgs = append(b.msgs, udpMessage{
+			buf:  b.bufs[i][off : off+int(b.sys.hdrs[i].len)],
+			addr: sockaddrAddrPort(&b.sys.names[i]),
+		})
+	}
+
+	return b, nil
+}
+
+// write sends datagrams of the batch, up to the batch size. Datagrams which fail to be sent are dropped, the returned
+// error means the socket is unusable.
+func (c *batchConn) write(b *udpBatch) error {
+	hdrs := b.sys.hdrs[:0]
+	for _, m := range b.msgs {
+		if c.family == syscall.AF_INET && !m.addr.Addr().Unmap().Is4() {
+			continue // unreachable from IPv4 socket
+		}
+
+		i := len(hdrs)
+		hdrs = hdrs[:i+1]
+		namelen := c.putSockaddr(&b.sys.names[i], m.addr)
+		if len(m.buf) > 0 {
+			b.sys.iovs[i].Base = &m.buf[0]
+		}
+		b.sys.iovs[i].SetLen(len(m.buf))
+		hdrs[i] = mmsghdr{hdr: syscall.Msghdr{
+			Name:    (*byte)(unsafe.Pointer(&b.sys.names[i])),
+			Namelen: namelen,
+			Iov:     &b.sys.iovs[i],
+			Iovlen:  1,
+		}}
+	}
+
+	for first := 0; first < len(hdrs); {
+		var (
+			n     int
+			errno syscall.Errno
+		)
+		err := c.raw.Write(func(fd uintptr) bool {
+			var r uintptr
+			for {
+				r, _, errno = syscall.Syscall6(sysSendmmsg, fd, uintptr(unsafe.Pointer(&hdrs[first])),
+					uintptr(len(hdrs)-first), syscall.MSG_DONTWAIT, 0, 0)
+				if errno != syscall.EINTR {
+					break
+				}
+			}
+			if errno == syscall.EAGAIN {
+				return false
+			}
+			n = int(r)
+
+			return true
+		})
+		if err != nil {
+			return err
+		}
+
+		if errno != 0 {
+			// the first datagram has failed (e.g. unreachable destination), skip it
+			n = 1
+		}
+		first += n
+	}
+
+	return nil
+}
+
+// putSockaddr encodes the address as sockaddr of the socket family and returns its length.
+func (c *batchConn) putSockaddr(sa *syscall.RawSockaddrInet6, addr netip.AddrPort) uint32 {
+	ip := addr.Addr()
+	if c.family == syscall.AF_INET {
+		sa4 := (*syscall.RawSockaddrInet4)(unsafe.Pointer(sa))
+		*sa4 = syscall.RawSockaddrInet4{Family: syscall.AF_INET, Addr: ip.Unmap().As4()}
+		binary.BigEndian.PutUint16((*[2]byte)(unsafe.Pointer(&sa4.Port))[:], addr.Port())
+
+		return syscall.SizeofSockaddrInet4
+	}
+
+	*sa = syscall.RawSockaddrInet6{Family: syscall.AF_INET6, Addr: ip.As16()}
+	binary.BigEndian.PutUint16((*[2]byte)(unsafe.Pointer(&sa.Port))[:], addr.Port())
+
+	return syscall.SizeofSockaddrInet6
+}
+
+// sockaddrAddrPort decodes the address of sockaddr, IPv4-mapped addresses are unmapped.
+func sockaddrAddrPort(sa *syscall.RawSockaddrInet6) netip.AddrPort {
+	switch sa.Family {
+	case syscall.AF_INET:
+		sa4 := (*syscall.RawSockaddrInet4)(unsafe.Pointer(sa))
+		port := binary.BigEndian.Uint16((*[2]byte)(unsafe.Pointer(&sa4.Port))[:])
+		return netip.AddrPortFrom(netip.AddrFrom4(sa4.Addr), port)
+	case syscall.AF_INET6:
+		port := binary.BigEndian.Uint16((*[2]byte)(unsafe.Pointer(&sa.Port))[:])
+		return netip.AddrPortFrom(netip.AddrFrom16(sa.Addr).Unmap(), port)
+	default:
+		return netip.AddrPort{}
+	}
+}
@@ -0,0 +1,60 @@
+//go:build !linux || !(amd64 || arm64)
+
+package proxyme
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+)
+
+// batchSupported reports whether datagrams are read and written in batches, here they are
+// relayed one per syscall.
+const batchSupported = false
+
+// batchSys is scratch of batched syscalls, there are none.
+type batchSys struct{}
+
+func newBatchSys(int) batchSys {
+	return batchSys{}
+}
+
+// batchConn is udp socket reading and writing datagrams one by one.
+type batchConn struct {
+	*net.UDPConn
+	batches *udpBatches
+}
+
+func newBatchConn(conn *net.UDPConn, batches *udpBatches) (*batchConn, error) {
+	return &batchConn{UDPConn: conn, batches: batches}, nil
+}
+
+// read blocks until the datagram arrives and returns the batch of it, the datagram is read into
+// the buffer at off leaving room for the header. Put the batch back to the pool when it's processed.
+func (c *batchConn) read(off int) (*udpBatch, error) {
+	b := c.batches.get()
+
+	n, addr, err := c.ReadFromUDPAddrPort(b.bufs[0][off:])
+	if err != nil {
+		c.batches.put(b)
+		return nil, err
+	}
+	b.msgs = append(b.msgs, udpMessage{
+		buf:  b.bufs[0][off : off+n],
+		addr: netip.AddrPortFrom(addr.Addr().Unmap(), addr.Port()),
+	})
+
+	return b, nil
+}
+
+// write sends datagrams of the batch. Datagrams which fail to be sent are dropped, the returned
+// error means the socket is unusable.
+func (c *batchConn) write(b *udpBatch) error {
+	for _, m := range b.msgs {
+		if _, err := c.WriteToUDPAddrPort(m.buf, m.addr); errors.Is(err, net.ErrClosed) {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,356 @@
+package proxyme
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// startProxy runs SOCKS5 server over the loopback listener.
+func startProxy(tb testing.TB, opts Options) net.Addr {
+	tb.Helper()
+
+	socks5, err := New(opts)
+	if err != nil {
+		tb.Fatalf("new: %v", err)
+	}
+
+	ls, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatalf("listen: %v", err)
+	}
+	tb.Cleanup(func() { _ = ls.Close() })
+
+	go func() {
+		for {
+			conn, err := ls.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				socks5.Handle(conn, nil)
+				_ = conn.Close()
+			}()
+		}
+	}()
+
+	return ls.Addr()
+}
+
+// startSink runs tcp server discarding input and replying with a byte on each received chunk of size.
+func startSink(tb testing.TB, size int) net.Addr {
+	tb.Helper()
+
+	ls, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatalf("listen: %v", err)
+	}
+	tb.Cleanup(func() { _ = ls.Close() })
+
+	go func() {
+		for {
+			conn, err := ls.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				buf := make([]byte, size)
+				for {
+					if _, err := io.ReadFull(conn, buf); err != nil {
+						return
+					}
+					if _, err := conn.Write([]byte{1}); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+
+	return ls.Addr()
+}
+
+// dialSOCKS5 negotiates noauth CONNECT to dst over the proxy.
+func dialSOCKS5(proxy, dst net.Addr) (net.Conn, error) {
+	conn, err := net.Dial("tcp", proxy.String())
+	if err != nil {
+		return nil, err
+	}
+
+	tcp := dst.(*net.TCPAddr)
+	req := []byte{protoVersion, 1, byte(typeNoAuth), protoVersion, byte(connect), 0, byte(ipv4)}
+	req = append(req, tcp.IP.To4()...)
+	req = binary.BigEndian.AppendUint16(req, uint16(tcp.Port))
+
+	if _, err := conn.Write(req); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	// auth reply (2 bytes) + command reply with ipv4 (10 bytes)
+	reply := make([]byte, 12)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	if reply[1] != byte(typeNoAuth) || reply[3] != byte(succeeded) {
+		_ = conn.Close()
+		return nil, fmt.Errorf("unexpected reply: %v", reply)
+	}
+
+	return conn, nil
+}
+
+func BenchmarkHandshake(b *testing.B) {
+	proxy := startProxy(b, Options{AllowNoAuth: true})
+	sink := startSink(b, 1)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	start := time.Now()
+
+	for i := 0; i < b.N; i++ {
+		conn, err := dialSOCKS5(proxy, sink)
+		if err != nil {
+			b.Fatalf("dial: %v", err)
+		}
+		_ = conn.Close()
+	}
+
+	b.ReportMetric(float64(b.N)/time.Since(start).Seconds(), "handshakes/s")
+}
+
+// memConn is in-memory client connection replaying the negotiation, replies are discarded.
+type memConn struct {
+	bytes.Reader
+}
+
+func (c *memConn) Write(p []byte) (int, error) { return len(p), nil }
+func (c *memConn) Close() error                { return nil }
+func (c *memConn) RemoteAddr() net.Addr        { return loopback }
+
+// nopUpstream is upstream connection of in-memory sessions.
+type nopUpstream struct {
+	net.Conn
+}
+
+func (nopUpstream) LocalAddr() net.Addr  { return loopback }
+func (nopUpstream) RemoteAddr() net.Addr { return loopback }
+func (nopUpstream) Close() error         { return nil }
+
+var loopback = &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1).To4(), Port: 1080}
+
+// handshake returns SOCKS5 handling noauth CONNECT negotiation in memory and the negotiation.
+func handshake(tb testing.TB) (*SOCKS5, []byte) {
+	tb.Helper()
+
+	var upstream net.Conn = nopUpstream{}
+	socks5, err := New(Options{
+		AllowNoAuth:   true,
+		Connect:       func(int, []byte, int) (net.Conn, error) { return upstream, nil },
+		OnEstablished: func(io.ReadWriteCloser, net.Conn, SessionInfo) {},
+	})
+	if err != nil {
+		tb.Fatalf("new: %v", err)
+	}
+
+	return socks5, []byte{protoVersion, 1, byte(typeNoAuth), protoVersion, byte(connect), 0, byte(ipv4), 127, 0, 0, 1, 0, 80}
+}
+
+// BenchmarkNegotiation measures the server side of the handshake without network: allocations
+// besides the session state and its registration are regressions.
+func BenchmarkNegotiation(b *testing.B) {
+	socks5, negotiation := handshake(b)
+	conn := &memConn{}
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		conn.Reset(negotiation)
+		socks5.Handle(conn, nil)
+	}
+}
+
+// maxHandshakeAllocs is the session state, its context and registration in the session store.
+const maxHandshakeAllocs = 8
+
+func TestHandshakeAllocs(t *testing.T) {
+	socks5, negotiation := handshake(t)
+	conn := &memConn{}
+
+	allocs := testing.AllocsPerRun(100, func() {
+		conn.Reset(negotiation)
+		socks5.Handle(conn, nil)
+	})
+	if allocs > maxHandshakeAllocs {
+		t.Errorf("handshake takes %v allocs, want no more than %d", allocs, maxHandshakeAllocs)
+	}
+}
+
+func TestMessagesAllocs(t *testing.T) {
+	var (
+		methodsBuf [8]authMethod
+		msgBuf     [maxDomainSize + 2]byte
+		r          bytes.Reader
+	)
+	greeting := []byte{protoVersion, 2, byte(typeNoAuth), byte(typeLogin)}
+	request := []byte{protoVersion, byte(connect), 0, byte(domainName), 4, 'h', 'o', 's', 't', 0, 80}
+	conn := newBufferedConn(&memConn{})
+
+	allocs := testing.AllocsPerRun(100, func() {
+		r.Reset(greeting)
+		auth := authRequest{methods: methodsBuf[:0], buf: msgBuf[:0]}
+		if _, err := auth.ReadFrom(&r); err != nil {
+			t.Fatalf("read greeting: %v", err)
+		}
+
+		r.Reset(request)
+		cmd := commandRequest{addr: msgBuf[:0]}
+		if _, err := cmd.ReadFrom(&r); err != nil {
+			t.Fatalf("read request: %v", err)
+		}
+
+		if err := sendReply(conn, authReply{method: typeNoAuth}); err != nil {
+			t.Fatalf("send method: %v", err)
+		}
+		reply := commandReply{rep: succeeded, addressType: cmd.addressType, addr: cmd.addr, port: cmd.port}
+		if err := sendReply(conn, reply); err != nil {
+			t.Fatalf("send reply: %v", err)
+		}
+	})
+	if allocs != 0 {
+		t.Errorf("messages take %v allocs, want 0", allocs)
+	}
+}
+
+func BenchmarkRelay(b *testing.B) {
+	sizes := []int{1 << 10, 64 << 10, 1 << 20}
+	sessions := []int{1, 16, 128}
+
+	for _, size := range sizes {
+		for _, concurrency := range sessions {
+			b.Run(fmt.Sprintf("%dKB/sessions=%d", size>>10, concurrency), func(b *testing.B) {
+				benchmarkRelay(b, Options{AllowNoAuth: true}, size, concurrency)
+			})
+		}
+	}
+}
+
+func benchmarkRelay(b *testing.B, opts Options, size, concurrency int) {
+	proxy := startProxy(b, opts)
+	sink := startSink(b, size)
+
+	conns := make([]net.Conn, concurrency)
+	for i := range conns {
+		conn, err := dialSOCKS5(proxy, sink)
+		if err != nil {
+			b.Fatalf("dial: %v", err)
+		}
+		defer conn.Close()
+		conns[i] = conn
+	}
+
+	payload := make([]byte, size)
+
+	b.ResetTimer()
+	start := time.Now()
+
+	var wg sync.WaitGroup
+	for i, conn := range conns {
+		// spread b.N transfers over the sessions
+		n := b.N / concurrency
+		if i < b.N%concurrency {
+			n++
+		}
+
+		wg.Add(1)
+		go func(conn net.Conn, n int) {
+			defer wg.Done()
+
+			ack := make([]byte, 1)
+			for j := 0; j < n; j++ {
+				if _, err := conn.Write(payload); err != nil {
+					b.Errorf("write: %v", err)
+					return
+				}
+				if _, err := io.ReadFull(conn, ack); err != nil {
+					b.Errorf("read: %v", err)
+					return
+				}
+			}
+		}(conn, n)
+	}
+	wg.Wait()
+
+	elapsed := time.Since(start).Seconds()
+	b.ReportMetric(float64(b.N*size)/elapsed/(1<<20), "MB/s")
+}
+
+// BenchmarkUDPBatch compares relaying of small datagrams (DNS-like) one per syscall and in batches
+// of recvmmsg and sendmmsg.
+func BenchmarkUDPBatch(b *testing.B) {
+	const (
+		size  = 64
+		burst = 32
+	)
+
+	b.Run("naive", func(b *testing.B) {
+		sender := listenBatchConn(b, "127.0.0.1:0", newUDPBatches(1, size))
+		receiver := listenBatchConn(b, "127.0.0.1:0", newUDPBatches(1, size))
+		dst := receiver.LocalAddr().(*net.UDPAddr).AddrPort()
+		payload, buf := make([]byte, size), make([]byte, size)
+
+		b.SetBytes(size)
+		b.ResetTimer()
+		for i := 0; i < b.N; i += burst {
+			n := min(burst, b.N-i)
+			for range n {
+				if _, err := sender.WriteToUDPAddrPort(payload, dst); err != nil {
+					b.Fatal(err)
+				}
+			}
+			for range n {
+				if _, _, err := receiver.ReadFromUDPAddrPort(buf); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+
+	b.Run("batch", func(b *testing.B) {
+		batches := newUDPBatches(burst, size)
+		sender := listenBatchConn(b, "127.0.0.1:0", batches)
+		receiver := listenBatchConn(b, "127.0.0.1:0", batches)
+		dst := receiver.LocalAddr().(*net.UDPAddr).AddrPort()
+		payload := make([]byte, size)
+
+		b.SetBytes(size)
+		b.ResetTimer()
+		for i := 0; i < b.N; i += burst {
+			n := min(burst, b.N-i)
+
+			out := batches.get()
+			for range n {
+				out.msgs = append(out.msgs, udpMessage{buf: payload, addr: dst})
+			}
+			if err := sender.write(out); err != nil {
+				b.Fatal(err)
+			}
+			batches.put(out)
+
+			for n > 0 {
+				in, err := receiver.read(0)
+				if err != nil {
+					b.Fatal(err)
+				}
+				n -= len(in.msgs)
+				batches.put(in)
+			}
+		}
+	})
+}
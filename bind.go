@@ -0,0 +1,98 @@
+package proxyme
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// errBindTimeout is returned when no incoming connection arrives in time for BIND command.
+	errBindTimeout = errors.New("bind: incoming connection timeout")
+
+	// errUnexpectedPeer is reported for incoming connections from peers other than the expected one.
+	errUnexpectedPeer = errors.New("bind: unexpected peer")
+)
+
+// BindEvent reports progress of BIND command to Options.OnBind.
+type BindEvent struct {
+	// Listener is the address the proxy listens on for the incoming connection
+	// (BND.ADDR & BND.PORT of the first reply).
+	Listener net.Addr
+
+	// Peer is the address of the accepted incoming connection, nil until it's accepted.
+	Peer net.Addr
+
+	// Elapsed is the time since the listener has been opened, zero on listener opened event.
+	Elapsed time.Duration
+
+	// Err is non-nil if no incoming connection has been accepted (including timeout).
+	Err error
+}
+
+// onBind reports bind progress if the hook is set.
+func (s *state) onBind(event BindEvent) {
+	if s.opts.onBind != nil {
+		s.opts.onBind(s.info(), event)
+	}
+}
+
+// accept waits for the incoming connection no longer than timeout (zero means forever).
+// Connections rejected by match are closed and accepting goes on, nil match accepts the first one.
+func accept(ls net.Listener, timeout time.Duration, match func(conn net.Conn) bool) (net.Conn, error) {
+	var expired atomic.Bool
+	if timeout > 0 {
+		timer := time.AfterFunc(timeout, func() {
+			expired.Store(true)
+			_ = ls.Close()
+		})
+		defer timer.Stop()
+	}
+
+	for {
+		conn, err := ls.Accept()
+		if err != nil {
+			if expired.Load() {
+				return nil, errBindTimeout
+			}
+			return nil, err
+		}
+
+		if match == nil || match(conn) {
+			return conn, nil
+		}
+
+		_ = conn.Close()
+	}
+}
+
+// expectedPeer returns matcher of incoming connections against BIND DST.ADDR: the address the client
+// expects the connection from. Unspecified address matches any peer, domain names are resolved.
+func expectedPeer(cmd commandRequest) (func(peer net.Addr) bool, error) {
+	var ips []net.IP
+
+	switch cmd.addressType {
+	case ipv4, ipv6:
+		ips = []net.IP{net.IP(cmd.addr)}
+	case domainName:
+		addrs, err := net.LookupIP(string(cmd.addr))
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrHostUnreachable, err)
+		}
+		ips = addrs
+	default:
+		return nil, fmt.Errorf("unknown address type: %d", cmd.addressType)
+	}
+
+	return func(peer net.Addr) bool {
+		ip := addrIP(peer)
+		for _, expected := range ips {
+			if expected.IsUnspecified() || expected.Equal(ip) {
+				return true
+			}
+		}
+		return false
+	}, nil
+}
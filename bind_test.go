@@ -0,0 +1,149 @@
+package proxyme
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func Test_accept(t *testing.T) {
+	tests := []struct {
+		name    string
+		timeout time.Duration
+		dial    bool
+		wantErr error
+	}{
+		{
+			name:    "accepted without timeout",
+			timeout: 0,
+			dial:    true,
+		},
+		{
+			name:    "accepted within timeout",
+			timeout: time.Second,
+			dial:    true,
+		},
+		{
+			name:    "timeout",
+			timeout: 10 * time.Millisecond,
+			dial:    false,
+			wantErr: errBindTimeout,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ls, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatalf("listen: %v", err)
+			}
+			defer ls.Close()
+
+			if tt.dial {
+				go func() {
+					if conn, err := net.Dial("tcp", ls.Addr().String()); err == nil {
+						_ = conn.Close()
+					}
+				}()
+			}
+
+			conn, err := accept(ls, tt.timeout, nil)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("accept() error = %v, want %v", err, tt.wantErr)
+			}
+			if err == nil {
+				_ = conn.Close()
+			}
+		})
+	}
+}
+
+func Test_accept_match(t *testing.T) {
+	ls, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ls.Close()
+
+	// the first two connections are stray ones
+	const stray = 2
+	go func() {
+		for i := 0; i <= stray; i++ {
+			conn, err := net.Dial("tcp", ls.Addr().String())
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	var seen int
+	conn, err := accept(ls, time.Second, func(conn net.Conn) bool {
+		seen++
+		return seen > stray
+	})
+	if err != nil {
+		t.Fatalf("accept() error = %v", err)
+	}
+	_ = conn.Close()
+
+	if seen != stray+1 {
+		t.Fatalf("accept() matched %d connections, want %d", seen, stray+1)
+	}
+}
+
+func Test_expectedPeer(t *testing.T) {
+	peer := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 40000}
+
+	tests := []struct {
+		name    string
+		cmd     commandRequest
+		want    bool
+		wantErr bool
+	}{
+		{
+			name: "same ip",
+			cmd:  commandRequest{addressType: ipv4, addr: net.IPv4(127, 0, 0, 1).To4(), port: 21},
+			want: true,
+		},
+		{
+			name: "other ip",
+			cmd:  commandRequest{addressType: ipv4, addr: net.IPv4(127, 0, 0, 2).To4(), port: 21},
+			want: false,
+		},
+		{
+			name: "unspecified ipv4",
+			cmd:  commandRequest{addressType: ipv4, addr: net.IPv4zero.To4()},
+			want: true,
+		},
+		{
+			name: "unspecified ipv6",
+			cmd:  commandRequest{addressType: ipv6, addr: net.IPv6unspecified},
+			want: true,
+		},
+		{
+			name: "domain",
+			cmd:  commandRequest{addressType: domainName, addr: []byte("localhost")},
+			want: true,
+		},
+		{
+			name:    "unknown address type",
+			cmd:     commandRequest{addressType: 0x7f},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			match, err := expectedPeer(tt.cmd)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("expectedPeer() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if got := match(peer); got != tt.want {
+				t.Errorf("expectedPeer() match = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
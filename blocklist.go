@@ -0,0 +1,317 @@
+package proxyme
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// blocklistTimeout limits downloading of the blocklist.
+const blocklistTimeout = time.Minute
+
+// Blocklist is a set of blocked domain names loaded from a file or http(s) URL, use its Check as
+// Options.Rules (see ChainRules to combine it with other rules). The list is swapped atomically on
+// Reload, so it's refreshed without restarting the proxy.
+//
+// Lists of millions of entries are supported: names are packed into a single sorted buffer taking
+// about the size of the names plus 4 bytes per entry. Lines of the following formats are
+// recognized, the others (SOA, NS records, invalid names) are skipped:
+//
+//	0.0.0.0 ads.example.com tracker.example.com   # hosts file
+//	ads.example.com                               # plain list of names
+//	ads.example.com CNAME .                       # RPZ zone: blocked by NXDOMAIN or NODATA (*.)
+//	*.ads.example.com 300 IN CNAME .              # wildcards match subdomains only
+//
+// Names match exactly, wildcards *.name match subdomains of name. Names of RPZ zones are relative
+// to $ORIGIN or absolute. Comments start with # or ;.
+type Blocklist struct {
+	source string // file path or http(s) URL
+	client *http.Client
+	names  atomic.Pointer[domainSet]
+
+	mu       sync.Mutex // serializes reloading
+	loaded   os.FileInfo
+	etag     string
+	modified string
+}
+
+// LoadBlocklist loads the blocklist from the file or http(s) URL.
+func LoadBlocklist(source string) (*Blocklist, error) {
+	b := &Blocklist{
+		source: source,
+		client: &http.Client{Timeout: blocklistTimeout},
+	}
+	if err := b.Reload(); err != nil {
+		return nil, err
+	}
+
+	return b, nil
+}
+
+// Reload re-reads the source and swaps the list if it has been changed since the last load (file
+// modification, ETag or Last-Modified of URL). On failure the current list is kept.
+func (b *Blocklist) Reload() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	loaded, etag, modified := b.loaded, b.etag, b.modified
+
+	r, err := b.open()
+	if err != nil || r == nil {
+		return err
+	}
+	defer r.Close() // nolint
+
+	names, err := parseBlocklist(r)
+	if err != nil {
+		// broken list is reloaded next time even if unchanged
+		b.loaded, b.etag, b.modified = loaded, etag, modified
+		return fmt.Errorf("blocklist: %s: %w", b.source, err)
+	}
+	b.names.Store(names)
+
+	return nil
+}
+
+// open opens the source, nil reader means it hasn't been changed since the last load.
+func (b *Blocklist) open() (io.ReadCloser, error) {
+	if !strings.HasPrefix(b.source, "http://") && !strings.HasPrefix(b.source, "https://") {
+		fi, err := os.Stat(b.source)
+		if err != nil {
+			return nil, fmt.Errorf("blocklist: %w", err)
+		}
+		if b.loaded != nil && os.SameFile(fi, b.loaded) &&
+			fi.Size() == b.loaded.Size() && fi.ModTime().Equal(b.loaded.ModTime()) {
+			return nil, nil
+		}
+
+		f, err := os.Open(b.source)
+		if err != nil {
+			return nil, fmt.Errorf("blocklist: %w", err)
+		}
+		b.loaded = fi
+
+		return f, nil
+	}
+
+	req, err := http.NewRequest(http.MethodGet, b.source, nil)
+	if err != nil {
+		return nil, fmt.Errorf("blocklist: %w", err)
+	}
+	if b.etag != "" {
+		req.Header.Set("If-None-Match", b.etag)
+	}
+	if b.modified != "" {
+		req.Header.Set("If-Modified-Since", b.modified)
+	}
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("blocklist: %w", err)
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		b.etag, b.modified = resp.Header.Get("ETag"), resp.Header.Get("Last-Modified")
+		return resp.Body, nil
+	case http.StatusNotModified:
+		_ = resp.Body.Close()
+		return nil, nil
+	default:
+		_ = resp.Body.Close()
+		return nil, fmt.Errorf("blocklist: %s: %s", b.source, resp.Status)
+	}
+}
+
+// Refresh reloads the list every interval until the context is done, failed reloads keep
+// the current list and are reported to onError.
+func (b *Blocklist) Refresh(ctx context.Context, interval time.Duration, onError func(error)) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+			if err := b.Reload(); err != nil && onError != nil {
+				onError(err)
+			}
+		}
+	}
+}
+
+// Len returns the number of entries of the list.
+func (b *Blocklist) Len() int {
+	return b.names.Load().len()
+}
+
+// Contains reports whether the domain name is blocked.
+func (b *Blocklist) Contains(name string) bool {
+	return b.names.Load().match(normalizeName(name))
+}
+
+// Check returns *RuleError if the domain name destination is blocked, RuleError.Rule is
+// "blocklist:" followed by the file name of the source. IP address destinations aren't checked.
+func (b *Blocklist) Check(info SessionInfo) error {
+	if info.AddressType != int(domainName) || !b.Contains(string(info.Addr)) {
+		return nil
+	}
+
+	return &RuleError{
+		Reason: fmt.Sprintf("%s blocked by %s", info.Addr, b.source),
+		Rule:   "blocklist:" + path.Base(b.source),
+	}
+}
+
+// parseBlocklist parses the blocklist of hosts, plain or RPZ format.
+func parseBlocklist(r io.Reader) (*domainSet, error) {
+	var (
+		names  []string
+		origin string
+		parens int // depth of multi-line record
+		lines  int // significant lines
+	)
+
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		line := sc.Text()
+		if i := strings.IndexAny(line, "#;"); i >= 0 {
+			line = line[:i]
+		}
+
+		// skip continuation of multi-line records (SOA)
+		wasInside := parens > 0
+		parens += strings.Count(line, "(") - strings.Count(line, ")")
+		fields := strings.Fields(line)
+		if wasInside || len(fields) == 0 {
+			continue
+		}
+		lines++
+
+		switch {
+		case strings.EqualFold(fields[0], "$ORIGIN") && len(fields) > 1:
+			origin = normalizeName(fields[1])
+		case strings.HasPrefix(fields[0], "$"):
+		case len(fields) == 1:
+			names = appendName(names, fields[0], "")
+		case net.ParseIP(fields[0]) != nil:
+			for _, name := range fields[1:] {
+				names = appendName(names, name, "")
+			}
+		default:
+			// RPZ record: owner [ttl] [class] CNAME target
+			i := slices.IndexFunc(fields, func(f string) bool { return strings.EqualFold(f, "CNAME") })
+			if i > 0 && i+1 < len(fields) && (fields[i+1] == "." || fields[i+1] == "*.") {
+				names = appendName(names, fields[0], origin)
+			}
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	if len(names) == 0 && lines > 0 {
+		return nil, errors.New("no entries")
+	}
+
+	return newDomainSet(names), nil
+}
+
+// appendName appends the valid name of the list, absolute names of RPZ zone are made relative
+// to the origin.
+func appendName(names []string, name, origin string) []string {
+	if origin != "" && strings.HasSuffix(name, ".") {
+		name = strings.TrimSuffix(normalizeName(name), "."+origin)
+	}
+	name = normalizeName(name)
+
+	host := strings.TrimPrefix(name, "*.")
+	if host == "" || host == "localhost" || net.ParseIP(host) != nil || !validName(host) {
+		return names
+	}
+
+	return append(names, name)
+}
+
+// validName reports whether the name consists of letters, digits, hyphens, underscores and dots.
+func validName(name string) bool {
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.') {
+			return false
+		}
+	}
+
+	return len(name) <= maxDomainLength
+}
+
+// domainSet is a sorted set of domain names packed into a single buffer, names starting with
+// "*." match subdomains.
+type domainSet struct {
+	data string   // concatenated names
+	offs []uint32 // start of every name in data and the end of the last one
+}
+
+func newDomainSet(names []string) *domainSet {
+	slices.Sort(names)
+	names = slices.Compact(names)
+
+	size := 0
+	for _, name := range names {
+		size += len(name)
+	}
+
+	var data strings.Builder
+	data.Grow(size)
+
+	offs := make([]uint32, 0, len(names)+1)
+	for _, name := range names {
+		offs = append(offs, uint32(data.Len())) // nolint
+		data.WriteString(name)
+	}
+	offs = append(offs, uint32(data.Len())) // nolint
+
+	return &domainSet{data: data.String(), offs: offs}
+}
+
+func (s *domainSet) len() int {
+	return len(s.offs) - 1
+}
+
+func (s *domainSet) at(i int) string {
+	return s.data[s.offs[i]:s.offs[i+1]]
+}
+
+// contains reports whether the set has the name.
+func (s *domainSet) contains(name string) bool {
+	i := sort.Search(s.len(), func(i int) bool { return s.at(i) >= name })
+	return i < s.len() && s.at(i) == name
+}
+
+// match reports whether the name or its parent domain wildcard is in the set.
+func (s *domainSet) match(name string) bool {
+	if s.contains(name) {
+		return true
+	}
+
+	for i := strings.IndexByte(name, '.'); i >= 0; i = strings.IndexByte(name, '.') {
+		name = name[i+1:]
+		if s.contains("*." + name) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,142 @@
+package proxyme
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestBlocklist_Contains(t *testing.T) {
+	const list = `
+# hosts file
+127.0.0.1 localhost
+0.0.0.0 ads.example.com Tracker.Example.com. # inline comment
+0.0.0.0 0.0.0.0
+
+# plain list
+malware.test
+
+; RPZ zone
+$TTL 300
+$ORIGIN rpz.local.
+@ IN SOA localhost. admin.localhost. (
+	1 ; serial
+	3600
+	600 )
+@ IN NS localhost.
+phishing.test CNAME .
+*.cdn.test 300 IN CNAME *.
+absolute.test.rpz.local. CNAME .
+allowed.test CNAME rpz-passthru.
+`
+
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{name: "ads.example.com", want: true},
+		{name: "ADS.example.com.", want: true},
+		{name: "tracker.example.com", want: true},
+		{name: "www.ads.example.com", want: false},
+		{name: "example.com", want: false},
+		{name: "localhost", want: false},
+		{name: "malware.test", want: true},
+		{name: "phishing.test", want: true},
+		{name: "absolute.test", want: true},
+		{name: "allowed.test", want: false},
+		{name: "img.cdn.test", want: true},
+		{name: "a.b.cdn.test", want: true},
+		{name: "cdn.test", want: false},
+		{name: "1", want: false},
+		{name: "serial", want: false},
+	}
+
+	b, err := LoadBlocklist(writeRules(t, filepath.Join(t.TempDir(), "blocklist"), list))
+	if err != nil {
+		t.Fatalf("LoadBlocklist() error = %v", err)
+	}
+	if got := b.Len(); got != 6 {
+		t.Errorf("Len() = %d, want 6", got)
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := b.Contains(tt.name); got != tt.want {
+				t.Errorf("Contains() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBlocklist_Check(t *testing.T) {
+	b, err := LoadBlocklist(writeRules(t, filepath.Join(t.TempDir(), "ads.txt"), "ads.example.com"))
+	if err != nil {
+		t.Fatalf("LoadBlocklist() error = %v", err)
+	}
+
+	var ruleErr *RuleError
+	err = b.Check(SessionInfo{AddressType: int(domainName), Addr: []byte("ads.example.com"), Port: 443})
+	if !errors.As(err, &ruleErr) || ruleErr.Rule != "blocklist:ads.txt" {
+		t.Errorf("Check() error = %v, want blocked by blocklist:ads.txt", err)
+	}
+
+	if err := b.Check(SessionInfo{AddressType: int(domainName), Addr: []byte("example.com"), Port: 443}); err != nil {
+		t.Errorf("Check() error = %v, want allowed", err)
+	}
+}
+
+func TestBlocklist_Reload(t *testing.T) {
+	var (
+		list     atomic.Value
+		requests atomic.Int64
+	)
+	list.Store("ads.example.com")
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+
+		body := list.Load().(string)
+		etag := `"` + body + `"`
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		_, _ = w.Write([]byte(body))
+	}))
+	defer srv.Close()
+
+	b, err := LoadBlocklist(srv.URL + "/list")
+	if err != nil {
+		t.Fatalf("LoadBlocklist() error = %v", err)
+	}
+
+	// not modified
+	if err := b.Reload(); err != nil || !b.Contains("ads.example.com") {
+		t.Fatalf("Reload() error = %v, list is lost", err)
+	}
+
+	// broken list keeps the current one
+	list.Store("<html>not found</html>\n<body>")
+	if err := b.Reload(); err == nil || !strings.Contains(err.Error(), "no entries") {
+		t.Fatalf("Reload() error = %v, want no entries", err)
+	}
+	if !b.Contains("ads.example.com") {
+		t.Fatalf("list is lost on failed reload")
+	}
+
+	list.Store("tracker.example.com")
+	if err := b.Reload(); err != nil {
+		t.Fatalf("Reload() error = %v", err)
+	}
+	if b.Contains("ads.example.com") || !b.Contains("tracker.example.com") {
+		t.Errorf("list isn't swapped on reload")
+	}
+	if n := requests.Load(); n != 4 {
+		t.Errorf("got %d requests, want 4", n)
+	}
+}
@@ -0,0 +1,88 @@
+package proxyme
+
+import (
+	"net"
+
+	"github.com/dblokhin/proxyme/wire"
+)
+
+// Canaries are destinations no legitimate client connects to (decoy hosts, internal addresses
+// listed in leaked documents): CONNECT attempts to them reveal compromised credentials or clients,
+// see Options.Canaries.
+type Canaries struct {
+	// Networks are canary IP networks, they match IP address destinations.
+	Networks []*net.IPNet
+
+	// Domains are canary domain names, they match domain name destinations and their subdomains.
+	Domains []string
+
+	// Status is the reply to the canary CONNECT: zero (succeeded) lets the command go on, so
+	// the canary may be a honeypot host, other statuses reject the command.
+	Status wire.Status
+
+	// Alert is called with the session trying to connect to the canary, before the command goes on
+	// or is rejected. It's called from the session goroutine and should not block for long.
+	Alert func(info SessionInfo)
+}
+
+// match reports whether the destination is a canary.
+func (c *Canaries) match(addrType addressType, addr []byte) bool {
+	if addrType == domainName {
+		return matchDomain(c.Domains, string(addr))
+	}
+
+	ip := net.IP(addr)
+	for _, n := range c.Networks {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// normalized returns copy of the canaries with domains in the form matchDomain expects.
+func (c *Canaries) normalized() *Canaries {
+	if c == nil {
+		return nil
+	}
+
+	res := *c
+	res.Domains = make([]string, 0, len(c.Domains))
+	for _, d := range c.Domains {
+		res.Domains = append(res.Domains, normalizeName(d))
+	}
+
+	return &res
+}
+
+// CanaryHits returns the number of CONNECT attempts to canary destinations (see Options.Canaries).
+func (s SOCKS5) CanaryHits() int64 {
+	if s.canaryHits == nil {
+		return 0
+	}
+
+	return s.canaryHits.Load()
+}
+
+// checkCanary alerts on CONNECT to the canary destination, it returns *RuleError if the canary
+// rejects the command.
+func checkCanary(state *state) error {
+	c := state.opts.canaries
+	if c == nil || !c.match(state.command.addressType, state.command.addr) {
+		return nil
+	}
+
+	if state.opts.canaryHits != nil {
+		state.opts.canaryHits.Add(1)
+	}
+	if c.Alert != nil {
+		c.Alert(state.info())
+	}
+
+	if c.Status == wire.StatusSucceeded {
+		return nil
+	}
+
+	return &RuleError{Status: c.Status, Reason: "canary destination " + state.info().Destination()}
+}
@@ -0,0 +1,81 @@
+package proxyme
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/dblokhin/proxyme/wire"
+)
+
+func Test_checkCanary(t *testing.T) {
+	_, decoyNet, _ := net.ParseCIDR("10.99.0.0/16")
+
+	tests := []struct {
+		name       string
+		status     wire.Status
+		command    commandRequest
+		wantAlert  bool
+		wantStatus commandStatus // status of the returned error, 0 means no error
+	}{
+		{
+			name:       "canary network",
+			status:     wire.StatusHostUnreachable,
+			command:    commandRequest{addressType: ipv4, addr: net.IPv4(10, 99, 1, 1).To4(), port: 22},
+			wantAlert:  true,
+			wantStatus: hostUnreachable,
+		},
+		{
+			name:       "canary subdomain",
+			status:     wire.StatusNotAllowed,
+			command:    commandRequest{addressType: domainName, addr: []byte("Vault.Corp.Example"), port: 443},
+			wantAlert:  true,
+			wantStatus: notAllowed,
+		},
+		{
+			name:      "honeypot goes on",
+			command:   commandRequest{addressType: domainName, addr: []byte("corp.example"), port: 443},
+			wantAlert: true,
+		},
+		{
+			name:    "regular destination",
+			status:  wire.StatusHostUnreachable,
+			command: commandRequest{addressType: ipv4, addr: net.IPv4(10, 98, 1, 1).To4(), port: 22},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var alerts []SessionInfo
+			canaries := &Canaries{
+				Networks: []*net.IPNet{decoyNet},
+				Domains:  []string{"Corp.Example."},
+				Status:   tt.status,
+				Alert:    func(info SessionInfo) { alerts = append(alerts, info) },
+			}
+			s := &state{
+				opts:     SOCKS5{canaries: canaries.normalized()},
+				username: "alice",
+				command:  tt.command,
+			}
+
+			err := checkCanary(s)
+
+			var ruleErr *RuleError
+			switch {
+			case tt.wantStatus == 0 && err != nil:
+				t.Errorf("checkCanary() error = %v", err)
+			case tt.wantStatus != 0 && !errors.As(err, &ruleErr):
+				t.Errorf("checkCanary() error = %v, want *RuleError", err)
+			case tt.wantStatus != 0 && errorStatus(err) != tt.wantStatus:
+				t.Errorf("checkCanary() status = %d, want %d", errorStatus(err), tt.wantStatus)
+			}
+
+			if got := len(alerts) == 1; got != tt.wantAlert {
+				t.Fatalf("got alerts %v, want alert %v", alerts, tt.wantAlert)
+			}
+			if tt.wantAlert && (alerts[0].Username != "alice" || alerts[0].Port != int(tt.command.port)) {
+				t.Errorf("got alert %+v, want session details", alerts[0])
+			}
+		})
+	}
+}
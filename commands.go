@@ -0,0 +1,165 @@
+package proxyme
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+)
+
+// errNoCommandReply reports CommandHandler returned without replying to the client.
+var errNoCommandReply = errors.New("handler returned without reply")
+
+// Command is custom command request of the client, see Options.Commands.
+type Command struct {
+	// Info describes the session and the request: Command, AddressType, Addr and Port.
+	Info SessionInfo
+
+	// Conn is the client connection past the request (encapsulated if the auth method does so).
+	// The handler replies to the client itself (see wire.CommandReply), the connection is closed
+	// once the handler returns.
+	Conn io.ReadWriteCloser
+}
+
+// authenticated runs post-auth hook before reading the client request.
+func authenticated(state *state) (transition, error) {
+	if state.opts.onAuth != nil {
+		if err := state.opts.onAuth(state.info()); err != nil {
+			return nil, fmt.Errorf("on authenticated: %w", err)
+		}
+	}
+
+	return getCommand, nil
+}
+
+// runCustom hands the session over to the custom command handler.
+func runCustom(state *state) (transition, error) {
+	handler := state.opts.commands[byte(state.command.commandType)]
+
+	// the handler speaks its own protocol, negotiation limits don't apply
+	if state.negotiation != nil {
+		state.negotiation.stop()
+	}
+
+	// replies may be held for pipelined messages or wait for the command reply (Quirks.CombineReplies)
+	if err := flush(state.conn); err != nil {
+		return nil, fmt.Errorf("sock write: %w", err)
+	}
+
+	cmd := Command{
+		Info: state.info(),
+		Conn: unwrap(state.conn),
+	}
+	if err := handler(cmd); err != nil {
+		return nil, fmt.Errorf("command %d: %w", state.command.commandType, err)
+	}
+
+	return nil, nil
+}
+
+// CommandHandler replaces the built-in handling of the command (see Options.CommandHandlers), e.g.
+// BIND allocating listeners from a port broker. The request is read and validated as usual, then
+// the handler drives the session through CommandSession: replies are encoded by the package and
+// the tunnel is relayed by the built-in relay, so limits, filters and accounting still apply.
+//
+// If the handler returns error before replying, the client gets the failure reply of the error
+// status as the built-in commands do (ErrNotAllowed, ErrHostUnreachable, *RuleError etc.), other
+// errors are replied with general failure.
+type CommandHandler interface {
+	ServeCommand(s *CommandSession) error
+}
+
+// CommandHandlerFunc is func implementing CommandHandler.
+type CommandHandlerFunc func(s *CommandSession) error
+
+// ServeCommand calls f(s).
+func (f CommandHandlerFunc) ServeCommand(s *CommandSession) error {
+	return f(s)
+}
+
+// CommandSession is the session of the command served by CommandHandler.
+type CommandSession struct {
+	state   *state
+	replied bool
+}
+
+// Info describes the session and the request: Command, AddressType, Addr and Port.
+func (s *CommandSession) Info() SessionInfo {
+	return s.state.info()
+}
+
+// Context returns the context of the session, it's canceled on session teardown.
+func (s *CommandSession) Context() context.Context {
+	if s.state.ctx == nil {
+		return context.Background()
+	}
+
+	return s.state.ctx
+}
+
+// Dial connects to the requested destination as CONNECT does: canaries, RewriteDestination, Rules
+// and Router apply.
+func (s *CommandSession) Dial() (net.Conn, error) {
+	return dial(s.state)
+}
+
+// Reply sends the successful reply with BND.ADDR and BND.PORT of the address (*net.TCPAddr or
+// *net.UDPAddr), nil address is replied as 0.0.0.0:0. BIND replies twice: with the address
+// listening for the peer, then with the address of the connected peer.
+func (s *CommandSession) Reply(addr net.Addr) error {
+	reply := commandReply{rep: succeeded, addressType: ipv4, addr: net.IPv4zero.To4()}
+	if addr != nil {
+		if udp, ok := addr.(*net.UDPAddr); ok {
+			addr = &net.TCPAddr{IP: udp.IP, Port: udp.Port}
+		}
+
+		addrType, ip, port, err := parseAddress(addr)
+		if err != nil {
+			return fmt.Errorf("reply address: %w", err)
+		}
+		reply.addressType, reply.addr, reply.port = addrType, ip, uint16(port) // nolint
+	}
+
+	if err := s.state.sendCommandReply(reply); err != nil {
+		return fmt.Errorf("sock write: %w", err)
+	}
+	s.replied = true
+
+	return nil
+}
+
+// Relay tunnels the client and the upstream with the built-in relay until either side closes,
+// the upstream is closed then. The successful reply must be sent before.
+func (s *CommandSession) Relay(upstream net.Conn) error {
+	if !s.replied {
+		_ = upstream.Close()
+		return errors.New("relay before reply")
+	}
+	if s.state.upstream == nil {
+		s.state.upstream = upstream.RemoteAddr()
+	}
+
+	return relay(s.state, upstream)
+}
+
+// runHandler hands the command over to its CommandHandler.
+func runHandler(state *state) (transition, error) {
+	handler := state.opts.handlers[byte(state.command.commandType)]
+
+	s := &CommandSession{state: state}
+	err := handler.ServeCommand(s)
+	if s.replied {
+		if err != nil {
+			return nil, fmt.Errorf("command %d: %w", state.command.commandType, err)
+		}
+		return nil, nil
+	}
+
+	if err == nil {
+		err = errNoCommandReply
+	}
+	state.status = errorStatus(err)
+
+	return failCommand, fmt.Errorf("command %d: %w", state.command.commandType, err)
+}
@@ -2,70 +2,319 @@ package proxyme
 
 import (
 	"bytes"
+	"errors"
 	"io"
+	"time"
 )
 
-// gssConn is encapsulated GSSAPI connection.
-type gssConn struct {
-	raw    io.ReadWriteCloser
-	gssapi GSSAPI
-	buffer bytes.Buffer
+// sessionBufferSize is enough to hold any protocol message except GSSAPI tokens
+// which are written directly when exceed the buffer.
+const sessionBufferSize = 512
+
+// bufferedConn coalesces protocol message writes until flush: each message (or a group of them)
+// goes to the client in a single write. It's used through negotiation, the tunnel relays unwrapped conn.
+// The buffer is a fixed array, so the conn embedded in the session state takes no allocations.
+//
+// Replies to pipelined messages are held (see flushPipelined) until the server is about to wait for
+// the client, so e.g. method selection, login and command replies of a client sending its greeting,
+// login and request at once go in a single segment.
+type bufferedConn struct {
+	io.ReadWriteCloser
+	buf  [sessionBufferSize]byte
+	n    int  // buffered bytes
+	held bool // buffered replies wait for the pipelined input to be read
 }
 
-func (g gssConn) Read(p []byte) (int, error) {
-	// from raw conn -> gssapi decode -> encapsulated conn -> payload
-	var msg gssapiMessage
+func newBufferedConn(conn io.ReadWriteCloser) *bufferedConn {
+	return &bufferedConn{ReadWriteCloser: conn}
+}
 
-	if g.buffer.Len() > 0 {
-		defer func() {
-			if g.buffer.Len() == 0 {
-				g.buffer.Reset()
-			}
-		}()
+func (c *bufferedConn) Write(p []byte) (int, error) {
+	if c.n+len(p) > len(c.buf) {
+		if err := c.Flush(); err != nil {
+			return 0, err
+		}
+		if len(p) > len(c.buf) {
+			return c.ReadWriteCloser.Write(p)
+		}
+	}
+	c.n += copy(c.buf[c.n:], p)
 
-		return g.buffer.Read(p)
+	return len(p), nil
+}
+
+// Read flushes held replies before it waits for the client.
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	if c.held && !c.pending() {
+		if err := c.Flush(); err != nil {
+			return 0, err
+		}
 	}
 
-	_, err := msg.ReadFrom(g.raw)
-	if err != nil {
-		return 0, err
+	return c.ReadWriteCloser.Read(p)
+}
+
+// pending reports whether the client has sent data which hasn't been read yet.
+func (c *bufferedConn) pending() bool {
+	return inputPending(socket(c.ReadWriteCloser))
+}
+
+// Flush writes buffered data to the underlying conn.
+func (c *bufferedConn) Flush() error {
+	c.held = false
+	if c.n == 0 {
+		return nil
 	}
 
-	if err := msg.validate(gssEncapsulation); err != nil {
-		return 0, err
+	n, err := c.ReadWriteCloser.Write(c.buf[:c.n])
+	if err == nil && n < c.n {
+		err = io.ErrShortWrite
+	}
+	// unwritten data is kept as bufio.Writer does
+	c.n = copy(c.buf[:], c.buf[n:c.n])
+
+	return err
+}
+
+// flush flushes buffered writes if w is buffered.
+func flush(w io.Writer) error {
+	if f, ok := w.(interface{ Flush() error }); ok {
+		return f.Flush()
+	}
+
+	return nil
+}
+
+// send writes protocol message and flushes it.
+func send(w io.Writer, msg io.WriterTo) error {
+	if _, err := msg.WriteTo(w); err != nil {
+		return err
 	}
 
-	payload, err := g.gssapi.Decode(msg.token)
+	return flush(w)
+}
+
+// reply is the message of the server encoded without allocations.
+type reply interface {
+	authReply | loginReply | commandReply
+	io.WriterTo
+	appendTo(b []byte) ([]byte, error)
+}
+
+// sendReply writes the reply and flushes it. The reply is encoded right into the buffer
+// of buffered conn, so it takes no allocations.
+func sendReply[R reply](w io.Writer, r R) error {
+	if err := writeReply(w, r); err != nil {
+		return err
+	}
+
+	return flush(w)
+}
+
+// sendPipelined writes the reply followed by reading the next client message and flushes it unless
+// the client has already sent more data: then the client has pipelined the next message without
+// waiting for the reply, so the reply is held to go along with the next ones.
+func sendPipelined[R reply](w io.Writer, r R) error {
+	if err := writeReply(w, r); err != nil {
+		return err
+	}
+
+	if c, ok := w.(*bufferedConn); ok && c.pending() {
+		c.held = true
+		return nil
+	}
+
+	return flush(w)
+}
+
+// writeReply writes the reply, buffered conn holds it until flush.
+func writeReply[R reply](w io.Writer, r R) error {
+	c, ok := w.(*bufferedConn)
+	if !ok {
+		_, err := r.WriteTo(w)
+		return err
+	}
+
+	free := c.buf[c.n:c.n]
+	b, err := r.appendTo(free)
 	if err != nil {
-		return 0, err
+		return err
+	}
+
+	if len(b) > cap(free) {
+		// doesn't fit the buffer, so it's been allocated
+		_, err = c.Write(b)
+		return err
+	}
+	c.n += len(b)
+
+	return nil
+}
+
+// unwrap returns underlying conn of buffered one, the negotiation wrapper is stripped as well
+// (it must be stopped first).
+func unwrap(conn io.ReadWriteCloser) io.ReadWriteCloser {
+	if c, ok := conn.(*bufferedConn); ok {
+		conn = c.ReadWriteCloser
+	}
+	if c, ok := conn.(*negotiationConn); ok && c.stopped {
+		conn = c.ReadWriteCloser
+	}
+
+	return conn
+}
+
+// socket returns the client connection under the buffered and negotiation wrappers whatever
+// the negotiation state is.
+func socket(conn io.ReadWriteCloser) io.ReadWriteCloser {
+	if c, ok := conn.(*bufferedConn); ok {
+		conn = c.ReadWriteCloser
 	}
+	if c, ok := conn.(*negotiationConn); ok {
+		conn = c.ReadWriteCloser
+	}
+
+	return conn
+}
+
+// errNegotiationTooLarge is returned when the client sends more than allowed during negotiation.
+var errNegotiationTooLarge = errors.New("negotiation exceeds max bytes")
+
+// negotiationConn guards negotiation from abusive clients:
+//   - limits the time each client message takes to arrive: the read deadline is armed by the first
+//     read after the server's reply, so the client can't hold the session by sending one byte a minute;
+//   - limits total bytes read, so the client can't burn resources with long method lists or
+//     endless GSSAPI exchanges.
+type negotiationConn struct {
+	io.ReadWriteCloser
+	conn    interface{ SetReadDeadline(t time.Time) error } // nil if deadlines are disabled
+	timeout time.Duration
+	limit   int // 0 means no limit
+
+	read    int  // bytes read
+	armed   bool // deadline is set for the message being read
+	stopped bool // negotiation is over
+}
+
+// newNegotiationConn wraps conn if any of limits applies, otherwise it returns nil.
+// Timeout is applied if conn supports read deadlines.
+func newNegotiationConn(conn io.ReadWriteCloser, timeout time.Duration, limit int) *negotiationConn {
+	d, ok := conn.(interface{ SetReadDeadline(t time.Time) error })
+	if !ok || timeout <= 0 {
+		d, timeout = nil, 0
+	}
+
+	if d == nil && limit <= 0 {
+		return nil
+	}
+
+	return &negotiationConn{ReadWriteCloser: conn, conn: d, timeout: timeout, limit: limit}
+}
+
+func (c *negotiationConn) Read(p []byte) (int, error) {
+	if c.stopped {
+		return c.ReadWriteCloser.Read(p)
+	}
+
+	if c.limit > 0 {
+		if c.read >= c.limit {
+			return 0, errNegotiationTooLarge
+		}
+		p = p[:min(len(p), c.limit-c.read)]
+	}
+
+	if c.conn != nil && !c.armed {
+		c.armed = true
+		_ = c.conn.SetReadDeadline(time.Now().Add(c.timeout))
+	}
+
+	n, err := c.ReadWriteCloser.Read(p)
+	c.read += n
+
+	return n, err
+}
+
+func (c *negotiationConn) Write(p []byte) (int, error) {
+	if !c.stopped {
+		// the reply is sent, next read waits for the new message
+		c.armed = false
+	}
+
+	return c.ReadWriteCloser.Write(p)
+}
+
+// stop lifts the limits once negotiation is over: the tunnel has no message timing nor size.
+func (c *negotiationConn) stop() {
+	c.stopped = true
+	if c.conn != nil {
+		_ = c.conn.SetReadDeadline(time.Time{})
+	}
+}
+
+// gssConn is encapsulated GSSAPI connection.
+type gssConn struct {
+	raw    io.ReadWriteCloser
+	gssapi GSSAPI
+
+	msg     gssapiMessage // reusable decode message
+	payload []byte        // decoded payload not yet consumed by Read
+	out     bytes.Buffer  // reusable encode buffer
+}
+
+func newGSSConn(raw io.ReadWriteCloser, gssapi GSSAPI, maxTokenSize int) *gssConn {
+	return &gssConn{
+		raw:    raw,
+		gssapi: gssapi,
+		msg:    gssapiMessage{limit: maxTokenSize},
+	}
+}
+
+func (g *gssConn) Read(p []byte) (int, error) {
+	// from raw conn -> gssapi decode -> encapsulated conn -> payload
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	// serve rest of the previously decoded token first
+	for len(g.payload) == 0 {
+		if _, err := g.msg.ReadFrom(g.raw); err != nil {
+			return 0, err
+		}
 
-	n := copy(p, payload)
-	if n < len(payload) {
-		if _, err := g.buffer.Write(payload[n:]); err != nil {
-			return n, err
+		if err := g.msg.validate(gssEncapsulation); err != nil {
+			return 0, err
 		}
+
+		payload, err := g.gssapi.Decode(g.msg.token)
+		if err != nil {
+			return 0, err
+		}
+
+		// empty payload is possible, read the next token then
+		g.payload = payload
 	}
 
+	n := copy(p, g.payload)
+	g.payload = g.payload[n:]
+
 	return n, nil
 }
 
-func (g gssConn) Write(p []byte) (int, error) {
+func (g *gssConn) Write(p []byte) (int, error) {
 	// payload -> encapsulated conn -> gssapi encode -> raw conn
 	const maxChunkSize = 1<<16 - 5
 
-	var (
-		n     int
-		chunk []byte
-	)
+	var chunk []byte
 
-	for len(p) > 0 {
-		bound := min(len(p), maxChunkSize)
-		chunk, p = p[:bound], p[bound:]
+	// all tokens of the payload are coalesced into a single raw write
+	g.out.Reset()
+	for rest := p; len(rest) > 0; {
+		bound := min(len(rest), maxChunkSize)
+		chunk, rest = rest[:bound], rest[bound:]
 
 		token, err := g.gssapi.Encode(chunk)
 		if err != nil {
-			return n, err
+			return 0, err
 		}
 
 		msg := gssapiMessage{
@@ -74,22 +323,19 @@ func (g gssConn) Write(p []byte) (int, error) {
 			token:       token,
 		}
 
-		buf := new(bytes.Buffer)
-		if _, err = msg.WriteTo(buf); err != nil {
-			return n, err
+		if _, err = msg.WriteTo(&g.out); err != nil {
+			return 0, err
 		}
+	}
 
-		nn, err := g.raw.Write(buf.Bytes())
-		n += nn
-
-		if err != nil {
-			return n, err
-		}
+	if _, err := g.raw.Write(g.out.Bytes()); err != nil {
+		// unknown part of tokens has been written, payload isn't consumed then
+		return 0, err
 	}
 
-	return n, nil
+	return len(p), nil
 }
 
-func (g gssConn) Close() error {
+func (g *gssConn) Close() error {
 	return g.raw.Close()
 }
@@ -0,0 +1,479 @@
+package proxyme
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// xorGSSAPI is fake GSSAPI "encrypting" the data by xor.
+type xorGSSAPI struct {
+	err error
+}
+
+func (x xorGSSAPI) AcceptContext(token []byte) (bool, []byte, error) {
+	return true, nil, x.err
+}
+
+func (x xorGSSAPI) AcceptProtectionLevel(lvl byte) (byte, error) {
+	return lvl, x.err
+}
+
+func (x xorGSSAPI) Encode(data []byte) ([]byte, error) {
+	return xor(data), x.err
+}
+
+func (x xorGSSAPI) Decode(token []byte) ([]byte, error) {
+	return xor(token), x.err
+}
+
+func xor(data []byte) []byte {
+	res := make([]byte, len(data))
+	for i, b := range data {
+		res[i] = b ^ 0x55
+	}
+	return res
+}
+
+// gssEncapsulate returns raw gssapi encapsulation messages of the payloads.
+func gssEncapsulate(payloads ...[]byte) []byte {
+	var buf bytes.Buffer
+	for _, p := range payloads {
+		msg := gssapiMessage{version: subnVersion, messageType: gssEncapsulation, token: xor(p)}
+		_, _ = msg.WriteTo(&buf)
+	}
+	return buf.Bytes()
+}
+
+// bufferConn is in-memory connection: reads from r and writes to w.
+type bufferConn struct {
+	r      io.Reader
+	w      bytes.Buffer
+	writes int
+}
+
+func (b *bufferConn) Read(p []byte) (int, error) {
+	return b.r.Read(p)
+}
+
+func (b *bufferConn) Write(p []byte) (int, error) {
+	b.writes++
+	return b.w.Write(p)
+}
+
+func (b *bufferConn) Close() error {
+	return nil
+}
+
+func Test_gssConn_Read(t *testing.T) {
+	tests := []struct {
+		name    string
+		raw     []byte
+		gssapi  GSSAPI
+		bufSize int
+		want    string
+		wantErr error
+	}{
+		{
+			name:    "token by small reads",
+			raw:     gssEncapsulate([]byte("hello world")),
+			gssapi:  xorGSSAPI{},
+			bufSize: 3,
+			want:    "hello world",
+		},
+		{
+			name:    "multiple tokens",
+			raw:     gssEncapsulate([]byte("hello"), []byte(" "), []byte("world")),
+			gssapi:  xorGSSAPI{},
+			bufSize: 100,
+			want:    "hello world",
+		},
+		{
+			name:    "empty token skipped",
+			raw:     gssEncapsulate([]byte("hello"), nil, []byte(" world")),
+			gssapi:  xorGSSAPI{},
+			bufSize: 4,
+			want:    "hello world",
+		},
+		{
+			name:    "decode error",
+			raw:     gssEncapsulate([]byte("hello")),
+			gssapi:  xorGSSAPI{err: errors.ErrUnsupported},
+			bufSize: 100,
+			wantErr: errors.ErrUnsupported,
+		},
+		{
+			name:    "invalid message type",
+			raw:     []byte{subnVersion, gssProtection, 0, 1, 0},
+			gssapi:  xorGSSAPI{},
+			bufSize: 100,
+			wantErr: errInvalidMessageType,
+		},
+		{
+			name:    "truncated",
+			raw:     gssEncapsulate([]byte("hello"))[:6],
+			gssapi:  xorGSSAPI{},
+			bufSize: 100,
+			wantErr: io.ErrUnexpectedEOF,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := newGSSConn(&bufferConn{r: bytes.NewReader(tt.raw)}, tt.gssapi, 0)
+
+			var (
+				got []byte
+				err error
+			)
+			buf := make([]byte, tt.bufSize)
+			for {
+				var n int
+				n, err = conn.Read(buf)
+				got = append(got, buf[:n]...)
+				if err != nil {
+					break
+				}
+			}
+
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("got error %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if !errors.Is(err, io.EOF) {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_gssConn_Write(t *testing.T) {
+	large := bytes.Repeat([]byte("x"), 1<<17)
+
+	tests := []struct {
+		name       string
+		payload    []byte
+		gssapi     GSSAPI
+		wantTokens int
+		wantErr    error
+	}{
+		{
+			name:       "small payload",
+			payload:    []byte("hello"),
+			gssapi:     xorGSSAPI{},
+			wantTokens: 1,
+		},
+		{
+			name:       "large payload",
+			payload:    large,
+			gssapi:     xorGSSAPI{},
+			wantTokens: 3,
+		},
+		{
+			name:    "encode error",
+			payload: []byte("hello"),
+			gssapi:  xorGSSAPI{err: errors.ErrUnsupported},
+			wantErr: errors.ErrUnsupported,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			raw := &bufferConn{}
+			conn := newGSSConn(raw, tt.gssapi, 0)
+
+			n, err := conn.Write(tt.payload)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if n != len(tt.payload) {
+				t.Errorf("got written %d, want %d", n, len(tt.payload))
+			}
+			if raw.writes != 1 {
+				t.Errorf("got %d raw writes, want tokens coalesced into 1", raw.writes)
+			}
+
+			// read it back
+			var (
+				got    []byte
+				tokens int
+				msg    gssapiMessage
+			)
+			for raw.w.Len() > 0 {
+				if _, err := msg.ReadFrom(&raw.w); err != nil {
+					t.Fatalf("read token: %v", err)
+				}
+				got = append(got, xor(msg.token)...)
+				tokens++
+			}
+			if tokens != tt.wantTokens {
+				t.Errorf("got %d tokens, want %d", tokens, tt.wantTokens)
+			}
+			if !bytes.Equal(got, tt.payload) {
+				t.Errorf("decoded payload differs from written one")
+			}
+		})
+	}
+}
+
+func Benchmark_gssConn(b *testing.B) {
+	for _, size := range []int{16, 1 << 10, 32 << 10} {
+		payload := bytes.Repeat([]byte("x"), size)
+
+		b.Run(fmt.Sprintf("read/%d", size), func(b *testing.B) {
+			raw := gssEncapsulate(payload)
+			reader := bytes.NewReader(raw)
+			conn := newGSSConn(&bufferConn{r: reader}, xorGSSAPI{}, 0)
+			buf := make([]byte, size)
+
+			b.SetBytes(int64(size))
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				reader.Reset(raw)
+				if _, err := io.ReadFull(conn, buf); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+
+		b.Run(fmt.Sprintf("write/%d", size), func(b *testing.B) {
+			raw := &bufferConn{}
+			conn := newGSSConn(raw, xorGSSAPI{}, 0)
+
+			b.SetBytes(int64(size))
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				raw.w.Reset()
+				if _, err := conn.Write(payload); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func Test_send(t *testing.T) {
+	tests := []struct {
+		name       string
+		conn       func(raw *bufferConn) io.ReadWriteCloser
+		msg        io.WriterTo
+		want       []byte
+		wantWrites int
+	}{
+		{
+			name: "buffered: single write",
+			conn: func(raw *bufferConn) io.ReadWriteCloser {
+				return newBufferedConn(raw)
+			},
+			msg: commandReply{
+				rep:         succeeded,
+				addressType: ipv4,
+				addr:        []byte{127, 0, 0, 1},
+				port:        1080,
+			},
+			want:       []byte{protoVersion, 0, 0, byte(ipv4), 127, 0, 0, 1, 0x04, 0x38},
+			wantWrites: 1,
+		},
+		{
+			name: "unbuffered: write per field",
+			conn: func(raw *bufferConn) io.ReadWriteCloser {
+				return raw
+			},
+			msg:        authReply{method: typeNoAuth},
+			want:       []byte{protoVersion, byte(typeNoAuth)},
+			wantWrites: 2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			raw := &bufferConn{}
+			if err := send(tt.conn(raw), tt.msg); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !bytes.Equal(raw.w.Bytes(), tt.want) {
+				t.Errorf("got %v, want %v", raw.w.Bytes(), tt.want)
+			}
+			if raw.writes != tt.wantWrites {
+				t.Errorf("got %d writes, want %d", raw.writes, tt.wantWrites)
+			}
+		})
+	}
+}
+
+func Test_sendPipelined(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("pending input is detected on linux only")
+	}
+
+	client, server := tcpPair(t)
+	defer client.Close()
+	defer server.Close()
+	_ = client.SetReadDeadline(time.Now().Add(time.Second))
+
+	conn := newBufferedConn(server)
+	methodReply := []byte{protoVersion, byte(typeLogin)}
+	loginBytes := []byte{subnVersion, byte(success)}
+
+	// the client waits for the reply
+	if err := sendPipelined(conn, authReply{method: typeLogin}); err != nil {
+		t.Fatalf("send method: %v", err)
+	}
+	buf := make([]byte, 64)
+	if n, err := client.Read(buf); err != nil || !bytes.Equal(buf[:n], methodReply) {
+		t.Fatalf("got % x, %v, want method reply at once", buf[:n], err)
+	}
+
+	// the client has pipelined the next message, so the reply is held
+	if _, err := client.Write([]byte("next")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	for deadline := time.Now().Add(time.Second); !conn.pending(); {
+		if time.Now().After(deadline) {
+			t.Fatal("client data hasn't arrived")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if err := sendPipelined(conn, loginReply{success}); err != nil {
+		t.Fatalf("send login: %v", err)
+	}
+	if !conn.held || conn.n != len(loginBytes) {
+		t.Fatalf("got %d buffered bytes (held %v), want login reply held", conn.n, conn.held)
+	}
+
+	// reading the pipelined message doesn't flush, the reply goes along with the next one
+	if _, err := io.ReadFull(conn, buf[:4]); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if !conn.held {
+		t.Fatal("reply flushed while pipelined data was read")
+	}
+	if err := sendPipelined(conn, authReply{method: typeNoAuth}); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+
+	want := append(loginBytes, protoVersion, byte(typeNoAuth))
+	if _, err := io.ReadFull(client, buf[:len(want)]); err != nil || !bytes.Equal(buf[:len(want)], want) {
+		t.Errorf("got % x, %v, want % x", buf[:len(want)], err, want)
+	}
+}
+
+func Test_bufferedConn_Read(t *testing.T) {
+	raw := &bufferConn{r: bytes.NewReader([]byte("request"))}
+	conn := newBufferedConn(raw)
+
+	// the held reply is flushed as nothing is pending on in-memory conn
+	if err := writeReply(conn, loginReply{success}); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	conn.held = true
+
+	if _, err := io.ReadFull(conn, make([]byte, 7)); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if got, want := raw.w.Bytes(), []byte{subnVersion, byte(success)}; !bytes.Equal(got, want) || conn.held {
+		t.Errorf("got % x written before read (held %v), want % x", got, conn.held, want)
+	}
+}
+
+func Test_unwrap(t *testing.T) {
+	raw := &bufferConn{}
+
+	if got := unwrap(newBufferedConn(raw)); got != raw {
+		t.Errorf("unwrap() of buffered conn = %v, want raw conn", got)
+	}
+	if got := unwrap(raw); got != raw {
+		t.Errorf("unwrap() of raw conn = %v, want raw conn", got)
+	}
+
+	client, server := tcpPair(t)
+	defer client.Close()
+	defer server.Close()
+
+	d := newNegotiationConn(server, time.Second, 0)
+	if got := unwrap(newBufferedConn(d)); got != io.ReadWriteCloser(d) {
+		t.Errorf("unwrap() of running negotiation conn = %v, want negotiation conn", got)
+	}
+	d.stop()
+	if got := unwrap(newBufferedConn(d)); got != io.ReadWriteCloser(server) {
+		t.Errorf("unwrap() of stopped negotiation conn = %v, want raw conn", got)
+	}
+}
+
+func Test_negotiationConn_timeout(t *testing.T) {
+	const timeout = 50 * time.Millisecond
+
+	client, server := tcpPair(t)
+	defer client.Close()
+	defer server.Close()
+
+	if newNegotiationConn(&bufferConn{}, timeout, 0) != nil {
+		t.Fatalf("newNegotiationConn() of conn without deadlines must be nil")
+	}
+
+	conn := newNegotiationConn(server, timeout, 0)
+	p := make([]byte, 2)
+
+	// dribbling client: the message isn't complete in time
+	if _, err := client.Write([]byte{1}); err != nil {
+		t.Fatalf("client write: %v", err)
+	}
+	if _, err := io.ReadFull(conn, p); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("read of incomplete message error = %v, want %v", err, os.ErrDeadlineExceeded)
+	}
+
+	// the reply re-arms deadline for the next message
+	if _, err := conn.Write([]byte{0}); err != nil {
+		t.Fatalf("reply: %v", err)
+	}
+	time.Sleep(timeout)
+	if _, err := client.Write([]byte{1, 2}); err != nil {
+		t.Fatalf("client write: %v", err)
+	}
+	if _, err := io.ReadFull(conn, p); err != nil {
+		t.Fatalf("read of message after reply: %v", err)
+	}
+
+	// no deadlines after negotiation
+	conn.stop()
+	go func() {
+		time.Sleep(2 * timeout)
+		_, _ = client.Write([]byte{3, 4})
+	}()
+	if _, err := io.ReadFull(conn, p); err != nil {
+		t.Fatalf("read after stop: %v", err)
+	}
+}
+
+func Test_negotiationConn_limit(t *testing.T) {
+	raw := &bufferConn{r: bytes.NewReader(bytes.Repeat([]byte{1}, 10))}
+	conn := newNegotiationConn(raw, 0, 4)
+
+	p := make([]byte, 8)
+	n, err := conn.Read(p)
+	if err != nil || n != 4 {
+		t.Fatalf("Read() = %d, %v, want 4 bytes up to the limit", n, err)
+	}
+	if _, err := conn.Read(p); !errors.Is(err, errNegotiationTooLarge) {
+		t.Fatalf("Read() past limit error = %v, want %v", err, errNegotiationTooLarge)
+	}
+
+	conn.stop()
+	if n, err := conn.Read(p); err != nil || n != 6 {
+		t.Fatalf("Read() after stop = %d, %v, want the rest 6 bytes", n, err)
+	}
+}
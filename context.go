@@ -0,0 +1,41 @@
+package proxyme
+
+import "context"
+
+type sessionKey struct{}
+
+// SessionFromContext returns the session of the context passed to AuthenticateContext and
+// GSSAPIContext callbacks: its ID and client address (Info.ClientAddr) and metadata (Info.Metadata).
+func SessionFromContext(ctx context.Context) (Session, bool) {
+	session, ok := ctx.Value(sessionKey{}).(Session)
+	return session, ok
+}
+
+// MetadataFromContext returns metadata of the session of the context passed to AuthenticateContext
+// and GSSAPIContext callbacks, nil if the context has no session.
+func MetadataFromContext(ctx context.Context) *Metadata {
+	session, ok := SessionFromContext(ctx)
+	if !ok {
+		return nil
+	}
+
+	return session.Info.Metadata
+}
+
+// authContext returns context of the authentication callbacks limited by AuthTimeout.
+func (s *state) authContext() (context.Context, context.CancelFunc) {
+	ctx := s.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	session := s.session
+	session.Info = s.info()
+	ctx = context.WithValue(ctx, sessionKey{}, session)
+
+	if s.opts.authTimeout > 0 {
+		return context.WithTimeout(ctx, s.opts.authTimeout)
+	}
+
+	return context.WithCancel(ctx)
+}
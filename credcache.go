@@ -0,0 +1,110 @@
+package proxyme
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dblokhin/proxyme/lru"
+)
+
+// defaultCredentialsCacheSize is the default number of verdicts kept by CachedCredentials.
+const defaultCredentialsCacheSize = 4096
+
+// CachedCredentials caches verdicts of Authenticate callback to spare slow backends (SQL, LDAP)
+// under heavy connection churn. Credentials are kept as SHA-256 digests only.
+// Use its Authenticate method as Options.Authenticate:
+//
+//	creds := &proxyme.CachedCredentials{Backend: checkLDAP, SuccessTTL: time.Minute, FailureTTL: 5 * time.Second}
+//	opts := proxyme.Options{Authenticate: creds.Authenticate}
+type CachedCredentials struct {
+	// Backend checks credentials on cache miss.
+	// REQUIRED.
+	Backend func(username, password []byte) error
+
+	// SuccessTTL is how long successful verdicts are cached, zero disables caching them.
+	// Password changes and revocations take effect after SuccessTTL.
+	SuccessTTL time.Duration
+
+	// FailureTTL is how long failed verdicts are cached, zero disables caching them.
+	// Only ErrInvalidCredentials failures are cached, other errors (backend outages) aren't.
+	FailureTTL time.Duration
+
+	// Size limits the number of cached verdicts.
+	// OPTIONAL, default 4096.
+	Size int
+
+	once   sync.Once
+	cache  *lru.Cache[[sha256.Size]byte, error] // nil error is successful verdict
+	hits   atomic.Uint64
+	misses atomic.Uint64
+}
+
+// CacheStats are hit/miss counters of a cache.
+type CacheStats struct {
+	Hits   uint64
+	Misses uint64
+}
+
+// HitRate returns ratio of hits to all lookups.
+func (s CacheStats) HitRate() float64 {
+	if s.Hits+s.Misses == 0 {
+		return 0
+	}
+
+	return float64(s.Hits) / float64(s.Hits+s.Misses)
+}
+
+// Authenticate returns cached verdict of the credentials or checks them with Backend.
+func (c *CachedCredentials) Authenticate(username, password []byte) error {
+	c.once.Do(func() {
+		size := c.Size
+		if size <= 0 {
+			size = defaultCredentialsCacheSize
+		}
+		c.cache = lru.New(lru.Options[[sha256.Size]byte, error]{Size: size})
+	})
+
+	key := credentialsKey(username, password)
+	if err, ok := c.cache.Get(key); ok {
+		c.hits.Add(1)
+		return err
+	}
+	c.misses.Add(1)
+
+	err := c.Backend(username, password)
+
+	ttl := c.SuccessTTL
+	if err != nil {
+		ttl = 0
+		if errors.Is(err, ErrInvalidCredentials) {
+			ttl = c.FailureTTL
+		}
+	}
+	if ttl > 0 {
+		c.cache.SetWithTTL(key, err, ttl)
+	}
+
+	return err
+}
+
+// Stats returns hit/miss counters of the cache.
+func (c *CachedCredentials) Stats() CacheStats {
+	return CacheStats{Hits: c.hits.Load(), Misses: c.misses.Load()}
+}
+
+// credentialsKey returns digest of the credentials, the length prefix separates username from password.
+func credentialsKey(username, password []byte) [sha256.Size]byte {
+	h := sha256.New()
+	_ = binary.Write(h, binary.BigEndian, uint32(len(username))) // nolint
+	_, _ = h.Write(username)
+	_, _ = h.Write(password)
+
+	var key [sha256.Size]byte
+	h.Sum(key[:0])
+
+	return key
+}
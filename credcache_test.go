@@ -0,0 +1,76 @@
+package proxyme
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestCachedCredentials_Authenticate(t *testing.T) {
+	errBackend := errors.New("backend is down")
+
+	tests := []struct {
+		name       string
+		successTTL time.Duration
+		failureTTL time.Duration
+		backendErr error
+		wantCalls  int
+	}{
+		{name: "success cached", successTTL: time.Minute, wantCalls: 1},
+		{name: "success isn't cached", failureTTL: time.Minute, wantCalls: 3},
+		{name: "failure cached", failureTTL: time.Minute, backendErr: ErrInvalidCredentials, wantCalls: 1},
+		{name: "failure isn't cached", successTTL: time.Minute, backendErr: ErrInvalidCredentials, wantCalls: 3},
+		{name: "backend errors aren't cached", successTTL: time.Minute, failureTTL: time.Minute, backendErr: errBackend, wantCalls: 3},
+		{name: "expired", successTTL: time.Nanosecond, wantCalls: 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			c := &CachedCredentials{
+				Backend: func(username, password []byte) error {
+					calls++
+					return tt.backendErr
+				},
+				SuccessTTL: tt.successTTL,
+				FailureTTL: tt.failureTTL,
+			}
+
+			for range 3 {
+				if err := c.Authenticate([]byte("user"), []byte("pass")); !errors.Is(err, tt.backendErr) {
+					t.Fatalf("Authenticate() error = %v, want %v", err, tt.backendErr)
+				}
+				time.Sleep(time.Millisecond)
+			}
+
+			if calls != tt.wantCalls {
+				t.Errorf("got %d backend calls, want %d", calls, tt.wantCalls)
+			}
+			if stats := c.Stats(); stats.Hits+stats.Misses != 3 || stats.Misses != uint64(tt.wantCalls) { // nolint
+				t.Errorf("got stats %+v, want %d misses of 3", stats, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestCachedCredentials_keys(t *testing.T) {
+	c := &CachedCredentials{
+		Backend:    StaticCredentials(map[string]string{"user": "pass"}),
+		SuccessTTL: time.Minute,
+		FailureTTL: time.Minute,
+	}
+
+	if err := c.Authenticate([]byte("user"), []byte("pass")); err != nil {
+		t.Fatal(err)
+	}
+	// other password of the same user isn't the cached verdict
+	if err := c.Authenticate([]byte("user"), []byte("wrong")); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("got error %v, want %v", err, ErrInvalidCredentials)
+	}
+	// username and password boundary matters
+	if err := c.Authenticate([]byte("use"), []byte("rpass")); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("got error %v, want %v", err, ErrInvalidCredentials)
+	}
+	if got := c.Stats().HitRate(); got != 0 {
+		t.Errorf("got hit rate %v, want 0", got)
+	}
+}
@@ -0,0 +1,26 @@
+// Package debugpprof registers runtime profiles of net/http/pprof on a custom mux, e.g. next to
+// the diagnostics of proxyme.Server:
+//
+//	mux := http.NewServeMux()
+//	srv.RegisterDebug(mux)
+//	debugpprof.Register(mux)
+//
+// Like any importer of net/http/pprof, the package registers the profiles on http.DefaultServeMux
+// too, that's why it's kept out of proxyme. Don't expose the mux publicly: profiles reveal internals
+// of the process.
+package debugpprof
+
+import (
+	"net/http"
+	"net/http/pprof"
+)
+
+// Register registers pprof handlers at /debug/pprof/ of the mux (compatible with go tool pprof):
+// /debug/pprof/ lists the profiles, /debug/pprof/<name> writes the named one.
+func Register(mux *http.ServeMux) {
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+}
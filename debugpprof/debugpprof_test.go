@@ -0,0 +1,39 @@
+package debugpprof
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRegister(t *testing.T) {
+	mux := http.NewServeMux()
+	Register(mux)
+
+	tests := []struct {
+		path     string
+		wantCode int
+		want     string
+	}{
+		{path: "/debug/pprof/", wantCode: http.StatusOK, want: "goroutine"},
+		{path: "/debug/pprof/goroutine?debug=1", wantCode: http.StatusOK, want: "goroutine profile"},
+		{path: "/debug/pprof/cmdline", wantCode: http.StatusOK, want: "debugpprof"},
+		{path: "/debug/pprof/unknown", wantCode: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tt.path, nil))
+
+			body, _ := io.ReadAll(w.Body)
+			if w.Code != tt.wantCode {
+				t.Fatalf("got code %d, want %d", w.Code, tt.wantCode)
+			}
+			if !strings.Contains(string(body), tt.want) {
+				t.Errorf("got body %q, want it containing %q", body, tt.want)
+			}
+		})
+	}
+}
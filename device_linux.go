@@ -0,0 +1,28 @@
+//go:build linux
+
+package proxyme
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// BindToDevice returns DialerControl binding sockets to the network interface (SO_BINDTODEVICE),
+// so connections egress via it regardless of the routing table. It's supported on Linux only
+// and may require CAP_NET_RAW.
+func BindToDevice(name string) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		var sockErr error
+		err := c.Control(func(fd uintptr) {
+			sockErr = syscall.SetsockoptString(int(fd), syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, name)
+		})
+		if err != nil {
+			return err
+		}
+		if sockErr != nil {
+			return fmt.Errorf("bind to device %s: %w", name, sockErr)
+		}
+
+		return nil
+	}
+}
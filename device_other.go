@@ -0,0 +1,18 @@
+//go:build !linux
+
+package proxyme
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+)
+
+// BindToDevice returns DialerControl binding sockets to the network interface (SO_BINDTODEVICE),
+// so connections egress via it regardless of the routing table. It's supported on Linux only:
+// elsewhere connections fail with errors.ErrUnsupported.
+func BindToDevice(name string) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		return fmt.Errorf("bind to device %s: %w", name, errors.ErrUnsupported)
+	}
+}
@@ -0,0 +1,70 @@
+package proxyme
+
+import (
+	"errors"
+	"net"
+	"runtime"
+	"syscall"
+	"testing"
+)
+
+func TestBindToDevice(t *testing.T) {
+	ls, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ls.Close() // nolint
+
+	tests := []struct {
+		name    string
+		device  string
+		wantErr bool
+	}{
+		{name: "loopback", device: "lo", wantErr: runtime.GOOS != "linux"},
+		{name: "unknown device", device: "nonexistent0", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dialer := net.Dialer{Control: BindToDevice(tt.device)}
+			conn, err := dialer.Dial("tcp", ls.Addr().String())
+			if errors.Is(err, syscall.EPERM) {
+				t.Skip("SO_BINDTODEVICE isn't permitted")
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Dial() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if conn != nil {
+				_ = conn.Close()
+			}
+		})
+	}
+}
+
+func TestNew_dialerControl(t *testing.T) {
+	ls, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ls.Close() // nolint
+
+	errControl := errors.New("control")
+	var address string
+	s, err := New(Options{
+		AllowNoAuth: true,
+		DialerControl: func(network, addr string, c syscall.RawConn) error {
+			address = addr
+			return errControl
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addr := ls.Addr().(*net.TCPAddr)
+	if _, err := s.connect(int(ipv4), addr.IP.To4(), addr.Port); !errors.Is(err, errControl) {
+		t.Errorf("connect() error = %v, want %v", err, errControl)
+	}
+	if address != ls.Addr().String() {
+		t.Errorf("got control of %q, want %q", address, ls.Addr().String())
+	}
+}
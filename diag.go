@@ -0,0 +1,226 @@
+package proxyme
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"runtime"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultStatsInterval = 10 * time.Second
+	defaultTopEntries    = 10
+	maxUserStats         = 10 // users of per-user stats
+)
+
+// MetricsSink receives gauges of the server, adapt it to Prometheus, StatsD, expvar etc.
+type MetricsSink interface {
+	Gauge(name string, value float64)
+}
+
+// Stats returns runtime stats of the process and the server: "goroutines", "conns" (open client
+// connections), "fds" (open file descriptors, Linux only), "stage.<name>" numbers of sessions
+// per state machine stage (see SOCKS5.Stages), "goroutines.sessions" and "goroutines.leaked"
+// (see SOCKS5.Goroutines), "spoofed.bind" and "spoofed.udp" (see SOCKS5.Spoofed), "rules.denied",
+// "rules.audited" and "rules.hits.<rule>" (see SOCKS5.RuleViolations and SOCKS5.RuleHits),
+// "tarpit.conns" (see SOCKS5.Tarpitted), "canary.hits" (see SOCKS5.CanaryHits), "auth.failures.<reason>"
+// (see SOCKS5.AuthFailures), "sessions.expired" (see SOCKS5.ExpiredSessions), "sessions.reaped" (see
+// SOCKS5.ReapedSessions), "users.sessions" and "users.queued" totals along with "users.sessions.<user>" and
+// "users.queued.<user>" of 10 users having the most sessions (see SOCKS5.UserSessions),
+// "replies.<status>" (see SOCKS5.Replies),
+// "sessions.total", "bytes.up", "bytes.down" and "errors.<stage>" (see SOCKS5.Snapshot), "udp.associations"
+// and "udp.dropped.<reason>" (see SOCKS5.UDPAssociations and SOCKS5.UDPDrops).
+func (s *Server) Stats() map[string]float64 {
+	s.mu.Lock()
+	conns := len(s.conns)
+	s.mu.Unlock()
+
+	stats := map[string]float64{
+		"goroutines": float64(runtime.NumGoroutine()),
+		"conns":      float64(conns),
+	}
+	if fds, ok := openFDs(); ok {
+		stats["fds"] = float64(fds)
+	}
+	if s.SOCKS5 != nil {
+		for name, n := range s.SOCKS5.Stages() {
+			stats["stage."+name] = float64(n)
+		}
+
+		live, leaked := s.SOCKS5.Goroutines()
+		stats["goroutines.sessions"] = float64(live)
+		stats["goroutines.leaked"] = float64(leaked)
+
+		bindPeers, datagrams := s.SOCKS5.Spoofed()
+		stats["spoofed.bind"] = float64(bindPeers)
+		stats["spoofed.udp"] = float64(datagrams)
+
+		denied, audited := s.SOCKS5.RuleViolations()
+		stats["rules.denied"] = float64(denied)
+		stats["rules.audited"] = float64(audited)
+		for rule, n := range s.SOCKS5.RuleHits() {
+			stats["rules.hits."+rule] = float64(n)
+		}
+
+		stats["tarpit.conns"] = float64(s.SOCKS5.Tarpitted())
+		stats["canary.hits"] = float64(s.SOCKS5.CanaryHits())
+		stats["sessions.expired"] = float64(s.SOCKS5.ExpiredSessions())
+		stats["sessions.reaped"] = float64(s.SOCKS5.ReapedSessions())
+		for status, n := range s.SOCKS5.Replies() {
+			stats["replies."+strconv.Itoa(status)] = float64(n)
+		}
+		if users := s.SOCKS5.UserSessions(); users != nil {
+			var active, queued int
+			for _, usage := range users {
+				active += usage.Active
+				queued += usage.Queued
+			}
+			stats["users.sessions"] = float64(active)
+			stats["users.queued"] = float64(queued)
+
+			// per-user keys are capped, sinks keep every key they have seen
+			for _, user := range busiestUsers(users, maxUserStats) {
+				stats["users.sessions."+user] = float64(users[user].Active)
+				stats["users.queued."+user] = float64(users[user].Queued)
+			}
+		}
+		for reason, n := range s.SOCKS5.AuthFailures() {
+			stats["auth.failures."+string(reason)] = float64(n)
+		}
+
+		snapshot := s.SOCKS5.Snapshot()
+		stats["sessions.total"] = float64(snapshot.Sessions)
+		stats["bytes.up"] = float64(snapshot.BytesUp)
+		stats["bytes.down"] = float64(snapshot.BytesDown)
+		for st, n := range snapshot.Errors {
+			stats["errors."+st] = float64(n)
+		}
+
+		stats["udp.associations"] = float64(s.SOCKS5.UDPAssociations())
+		for reason, n := range s.SOCKS5.UDPDrops() {
+			stats["udp.dropped."+reason] = float64(n)
+		}
+	}
+
+	return stats
+}
+
+// busiestUsers returns up to n users having the most sessions, active and queued ones.
+func busiestUsers(users map[string]UserSessions, n int) []string {
+	names := make([]string, 0, len(users))
+	for user := range users {
+		names = append(names, user)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		a, b := users[names[i]], users[names[j]]
+		if a.Active+a.Queued != b.Active+b.Queued {
+			return a.Active+a.Queued > b.Active+b.Queued
+		}
+		return names[i] < names[j]
+	})
+
+	return names[:min(n, len(names))]
+}
+
+// reportStats reports Stats to Metrics until the server stops serving.
+func (s *Server) reportStats() {
+	interval := s.StatsInterval
+	if interval <= 0 {
+		interval = defaultStatsInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	metrics := s.Metrics
+	for {
+		for name, value := range s.Stats() {
+			metrics.Gauge(name, value)
+		}
+
+		<-ticker.C
+
+		s.mu.Lock()
+		if s.closed || len(s.listeners) == 0 {
+			s.reporting = false
+			s.mu.Unlock()
+			return
+		}
+		s.mu.Unlock()
+	}
+}
+
+// openFDs returns number of open file descriptors of the process.
+func openFDs() (int, bool) {
+	entries, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		return 0, false
+	}
+
+	return len(entries), true
+}
+
+// RegisterDebug registers diagnostics handlers on the mux: dump of Stats at /debug/proxyme/stats,
+// SOCKS5.TopStats at /debug/proxyme/top?n=N (10 entries by default) and SOCKS5.Events at
+// /debug/proxyme/events?client=IP&session=N (both filters are optional). Don't expose the mux
+// publicly: events reveal clients and destinations. Register pprof profiles on the same mux
+// with debugpprof package.
+func (s *Server) RegisterDebug(mux *http.ServeMux) {
+	mux.HandleFunc("/debug/proxyme/stats", func(w http.ResponseWriter, r *http.Request) {
+		stats := s.Stats()
+
+		names := make([]string, 0, len(stats))
+		for name := range stats {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		for _, name := range names {
+			_, _ = fmt.Fprintf(w, "%s %v\n", name, stats[name])
+		}
+	})
+	mux.HandleFunc("/debug/proxyme/top", func(w http.ResponseWriter, r *http.Request) {
+		n, err := strconv.Atoi(r.URL.Query().Get("n"))
+		if err != nil || n <= 0 {
+			n = defaultTopEntries
+		}
+
+		var top TopStats
+		if s.SOCKS5 != nil {
+			top = s.SOCKS5.TopStats(n)
+		}
+
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		for _, e := range top.Destinations {
+			_, _ = fmt.Fprintf(w, "destination %s %d\n", e.Key, e.Count)
+		}
+		for _, e := range top.Users {
+			_, _ = fmt.Fprintf(w, "user %s %d\n", e.Key, e.Count)
+		}
+	})
+	mux.HandleFunc("/debug/proxyme/events", func(w http.ResponseWriter, r *http.Request) {
+		var events []Event
+		if s.SOCKS5 != nil {
+			events = s.SOCKS5.Events()
+		}
+
+		client := r.URL.Query().Get("client")
+		session, _ := strconv.ParseUint(r.URL.Query().Get("session"), 10, 64)
+
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		for _, e := range events {
+			if host, _, _ := net.SplitHostPort(e.Client); client != "" && e.Client != client && host != client {
+				continue
+			}
+			if session != 0 && e.Session != session {
+				continue
+			}
+			_, _ = fmt.Fprintln(w, e)
+		}
+	})
+}
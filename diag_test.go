@@ -0,0 +1,155 @@
+package proxyme
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type gaugeRecorder struct {
+	mu     sync.Mutex
+	gauges map[string]float64
+}
+
+func (r *gaugeRecorder) Gauge(name string, value float64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.gauges == nil {
+		r.gauges = make(map[string]float64)
+	}
+	r.gauges[name] = value
+}
+
+func (r *gaugeRecorder) get(name string) (float64, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	v, ok := r.gauges[name]
+	return v, ok
+}
+
+func TestServer_Metrics(t *testing.T) {
+	socks5, err := New(Options{AllowNoAuth: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var rec gaugeRecorder
+	srv := &Server{SOCKS5: socks5, Metrics: &rec, StatsInterval: 10 * time.Millisecond}
+	defer srv.Close() // nolint
+
+	ls, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(ls) // nolint
+
+	conn, err := net.Dial("tcp", ls.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close() // nolint
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		conns, _ := rec.get("conns")
+		greeting, _ := rec.get("stage.greeting")
+		if conns == 1 && greeting == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got conns %v at greeting %v, want the client connection", conns, greeting)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if v, ok := rec.get("goroutines"); !ok || v <= 0 {
+		t.Errorf("got goroutines gauge %v, %v", v, ok)
+	}
+}
+
+func Test_busiestUsers(t *testing.T) {
+	users := map[string]UserSessions{
+		"alice": {Active: 1},
+		"bob":   {Active: 2, Queued: 3},
+		"carol": {Active: 2},
+		"dave":  {Active: 1, Queued: 1},
+	}
+
+	tests := []struct {
+		name string
+		n    int
+		want []string
+	}{
+		{name: "capped", n: 2, want: []string{"bob", "carol"}},
+		{name: "ties by name", n: 3, want: []string{"bob", "carol", "dave"}},
+		{name: "all", n: 10, want: []string{"bob", "carol", "dave", "alice"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := busiestUsers(users, tt.n); !slices.Equal(got, tt.want) {
+				t.Errorf("busiestUsers() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestServer_RegisterDebug(t *testing.T) {
+	srv := &Server{SOCKS5: &SOCKS5{stages: &stageCounts{}, replies: &replyCounts{}, topStats: newTopStats(10, 0),
+		events: newEventLog(10), userSlots: newUserSlots(2, 0)}}
+	srv.SOCKS5.topStats.request("example.com:443")
+	for range 2 {
+		if _, err := srv.SOCKS5.userSlots.acquire(context.Background(), "alice"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	srv.SOCKS5.replies.add(notAllowed)
+	srv.SOCKS5.events.add(Event{Session: 1, Client: "10.0.0.1:5000", Kind: EventAccepted})
+	srv.SOCKS5.events.add(Event{Session: 2, Client: "10.0.0.2:5000", Kind: EventError, Detail: "sock read: EOF"})
+
+	mux := http.NewServeMux()
+	srv.RegisterDebug(mux)
+
+	tests := []struct {
+		path     string
+		wantCode int
+		want     string
+		wantNot  string
+	}{
+		{path: "/debug/proxyme/stats", wantCode: http.StatusOK, want: "stage.relay 0"},
+		{path: "/debug/proxyme/stats", wantCode: http.StatusOK, want: "goroutines.leaked 0"},
+		{path: "/debug/proxyme/stats", wantCode: http.StatusOK, want: "replies.2 1"},
+		{path: "/debug/proxyme/stats", wantCode: http.StatusOK, want: "users.sessions 2"},
+		{path: "/debug/proxyme/stats", wantCode: http.StatusOK, want: "users.sessions.alice 2"},
+		{path: "/debug/proxyme/top?n=5", wantCode: http.StatusOK, want: "destination example.com:443 1"},
+		{path: "/debug/proxyme/events", wantCode: http.StatusOK, want: "#2 10.0.0.2:5000 error sock read: EOF"},
+		{path: "/debug/proxyme/events?client=10.0.0.1", wantCode: http.StatusOK, want: "#1 10.0.0.1:5000 accepted",
+			wantNot: "10.0.0.2"},
+		{path: "/debug/proxyme/events?session=2", wantCode: http.StatusOK, want: "#2", wantNot: "#1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tt.path, nil))
+
+			body, _ := io.ReadAll(w.Body)
+			if w.Code != tt.wantCode {
+				t.Fatalf("got code %d, want %d", w.Code, tt.wantCode)
+			}
+			if !strings.Contains(string(body), tt.want) {
+				t.Errorf("got body %q, want it containing %q", body, tt.want)
+			}
+			if tt.wantNot != "" && strings.Contains(string(body), tt.wantNot) {
+				t.Errorf("got body %q, want it not containing %q", body, tt.wantNot)
+			}
+		})
+	}
+}
@@ -0,0 +1,163 @@
+package proxyme
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"strings"
+
+	"github.com/dblokhin/proxyme/wire"
+)
+
+const (
+	// dnsPort is the destination port of intercepted DNS queries (see Options.UDPInterceptDNS).
+	dnsPort = 53
+	// dnsHeaderSize is the size of DNS message header.
+	dnsHeaderSize = 12
+	// dnsAnswerTTL is TTL of intercepted answers in seconds.
+	dnsAnswerTTL = 60
+)
+
+// DNS query types, classes and response codes (RFC 1035, RFC 3596)
+const (
+	dnsTypeA    = 1
+	dnsTypeAAAA = 28
+	dnsClassIN  = 1
+
+	dnsRcodeServFail = 2
+	dnsRcodeRefused  = 5
+)
+
+var errDNSQuery = errors.New("invalid dns query")
+
+// dnsQuery is the DNS query of a single question.
+type dnsQuery struct {
+	id       uint16
+	flags    uint16
+	name     string // queried name without the trailing dot
+	qtype    uint16
+	qclass   uint16
+	question []byte // the question section as is, it's echoed in the reply
+}
+
+// parseDNSQuery parses the standard query of a single question, compression isn't allowed
+// in questions of queries.
+func parseDNSQuery(b []byte) (dnsQuery, error) {
+	if len(b) < dnsHeaderSize {
+		return dnsQuery{}, errDNSQuery
+	}
+
+	q := dnsQuery{
+		id:    binary.BigEndian.Uint16(b),
+		flags: binary.BigEndian.Uint16(b[2:]),
+	}
+	// QR is set, OPCODE isn't QUERY or the number of questions isn't 1
+	if q.flags&0x8000 != 0 || q.flags&0x7800 != 0 || binary.BigEndian.Uint16(b[4:]) != 1 {
+		return dnsQuery{}, errDNSQuery
+	}
+
+	var name strings.Builder
+	i := dnsHeaderSize
+	for {
+		if i >= len(b) {
+			return dnsQuery{}, errDNSQuery
+		}
+		size := int(b[i])
+		i++
+		if size == 0 {
+			break
+		}
+		if size > 63 || i+size > len(b) || name.Len()+size+1 > maxDomainSize {
+			return dnsQuery{}, errDNSQuery
+		}
+		if name.Len() > 0 {
+			name.WriteByte('.')
+		}
+		name.Write(b[i : i+size])
+		i += size
+	}
+	if i+4 > len(b) || name.Len() == 0 {
+		return dnsQuery{}, errDNSQuery
+	}
+
+	q.name = name.String()
+	q.qtype = binary.BigEndian.Uint16(b[i:])
+	q.qclass = binary.BigEndian.Uint16(b[i+2:])
+	q.question = b[dnsHeaderSize : i+4]
+
+	return q, nil
+}
+
+// intercepted reports whether the proxy answers the query itself: A and AAAA queries of internet class.
+func (q dnsQuery) intercepted() bool {
+	return q.qclass == dnsClassIN && (q.qtype == dnsTypeA || q.qtype == dnsTypeAAAA)
+}
+
+// appendDNSReply appends the reply to the query of the rcode and the addresses of the queried type.
+func appendDNSReply(b []byte, q dnsQuery, rcode int, ips []net.IP) []byte {
+	var answers [][]byte
+	for _, ip := range ips {
+		if ip4 := ip.To4(); ip4 != nil && q.qtype == dnsTypeA {
+			answers = append(answers, ip4)
+		} else if ip4 == nil && len(ip) == net.IPv6len && q.qtype == dnsTypeAAAA {
+			answers = append(answers, ip)
+		}
+	}
+
+	// QR, the query's OPCODE and RD, RA
+	flags := 0x8000 | q.flags&0x7900 | 0x0080 | uint16(rcode) // nolint
+	b = binary.BigEndian.AppendUint16(b, q.id)
+	b = binary.BigEndian.AppendUint16(b, flags)
+	b = binary.BigEndian.AppendUint16(b, 1)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(answers))) // nolint
+	b = binary.BigEndian.AppendUint16(b, 0)
+	b = binary.BigEndian.AppendUint16(b, 0)
+	b = append(b, q.question...)
+
+	for _, rdata := range answers {
+		b = append(b, 0xc0, dnsHeaderSize) // pointer to the name of the question
+		b = binary.BigEndian.AppendUint16(b, q.qtype)
+		b = binary.BigEndian.AppendUint16(b, dnsClassIN)
+		b = binary.BigEndian.AppendUint32(b, dnsAnswerTTL)
+		b = binary.BigEndian.AppendUint16(b, uint16(len(rdata))) // nolint
+		b = append(b, rdata...)
+	}
+
+	return b
+}
+
+// interceptDNS answers the DNS query of the datagram sent to port 53 from the resolver of the proxy:
+// queried names are checked against the rules as destinations, denied ones are refused. The reply
+// datagram is appended to b, ok is false if the datagram is relayed as usual (not a query the proxy
+// answers to, or a query of other type of the allowed name).
+func (a *udpAssociation) interceptDNS(b []byte, d wire.Datagram) ([]byte, bool) {
+	q, err := parseDNSQuery(d.Data)
+	if err != nil {
+		return b, false
+	}
+
+	state := a.state
+	info := state.info()
+	info.AddressType, info.Addr, info.Port = int(domainName), []byte(q.name), int(d.Port)
+
+	rcode := 0
+	var ips []net.IP
+	if resolved, err := state.opts.resolver.resolve(q.name); err != nil {
+		rcode = dnsRcodeServFail
+	} else {
+		ips, info.ResolvedIPs = resolved, resolved
+	}
+
+	if state.opts.rules != nil && enforceRules(state, info) != nil {
+		rcode, ips = dnsRcodeRefused, nil
+	} else if !q.intercepted() {
+		return b, false
+	}
+
+	reply := wire.Datagram{Address: d.Address}
+	if b, err = reply.AppendTo(b); err != nil {
+		return b, false
+	}
+
+	return appendDNSReply(b, q, rcode, ips), true
+}
@@ -0,0 +1,114 @@
+package proxyme
+
+import (
+	"encoding/binary"
+	"net"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// dnsQueryMessage returns the standard query of the name.
+func dnsQueryMessage(id uint16, name string, qtype uint16) []byte {
+	b := binary.BigEndian.AppendUint16(nil, id)
+	b = append(b, 0x01, 0x00, 0, 1, 0, 0, 0, 0, 0, 0) // RD, one question
+	for len(name) > 0 {
+		label := name
+		if i := strings.IndexByte(name, '.'); i >= 0 {
+			label, name = name[:i], name[i+1:]
+		} else {
+			name = ""
+		}
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+	}
+	b = append(b, 0)
+	b = binary.BigEndian.AppendUint16(b, qtype)
+	return binary.BigEndian.AppendUint16(b, dnsClassIN)
+}
+
+func Test_parseDNSQuery(t *testing.T) {
+	query := dnsQueryMessage(7, "example.com", dnsTypeA)
+	response := slices.Clone(query)
+	response[2] |= 0x80
+	twoQuestions := slices.Clone(query)
+	twoQuestions[5] = 2
+
+	tests := []struct {
+		name      string
+		msg       []byte
+		wantName  string
+		wantQtype uint16
+		wantErr   bool
+	}{
+		{name: "A query", msg: query, wantName: "example.com", wantQtype: dnsTypeA},
+		{name: "AAAA query", msg: dnsQueryMessage(7, "example.com", dnsTypeAAAA), wantName: "example.com", wantQtype: dnsTypeAAAA},
+		{name: "short header", msg: query[:8], wantErr: true},
+		{name: "truncated question", msg: query[:len(query)-2], wantErr: true},
+		{name: "truncated name", msg: query[:16], wantErr: true},
+		{name: "response", msg: response, wantErr: true},
+		{name: "two questions", msg: twoQuestions, wantErr: true},
+		{name: "root name", msg: dnsQueryMessage(7, "", dnsTypeA), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q, err := parseDNSQuery(tt.msg)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseDNSQuery() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && (q.name != tt.wantName || q.qtype != tt.wantQtype || q.id != 7) {
+				t.Errorf("parseDNSQuery() = %+v, want %s of type %d", q, tt.wantName, tt.wantQtype)
+			}
+		})
+	}
+}
+
+func Test_appendDNSReply(t *testing.T) {
+	ips := []net.IP{net.IPv4(192, 0, 2, 1), net.ParseIP("2001:db8::1"), net.IPv4(192, 0, 2, 2)}
+
+	tests := []struct {
+		name        string
+		qtype       uint16
+		rcode       int
+		wantAnswers []net.IP
+	}{
+		{name: "A", qtype: dnsTypeA, wantAnswers: []net.IP{ips[0].To4(), ips[2].To4()}},
+		{name: "AAAA", qtype: dnsTypeAAAA, wantAnswers: []net.IP{ips[1]}},
+		{name: "refused", qtype: dnsTypeA, rcode: dnsRcodeRefused},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := dnsQueryMessage(7, "example.com", tt.qtype)
+			q, err := parseDNSQuery(msg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			answerIPs := ips
+			if tt.rcode != 0 {
+				answerIPs = nil
+			}
+
+			b := appendDNSReply(nil, q, tt.rcode, answerIPs)
+			if id, flags := binary.BigEndian.Uint16(b), binary.BigEndian.Uint16(b[2:]); id != 7 ||
+				flags != 0x8180|uint16(tt.rcode) {
+				t.Fatalf("got id %d, flags %#x", id, flags)
+			}
+			if n := int(binary.BigEndian.Uint16(b[6:])); n != len(tt.wantAnswers) {
+				t.Fatalf("got %d answers, want %d", n, len(tt.wantAnswers))
+			}
+
+			// answers follow the question: name pointer, type, class, ttl, rdlength and rdata
+			rest := b[len(msg):]
+			for _, want := range tt.wantAnswers {
+				size := int(binary.BigEndian.Uint16(rest[10:]))
+				if got := net.IP(rest[12 : 12+size]); !got.Equal(want) || size != len(want) {
+					t.Errorf("got answer %v, want %v", got, want)
+				}
+				rest = rest[12+size:]
+			}
+			if len(rest) != 0 {
+				t.Errorf("got %d trailing bytes", len(rest))
+			}
+		})
+	}
+}
@@ -0,0 +1,78 @@
+package proxyme
+
+import (
+	"fmt"
+	"io"
+	"net"
+)
+
+// maxEarlyDataSize bounds early data forwarded ahead of the CONNECT reply: a full TLS record.
+const maxEarlyDataSize = 16<<10 + 5
+
+// ErrEarlyData rejects CONNECT requests followed by data sent before the reply (see EarlyDataReject).
+var ErrEarlyData = fmt.Errorf("%w: data sent before the command reply", ErrNotAllowed)
+
+// EarlyData selects how data the client sends after the CONNECT request without waiting for
+// the reply is handled, e.g. TLS ClientHello of clients pipelining optimistically. Early data is
+// detected where the server can peek into the socket (Linux) and only the data which has arrived
+// along with the request, later data is relayed as usual.
+type EarlyData int
+
+const (
+	// EarlyDataRelay leaves early data in the socket: it's relayed once the reply is sent.
+	EarlyDataRelay EarlyData = iota
+
+	// EarlyDataForward reads early data (up to a TLS record) and writes it to the destination right
+	// after connecting, before the reply is sent, so the destination gets e.g. ClientHello a round
+	// trip earlier. Sessions taken over by OnEstablished or wrapped by Filter get early data in
+	// the client stream instead, as with EarlyDataRelay.
+	EarlyDataForward
+
+	// EarlyDataReject enforces a single command per exchange: CONNECT requests followed by early data
+	// are rejected with notAllowed status and ErrEarlyData is reported to onError of Handle.
+	EarlyDataReject
+)
+
+// takeEarlyData checks the client for early data before connecting, it returns the data to forward
+// to the destination.
+func takeEarlyData(state *state) ([]byte, error) {
+	if state.opts.earlyData == EarlyDataRelay {
+		return nil, nil
+	}
+
+	conn := socket(state.conn)
+	n := inputQueued(conn)
+	switch {
+	case n == 0:
+		return nil, nil
+	case state.opts.earlyData == EarlyDataReject:
+		state.status = notAllowed
+		return nil, ErrEarlyData
+	case state.opts.onEstablished != nil || state.opts.filter != nil:
+		// the hooks see the client stream as is
+		return nil, nil
+	}
+
+	early := make([]byte, min(n, maxEarlyDataSize))
+	if _, err := io.ReadFull(conn, early); err != nil {
+		return nil, fmt.Errorf("sock read: %w", err)
+	}
+
+	return early, nil
+}
+
+// forwardEarlyData writes early data of the client to the connected destination, the connection is
+// closed on failure.
+func forwardEarlyData(state *state, conn net.Conn) error {
+	if len(state.early) == 0 {
+		return nil
+	}
+
+	if _, err := conn.Write(state.early); err != nil {
+		_ = conn.Close()
+		state.status = sockFailure
+		return fmt.Errorf("early data: %w", err)
+	}
+
+	return nil
+}
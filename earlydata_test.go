@@ -0,0 +1,84 @@
+package proxyme
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func Test_takeEarlyData(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("pending input is detected on linux only")
+	}
+
+	tests := []struct {
+		name       string
+		mode       EarlyData
+		filter     bool
+		send       []byte
+		want       []byte
+		wantErr    error
+		wantQueued bool // early data is left in the socket
+	}{
+		{name: "relay", mode: EarlyDataRelay, send: []byte("hello"), wantQueued: true},
+		{name: "forward", mode: EarlyDataForward, send: []byte("hello"), want: []byte("hello")},
+		{name: "forward without early data", mode: EarlyDataForward},
+		{name: "forward through filter", mode: EarlyDataForward, filter: true, send: []byte("hello"), wantQueued: true},
+		{name: "forward up to a record", mode: EarlyDataForward, send: bytes.Repeat([]byte("x"), maxEarlyDataSize+1),
+			want: bytes.Repeat([]byte("x"), maxEarlyDataSize), wantQueued: true},
+		{name: "reject", mode: EarlyDataReject, send: []byte("hello"), wantErr: ErrEarlyData, wantQueued: true},
+		{name: "reject without early data", mode: EarlyDataReject},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := tcpPair(t)
+			defer client.Close()
+			defer server.Close()
+
+			s := &state{conn: newBufferedConn(server), opts: SOCKS5{earlyData: tt.mode}}
+			if tt.filter {
+				s.opts.filter = func(SessionInfo) (StreamFilter, error) { return nil, nil }
+			}
+
+			if len(tt.send) > 0 {
+				if _, err := client.Write(tt.send); err != nil {
+					t.Fatalf("write: %v", err)
+				}
+				for deadline := time.Now().Add(time.Second); inputQueued(server) < len(tt.send); {
+					if time.Now().After(deadline) {
+						t.Fatal("client data hasn't arrived")
+					}
+					time.Sleep(time.Millisecond)
+				}
+			}
+
+			got, err := takeEarlyData(s)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("takeEarlyData() error = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil && s.status != notAllowed {
+				t.Errorf("got status %v, want not allowed", s.status)
+			}
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("takeEarlyData() = %d bytes, want %d", len(got), len(tt.want))
+			}
+			if queued := inputQueued(server) > 0; queued != tt.wantQueued {
+				t.Errorf("data left in the socket %v, want %v", queued, tt.wantQueued)
+			}
+		})
+	}
+}
+
+func Test_socket(t *testing.T) {
+	client, server := tcpPair(t)
+	defer client.Close()
+	defer server.Close()
+
+	conn := newBufferedConn(newNegotiationConn(server, time.Second, 0))
+	if got := socket(conn); got != io.ReadWriteCloser(server) {
+		t.Errorf("socket() = %T, want the client connection", got)
+	}
+}
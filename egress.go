@@ -0,0 +1,108 @@
+package proxyme
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"net"
+	"strconv"
+	"time"
+)
+
+// Affinity is the key sessions stick to an egress of EgressPool by.
+type Affinity int
+
+const (
+	// AffinityUser sticks sessions of the same username (client IP for anonymous clients).
+	AffinityUser Affinity = iota
+
+	// AffinityDestination sticks sessions to the same destination host.
+	AffinityDestination
+)
+
+// EgressPool is Router spreading sessions over the pool of egresses with consistent (rendezvous)
+// hashing of the affinity key: repeated sessions of the same user or destination exit via the same
+// egress, which matters for sites flagging IP hopping. Changing the pool moves only sessions of
+// added or removed egresses. Egresses are identified by LocalIP, ones without it by the position.
+//
+// If TTL is set, the key is re-balanced to the other egress of the pool once per TTL, moments of
+// re-balancing are spread over the TTL so keys don't move all together.
+// Empty pool routes sessions with Options.Connect.
+type EgressPool struct {
+	Egresses []Egress
+	Affinity Affinity
+	TTL      time.Duration
+}
+
+func (p EgressPool) Route(info SessionInfo) (Egress, error) {
+	return p.pick(p.key(info), time.Now()), nil
+}
+
+// key returns affinity key of the session.
+func (p EgressPool) key(info SessionInfo) string {
+	if p.Affinity == AffinityDestination {
+		host, _, err := net.SplitHostPort(info.Destination())
+		if err != nil {
+			return info.Destination()
+		}
+		return host
+	}
+
+	if info.Username != "" {
+		return "user:" + info.Username
+	}
+	if ip := addrIP(info.ClientAddr); ip != nil {
+		return "ip:" + ip.String()
+	}
+
+	return ""
+}
+
+// pick returns egress of the key at the moment.
+func (p EgressPool) pick(key string, now time.Time) Egress {
+	if len(p.Egresses) == 0 {
+		return Egress{}
+	}
+
+	var epoch uint64
+	if p.TTL > 0 {
+		// the offset staggers re-balancing of keys over the TTL
+		offset := hashKey(key, "", 0) % uint64(p.TTL)
+		epoch = (uint64(now.UnixNano()) + offset) / uint64(p.TTL) // nolint
+	}
+
+	var (
+		best   int
+		weight uint64
+	)
+	for i, egress := range p.Egresses {
+		id := strconv.Itoa(i)
+		if egress.LocalIP != nil {
+			id = egress.LocalIP.String()
+		}
+
+		if w := hashKey(key, id, epoch); i == 0 || w > weight {
+			best, weight = i, w
+		}
+	}
+
+	return p.Egresses[best]
+}
+
+// hashKey returns rendezvous hashing weight of the key for the egress id.
+func hashKey(key, id string, epoch uint64) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(key))
+	_, _ = h.Write([]byte{0})
+	_, _ = h.Write([]byte(id))
+	_ = binary.Write(h, binary.BigEndian, epoch)
+
+	// splitmix64 finalizer: trailing bytes of FNV barely change the high bits
+	x := h.Sum64()
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+
+	return x
+}
@@ -0,0 +1,125 @@
+package proxyme
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func testPool(n int) []Egress {
+	pool := make([]Egress, n)
+	for i := range pool {
+		pool[i] = Egress{LocalIP: net.IPv4(192, 0, 2, byte(i+1))}
+	}
+	return pool
+}
+
+func TestEgressPool_key(t *testing.T) {
+	client := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 5555}
+
+	tests := []struct {
+		name     string
+		affinity Affinity
+		info     SessionInfo
+		want     string
+	}{
+		{
+			name: "user",
+			info: SessionInfo{Username: "alice", ClientAddr: client},
+			want: "user:alice",
+		},
+		{
+			name: "anonymous user",
+			info: SessionInfo{ClientAddr: client},
+			want: "ip:10.0.0.1",
+		},
+		{
+			name:     "destination domain",
+			affinity: AffinityDestination,
+			info:     SessionInfo{AddressType: int(domainName), Addr: []byte("example.com"), Port: 443},
+			want:     "example.com",
+		},
+		{
+			name:     "destination ip",
+			affinity: AffinityDestination,
+			info:     SessionInfo{AddressType: int(ipv4), Addr: []byte{1, 2, 3, 4}, Port: 80},
+			want:     "1.2.3.4",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := EgressPool{Affinity: tt.affinity}
+			if got := p.key(tt.info); got != tt.want {
+				t.Errorf("key() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEgressPool_pick(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	keys := make([]string, 200)
+	for i := range keys {
+		keys[i] = "user:" + string(rune('a'+i%26)) + string(rune('a'+i/26))
+	}
+
+	t.Run("sticky", func(t *testing.T) {
+		p := EgressPool{Egresses: testPool(4)}
+		for _, key := range keys {
+			if a, b := p.pick(key, now), p.pick(key, now.Add(time.Hour)); !a.LocalIP.Equal(b.LocalIP) {
+				t.Fatalf("key %s moved from %v to %v", key, a.LocalIP, b.LocalIP)
+			}
+		}
+	})
+
+	t.Run("spread", func(t *testing.T) {
+		p := EgressPool{Egresses: testPool(4)}
+		used := make(map[string]int)
+		for _, key := range keys {
+			used[p.pick(key, now).LocalIP.String()]++
+		}
+		if len(used) != 4 {
+			t.Fatalf("got egresses %v, want all of 4", used)
+		}
+	})
+
+	t.Run("removal moves keys of removed egress only", func(t *testing.T) {
+		full := EgressPool{Egresses: testPool(4)}
+		reduced := EgressPool{Egresses: full.Egresses[1:]}
+		for _, key := range keys {
+			before, after := full.pick(key, now), reduced.pick(key, now)
+			if !before.LocalIP.Equal(full.Egresses[0].LocalIP) && !before.LocalIP.Equal(after.LocalIP) {
+				t.Fatalf("key %s moved from %v to %v", key, before.LocalIP, after.LocalIP)
+			}
+		}
+	})
+
+	t.Run("ttl re-balancing", func(t *testing.T) {
+		p := EgressPool{Egresses: testPool(4), TTL: time.Minute}
+
+		var moved, movedEarly int
+		for _, key := range keys {
+			a := p.pick(key, now)
+			if b := p.pick(key, now.Add(p.TTL)); !a.LocalIP.Equal(b.LocalIP) {
+				moved++
+			}
+			if b := p.pick(key, now.Add(time.Second)); !a.LocalIP.Equal(b.LocalIP) {
+				movedEarly++
+			}
+		}
+		// every key crosses the epoch boundary within TTL, 3/4 of them change egress
+		if moved < len(keys)/2 {
+			t.Errorf("got %d of %d keys re-balanced within TTL", moved, len(keys))
+		}
+		// boundaries are spread over TTL: few keys cross it within a second
+		if movedEarly > len(keys)/10 {
+			t.Errorf("got %d of %d keys re-balanced within a second", movedEarly, len(keys))
+		}
+	})
+
+	t.Run("empty pool", func(t *testing.T) {
+		if got := (EgressPool{}).pick("key", now); got.LocalIP != nil || got.Connect != nil {
+			t.Errorf("pick() = %v, want zero egress", got)
+		}
+	})
+}
@@ -0,0 +1,182 @@
+package proxyme
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dblokhin/proxyme/wire"
+)
+
+// EventKind is the kind of session events (see Options.EventLogSize).
+type EventKind string
+
+const (
+	EventAccepted EventKind = "accepted" // client connection is accepted
+	EventMethod   EventKind = "method"   // authentication method is chosen or none is acceptable
+	EventAuth     EventKind = "auth"     // client is authenticated
+	EventCommand  EventKind = "command"  // client request is read
+	EventReply    EventKind = "reply"    // command reply is sent
+	EventError    EventKind = "error"    // error is reported to onError of Handle
+	EventClosed   EventKind = "closed"   // session is over
+)
+
+// Event is the recent session event of the event log (see Options.EventLogSize).
+type Event struct {
+	Time time.Time
+
+	// Session is the sequence number of the session within the process, it correlates events of
+	// the same session.
+	Session uint64
+
+	// Client is address of the client, empty if unknown.
+	Client string
+
+	Kind   EventKind
+	Detail string
+}
+
+func (e Event) String() string {
+	return fmt.Sprintf("%s #%d %s %s %s", e.Time.Format(time.RFC3339Nano), e.Session, e.Client, e.Kind, e.Detail)
+}
+
+// eventLog is the fixed-size ring of recent session events.
+type eventLog struct {
+	sessions atomic.Uint64 // sequence of sessions
+
+	mu     sync.Mutex
+	events []Event
+	next   int // index of the next event in the ring
+	full   bool
+}
+
+// newEventLog returns the log keeping up to size recent events, nil if disabled.
+func newEventLog(size int) *eventLog {
+	if size <= 0 {
+		return nil
+	}
+
+	return &eventLog{events: make([]Event, size)}
+}
+
+func (l *eventLog) add(e Event) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.events[l.next] = e
+	l.next = (l.next + 1) % len(l.events)
+	l.full = l.full || l.next == 0
+}
+
+// snapshot returns the events from the oldest to the newest.
+func (l *eventLog) snapshot() []Event {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if !l.full {
+		return append([]Event(nil), l.events[:l.next]...)
+	}
+
+	res := make([]Event, 0, len(l.events))
+	res = append(res, l.events[l.next:]...)
+	return append(res, l.events[:l.next]...)
+}
+
+// trace logs the event of the session, it's no-op if the event log is disabled. Callers on hot
+// paths check the log is enabled first, so the arguments take no allocations otherwise.
+func (s *state) trace(kind EventKind, format string, args ...any) {
+	if s.opts.events == nil {
+		return
+	}
+
+	var client string
+	if s.clientAddr != nil {
+		client = s.clientAddr.String()
+	}
+
+	s.opts.events.add(Event{
+		Time:    time.Now(),
+		Session: s.traceID,
+		Client:  client,
+		Kind:    kind,
+		Detail:  fmt.Sprintf(format, args...),
+	})
+}
+
+// traceSession logs the session accepted, the returned func logs it closed with the last error
+// as the reason.
+func (s *state) traceSession() func() {
+	if s.opts.events == nil {
+		return func() {}
+	}
+
+	s.traceID = s.opts.events.sessions.Add(1)
+	s.trace(EventAccepted, "")
+
+	return func() {
+		elapsed := time.Since(s.started).Round(time.Millisecond)
+		if s.lastErr != nil {
+			s.trace(EventClosed, "after %v: %v", elapsed, s.lastErr)
+			return
+		}
+		s.trace(EventClosed, "after %v", elapsed)
+	}
+}
+
+// traceMethod logs the chosen authentication method.
+func (s *state) traceMethod(method authMethod) {
+	if s.opts.events == nil {
+		return
+	}
+
+	s.trace(EventMethod, "%v, offered %v", wire.Method(method), s.methods)
+}
+
+// traceAuth logs the authenticated client.
+func (s *state) traceAuth() {
+	if s.opts.events == nil {
+		return
+	}
+
+	s.trace(EventAuth, "username %q", s.username)
+}
+
+// traceError logs the error of the session, the last one is the close reason.
+func (s *state) traceError(err error) {
+	s.lastErr = err
+	if s.opts.events == nil {
+		return
+	}
+
+	s.trace(EventError, "%v", err)
+}
+
+// traceCommand logs the command request.
+func (s *state) traceCommand() {
+	if s.opts.events == nil {
+		return
+	}
+
+	s.trace(EventCommand, "%v %s", wire.Command(s.command.commandType), s.info().Destination())
+}
+
+// traceReply logs the command reply.
+func (s *state) traceReply(reply commandReply) {
+	if s.opts.events == nil {
+		return
+	}
+
+	bnd := buildDialAddress(int(reply.addressType), reply.addr, int(reply.port))
+	s.trace(EventReply, "%v %s", wire.Status(reply.rep), bnd)
+}
+
+// Events returns recent session events from the oldest to the newest (see Options.EventLogSize),
+// nil if the event log is disabled.
+func (s SOCKS5) Events() []Event {
+	if s.events == nil {
+		return nil
+	}
+
+	return s.events.snapshot()
+}
@@ -0,0 +1,41 @@
+package proxyme
+
+import (
+	"slices"
+	"testing"
+)
+
+func Test_eventLog(t *testing.T) {
+	tests := []struct {
+		name   string
+		size   int
+		events int
+		want   []uint64 // sessions of the snapshot
+	}{
+		{name: "empty", size: 3, events: 0, want: []uint64{}},
+		{name: "partial", size: 3, events: 2, want: []uint64{1, 2}},
+		{name: "full", size: 3, events: 3, want: []uint64{1, 2, 3}},
+		{name: "wrapped", size: 3, events: 5, want: []uint64{3, 4, 5}},
+		{name: "wrapped twice", size: 3, events: 7, want: []uint64{5, 6, 7}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newEventLog(tt.size)
+			for i := 1; i <= tt.events; i++ {
+				l.add(Event{Session: uint64(i)}) // nolint
+			}
+
+			got := make([]uint64, 0)
+			for _, e := range l.snapshot() {
+				got = append(got, e.Session)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("got sessions %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	if newEventLog(0) != nil {
+		t.Error("event log of zero size is enabled")
+	}
+}
@@ -0,0 +1,61 @@
+// Package expvarsink publishes proxyme gauges in expvar, so they're served at /debug/vars by
+// expvar.Handler, e.g. {"proxyme": {"conns": 3, "sessions.total": 120}}. Use it as Server.Metrics
+// (or Options.Metrics) where there is no metrics stack:
+//
+//	sink, err := expvarsink.New("proxyme")
+//	...
+//	srv := &proxyme.Server{SOCKS5: socks5, Metrics: sink}
+//
+// Like any importer of expvar, the package registers /debug/vars on http.DefaultServeMux, that's why
+// it's kept out of proxyme.
+package expvarsink
+
+import (
+	"expvar"
+	"fmt"
+	"sync"
+)
+
+// Sink is proxyme.MetricsSink publishing gauges in expvar under the namespace.
+type Sink struct {
+	vars *expvar.Map
+}
+
+// mu serializes publishing of expvar namespaces.
+var mu sync.Mutex
+
+// New returns the sink publishing gauges under the namespace, sinks of the same namespace share
+// the variables. It fails if the namespace is taken by other kind of variable.
+func New(namespace string) (*Sink, error) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	switch v := expvar.Get(namespace).(type) {
+	case nil:
+		return &Sink{vars: expvar.NewMap(namespace)}, nil
+	case *expvar.Map:
+		return &Sink{vars: v}, nil
+	default:
+		return nil, fmt.Errorf("expvar %q is %T, not a map", namespace, v)
+	}
+}
+
+// Gauge sets the gauge value.
+func (s *Sink) Gauge(name string, value float64) {
+	f, ok := s.vars.Get(name).(*expvar.Float)
+	if !ok {
+		f = new(expvar.Float)
+		s.vars.Set(name, f)
+	}
+	f.Set(value)
+}
+
+// Get returns the gauge value, ok is false if it hasn't been reported.
+func (s *Sink) Get(name string) (value float64, ok bool) {
+	f, ok := s.vars.Get(name).(*expvar.Float)
+	if !ok {
+		return 0, false
+	}
+
+	return f.Value(), true
+}
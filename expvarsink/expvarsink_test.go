@@ -0,0 +1,74 @@
+package expvarsink
+
+import (
+	"expvar"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/dblokhin/proxyme"
+)
+
+func TestNew(t *testing.T) {
+	a, err := New("proxyme_test.shared")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := New("proxyme_test.shared")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a.Gauge("conns", 3)
+	if v, ok := b.Get("conns"); !ok || v != 3 {
+		t.Errorf("got shared gauge %v, %v, want 3", v, ok)
+	}
+	b.Gauge("conns", 1)
+	if v, _ := a.Get("conns"); v != 1 {
+		t.Errorf("got gauge %v, want updated 1", v)
+	}
+	if _, ok := a.Get("unknown"); ok {
+		t.Error("got unreported gauge")
+	}
+
+	vars, _ := expvar.Get("proxyme_test.shared").(*expvar.Map)
+	if vars == nil || vars.Get("conns").String() != "1" {
+		t.Errorf("got published vars %v, want conns gauge", vars)
+	}
+
+	if expvar.Get("proxyme_test.int") == nil {
+		expvar.NewInt("proxyme_test.int")
+	}
+	if _, err := New("proxyme_test.int"); err == nil {
+		t.Error("expected error of the namespace taken by int")
+	}
+}
+
+func TestSink_server(t *testing.T) {
+	socks5, err := proxyme.New(proxyme.Options{AllowNoAuth: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink, err := New("proxyme_test.server")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := &proxyme.Server{SOCKS5: socks5, Metrics: sink, StatsInterval: 10 * time.Millisecond}
+	defer srv.Close() // nolint
+
+	ls, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(ls) // nolint
+
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		if _, ok := sink.Get("sessions.total"); ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("stats aren't published in expvar")
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package proxyme
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// runResolve answers Tor RESOLVE and RESOLVE_PTR commands.
+func runResolve(state *state) (transition, error) {
+	reply := commandReply{
+		rep:  succeeded,
+		port: state.command.port,
+	}
+
+	if state.command.commandType == resolveName {
+		ip := net.IP(state.command.addr)
+		if state.command.addressType == domainName {
+			ips, err := state.opts.resolver.resolve(string(state.command.addr))
+			if err != nil {
+				state.status = hostUnreachable
+				return failCommand, err
+			}
+			state.resolved = ips
+			ip = preferIPv4(ips)
+		}
+
+		reply.addressType, reply.addr = ipv6, ip.To16()
+		if ip4 := ip.To4(); ip4 != nil {
+			reply.addressType, reply.addr = ipv4, ip4
+		}
+	} else {
+		if state.command.addressType == domainName {
+			state.status = addressNotSupported
+			return failCommand, fmt.Errorf("resolve ptr of domain name")
+		}
+
+		names, err := state.opts.lookupAddr(net.IP(state.command.addr))
+		if err == nil && len(names) == 0 {
+			err = fmt.Errorf("no names")
+		}
+		if err != nil {
+			state.status = hostUnreachable
+			return failCommand, fmt.Errorf("resolve ptr %v: %w", net.IP(state.command.addr), err)
+		}
+
+		name := strings.TrimSuffix(names[0], ".")
+		if len(name) == 0 || len(name) > maxDomainSize {
+			state.status = hostUnreachable
+			return failCommand, fmt.Errorf("resolve ptr %v: invalid name %q", net.IP(state.command.addr), name)
+		}
+		reply.addressType, reply.addr = domainName, []byte(name)
+	}
+
+	if err := state.sendCommandReply(reply); err != nil {
+		return nil, fmt.Errorf("sock write: %w", err)
+	}
+
+	return nil, nil
+}
+
+// preferIPv4 returns the first IPv4 address or the first address if there are none.
+func preferIPv4(ips []net.IP) net.IP {
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			return ip
+		}
+	}
+
+	return ips[0]
+}
@@ -0,0 +1,36 @@
+package proxyme
+
+import "fmt"
+
+// runFastOpen replies CONNECT succeeded before connecting to the checked destination (see
+// Options.FastOpen). Data the client sends meanwhile waits in the socket and is relayed once
+// connected, early data taken before the reply goes first.
+func runFastOpen(state *state) (transition, error) {
+	connect, dst, err := checkDestination(state)
+	if err != nil {
+		state.status = errorStatus(err)
+		return failCommand, err
+	}
+
+	client := addrIP(state.clientAddr)
+	bndAddrType, bndAddr := familyAddr(nil, client == nil || client.To4() != nil)
+	reply := commandReply{
+		rep:         succeeded,
+		addressType: bndAddrType,
+		addr:        bndAddr,
+	}
+	if err := state.sendCommandReply(reply); err != nil {
+		return nil, fmt.Errorf("sock write: %w", err)
+	}
+
+	conn, err := connectDestination(state, connect, dst)
+	if err != nil {
+		// success has been replied, the client learns of the failure from the closed connection
+		return nil, fmt.Errorf("fast open: %w", err)
+	}
+	if err := forwardEarlyData(state, conn); err != nil {
+		return nil, fmt.Errorf("fast open: %w", err)
+	}
+
+	return nil, relay(state, conn)
+}
@@ -0,0 +1,80 @@
+package proxyme
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// ErrGoroutineLeak is reported for sessions whose goroutines outlive them (see Options.LeakTimeout).
+var ErrGoroutineLeak = errors.New("goroutine leak")
+
+// goroutineCounts accounts goroutines spawned by sessions.
+type goroutineCounts struct {
+	live   atomic.Int64 // running goroutines of all sessions
+	leaked atomic.Int64 // sessions reported leaking
+}
+
+// spawn runs fn in a goroutine accounted to the session.
+func (s *state) spawn(fn func()) {
+	if s.goroutines == nil {
+		s.goroutines = new(atomic.Int64)
+	}
+	live := s.goroutines
+	live.Add(1)
+
+	counts := s.opts.goroutines
+	if counts != nil {
+		counts.live.Add(1)
+	}
+
+	go func() {
+		defer func() {
+			live.Add(-1)
+			if counts != nil {
+				counts.live.Add(-1)
+			}
+		}()
+
+		fn()
+	}()
+}
+
+// watchLeaks is called once the session is over, it reports the session if its goroutines are
+// still running after the leak timeout.
+func (s *state) watchLeaks(onError func(error)) {
+	timeout := s.opts.leakTimeout
+	live := s.goroutines
+	if timeout <= 0 || live == nil || live.Load() == 0 {
+		return
+	}
+
+	info := s.info()
+	counts := s.opts.goroutines
+
+	time.AfterFunc(timeout, func() {
+		n := live.Load()
+		if n == 0 {
+			return
+		}
+
+		if counts != nil {
+			counts.leaked.Add(1)
+		}
+		if onError != nil {
+			onError(fmt.Errorf("%w: %d goroutines of session %v -> %s outlived it by %v",
+				ErrGoroutineLeak, n, info.ClientAddr, buildDialAddress(info.AddressType, info.Addr, info.Port), timeout))
+		}
+	})
+}
+
+// Goroutines returns number of running goroutines spawned by sessions (relay copying) and number
+// of sessions reported leaking goroutines (see Options.LeakTimeout).
+func (s SOCKS5) Goroutines() (live, leaked int64) {
+	if s.goroutines == nil {
+		return 0, 0
+	}
+
+	return s.goroutines.live.Load(), s.goroutines.leaked.Load()
+}
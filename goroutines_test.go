@@ -0,0 +1,70 @@
+package proxyme
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func Test_state_watchLeaks(t *testing.T) {
+	tests := []struct {
+		name    string
+		timeout time.Duration
+		block   bool // the spawned goroutine outlives the session
+		want    bool // the leak is reported
+	}{
+		{name: "leak", timeout: 10 * time.Millisecond, block: true, want: true},
+		{name: "finished goroutine", timeout: 10 * time.Millisecond},
+		{name: "disabled", block: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &state{opts: SOCKS5{goroutines: &goroutineCounts{}, leakTimeout: tt.timeout}}
+
+			release := make(chan struct{})
+			defer close(release)
+			finished := make(chan struct{})
+
+			s.spawn(func() {
+				defer close(finished)
+				if tt.block {
+					<-release
+				}
+			})
+			if !tt.block {
+				<-finished
+			}
+
+			var rec errorRecorder
+			s.watchLeaks(rec.report)
+			time.Sleep(tt.timeout + 50*time.Millisecond)
+
+			errs := rec.errors()
+			if got := len(errs) == 1 && errors.Is(errs[0], ErrGoroutineLeak); got != tt.want {
+				t.Errorf("got reported errors %v, want leak %v", errs, tt.want)
+			}
+
+			live, leaked := s.opts.Goroutines()
+			if err := checkGoroutines(live, leaked, tt.block, tt.want); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func checkGoroutines(live, leaked int64, running, reported bool) error {
+	var wantLive, wantLeaked int64
+	if running {
+		wantLive = 1
+	}
+	if reported {
+		wantLeaked = 1
+	}
+
+	if live != wantLive || leaked != wantLeaked {
+		return fmt.Errorf("got goroutines %d, leaked %d, want %d, %d", live, leaked, wantLive, wantLeaked)
+	}
+
+	return nil
+}
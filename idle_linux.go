@@ -0,0 +1,37 @@
+//go:build linux && !386
+
+package proxyme
+
+import (
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// idleTime returns the time since the last data sent or received over the tcp connection.
+func idleTime(conn any) (time.Duration, bool) {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return 0, false
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return 0, false
+	}
+
+	var (
+		info  syscall.TCPInfo
+		errno syscall.Errno
+	)
+	err = raw.Control(func(fd uintptr) {
+		size := uint32(syscall.SizeofTCPInfo)
+		_, _, errno = syscall.Syscall6(syscall.SYS_GETSOCKOPT, fd, syscall.IPPROTO_TCP, syscall.TCP_INFO,
+			uintptr(unsafe.Pointer(&info)), uintptr(unsafe.Pointer(&size)), 0)
+	})
+	if err != nil || errno != 0 {
+		return 0, false
+	}
+
+	ms := min(info.Last_data_recv, info.Last_data_sent)
+	return time.Duration(ms) * time.Millisecond, true
+}
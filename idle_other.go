@@ -0,0 +1,10 @@
+//go:build !linux || 386
+
+package proxyme
+
+import "time"
+
+// idleTime isn't supported, connections are never considered idle.
+func idleTime(any) (time.Duration, bool) {
+	return 0, false
+}
@@ -0,0 +1,163 @@
+package proxyme
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+// punycode parameters (RFC 3492)
+const (
+	punyBase        = 36
+	punyTMin        = 1
+	punyTMax        = 26
+	punySkew        = 38
+	punyDamp        = 700
+	punyInitialBias = 72
+	punyInitialN    = 128
+
+	acePrefix = "xn--" // prefix of punycode encoded labels (RFC 3490)
+)
+
+// idnaDots are full stops separating labels of internationalized names (RFC 3490).
+var idnaDots = strings.NewReplacer("。", ".", "．", ".", "｡", ".")
+
+// normalizeName returns the domain name in the form rules, lists and logs compare: lowercased,
+// without trailing dot, labels of internationalized names are punycode encoded (ASCII compatible
+// encoding of RFC 3490), so "Пример.рф." and "xn--e1afmkfd.xn--p1ai" are the same name. Names of
+// invalid UTF-8 are only lowercased.
+func normalizeName(name string) string {
+	switch {
+	case isASCII(name):
+		return strings.TrimSuffix(strings.ToLower(name), ".")
+	case !utf8.ValidString(name):
+		// strings.ToLower would replace invalid bytes
+		return string(lowerASCII([]byte(name)))
+	}
+
+	name = strings.TrimSuffix(strings.ToLower(name), ".")
+	labels := strings.Split(idnaDots.Replace(name), ".")
+	for i, label := range labels {
+		if !isASCII(label) {
+			labels[i] = acePrefix + punycode(label)
+		}
+	}
+
+	return strings.TrimSuffix(strings.Join(labels, "."), ".")
+}
+
+// normalizeDomain normalizes the domain name as normalizeName does, ASCII names are normalized in
+// place without allocations.
+func normalizeDomain(name []byte) []byte {
+	if !isASCII(name) && utf8.Valid(name) {
+		return []byte(normalizeName(string(name)))
+	}
+
+	return lowerASCII(name)
+}
+
+// lowerASCII lowercases ASCII letters of the name in place and removes trailing dot.
+func lowerASCII(name []byte) []byte {
+	for i, c := range name {
+		if c >= 'A' && c <= 'Z' {
+			name[i] = c + 'a' - 'A'
+		}
+	}
+	if n := len(name); n > 0 && name[n-1] == '.' {
+		name = name[:n-1]
+	}
+
+	return name
+}
+
+func isASCII[T string | []byte](s T) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+
+	return true
+}
+
+// punycode encodes the label to punycode (RFC 3492) without the ACE prefix.
+func punycode(label string) string {
+	runes := []rune(label)
+
+	out := make([]byte, 0, 2*len(label))
+	for _, r := range runes {
+		if r < utf8.RuneSelf {
+			out = append(out, byte(r))
+		}
+	}
+	basic := len(out)
+	if basic > 0 {
+		out = append(out, '-')
+	}
+
+	n, delta, bias := rune(punyInitialN), 0, punyInitialBias
+	for h := basic; h < len(runes); {
+		// the next code point to insert
+		m := rune(utf8.MaxRune)
+		for _, r := range runes {
+			if r >= n && r < m {
+				m = r
+			}
+		}
+		delta += int(m-n) * (h + 1)
+		n = m
+
+		for _, r := range runes {
+			if r < n {
+				delta++
+			}
+			if r != n {
+				continue
+			}
+
+			// encode delta as variable-length integer
+			q := delta
+			for k := punyBase; ; k += punyBase {
+				t := min(max(k-bias, punyTMin), punyTMax)
+				if q < t {
+					break
+				}
+				out = append(out, punyDigit(t+(q-t)%(punyBase-t)))
+				q = (q - t) / (punyBase - t)
+			}
+			out = append(out, punyDigit(q))
+
+			bias = punyAdapt(delta, h+1, h == basic)
+			delta = 0
+			h++
+		}
+		delta++
+		n++
+	}
+
+	return string(out)
+}
+
+func punyDigit(d int) byte {
+	if d < 26 {
+		return byte('a' + d)
+	}
+
+	return byte('0' + d - 26)
+}
+
+func punyAdapt(delta, points int, first bool) int {
+	if first {
+		delta /= punyDamp
+	} else {
+		delta /= 2
+	}
+	delta += delta / points
+
+	k := 0
+	for delta > (punyBase-punyTMin)*punyTMax/2 {
+		delta /= punyBase - punyTMin
+		k += punyBase
+	}
+
+	return k + (punyBase-punyTMin+1)*delta/(delta+punySkew)
+}
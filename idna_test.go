@@ -0,0 +1,50 @@
+package proxyme
+
+import (
+	"testing"
+)
+
+func Test_normalizeName(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{name: "Example.COM.", want: "example.com"},
+		{name: "xn--e1afmkfd.xn--p1ai", want: "xn--e1afmkfd.xn--p1ai"},
+		{name: "пример.рф", want: "xn--e1afmkfd.xn--p1ai"},
+		{name: "ПРИМЕР.РФ.", want: "xn--e1afmkfd.xn--p1ai"},
+		{name: "пример。рф", want: "xn--e1afmkfd.xn--p1ai"},
+		{name: "www.Bücher.de", want: "www.xn--bcher-kva.de"},
+		{name: "münchen.de", want: "xn--mnchen-3ya.de"},
+		{name: "日本語.jp", want: "xn--wgv71a119e.jp"},
+		{name: "他们为什么不说中文", want: "xn--ihqwcrb4cv8a8dqg056pqjye"},
+		{name: "*.пример.рф", want: "*.xn--e1afmkfd.xn--p1ai"},
+		{name: "bad\xff.com", want: "bad\xff.com"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := normalizeName(tt.name); got != tt.want {
+				t.Errorf("normalizeName(%q) = %q, want %q", tt.name, got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_normalizeDomain(t *testing.T) {
+	name := []byte("WWW.Example.com.")
+	got := normalizeDomain(name)
+	if string(got) != "www.example.com" {
+		t.Errorf("got %q, want %q", got, "www.example.com")
+	}
+	if &got[0] != &name[0] {
+		t.Error("ASCII name isn't normalized in place")
+	}
+
+	if got := normalizeDomain([]byte("Пример.рф.")); string(got) != "xn--e1afmkfd.xn--p1ai" {
+		t.Errorf("got %q, want %q", got, "xn--e1afmkfd.xn--p1ai")
+	}
+
+	if n := testing.AllocsPerRun(100, func() { normalizeDomain(name) }); n != 0 {
+		t.Errorf("ASCII name takes %v allocs, want 0", n)
+	}
+}
@@ -0,0 +1,2461 @@
+package proxyme_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dblokhin/proxyme"
+	"github.com/dblokhin/proxyme/internal/testproxy"
+	"github.com/dblokhin/proxyme/testsupport"
+	"github.com/dblokhin/proxyme/wire"
+)
+
+func TestIntegration_connect(t *testing.T) {
+	echo4 := testproxy.Echo(t, "127.0.0.1:0")
+
+	tests := []struct {
+		name    string
+		address func(t *testing.T) string
+	}{
+		{
+			name: "ipv4",
+			address: func(t *testing.T) string {
+				return echo4.String()
+			},
+		},
+		{
+			name: "ipv6",
+			address: func(t *testing.T) string {
+				ls, err := net.Listen("tcp", "[::1]:0")
+				if err != nil {
+					t.Skipf("ipv6 loopback is not available: %v", err)
+				}
+				_ = ls.Close()
+
+				return testproxy.Echo(t, "[::1]:0").String()
+			},
+		},
+		{
+			name: "domain name",
+			address: func(t *testing.T) string {
+				return net.JoinHostPort("localhost", strconv.Itoa(echo4.Port))
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			address := tt.address(t)
+			proxy := testproxy.Start(t, proxyme.Options{AllowNoAuth: true})
+			client := proxy.Dial(t)
+
+			reply, err := client.Connect(address)
+			if err != nil {
+				t.Fatalf("connect: %v", err)
+			}
+			if reply.Status != 0 {
+				t.Fatalf("got status %d, want succeeded", reply.Status)
+			}
+			if err := client.Echo("hello through the tunnel"); err != nil {
+				t.Fatalf("echo: %v", err)
+			}
+		})
+	}
+}
+
+func TestIntegration_connectFailure(t *testing.T) {
+	// closed port
+	ls := testproxy.Listen(t, "tcp", "127.0.0.1:0")
+	closed := ls.Addr().String()
+	_ = ls.Close()
+
+	tests := []struct {
+		name       string
+		opts       proxyme.Options
+		address    string
+		wantStatus byte
+	}{
+		{
+			name:       "connection refused",
+			opts:       proxyme.Options{AllowNoAuth: true},
+			address:    closed,
+			wantStatus: 5,
+		},
+		{
+			name: "not allowed",
+			opts: proxyme.Options{
+				AllowNoAuth: true,
+				Connect: func(addressType int, addr []byte, port int) (net.Conn, error) {
+					return nil, proxyme.ErrNotAllowed
+				},
+			},
+			address:    closed,
+			wantStatus: 2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proxy := testproxy.Start(t, tt.opts)
+			client := proxy.Dial(t)
+
+			reply, err := client.Connect(tt.address)
+			if err != nil {
+				t.Fatalf("connect: %v", err)
+			}
+			if reply.Status != tt.wantStatus {
+				t.Errorf("got status %d, want %d", reply.Status, tt.wantStatus)
+			}
+			if err := client.Closed(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestIntegration_login(t *testing.T) {
+	echo := testproxy.Echo(t, "127.0.0.1:0")
+	proxy := testproxy.Start(t, proxyme.Options{
+		Authenticate: proxyme.StaticCredentials(map[string]string{"user": "pass"}),
+	})
+
+	tests := []struct {
+		name       string
+		username   string
+		password   string
+		wantStatus byte
+	}{
+		{name: "success", username: "user", password: "pass", wantStatus: 0},
+		{name: "wrong password", username: "user", password: "wrong", wantStatus: 0xff},
+		{name: "unknown user", username: "nobody", password: "pass", wantStatus: 0xff},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := proxy.Dial(t)
+
+			method, err := client.Greet(0, 2)
+			if err != nil {
+				t.Fatalf("greet: %v", err)
+			}
+			if method != 2 {
+				t.Fatalf("got method %d, want username/password", method)
+			}
+
+			status, err := client.Login(tt.username, tt.password)
+			if err != nil {
+				t.Fatalf("login: %v", err)
+			}
+			if status != tt.wantStatus {
+				t.Fatalf("got status %d, want %d", status, tt.wantStatus)
+			}
+
+			if status != 0 {
+				if err := client.Closed(); err != nil {
+					t.Error(err)
+				}
+				return
+			}
+
+			if err := client.Request(1, echo.IP.String(), echo.Port); err != nil {
+				t.Fatalf("request: %v", err)
+			}
+			if reply, err := client.Reply(); err != nil || reply.Status != 0 {
+				t.Fatalf("got reply %v, error %v", reply, err)
+			}
+			if err := client.Echo("authenticated"); err != nil {
+				t.Fatalf("echo: %v", err)
+			}
+		})
+	}
+}
+
+func TestIntegration_noAcceptableMethods(t *testing.T) {
+	proxy := testproxy.Start(t, proxyme.Options{AllowNoAuth: true})
+	client := proxy.Dial(t)
+
+	method, err := client.Greet(1, 2)
+	if err != nil {
+		t.Fatalf("greet: %v", err)
+	}
+	if method != 0xff {
+		t.Errorf("got method %d, want no acceptable methods", method)
+	}
+	if err := client.Closed(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestIntegration_bind(t *testing.T) {
+	listened := make(chan proxyme.SessionInfo, 1)
+	proxy := testproxy.Start(t, proxyme.Options{
+		AllowNoAuth: true,
+		Listen: func(info proxyme.SessionInfo) (net.Listener, error) {
+			listened <- info
+			return net.Listen("tcp", "127.0.0.1:0")
+		},
+	})
+	client := proxy.Dial(t)
+
+	if _, err := client.Greet(0); err != nil {
+		t.Fatalf("greet: %v", err)
+	}
+	if err := client.Request(2, "127.0.0.1", 1); err != nil {
+		t.Fatalf("request: %v", err)
+	}
+
+	first, err := client.Reply()
+	if err != nil || first.Status != 0 {
+		t.Fatalf("got first reply %v, error %v", first, err)
+	}
+
+	// listener is chosen knowing the request
+	info := <-listened
+	if info.Command != 2 || net.IP(info.Addr).String() != "127.0.0.1" || info.Port != 1 || info.ClientAddr == nil {
+		t.Errorf("got listen info %+v, want the bind request of the client", info)
+	}
+
+	peer, err := net.DialTimeout("tcp", first.Address(), testproxy.Timeout)
+	if err != nil {
+		t.Fatalf("dial bind address: %v", err)
+	}
+	defer peer.Close()
+
+	second, err := client.Reply()
+	if err != nil || second.Status != 0 {
+		t.Fatalf("got second reply %v, error %v", second, err)
+	}
+	if second.Address() != peer.LocalAddr().String() {
+		t.Errorf("got peer address %s, want %s", second.Address(), peer.LocalAddr())
+	}
+
+	if _, err := peer.Write([]byte("ping")); err != nil {
+		t.Fatalf("peer write: %v", err)
+	}
+	got := make([]byte, 4)
+	if _, err := client.Read(got); err != nil || string(got) != "ping" {
+		t.Fatalf("got %q, error %v", got, err)
+	}
+}
+
+func TestIntegration_bindSpoofedPeer(t *testing.T) {
+	proxy := testproxy.Start(t, proxyme.Options{
+		AllowNoAuth:    true,
+		BindExpectPeer: true,
+		BindTimeout:    300 * time.Millisecond, // the session waits for the expected peer until timeout
+		Listen: func(proxyme.SessionInfo) (net.Listener, error) {
+			return net.Listen("tcp", "127.0.0.1:0")
+		},
+	})
+	client := proxy.Dial(t)
+
+	if _, err := client.Greet(0); err != nil {
+		t.Fatalf("greet: %v", err)
+	}
+	if err := client.Request(2, "192.0.2.1", 1); err != nil {
+		t.Fatalf("request: %v", err)
+	}
+
+	first, err := client.Reply()
+	if err != nil || first.Status != 0 {
+		t.Fatalf("got first reply %v, error %v", first, err)
+	}
+
+	peer, err := net.DialTimeout("tcp", first.Address(), testproxy.Timeout)
+	if err != nil {
+		t.Fatalf("dial bind address: %v", err)
+	}
+	defer peer.Close()
+
+	// the connection of unexpected peer is closed
+	_ = peer.SetReadDeadline(time.Now().Add(testproxy.Timeout))
+	if _, err := peer.Read(make([]byte, 1)); !errors.Is(err, io.EOF) {
+		t.Errorf("got peer read error %v, want EOF", err)
+	}
+
+	if bindPeers, _ := proxy.SOCKS5.Spoofed(); bindPeers != 1 {
+		t.Errorf("got %d spoofed bind peers, want 1", bindPeers)
+	}
+}
+
+func TestIntegration_bindNotAllowed(t *testing.T) {
+	proxy := testproxy.Start(t, proxyme.Options{AllowNoAuth: true})
+	client := proxy.Dial(t)
+
+	if _, err := client.Greet(0); err != nil {
+		t.Fatalf("greet: %v", err)
+	}
+	if err := client.Request(2, "127.0.0.1", 1); err != nil {
+		t.Fatalf("request: %v", err)
+	}
+
+	reply, err := client.Reply()
+	if err != nil {
+		t.Fatalf("reply: %v", err)
+	}
+	if reply.Status != 2 {
+		t.Errorf("got status %d, want not allowed", reply.Status)
+	}
+}
+
+func TestIntegration_truncated(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{name: "greeting", data: []byte{5, 3, 0}},
+		{name: "command header", data: []byte{5, 1, 0, 5, 1, 0}},
+		{name: "command address", data: []byte{5, 1, 0, 5, 1, 0, 1, 127, 0}},
+		{name: "domain name", data: []byte{5, 1, 0, 5, 1, 0, 3, 10, 'e', 'x'}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proxy := testproxy.Start(t, proxyme.Options{AllowNoAuth: true})
+			client := proxy.Dial(t)
+
+			if _, err := client.Write(tt.data); err != nil {
+				t.Fatalf("write: %v", err)
+			}
+			_ = client.Conn.(*net.TCPConn).CloseWrite()
+
+			// drain replies until the server closes
+			buf := make([]byte, 64)
+			for {
+				if _, err := client.Read(buf); err != nil {
+					break
+				}
+			}
+
+			errs := proxy.Errors()
+			if len(errs) == 0 {
+				t.Fatalf("expected handler error")
+			}
+			if !errors.Is(errs[len(errs)-1], io.ErrUnexpectedEOF) && !errors.Is(errs[len(errs)-1], io.EOF) {
+				t.Errorf("got error %v, want EOF", errs[len(errs)-1])
+			}
+		})
+	}
+}
+
+func TestIntegration_bindEvents(t *testing.T) {
+	events := make(chan proxyme.BindEvent, 2)
+
+	proxy := testproxy.Start(t, proxyme.Options{
+		AllowNoAuth: true,
+		Listen: func(proxyme.SessionInfo) (net.Listener, error) {
+			return net.Listen("tcp", "127.0.0.1:0")
+		},
+		OnBind: func(info proxyme.SessionInfo, event proxyme.BindEvent) {
+			events <- event
+		},
+	})
+	client := proxy.Dial(t)
+
+	if _, err := client.Greet(0); err != nil {
+		t.Fatalf("greet: %v", err)
+	}
+	if err := client.Request(2, "127.0.0.1", 1); err != nil {
+		t.Fatalf("request: %v", err)
+	}
+
+	// orchestration learns the listener address from the hook
+	opened := <-events
+	if opened.Peer != nil || opened.Err != nil {
+		t.Fatalf("unexpected listener opened event: %+v", opened)
+	}
+
+	peer, err := net.DialTimeout("tcp", opened.Listener.String(), testproxy.Timeout)
+	if err != nil {
+		t.Fatalf("dial bind address: %v", err)
+	}
+	defer peer.Close()
+
+	accepted := <-events
+	if accepted.Err != nil || accepted.Peer.String() != peer.LocalAddr().String() {
+		t.Errorf("unexpected peer accepted event: %+v", accepted)
+	}
+}
+
+func TestIntegration_bindTimeout(t *testing.T) {
+	proxy := testproxy.Start(t, proxyme.Options{
+		AllowNoAuth: true,
+		Listen: func(proxyme.SessionInfo) (net.Listener, error) {
+			return net.Listen("tcp", "127.0.0.1:0")
+		},
+		BindTimeout: 10 * time.Millisecond,
+	})
+	client := proxy.Dial(t)
+
+	if _, err := client.Greet(0); err != nil {
+		t.Fatalf("greet: %v", err)
+	}
+	if err := client.Request(2, "127.0.0.1", 1); err != nil {
+		t.Fatalf("request: %v", err)
+	}
+
+	if first, err := client.Reply(); err != nil || first.Status != 0 {
+		t.Fatalf("got first reply %v, error %v", first, err)
+	}
+
+	second, err := client.Reply()
+	if err != nil {
+		t.Fatalf("second reply: %v", err)
+	}
+	if second.Status != 6 {
+		t.Errorf("got status %d, want TTL expired", second.Status)
+	}
+}
+
+func TestIntegration_sessions(t *testing.T) {
+	echo := testproxy.Echo(t, "127.0.0.1:0")
+	store := &proxyme.MemorySessions{}
+
+	proxy := testproxy.Start(t, proxyme.Options{AllowNoAuth: true, Sessions: store})
+	client := proxy.Dial(t)
+
+	if _, err := client.Connect(echo.String()); err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	if err := client.Echo("hello"); err != nil {
+		t.Fatalf("echo: %v", err)
+	}
+
+	sessions := store.Sessions()
+	if len(sessions) != 1 {
+		t.Fatalf("got %d sessions, want 1", len(sessions))
+	}
+	if got := sessions[0].Info.Destination(); got != echo.String() {
+		t.Fatalf("got session destination %s, want %s", got, echo.String())
+	}
+
+	if !store.Kill(sessions[0].ID) {
+		t.Fatalf("session not found")
+	}
+	if err := client.Closed(); err != nil {
+		t.Fatalf("killed session: %v", err)
+	}
+
+	// the session is removed once the relay finishes
+	deadline := time.Now().Add(testproxy.Timeout)
+	for len(store.Sessions()) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("killed session is still registered")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestIntegration_rulesResolved(t *testing.T) {
+	echo := testproxy.Echo(t, "127.0.0.1:0")
+	address := net.JoinHostPort("localhost", strconv.Itoa(echo.Port))
+
+	denyLoopback := func(info proxyme.SessionInfo) error {
+		for _, ip := range info.ResolvedIPs {
+			if ip.IsLoopback() {
+				return errors.New("loopback destination")
+			}
+		}
+		return nil
+	}
+
+	tests := []struct {
+		name       string
+		rules      func(info proxyme.SessionInfo) error
+		wantStatus byte
+	}{
+		{name: "allowed", rules: func(info proxyme.SessionInfo) error { return nil }, wantStatus: 0},
+		{name: "denied by resolved ip", rules: denyLoopback, wantStatus: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstream := make(chan net.Addr, 1)
+			proxy := testproxy.Start(t, proxyme.Options{
+				AllowNoAuth: true,
+				Rules:       tt.rules,
+				Resolve: func(host string) ([]net.IP, error) {
+					return []net.IP{net.IPv4(127, 0, 0, 1)}, nil
+				},
+				OnEstablished: func(client io.ReadWriteCloser, conn net.Conn, info proxyme.SessionInfo) {
+					upstream <- info.Upstream
+					_ = client.Close()
+					_ = conn.Close()
+				},
+			})
+			client := proxy.Dial(t)
+
+			reply, err := client.Connect(address)
+			if err != nil {
+				t.Fatalf("connect: %v", err)
+			}
+			if reply.Status != tt.wantStatus {
+				t.Fatalf("got status %d, want %d", reply.Status, tt.wantStatus)
+			}
+			if err := client.Closed(); err != nil {
+				t.Fatalf("client: %v", err)
+			}
+
+			if tt.wantStatus == 0 {
+				if got := <-upstream; got == nil || got.String() != echo.String() {
+					t.Fatalf("got upstream %v, want %v", got, echo)
+				}
+			}
+		})
+	}
+}
+
+func TestIntegration_ports(t *testing.T) {
+	echo := testproxy.Echo(t, "127.0.0.1:0")
+
+	tests := []struct {
+		name       string
+		allowed    []int
+		denied     []int
+		wantStatus byte
+	}{
+		{name: "allowed", allowed: []int{echo.Port}, wantStatus: 0},
+		{name: "not allowed", allowed: []int{443}, wantStatus: 2},
+		{name: "denied", denied: []int{echo.Port}, wantStatus: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proxy := testproxy.Start(t, proxyme.Options{
+				AllowNoAuth:  true,
+				AllowedPorts: tt.allowed,
+				DeniedPorts:  tt.denied,
+				// ports are checked before rules
+				Rules: func(info proxyme.SessionInfo) error {
+					if tt.wantStatus != 0 {
+						t.Errorf("rules are checked for port %d", info.Port)
+					}
+					return nil
+				},
+			})
+			client := proxy.Dial(t)
+
+			reply, err := client.Connect(echo.String())
+			if err != nil {
+				t.Fatalf("connect: %v", err)
+			}
+			if reply.Status != tt.wantStatus {
+				t.Fatalf("got status %d, want %d", reply.Status, tt.wantStatus)
+			}
+			if tt.wantStatus == 0 {
+				if err := client.Echo("allowed port"); err != nil {
+					t.Fatalf("echo: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestIntegration_messageTimeout(t *testing.T) {
+	proxy := testproxy.Start(t, proxyme.Options{
+		AllowNoAuth:    true,
+		MessageTimeout: 50 * time.Millisecond,
+	})
+	client := proxy.Dial(t)
+
+	// slowloris: the greeting is never completed
+	if _, err := client.Write([]byte{5}); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if err := client.Closed(); err != nil {
+		t.Fatalf("dribbling client: %v", err)
+	}
+
+	// the tunnel isn't limited by message timeout
+	echo := testproxy.Echo(t, "127.0.0.1:0")
+	client = proxy.Dial(t)
+	if _, err := client.Connect(echo.String()); err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if err := client.Echo("hello"); err != nil {
+		t.Fatalf("echo: %v", err)
+	}
+}
+
+func TestIntegration_maxNegotiationBytes(t *testing.T) {
+	proxy := testproxy.Start(t, proxyme.Options{
+		AllowNoAuth:         true,
+		MaxNegotiationBytes: 16,
+	})
+	client := proxy.Dial(t)
+
+	// 255 methods exceed the limit
+	methods := make([]byte, 255)
+	for i := range methods {
+		methods[i] = byte(i + 3)
+	}
+	if _, err := client.Greet(methods...); err == nil {
+		t.Fatalf("greeting past the limit must fail")
+	}
+	if err := client.Closed(); err != nil {
+		t.Fatalf("client: %v", err)
+	}
+
+	// negotiation fits the limit
+	echo := testproxy.Echo(t, "127.0.0.1:0")
+	client = proxy.Dial(t)
+	if _, err := client.Connect(echo.String()); err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	if err := client.Echo("tunnel isn't limited"); err != nil {
+		t.Fatalf("echo: %v", err)
+	}
+}
+
+func TestIntegration_routerUpstream(t *testing.T) {
+	echo := testproxy.Echo(t, "127.0.0.1:0")
+
+	// upstream proxy rejects one of destinations disguising it as unreachable
+	blocked := testproxy.Listen(t, "tcp", "127.0.0.1:0").Addr().String()
+	upstreamSessions := &proxyme.MemorySessions{}
+	upstream := testproxy.Start(t, proxyme.Options{
+		Authenticate: proxyme.StaticCredentials(map[string]string{"front": "secret"}),
+		Sessions:     upstreamSessions,
+		Rules: func(info proxyme.SessionInfo) error {
+			if info.Destination() == blocked {
+				return &proxyme.RuleError{Status: wire.StatusHostUnreachable}
+			}
+			return nil
+		},
+	})
+
+	usernames := make(chan string, 2)
+	front := testproxy.Start(t, proxyme.Options{
+		Authenticate: proxyme.StaticCredentials(map[string]string{"alice": "pass"}),
+		Router: proxyme.StaticRouter{
+			Users: map[string]proxyme.Egress{
+				"alice": {Connect: proxyme.UpstreamSOCKS5(upstream.Addr, "front", "secret")},
+			},
+		},
+		Rules: func(info proxyme.SessionInfo) error {
+			usernames <- info.Username
+			return nil
+		},
+	})
+
+	connect := func(address string) (*testproxy.Client, testproxy.Reply) {
+		client := front.Dial(t)
+		if _, err := client.Greet(2); err != nil {
+			t.Fatalf("greet: %v", err)
+		}
+		if status, err := client.Login("alice", "pass"); err != nil || status != 0 {
+			t.Fatalf("login: %d, %v", status, err)
+		}
+
+		host, port, _ := net.SplitHostPort(address)
+		portNum, _ := strconv.Atoi(port)
+		if err := client.Request(1, host, portNum); err != nil {
+			t.Fatalf("request: %v", err)
+		}
+		reply, err := client.Reply()
+		if err != nil {
+			t.Fatalf("reply: %v", err)
+		}
+
+		return client, reply
+	}
+
+	client, reply := connect(echo.String())
+	if reply.Status != 0 {
+		t.Fatalf("got status %d, want succeeded", reply.Status)
+	}
+	if err := client.Echo("through the chain"); err != nil {
+		t.Fatalf("echo: %v", err)
+	}
+	if got := <-usernames; got != "alice" {
+		t.Fatalf("got username %q, want %q", got, "alice")
+	}
+	if sessions := upstreamSessions.Sessions(); len(sessions) != 1 || sessions[0].Info.Username != "front" {
+		t.Fatalf("got upstream sessions %v, want the front proxy one", sessions)
+	}
+
+	_, reply = connect(blocked)
+	if reply.Status != byte(wire.StatusHostUnreachable) {
+		t.Fatalf("got status %d, want upstream status %d", reply.Status, wire.StatusHostUnreachable)
+	}
+}
+
+func TestIntegration_authenticateContext(t *testing.T) {
+	type call struct {
+		session     proxyme.Session
+		hasDeadline bool
+	}
+
+	calls := make(chan call, 1)
+	sessions := &proxyme.MemorySessions{}
+	proxy := testproxy.Start(t, proxyme.Options{
+		Sessions:    sessions,
+		AuthTimeout: 100 * time.Millisecond,
+		AuthenticateContext: func(ctx context.Context, username, password []byte) error {
+			session, _ := proxyme.SessionFromContext(ctx)
+			_, hasDeadline := ctx.Deadline()
+			calls <- call{session: session, hasDeadline: hasDeadline}
+
+			if string(username) == "slow" {
+				// the backend respects cancellation
+				<-ctx.Done()
+				return ctx.Err()
+			}
+			return nil
+		},
+	})
+
+	login := func(t *testing.T, username string) (*testproxy.Client, <-chan byte) {
+		client := proxy.Dial(t)
+		if _, err := client.Greet(2); err != nil {
+			t.Fatalf("greet: %v", err)
+		}
+
+		status := make(chan byte, 1)
+		go func() {
+			s, _ := client.Login(username, "pass")
+			status <- s
+		}()
+
+		return client, status
+	}
+
+	t.Run("session and deadline", func(t *testing.T) {
+		_, status := login(t, "user")
+
+		c := <-calls
+		if c.session.ID == "" || c.session.Info.ClientAddr == nil {
+			t.Errorf("got session %+v, want the one with ID and client address", c.session)
+		}
+		if !c.hasDeadline {
+			t.Error("got context without deadline")
+		}
+		if s := <-status; s != 0 {
+			t.Errorf("got status %d, want success", s)
+		}
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		_, status := login(t, "slow")
+
+		<-calls
+		select {
+		case s := <-status:
+			if s != 0xff {
+				t.Errorf("got status %d, want denied", s)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("authentication isn't canceled on timeout")
+		}
+	})
+
+	t.Run("canceled on kill", func(t *testing.T) {
+		client, _ := login(t, "slow")
+
+		c := <-calls
+		if !sessions.Kill(c.session.ID) {
+			t.Fatalf("session %s isn't found", c.session.ID)
+		}
+		if err := client.Closed(); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func TestIntegration_authCache(t *testing.T) {
+	echo := testproxy.Echo(t, "127.0.0.1:0")
+	usernames := make(chan string, 2)
+	host, port, _ := net.SplitHostPort(echo.String())
+	portNum, _ := strconv.Atoi(port)
+
+	connect := func(t *testing.T, client *testproxy.Client) {
+		t.Helper()
+
+		if err := client.Request(1, host, portNum); err != nil {
+			t.Fatalf("request: %v", err)
+		}
+		if reply, err := client.Reply(); err != nil || reply.Status != 0 {
+			t.Fatalf("connect: %v, %v", reply, err)
+		}
+	}
+
+	proxy := testproxy.Start(t, proxyme.Options{
+		Authenticate: proxyme.StaticCredentials(map[string]string{"alice": "pass"}),
+		AuthCacheTTL: time.Minute,
+		Rules: func(info proxyme.SessionInfo) error {
+			usernames <- info.Username
+			return nil
+		},
+	})
+
+	// noauth isn't allowed before login
+	client := proxy.Dial(t)
+	if method, err := client.Greet(0); err != nil || method != 0xff {
+		t.Fatalf("got method %d, %v, want no acceptable methods", method, err)
+	}
+
+	client = proxy.Dial(t)
+	if method, err := client.Greet(0, 2); err != nil || method != 2 {
+		t.Fatalf("got method %d, %v, want username/password", method, err)
+	}
+	if status, err := client.Login("alice", "pass"); err != nil || status != 0 {
+		t.Fatalf("login: %d, %v", status, err)
+	}
+	connect(t, client)
+	<-usernames
+
+	// the next session from the same IP skips login
+	client = proxy.Dial(t)
+	if method, err := client.Greet(0, 2); err != nil || method != 0 {
+		t.Fatalf("got method %d, %v, want noauth", method, err)
+	}
+	connect(t, client)
+	if err := client.Echo("cached"); err != nil {
+		t.Fatal(err)
+	}
+	if username := <-usernames; username != "alice" {
+		t.Errorf("got username %q, want the cached login", username)
+	}
+}
+
+func TestIntegration_commands(t *testing.T) {
+	proxy := testproxy.Start(t, proxyme.Options{
+		AllowNoAuth: true,
+		OnAuthenticated: func(info proxyme.SessionInfo) error {
+			if info.ClientAddr == nil {
+				return errors.New("unknown client")
+			}
+			return nil
+		},
+		Commands: map[byte]func(cmd proxyme.Command) error{
+			// replies with the requested address and then echoes the client data
+			0xF0: func(cmd proxyme.Command) error {
+				reply := wire.CommandReply{
+					Status: wire.StatusSucceeded,
+					Address: wire.Address{
+						Type: wire.AddressType(cmd.Info.AddressType),
+						Addr: cmd.Info.Addr,
+						Port: uint16(cmd.Info.Port), // nolint
+					},
+				}
+				if _, err := reply.WriteTo(cmd.Conn); err != nil {
+					return err
+				}
+
+				_, err := io.Copy(cmd.Conn, cmd.Conn)
+				return err
+			},
+		},
+	})
+
+	tests := []struct {
+		name       string
+		command    byte
+		port       int
+		wantStatus byte
+	}{
+		{name: "custom command", command: 0xF0, port: 0, wantStatus: 0},
+		{name: "unknown command", command: 0xF1, port: 80, wantStatus: byte(wire.StatusNotSupported)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := proxy.Dial(t)
+			if _, err := client.Greet(0); err != nil {
+				t.Fatalf("greet: %v", err)
+			}
+			if err := client.Request(tt.command, "example.com", tt.port); err != nil {
+				t.Fatalf("request: %v", err)
+			}
+
+			reply, err := client.Reply()
+			if err != nil {
+				t.Fatalf("reply: %v", err)
+			}
+			if reply.Status != tt.wantStatus {
+				t.Fatalf("got status %d, want %d", reply.Status, tt.wantStatus)
+			}
+			if reply.Status != 0 {
+				return
+			}
+
+			if reply.Address() != "example.com:0" {
+				t.Errorf("got address %s, want the requested one", reply.Address())
+			}
+			if err := client.Echo("custom"); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestIntegration_commandHandlers(t *testing.T) {
+	// the port broker hands out listeners for BIND
+	broker := make(chan net.Listener, 1)
+	ls, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	broker <- ls
+
+	proxy := testproxy.Start(t, proxyme.Options{
+		AllowNoAuth: true,
+		CommandHandlers: map[byte]proxyme.CommandHandler{
+			byte(wire.CommandBind): proxyme.CommandHandlerFunc(func(s *proxyme.CommandSession) error {
+				var ls net.Listener
+				select {
+				case ls = <-broker:
+				default:
+					return proxyme.ErrNotAllowed
+				}
+				defer ls.Close()
+
+				if err := s.Reply(ls.Addr()); err != nil {
+					return err
+				}
+				peer, err := ls.Accept()
+				if err != nil {
+					return err
+				}
+				if err := s.Reply(peer.RemoteAddr()); err != nil {
+					_ = peer.Close()
+					return err
+				}
+
+				return s.Relay(peer)
+			}),
+			byte(wire.CommandConnect): proxyme.CommandHandlerFunc(func(s *proxyme.CommandSession) error {
+				if string(s.Info().Addr) == "blocked.example.com" {
+					return proxyme.ErrNotAllowed
+				}
+				return nil // no reply
+			}),
+		},
+	})
+
+	t.Run("bind", func(t *testing.T) {
+		client := proxy.Dial(t)
+		if _, err := client.Greet(0); err != nil {
+			t.Fatalf("greet: %v", err)
+		}
+		if err := client.Request(byte(wire.CommandBind), "127.0.0.1", 1); err != nil {
+			t.Fatalf("request: %v", err)
+		}
+
+		first, err := client.Reply()
+		if err != nil || first.Status != 0 {
+			t.Fatalf("got first reply %v, error %v", first, err)
+		}
+		if first.Address() != ls.Addr().String() {
+			t.Fatalf("got bind address %s, want the brokered %s", first.Address(), ls.Addr())
+		}
+
+		peer, err := net.DialTimeout("tcp", first.Address(), testproxy.Timeout)
+		if err != nil {
+			t.Fatalf("dial bind address: %v", err)
+		}
+		defer peer.Close()
+
+		second, err := client.Reply()
+		if err != nil || second.Status != 0 {
+			t.Fatalf("got second reply %v, error %v", second, err)
+		}
+		if second.Address() != peer.LocalAddr().String() {
+			t.Errorf("got peer address %s, want %s", second.Address(), peer.LocalAddr())
+		}
+
+		if _, err := peer.Write([]byte("ping")); err != nil {
+			t.Fatalf("peer write: %v", err)
+		}
+		got := make([]byte, 4)
+		if _, err := io.ReadFull(client, got); err != nil || string(got) != "ping" {
+			t.Fatalf("got %q, error %v", got, err)
+		}
+	})
+
+	tests := []struct {
+		name    string
+		command wire.Command
+		address string
+		want    wire.Status
+	}{
+		{name: "broker exhausted", command: wire.CommandBind, address: "127.0.0.1:1", want: wire.StatusNotAllowed},
+		{name: "handler error", command: wire.CommandConnect, address: "blocked.example.com:80", want: wire.StatusNotAllowed},
+		{name: "no reply", command: wire.CommandConnect, address: "example.com:80", want: wire.StatusFailure},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := proxy.Dial(t).Run(
+				testsupport.Greeting(wire.MethodNoAuth),
+				testsupport.ExpectMethod(wire.MethodNoAuth),
+				testsupport.Request(tt.command, tt.address),
+				testsupport.ExpectReply(tt.want),
+				testsupport.ExpectClosed(),
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestIntegration_onAuthenticated(t *testing.T) {
+	proxy := testproxy.Start(t, proxyme.Options{
+		Authenticate: proxyme.StaticCredentials(map[string]string{"alice": "pass", "bob": "pass"}),
+		OnAuthenticated: func(info proxyme.SessionInfo) error {
+			if info.Username == "bob" {
+				return errors.New("bob is over quota")
+			}
+			return nil
+		},
+	})
+
+	tests := []struct {
+		username   string
+		wantClosed bool
+	}{
+		{username: "alice"},
+		{username: "bob", wantClosed: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.username, func(t *testing.T) {
+			client := proxy.Dial(t)
+			if _, err := client.Greet(2); err != nil {
+				t.Fatalf("greet: %v", err)
+			}
+			if status, err := client.Login(tt.username, "pass"); err != nil || status != 0 {
+				t.Fatalf("login: %d, %v", status, err)
+			}
+
+			if !tt.wantClosed {
+				return
+			}
+			if err := client.Closed(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestIntegration_resolve(t *testing.T) {
+	opts := proxyme.Options{
+		AllowNoAuth:  true,
+		AllowResolve: true,
+		Resolve: func(host string) ([]net.IP, error) {
+			if host == "dual.test" {
+				return []net.IP{net.ParseIP("2001:db8::1"), net.IPv4(192, 0, 2, 1)}, nil
+			}
+			return nil, errors.New("nxdomain")
+		},
+		ResolvePTR: func(ip net.IP) ([]string, error) {
+			if ip.Equal(net.IPv4(192, 0, 2, 1)) {
+				return []string{"dual.test."}, nil
+			}
+			return nil, errors.New("nxdomain")
+		},
+	}
+	proxy := testproxy.Start(t, opts)
+
+	opts.AllowResolve = false
+	disabled := testproxy.Start(t, opts)
+
+	tests := []struct {
+		name        string
+		proxy       *testproxy.Proxy
+		command     byte
+		host        string
+		wantStatus  wire.Status
+		wantAddress string
+	}{
+		{name: "resolve", proxy: proxy, command: 0xF0, host: "dual.test", wantAddress: "192.0.2.1:0"},
+		{name: "resolve ip", proxy: proxy, command: 0xF0, host: "2001:db8::2", wantAddress: "[2001:db8::2]:0"},
+		{name: "resolve failure", proxy: proxy, command: 0xF0, host: "unknown.test", wantStatus: wire.StatusHostUnreachable},
+		{name: "resolve ptr", proxy: proxy, command: 0xF1, host: "192.0.2.1", wantAddress: "dual.test:0"},
+		{name: "resolve ptr failure", proxy: proxy, command: 0xF1, host: "192.0.2.2", wantStatus: wire.StatusHostUnreachable},
+		{name: "resolve ptr of domain", proxy: proxy, command: 0xF1, host: "dual.test", wantStatus: wire.StatusAddressNotSupported},
+		{name: "disabled", proxy: disabled, command: 0xF0, host: "dual.test", wantStatus: wire.StatusNotSupported},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := tt.proxy.Dial(t)
+			if _, err := client.Greet(0); err != nil {
+				t.Fatalf("greet: %v", err)
+			}
+
+			port := 0
+			if tt.proxy == disabled {
+				port = 80 // zero port is invalid for unknown commands
+			}
+			if err := client.Request(tt.command, tt.host, port); err != nil {
+				t.Fatalf("request: %v", err)
+			}
+
+			reply, err := client.Reply()
+			if err != nil {
+				t.Fatalf("reply: %v", err)
+			}
+			if wire.Status(reply.Status) != tt.wantStatus {
+				t.Fatalf("got status %d, want %d", reply.Status, tt.wantStatus)
+			}
+			if tt.wantAddress != "" && reply.Address() != tt.wantAddress {
+				t.Errorf("got address %s, want %s", reply.Address(), tt.wantAddress)
+			}
+			if err := client.Closed(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+// gauges records the latest values of gauges.
+type gauges struct {
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+func (g *gauges) Gauge(name string, value float64) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.values == nil {
+		g.values = make(map[string]float64)
+	}
+	g.values[name] = value
+}
+
+func (g *gauges) has(name string) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	_, ok := g.values[name]
+	return ok
+}
+
+func TestIntegration_timings(t *testing.T) {
+	echo := testproxy.Echo(t, "127.0.0.1:0")
+
+	var metrics gauges
+	proxy := testproxy.Start(t, proxyme.Options{AllowNoAuth: true, Metrics: &metrics})
+	client := proxy.Dial(t)
+
+	if reply, err := client.Connect(echo.String()); err != nil || reply.Status != 0 {
+		t.Fatalf("got reply %v, error %v", reply, err)
+	}
+	if err := client.Echo("ping"); err != nil {
+		t.Fatalf("echo: %v", err)
+	}
+
+	// the echo is seen by the client right after the proxy has recorded ttfb
+	deadline := time.Now().Add(testproxy.Timeout)
+	for !metrics.has("latency.ttfb") {
+		if time.Now().After(deadline) {
+			t.Fatal("ttfb isn't reported")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	for _, name := range []string{"latency.auth", "latency.dial"} {
+		if !metrics.has(name) {
+			t.Errorf("%s isn't reported", name)
+		}
+	}
+
+	sessions := proxy.SOCKS5.Sessions()
+	if len(sessions) != 1 {
+		t.Fatalf("got sessions %v, want the client one", sessions)
+	}
+	if timings := sessions[0].Info.Timings; timings.Auth <= 0 || timings.Dial <= 0 || timings.FirstByte <= 0 {
+		t.Errorf("got timings %+v, want all stages", timings)
+	}
+}
+
+func TestIntegration_snapshot(t *testing.T) {
+	echo := testproxy.Echo(t, "127.0.0.1:0")
+	proxy := testproxy.Start(t, proxyme.Options{AllowNoAuth: true})
+
+	client := proxy.Dial(t)
+	if reply, err := client.Connect(echo.String()); err != nil || reply.Status != 0 {
+		t.Fatalf("got reply %v, error %v", reply, err)
+	}
+	if err := client.Echo("ping"); err != nil {
+		t.Fatalf("echo: %v", err)
+	}
+	_ = client.Close()
+
+	// no acceptable methods
+	rejected := proxy.Dial(t)
+	if err := rejected.Run(testsupport.Greeting(wire.MethodLogin), testsupport.ExpectMethod(wire.MethodNoAcceptable)); err != nil {
+		t.Fatal(err)
+	}
+	_ = rejected.Close()
+
+	var snapshot proxyme.Snapshot
+	for deadline := time.Now().Add(testproxy.Timeout); ; time.Sleep(time.Millisecond) {
+		if snapshot = proxy.SOCKS5.Snapshot(); snapshot.Active == 0 && snapshot.Sessions == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got snapshot %+v, want sessions over", snapshot)
+		}
+	}
+
+	if snapshot.BytesUp != 4 || snapshot.BytesDown != 4 {
+		t.Errorf("got %d bytes up, %d down, want 4 both", snapshot.BytesUp, snapshot.BytesDown)
+	}
+	if snapshot.Errors["greeting"] != 1 || len(snapshot.Errors) != 1 {
+		t.Errorf("got errors %v, want the rejected greeting", snapshot.Errors)
+	}
+}
+
+func TestIntegration_token(t *testing.T) {
+	echo := testproxy.Echo(t, "127.0.0.1:0")
+	proxy := testproxy.Start(t, proxyme.Options{Token: "secret"})
+
+	tests := []struct {
+		name       string
+		token      string
+		wantStatus byte
+	}{
+		{name: "valid token", token: "secret", wantStatus: 0},
+		{name: "wrong token", token: "wrong", wantStatus: 0xff},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := proxy.Dial(t)
+
+			if method, err := client.Greet(0x80); err != nil || method != 0x80 {
+				t.Fatalf("got method %d, error %v", method, err)
+			}
+			msg := append([]byte{1, byte(len(tt.token))}, tt.token...)
+			if _, err := client.Write(msg); err != nil {
+				t.Fatalf("write token: %v", err)
+			}
+			reply := make([]byte, 2)
+			if _, err := io.ReadFull(client, reply); err != nil || reply[1] != tt.wantStatus {
+				t.Fatalf("got token reply %v, error %v", reply, err)
+			}
+			if tt.wantStatus != 0 {
+				return
+			}
+
+			host, port, _ := net.SplitHostPort(echo.String())
+			portNum, _ := strconv.Atoi(port)
+			if err := client.Request(1, host, portNum); err != nil {
+				t.Fatalf("request: %v", err)
+			}
+			if r, err := client.Reply(); err != nil || r.Status != 0 {
+				t.Fatalf("got reply %v, error %v", r, err)
+			}
+			if err := client.Echo("ping"); err != nil {
+				t.Errorf("echo: %v", err)
+			}
+		})
+	}
+}
+
+func TestIntegration_canary(t *testing.T) {
+	echo := testproxy.Echo(t, "127.0.0.1:0")
+
+	alerts := make(chan proxyme.SessionInfo, 1)
+	proxy := testproxy.Start(t, proxyme.Options{
+		AllowNoAuth: true,
+		Canaries: &proxyme.Canaries{
+			Domains: []string{"vault.corp.example"},
+			Status:  wire.StatusHostUnreachable,
+			Alert:   func(info proxyme.SessionInfo) { alerts <- info },
+		},
+	})
+
+	reply, err := proxy.Dial(t).Connect("vault.corp.example:443")
+	if err != nil || reply.Status != byte(wire.StatusHostUnreachable) {
+		t.Fatalf("got reply %v, error %v, want host unreachable", reply, err)
+	}
+	select {
+	case info := <-alerts:
+		if info.Destination() != "vault.corp.example:443" || info.ClientAddr == nil {
+			t.Errorf("got alert %+v, want session details", info)
+		}
+	default:
+		t.Fatalf("canary alert isn't raised")
+	}
+
+	client := proxy.Dial(t)
+	if reply, err := client.Connect(echo.String()); err != nil || reply.Status != 0 {
+		t.Fatalf("got reply %v, error %v", reply, err)
+	}
+	if err := client.Echo("regular"); err != nil {
+		t.Fatalf("echo: %v", err)
+	}
+	if hits := proxy.SOCKS5.CanaryHits(); hits != 1 {
+		t.Errorf("got %d canary hits, want 1", hits)
+	}
+}
+
+func TestIntegration_authReasons(t *testing.T) {
+	proxy := testproxy.Start(t, proxyme.Options{
+		Authenticate: proxyme.StaticCredentials(map[string]string{"user": "pass"}),
+	})
+
+	tests := []struct {
+		name       string
+		client     func(client *testproxy.Client) error
+		wantReason proxyme.AuthReason
+	}{
+		{
+			name: "unknown user",
+			client: func(client *testproxy.Client) error {
+				_, err := client.Login("nobody", "pass")
+				return err
+			},
+			wantReason: proxyme.AuthUnknownUser,
+		},
+		{
+			name: "bad password",
+			client: func(client *testproxy.Client) error {
+				_, err := client.Login("user", "wrong")
+				return err
+			},
+			wantReason: proxyme.AuthBadPassword,
+		},
+		{
+			name: "malformed",
+			client: func(client *testproxy.Client) error {
+				_, err := client.Write([]byte{5, 1, 'u', 1, 'p'}) // wrong subnegotiation version
+				return err
+			},
+			wantReason: proxyme.AuthMalformed,
+		},
+		{
+			name: "aborted",
+			client: func(client *testproxy.Client) error {
+				_, err := client.Write([]byte{1, 4, 'u'})
+				return err
+			},
+			wantReason: proxyme.AuthAborted,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := len(proxy.Errors())
+
+			client := proxy.Dial(t)
+			if method, err := client.Greet(2); err != nil || method != 2 {
+				t.Fatalf("got method %d, error %v", method, err)
+			}
+			if err := tt.client(client); err != nil {
+				t.Fatalf("client: %v", err)
+			}
+			if tt.wantReason == proxyme.AuthAborted {
+				_ = client.Close()
+			} else if err := client.Closed(); err != nil {
+				t.Fatal(err)
+			}
+
+			var authErr *proxyme.AuthError
+			deadline := time.Now().Add(testproxy.Timeout)
+			for authErr == nil && time.Now().Before(deadline) {
+				for _, err := range proxy.Errors()[before:] {
+					errors.As(err, &authErr)
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+			if authErr == nil || authErr.Reason != tt.wantReason || authErr.Method != 2 {
+				t.Fatalf("got auth error %v, want reason %s", authErr, tt.wantReason)
+			}
+		})
+	}
+
+	client := proxy.Dial(t)
+	if method, err := client.Greet(0); err != nil || method != 0xff {
+		t.Fatalf("got method %d, error %v, want no acceptable methods", method, err)
+	}
+	_ = client.Closed()
+
+	failures := proxy.SOCKS5.AuthFailures()
+	for _, reason := range []proxyme.AuthReason{
+		proxyme.AuthUnknownUser, proxyme.AuthBadPassword, proxyme.AuthMalformed,
+		proxyme.AuthAborted, proxyme.AuthUnsupportedMethod,
+	} {
+		if failures[reason] != 1 {
+			t.Errorf("got %d failures of %s, want 1", failures[reason], reason)
+		}
+	}
+}
+
+func TestIntegration_pipelinedReplies(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("pending input is detected on linux only")
+	}
+
+	echo := testproxy.Echo(t, "127.0.0.1:0")
+	proxy := testproxy.Start(t, proxyme.Options{
+		Authenticate: func(username, password []byte) error { return nil },
+	})
+
+	t.Run("pipelined", func(t *testing.T) {
+		client := proxy.Dial(t)
+		// the client sends greeting, login and request at once and gets all replies in one segment
+		msgs := append(testsupport.Greeting(wire.MethodLogin).Send, testsupport.Login("user", "secret").Send...)
+		msgs = append(msgs, testsupport.Request(wire.CommandConnect, echo.String()).Send...)
+		if _, err := client.Write(msgs); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+
+		buf := make([]byte, 64)
+		n, err := client.Read(buf)
+		if err != nil {
+			t.Fatalf("read: %v", err)
+		}
+		if n != 2+2+10 || buf[1] != byte(wire.MethodLogin) || buf[3] != wire.LoginSucceeded || buf[5] != 0 {
+			t.Fatalf("got replies % x, want method, login and command replies in a single segment", buf[:n])
+		}
+		if err := client.Echo("pipelined"); err != nil {
+			t.Fatalf("echo: %v", err)
+		}
+	})
+
+	t.Run("waiting for replies", func(t *testing.T) {
+		client := proxy.Dial(t)
+		err := client.Run(
+			testsupport.Greeting(wire.MethodLogin),
+			testsupport.ExpectMethod(wire.MethodLogin),
+			testsupport.Login("user", "secret"),
+			testsupport.ExpectLogin(wire.LoginSucceeded),
+			testsupport.Request(wire.CommandConnect, echo.String()),
+			testsupport.ExpectReply(wire.StatusSucceeded),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestIntegration_earlyData(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("pending input is detected on linux only")
+	}
+
+	echo := testproxy.Echo(t, "127.0.0.1:0")
+
+	tests := []struct {
+		name       string
+		mode       proxyme.EarlyData
+		wantStatus wire.Status
+	}{
+		{name: "relay", mode: proxyme.EarlyDataRelay, wantStatus: wire.StatusSucceeded},
+		{name: "forward", mode: proxyme.EarlyDataForward, wantStatus: wire.StatusSucceeded},
+		{name: "reject", mode: proxyme.EarlyDataReject, wantStatus: wire.StatusNotAllowed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proxy := testproxy.Start(t, proxyme.Options{AllowNoAuth: true, EarlyData: tt.mode})
+			client := proxy.Dial(t)
+
+			// the client sends ClientHello along with the request without waiting for the reply
+			msgs := append(testsupport.Greeting(wire.MethodNoAuth).Send, testsupport.Request(wire.CommandConnect, echo.String()).Send...)
+			if _, err := client.Write(append(msgs, "hello"...)); err != nil {
+				t.Fatalf("write: %v", err)
+			}
+
+			err := client.Run(
+				testsupport.ExpectMethod(wire.MethodNoAuth),
+				testsupport.ExpectReply(tt.wantStatus),
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if tt.wantStatus != wire.StatusSucceeded {
+				if err := client.Closed(); err != nil {
+					t.Errorf("client: %v", err)
+				}
+				return
+			}
+
+			buf := make([]byte, len("hello"))
+			if _, err := io.ReadFull(client, buf); err != nil || string(buf) != "hello" {
+				t.Fatalf("got %q, %v, want early data echoed", buf, err)
+			}
+			if err := client.Echo("after the reply"); err != nil {
+				t.Fatalf("echo: %v", err)
+			}
+		})
+	}
+}
+
+func TestIntegration_fastOpen(t *testing.T) {
+	echo := testproxy.Echo(t, "127.0.0.1:0")
+
+	tests := []struct {
+		name       string
+		earlyData  proxyme.EarlyData
+		pipelined  bool  // the client sends data along with the request
+		connectErr error // connecting fails once the client has sent data
+		rules      func(info proxyme.SessionInfo) error
+		wantStatus wire.Status
+	}{
+		{name: "data sent while connecting", wantStatus: wire.StatusSucceeded},
+		{name: "early data sent along with the request", earlyData: proxyme.EarlyDataForward, pipelined: true,
+			wantStatus: wire.StatusSucceeded},
+		{name: "connect fails after data is sent", connectErr: proxyme.ErrConnectionRefused,
+			wantStatus: wire.StatusSucceeded},
+		{name: "connect fails after early data is taken", earlyData: proxyme.EarlyDataForward, pipelined: true,
+			connectErr: proxyme.ErrConnectionRefused, wantStatus: wire.StatusSucceeded},
+		{name: "denied destination is replied", rules: func(proxyme.SessionInfo) error { return proxyme.ErrNotAllowed },
+			wantStatus: wire.StatusNotAllowed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.pipelined && runtime.GOOS != "linux" {
+				t.Skip("pending input is detected on linux only")
+			}
+
+			release := make(chan struct{})
+			proxy := testproxy.Start(t, proxyme.Options{
+				AllowNoAuth: true,
+				FastOpen:    true,
+				EarlyData:   tt.earlyData,
+				Rules:       tt.rules,
+				Connect: func(addressType int, addr []byte, port int) (net.Conn, error) {
+					// connecting takes until the client has got the reply and sent data
+					<-release
+					if tt.connectErr != nil {
+						return nil, tt.connectErr
+					}
+					return net.Dial("tcp", echo.String())
+				},
+			})
+			client := proxy.Dial(t)
+
+			msgs := append(testsupport.Greeting(wire.MethodNoAuth).Send, testsupport.Request(wire.CommandConnect, echo.String()).Send...)
+			if tt.pipelined {
+				msgs = append(msgs, "hello"...)
+			}
+			if _, err := client.Write(msgs); err != nil {
+				t.Fatalf("write: %v", err)
+			}
+			err := client.Run(
+				testsupport.ExpectMethod(wire.MethodNoAuth),
+				testsupport.ExpectReply(tt.wantStatus),
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.wantStatus != wire.StatusSucceeded {
+				return
+			}
+
+			if !tt.pipelined {
+				if _, err := client.Write([]byte("hello")); err != nil {
+					t.Fatalf("write: %v", err)
+				}
+			}
+			close(release)
+
+			if tt.connectErr != nil {
+				if err := client.Closed(); err != nil {
+					t.Errorf("client: %v", err)
+				}
+
+				deadline := time.Now().Add(testproxy.Timeout)
+				for !slices.ContainsFunc(proxy.Errors(), func(err error) bool { return errors.Is(err, tt.connectErr) }) {
+					if time.Now().After(deadline) {
+						t.Fatalf("got errors %v, want %v", proxy.Errors(), tt.connectErr)
+					}
+					time.Sleep(10 * time.Millisecond)
+				}
+				return
+			}
+
+			buf := make([]byte, len("hello"))
+			if _, err := io.ReadFull(client, buf); err != nil || string(buf) != "hello" {
+				t.Fatalf("got %q, %v, want data sent before connected echoed", buf, err)
+			}
+			if err := client.Echo("after connected"); err != nil {
+				t.Fatalf("echo: %v", err)
+			}
+		})
+	}
+}
+
+func TestIntegration_quirks(t *testing.T) {
+	echo := testproxy.Echo(t, "127.0.0.1:0")
+	request := []byte{5, 1, 0, 1, 127, 0, 0, 1, byte(echo.Port >> 8), byte(echo.Port)}
+
+	t.Run("pipelining client reading replies at once", func(t *testing.T) {
+		proxy := testproxy.Start(t, proxyme.Options{AllowNoAuth: true, Quirks: proxyme.Quirks{CombineReplies: true}})
+		client := proxy.Dial(t)
+
+		// the client sends greeting and request together and expects both replies in one read
+		if _, err := client.Write(append([]byte{5, 1, 0}, request...)); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		buf := make([]byte, 64)
+		n, err := client.Read(buf)
+		if err != nil {
+			t.Fatalf("read: %v", err)
+		}
+		if n != 2+10 || buf[1] != 0 || buf[3] != 0 {
+			t.Fatalf("got replies % x, want method and command replies in a single segment", buf[:n])
+		}
+		if err := client.Echo("combined"); err != nil {
+			t.Fatalf("echo: %v", err)
+		}
+	})
+
+	t.Run("non-zero rsv", func(t *testing.T) {
+		for _, tolerate := range []bool{false, true} {
+			proxy := testproxy.Start(t, proxyme.Options{AllowNoAuth: true, Quirks: proxyme.Quirks{TolerateRSV: tolerate}})
+			client := proxy.Dial(t)
+
+			if _, err := client.Greet(0); err != nil {
+				t.Fatalf("greet: %v", err)
+			}
+			req := append([]byte(nil), request...)
+			req[2] = 0xff
+			if _, err := client.Write(req); err != nil {
+				t.Fatalf("write: %v", err)
+			}
+
+			reply, err := client.Reply()
+			if !tolerate {
+				if err == nil {
+					t.Errorf("strict server replied %v to request with non-zero rsv", reply)
+				}
+				continue
+			}
+			if err != nil || reply.Status != 0 {
+				t.Fatalf("got reply %v, error %v, want succeeded", reply, err)
+			}
+		}
+	})
+
+	t.Run("write through with reply delay", func(t *testing.T) {
+		const delay = 100 * time.Millisecond
+		proxy := testproxy.Start(t, proxyme.Options{
+			AllowNoAuth: true,
+			Quirks:      proxyme.Quirks{WriteThrough: true, MethodReplyDelay: delay},
+		})
+		client := proxy.Dial(t)
+
+		start := time.Now()
+		if _, err := client.Greet(0); err != nil {
+			t.Fatalf("greet: %v", err)
+		}
+		if elapsed := time.Since(start); elapsed < delay {
+			t.Errorf("method reply is sent in %v, want delay %v", elapsed, delay)
+		}
+		if _, err := client.Write(request); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		if reply, err := client.Reply(); err != nil || reply.Status != 0 {
+			t.Fatalf("got reply %v, error %v, want succeeded", reply, err)
+		}
+		if err := client.Echo("write through"); err != nil {
+			t.Fatalf("echo: %v", err)
+		}
+	})
+}
+
+func TestIntegration_lenientParsing(t *testing.T) {
+	echo := testproxy.Echo(t, "127.0.0.1:0")
+
+	// embedded client sending C string domain name and garbage in RSV
+	request := testsupport.Request(wire.CommandConnect, net.JoinHostPort("localhost\x00", strconv.Itoa(echo.Port))).Patch(2, 0x80)
+
+	t.Run("strict", func(t *testing.T) {
+		proxy := testproxy.Start(t, proxyme.Options{AllowNoAuth: true})
+		err := proxy.Dial(t).Run(
+			testsupport.Greeting(wire.MethodNoAuth),
+			testsupport.ExpectMethod(wire.MethodNoAuth),
+			request,
+			testsupport.ExpectClosed(),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("lenient", func(t *testing.T) {
+		proxy := testproxy.Start(t, proxyme.Options{AllowNoAuth: true, LenientParsing: true})
+		client := proxy.Dial(t)
+		err := client.Run(
+			testsupport.Greeting(wire.MethodNoAuth),
+			testsupport.ExpectMethod(wire.MethodNoAuth),
+			request,
+			testsupport.ExpectReply(wire.StatusSucceeded),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := client.Echo("lenient"); err != nil {
+			t.Fatalf("echo: %v", err)
+		}
+
+		errs := proxy.Errors()
+		if len(errs) == 0 || !errors.Is(errs[0], proxyme.ErrProtocolDeviation) {
+			t.Errorf("got errors %v, want protocol deviation reported", errs)
+		}
+	})
+}
+
+func TestIntegration_unknownAddressType(t *testing.T) {
+	proxy := testproxy.Start(t, proxyme.Options{AllowNoAuth: true, FailureLinger: time.Second})
+
+	// the payload of unknown address type is left unread by the server
+	err := proxy.Dial(t).Run(
+		testsupport.Greeting(wire.MethodNoAuth),
+		testsupport.ExpectMethod(wire.MethodNoAuth),
+		testsupport.Request(wire.CommandConnect, "unknown:80").Patch(3, 9),
+		testsupport.ExpectReply(wire.StatusAddressNotSupported),
+		testsupport.ExpectClosed(),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestIntegration_sessionDeadline(t *testing.T) {
+	echo := testproxy.Echo(t, "127.0.0.1:0")
+
+	path := filepath.Join(t.TempDir(), "rules")
+	if err := os.WriteFile(path, []byte("allow duration=300ms\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	rules, err := proxyme.LoadRules(path)
+	if err != nil {
+		t.Fatalf("LoadRules() error = %v", err)
+	}
+
+	proxy := testproxy.Start(t, proxyme.Options{
+		AllowNoAuth:     true,
+		Rules:           rules.Check,
+		SessionDeadline: rules.Deadline,
+	})
+
+	client := proxy.Dial(t)
+	if reply, err := client.Connect(echo.String()); err != nil || reply.Status != 0 {
+		t.Fatalf("got reply %v, error %v", reply, err)
+	}
+	if err := client.Echo("before deadline"); err != nil {
+		t.Fatalf("echo: %v", err)
+	}
+
+	started := time.Now()
+	if err := client.Closed(); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(started); elapsed > 2*time.Second {
+		t.Errorf("session terminated in %v, want 300ms", elapsed)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for proxy.SOCKS5.ExpiredSessions() == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := proxy.SOCKS5.ExpiredSessions(); n != 1 {
+		t.Errorf("got %d expired sessions, want 1", n)
+	}
+	for time.Now().Before(deadline) && len(proxy.Errors()) == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if errs := proxy.Errors(); len(errs) == 0 || !errors.Is(errs[len(errs)-1], proxyme.ErrSessionExpired) {
+		t.Errorf("got errors %v, want session expiration reported", errs)
+	}
+}
+
+func TestIntegration_events(t *testing.T) {
+	proxy := testproxy.Start(t, proxyme.Options{
+		Authenticate: proxyme.StaticCredentials(map[string]string{"user": "pass"}),
+		Rules: func(info proxyme.SessionInfo) error {
+			return proxyme.ErrNotAllowed
+		},
+		EventLogSize: 64,
+	})
+
+	err := proxy.Dial(t).Run(
+		testsupport.Greeting(wire.MethodNoAuth, wire.MethodLogin),
+		testsupport.ExpectMethod(wire.MethodLogin),
+		testsupport.Login("user", "pass"),
+		testsupport.ExpectLogin(wire.LoginSucceeded),
+		testsupport.Request(wire.CommandConnect, "10.0.0.1:443"),
+		testsupport.ExpectReply(wire.StatusNotAllowed),
+		testsupport.ExpectClosed(),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []struct {
+		kind   proxyme.EventKind
+		detail string
+	}{
+		{kind: proxyme.EventAccepted},
+		{kind: proxyme.EventMethod, detail: "login"},
+		{kind: proxyme.EventAuth, detail: `"user"`},
+		{kind: proxyme.EventCommand, detail: "connect 10.0.0.1:443"},
+		{kind: proxyme.EventError, detail: "not allowed"},
+		{kind: proxyme.EventReply, detail: "not allowed by ruleset 10.0.0.1:443"},
+		{kind: proxyme.EventClosed, detail: "not allowed"},
+	}
+
+	var events []proxyme.Event
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if events = proxy.SOCKS5.Events(); len(events) >= len(want) {
+			break
+		}
+	}
+	if len(events) != len(want) {
+		t.Fatalf("got events %v, want %d", events, len(want))
+	}
+	for i, e := range events {
+		if e.Kind != want[i].kind || !strings.Contains(e.Detail, want[i].detail) || e.Session != events[0].Session {
+			t.Errorf("got event %d %v, want %s %q", i, e, want[i].kind, want[i].detail)
+		}
+	}
+}
+
+func TestIntegration_hosts(t *testing.T) {
+	echo := testproxy.Echo(t, "127.0.0.1:0")
+	_, port, _ := net.SplitHostPort(echo.String())
+
+	for _, withRules := range []bool{false, true} {
+		t.Run("rules "+strconv.FormatBool(withRules), func(t *testing.T) {
+			resolved := make(chan []net.IP, 1)
+			opts := proxyme.Options{
+				AllowNoAuth: true,
+				Hosts:       map[string][]net.IP{"echo.internal": {net.IPv4(127, 0, 0, 1)}},
+			}
+			if withRules {
+				opts.Rules = func(info proxyme.SessionInfo) error {
+					resolved <- info.ResolvedIPs
+					return nil
+				}
+			}
+			proxy := testproxy.Start(t, opts)
+
+			client := proxy.Dial(t)
+			if reply, err := client.Connect(net.JoinHostPort("echo.internal", port)); err != nil || reply.Status != 0 {
+				t.Fatalf("got reply %v, error %v", reply, err)
+			}
+			if err := client.Echo("pinned"); err != nil {
+				t.Fatalf("echo: %v", err)
+			}
+
+			if withRules {
+				if ips := <-resolved; len(ips) != 1 || !ips[0].Equal(net.IPv4(127, 0, 0, 1)) {
+					t.Errorf("rules got resolved ips %v, want the pinned one", ips)
+				}
+			}
+		})
+	}
+}
+
+func TestIntegration_metadata(t *testing.T) {
+	tenants := map[string]string{"alice": "acme", "bob": "initech"}
+	established := make(chan string, 1)
+	proxy := testproxy.Start(t, proxyme.Options{
+		AuthenticateContext: func(ctx context.Context, username, password []byte) error {
+			proxyme.MetadataFromContext(ctx).Set("tenant", tenants[string(username)])
+			return nil
+		},
+		Rules: func(info proxyme.SessionInfo) error {
+			if info.Metadata.String("tenant") != "acme" {
+				return proxyme.ErrNotAllowed
+			}
+			return nil
+		},
+		OnEstablished: func(client io.ReadWriteCloser, upstream net.Conn, info proxyme.SessionInfo) {
+			established <- info.Metadata.String("tenant")
+			_ = client.Close()
+			_ = upstream.Close()
+		},
+	})
+	echo := testproxy.Echo(t, "127.0.0.1:0")
+
+	tests := []struct {
+		username string
+		status   wire.Status
+	}{
+		{username: "alice", status: wire.StatusSucceeded},
+		{username: "bob", status: wire.StatusNotAllowed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.username, func(t *testing.T) {
+			client := proxy.Dial(t)
+			err := client.Run(
+				testsupport.Greeting(wire.MethodLogin),
+				testsupport.ExpectMethod(wire.MethodLogin),
+				testsupport.Login(tt.username, "secret"),
+				testsupport.ExpectLogin(wire.LoginSucceeded),
+				testsupport.Request(wire.CommandConnect, echo.String()),
+				testsupport.ExpectReply(tt.status),
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+
+	if tenant := <-established; tenant != "acme" {
+		t.Errorf("OnEstablished got tenant %q, want acme", tenant)
+	}
+}
+
+func TestIntegration_normalizedDomain(t *testing.T) {
+	names := make(chan string, 1)
+	proxy := testproxy.Start(t, proxyme.Options{
+		AllowNoAuth: true,
+		Rules: func(info proxyme.SessionInfo) error {
+			names <- string(info.Addr)
+			return proxyme.ErrNotAllowed
+		},
+		Resolve: func(host string) ([]net.IP, error) {
+			return []net.IP{net.IPv4(192, 0, 2, 1)}, nil
+		},
+	})
+
+	tests := []struct {
+		name string
+		host string
+		want string
+	}{
+		{name: "trailing dot", host: "WWW.Example.COM.", want: "www.example.com"},
+		{name: "unicode", host: "Пример.РФ", want: "xn--e1afmkfd.xn--p1ai"},
+		{name: "punycode", host: "xn--e1afmkfd.xn--p1ai.", want: "xn--e1afmkfd.xn--p1ai"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := proxy.Dial(t).Run(
+				testsupport.Greeting(wire.MethodNoAuth),
+				testsupport.ExpectMethod(wire.MethodNoAuth),
+				testsupport.Request(wire.CommandConnect, net.JoinHostPort(tt.host, "443")),
+				testsupport.ExpectReply(wire.StatusNotAllowed),
+				testsupport.ExpectClosed(),
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := <-names; got != tt.want {
+				t.Errorf("rules got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIntegration_maxSessionDuration(t *testing.T) {
+	echo := testproxy.Echo(t, "127.0.0.1:0")
+
+	tests := []struct {
+		name       string
+		deadline   time.Duration // SessionDeadline after the start, 0 means none
+		wantReason string
+	}{
+		{name: "max duration", wantReason: "max session duration 300ms"},
+		{name: "later deadline", deadline: time.Hour, wantReason: "max session duration 300ms"},
+		{name: "earlier deadline", deadline: 100 * time.Millisecond, wantReason: "deadline"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := proxyme.Options{AllowNoAuth: true, MaxSessionDuration: 300 * time.Millisecond}
+			if tt.deadline > 0 {
+				deadline := time.Now().Add(tt.deadline)
+				opts.SessionDeadline = func(info proxyme.SessionInfo) time.Time { return deadline }
+			}
+			proxy := testproxy.Start(t, opts)
+
+			client := proxy.Dial(t)
+			if reply, err := client.Connect(echo.String()); err != nil || reply.Status != 0 {
+				t.Fatalf("got reply %v, error %v", reply, err)
+			}
+			if err := client.Echo("ping"); err != nil {
+				t.Fatalf("echo: %v", err)
+			}
+			if err := client.Closed(); err != nil {
+				t.Fatal(err)
+			}
+
+			var errs []error
+			for deadline := time.Now().Add(time.Second); len(errs) == 0 && time.Now().Before(deadline); {
+				time.Sleep(10 * time.Millisecond)
+				errs = proxy.Errors()
+			}
+			if len(errs) != 1 || !errors.Is(errs[0], proxyme.ErrSessionExpired) ||
+				!strings.Contains(errs[0].Error(), tt.wantReason) {
+				t.Errorf("got errors %v, want session expiration by %s", errs, tt.wantReason)
+			}
+			if n := proxy.SOCKS5.ExpiredSessions(); n != 1 {
+				t.Errorf("got %d expired sessions, want 1", n)
+			}
+		})
+	}
+}
+
+func TestIntegration_reaper(t *testing.T) {
+	echo := testproxy.Echo(t, "127.0.0.1:0")
+
+	tests := []struct {
+		name      string
+		idle      time.Duration
+		deadline  time.Duration // SessionDeadline moved to after the echo, 0 means none
+		linuxOnly bool          // idle time is known on Linux only
+		wantErr   error
+	}{
+		{name: "idle", idle: 100 * time.Millisecond, linuxOnly: true, wantErr: proxyme.ErrSessionIdle},
+		{name: "deadline moved earlier", deadline: 50 * time.Millisecond, wantErr: proxyme.ErrSessionExpired},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.linuxOnly && (runtime.GOOS != "linux" || runtime.GOARCH == "386") {
+				t.Skip("idle time is known on linux only")
+			}
+
+			var deadline atomic.Int64
+			proxy := testproxy.Start(t, proxyme.Options{
+				AllowNoAuth:  true,
+				IdleTimeout:  tt.idle,
+				ReapInterval: 20 * time.Millisecond,
+				SessionDeadline: func(info proxyme.SessionInfo) time.Time {
+					if n := deadline.Load(); n > 0 {
+						return time.Unix(0, n)
+					}
+					return time.Time{}
+				},
+			})
+
+			client := proxy.Dial(t)
+			if reply, err := client.Connect(echo.String()); err != nil || reply.Status != 0 {
+				t.Fatalf("got reply %v, error %v", reply, err)
+			}
+			if err := client.Echo("ping"); err != nil {
+				t.Fatalf("echo: %v", err)
+			}
+			if tt.deadline > 0 {
+				deadline.Store(time.Now().Add(tt.deadline).UnixNano())
+			}
+			if err := client.Closed(); err != nil {
+				t.Fatal(err)
+			}
+
+			var errs []error
+			for deadline := time.Now().Add(time.Second); len(errs) == 0 && time.Now().Before(deadline); {
+				time.Sleep(10 * time.Millisecond)
+				errs = proxy.Errors()
+			}
+			if len(errs) != 1 || !errors.Is(errs[0], tt.wantErr) {
+				t.Errorf("got errors %v, want %v", errs, tt.wantErr)
+			}
+			if n := proxy.SOCKS5.ReapedSessions() + proxy.SOCKS5.ExpiredSessions(); n != 1 {
+				t.Errorf("got %d reaped and expired sessions, want 1", n)
+			}
+		})
+	}
+}
+
+// sessionEvents records session events.
+type sessionEvents struct {
+	mu     sync.Mutex
+	events []proxyme.SessionEvent
+}
+
+func (s *sessionEvents) SessionEvent(e proxyme.SessionEvent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.events = append(s.events, e)
+}
+
+func (s *sessionEvents) get() []proxyme.SessionEvent {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return slices.Clone(s.events)
+}
+
+func TestIntegration_sessionEvents(t *testing.T) {
+	echo := testproxy.Echo(t, "127.0.0.1:0")
+	sink := &sessionEvents{}
+	proxy := testproxy.Start(t, proxyme.Options{
+		AllowNoAuth:   true,
+		DeniedPorts:   []int{25},
+		SessionEvents: sink,
+	})
+
+	// sessions failed before the tunnel is established aren't reported
+	if reply, err := proxy.Dial(t).Connect("127.0.0.1:25"); err != nil || reply.Status != 2 {
+		t.Fatalf("got reply %v, error %v", reply, err)
+	}
+
+	client := proxy.Dial(t)
+	if reply, err := client.Connect(echo.String()); err != nil || reply.Status != 0 {
+		t.Fatalf("got reply %v, error %v", reply, err)
+	}
+	if err := client.Echo("ping"); err != nil {
+		t.Fatalf("echo: %v", err)
+	}
+	_ = client.Close()
+
+	var events []proxyme.SessionEvent
+	for deadline := time.Now().Add(time.Second); len(events) < 2 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+		events = sink.get()
+	}
+	if len(events) != 2 {
+		t.Fatalf("got events %v, want start and end", events)
+	}
+
+	start, end := events[0], events[1]
+	if start.Type != proxyme.SessionStart || start.Info.Destination() != echo.String() || start.ID == "" {
+		t.Errorf("got start event %+v", start)
+	}
+	if end.Type != proxyme.SessionEnd || end.ID != start.ID || end.BytesUp != 4 || end.BytesDown != 4 || end.Duration <= 0 {
+		t.Errorf("got end event %+v", end)
+	}
+}
+
+func TestIntegration_maxSessionsPerUser(t *testing.T) {
+	echo := testproxy.Echo(t, "127.0.0.1:0")
+	proxy := testproxy.Start(t, proxyme.Options{
+		Authenticate:        proxyme.StaticCredentials(map[string]string{"user": "pass"}),
+		MaxSessionsPerUser:  1,
+		SessionQueueTimeout: 300 * time.Millisecond,
+	})
+
+	connect := func(client *testproxy.Client, status wire.Status) error {
+		return client.Run(
+			testsupport.Greeting(wire.MethodLogin),
+			testsupport.ExpectMethod(wire.MethodLogin),
+			testsupport.Login("user", "pass"),
+			testsupport.ExpectLogin(wire.LoginSucceeded),
+			testsupport.Request(wire.CommandConnect, echo.String()),
+			testsupport.ExpectReply(status),
+		)
+	}
+
+	first := proxy.Dial(t)
+	if err := connect(first, wire.StatusSucceeded); err != nil {
+		t.Fatal(err)
+	}
+	if err := first.Echo("first"); err != nil {
+		t.Fatalf("echo: %v", err)
+	}
+	if got := proxy.SOCKS5.UserSessions()["user"]; got != (proxyme.UserSessions{Active: 1}) {
+		t.Errorf("got usage %v, want 1 active session", got)
+	}
+
+	// no slot is freed within the queue timeout
+	if err := connect(proxy.Dial(t), wire.StatusNotAllowed); err != nil {
+		t.Fatal(err)
+	}
+	if errs := proxy.Errors(); len(errs) == 0 || !errors.Is(errs[len(errs)-1], proxyme.ErrTooManySessions) {
+		t.Errorf("got errors %v, want too many sessions", errs)
+	}
+
+	// the queued command gets the slot of the finished session
+	second, queued := proxy.Dial(t), make(chan error, 1)
+	go func() { queued <- connect(second, wire.StatusSucceeded) }()
+	time.Sleep(100 * time.Millisecond)
+	_ = first.Close()
+
+	if err := <-queued; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestIntegration_topStats(t *testing.T) {
+	echo := testproxy.Echo(t, "127.0.0.1:0")
+	proxy := testproxy.Start(t, proxyme.Options{
+		AllowNoAuth:  true,
+		Authenticate: proxyme.StaticCredentials(map[string]string{"user": "pass"}),
+		TopStatsSize: 10,
+	})
+
+	client := proxy.Dial(t)
+	err := client.Run(
+		testsupport.Greeting(wire.MethodLogin),
+		testsupport.ExpectMethod(wire.MethodLogin),
+		testsupport.Login("user", "pass"),
+		testsupport.ExpectLogin(wire.LoginSucceeded),
+		testsupport.Request(wire.CommandConnect, echo.String()),
+		testsupport.ExpectReply(wire.StatusSucceeded),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Echo("hello"); err != nil {
+		t.Fatalf("echo: %v", err)
+	}
+	_ = client.Close()
+
+	if reply, err := proxy.Dial(t).Connect("127.0.0.1:1"); err != nil || reply.Status == 0 {
+		t.Fatalf("got reply %v, error %v, want failure", reply, err)
+	}
+
+	// bytes are counted once the session is over
+	var top proxyme.TopStats
+	deadline := time.Now().Add(time.Second)
+	for len(top.Users) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		top = proxy.SOCKS5.TopStats(10)
+	}
+
+	if len(top.Destinations) != 2 {
+		t.Errorf("got destinations %v, want 2", top.Destinations)
+	}
+	if want := (proxyme.TopEntry{Key: "user", Count: 10}); len(top.Users) != 1 || top.Users[0] != want {
+		t.Errorf("got users %v, want %v", top.Users, want)
+	}
+	if replies := proxy.SOCKS5.Replies(); replies[int(wire.StatusSucceeded)] != 1 || len(replies) != 2 {
+		t.Errorf("got replies %v, want a success and a failure", replies)
+	}
+}
+
+func TestIntegration_udpAssociate(t *testing.T) {
+	echo := testproxy.EchoUDP(t, "127.0.0.1:0")
+	proxy := testproxy.Start(t, proxyme.Options{
+		AllowNoAuth:        true,
+		AllowUDPAssociate:  true,
+		UDPMaxDatagramSize: 16,
+		Rules: func(info proxyme.SessionInfo) error {
+			if info.Port == 9 {
+				return proxyme.ErrNotAllowed
+			}
+			return nil
+		},
+	})
+
+	client := proxy.Dial(t)
+	if _, err := client.Greet(0); err != nil {
+		t.Fatalf("greet: %v", err)
+	}
+	if err := client.Request(byte(wire.CommandUDPAssociate), "0.0.0.0", 0); err != nil {
+		t.Fatalf("request: %v", err)
+	}
+	reply, err := client.Reply()
+	if err != nil || reply.Status != byte(wire.StatusSucceeded) {
+		t.Fatalf("got reply %v, error %v", reply, err)
+	}
+
+	relay, err := net.ResolveUDPAddr("udp", reply.Address())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(testproxy.Timeout))
+
+	send := func(frag uint8, dst *net.UDPAddr, data string) {
+		t.Helper()
+
+		addr, err := wire.AddressFrom(dst)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := wire.Datagram{Frag: frag, Address: addr, Data: []byte(data)}.AppendTo(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := conn.WriteToUDP(b, relay); err != nil {
+			t.Fatalf("send: %v", err)
+		}
+	}
+
+	// dropped datagrams go first, so the echo of the last one proves they have been processed
+	send(0, echo, strings.Repeat("x", 17))
+	send(1, echo, "fragment")
+	send(0, &net.UDPAddr{IP: echo.IP, Port: 9}, "denied")
+	send(0, echo, "ping")
+
+	buf := make([]byte, 64<<10)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatalf("receive: %v", err)
+	}
+	d, err := wire.ParseDatagram(buf[:n])
+	if err != nil {
+		t.Fatalf("parse datagram: %v", err)
+	}
+	if string(d.Data) != "ping" || d.Address.String() != echo.String() {
+		t.Errorf("got %q from %v, want %q from %v", d.Data, d.Address, "ping", echo)
+	}
+
+	drops := proxy.SOCKS5.UDPDrops()
+	for reason, want := range map[string]int64{"oversized": 1, "fragmented": 1, "denied": 1, "unsolicited": 0} {
+		if drops[reason] != want {
+			t.Errorf("got %d %s drops, want %d", drops[reason], reason, want)
+		}
+	}
+	if n := proxy.SOCKS5.UDPAssociations(); n != 1 {
+		t.Errorf("got %d associations, want 1", n)
+	}
+
+	// the association terminates with the control connection
+	_ = client.Close()
+	deadline := time.Now().Add(testproxy.Timeout)
+	for proxy.SOCKS5.UDPAssociations() != 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := proxy.SOCKS5.UDPAssociations(); n != 0 {
+		t.Errorf("got %d associations after close, want 0", n)
+	}
+}
+
+func TestIntegration_udpInterceptDNS(t *testing.T) {
+	proxy := testproxy.Start(t, proxyme.Options{
+		AllowNoAuth:       true,
+		AllowUDPAssociate: true,
+		UDPInterceptDNS:   true,
+		Hosts: map[string][]net.IP{
+			"allowed.test": {net.IPv4(192, 0, 2, 1)},
+			"blocked.test": {net.IPv4(192, 0, 2, 2)},
+		},
+		Rules: func(info proxyme.SessionInfo) error {
+			if string(info.Addr) == "blocked.test" {
+				return proxyme.ErrNotAllowed
+			}
+			return nil
+		},
+	})
+
+	client := proxy.Dial(t)
+	if _, err := client.Greet(0); err != nil {
+		t.Fatalf("greet: %v", err)
+	}
+	if err := client.Request(byte(wire.CommandUDPAssociate), "0.0.0.0", 0); err != nil {
+		t.Fatalf("request: %v", err)
+	}
+	reply, err := client.Reply()
+	if err != nil || reply.Status != byte(wire.StatusSucceeded) {
+		t.Fatalf("got reply %v, error %v", reply, err)
+	}
+
+	relay, err := net.ResolveUDPAddr("udp", reply.Address())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(testproxy.Timeout))
+
+	// nothing listens on the port: the answers come from the proxy
+	server := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53}
+	addr, err := wire.AddressFrom(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		host      string
+		wantRcode byte
+		wantIP    net.IP
+	}{
+		{name: "allowed", host: "allowed.test", wantIP: net.IPv4(192, 0, 2, 1)},
+		{name: "blocked", host: "blocked.test", wantRcode: 5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// A query of the host: header of one question, the name, type A and class IN
+			query := []byte{0, 42, 1, 0, 0, 1, 0, 0, 0, 0, 0, 0}
+			for _, label := range strings.Split(tt.host, ".") {
+				query = append(append(query, byte(len(label))), label...)
+			}
+			query = append(query, 0, 0, 1, 0, 1)
+
+			b, err := wire.Datagram{Address: addr, Data: query}.AppendTo(nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := conn.WriteToUDP(b, relay); err != nil {
+				t.Fatalf("send: %v", err)
+			}
+
+			buf := make([]byte, 64<<10)
+			n, err := conn.Read(buf)
+			if err != nil {
+				t.Fatalf("receive: %v", err)
+			}
+			d, err := wire.ParseDatagram(buf[:n])
+			if err != nil {
+				t.Fatalf("parse datagram: %v", err)
+			}
+			if d.Address.String() != server.String() || len(d.Data) < len(query) || d.Data[1] != 42 {
+				t.Fatalf("got %x from %v", d.Data, d.Address)
+			}
+			if rcode := d.Data[3] & 0x0f; rcode != tt.wantRcode {
+				t.Errorf("got rcode %d, want %d", rcode, tt.wantRcode)
+			}
+			if tt.wantIP != nil && !net.IP(d.Data[len(d.Data)-4:]).Equal(tt.wantIP) {
+				t.Errorf("got answer %x, want %v", d.Data[len(query):], tt.wantIP)
+			}
+		})
+	}
+}
+
+func TestIntegration_udpAssociateLimits(t *testing.T) {
+	proxy := testproxy.Start(t, proxyme.Options{
+		AllowNoAuth:                 true,
+		AllowUDPAssociate:           true,
+		UDPIdleTimeout:              100 * time.Millisecond,
+		MaxUDPAssociationsPerClient: 1,
+	})
+
+	first := proxy.Dial(t)
+	err := first.Run(
+		testsupport.Greeting(wire.MethodNoAuth),
+		testsupport.ExpectMethod(wire.MethodNoAuth),
+		testsupport.Request(wire.CommandUDPAssociate, "0.0.0.0:0"),
+		testsupport.ExpectReply(wire.StatusSucceeded),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = proxy.Dial(t).Run(
+		testsupport.Greeting(wire.MethodNoAuth),
+		testsupport.ExpectMethod(wire.MethodNoAuth),
+		testsupport.Request(wire.CommandUDPAssociate, "0.0.0.0:0"),
+		testsupport.ExpectReply(wire.StatusNotAllowed),
+	)
+	if err != nil {
+		t.Errorf("second association: %v", err)
+	}
+
+	// idle association closes the control connection
+	if err := first.Closed(); err != nil {
+		t.Errorf("idle association: %v", err)
+	}
+}
+
+func TestIntegration_bandwidth(t *testing.T) {
+	const rate = 100 << 10
+
+	echo := testproxy.Echo(t, "127.0.0.1:0")
+	proxy := testproxy.Start(t, proxyme.Options{AllowNoAuth: true, SessionBandwidthLimit: rate})
+	client := proxy.Dial(t)
+
+	if _, err := client.Connect(echo.String()); err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+
+	// both directions share the session limit: 80K at 100K/s after the 10K burst
+	start := time.Now()
+	if err := client.Echo(strings.Repeat("x", 40<<10)); err != nil {
+		t.Fatalf("echo: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 500*time.Millisecond {
+		t.Errorf("echo took %v, want at least 500ms within the bandwidth limit", elapsed)
+	}
+}
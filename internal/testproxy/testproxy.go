@@ -0,0 +1,208 @@
+// Package testproxy is the integration test harness: it runs proxyme SOCKS5 server and
+// helper servers over the loopback, clients speak SOCKS5 with testsupport.Client.
+package testproxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dblokhin/proxyme"
+	"github.com/dblokhin/proxyme/testsupport"
+)
+
+// Timeout bounds every network operation of the harness to keep broken tests from hanging.
+const Timeout = 5 * time.Second
+
+// Proxy is SOCKS5 server running over the loopback.
+type Proxy struct {
+	Addr   string          // proxy address
+	SOCKS5 *proxyme.SOCKS5 // protocol handler serving the clients
+
+	mu   sync.Mutex
+	errs []error // errors reported by the handler
+}
+
+// Start runs SOCKS5 server with opts, it's stopped on test cleanup.
+func Start(tb testing.TB, opts proxyme.Options) *Proxy {
+	tb.Helper()
+
+	socks5, err := proxyme.New(opts)
+	if err != nil {
+		tb.Fatalf("new socks5: %v", err)
+	}
+
+	ls := Listen(tb, "tcp", "127.0.0.1:0")
+	p := &Proxy{Addr: ls.Addr().String(), SOCKS5: socks5}
+
+	var wg sync.WaitGroup
+	tb.Cleanup(func() {
+		_ = ls.Close()
+		wg.Wait()
+	})
+
+	go func() {
+		for {
+			conn, err := ls.Accept()
+			if err != nil {
+				return
+			}
+
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				socks5.Handle(conn, p.report)
+				_ = conn.Close()
+			}()
+		}
+	}()
+
+	return p
+}
+
+func (p *Proxy) report(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.errs = append(p.errs, err)
+}
+
+// Errors returns errors reported by the SOCKS5 handler so far.
+func (p *Proxy) Errors() []error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return append([]error(nil), p.errs...)
+}
+
+// Dial connects to the proxy.
+func (p *Proxy) Dial(tb testing.TB) *Client {
+	tb.Helper()
+
+	conn, err := net.DialTimeout("tcp", p.Addr, Timeout)
+	if err != nil {
+		tb.Fatalf("dial proxy: %v", err)
+	}
+	tb.Cleanup(func() { _ = conn.Close() })
+
+	_ = conn.SetDeadline(time.Now().Add(Timeout))
+
+	return &Client{Conn: conn}
+}
+
+// Listen announces on the local address, the listener is closed on test cleanup.
+func Listen(tb testing.TB, network, address string) net.Listener {
+	tb.Helper()
+
+	ls, err := net.Listen(network, address)
+	if err != nil {
+		tb.Fatalf("listen %s %s: %v", network, address, err)
+	}
+	tb.Cleanup(func() { _ = ls.Close() })
+
+	return ls
+}
+
+// Echo runs tcp echo server on the local address and returns its address.
+func Echo(tb testing.TB, address string) *net.TCPAddr {
+	tb.Helper()
+
+	ls := Listen(tb, "tcp", address)
+
+	go func() {
+		for {
+			conn, err := ls.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	return ls.Addr().(*net.TCPAddr)
+}
+
+// Client is SOCKS5 client connection.
+type Client = testsupport.Client
+
+// Reply is server reply on the command.
+type Reply = testsupport.Reply
+
+// EchoUDP runs udp echo server on the local address and returns its address.
+func EchoUDP(tb testing.TB, address string) *net.UDPAddr {
+	tb.Helper()
+
+	addr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		tb.Fatalf("resolve %s: %v", address, err)
+	}
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		tb.Fatalf("listen udp %s: %v", address, err)
+	}
+	tb.Cleanup(func() { _ = conn.Close() })
+
+	go func() {
+		buf := make([]byte, 64<<10)
+		for {
+			n, from, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			_, _ = conn.WriteToUDP(buf[:n], from)
+		}
+	}()
+
+	return conn.LocalAddr().(*net.UDPAddr)
+}
+
+// TLS returns TLS configs of the server and the client trusting it, the certificate is self-signed
+// for the loopback addresses.
+func TLS(tb testing.TB) (server, client *tls.Config) {
+	tb.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		tb.Fatalf("generate key: %v", err)
+	}
+
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		tb.Fatalf("create certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		tb.Fatalf("parse certificate: %v", err)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+
+	server = &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+	client = &tls.Config{RootCAs: roots}
+
+	return server, client
+}
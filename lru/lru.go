@@ -0,0 +1,161 @@
+// Package lru provides concurrency safe LRU cache with optional expiration of entries, it backs
+// the caches of proxyme (auth, resolver) and is usable for custom callbacks (rules, routers).
+package lru
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// Options configure the cache.
+type Options[K comparable, V any] struct {
+	// Size limits the number of entries, the least recently used entry is evicted past the limit.
+	// REQUIRED.
+	Size int
+
+	// TTL is the default time to live of entries.
+	// OPTIONAL, default entries don't expire.
+	TTL time.Duration
+
+	// OnEvict if specified, is called with entries removed by the cache itself: evicted past Size
+	// or expired. It isn't called for Remove, Purge and replaced values. It's called outside
+	// the cache lock, so it may use the cache.
+	// OPTIONAL.
+	OnEvict func(key K, value V)
+}
+
+// Cache is concurrency safe LRU cache. Expired entries are removed on access or evicted as
+// the least recently used ones, they count in Len until then.
+type Cache[K comparable, V any] struct {
+	mu    sync.Mutex
+	opts  Options[K, V]
+	items map[K]*list.Element
+	order list.List // front is the most recently used
+	now   func() time.Time
+}
+
+type entry[K comparable, V any] struct {
+	key     K
+	value   V
+	expires time.Time // zero means never
+}
+
+// New returns empty cache. Size less than 1 is treated as 1.
+func New[K comparable, V any](opts Options[K, V]) *Cache[K, V] {
+	opts.Size = max(opts.Size, 1)
+
+	return &Cache[K, V]{
+		opts:  opts,
+		items: make(map[K]*list.Element),
+		now:   time.Now,
+	}
+}
+
+// Get returns value of the key and marks it recently used.
+func (c *Cache[K, V]) Get(key K) (V, bool) {
+	var (
+		value   V
+		ok      bool
+		evicted []*entry[K, V]
+	)
+
+	c.mu.Lock()
+	if el, found := c.items[key]; found {
+		e := el.Value.(*entry[K, V])
+		if e.expired(c.now()) {
+			c.remove(el)
+			evicted = append(evicted, e)
+		} else {
+			c.order.MoveToFront(el)
+			value, ok = e.value, true
+		}
+	}
+	c.mu.Unlock()
+
+	c.evicted(evicted)
+
+	return value, ok
+}
+
+// Set sets value of the key with the default TTL.
+func (c *Cache[K, V]) Set(key K, value V) {
+	c.SetWithTTL(key, value, c.opts.TTL)
+}
+
+// SetWithTTL sets value of the key expiring after ttl, zero ttl means the entry doesn't expire.
+func (c *Cache[K, V]) SetWithTTL(key K, value V, ttl time.Duration) {
+	var expires time.Time
+	if ttl > 0 {
+		expires = c.now().Add(ttl)
+	}
+
+	var evicted []*entry[K, V]
+
+	c.mu.Lock()
+	if el, ok := c.items[key]; ok {
+		e := el.Value.(*entry[K, V])
+		e.value, e.expires = value, expires
+		c.order.MoveToFront(el)
+	} else {
+		c.items[key] = c.order.PushFront(&entry[K, V]{key: key, value: value, expires: expires})
+
+		for c.order.Len() > c.opts.Size {
+			oldest := c.order.Back()
+			c.remove(oldest)
+			evicted = append(evicted, oldest.Value.(*entry[K, V]))
+		}
+	}
+	c.mu.Unlock()
+
+	c.evicted(evicted)
+}
+
+// Remove removes the key and reports whether it has been in the cache.
+func (c *Cache[K, V]) Remove(key K) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.items[key]
+	if ok {
+		c.remove(el)
+	}
+
+	return ok
+}
+
+// Len returns the number of entries.
+func (c *Cache[K, V]) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.order.Len()
+}
+
+// Purge removes all entries.
+func (c *Cache[K, V]) Purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	clear(c.items)
+	c.order.Init()
+}
+
+func (c *Cache[K, V]) remove(el *list.Element) {
+	c.order.Remove(el)
+	delete(c.items, el.Value.(*entry[K, V]).key)
+}
+
+func (c *Cache[K, V]) evicted(entries []*entry[K, V]) {
+	if c.opts.OnEvict == nil {
+		return
+	}
+
+	for _, e := range entries {
+		c.opts.OnEvict(e.key, e.value)
+	}
+}
+
+func (e *entry[K, V]) expired(now time.Time) bool {
+	return !e.expires.IsZero() && !now.Before(e.expires)
+}
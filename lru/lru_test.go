@@ -0,0 +1,207 @@
+package lru
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+type clock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *clock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.now
+}
+
+func (c *clock) Add(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.now = c.now.Add(d)
+}
+
+func newTestCache(opts Options[string, int]) (*Cache[string, int], *clock) {
+	clk := &clock{now: time.Unix(1700000000, 0)}
+	c := New(opts)
+	c.now = clk.Now
+
+	return c, clk
+}
+
+func TestCache(t *testing.T) {
+	type evicted struct {
+		key   string
+		value int
+	}
+
+	tests := []struct {
+		name        string
+		opts        Options[string, int]
+		run         func(c *Cache[string, int], clk *clock)
+		want        map[string]int // present entries
+		wantMissing []string
+		wantEvicted []evicted
+		wantLen     int
+	}{
+		{
+			name: "least recently used evicted",
+			opts: Options[string, int]{Size: 2},
+			run: func(c *Cache[string, int], clk *clock) {
+				c.Set("a", 1)
+				c.Set("b", 2)
+				c.Get("a")
+				c.Set("c", 3)
+			},
+			want:        map[string]int{"a": 1, "c": 3},
+			wantMissing: []string{"b"},
+			wantEvicted: []evicted{{"b", 2}},
+			wantLen:     2,
+		},
+		{
+			name: "update keeps size",
+			opts: Options[string, int]{Size: 2},
+			run: func(c *Cache[string, int], clk *clock) {
+				c.Set("a", 1)
+				c.Set("b", 2)
+				c.Set("a", 10)
+			},
+			want:    map[string]int{"a": 10, "b": 2},
+			wantLen: 2,
+		},
+		{
+			name: "default ttl",
+			opts: Options[string, int]{Size: 10, TTL: time.Minute},
+			run: func(c *Cache[string, int], clk *clock) {
+				c.Set("a", 1)
+				clk.Add(30 * time.Second)
+				c.Set("b", 2)
+				clk.Add(30 * time.Second)
+			},
+			want:        map[string]int{"b": 2},
+			wantMissing: []string{"a"},
+			wantEvicted: []evicted{{"a", 1}},
+			wantLen:     1,
+		},
+		{
+			name: "ttl per entry",
+			opts: Options[string, int]{Size: 10, TTL: time.Minute},
+			run: func(c *Cache[string, int], clk *clock) {
+				c.SetWithTTL("a", 1, time.Second)
+				c.SetWithTTL("b", 2, 0)
+				clk.Add(time.Hour)
+			},
+			want:        map[string]int{"b": 2},
+			wantMissing: []string{"a"},
+			wantEvicted: []evicted{{"a", 1}},
+			wantLen:     1,
+		},
+		{
+			name: "remove and purge",
+			opts: Options[string, int]{Size: 10},
+			run: func(c *Cache[string, int], clk *clock) {
+				c.Set("a", 1)
+				c.Set("b", 2)
+				c.Remove("a")
+				c.Purge()
+				c.Set("c", 3)
+			},
+			want:        map[string]int{"c": 3},
+			wantMissing: []string{"a", "b"},
+			wantLen:     1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []evicted
+			tt.opts.OnEvict = func(key string, value int) {
+				got = append(got, evicted{key, value})
+			}
+
+			c, clk := newTestCache(tt.opts)
+			tt.run(c, clk)
+
+			for key, want := range tt.want {
+				if v, ok := c.Get(key); !ok || v != want {
+					t.Errorf("Get(%s) = %v, %v, want %v", key, v, ok, want)
+				}
+			}
+			for _, key := range tt.wantMissing {
+				if v, ok := c.Get(key); ok {
+					t.Errorf("Get(%s) = %v, want missing", key, v)
+				}
+			}
+			if n := c.Len(); n != tt.wantLen {
+				t.Errorf("Len() = %d, want %d", n, tt.wantLen)
+			}
+			if len(got) != len(tt.wantEvicted) {
+				t.Fatalf("got evicted %v, want %v", got, tt.wantEvicted)
+			}
+			for i := range got {
+				if got[i] != tt.wantEvicted[i] {
+					t.Errorf("got evicted %v, want %v", got, tt.wantEvicted)
+				}
+			}
+		})
+	}
+}
+
+func TestCache_Remove(t *testing.T) {
+	c := New(Options[string, int]{Size: 1})
+	c.Set("a", 1)
+
+	if !c.Remove("a") {
+		t.Error("Remove() = false, want true")
+	}
+	if c.Remove("a") {
+		t.Error("Remove() = true of removed key")
+	}
+}
+
+func TestCache_onEvictReentrant(t *testing.T) {
+	var c *Cache[string, int]
+	c = New(Options[string, int]{
+		Size: 1,
+		OnEvict: func(key string, value int) {
+			// the callback runs outside the lock
+			c.Len()
+		},
+	})
+
+	c.Set("a", 1)
+	c.Set("b", 2)
+}
+
+func TestCache_concurrent(t *testing.T) {
+	c := New(Options[string, int]{Size: 64, TTL: time.Millisecond, OnEvict: func(string, int) {}})
+
+	var wg sync.WaitGroup
+	for g := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for i := range 1000 {
+				key := strconv.Itoa((g*1000 + i) % 100)
+				c.Set(key, i)
+				c.Get(key)
+				if i%10 == 0 {
+					c.Remove(key)
+				}
+				if i%100 == 0 {
+					c.Len()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n := c.Len(); n > 64 {
+		t.Errorf("Len() = %d exceeds size", n)
+	}
+}
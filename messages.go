@@ -1,45 +1,79 @@
 package proxyme
 
 import (
+	"bytes"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
 	"net"
+	"slices"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/dblokhin/proxyme/wire"
 )
 
 var (
 	errInvalidAddrType  = errors.New("invalid address type")
 	errInvalidAddr      = errors.New("invalid address")
 	errInvalidTokenSize = errors.New("invalid token size")
+
+	errInvalidMessageType = errors.New("invalid gssapi subnegation message type")
 )
 
+// ErrProtocolDeviation is reported to onError of Handle for requests violating RFC 1928 which are
+// tolerated in lenient parsing mode (see Options.LenientParsing), the session goes on.
+var ErrProtocolDeviation = errors.New("protocol deviation")
+
+// maxDomainLength is the max length of domain name in text form (RFC 1035).
+const maxDomainLength = 253
+
 type authRequest struct {
 	version uint8
 	methods []authMethod
+	buf     []byte // read buffer
 }
 
+// ReadFrom reads the request, the methods reuse capacity of a.methods and the header is read
+// into buf if it has capacity, so the request is read without allocations. Repeated methods are
+// dropped keeping the order of the first occurrences (the client preference).
 func (a *authRequest) ReadFrom(r io.Reader) (n int64, err error) {
-	if err = binary.Read(r, binary.BigEndian, &a.version); err != nil {
-		return
+	head, err := readBytes(r, a.buf, 2, &n)
+	if err != nil {
+		return n, err
 	}
-	n++
+	a.version = head[0]
+	size := int(head[1])
 
-	var size uint8
-	if err = binary.Read(r, binary.BigEndian, &size); err != nil {
-		return
+	raw, err := readBytes(r, a.buf, size, &n)
+	if err != nil {
+		return n, err
 	}
-	n++
 
-	a.methods = make([]authMethod, size)
-	for i := 0; i < len(a.methods); i++ {
-		if err = binary.Read(r, binary.BigEndian, &a.methods[i]); err != nil {
-			return
+	var seen [256 / 64]uint64
+	a.methods = slices.Grow(a.methods[:0], size)
+	for _, m := range raw {
+		if bit := uint64(1) << (m % 64); seen[m/64]&bit == 0 {
+			seen[m/64] |= bit
+			a.methods = append(a.methods, authMethod(m))
 		}
-		n++
 	}
 
-	return
+	return n, nil
+}
+
+// readBytes reads n bytes into buf if it has capacity (allocating otherwise) and adds them to total.
+func readBytes(r io.Reader, buf []byte, n int, total *int64) ([]byte, error) {
+	if cap(buf) < n {
+		buf = make([]byte, n)
+	}
+	buf = buf[:n]
+
+	nn, err := io.ReadFull(r, buf)
+	*total += int64(nn)
+
+	return buf, err
 }
 
 func (a *authRequest) validate() error {
@@ -72,6 +106,11 @@ func (a authReply) WriteTo(w io.Writer) (n int64, err error) {
 	return
 }
 
+// appendTo appends the encoded reply to b.
+func (a authReply) appendTo(b []byte) ([]byte, error) {
+	return append(b, protoVersion, byte(a.method)), nil
+}
+
 type commandRequest struct {
 	version     uint8 // MUST BE 5
 	commandType commandType
@@ -81,69 +120,106 @@ type commandRequest struct {
 	port        uint16
 }
 
+// ReadFrom reads the request, the address reuses capacity of c.addr, so the request is read
+// without allocations if it has capacity for the longest domain name and the port.
 func (c *commandRequest) ReadFrom(r io.Reader) (n int64, err error) {
-	if err = binary.Read(r, binary.BigEndian, &c.version); err != nil {
-		return
-	}
-	n++
-
-	// Read CMD and others
-	if err = binary.Read(r, binary.BigEndian, &c.commandType); err != nil {
-		return
-	}
-	n++
-
-	if err = binary.Read(r, binary.BigEndian, &c.rsv); err != nil {
-		return
+	buf := c.addr[:0]
+	if cap(buf) < maxDomainSize+2 {
+		buf = make([]byte, 0, maxDomainSize+2)
 	}
-	n++
 
-	if err = binary.Read(r, binary.BigEndian, &c.addressType); err != nil {
-		return
+	head, err := readBytes(r, buf, 4, &n)
+	if err != nil {
+		return n, err
 	}
-	n++
+	c.version = head[0]
+	c.commandType = commandType(head[1])
+	c.rsv = head[2]
+	c.addressType = addressType(head[3])
 
 	// read the string size
-	var size uint8
+	var size int
 	switch c.addressType {
 	case ipv4:
 		size = net.IPv4len
 	case ipv6:
 		size = net.IPv6len
 	case domainName:
-		if err = binary.Read(r, binary.BigEndian, &size); err != nil {
-			return
+		b, err := readBytes(r, buf, 1, &n)
+		if err != nil {
+			return n, err
 		}
-		n++
+		size = int(b[0])
 	default:
 		return n, errInvalidAddrType
 	}
 
-	c.addr = make([]byte, size)
-	if nn, err := io.ReadFull(r, c.addr); err != nil {
-		return n + int64(nn), err
+	// the address goes along with the port, the port is cut off then
+	addr, err := readBytes(r, buf, size+2, &n)
+	if err != nil {
+		return n, err
 	}
-	n += int64(len(c.addr))
+	c.addr = addr[:size]
+	c.port = binary.BigEndian.Uint16(addr[size:])
 
-	if err = binary.Read(r, binary.BigEndian, &c.port); err != nil {
-		return
+	return n, nil
+}
+
+// deviations collects violations of RFC 1928 tolerated by lenient parsing.
+type deviations []string
+
+// tolerate reports whether the violation is tolerated, tolerated violations are recorded.
+// Nil deviations are strict parsing which tolerates nothing.
+func (d *deviations) tolerate(format string, args ...any) bool {
+	if d == nil {
+		return false
 	}
-	n += 2
+	*d = append(*d, fmt.Sprintf(format, args...))
 
-	return
+	return true
 }
 
-func (c *commandRequest) validate() error {
+// err returns ErrProtocolDeviation listing the deviations, nil if there are none.
+func (d *deviations) err() error {
+	if d == nil || len(*d) == 0 {
+		return nil
+	}
+
+	return fmt.Errorf("%w: %s", ErrProtocolDeviation, strings.Join(*d, ", "))
+}
+
+// validate validates the request, DST.PORT may be zero in requests of custom commands and
+// UDP ASSOCIATE (RFC 1928: the client may not know the port it's going to send datagrams from).
+// Violations are tolerated and recorded to lenient unless it's nil, the request is fixed up
+// if possible (e.g. NUL padding of domain name is trimmed).
+func (c *commandRequest) validate(custom bool, lenient *deviations) error {
 	if c.version != protoVersion {
 		return fmt.Errorf("invalid command.version: %d", c.version)
 	}
 
-	if c.rsv != 0 {
+	if c.rsv != 0 && !lenient.tolerate("rsv %d", c.rsv) {
 		return fmt.Errorf("invalid command.rsv: %d", c.rsv)
 	}
 
 	switch c.addressType {
-	case ipv4, ipv6, domainName:
+	case ipv4, ipv6:
+	case domainName:
+		// some clients send C strings
+		if name := bytes.TrimRight(c.addr, "\x00"); len(name) < len(c.addr) && len(name) > 0 &&
+			bytes.IndexByte(name, 0) < 0 && lenient.tolerate("NUL padded domain name") {
+			c.addr = name
+		}
+		if bytes.IndexByte(c.addr, 0) >= 0 {
+			return fmt.Errorf("%w: NUL in domain name %q", errInvalidAddr, string(c.addr))
+		}
+		// rules, lists and logs see the same name whatever form the client sent
+		c.addr = normalizeDomain(c.addr)
+		if len(c.addr) > maxDomainSize {
+			return fmt.Errorf("%w: domain name of %d bytes", errInvalidAddr, len(c.addr))
+		}
+		if len(c.addr) > maxDomainLength && !lenient.tolerate("domain name of %d bytes", len(c.addr)) {
+			return fmt.Errorf("%w: domain name of %d bytes", errInvalidAddr, len(c.addr))
+		}
 	default:
 		return fmt.Errorf("%w: %d", errInvalidAddrType, c.addressType)
 	}
@@ -154,7 +230,7 @@ func (c *commandRequest) validate() error {
 		return fmt.Errorf("invalid addr: %d %q", c.addressType, string(c.addr))
 	}
 
-	if c.port == 0 {
+	if c.port == 0 && !custom && c.commandType != udpAssoc {
 		return fmt.Errorf("invalid port: %d", c.port)
 	}
 
@@ -226,6 +302,35 @@ func (r commandReply) WriteTo(w io.Writer) (n int64, err error) {
 	return
 }
 
+// appendTo appends the encoded reply to b.
+func (r commandReply) appendTo(b []byte) ([]byte, error) {
+	if len(r.addr) > maxDomainSize {
+		return b, errInvalidAddr
+	}
+
+	switch r.addressType {
+	case ipv4:
+		if len(r.addr) != net.IPv4len {
+			return b, errInvalidAddrType
+		}
+	case ipv6:
+		if len(r.addr) != net.IPv6len {
+			return b, errInvalidAddrType
+		}
+	case domainName:
+	default:
+		return b, errInvalidAddrType
+	}
+
+	b = append(b, protoVersion, byte(r.rep), r.rsv, byte(r.addressType))
+	if r.addressType == domainName {
+		b = append(b, byte(len(r.addr)))
+	}
+	b = append(b, r.addr...)
+
+	return binary.BigEndian.AppendUint16(b, r.port), nil
+}
+
 // loginRequest clients request username/passwd authenticate scenario
 type loginRequest struct {
 	version  uint8 // MUST BE 1
@@ -265,17 +370,53 @@ func (r *loginRequest) ReadFrom(reader io.Reader) (n int64, err error) {
 	return
 }
 
-func (r *loginRequest) validate() error {
+func (r *loginRequest) validate(policy credentialPolicy) error {
 	if r.version != subnVersion {
 		return fmt.Errorf("invalid subnegotion version: %d", r.version)
 	}
 
-	if len(r.username) == 0 {
-		return fmt.Errorf("empty username")
+	if err := policy.check("username", r.username); err != nil {
+		return err
+	}
+
+	if err := policy.check("password", r.password); err != nil {
+		return err
 	}
 
-	if len(r.password) == 0 {
-		return fmt.Errorf("empty password")
+	return nil
+}
+
+// credentialPolicy restricts username/password values.
+// Zero value follows RFC 1929: from 1 up to 255 bytes of any content.
+type credentialPolicy struct {
+	allowEmpty bool // deviation from RFC 1929: ULEN/PLEN may be 0
+	minLength  int  // 0 means 1
+	maxLength  int  // 0 means maxCredentialSize
+	utf8       bool // require valid UTF-8
+}
+
+func (p credentialPolicy) check(name string, value []byte) error {
+	if len(value) == 0 {
+		if p.allowEmpty {
+			return nil
+		}
+		return fmt.Errorf("empty %s", name)
+	}
+
+	if len(value) < max(p.minLength, 1) {
+		return fmt.Errorf("too short %s: %d bytes", name, len(value))
+	}
+
+	maxLength := maxCredentialSize
+	if p.maxLength > 0 {
+		maxLength = p.maxLength
+	}
+	if len(value) > maxLength {
+		return fmt.Errorf("too long %s: %d bytes", name, len(value))
+	}
+
+	if p.utf8 && !utf8.Valid(value) {
+		return fmt.Errorf("invalid utf-8 %s", name)
 	}
 
 	return nil
@@ -300,9 +441,15 @@ func (l loginReply) WriteTo(w io.Writer) (n int64, err error) {
 	return
 }
 
+// appendTo appends the encoded reply to b.
+func (l loginReply) appendTo(b []byte) ([]byte, error) {
+	return append(b, subnVersion, byte(l.status)), nil
+}
+
 const (
-	maxTokenSize  = 1<<16 - 1
-	maxDomainSize = 1<<8 - 1
+	maxTokenSize      = wire.MaxTokenSize
+	maxDomainSize     = wire.MaxDomainSize
+	maxCredentialSize = wire.MaxCredentialLen
 )
 
 // gssapiMessage server/client message
@@ -310,6 +457,8 @@ type gssapiMessage struct {
 	version     uint8 // MUST BE 1
 	messageType uint8
 	token       []byte
+
+	limit int // max token size accepted by ReadFrom, 0 means gssMaxTokenSize
 }
 
 func (m *gssapiMessage) WriteTo(w io.Writer) (n int64, err error) {
@@ -355,7 +504,18 @@ func (m *gssapiMessage) ReadFrom(reader io.Reader) (n int64, err error) {
 	}
 	n += 2
 
-	m.token = make([]byte, size)
+	// check the size before allocation
+	if m.limit > 0 && int(size) > m.limit {
+		return n, fmt.Errorf("%w: %d", errInvalidTokenSize, size)
+	}
+
+	// reuse token buffer of the message
+	if cap(m.token) >= int(size) {
+		m.token = m.token[:size]
+	} else {
+		m.token = make([]byte, size)
+	}
+
 	if _, err = io.ReadFull(reader, m.token); err != nil {
 		return
 	}
@@ -374,8 +534,16 @@ func (m *gssapiMessage) validate(messageType uint8) error {
 	}
 
 	if m.messageType != messageType {
-		return fmt.Errorf("invalid gssapi subnegation message type: %d", m.messageType)
+		return fmt.Errorf("%w: %d", errInvalidMessageType, m.messageType)
 	}
 
 	return nil
 }
+
+// gssapiAbort is the server refusal of gssapi negotiation: the message of type X'FF' without token.
+type gssapiAbort struct{}
+
+func (gssapiAbort) WriteTo(w io.Writer) (n int64, err error) {
+	nn, err := w.Write([]byte{subnVersion, gssAbort})
+	return int64(nn), err
+}
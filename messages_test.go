@@ -7,6 +7,7 @@ import (
 	"io"
 	"net"
 	"slices"
+	"strings"
 	"testing"
 )
 
@@ -52,6 +53,24 @@ func Test_authRequest_ReadFrom(t *testing.T) {
 				return nil
 			},
 		},
+		{
+			name: "repeated methods",
+			args: args{
+				r: bytes.NewReader(append([]byte{protoVersion, 255}, bytes.Repeat([]byte{0x02, 0x00, 0x02}, 85)...)),
+			},
+			check: func(msg *authRequest, i int64, err error) error {
+				if err != nil {
+					return fmt.Errorf("unexpected error %v", err)
+				}
+				if i != 2+255 {
+					return fmt.Errorf("got len %d, want %d", i, 2+255)
+				}
+				if !slices.Equal(msg.methods, []authMethod{typeLogin, typeNoAuth}) {
+					return fmt.Errorf("got methods %v, want %v", msg.methods, []authMethod{typeLogin, typeNoAuth})
+				}
+				return nil
+			},
+		},
 		{
 			name: "EOF",
 			args: args{
@@ -327,12 +346,61 @@ func Test_gssapiMessage_ReadFrom(t *testing.T) {
 	payload := append([]byte{subnVersion, gssAuthentication, 0x00, byte(len(token))}, token...)
 	type args struct {
 		reader io.Reader
+		limit  int
 	}
 	tests := []struct {
 		name  string
 		args  args
 		check func(*gssapiMessage, int64, error) error
 	}{
+		{
+			name: "token size equals limit",
+			args: args{
+				reader: bytes.NewReader(payload),
+				limit:  len(token),
+			},
+			check: func(msg *gssapiMessage, i int64, err error) error {
+				if err != nil {
+					return fmt.Errorf("unexpected error %v", err)
+				}
+				if !slices.Equal(msg.token, token) {
+					return fmt.Errorf("got token %s, want %s", msg.token, token)
+				}
+				return nil
+			},
+		},
+		{
+			name: "token size exceeds limit",
+			args: args{
+				reader: bytes.NewReader(payload),
+				limit:  len(token) - 1,
+			},
+			check: func(msg *gssapiMessage, i int64, err error) error {
+				if !errors.Is(err, errInvalidTokenSize) {
+					return fmt.Errorf("got error %v, want %v", err, errInvalidTokenSize)
+				}
+				if i != 4 {
+					return fmt.Errorf("got len %d, want only header read", i)
+				}
+				return nil
+			},
+		},
+		{
+			name: "max token size",
+			args: args{
+				reader: bytes.NewReader(append([]byte{subnVersion, gssEncapsulation, 0xff, 0xff},
+					make([]byte, gssMaxTokenSize)...)),
+			},
+			check: func(msg *gssapiMessage, i int64, err error) error {
+				if err != nil {
+					return fmt.Errorf("unexpected error %v", err)
+				}
+				if len(msg.token) != gssMaxTokenSize {
+					return fmt.Errorf("got token size %d, want %d", len(msg.token), gssMaxTokenSize)
+				}
+				return nil
+			},
+		},
 		{
 			name: "common case",
 			args: args{
@@ -373,7 +441,7 @@ func Test_gssapiMessage_ReadFrom(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			m := &gssapiMessage{}
+			m := &gssapiMessage{limit: tt.args.limit}
 			gotN, err := m.ReadFrom(tt.args.reader)
 			if err := tt.check(m, gotN, err); err != nil {
 				t.Errorf("ReadFrom() = %v", err)
@@ -570,6 +638,23 @@ func Test_commandRequest_validate(t *testing.T) {
 				return fmt.Errorf("got nil, want invalid port error")
 			},
 		},
+		{
+			name: "udp associate with unknown address and port",
+			fields: fields{
+				version:     protoVersion,
+				commandType: udpAssoc,
+				rsv:         0,
+				addressType: ipv4,
+				addr:        net.IPv4zero.To4(),
+				port:        0,
+			},
+			check: func(err error) error {
+				if err != nil {
+					return fmt.Errorf("got %q, want nil", err)
+				}
+				return nil
+			},
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -581,13 +666,124 @@ func Test_commandRequest_validate(t *testing.T) {
 				addr:        tt.fields.addr,
 				port:        tt.fields.port,
 			}
-			if err := tt.check(c.validate()); err != nil {
+			if err := tt.check(c.validate(false, nil)); err != nil {
 				t.Errorf("validate() error = %v", err)
 			}
 		})
 	}
 }
 
+func Test_commandRequest_validateLenient(t *testing.T) {
+	ip := net.ParseIP("192.168.1.1").To4()
+
+	tests := []struct {
+		name       string
+		req        commandRequest
+		wantAddr   string
+		deviations int // tolerated in lenient mode, rejected in strict mode
+		wantErr    bool
+	}{
+		{
+			name:     "valid",
+			req:      commandRequest{version: protoVersion, commandType: connect, addressType: domainName, addr: []byte("example.com"), port: 80},
+			wantAddr: "example.com",
+		},
+		{
+			name:       "non-zero rsv",
+			req:        commandRequest{version: protoVersion, commandType: connect, rsv: 1, addressType: ipv4, addr: ip, port: 80},
+			wantAddr:   string(ip),
+			deviations: 1,
+		},
+		{
+			name:     "zero address and port of udp associate",
+			req:      commandRequest{version: protoVersion, commandType: udpAssoc, addressType: ipv4, addr: net.IPv4zero.To4()},
+			wantAddr: string(net.IPv4zero.To4()),
+		},
+		{
+			name:       "nul padded domain name",
+			req:        commandRequest{version: protoVersion, commandType: connect, rsv: 0xff, addressType: domainName, addr: []byte("example.com\x00\x00"), port: 80},
+			wantAddr:   "example.com",
+			deviations: 2,
+		},
+		{
+			name:       "too long domain name",
+			req:        commandRequest{version: protoVersion, commandType: connect, addressType: domainName, addr: bytes.Repeat([]byte("a"), 255), port: 80},
+			wantAddr:   strings.Repeat("a", 255),
+			deviations: 1,
+		},
+		{
+			name:    "nul inside domain name",
+			req:     commandRequest{version: protoVersion, commandType: connect, addressType: domainName, addr: []byte("example\x00.com"), port: 80},
+			wantErr: true,
+		},
+		{
+			name:    "zero port of connect",
+			req:     commandRequest{version: protoVersion, commandType: connect, addressType: ipv4, addr: ip},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			strict := tt.req
+			if err := strict.validate(false, nil); (err != nil) != (tt.wantErr || tt.deviations > 0) {
+				t.Errorf("strict validate() error = %v", err)
+			}
+
+			lenient := &deviations{}
+			err := tt.req.validate(false, lenient)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("lenient validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if len(*lenient) != tt.deviations || (tt.deviations > 0) != errors.Is(lenient.err(), ErrProtocolDeviation) {
+				t.Errorf("got deviations %q, want %d", *lenient, tt.deviations)
+			}
+			if string(tt.req.addr) != tt.wantAddr {
+				t.Errorf("got addr %q, want %q", tt.req.addr, tt.wantAddr)
+			}
+		})
+	}
+}
+
+func FuzzAuthRequest_ReadFrom(f *testing.F) {
+	f.Add([]byte{protoVersion, 1, 0x00})
+	f.Add([]byte{protoVersion, 3, 0x02, 0x00, 0x02})
+	f.Add(append([]byte{protoVersion, 255}, bytes.Repeat([]byte{0xff}, 255)...))
+	f.Add([]byte{protoVersion, 255, 0x00})
+	f.Add([]byte{protoVersion})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var buf [maxDomainSize + 2]byte
+		a := authRequest{methods: make([]authMethod, 0, 255), buf: buf[:0]}
+
+		n, err := a.ReadFrom(bytes.NewReader(data))
+		if n > int64(len(data)) {
+			t.Fatalf("read %d bytes of %d", n, len(data))
+		}
+		if err != nil {
+			return
+		}
+
+		if len(a.methods) > int(data[1]) {
+			t.Fatalf("got %d methods of NMETHODS %d", len(a.methods), data[1])
+		}
+		seen := make(map[authMethod]bool)
+		for _, m := range a.methods {
+			if seen[m] {
+				t.Fatalf("repeated method %d in %v", m, a.methods)
+			}
+			seen[m] = true
+		}
+		for _, m := range data[2:n] {
+			if !seen[authMethod(m)] {
+				t.Fatalf("method %d is lost", m)
+			}
+		}
+	})
+}
+
 func Test_authRequest_validate(t *testing.T) {
 	type fields struct {
 		version uint8
@@ -657,6 +853,7 @@ func Test_loginRequest_validate(t *testing.T) {
 		version  uint8
 		username []byte
 		password []byte
+		policy   credentialPolicy
 	}
 	tests := []struct {
 		name   string
@@ -720,6 +917,95 @@ func Test_loginRequest_validate(t *testing.T) {
 				return fmt.Errorf("got nil, want invalid password error")
 			},
 		},
+		{
+			name: "max size credentials",
+			fields: fields{
+				version:  subnVersion,
+				username: bytes.Repeat([]byte("u"), maxCredentialSize),
+				password: bytes.Repeat([]byte("p"), maxCredentialSize),
+			},
+			check: func(err error) error {
+				if err != nil {
+					return fmt.Errorf("got %q, want nil", err)
+				}
+				return nil
+			},
+		},
+		{
+			name: "empty credentials allowed",
+			fields: fields{
+				version:  subnVersion,
+				username: nil,
+				password: nil,
+				policy:   credentialPolicy{allowEmpty: true, minLength: 3},
+			},
+			check: func(err error) error {
+				if err != nil {
+					return fmt.Errorf("got %q, want nil", err)
+				}
+				return nil
+			},
+		},
+		{
+			name: "too short username",
+			fields: fields{
+				version:  subnVersion,
+				username: []byte("us"),
+				password: []byte("password"),
+				policy:   credentialPolicy{minLength: 3},
+			},
+			check: func(err error) error {
+				if err != nil {
+					return nil
+				}
+				return fmt.Errorf("got nil, want too short username error")
+			},
+		},
+		{
+			name: "too long password",
+			fields: fields{
+				version:  subnVersion,
+				username: []byte("username"),
+				password: []byte("password"),
+				policy:   credentialPolicy{maxLength: 4},
+			},
+			check: func(err error) error {
+				if err != nil {
+					return nil
+				}
+				return fmt.Errorf("got nil, want too long password error")
+			},
+		},
+		{
+			name: "invalid utf-8",
+			fields: fields{
+				version:  subnVersion,
+				username: []byte{0xff, 0xfe},
+				password: []byte("password"),
+				policy:   credentialPolicy{utf8: true},
+			},
+			check: func(err error) error {
+				if err != nil {
+					return nil
+				}
+				return fmt.Errorf("got nil, want invalid utf-8 error")
+			},
+		},
+		{
+			name: "valid utf-8",
+			fields: fields{
+				version:  subnVersion,
+				username: []byte("пользователь"),
+				password: []byte("пароль"),
+				policy:   credentialPolicy{utf8: true},
+			},
+			check: func(err error) error {
+				if err != nil {
+					return fmt.Errorf("got %q, want nil", err)
+				}
+				return nil
+			},
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -728,7 +1014,7 @@ func Test_loginRequest_validate(t *testing.T) {
 				username: tt.fields.username,
 				password: tt.fields.password,
 			}
-			if err := tt.check(r.validate()); err != nil {
+			if err := tt.check(r.validate(tt.fields.policy)); err != nil {
 				t.Errorf("validate() error = %v", err)
 			}
 		})
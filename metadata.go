@@ -0,0 +1,80 @@
+package proxyme
+
+import "sync"
+
+// Metadata is key/value store of the session shared by its hooks: e.g. the authentication backend
+// stores the tenant of the user, rules and the router read it. It's reachable through
+// SessionInfo.Metadata and, in AuthenticateContext and GSSAPIContext callbacks, through
+// MetadataFromContext. Metadata is safe for concurrent use and lives as long as the session.
+type Metadata struct {
+	mu     sync.RWMutex
+	values map[string]any // created on the first Set
+}
+
+// Get returns the value of the key, ok is false if it's not set.
+func (m *Metadata) Get(key string) (value any, ok bool) {
+	if m == nil {
+		return nil, false
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	value, ok = m.values[key]
+	return value, ok
+}
+
+// String returns the value of the key if it's a string, empty string otherwise.
+func (m *Metadata) String(key string) string {
+	value, _ := m.Get(key)
+	s, _ := value.(string)
+
+	return s
+}
+
+// Set sets the value of the key.
+func (m *Metadata) Set(key string, value any) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.values == nil {
+		m.values = make(map[string]any)
+	}
+	m.values[key] = value
+}
+
+// Delete removes the key.
+func (m *Metadata) Delete(key string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.values, key)
+}
+
+// Len returns the number of keys.
+func (m *Metadata) Len() int {
+	if m == nil {
+		return 0
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return len(m.values)
+}
+
+// Range calls fn for every key and value until fn returns false, fn must not modify the metadata.
+func (m *Metadata) Range(fn func(key string, value any) bool) {
+	if m == nil {
+		return
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for key, value := range m.values {
+		if !fn(key, value) {
+			return
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package proxyme
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func TestMetadata(t *testing.T) {
+	var m Metadata
+
+	if _, ok := m.Get("tenant"); ok || m.Len() != 0 {
+		t.Fatal("got values of empty metadata")
+	}
+
+	m.Set("tenant", "acme")
+	m.Set("quota", 10)
+	m.Set("tenant", "initech")
+	if got := m.String("tenant"); got != "initech" {
+		t.Errorf("String(tenant) = %q, want initech", got)
+	}
+	if got := m.String("quota"); got != "" {
+		t.Errorf("String(quota) = %q, want empty for not string value", got)
+	}
+	if got, ok := m.Get("quota"); !ok || got != 10 {
+		t.Errorf("Get(quota) = %v, %v, want 10, true", got, ok)
+	}
+
+	got := make(map[string]any)
+	m.Range(func(key string, value any) bool {
+		got[key] = value
+		return true
+	})
+	if want := map[string]any{"tenant": "initech", "quota": 10}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Range() got %v, want %v", got, want)
+	}
+
+	m.Delete("tenant")
+	if _, ok := m.Get("tenant"); ok || m.Len() != 1 {
+		t.Errorf("got %d keys after Delete, want 1", m.Len())
+	}
+
+	var nilMetadata *Metadata
+	if _, ok := nilMetadata.Get("tenant"); ok || nilMetadata.Len() != 0 || nilMetadata.String("tenant") != "" {
+		t.Error("got values of nil metadata")
+	}
+}
+
+func TestMetadata_concurrent(t *testing.T) {
+	var (
+		m  Metadata
+		wg sync.WaitGroup
+	)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			m.Set("key", i)
+			m.Get("key")
+			m.Range(func(string, any) bool { return true })
+		}()
+	}
+	wg.Wait()
+
+	if m.Len() != 1 {
+		t.Errorf("got %d keys, want 1", m.Len())
+	}
+}
@@ -0,0 +1,78 @@
+package proxyme
+
+import (
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// defaultThroughputInterval is the default period of reporting relay throughput.
+const defaultThroughputInterval = 10 * time.Second
+
+// countingWriter counts bytes written to w.
+type countingWriter struct {
+	w io.Writer
+	n *atomic.Int64
+}
+
+func (c countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n.Add(int64(n))
+
+	return n, err
+}
+
+// writer returns w counting written bytes if n is not nil.
+func writer(w io.Writer, n *atomic.Int64) io.Writer {
+	if n == nil {
+		return w
+	}
+
+	return countingWriter{w: w, n: n}
+}
+
+// meter reports transfer rates of the relayed session to the metrics sink every interval until
+// the returned stop func is called. Rates are bytes per second written to upstream (up) and
+// to the client (down).
+func (s *state) meter(up, down *atomic.Int64) (stop func()) {
+	interval := s.opts.throughputInterval
+	if interval <= 0 {
+		interval = defaultThroughputInterval
+	}
+
+	name := "relay." + s.session.ID
+	if s.session.ID == "" && s.clientAddr != nil {
+		name = "relay." + s.clientAddr.String()
+	}
+
+	metrics := s.opts.metrics
+	done := make(chan struct{})
+
+	s.spawn(func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		var lastUp, lastDown int64
+		last := time.Now()
+
+		for {
+			select {
+			case <-done:
+				// finished session is no longer a talker
+				metrics.Gauge(name+".up", 0)
+				metrics.Gauge(name+".down", 0)
+				return
+			case now := <-ticker.C:
+				elapsed := now.Sub(last).Seconds()
+				u, d := up.Load(), down.Load()
+
+				metrics.Gauge(name+".up", float64(u-lastUp)/elapsed)
+				metrics.Gauge(name+".down", float64(d-lastDown)/elapsed)
+
+				lastUp, lastDown, last = u, d, now
+			}
+		}
+	})
+
+	return func() { close(done) }
+}
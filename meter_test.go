@@ -0,0 +1,71 @@
+package proxyme
+
+import (
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func Test_state_meter(t *testing.T) {
+	var rec gaugeRecorder
+	s := &state{
+		opts:    SOCKS5{metrics: &rec, throughputInterval: 10 * time.Millisecond},
+		session: Session{ID: "abc"},
+	}
+
+	waitGauge := func(t *testing.T, name string, ok func(float64) bool) {
+		t.Helper()
+
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			if v, found := rec.get(name); found && ok(v) {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("gauge %s isn't reported", name)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	var up, down atomic.Int64
+	stop := s.meter(&up, &down)
+
+	up.Add(1 << 20)
+	waitGauge(t, "relay.abc.up", func(v float64) bool { return v > 0 })
+
+	stop()
+	waitGauge(t, "relay.abc.up", func(v float64) bool { return v == 0 })
+	waitGauge(t, "relay.abc.down", func(v float64) bool { return v == 0 })
+}
+
+func Test_link_metered(t *testing.T) {
+	client, clientSide := net.Pipe()
+	upstream, upstreamSide := net.Pipe()
+
+	var up, down atomic.Int64
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		link(linkOptions{up: &up, down: &down}, upstreamSide, clientSide)
+	}()
+
+	go client.Write([]byte("request")) // nolint
+	if _, err := io.ReadFull(upstream, make([]byte, len("request"))); err != nil {
+		t.Fatal(err)
+	}
+
+	go upstream.Write([]byte("response")) // nolint
+	if _, err := io.ReadFull(client, make([]byte, len("response"))); err != nil {
+		t.Fatal(err)
+	}
+
+	_ = client.Close()
+	<-done
+
+	if up.Load() != int64(len("request")) || down.Load() != int64(len("response")) {
+		t.Errorf("got up %d, down %d bytes, want %d, %d", up.Load(), down.Load(), len("request"), len("response"))
+	}
+}
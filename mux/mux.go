@@ -0,0 +1,371 @@
+// Package mux multiplexes streams over a single connection, it carries proxyme reverse tunnels
+// (see proxyme.Agent and proxyme.Rendezvous). Streams are net.Conn supporting half-close, each of them
+// has its own flow control window, so a slow stream doesn't stall the others.
+//
+// Every frame starts with the header:
+//
+//	+------+-----------+--------+
+//	| TYPE | STREAM ID | LENGTH |
+//	+------+-----------+--------+
+//	|  1   |     4     |   4    |
+//	+------+-----------+--------+
+//
+// LENGTH is the size of DATA frame payload, the window increment of WINDOW frame or the opaque
+// value of PING and PONG frames. Client sessions open odd streams, server sessions open even ones.
+package mux
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	headerSize = 9
+
+	// maxPayload is the max size of DATA frame payload.
+	maxPayload = 16 << 10
+
+	// window is the receive window of a stream: the max amount of data sent to the stream
+	// which hasn't been read yet.
+	window = 256 << 10
+
+	// acceptBacklog is the max number of opened streams waiting for Accept, streams past it are reset.
+	acceptBacklog = 256
+)
+
+type frameType uint8
+
+const (
+	frameOpen   frameType = iota + 1 // the stream is opened
+	frameData                        // stream data
+	frameWindow                      // the receiver has read LENGTH bytes more
+	frameClose                       // the sender has finished sending (half-close)
+	frameReset                       // the stream is aborted
+	framePing                        // keepalive request
+	framePong                        // keepalive response
+)
+
+var (
+	// ErrReset is returned by stream operations after the peer has reset the stream.
+	ErrReset = errors.New("mux: stream reset by peer")
+
+	// ErrSessionClosed is returned by operations of closed session and its streams.
+	ErrSessionClosed = fmt.Errorf("mux: session closed: %w", net.ErrClosed)
+
+	errProtocol = errors.New("mux: protocol error")
+)
+
+// Session multiplexes streams over the connection, it implements net.Listener accepting streams
+// opened by the peer.
+type Session struct {
+	conn net.Conn
+
+	writeMu sync.Mutex // serializes frames
+
+	mu      sync.Mutex
+	streams map[uint32]*Stream
+	nextID  uint32
+	pings   map[uint32]chan struct{}
+	pingID  uint32
+
+	accept    chan *Stream
+	done      chan struct{}
+	closeOnce sync.Once
+	err       error // the reason the session is closed, set before done is closed
+}
+
+// Client returns session over the connection of the side which dialed it.
+func Client(conn net.Conn) *Session {
+	return newSession(conn, 1)
+}
+
+// Server returns session over the connection of the side which accepted it.
+func Server(conn net.Conn) *Session {
+	return newSession(conn, 2)
+}
+
+func newSession(conn net.Conn, firstID uint32) *Session {
+	s := &Session{
+		conn:    conn,
+		streams: make(map[uint32]*Stream),
+		nextID:  firstID,
+		pings:   make(map[uint32]chan struct{}),
+		accept:  make(chan *Stream, acceptBacklog),
+		done:    make(chan struct{}),
+	}
+	go s.recvLoop()
+
+	return s
+}
+
+// Open opens new stream.
+func (s *Session) Open() (*Stream, error) {
+	s.mu.Lock()
+	if s.isClosed() {
+		s.mu.Unlock()
+		return nil, s.Err()
+	}
+
+	id := s.nextID
+	s.nextID += 2
+	st := newStream(s, id)
+	s.streams[id] = st
+	s.mu.Unlock()
+
+	if err := s.writeFrame(frameOpen, id, 0, nil); err != nil {
+		return nil, err
+	}
+
+	return st, nil
+}
+
+// Accept waits for the stream opened by the peer.
+func (s *Session) Accept() (net.Conn, error) {
+	select {
+	case st := <-s.accept:
+		return st, nil
+	case <-s.done:
+		return nil, s.Err()
+	}
+}
+
+// Addr returns local address of the connection.
+func (s *Session) Addr() net.Addr {
+	return s.conn.LocalAddr()
+}
+
+// Ping sends keepalive and waits for the response no longer than timeout, it returns the round trip
+// time. The session is alive as long as pings are responded.
+func (s *Session) Ping(timeout time.Duration) (time.Duration, error) {
+	s.mu.Lock()
+	id := s.pingID
+	s.pingID++
+	pong := make(chan struct{})
+	s.pings[id] = pong
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		delete(s.pings, id)
+		s.mu.Unlock()
+	}()
+
+	start := time.Now()
+	if err := s.writeFrame(framePing, 0, id, nil); err != nil {
+		return 0, err
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-pong:
+		return time.Since(start), nil
+	case <-timer.C:
+		return 0, fmt.Errorf("mux: ping timeout")
+	case <-s.done:
+		return 0, s.Err()
+	}
+}
+
+// NumStreams returns the number of open streams.
+func (s *Session) NumStreams() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.streams)
+}
+
+// Close closes the connection and all the streams.
+func (s *Session) Close() error {
+	s.close(ErrSessionClosed)
+	return nil
+}
+
+// Done is closed once the session is closed.
+func (s *Session) Done() <-chan struct{} {
+	return s.done
+}
+
+// Err returns the reason the session has been closed, nil if it's open.
+func (s *Session) Err() error {
+	select {
+	case <-s.done:
+		return s.err
+	default:
+		return nil
+	}
+}
+
+func (s *Session) isClosed() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *Session) close(err error) {
+	s.closeOnce.Do(func() {
+		s.err = err
+		close(s.done)
+		_ = s.conn.Close()
+
+		s.mu.Lock()
+		streams := s.streams
+		s.streams = make(map[uint32]*Stream)
+		s.mu.Unlock()
+
+		for _, st := range streams {
+			st.abort(ErrSessionClosed)
+		}
+	})
+}
+
+func (s *Session) writeFrame(typ frameType, id, length uint32, payload []byte) error {
+	var hdr [headerSize]byte
+	hdr[0] = byte(typ)
+	binary.BigEndian.PutUint32(hdr[1:5], id)
+	binary.BigEndian.PutUint32(hdr[5:9], length)
+
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	if s.isClosed() {
+		return s.Err()
+	}
+
+	bufs := net.Buffers{hdr[:], payload}
+	if _, err := bufs.WriteTo(s.conn); err != nil {
+		s.close(fmt.Errorf("mux: write: %w", err))
+		return s.Err()
+	}
+
+	return nil
+}
+
+// writeFrameAsync sends the frame from the receive loop without blocking it: if both peers block
+// writing to the full connection while not reading it they deadlock.
+func (s *Session) writeFrameAsync(typ frameType, id, length uint32) {
+	go s.writeFrame(typ, id, length, nil) // nolint: failures close the session
+}
+
+func (s *Session) stream(id uint32) *Stream {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.streams[id]
+}
+
+func (s *Session) remove(id uint32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.streams, id)
+}
+
+func (s *Session) recvLoop() {
+	var hdr [headerSize]byte
+
+	for {
+		if _, err := io.ReadFull(s.conn, hdr[:]); err != nil {
+			s.close(fmt.Errorf("mux: read: %w", err))
+			return
+		}
+
+		typ := frameType(hdr[0])
+		id := binary.BigEndian.Uint32(hdr[1:5])
+		length := binary.BigEndian.Uint32(hdr[5:9])
+
+		if err := s.handle(typ, id, length); err != nil {
+			s.close(err)
+			return
+		}
+	}
+}
+
+func (s *Session) handle(typ frameType, id, length uint32) error {
+	switch typ {
+	case frameOpen:
+		return s.opened(id)
+
+	case frameData:
+		if length > maxPayload {
+			return fmt.Errorf("%w: frame of %d bytes", errProtocol, length)
+		}
+
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(s.conn, payload); err != nil {
+			return fmt.Errorf("mux: read: %w", err)
+		}
+
+		// data of streams closed locally is discarded
+		if st := s.stream(id); st != nil && !st.receive(payload) {
+			return fmt.Errorf("%w: stream %d exceeds window", errProtocol, id)
+		}
+
+	case frameWindow:
+		if st := s.stream(id); st != nil {
+			st.grow(int(length))
+		}
+
+	case frameClose:
+		if st := s.stream(id); st != nil {
+			st.finish()
+		}
+
+	case frameReset:
+		if st := s.stream(id); st != nil {
+			s.remove(id)
+			st.abort(ErrReset)
+		}
+
+	case framePing:
+		s.writeFrameAsync(framePong, 0, length)
+
+	case framePong:
+		s.mu.Lock()
+		if pong, ok := s.pings[length]; ok {
+			close(pong)
+			delete(s.pings, length)
+		}
+		s.mu.Unlock()
+
+	default:
+		return fmt.Errorf("%w: unknown frame type %d", errProtocol, typ)
+	}
+
+	return nil
+}
+
+// opened registers the stream opened by the peer.
+func (s *Session) opened(id uint32) error {
+	s.mu.Lock()
+	if id%2 == s.nextID%2 {
+		s.mu.Unlock()
+		return fmt.Errorf("%w: peer opens stream %d of the local side", errProtocol, id)
+	}
+	if _, ok := s.streams[id]; ok {
+		s.mu.Unlock()
+		return fmt.Errorf("%w: stream %d is already open", errProtocol, id)
+	}
+
+	st := newStream(s, id)
+	s.streams[id] = st
+	s.mu.Unlock()
+
+	select {
+	case s.accept <- st:
+	default:
+		s.remove(id)
+		s.writeFrameAsync(frameReset, id, 0)
+	}
+
+	return nil
+}
@@ -0,0 +1,266 @@
+package mux
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// pair returns client and server sessions over in-memory connection.
+func pair(tb testing.TB) (*Session, *Session) {
+	tb.Helper()
+
+	c, s := net.Pipe()
+	client, server := Client(c), Server(s)
+	tb.Cleanup(func() {
+		_ = client.Close()
+		_ = server.Close()
+	})
+
+	return client, server
+}
+
+// open opens the stream on the client and accepts it on the server.
+func open(tb testing.TB, client, server *Session) (*Stream, *Stream) {
+	tb.Helper()
+
+	c, err := client.Open()
+	if err != nil {
+		tb.Fatalf("open: %v", err)
+	}
+	s, err := server.Accept()
+	if err != nil {
+		tb.Fatalf("accept: %v", err)
+	}
+
+	return c, s.(*Stream)
+}
+
+func TestStream(t *testing.T) {
+	tests := []struct {
+		name  string
+		check func(c, s *Stream) error
+	}{
+		{
+			name: "half-close",
+			check: func(c, s *Stream) error {
+				go func() {
+					_, _ = c.Write([]byte("request"))
+					_ = c.CloseWrite()
+				}()
+
+				req, err := io.ReadAll(s)
+				if err != nil || string(req) != "request" {
+					return fmt.Errorf("server got %q, %v", req, err)
+				}
+
+				// the other direction still works
+				go func() {
+					_, _ = s.Write([]byte("response"))
+					_ = s.Close()
+				}()
+
+				resp, err := io.ReadAll(c)
+				if err != nil || string(resp) != "response" {
+					return fmt.Errorf("client got %q, %v", resp, err)
+				}
+				return nil
+			},
+		},
+		{
+			name: "close resets the sending peer",
+			check: func(c, s *Stream) error {
+				_ = s.Close()
+
+				deadline := time.Now().Add(time.Second)
+				for time.Now().Before(deadline) {
+					if _, err := c.Write([]byte("x")); err != nil {
+						if !errors.Is(err, ErrReset) {
+							return fmt.Errorf("got write error %v, want %v", err, ErrReset)
+						}
+						return nil
+					}
+					time.Sleep(time.Millisecond)
+				}
+				return fmt.Errorf("writes to reset stream succeed")
+			},
+		},
+		{
+			name: "read deadline",
+			check: func(c, s *Stream) error {
+				_ = s.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+				if _, err := s.Read(make([]byte, 1)); !errors.Is(err, os.ErrDeadlineExceeded) {
+					return fmt.Errorf("got read error %v, want deadline exceeded", err)
+				}
+
+				// the stream is usable after the deadline is reset
+				_ = s.SetReadDeadline(time.Time{})
+				go c.Write([]byte("x")) // nolint
+				if _, err := s.Read(make([]byte, 1)); err != nil {
+					return fmt.Errorf("read: %w", err)
+				}
+				return nil
+			},
+		},
+		{
+			name: "write blocks on full window",
+			check: func(c, s *Stream) error {
+				_ = c.SetWriteDeadline(time.Now().Add(100 * time.Millisecond))
+				n, err := c.Write(make([]byte, 2*window))
+				if !errors.Is(err, os.ErrDeadlineExceeded) || n != window {
+					return fmt.Errorf("wrote %d bytes, %v, want the window and deadline exceeded", n, err)
+				}
+
+				// reading opens the window
+				_ = c.SetWriteDeadline(time.Time{})
+				go io.Copy(io.Discard, s) // nolint
+				if _, err := c.Write(make([]byte, window)); err != nil {
+					return fmt.Errorf("write after read: %w", err)
+				}
+				return nil
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := pair(t)
+			c, s := open(t, client, server)
+
+			if err := tt.check(c, s); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestSession_concurrentStreams(t *testing.T) {
+	client, server := pair(t)
+
+	// server echoes every stream
+	go func() {
+		for {
+			conn, err := server.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close() // nolint
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			c, err := client.Open()
+			if err != nil {
+				t.Errorf("open: %v", err)
+				return
+			}
+			defer c.Close() // nolint
+
+			data := make([]byte, 1<<20)
+			_, _ = rand.Read(data)
+
+			go func() {
+				_, _ = c.Write(data)
+				_ = c.CloseWrite()
+			}()
+
+			got, err := io.ReadAll(c)
+			if err != nil || !bytes.Equal(got, data) {
+				t.Errorf("stream %d: got %d bytes, %v", c.ID(), len(got), err)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestSession_slowStreamDoesNotStall(t *testing.T) {
+	client, server := pair(t)
+
+	// the first stream is never read
+	slow, _ := open(t, client, server)
+	go slow.Write(make([]byte, 2*window)) // nolint
+
+	c, s := open(t, client, server)
+	go c.Write([]byte("ping")) // nolint
+
+	_ = s.SetReadDeadline(time.Now().Add(time.Second))
+	got := make([]byte, 4)
+	if _, err := io.ReadFull(s, got); err != nil {
+		t.Fatalf("read of the other stream: %v", err)
+	}
+}
+
+func TestSession_Close(t *testing.T) {
+	client, server := pair(t)
+	c, s := open(t, client, server)
+
+	_ = client.Close()
+
+	if _, err := c.Write([]byte("x")); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("got write error %v, want closed", err)
+	}
+	if _, err := client.Open(); err == nil {
+		t.Errorf("open of closed session succeeded")
+	}
+
+	// the peer detects the closed connection
+	select {
+	case <-server.Done():
+	case <-time.After(time.Second):
+		t.Fatal("server session isn't closed")
+	}
+	if _, err := s.Read(make([]byte, 1)); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("got read error %v, want closed", err)
+	}
+	if _, err := server.Accept(); err == nil {
+		t.Errorf("accept of closed session succeeded")
+	}
+}
+
+func TestSession_Ping(t *testing.T) {
+	client, server := pair(t)
+
+	if _, err := client.Ping(time.Second); err != nil {
+		t.Errorf("client ping: %v", err)
+	}
+	if _, err := server.Ping(time.Second); err != nil {
+		t.Errorf("server ping: %v", err)
+	}
+
+	_ = server.Close()
+	if _, err := client.Ping(time.Second); err == nil {
+		t.Errorf("ping of closed peer succeeded")
+	}
+}
+
+func TestSession_protocolError(t *testing.T) {
+	c, s := net.Pipe()
+	server := Server(s)
+	defer server.Close() // nolint
+
+	// the client opens even stream of the server side
+	go c.Write([]byte{byte(frameOpen), 0, 0, 0, 2, 0, 0, 0, 0}) // nolint
+
+	select {
+	case <-server.Done():
+		if !errors.Is(server.Err(), errProtocol) {
+			t.Errorf("got error %v, want protocol error", server.Err())
+		}
+	case <-time.After(time.Second):
+		t.Fatal("session isn't closed on protocol error")
+	}
+}
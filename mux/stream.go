@@ -0,0 +1,295 @@
+package mux
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Stream is a bidirectional stream of the session, it implements net.Conn.
+type Stream struct {
+	s  *Session
+	id uint32
+
+	mu         sync.Mutex
+	buf        bytes.Buffer // received data which hasn't been read
+	unacked    int          // read bytes which haven't been reported to the peer
+	sendWindow int          // bytes the peer is ready to receive
+	finRecv    bool         // the peer has finished sending
+	finSent    bool         // the local side has finished sending
+	closed     bool         // closed locally
+	err        error        // reset by the peer or the session is closed
+
+	readDeadline  time.Time
+	writeDeadline time.Time
+	readable      chan struct{} // signals changes to the blocked reader
+	writable      chan struct{} // signals changes to the blocked writer
+}
+
+func newStream(s *Session, id uint32) *Stream {
+	return &Stream{
+		s:          s,
+		id:         id,
+		sendWindow: window,
+		readable:   make(chan struct{}, 1),
+		writable:   make(chan struct{}, 1),
+	}
+}
+
+// ID returns the stream identifier in the session.
+func (st *Stream) ID() uint32 {
+	return st.id
+}
+
+// Read reads data sent by the peer, it returns io.EOF once the peer has finished sending
+// and all the data has been read.
+func (st *Stream) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	for {
+		st.mu.Lock()
+		if st.closed {
+			st.mu.Unlock()
+			return 0, net.ErrClosed
+		}
+
+		if st.buf.Len() > 0 {
+			n, _ := st.buf.Read(p)
+
+			// report the read data once a half of the window is consumed
+			st.unacked += n
+			credit := 0
+			if st.unacked >= window/2 && !st.finRecv && st.err == nil {
+				credit, st.unacked = st.unacked, 0
+			}
+			st.mu.Unlock()
+
+			if credit > 0 {
+				_ = st.s.writeFrame(frameWindow, st.id, uint32(credit), nil) // nolint: failure closes the session
+			}
+			return n, nil
+		}
+
+		switch {
+		case st.finRecv:
+			st.mu.Unlock()
+			return 0, io.EOF
+		case st.err != nil:
+			err := st.err
+			st.mu.Unlock()
+			return 0, err
+		}
+
+		deadline := st.readDeadline
+		st.mu.Unlock()
+
+		if err := wait(st.readable, deadline); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// Write sends data to the peer, it blocks while the peer's receive window is full.
+func (st *Stream) Write(p []byte) (int, error) {
+	var written int
+
+	for len(p) > 0 {
+		st.mu.Lock()
+		switch {
+		case st.closed:
+			st.mu.Unlock()
+			return written, net.ErrClosed
+		case st.err != nil:
+			err := st.err
+			st.mu.Unlock()
+			return written, err
+		case st.finSent:
+			st.mu.Unlock()
+			return written, errors.New("mux: write after close write")
+		}
+
+		if st.sendWindow == 0 {
+			deadline := st.writeDeadline
+			st.mu.Unlock()
+
+			if err := wait(st.writable, deadline); err != nil {
+				return written, err
+			}
+			continue
+		}
+
+		n := min(len(p), st.sendWindow, maxPayload)
+		st.sendWindow -= n
+		st.mu.Unlock()
+
+		if err := st.s.writeFrame(frameData, st.id, uint32(n), p[:n]); err != nil {
+			return written, err
+		}
+
+		written += n
+		p = p[n:]
+	}
+
+	return written, nil
+}
+
+// CloseWrite finishes sending, the peer reads io.EOF after the data sent before.
+func (st *Stream) CloseWrite() error {
+	st.mu.Lock()
+	if st.closed || st.finSent || st.err != nil {
+		st.mu.Unlock()
+		return nil
+	}
+	st.finSent = true
+	st.mu.Unlock()
+
+	return st.s.writeFrame(frameClose, st.id, 0, nil)
+}
+
+// Close closes the stream. If the peer is still sending the stream is reset, so the peer's writes
+// fail, otherwise the peer reads io.EOF after the data sent before.
+func (st *Stream) Close() error {
+	st.mu.Lock()
+	if st.closed {
+		st.mu.Unlock()
+		return nil
+	}
+	st.closed = true
+
+	typ := frameClose
+	switch {
+	case st.err != nil:
+		typ = 0 // the peer has forgotten the stream
+	case !st.finRecv:
+		typ = frameReset
+	case st.finSent:
+		typ = 0 // the both sides have finished
+	}
+	st.mu.Unlock()
+
+	notify(st.readable)
+	notify(st.writable)
+	st.s.remove(st.id)
+
+	if typ == 0 {
+		return nil
+	}
+
+	return st.s.writeFrame(typ, st.id, 0, nil)
+}
+
+func (st *Stream) LocalAddr() net.Addr {
+	return st.s.conn.LocalAddr()
+}
+
+func (st *Stream) RemoteAddr() net.Addr {
+	return st.s.conn.RemoteAddr()
+}
+
+func (st *Stream) SetDeadline(t time.Time) error {
+	_ = st.SetReadDeadline(t)
+	return st.SetWriteDeadline(t)
+}
+
+func (st *Stream) SetReadDeadline(t time.Time) error {
+	st.mu.Lock()
+	st.readDeadline = t
+	st.mu.Unlock()
+
+	notify(st.readable)
+	return nil
+}
+
+func (st *Stream) SetWriteDeadline(t time.Time) error {
+	st.mu.Lock()
+	st.writeDeadline = t
+	st.mu.Unlock()
+
+	notify(st.writable)
+	return nil
+}
+
+// receive buffers data sent by the peer, it reports false if the peer exceeds the window.
+func (st *Stream) receive(p []byte) bool {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if st.buf.Len()+len(p) > window {
+		return false
+	}
+	if st.finRecv {
+		return true // data after close is ignored
+	}
+
+	st.buf.Write(p)
+	notify(st.readable)
+
+	return true
+}
+
+// grow adds the peer's window increment.
+func (st *Stream) grow(n int) {
+	st.mu.Lock()
+	st.sendWindow += n
+	st.mu.Unlock()
+
+	notify(st.writable)
+}
+
+// finish marks the peer has finished sending.
+func (st *Stream) finish() {
+	st.mu.Lock()
+	st.finRecv = true
+	st.mu.Unlock()
+
+	notify(st.readable)
+}
+
+// abort fails pending and further operations with err, received data is still readable.
+func (st *Stream) abort(err error) {
+	st.mu.Lock()
+	if st.err == nil {
+		st.err = err
+	}
+	st.mu.Unlock()
+
+	notify(st.readable)
+	notify(st.writable)
+}
+
+// notify signals the change to the waiter if any.
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// wait waits for the signal until the deadline (zero means forever).
+func wait(ch chan struct{}, deadline time.Time) error {
+	if deadline.IsZero() {
+		<-ch
+		return nil
+	}
+
+	d := time.Until(deadline)
+	if d <= 0 {
+		return os.ErrDeadlineExceeded
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ch:
+		return nil
+	case <-timer.C:
+		return os.ErrDeadlineExceeded
+	}
+}
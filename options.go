@@ -0,0 +1,149 @@
+package proxyme
+
+import (
+	"net"
+	"slices"
+	"time"
+)
+
+// Option sets up Options of NewWith. Options are applied in order, later ones override the fields
+// set by earlier ones (WithRules adds the rules instead).
+type Option func(opts *Options)
+
+// NewWith returns SOCKS5 protocol handler configured by the options, e.g.
+//
+//	socks5, err := proxyme.NewWith(
+//		proxyme.WithAuth(users.Authenticate),
+//		proxyme.WithConnectTimeout(5*time.Second),
+//		proxyme.WithRules(rules.Check),
+//	)
+//
+// It's New of the Options the options build: the same validation and defaults apply, fields no option
+// sets may be set by WithOptions.
+func NewWith(options ...Option) (*SOCKS5, error) {
+	var opts Options
+	for _, option := range options {
+		option(&opts)
+	}
+
+	return New(opts)
+}
+
+// WithOptions sets all the Options at once, e.g. the ones loaded from the config file. Follow it with
+// the options to override.
+func WithOptions(o Options) Option {
+	return func(opts *Options) {
+		*opts = o
+	}
+}
+
+// WithNoAuth allows anonymous access (Options.AllowNoAuth), only from the networks if any are given
+// (Options.NoAuthNetworks).
+func WithNoAuth(networks ...*net.IPNet) Option {
+	return func(opts *Options) {
+		opts.AllowNoAuth = true
+		opts.NoAuthNetworks = networks
+	}
+}
+
+// WithAuth enables username/password authentication checked by authenticate (Options.Authenticate).
+func WithAuth(authenticate func(username, password []byte) error) Option {
+	return func(opts *Options) {
+		opts.Authenticate = authenticate
+	}
+}
+
+// WithGSSAPI enables GSSAPI authentication of the contexts made by gssapi (Options.GSSAPI).
+func WithGSSAPI(gssapi func() (GSSAPI, error)) Option {
+	return func(opts *Options) {
+		opts.GSSAPI = gssapi
+	}
+}
+
+// WithConnect sets the dialer of CONNECT destinations (Options.Connect).
+func WithConnect(connect func(addressType int, addr []byte, port int) (net.Conn, error)) Option {
+	return func(opts *Options) {
+		opts.Connect = connect
+	}
+}
+
+// WithConnectTimeout limits connecting to CONNECT destinations by the built-in dialer
+// (Options.ConnectTimeout).
+func WithConnectTimeout(timeout time.Duration) Option {
+	return func(opts *Options) {
+		opts.ConnectTimeout = timeout
+	}
+}
+
+// WithRules adds the rules checking the destinations (Options.Rules): the rules of all WithRules
+// and WithOptions are checked in order as ChainRules does. Nil rules are skipped, so WithRules of
+// nil rules only doesn't enable resolving of domain destinations for the rules.
+func WithRules(rules ...func(info SessionInfo) error) Option {
+	return func(opts *Options) {
+		if !slices.ContainsFunc(rules, func(rule func(info SessionInfo) error) bool { return rule != nil }) {
+			return
+		}
+		opts.Rules = ChainRules(append([]func(info SessionInfo) error{opts.Rules}, rules...)...)
+	}
+}
+
+// WithPorts limits destination ports (Options.AllowedPorts and Options.DeniedPorts), nil lists
+// don't limit.
+func WithPorts(allowed, denied []int) Option {
+	return func(opts *Options) {
+		opts.AllowedPorts = allowed
+		opts.DeniedPorts = denied
+	}
+}
+
+// WithBind enables BIND command accepting incoming connections on the listeners of listen
+// (Options.Listen).
+func WithBind(listen func(info SessionInfo) (net.Listener, error)) Option {
+	return func(opts *Options) {
+		opts.Listen = listen
+	}
+}
+
+// WithUDPAssociate enables UDP ASSOCIATE command relaying datagrams through the ports of the range,
+// zero range means ports chosen by the system (Options.AllowUDPAssociate and Options.UDPPortRange).
+func WithUDPAssociate(ports PortRange) Option {
+	return func(opts *Options) {
+		opts.AllowUDPAssociate = true
+		opts.UDPPortRange = ports
+	}
+}
+
+// WithSessionLimits limits concurrent sessions of the user, commands beyond the limit wait for up
+// to queueTimeout (Options.MaxSessionsPerUser and Options.SessionQueueTimeout).
+func WithSessionLimits(maxPerUser int, queueTimeout time.Duration) Option {
+	return func(opts *Options) {
+		opts.MaxSessionsPerUser = maxPerUser
+		opts.SessionQueueTimeout = queueTimeout
+	}
+}
+
+// WithBandwidth limits relay bandwidth of all sessions and of each session in bytes per second,
+// zero means unlimited (Options.BandwidthLimit and Options.SessionBandwidthLimit).
+func WithBandwidth(limit, sessionLimit int64) Option {
+	return func(opts *Options) {
+		opts.BandwidthLimit = limit
+		opts.SessionBandwidthLimit = sessionLimit
+	}
+}
+
+// WithMetrics reports live relay throughput to the sink every interval (Options.Metrics and
+// Options.ThroughputInterval).
+func WithMetrics(sink MetricsSink, interval time.Duration) Option {
+	return func(opts *Options) {
+		opts.Metrics = sink
+		opts.ThroughputInterval = interval
+	}
+}
+
+// WithSessionEvents reports start and end events of sessions to the sink, e.g. WebhookSink
+// (Options.SessionEvents).
+func WithSessionEvents(sink SessionEventSink) Option {
+	return func(opts *Options) {
+		opts.SessionEvents = sink
+	}
+}
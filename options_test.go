@@ -0,0 +1,107 @@
+package proxyme
+
+import (
+	"errors"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestNewWith(t *testing.T) {
+	var checked []string
+	rule := func(name string) func(info SessionInfo) error {
+		return func(info SessionInfo) error {
+			checked = append(checked, name)
+			return nil
+		}
+	}
+
+	tests := []struct {
+		name        string
+		options     []Option
+		wantErr     bool
+		wantTimeout time.Duration
+		wantRules   []string
+		wantNoRules bool
+	}{
+		{
+			name:    "no auth methods",
+			wantErr: true,
+		},
+		{
+			name:        "auth and connect timeout",
+			options:     []Option{WithAuth(func(username, password []byte) error { return nil }), WithConnectTimeout(5 * time.Second)},
+			wantTimeout: 5 * time.Second,
+		},
+		{
+			name: "options overridden",
+			options: []Option{
+				WithOptions(Options{AllowNoAuth: true, ConnectTimeout: time.Second}),
+				WithConnectTimeout(2 * time.Second),
+			},
+			wantTimeout: 2 * time.Second,
+		},
+		{
+			name: "rules added in order",
+			options: []Option{
+				WithOptions(Options{AllowNoAuth: true, Rules: rule("options")}),
+				WithRules(rule("first")),
+				WithRules(nil, rule("second")),
+			},
+			wantRules: []string{"options", "first", "second"},
+		},
+		{
+			name:        "nil rules only",
+			options:     []Option{WithNoAuth(), WithRules(nil, nil)},
+			wantNoRules: true,
+		},
+		{
+			name:    "invalid option",
+			options: []Option{WithNoAuth(), WithPorts([]int{0}, nil)},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			checked = nil
+
+			socks5, err := NewWith(tt.options...)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewWith() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+
+			if socks5.timeout != tt.wantTimeout {
+				t.Errorf("got connect timeout %v, want %v", socks5.timeout, tt.wantTimeout)
+			}
+			if tt.wantNoRules && socks5.rules != nil {
+				t.Errorf("got rules set, want none")
+			}
+			if socks5.rules != nil {
+				if err := socks5.rules(SessionInfo{}); err != nil {
+					t.Fatalf("rules error = %v", err)
+				}
+			}
+			if !slices.Equal(checked, tt.wantRules) {
+				t.Errorf("got rules checked %v, want %v", checked, tt.wantRules)
+			}
+		})
+	}
+}
+
+func TestWithRules_reject(t *testing.T) {
+	deny := func(info SessionInfo) error { return ErrNotAllowed }
+
+	socks5, err := NewWith(WithNoAuth(), WithRules(deny), WithRules(func(info SessionInfo) error {
+		t.Error("rules after the rejecting one are checked")
+		return nil
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := socks5.rules(SessionInfo{}); !errors.Is(err, ErrNotAllowed) {
+		t.Errorf("rules error = %v, want %v", err, ErrNotAllowed)
+	}
+}
@@ -0,0 +1,39 @@
+//go:build linux
+
+package proxyme
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+// inputPending reports whether the tcp connection has received data which hasn't been read yet.
+func inputPending(conn any) bool {
+	return inputQueued(conn) > 0
+}
+
+// inputQueued returns the number of bytes the tcp connection has received but not read yet.
+func inputQueued(conn any) int {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return 0
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return 0
+	}
+
+	var (
+		n     int32
+		errno syscall.Errno
+	)
+	err = raw.Control(func(fd uintptr) {
+		_, _, errno = syscall.Syscall(syscall.SYS_IOCTL, fd, syscall.TIOCINQ, uintptr(unsafe.Pointer(&n)))
+	})
+
+	if err != nil || errno != 0 {
+		return 0
+	}
+
+	return int(n)
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package proxyme
+
+// inputPending isn't supported, no data is considered pending, so replies are flushed at once.
+func inputPending(any) bool {
+	return false
+}
+
+// inputQueued isn't supported, early data of the client isn't detected.
+func inputQueued(any) int {
+	return 0
+}
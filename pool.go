@@ -0,0 +1,223 @@
+package proxyme
+
+import (
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	defaultPoolMaxIdle     = 2
+	defaultPoolIdleTimeout = 30 * time.Second
+	aliveCheckTimeout      = time.Millisecond
+)
+
+// ConnPool is Connect callback keeping spare connections to allowlisted destinations: once
+// a destination is contacted, the pool dials up to MaxIdle connections to it in background, so
+// the following sessions of bursty clients get established connection without connect latency.
+// Spare connections are never used twice: sessions own their connections, the pool only dials
+// them in advance. Allowlist destinations which tolerate idle connections (HTTP, TLS servers).
+//
+// Use its Connect method as Options.Connect or Egress.Connect, Close it on shutdown.
+type ConnPool struct {
+	// Dial connects to destinations, it has Options.Connect signature.
+	// OPTIONAL, default dials tcp connection.
+	Dial func(addressType int, addr []byte, port int) (net.Conn, error)
+
+	// Destinations is allowlist of destinations (host:port as requested by clients) to keep spare
+	// connections to, other destinations are dialed directly.
+	Destinations []string
+
+	// MaxIdle is the max number of spare connections per destination.
+	// OPTIONAL, default 2.
+	MaxIdle int
+
+	// IdleTimeout closes spare connections which aren't taken in time.
+	// OPTIONAL, default 30 seconds.
+	IdleTimeout time.Duration
+
+	once    sync.Once
+	mu      sync.Mutex
+	allowed map[string]struct{}
+	idle    map[string][]*idleConn
+	filling map[string]bool
+	closed  bool
+}
+
+type idleConn struct {
+	net.Conn
+	timer *time.Timer
+}
+
+func (p *ConnPool) init() {
+	p.once.Do(func() {
+		p.allowed = make(map[string]struct{}, len(p.Destinations))
+		for _, dst := range p.Destinations {
+			p.allowed[dst] = struct{}{}
+		}
+		p.idle = make(map[string][]*idleConn)
+		p.filling = make(map[string]bool)
+	})
+}
+
+// Connect returns spare connection to the destination if any or dials it.
+func (p *ConnPool) Connect(addressType int, addr []byte, port int) (net.Conn, error) {
+	p.init()
+
+	address := buildDialAddress(addressType, addr, port)
+	if _, ok := p.allowed[address]; !ok {
+		return p.dial(addressType, addr, port)
+	}
+
+	defer p.fill(address, addressType, append([]byte(nil), addr...), port)
+
+	for {
+		conn := p.take(address)
+		if conn == nil {
+			break
+		}
+		if alive(conn) {
+			return conn, nil
+		}
+		_ = conn.Close()
+	}
+
+	return p.dial(addressType, addr, port)
+}
+
+// Close closes spare connections, the pool dials directly afterward.
+func (p *ConnPool) Close() error {
+	p.init()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.closed = true
+	for address, conns := range p.idle {
+		for _, conn := range conns {
+			conn.timer.Stop()
+			_ = conn.Close()
+		}
+		delete(p.idle, address)
+	}
+
+	return nil
+}
+
+func (p *ConnPool) dial(addressType int, addr []byte, port int) (net.Conn, error) {
+	if p.Dial != nil {
+		return p.Dial(addressType, addr, port)
+	}
+
+	return defaultConnect(0, nil, nil)(addressType, addr, port)
+}
+
+// take returns the most recent spare connection of the destination.
+func (p *ConnPool) take(address string) net.Conn {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	conns := p.idle[address]
+	if len(conns) == 0 {
+		return nil
+	}
+
+	conn := conns[len(conns)-1]
+	p.idle[address] = conns[:len(conns)-1]
+	conn.timer.Stop()
+
+	return conn.Conn
+}
+
+// fill dials spare connections of the destination up to MaxIdle in background.
+func (p *ConnPool) fill(address string, addressType int, addr []byte, port int) {
+	maxIdle := p.MaxIdle
+	if maxIdle <= 0 {
+		maxIdle = defaultPoolMaxIdle
+	}
+
+	p.mu.Lock()
+	if p.closed || p.filling[address] || len(p.idle[address]) >= maxIdle {
+		p.mu.Unlock()
+		return
+	}
+	p.filling[address] = true
+	p.mu.Unlock()
+
+	go func() {
+		defer func() {
+			p.mu.Lock()
+			delete(p.filling, address)
+			p.mu.Unlock()
+		}()
+
+		for {
+			conn, err := p.dial(addressType, addr, port)
+			if err != nil {
+				return
+			}
+			if !p.put(address, conn, maxIdle) {
+				return
+			}
+		}
+	}()
+}
+
+// put adds spare connection and reports whether more of them are needed.
+func (p *ConnPool) put(address string, conn net.Conn, maxIdle int) bool {
+	timeout := p.IdleTimeout
+	if timeout <= 0 {
+		timeout = defaultPoolIdleTimeout
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed || len(p.idle[address]) >= maxIdle {
+		_ = conn.Close()
+		return false
+	}
+
+	idle := &idleConn{Conn: conn}
+	idle.timer = time.AfterFunc(timeout, func() {
+		p.expire(address, idle)
+	})
+	p.idle[address] = append(p.idle[address], idle)
+
+	return len(p.idle[address]) < maxIdle
+}
+
+// expire closes spare connection which hasn't been taken in time.
+func (p *ConnPool) expire(address string, conn *idleConn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	conns := p.idle[address]
+	for i, c := range conns {
+		if c == conn {
+			p.idle[address] = append(conns[:i], conns[i+1:]...)
+			_ = conn.Close()
+			return
+		}
+	}
+}
+
+// alive reports whether the idle connection hasn't been closed by the peer. Connections which
+// got data while idle (e.g. server greeting) aren't reused: the data would be lost.
+func alive(conn net.Conn) bool {
+	// expired deadline fails reads without polling the socket, so wait a bit
+	if err := conn.SetReadDeadline(time.Now().Add(aliveCheckTimeout)); err != nil {
+		return false
+	}
+
+	var buf [1]byte
+	_, err := conn.Read(buf[:])
+
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		return false
+	}
+
+	return conn.SetReadDeadline(time.Time{}) == nil
+}
@@ -0,0 +1,196 @@
+package proxyme
+
+import (
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// poolServer accepts connections keeping them in accepted.
+type poolServer struct {
+	ls       net.Listener
+	accepted chan net.Conn
+	dials    atomic.Int32
+}
+
+func newPoolServer(t *testing.T) *poolServer {
+	ls, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = ls.Close() })
+
+	s := &poolServer{ls: ls, accepted: make(chan net.Conn, 16)}
+	go func() {
+		for {
+			conn, err := ls.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { _ = conn.Close() })
+			s.accepted <- conn
+		}
+	}()
+
+	return s
+}
+
+func (s *poolServer) dial(addressType int, addr []byte, port int) (net.Conn, error) {
+	s.dials.Add(1)
+	return net.Dial("tcp", buildDialAddress(addressType, addr, port))
+}
+
+func (s *poolServer) connect(t *testing.T, pool *ConnPool) net.Conn {
+	t.Helper()
+
+	addr := s.ls.Addr().(*net.TCPAddr)
+	conn, err := pool.Connect(int(ipv4), addr.IP.To4(), addr.Port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+
+	return conn
+}
+
+func (s *poolServer) waitDials(t *testing.T, want int32) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for s.dials.Load() != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d dials, want %d", s.dials.Load(), want)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestConnPool_Connect(t *testing.T) {
+	t.Run("not allowlisted", func(t *testing.T) {
+		srv := newPoolServer(t)
+		pool := &ConnPool{Dial: srv.dial}
+		defer pool.Close() // nolint
+
+		srv.connect(t, pool)
+		srv.connect(t, pool)
+
+		time.Sleep(10 * time.Millisecond)
+		if n := srv.dials.Load(); n != 2 {
+			t.Errorf("got %d dials, want 2 without spare connections", n)
+		}
+	})
+
+	t.Run("spare connections", func(t *testing.T) {
+		srv := newPoolServer(t)
+		pool := &ConnPool{Dial: srv.dial, Destinations: []string{srv.ls.Addr().String()}, MaxIdle: 2}
+		defer pool.Close() // nolint
+
+		srv.connect(t, pool)
+		srv.waitDials(t, 3)
+
+		// the spare connection is taken and replaced
+		srv.connect(t, pool)
+		srv.waitDials(t, 4)
+
+		srv.connect(t, pool)
+		srv.connect(t, pool)
+		srv.waitDials(t, 6)
+	})
+
+	t.Run("closed spare connection", func(t *testing.T) {
+		srv := newPoolServer(t)
+		pool := &ConnPool{Dial: srv.dial, Destinations: []string{srv.ls.Addr().String()}, MaxIdle: 1}
+		defer pool.Close() // nolint
+
+		srv.connect(t, pool)
+		srv.waitDials(t, 2)
+
+		<-srv.accepted                   // session connection
+		spare := <-srv.accepted          // spare connection
+		_ = spare.(*net.TCPConn).Close() // peer closes it while idle
+		time.Sleep(10 * time.Millisecond)
+
+		conn := srv.connect(t, pool)
+		if n := srv.dials.Load(); n < 3 {
+			t.Fatalf("got %d dials, want the closed spare replaced", n)
+		}
+
+		// the session gets a working connection
+		peer := <-srv.accepted
+		if _, err := conn.Write([]byte("ping")); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 4)
+		if _, err := io.ReadFull(peer, buf); err != nil || string(buf) != "ping" {
+			t.Errorf("got %q, %v, want ping", buf, err)
+		}
+	})
+
+	t.Run("idle timeout", func(t *testing.T) {
+		srv := newPoolServer(t)
+		pool := &ConnPool{Dial: srv.dial, Destinations: []string{srv.ls.Addr().String()}, MaxIdle: 1, IdleTimeout: 10 * time.Millisecond}
+		defer pool.Close() // nolint
+
+		srv.connect(t, pool)
+		<-srv.accepted
+		spare := <-srv.accepted
+
+		_ = spare.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := spare.Read(make([]byte, 1)); err != io.EOF {
+			t.Errorf("got %v, want spare connection closed by the pool", err)
+		}
+	})
+
+	t.Run("close", func(t *testing.T) {
+		srv := newPoolServer(t)
+		pool := &ConnPool{Dial: srv.dial, Destinations: []string{srv.ls.Addr().String()}, MaxIdle: 1}
+
+		srv.connect(t, pool)
+		<-srv.accepted
+		spare := <-srv.accepted
+
+		_ = pool.Close()
+		_ = spare.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := spare.Read(make([]byte, 1)); err != io.EOF {
+			t.Errorf("got %v, want spare connection closed", err)
+		}
+
+		// dials directly after close
+		srv.connect(t, pool)
+		time.Sleep(10 * time.Millisecond)
+		if n := srv.dials.Load(); n != 3 {
+			t.Errorf("got %d dials, want 3", n)
+		}
+	})
+}
+
+func Test_alive(t *testing.T) {
+	tests := []struct {
+		name string
+		peer func(peer net.Conn)
+		want bool
+	}{
+		{name: "idle", peer: func(peer net.Conn) {}, want: true},
+		{name: "closed", peer: func(peer net.Conn) { _ = peer.Close() }, want: false},
+		{name: "got data", peer: func(peer net.Conn) { _, _ = peer.Write([]byte("220 hello")) }, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newPoolServer(t)
+			conn, err := net.Dial("tcp", srv.ls.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close() // nolint
+
+			tt.peer(<-srv.accepted)
+			time.Sleep(10 * time.Millisecond)
+
+			if got := alive(conn); got != tt.want {
+				t.Errorf("alive() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
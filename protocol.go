@@ -1,13 +1,19 @@
 package proxyme
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"net"
 	"os"
+	"slices"
 	"strconv"
+	"sync/atomic"
 	"syscall"
+	"time"
+
+	"github.com/dblokhin/proxyme/wire"
 )
 
 var (
@@ -18,78 +24,202 @@ var (
 	ErrTTLExpired         = errors.New("ttl expired")
 )
 
-// as defined http://www.ietf.org/rfc/rfc1928.txt
+// as defined http://www.ietf.org/rfc/rfc1928.txt, see wire package for exported protocol messages
 
 const (
-	protoVersion uint8 = 5
-	subnVersion  uint8 = 1
+	protoVersion = wire.Version
+	subnVersion  = wire.SubnegotiationVersion
 )
 
 // authentication methods
 type authMethod uint8
 
 const (
-	typeNoAuth authMethod = 0
-	typeGSSAPI authMethod = 1
-	typeLogin  authMethod = 2
-	typeError  authMethod = 0xff
+	typeNoAuth = authMethod(wire.MethodNoAuth)
+	typeGSSAPI = authMethod(wire.MethodGSSAPI)
+	typeLogin  = authMethod(wire.MethodLogin)
+	typeError  = authMethod(wire.MethodNoAcceptable)
 )
 
 // address types based on RFC (atyp)
 type addressType uint8
 
 const (
-	ipv4       addressType = 1
-	domainName addressType = 3
-	ipv6       addressType = 4
+	ipv4       = addressType(wire.AddressIPv4)
+	domainName = addressType(wire.AddressDomainName)
+	ipv6       = addressType(wire.AddressIPv6)
 )
 
 // protocol commands
 type commandType uint8
 
 const (
-	connect  commandType = 1
-	bind     commandType = 2
-	udpAssoc commandType = 3
+	connect  = commandType(wire.CommandConnect)
+	bind     = commandType(wire.CommandBind)
+	udpAssoc = commandType(wire.CommandUDPAssociate)
+
+	resolveName = commandType(wire.CommandResolve)    // tor extension
+	resolvePTR  = commandType(wire.CommandResolvePTR) // tor extension
 )
 
 type commandStatus uint8
 
 const (
-	succeeded           commandStatus = 0
-	sockFailure         commandStatus = 1 // general SOCKS server failure
-	notAllowed          commandStatus = 2 // connection not allowed by ruleset
-	networkUnreachable  commandStatus = 3 // network unreachable
-	hostUnreachable     commandStatus = 4 // host unreachable
-	connectionRefused   commandStatus = 5 // connection refused
-	ttlExpired          commandStatus = 6 // ttl expired
-	notSupported        commandStatus = 7 // command not supported
-	addressNotSupported commandStatus = 8 // address type not supported
+	succeeded           = commandStatus(wire.StatusSucceeded)
+	sockFailure         = commandStatus(wire.StatusFailure)             // general SOCKS server failure
+	notAllowed          = commandStatus(wire.StatusNotAllowed)          // connection not allowed by ruleset
+	networkUnreachable  = commandStatus(wire.StatusNetworkUnreachable)  // network unreachable
+	hostUnreachable     = commandStatus(wire.StatusHostUnreachable)     // host unreachable
+	connectionRefused   = commandStatus(wire.StatusConnectionRefused)   // connection refused
+	ttlExpired          = commandStatus(wire.StatusTTLExpired)          // ttl expired
+	notSupported        = commandStatus(wire.StatusNotSupported)        // command not supported
+	addressNotSupported = commandStatus(wire.StatusAddressNotSupported) // address type not supported
 )
 
 // SOCKS5 implements SOCKS5 protocol.
 type SOCKS5 struct {
-	auth    map[authMethod]authHandler
-	listen  func() (net.Listener, error) // listen for BIND command
-	connect func(addressType int, addr []byte, port int) (net.Conn, error)
+	auth       map[authMethod]authHandler
+	noAuthNets []*net.IPNet                                 // networks permitted to use noauth (empty means any)
+	preferAuth bool                                         // choose identifying methods over noauth
+	listen     func(info SessionInfo) (net.Listener, error) // listen for BIND command
+	connect    func(addressType int, addr []byte, port int) (net.Conn, error)
+	custom     bool                                                   // connect isn't the built-in dialer
+	router     Router                                                 // selects egress of sessions
+	timeout    time.Duration                                          // connect timeout of the built-in dialer
+	control    func(network, address string, c syscall.RawConn) error // socket setup of the built-in dialer
+	sockopts   SocketOptions                                          // client and upstream socket tuning
+
+	onEstablished  func(client io.ReadWriteCloser, upstream net.Conn, info SessionInfo)
+	onAuth         func(info SessionInfo) error     // post-auth pre-command hook
+	commands       map[byte]func(cmd Command) error // custom command handlers
+	handlers       map[byte]CommandHandler          // replacements of command handling
+	filter         func(info SessionInfo) (StreamFilter, error)
+	rewrite        func(addressType int, addr []byte, port int) (int, []byte, int, error)
+	onBind         func(info SessionInfo, event BindEvent)
+	bindTimeout    time.Duration
+	bindExpectPeer bool      // ignore incoming connections from peers other than BIND DST.ADDR
+	udp            *udpRelay // UDP ASSOCIATE relay settings and counters, nil if disabled
+
+	authTimeout         time.Duration     // max time of authentication callbacks
+	authCache           *authCache        // recent logins by client IP, nil if disabled
+	authFailures        authFailureCounts // failures by reason
+	replyAddress        ReplyAddress      // BND.ADDR of CONNECT replies
+	advertisedAddrs     []net.IP          // BND.ADDR of ReplyAdvertisedAddr
+	failureStatus       commandStatus     // uniform status of command failures, 0 if disabled
+	failureJitter       time.Duration     // max delay of command failure replies
+	failureLinger       time.Duration     // max time to wait for the client to close after failure reply
+	tarpit              *tarpit           // holds connections of denied clients, nil if disabled
+	messageTimeout      time.Duration     // max time each client message takes to arrive
+	maxNegotiationBytes int               // max bytes client sends during negotiation
+	quirks              Quirks            // compatibility with broken clients
+	lenientParsing      bool              // tolerate violations of RFC 1928 in requests
+	earlyData           EarlyData         // handling of data sent before the CONNECT reply
+	fastOpen            bool              // CONNECT is replied before connecting
+
+	sessions        SessionStore                      // registry of live sessions
+	userSlots       *userSlots                        // limits sessions per user, nil if unlimited
+	rules           func(info SessionInfo) error      // destination rules
+	rulesDryRun     bool                              // rules violations are counted but not enforced
+	onRuleViolation func(info SessionInfo, err error) // reports dry-run violations
+	ruleCounts      *ruleCounts                       // violations of the rules
+	ports           *portPolicy                       // allowed and denied destination ports
+	deadline        func(info SessionInfo) time.Time  // terminates established sessions
+	maxDuration     time.Duration                     // max lifetime of sessions, 0 means unlimited
+	expired         *atomic.Int64                     // sessions terminated at the deadline
+	reaper          *reaper                           // closes idle and expired sessions, nil if disabled
+	resolver        *resolver                         // resolves domain names for rules and RESOLVE
+	canaries        *Canaries                         // alerting decoy destinations
+	canaryHits      *atomic.Int64                     // connect attempts to canaries
+
+	allowResolve bool                              // enables RESOLVE and RESOLVE_PTR extensions
+	lookupAddr   func(ip net.IP) ([]string, error) // reverse lookups of RESOLVE_PTR
+
+	stages      *stageCounts     // sessions per state machine stage
+	counts      *sessionCounts   // sessions, relayed bytes and errors
+	goroutines  *goroutineCounts // goroutines spawned by sessions
+	spoofed     *spoofCounts     // traffic dropped by spoof protection
+	leakTimeout time.Duration    // report goroutines outliving the session by that long
+	relayBuffer int              // max size of relay buffers
+	bandwidth   *scheduler       // shares relay bandwidth, nil if unlimited
+
+	metrics            MetricsSink      // receives live relay throughput, nil disables metering
+	throughputInterval time.Duration    // period of throughput reports
+	replies            *replyCounts     // command replies by status
+	topStats           *topStats        // top destinations and users, nil if disabled
+	events             *eventLog        // recent session events, nil if disabled
+	sessionEvents      SessionEventSink // receives starts and ends of sessions, nil if disabled
+}
+
+// permits reports whether auth method is permitted for the client.
+func (s SOCKS5) permits(method authMethod, client net.Addr) bool {
+	if method != typeNoAuth || len(s.noAuthNets) == 0 {
+		return true
+	}
+
+	ip := addrIP(client)
+	if ip == nil {
+		return false
+	}
+
+	for _, network := range s.noAuthNets {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
 }
 
 // state is state through the SOCKS5 protocol negotiations.
 type state struct {
-	opts SOCKS5 // protocol options
-
-	conn    io.ReadWriteCloser // client connection
-	methods []authMethod       // proposed authenticate methods by client
-	method  authHandler        // chosen authenticate method (handler)
-	command commandRequest     // clients validated command to SOCKS5 server
-	status  commandStatus      // server reply/result on command
+	opts SOCKS5          // protocol options
+	ctx  context.Context // canceled on session teardown, nil means background
+
+	conn       io.ReadWriteCloser // client connection
+	clientAddr net.Addr           // client remote address if known
+	redirected bool               // transparently redirected connection (no SOCKS5 negotiation)
+	identity   string             // username authenticated by the embedder (see SOCKS5.HandleAuthenticated)
+	methods    []authMethod       // proposed authenticate methods by client
+	method     authHandler        // chosen authenticate method (handler)
+	username   string             // authenticated username if the method has one
+	command    commandRequest     // clients validated command to SOCKS5 server
+	status     commandStatus      // server reply/result on command
+
+	resolved []net.IP   // resolved addresses of domain name destination
+	upstream net.Addr   // address of the connected destination
+	early    []byte     // data of the client forwarded ahead of the CONNECT reply
+	up, down int64      // relayed bytes of the session
+	reaped   *reapEntry // the session watched by the reaper, nil if disabled
+
+	negotiation *negotiationConn // client negotiation limits, nil if disabled
+
+	session     Session // registered live session
+	kill        func()  // terminates the session
+	releaseSlot func()  // frees the session slot of the user, nil if not taken
+	traceID     uint64  // session number in the event log
+	lastErr     error   // last error of the session, the close reason
+	notified    bool    // the start has been reported to sessionEvents
+	stage       stage   // current state machine stage
+
+	started time.Time // the time the client has been accepted
+	timings Timings   // latencies of the session stages
+
+	metadata Metadata // values shared by the session hooks
+
+	goroutines *atomic.Int64 // running goroutines spawned by the session
+
+	// storage of negotiation messages and replies, so the handshake takes no allocations
+	buffered   bufferedConn
+	methodsBuf [wire.MaxMethods]authMethod
+	dstBuf     [1]destination
+	msgBuf     [maxDomainSize + 2]byte
 }
 
 type transition func(*state) (transition, error)
 
 // initial starts protocol negotiation
 func initial(state *state) (transition, error) {
-	var msg authRequest
+	msg := authRequest{methods: state.methodsBuf[:0], buf: state.msgBuf[:0]}
 
 	if _, err := msg.ReadFrom(state.conn); err != nil {
 		return nil, fmt.Errorf("sock read: %w", err)
@@ -100,12 +230,40 @@ func initial(state *state) (transition, error) {
 
 	state.methods = msg.methods
 
-	// choose auth method
+	// the client has been authenticated by the embedder, noauth only carries its identity
+	if state.identity != "" {
+		if !slices.Contains(state.methods, typeNoAuth) {
+			return failAuth, nil
+		}
+		state.method = cachedAuth{username: state.identity}
+		return authenticate, nil
+	}
+
+	// skip authentication of the client which has recently logged in
+	if method, ok := state.cachedMethod(); ok {
+		state.method = method
+		return authenticate, nil
+	}
+
+	// choose auth method in the client preference order
+	var noAuth authHandler
 	for _, code := range state.methods {
-		if method, ok := state.opts.auth[code]; ok {
-			state.method = method
-			return authenticate, nil
+		method, ok := state.opts.auth[code]
+		if !ok || !state.opts.permits(code, state.clientAddr) {
+			continue
+		}
+		if code == typeNoAuth && state.opts.preferAuth {
+			noAuth = method // unless the client identifies itself
+			continue
 		}
+
+		state.method = method
+		return authenticate, nil
+	}
+
+	if noAuth != nil {
+		state.method = noAuth
+		return authenticate, nil
 	}
 
 	return failAuth, nil
@@ -115,68 +273,157 @@ func failAuth(state *state) (transition, error) {
 	// If the selected METHOD is X'FF', none of the methods listed by the
 	// client are acceptable, and the client MUST close the connection.
 	reply := authReply{method: typeError}
+	state.traceMethod(typeError)
 
-	if _, err := reply.WriteTo(state.conn); err != nil {
+	if err := sendReply(state.conn, reply); err != nil {
 		return nil, fmt.Errorf("sock write: %w", err)
 	}
+	state.opts.authFailures.add(AuthUnsupportedMethod)
+	state.tarpit()
 
 	// stop
-	return nil, fmt.Errorf("rejected authenticate methods: %v", state.methods)
+	return nil, &AuthError{
+		Reason: AuthUnsupportedMethod,
+		Method: int(typeError),
+		Err:    fmt.Errorf("rejected authenticate methods: %v", state.methods),
+	}
 }
 
 func authenticate(state *state) (transition, error) {
 	// send chosen authenticate method
 	reply := authReply{method: state.method.method()}
-
-	if _, err := reply.WriteTo(state.conn); err != nil {
+	quirks := state.opts.quirks
+	state.traceMethod(reply.method)
+	time.Sleep(quirks.MethodReplyDelay)
+
+	if quirks.combinesReply(reply.method) {
+		// goes to the client along with the command reply
+		if err := writeReply(state.conn, reply); err != nil {
+			return nil, fmt.Errorf("sock write: %w", err)
+		}
+	} else if err := sendPipelined(state.conn, reply); err != nil {
 		return nil, fmt.Errorf("sock write: %w", err)
 	}
 
 	// do authentication
-	conn, err := state.method.auth(state.conn)
+	state.enter(stageAuth)
+	// noauth runs no callbacks, so it takes no context
+	ctx, cancel := context.Background(), context.CancelFunc(func() {})
+	if reply.method != typeNoAuth {
+		ctx, cancel = state.authContext()
+	}
+	conn, username, err := state.method.auth(ctx, state.conn)
+	cancel()
 	if err != nil {
-		return nil, fmt.Errorf("authenticate: %w", err)
+		// the failure reply is sent after the jitter of AuthFailureDelay, tarpit the client if enabled
+		state.tarpit()
+
+		authErr := newAuthError(state.method.method(), err)
+		state.opts.authFailures.add(authErr.Reason)
+
+		return nil, authErr
 	}
 
 	// Hijacks client conn (reason: protocol flow might consider encapsulation).
 	// For example GSSAPI encapsulates the traffic intro gssapi protocol messages.
 	// Package user can encapsulate traffic into whatever he wants using Connect method.
 	state.conn = conn
+	state.username = username
+	state.rememberLogin()
+	state.traceAuth()
+	state.enter(stageCommand)
+	state.timed("auth", time.Since(state.started))
 
-	return getCommand, nil
+	return authenticated, nil
 }
 
 func getCommand(state *state) (transition, error) {
-	var msg commandRequest
+	msg := commandRequest{addr: state.msgBuf[:0]}
 
 	if _, err := msg.ReadFrom(state.conn); err != nil {
-		// ReadFrom can return errInvalidAddrType:
-		// we stop reading tcp input stream when encounter invalid address type,
-		// because don't know how to parse payload.
-		// that's why we need to close connection (return nil transition).
+		if errors.Is(err, errInvalidAddrType) {
+			// the length of the rest of the request is unknown, so the session can't go on:
+			// discard what the client has sent and reply before closing
+			return failUnknownAddrType(state, msg, err)
+		}
 
 		return nil, fmt.Errorf("sock read: %w", err)
 	}
-	if err := msg.validate(); err != nil {
+	if state.opts.quirks.TolerateRSV {
+		msg.rsv = 0
+	}
+	_, custom := state.opts.commands[byte(msg.commandType)]
+	_, replaced := state.opts.handlers[byte(msg.commandType)]
+	builtin := msg.commandType == connect || msg.commandType == bind || msg.commandType == udpAssoc
+	extension := state.opts.allowResolve && (msg.commandType == resolveName || msg.commandType == resolvePTR)
+
+	var lenient *deviations
+	if state.opts.lenientParsing {
+		lenient = &deviations{}
+	}
+	if err := msg.validate(custom || extension || replaced && !builtin, lenient); err != nil {
 		return nil, err
 	}
 
 	state.command = msg
+	state.publish()
+	state.traceCommand()
+	if state.opts.topStats != nil {
+		state.opts.topStats.request(state.info().Destination())
+	}
+
+	// tolerated deviations are reported, the session goes on
+	deviation := lenient.err()
+
+	if err := state.takeSlot(); err != nil {
+		state.status = notAllowed
+		return failCommand, errors.Join(deviation, err)
+	}
+
+	if replaced {
+		return runHandler, deviation
+	}
+	if custom {
+		return runCustom, deviation
+	}
 
 	switch msg.commandType {
 	case connect:
-		return runConnect, nil
+		return runConnect, deviation
 	case bind:
-		return runBind, nil
+		return runBind, deviation
 	case udpAssoc:
-		return runUDPAssoc, nil
+		return runUDPAssoc, deviation
+	case resolveName, resolvePTR:
+		if extension {
+			return runResolve, deviation
+		}
+		fallthrough
 
 	default:
 		state.status = notSupported
-		return failCommand, fmt.Errorf("unsupported command: %d", msg.commandType)
+		return failCommand, errors.Join(deviation, fmt.Errorf("unsupported command: %d", msg.commandType))
 	}
 }
 
+// failUnknownAddrType replies address type not supported to the request of unknown address type.
+// The rest of the request is drained (bounded by size and time), so the reply isn't lost to RST
+// caused by unread client data.
+func failUnknownAddrType(state *state, msg commandRequest, err error) (transition, error) {
+	if state.negotiation != nil {
+		state.negotiation.stop()
+	}
+	drain(unwrap(state.conn), maxRequestSize, drainTimeout)
+	err = fmt.Errorf("sock read: %w: %d", err, msg.addressType)
+
+	// the reply can't echo unknown address
+	msg.addressType, msg.addr, msg.port = ipv4, net.IPv4zero.To4(), 0
+	state.command = msg
+	state.status = addressNotSupported
+
+	return failCommand, err
+}
+
 func runBind(state *state) (transition, error) {
 	if state.opts.listen == nil {
 		state.status = notAllowed
@@ -185,38 +432,28 @@ func runBind(state *state) (transition, error) {
 	return defaultBind, nil
 }
 
-func runUDPAssoc(state *state) (transition, error) {
-	state.status = notSupported
-	return failCommand, nil
-}
-
 func runConnect(state *state) (transition, error) {
-	// connect
-	addrType := int(state.command.addressType) //nolint
-	addr := state.command.addr
-	port := int(state.command.port)
+	early, err := takeEarlyData(state)
+	if err != nil {
+		return failCommand, err
+	}
+	state.early = early
+
+	if state.opts.fastOpen {
+		return runFastOpen(state)
+	}
 
-	conn, err := state.opts.connect(addrType, addr, port)
+	conn, err := dial(state)
 	if err != nil {
-		switch {
-		case errors.Is(err, ErrNotAllowed):
-			state.status = notAllowed
-		case errors.Is(err, ErrHostUnreachable):
-			state.status = hostUnreachable
-		case errors.Is(err, ErrConnectionRefused):
-			state.status = connectionRefused
-		case errors.Is(err, ErrNetworkUnreachable):
-			state.status = networkUnreachable
-		case errors.Is(err, ErrTTLExpired):
-			state.status = ttlExpired
-		default:
-			state.status = sockFailure
-		}
+		return failCommand, err
+	}
 
+	if err := forwardEarlyData(state, conn); err != nil {
 		return failCommand, err
 	}
 
-	bndAddrType, bndAddr, bndPort, err := parseAddress(conn.LocalAddr())
+	bndAddrType, bndAddr, bndPort, err := replyAddress(state.opts.replyAddress, state.opts.advertisedAddrs,
+		addrIP(state.clientAddr), conn.LocalAddr())
 	if err != nil {
 		return nil, fmt.Errorf("local address: %w", err)
 	}
@@ -229,25 +466,153 @@ func runConnect(state *state) (transition, error) {
 		port:        uint16(bndPort), // nolint
 	}
 
-	if _, err := reply.WriteTo(state.conn); err != nil {
+	if err := state.sendCommandReply(reply); err != nil {
 		return nil, fmt.Errorf("sock write: %w", err)
 	}
 
-	link(conn, state.conn)
+	return nil, relay(state, conn)
+}
 
-	return nil, nil
+// runTransparent tunnels transparently redirected connection to the original destination.
+// No negotiation took place so nothing is replied to the client.
+func runTransparent(state *state) (transition, error) {
+	conn, err := dial(state)
+	if err != nil {
+		return nil, err
+	}
+
+	return nil, relay(state, conn)
+}
+
+// dial connects to the command destination and sets up status on failure.
+func dial(state *state) (net.Conn, error) {
+	connect, dst, err := checkDestination(state)
+	if err != nil {
+		state.status = errorStatus(err)
+		return nil, err
+	}
+
+	return connectDestination(state, connect, dst)
+}
+
+// checkDestination checks the command destination against canaries and rules, it returns
+// the connect function of the egress and the destinations to try.
+func checkDestination(state *state) (func(addressType int, addr []byte, port int) (net.Conn, error), []destination, error) {
+	addrType := int(state.command.addressType) //nolint
+	addr := state.command.addr
+	port := int(state.command.port)
+
+	state.enter(stageConnect)
+
+	// canaries see the requested destination whatever rewrites and rules do
+	err := checkCanary(state)
+	if err == nil && state.opts.rewrite != nil {
+		// replies still carry requested destination
+		addrType, addr, port, err = state.opts.rewrite(addrType, addr, port)
+	}
+
+	var dst []destination
+	if err == nil {
+		dst, err = checkRules(state, addrType, addr, port)
+	}
+
+	connect, custom := state.opts.connect, state.opts.custom
+	if err == nil && state.opts.router != nil {
+		connect, custom, err = route(state)
+	}
+
+	// custom egresses get the checked name rather than the addresses, they may resolve it remotely
+	// (e.g. upstream proxies), names pinned by Hosts are dialed by the addresses anyway
+	if err == nil && custom && addressType(addrType) == domainName && !state.opts.resolver.isPinned(addr) { //nolint
+		dst = append(dst[:0], destination{addrType: addrType, addr: addr, port: port})
+	}
+
+	return connect, dst, err
+}
+
+// connectDestination connects to the first reachable destination and sets up status on failure.
+func connectDestination(state *state, connect func(addressType int, addr []byte, port int) (net.Conn, error),
+	dst []destination) (net.Conn, error) {
+	var (
+		conn net.Conn
+		err  error
+	)
+	dialed := time.Now()
+	for _, d := range dst {
+		// try resolved addresses in order as net.Dial does
+		conn, err = connect(d.addrType, d.addr, d.port)
+		if err == nil {
+			break
+		}
+	}
+	if err != nil {
+		state.status = errorStatus(err)
+		return nil, err
+	}
+
+	if err := state.opts.sockopts.apply(conn); err != nil {
+		_ = conn.Close()
+		state.status = sockFailure
+		return nil, fmt.Errorf("upstream socket options: %w", err)
+	}
+
+	state.upstream = conn.RemoteAddr()
+	state.timed("dial", time.Since(dialed))
+
+	return conn, nil
+}
+
+// errorStatus returns reply status of the connect error.
+func errorStatus(err error) commandStatus {
+	var ruleErr *RuleError
+
+	switch {
+	case errors.As(err, &ruleErr):
+		return commandStatus(ruleErr.status())
+	case errors.Is(err, ErrNotAllowed):
+		return notAllowed
+	case errors.Is(err, ErrHostUnreachable):
+		return hostUnreachable
+	case errors.Is(err, ErrConnectionRefused):
+		return connectionRefused
+	case errors.Is(err, ErrNetworkUnreachable):
+		return networkUnreachable
+	case errors.Is(err, ErrTTLExpired):
+		return ttlExpired
+	default:
+		return sockFailure
+	}
+}
+
+// sendCommandReply sends the command reply to the client and counts its status.
+func (s *state) sendCommandReply(reply commandReply) error {
+	if err := sendReply(s.conn, reply); err != nil {
+		return err
+	}
+	s.opts.replies.add(reply.rep)
+	s.traceReply(reply)
+
+	return nil
 }
 
 func failCommand(state *state) (transition, error) {
+	status := state.status
+	denied := status == notAllowed
+	if state.opts.failureStatus != 0 {
+		// disguise the failure reason
+		status = state.opts.failureStatus
+	}
+	time.Sleep(failureDelay(state.opts.failureJitter))
+
 	reply := commandReply{
-		rep:         state.status,
+		rep:         status,
 		rsv:         0,
 		addressType: state.command.addressType,
 		addr:        state.command.addr,
 		port:        state.command.port,
 	}
 
-	if _, err := reply.WriteTo(state.conn); err != nil {
+	if err := state.sendCommandReply(reply); err != nil {
 		return nil, fmt.Errorf("sock write: %w", err)
 	}
 
@@ -255,6 +620,13 @@ func failCommand(state *state) (transition, error) {
 	// SOCKS server MUST terminate the TCP connection shortly after sending
 	// the reply.  This must be no more than 10 seconds after detecting the
 	// condition that caused a failure.
+	if state.negotiation != nil {
+		state.negotiation.stop()
+	}
+	if denied && state.tarpit() {
+		return nil, nil
+	}
+	teardown(unwrap(state.conn), state.opts.failureLinger)
 
 	return nil, nil
 }
@@ -270,8 +642,31 @@ func parseAddress(addr net.Addr) (addressType, net.IP, int, error) {
 	return ipv6, tcp.IP, tcp.Port, nil
 }
 
+// addrIP returns IP of the network address or nil if it has no IP.
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP
+	case *net.UDPAddr:
+		return a.IP
+	case *net.IPAddr:
+		return a.IP
+	case nil:
+		return nil
+	}
+
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+
+	return net.ParseIP(host)
+}
+
 func defaultBind(state *state) (transition, error) {
-	ls, err := state.opts.listen()
+	state.enter(stageBind)
+
+	ls, err := state.opts.listen(state.info())
 	if err != nil {
 		state.status = sockFailure
 		return failCommand, fmt.Errorf("listen: %w", err)
@@ -293,17 +688,50 @@ func defaultBind(state *state) (transition, error) {
 		port:        uint16(bndPort), // nolint
 	}
 
-	if _, err := reply.WriteTo(state.conn); err != nil {
+	if err := state.sendCommandReply(reply); err != nil {
 		return nil, fmt.Errorf("sock write: %w", err)
 	}
 
+	opened := time.Now()
+
+	// incoming connections from other peers are ignored if the client's one is expected
+	var match func(conn net.Conn) bool
+	if state.opts.bindExpectPeer {
+		expected, err := expectedPeer(state.command)
+		if err != nil {
+			state.status = hostUnreachable
+			return failCommand, fmt.Errorf("bind expected peer: %w", err)
+		}
+
+		match = func(conn net.Conn) bool {
+			if expected(conn.RemoteAddr()) {
+				return true
+			}
+
+			if state.opts.spoofed != nil {
+				state.opts.spoofed.bindPeers.Add(1)
+			}
+			state.onBind(BindEvent{Listener: ls.Addr(), Peer: conn.RemoteAddr(), Elapsed: time.Since(opened), Err: errUnexpectedPeer})
+			return false
+		}
+	}
+
+	state.onBind(BindEvent{Listener: ls.Addr()})
+
 	// accept connection
-	conn, err := ls.Accept()
+	conn, err := accept(ls, state.opts.bindTimeout, match)
 	if err != nil {
+		state.onBind(BindEvent{Listener: ls.Addr(), Elapsed: time.Since(opened), Err: err})
+
 		state.status = sockFailure
+		if errors.Is(err, errBindTimeout) {
+			state.status = ttlExpired
+		}
 		return failCommand, fmt.Errorf("listen accept: %w", err)
 	}
 
+	state.onBind(BindEvent{Listener: ls.Addr(), Peer: conn.RemoteAddr(), Elapsed: time.Since(opened)})
+
 	// parse remote addr
 	bndAddrType, bndIP, bndPort, err = parseAddress(conn.RemoteAddr())
 	if err != nil {
@@ -316,39 +744,56 @@ func defaultBind(state *state) (transition, error) {
 	reply.addr = bndIP
 	reply.port = uint16(bndPort) // nolint
 
-	if _, err := reply.WriteTo(state.conn); err != nil {
+	if err := state.sendCommandReply(reply); err != nil {
 		return nil, fmt.Errorf("sock write: %w", err)
 	}
 
-	link(conn, state.conn)
-
-	return nil, nil
+	return nil, relay(state, conn)
 }
 
-func defaultConnect(addressType int, addr []byte, port int) (net.Conn, error) {
-	// make connection string for net.Dial
-	address := buildDialAddress(addressType, addr, port)
+// defaultConnect returns Connect callback dialing tcp connection to the destination from localIP
+// (nil means any). Zero timeout means no timeout besides the operating system one, control
+// if not nil, sets up sockets before connecting.
+func defaultConnect(timeout time.Duration, localIP net.IP, control func(network, address string, c syscall.RawConn) error) func(addressType int, addr []byte, port int) (net.Conn, error) {
+	dialer := net.Dialer{Timeout: timeout, Control: control}
+	if localIP != nil {
+		dialer.LocalAddr = &net.TCPAddr{IP: localIP}
+	}
 
-	conn, err := net.Dial("tcp", address)
-	if err != nil {
-		if errors.Is(err, syscall.EHOSTUNREACH) {
-			return conn, fmt.Errorf("%w: %v", ErrHostUnreachable, err)
-		}
-		if errors.Is(err, syscall.ECONNREFUSED) {
-			return conn, fmt.Errorf("%w: %v", ErrConnectionRefused, err)
-		}
-		if errors.Is(err, syscall.ENETUNREACH) {
-			return conn, fmt.Errorf("%w: %v", ErrNetworkUnreachable, err)
-		}
-		if errors.Is(err, os.ErrDeadlineExceeded) {
-			return conn, fmt.Errorf("%w: %v", ErrTTLExpired, err)
+	return func(addressType int, addr []byte, port int) (net.Conn, error) {
+		// make connection string for net.Dial
+		address := buildDialAddress(addressType, addr, port)
+
+		conn, err := dialer.Dial("tcp", address)
+		if err != nil {
+			return nil, dialError(err)
 		}
-		return conn, err
+
+		_ = conn.(*net.TCPConn).SetLinger(0) // nolint
+
+		return conn, nil
 	}
+}
 
-	_ = conn.(*net.TCPConn).SetLinger(0) // nolint
+// dialError wraps dial error into the one determining reply status.
+func dialError(err error) error {
+	var netErr net.Error
+
+	switch {
+	case errors.Is(err, syscall.EHOSTUNREACH):
+		return fmt.Errorf("%w: %v", ErrHostUnreachable, err)
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return fmt.Errorf("%w: %v", ErrConnectionRefused, err)
+	case errors.Is(err, syscall.ENETUNREACH):
+		return fmt.Errorf("%w: %v", ErrNetworkUnreachable, err)
+	case errors.Is(err, os.ErrDeadlineExceeded),
+		errors.Is(err, context.DeadlineExceeded),
+		errors.Is(err, syscall.ETIMEDOUT),
+		errors.As(err, &netErr) && netErr.Timeout():
+		return fmt.Errorf("%w: %v", ErrTTLExpired, err)
+	}
 
-	return conn, nil
+	return err
 }
 
 // buildDialAddress returns address in net.Dial format from SOCKS5 details.
@@ -363,13 +808,85 @@ func buildDialAddress(addressType int, addr []byte, port int) string {
 	return net.JoinHostPort(host, strconv.Itoa(port))
 }
 
+// link relays data in both directions until both sides finish sending.
+// When one side sends EOF the other one gets FIN via CloseWrite and may still send the rest of data
+// back (half-close used by SMTP, git etc.). If the peer doesn't support CloseWrite or copying fails
+// both sides are closed at once. It returns the numbers of bytes written to dst and src.
+//
+// When both sides are *net.TCPConn on Linux io.Copy goes to TCPConn.ReadFrom which uses zero-copy
+// splice(2), so keep the connections unwrapped to get the fast path. Other sessions are copied
+// with pooled buffers growing up to opts.bufferSize (see copyBuffer), so are metered sessions.
+//
 // nolint
-func link(dst, src io.ReadWriteCloser) {
-	go func() {
-		_, _ = io.Copy(dst, src)
-		_ = dst.Close()
-	}()
+func link(opts linkOptions, dst, src io.ReadWriteCloser) (up, down int64) {
+	spawn := opts.spawn
+	if spawn == nil {
+		spawn = func(fn func()) { go fn() }
+	}
+
+	done := make(chan struct{})
+	spawn(func() {
+		defer close(done)
+		up = pipe(dst, src, opts.bufferSize, opts.up)
+	})
+
+	if opts.firstByte != nil {
+		// the first byte is copied alone to catch the time, the rest goes the fast path
+		n, err := io.CopyN(writer(src, opts.down), dst, 1)
+		down += n
+		if n == 1 {
+			opts.firstByte()
+		} else if err != nil && !errors.Is(err, io.EOF) {
+			_ = src.Close()
+			_ = dst.Close()
+		}
+	}
+	down += pipe(src, dst, opts.bufferSize, opts.down)
+	<-done
+
+	_ = src.Close()
+	_ = dst.Close()
+
+	return up, down
+}
 
-	_, _ = io.Copy(src, dst)
+// linkOptions tune relaying of link.
+type linkOptions struct {
+	spawn      func(func())  // runs the copying goroutine, nil means go statement
+	bufferSize int           // max size of relay buffers, 0 means default
+	up         *atomic.Int64 // counts bytes written to dst, nil disables metering
+	down       *atomic.Int64 // counts bytes written to src, nil disables metering
+	firstByte  func()        // called once the first byte is written to src, OPTIONAL
+}
+
+// closeWriter is implemented by connections supporting half-close (*net.TCPConn, *net.UnixConn).
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// pipe copies src to dst and then propagates EOF to dst. On failure it closes both sides
+// to interrupt the opposite direction. It returns the number of bytes written to dst.
+func pipe(dst, src io.ReadWriteCloser, bufferSize int, written *atomic.Int64) int64 {
+	var (
+		n   int64
+		err error
+	)
+	switch {
+	case written != nil:
+		n, err = copyBuffer(writer(dst, written), src, bufferSize)
+	case spliceable(dst, src):
+		n, err = io.Copy(dst, src)
+	default:
+		n, err = copyBuffer(dst, src, bufferSize)
+	}
+	if err == nil {
+		if cw, ok := dst.(closeWriter); ok && cw.CloseWrite() == nil {
+			return n
+		}
+	}
+
+	_ = dst.Close()
 	_ = src.Close()
+
+	return n
 }
@@ -2,13 +2,17 @@ package proxyme
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"net"
+	"os"
 	"reflect"
 	"strconv"
+	"syscall"
 	"testing"
+	"time"
 )
 
 type fakeRWCloser struct {
@@ -26,20 +30,86 @@ func (f fakeRWCloser) Read(p []byte) (n int, err error) {
 }
 
 func (f fakeRWCloser) Close() error {
+	if f.fnClose == nil {
+		return nil
+	}
 	return f.fnClose()
 }
 
 type fakeAuth struct {
 	fnMethod func() authMethod
 	fnAuth   func(conn io.ReadWriteCloser) (io.ReadWriteCloser, error)
+	username string
 }
 
 func (f fakeAuth) method() authMethod {
 	return f.fnMethod()
 }
 
-func (f fakeAuth) auth(conn io.ReadWriteCloser) (io.ReadWriteCloser, error) {
-	return f.fnAuth(conn)
+func (f fakeAuth) auth(_ context.Context, conn io.ReadWriteCloser) (io.ReadWriteCloser, string, error) {
+	conn, err := f.fnAuth(conn)
+	return conn, f.username, err
+}
+
+func TestSOCKS5_permits(t *testing.T) {
+	_, lan, _ := net.ParseCIDR("192.168.0.0/16")
+	_, local, _ := net.ParseCIDR("::1/128")
+
+	type args struct {
+		method authMethod
+		client net.Addr
+	}
+	tests := []struct {
+		name     string
+		networks []*net.IPNet
+		args     args
+		want     bool
+	}{
+		{
+			name:     "no restrictions",
+			networks: nil,
+			args:     args{method: typeNoAuth, client: nil},
+			want:     true,
+		},
+		{
+			name:     "login is not restricted",
+			networks: []*net.IPNet{lan},
+			args:     args{method: typeLogin, client: &net.TCPAddr{IP: net.IPv4(8, 8, 8, 8)}},
+			want:     true,
+		},
+		{
+			name:     "noauth from permitted network",
+			networks: []*net.IPNet{lan, local},
+			args:     args{method: typeNoAuth, client: &net.TCPAddr{IP: net.IPv4(192, 168, 1, 10)}},
+			want:     true,
+		},
+		{
+			name:     "noauth from permitted ipv6 network",
+			networks: []*net.IPNet{lan, local},
+			args:     args{method: typeNoAuth, client: &net.TCPAddr{IP: net.IPv6loopback}},
+			want:     true,
+		},
+		{
+			name:     "noauth from other network",
+			networks: []*net.IPNet{lan, local},
+			args:     args{method: typeNoAuth, client: &net.TCPAddr{IP: net.IPv4(8, 8, 8, 8)}},
+			want:     false,
+		},
+		{
+			name:     "noauth from unknown address",
+			networks: []*net.IPNet{lan},
+			args:     args{method: typeNoAuth, client: nil},
+			want:     false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := SOCKS5{noAuthNets: tt.networks}
+			if got := s.permits(tt.args.method, tt.args.client); got != tt.want {
+				t.Errorf("permits() = %v, want %v", got, tt.want)
+			}
+		})
+	}
 }
 
 func Test_failAuth(t *testing.T) {
@@ -154,6 +224,90 @@ func Test_initial(t *testing.T) {
 				return nil
 			},
 		},
+		{
+			name: "repeated methods keep the client preference",
+			args: args{
+				state: &state{
+					opts: SOCKS5{
+						auth: map[authMethod]authHandler{
+							typeNoAuth: &noAuth{},
+							typeLogin:  &usernameAuth{},
+						},
+					},
+					conn: fakeRWCloser{
+						fnRead: bytes.NewReader([]byte{0x05, 0x05, 0x80, byte(typeLogin), 0x80, byte(typeNoAuth), byte(typeLogin)}).Read,
+					},
+				},
+			},
+			check: func(state *state, transition transition, err error) error {
+				if err != nil {
+					return fmt.Errorf("unexpected error: %w", err)
+				}
+				want := []authMethod{0x80, typeLogin, typeNoAuth}
+				if !reflect.DeepEqual(state.methods, want) {
+					return fmt.Errorf("got %v, want %v", state.methods, want)
+				}
+				if state.method == nil || state.method.method() != typeLogin {
+					return fmt.Errorf("got auth handler %v, want login", state.method)
+				}
+
+				return nil
+			},
+		},
+		{
+			name: "prefer authentication over noauth",
+			args: args{
+				state: &state{
+					opts: SOCKS5{
+						auth: map[authMethod]authHandler{
+							typeNoAuth: &noAuth{},
+							typeLogin:  &usernameAuth{},
+						},
+						preferAuth: true,
+					},
+					conn: fakeRWCloser{
+						fnRead: bytes.NewReader([]byte{0x05, 0x02, byte(typeNoAuth), byte(typeLogin)}).Read,
+					},
+				},
+			},
+			check: func(state *state, transition transition, err error) error {
+				if err != nil {
+					return fmt.Errorf("unexpected error: %w", err)
+				}
+				if state.method == nil || state.method.method() != typeLogin {
+					return fmt.Errorf("got auth handler %v, want login", state.method)
+				}
+
+				return nil
+			},
+		},
+		{
+			name: "prefer authentication falls back to noauth",
+			args: args{
+				state: &state{
+					opts: SOCKS5{
+						auth: map[authMethod]authHandler{
+							typeNoAuth: &noAuth{},
+							typeLogin:  &usernameAuth{},
+						},
+						preferAuth: true,
+					},
+					conn: fakeRWCloser{
+						fnRead: bytes.NewReader([]byte{0x05, 0x02, byte(typeNoAuth), byte(typeGSSAPI)}).Read,
+					},
+				},
+			},
+			check: func(state *state, transition transition, err error) error {
+				if err != nil {
+					return fmt.Errorf("unexpected error: %w", err)
+				}
+				if state.method == nil || state.method.method() != typeNoAuth {
+					return fmt.Errorf("got auth handler %v, want noauth", state.method)
+				}
+
+				return nil
+			},
+		},
 		{
 			name: "no common auth method",
 			args: args{
@@ -368,6 +522,35 @@ func Test_authenticate(t *testing.T) {
 				return nil
 			},
 		},
+		{
+			name: "auth error: credentials rejected",
+			args: args{
+				state: &state{
+					conn: fakeRWCloser{
+						fnWrite: func(p []byte) (n int, err error) {
+							return len(p), nil
+						},
+					},
+					method: fakeAuth{
+						fnMethod: func() authMethod {
+							return typeLogin
+						},
+						fnAuth: func(conn io.ReadWriteCloser) (io.ReadWriteCloser, error) {
+							return conn, ErrInvalidCredentials
+						},
+					},
+				},
+			},
+			check: func(s *state, t transition, err error) error {
+				if !errors.Is(err, ErrInvalidCredentials) {
+					return fmt.Errorf("got error %v, want %v", err, ErrInvalidCredentials)
+				}
+				if t != nil {
+					return fmt.Errorf("expected nil transition")
+				}
+				return nil
+			},
+		},
 		{
 			name: "network error",
 			args: args{
@@ -489,8 +672,8 @@ func Test_getCommand(t *testing.T) {
 				if !errors.Is(err, errInvalidAddrType) {
 					return fmt.Errorf("got %v, want %v", err, errInvalidAddrType)
 				}
-				if t != nil {
-					return fmt.Errorf("want nil transition")
+				if t == nil || s.status != addressNotSupported {
+					return fmt.Errorf("got status %d, want address not supported reply", s.status)
 				}
 				return nil
 			},
@@ -622,6 +805,35 @@ func Test_failCommand(t *testing.T) {
 				return nil
 			},
 		},
+		{
+			name: "disguised status",
+			args: args{
+				state: &state{
+					opts: SOCKS5{failureStatus: hostUnreachable, failureJitter: time.Millisecond},
+					command: commandRequest{
+						version:     5,
+						commandType: connect,
+						addressType: ipv4,
+						addr:        net.IPv4(10, 0, 0, 1).To4(),
+						port:        22,
+					},
+					status: connectionRefused,
+					conn:   &bufferConn{},
+				},
+			},
+			check: func(s *state, t transition, err error) error {
+				if err != nil {
+					return fmt.Errorf("unexpected error: %v", err)
+				}
+
+				reply := s.conn.(*bufferConn).w.Bytes()
+				if len(reply) < 2 || commandStatus(reply[1]) != hostUnreachable {
+					return fmt.Errorf("got reply %v, want host unreachable status", reply)
+				}
+
+				return nil
+			},
+		},
 		{
 			name: "network error",
 			args: args{
@@ -691,7 +903,7 @@ func Test_runBind(t *testing.T) {
 			args: args{
 				state: &state{
 					opts: SOCKS5{
-						listen: func() (net.Listener, error) {
+						listen: func(info SessionInfo) (net.Listener, error) {
 							return nil, nil
 						},
 					},
@@ -796,11 +1008,18 @@ func makeTCPConn() (net.Conn, error) {
 	}
 	defer ls.Close()
 	go func() {
-		_, _ = ls.Accept()
+		conn, err := ls.Accept()
+		if err != nil {
+			return
+		}
+		// close on client EOF as a well-behaved server does
+		_, _ = io.Copy(io.Discard, conn)
+		_ = conn.Close()
 	}()
 
 	return net.Dial("tcp", ls.Addr().String())
 }
+
 func Test_runConnect(t *testing.T) {
 	ipaddr, _ := net.ResolveTCPAddr("tcp", "192.168.1.1:1234")
 
@@ -811,6 +1030,8 @@ func Test_runConnect(t *testing.T) {
 
 	resultBuffer := bytes.Buffer{}
 
+	var established SessionInfo
+
 	type args struct {
 		state *state
 	}
@@ -860,6 +1081,37 @@ func Test_runConnect(t *testing.T) {
 				return nil
 			},
 		},
+		{
+			name: "rewrite error: not allowed",
+			args: args{
+				state: &state{
+					opts: SOCKS5{
+						rewrite: func(addressType int, addr []byte, port int) (int, []byte, int, error) {
+							return addressType, addr, port, ErrNotAllowed
+						},
+						connect: func(addressType int, addr []byte, port int) (net.Conn, error) {
+							return nil, fmt.Errorf("must not be called")
+						},
+					},
+					conn: nil,
+					command: commandRequest{
+						commandType: connect,
+						addressType: ipv4,
+						addr:        ipaddr.IP.To4(),
+						port:        uint16(ipaddr.Port),
+					},
+				},
+			},
+			check: func(s *state, t transition, err error) error {
+				if !errors.Is(err, ErrNotAllowed) {
+					return fmt.Errorf("unexpected error: %w, want %w", err, ErrNotAllowed)
+				}
+				if s.status != notAllowed {
+					return fmt.Errorf("got status %d, want %d", s.status, notAllowed)
+				}
+				return nil
+			},
+		},
 		{
 			name: "connect error: host unreachable",
 			args: args{
@@ -1133,6 +1385,47 @@ func Test_runConnect(t *testing.T) {
 				return nil
 			},
 		},
+		{
+			name: "reply success: established hook",
+			args: args{
+				state: &state{
+					opts: SOCKS5{
+						connect: func(addressType int, addr []byte, port int) (net.Conn, error) {
+							return validTCPConn, nil
+						},
+						onEstablished: func(client io.ReadWriteCloser, upstream net.Conn, info SessionInfo) {
+							established = info
+						},
+					},
+					conn: fakeRWCloser{
+						fnWrite: func(p []byte) (n int, err error) {
+							return len(p), nil
+						},
+					},
+					command: commandRequest{
+						commandType: connect,
+						addressType: ipv4,
+						addr:        ipaddr.IP.To4(),
+						port:        uint16(ipaddr.Port),
+					},
+				},
+			},
+			check: func(s *state, t transition, err error) error {
+				if err != nil {
+					return fmt.Errorf("unexpected error: %w", err)
+				}
+				if t != nil {
+					return fmt.Errorf("want transition nil")
+				}
+				if established.Command != int(connect) {
+					return fmt.Errorf("got command %d, want %d", established.Command, connect)
+				}
+				if established.Destination() != ipaddr.String() {
+					return fmt.Errorf("got destination %s, want %s", established.Destination(), ipaddr)
+				}
+				return nil
+			},
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -1197,3 +1490,190 @@ func Test_buildDialAddress(t *testing.T) {
 		})
 	}
 }
+
+func Test_dialError(t *testing.T) {
+	timeout := &net.OpError{Op: "dial", Net: "tcp", Err: &timeoutError{}}
+	other := errors.New("other")
+
+	tests := []struct {
+		name string
+		err  error
+		want error
+	}{
+		{name: "host unreachable", err: syscall.EHOSTUNREACH, want: ErrHostUnreachable},
+		{name: "connection refused", err: syscall.ECONNREFUSED, want: ErrConnectionRefused},
+		{name: "network unreachable", err: syscall.ENETUNREACH, want: ErrNetworkUnreachable},
+		{name: "deadline exceeded", err: os.ErrDeadlineExceeded, want: ErrTTLExpired},
+		{name: "context deadline", err: fmt.Errorf("dial: %w", context.DeadlineExceeded), want: ErrTTLExpired},
+		{name: "net timeout", err: timeout, want: ErrTTLExpired},
+		{name: "other", err: other, want: other},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := dialError(tt.err); !errors.Is(got, tt.want) {
+				t.Errorf("dialError() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// tcpPair returns two ends of the loopback tcp connection.
+func tcpPair(tb testing.TB) (net.Conn, net.Conn) {
+	tb.Helper()
+
+	ls, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatalf("listen: %v", err)
+	}
+	defer ls.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := ls.Accept()
+		accepted <- conn
+	}()
+
+	conn, err := net.Dial("tcp", ls.Addr().String())
+	if err != nil {
+		tb.Fatalf("dial: %v", err)
+	}
+
+	peer := <-accepted
+	if peer == nil {
+		tb.Fatalf("accept failed")
+	}
+
+	return conn, peer
+}
+
+// onlyRWC hides optimized interfaces (ReaderFrom, WriterTo) of the connection.
+type onlyRWC struct {
+	io.ReadWriteCloser
+}
+
+func Test_link(t *testing.T) {
+	tests := []struct {
+		name  string
+		pair  func(tb testing.TB) (net.Conn, net.Conn)
+		check func(client, upstream net.Conn) error
+	}{
+		{
+			name: "half-close propagated",
+			pair: tcpPair,
+			check: func(client, upstream net.Conn) error {
+				// client sends request and half-closes, the response comes after upstream sees EOF
+				if _, err := client.Write([]byte("request")); err != nil {
+					return fmt.Errorf("client write: %w", err)
+				}
+				if err := client.(*net.TCPConn).CloseWrite(); err != nil {
+					return fmt.Errorf("client close write: %w", err)
+				}
+
+				req, err := io.ReadAll(upstream)
+				if err != nil {
+					return fmt.Errorf("upstream read: %w", err)
+				}
+				if string(req) != "request" {
+					return fmt.Errorf("upstream got %q, want %q", req, "request")
+				}
+
+				if _, err := upstream.Write([]byte("response")); err != nil {
+					return fmt.Errorf("upstream write: %w", err)
+				}
+				_ = upstream.Close()
+
+				resp, err := io.ReadAll(client)
+				if err != nil {
+					return fmt.Errorf("client read: %w", err)
+				}
+				if string(resp) != "response" {
+					return fmt.Errorf("client got %q, want %q", resp, "response")
+				}
+				return nil
+			},
+		},
+		{
+			name: "full close without half-close support",
+			pair: func(tb testing.TB) (net.Conn, net.Conn) {
+				return net.Pipe()
+			},
+			check: func(client, upstream net.Conn) error {
+				_ = client.Close()
+
+				if _, err := upstream.Read(make([]byte, 1)); !errors.Is(err, io.EOF) {
+					return fmt.Errorf("upstream conn must be closed, got %v", err)
+				}
+				return nil
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, clientSide := tt.pair(t)
+			upstream, upstreamSide := tt.pair(t)
+			defer client.Close()
+			defer upstream.Close()
+
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				link(linkOptions{}, upstreamSide, clientSide)
+			}()
+
+			if err := tt.check(client, upstream); err != nil {
+				t.Errorf("link() error = %v", err)
+			}
+
+			select {
+			case <-done:
+			case <-time.After(time.Second):
+				t.Errorf("link() didn't finish")
+			}
+		})
+	}
+}
+
+func Benchmark_link(b *testing.B) {
+	sizes := []int{4 << 10, 256 << 10, 4 << 20}
+	modes := []struct {
+		name string
+		wrap func(net.Conn) io.ReadWriteCloser
+	}{
+		{name: "tcp", wrap: func(c net.Conn) io.ReadWriteCloser { return c }},
+		{name: "generic", wrap: func(c net.Conn) io.ReadWriteCloser { return onlyRWC{c} }},
+	}
+
+	for _, mode := range modes {
+		for _, size := range sizes {
+			b.Run(fmt.Sprintf("%s/%dKB", mode.name, size>>10), func(b *testing.B) {
+				client, clientSide := tcpPair(b)
+				upstream, upstreamSide := tcpPair(b)
+				defer client.Close()
+				defer upstream.Close()
+
+				go link(linkOptions{}, mode.wrap(upstreamSide), mode.wrap(clientSide))
+
+				payload := make([]byte, size)
+				buf := make([]byte, size)
+
+				b.SetBytes(int64(size))
+				b.ResetTimer()
+
+				for i := 0; i < b.N; i++ {
+					go func() {
+						_, _ = client.Write(payload)
+					}()
+					if _, err := io.ReadFull(upstream, buf); err != nil {
+						b.Fatalf("read: %v", err)
+					}
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package proxyme
+
+import "time"
+
+// Quirks is compatibility settings for broken clients deviating from RFC 1928 or depending on how
+// the server writes replies. Zero value is the standard behavior.
+type Quirks struct {
+	// MethodReplyDelay delays the method selection reply, some clients misbehave when the reply
+	// arrives before they have finished sending the greeting.
+	MethodReplyDelay time.Duration
+
+	// CombineReplies holds the method selection reply of methods without subnegotiation (noauth)
+	// until the command reply, so both go to the client in a single TCP segment. Only clients
+	// pipelining the request after the greeting work in this mode: clients waiting for the method
+	// selection reply before sending the request hang until MessageTimeout.
+	CombineReplies bool
+
+	// WriteThrough disables coalescing of protocol message writes: messages are written to
+	// the connection unbuffered as they are encoded, for clients misbehaving on coalesced replies.
+	WriteThrough bool
+
+	// TolerateRSV accepts requests with non-zero RSV field.
+	TolerateRSV bool
+}
+
+// WithQuirks returns a copy of the server applying the quirks to its sessions. The copy shares
+// sessions, counters and caches with the original, so the quirks may be toggled per listener:
+//
+//	srv := &proxyme.Server{SOCKS5: socks5.WithQuirks(proxyme.Quirks{CombineReplies: true})}
+//	go srv.ListenAndServe(":1081") // legacy clients
+func (s SOCKS5) WithQuirks(q Quirks) *SOCKS5 {
+	s.quirks = q
+	return &s
+}
+
+// combinesReply reports whether the method selection reply waits for the command reply.
+func (q Quirks) combinesReply(method authMethod) bool {
+	return q.CombineReplies && method == typeNoAuth
+}
@@ -0,0 +1,41 @@
+package proxyme
+
+import "testing"
+
+func TestSOCKS5_WithQuirks(t *testing.T) {
+	s, err := New(Options{AllowNoAuth: true})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+
+	legacy := s.WithQuirks(Quirks{CombineReplies: true})
+	if s.quirks.CombineReplies {
+		t.Errorf("WithQuirks() changes the original server")
+	}
+	if !legacy.quirks.CombineReplies {
+		t.Errorf("WithQuirks() quirks aren't applied")
+	}
+	if legacy.canaryHits != s.canaryHits || legacy.sessions != s.sessions {
+		t.Errorf("WithQuirks() copy doesn't share counters and sessions")
+	}
+}
+
+func TestQuirks_combinesReply(t *testing.T) {
+	tests := []struct {
+		name   string
+		quirks Quirks
+		method authMethod
+		want   bool
+	}{
+		{name: "standard", method: typeNoAuth, want: false},
+		{name: "noauth", quirks: Quirks{CombineReplies: true}, method: typeNoAuth, want: true},
+		{name: "subnegotiation", quirks: Quirks{CombineReplies: true}, method: typeLogin, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.quirks.combinesReply(tt.method); got != tt.want {
+				t.Errorf("combinesReply() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
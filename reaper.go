@@ -0,0 +1,192 @@
+package proxyme
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// defaultReapInterval is the default period of reaper scans.
+const defaultReapInterval = 10 * time.Second
+
+// ErrSessionIdle reports the established session closed by the reaper for being idle (see
+// Options.IdleTimeout).
+var ErrSessionIdle = errors.New("session idle")
+
+// reaper closes established sessions idle for too long or outliving their deadlines: the relay has
+// no timeouts of its own, and deadlines are armed once the tunnel is established, so the reaper
+// rechecks them as the rules change. The scanning goroutine runs while there are sessions.
+type reaper struct {
+	interval    time.Duration
+	idle        time.Duration                    // 0 means sessions aren't checked for idleness
+	deadline    func(info SessionInfo) time.Time // Options.SessionDeadline
+	maxDuration time.Duration                    // Options.MaxSessionDuration
+	expired     *atomic.Int64                    // sessions terminated at the deadline
+
+	mu       sync.Mutex
+	sessions map[*reapEntry]struct{}
+	running  bool
+
+	reaped atomic.Int64 // sessions closed for being idle
+}
+
+// reapEntry is the session watched by the reaper.
+type reapEntry struct {
+	conn    any    // client connection, the source of idle time
+	kill    func() // closes the session
+	started time.Time
+
+	mu     sync.Mutex
+	info   *SessionInfo // nil until the tunnel is established
+	armed  time.Time    // deadline armed when the tunnel has been established
+	reason error        // why the session has been reaped
+}
+
+// newReaper returns the reaper of the options counting sessions terminated at the deadline by expired,
+// nil if it's disabled.
+func newReaper(opts Options, expired *atomic.Int64) *reaper {
+	if opts.IdleTimeout == 0 && opts.ReapInterval == 0 {
+		return nil
+	}
+
+	interval := opts.ReapInterval
+	if interval == 0 {
+		interval = defaultReapInterval
+		if opts.IdleTimeout > 0 {
+			interval = min(interval, opts.IdleTimeout)
+		}
+	}
+
+	return &reaper{
+		interval:    interval,
+		idle:        opts.IdleTimeout,
+		deadline:    opts.SessionDeadline,
+		maxDuration: opts.MaxSessionDuration,
+		expired:     expired,
+		sessions:    make(map[*reapEntry]struct{}),
+	}
+}
+
+// reap puts the session under watch of the reaper, kill closes the session. The returned func
+// removes the session and reports the reason if it has been reaped.
+func (s *state) reap(conn any, kill func(), onError func(error)) func() {
+	r := s.opts.reaper
+	if r == nil {
+		return func() {}
+	}
+
+	e := &reapEntry{conn: conn, kill: kill, started: s.started}
+	s.reaped = e
+
+	r.mu.Lock()
+	r.sessions[e] = struct{}{}
+	if !r.running {
+		r.running = true
+		go r.run()
+	}
+	r.mu.Unlock()
+
+	return func() {
+		r.mu.Lock()
+		delete(r.sessions, e)
+		r.mu.Unlock()
+
+		e.mu.Lock()
+		err := e.reason
+		e.mu.Unlock()
+
+		if err != nil {
+			s.traceError(err)
+			if onError != nil {
+				onError(err)
+			}
+		}
+	}
+}
+
+// established lets the reaper check the session once its tunnel is established with the deadline.
+func (s *state) established(info SessionInfo, deadline time.Time) {
+	e := s.reaped
+	if e == nil {
+		return
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.info, e.armed = &info, deadline
+}
+
+// run scans the sessions every interval until there are none.
+func (r *reaper) run() {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	var batch []*reapEntry
+	for now := range ticker.C {
+		r.mu.Lock()
+		if len(r.sessions) == 0 {
+			r.running = false
+			r.mu.Unlock()
+			return
+		}
+		batch = batch[:0]
+		for e := range r.sessions {
+			batch = append(batch, e)
+		}
+		r.mu.Unlock()
+
+		for _, e := range batch {
+			r.check(e, now)
+		}
+		clear(batch)
+	}
+}
+
+// check closes the established session idle for too long or past its deadline. Deadlines which
+// haven't moved since the tunnel has been established are left to the armed timer.
+func (r *reaper) check(e *reapEntry, now time.Time) {
+	e.mu.Lock()
+	info, armed, reaped := e.info, e.armed, e.reason != nil
+	e.mu.Unlock()
+	if info == nil || reaped {
+		return
+	}
+
+	deadline, reason := sessionDeadline(r.deadline, r.maxDuration, *info, e.started)
+	if !deadline.IsZero() && !now.Before(deadline) && (armed.IsZero() || deadline.Before(armed)) {
+		r.expired.Add(1)
+		e.close(fmt.Errorf("%w: %s: %s at %s", ErrSessionExpired, info.Destination(), reason, deadline.Format(time.RFC3339)))
+		return
+	}
+
+	// UDP associations have their own idle timeout, the control connection is idle by design
+	if r.idle == 0 || commandType(info.Command) == udpAssoc {
+		return
+	}
+	if idle, ok := idleTime(e.conn); ok && idle >= r.idle {
+		r.reaped.Add(1)
+		e.close(fmt.Errorf("%w: %s: no data for %v", ErrSessionIdle, info.Destination(), idle.Round(time.Millisecond)))
+	}
+}
+
+// close closes the session for the reason.
+func (e *reapEntry) close(reason error) {
+	e.mu.Lock()
+	e.reason = reason
+	e.mu.Unlock()
+
+	e.kill()
+}
+
+// ReapedSessions returns the number of established sessions closed for being idle (see
+// Options.IdleTimeout). Sessions closed past their deadlines are counted by ExpiredSessions.
+func (s SOCKS5) ReapedSessions() int64 {
+	if s.reaper == nil {
+		return 0
+	}
+
+	return s.reaper.reaped.Load()
+}
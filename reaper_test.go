@@ -0,0 +1,96 @@
+package proxyme
+
+import (
+	"errors"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func Test_newReaper(t *testing.T) {
+	tests := []struct {
+		name         string
+		opts         Options
+		wantDisabled bool
+		wantInterval time.Duration
+	}{
+		{name: "disabled", wantDisabled: true},
+		{name: "default interval", opts: Options{IdleTimeout: time.Minute}, wantInterval: defaultReapInterval},
+		{name: "idle timeout shorter than default", opts: Options{IdleTimeout: time.Second}, wantInterval: time.Second},
+		{name: "deadlines only", opts: Options{ReapInterval: time.Second}, wantInterval: time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newReaper(tt.opts, &atomic.Int64{})
+			if (r == nil) != tt.wantDisabled {
+				t.Fatalf("newReaper() = %v, want disabled %v", r, tt.wantDisabled)
+			}
+			if r != nil && r.interval != tt.wantInterval {
+				t.Errorf("got interval %v, want %v", r.interval, tt.wantInterval)
+			}
+		})
+	}
+}
+
+func Test_reaper_check(t *testing.T) {
+	now := time.Now()
+	past, later := now.Add(-time.Second), now.Add(time.Hour)
+
+	tests := []struct {
+		name        string
+		idle        time.Duration
+		deadline    time.Time // current deadline of the session
+		armed       time.Time // deadline armed when the tunnel was established
+		command     commandType
+		established bool
+		linuxOnly   bool // idle time is known on Linux only
+		wantErr     error
+	}{
+		{name: "not established", deadline: past, wantErr: nil},
+		{name: "deadline moved earlier", deadline: past, armed: later, established: true, wantErr: ErrSessionExpired},
+		{name: "deadline set since established", deadline: past, established: true, wantErr: ErrSessionExpired},
+		{name: "armed deadline is left to the timer", deadline: past, armed: past, established: true, wantErr: nil},
+		{name: "deadline ahead", deadline: later, established: true, wantErr: nil},
+		{name: "idle", idle: time.Millisecond, established: true, command: connect, linuxOnly: true, wantErr: ErrSessionIdle},
+		{name: "idle udp association", idle: time.Millisecond, established: true, command: udpAssoc, wantErr: nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.linuxOnly && (runtime.GOOS != "linux" || runtime.GOARCH == "386") {
+				t.Skip("idle time is known on linux only")
+			}
+
+			client, server := tcpPair(t)
+			defer client.Close()
+			defer server.Close()
+
+			var killed bool
+			expired := &atomic.Int64{}
+			r := newReaper(Options{
+				IdleTimeout:     tt.idle,
+				ReapInterval:    time.Hour,
+				SessionDeadline: func(SessionInfo) time.Time { return tt.deadline },
+			}, expired)
+			e := &reapEntry{conn: server, kill: func() { killed = true }, started: now}
+
+			s := &state{reaped: e}
+			if tt.established {
+				s.established(SessionInfo{Command: int(tt.command)}, tt.armed)
+			}
+			time.Sleep(10 * time.Millisecond) // the connection gets idle
+
+			r.check(e, time.Now())
+
+			if !errors.Is(e.reason, tt.wantErr) || (e.reason == nil) != (tt.wantErr == nil) {
+				t.Fatalf("reaped for %v, want %v", e.reason, tt.wantErr)
+			}
+			if killed != (tt.wantErr != nil) {
+				t.Errorf("killed %v, want %v", killed, tt.wantErr != nil)
+			}
+			if got := expired.Load() + r.reaped.Load(); killed && got != 1 {
+				t.Errorf("got %d sessions counted, want 1", got)
+			}
+		})
+	}
+}
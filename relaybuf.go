@@ -0,0 +1,96 @@
+package proxyme
+
+import (
+	"errors"
+	"io"
+	"math/bits"
+	"net"
+	"runtime"
+	"sync"
+)
+
+const (
+	minRelayBufferSize     = 2 << 10  // initial buffer of the adaptive copy
+	defaultRelayBufferSize = 32 << 10 // the same as io.Copy
+	maxRelayBufferSize     = 1 << 20
+	relayBufferClasses     = 10 // minRelayBufferSize << 9 == maxRelayBufferSize
+)
+
+// errInvalidWrite means that a write returned an impossible count.
+var errInvalidWrite = errors.New("invalid write result")
+
+// relayBuffers pools relay buffers by power of two size classes from minRelayBufferSize
+// to maxRelayBufferSize.
+var relayBuffers [relayBufferClasses]sync.Pool
+
+// sizeClass returns the pool class of the buffer size, size is rounded up to the power of two.
+func sizeClass(size int) int {
+	if size <= minRelayBufferSize {
+		return 0
+	}
+
+	return bits.Len(uint((size - 1) / minRelayBufferSize))
+}
+
+func getRelayBuffer(size int) *[]byte {
+	class := sizeClass(size)
+	if b, ok := relayBuffers[class].Get().(*[]byte); ok {
+		*b = (*b)[:size]
+		return b
+	}
+
+	b := make([]byte, size, minRelayBufferSize<<class)
+	return &b
+}
+
+func putRelayBuffer(b *[]byte) {
+	relayBuffers[sizeClass(cap(*b))].Put(b)
+}
+
+// spliceable reports whether io.Copy from src to dst goes to splice(2) without user space buffers.
+func spliceable(dst, src io.ReadWriteCloser) bool {
+	_, dstTCP := dst.(*net.TCPConn)
+	_, srcTCP := src.(*net.TCPConn)
+
+	return runtime.GOOS == "linux" && dstTCP && srcTCP
+}
+
+// copyBuffer copies src to dst like io.Copy with pooled buffer growing up to maxSize: it starts
+// small, so idle sessions take little memory, and doubles each time a read fills the whole buffer,
+// so bulk transfers get large buffers.
+func copyBuffer(dst io.Writer, src io.Reader, maxSize int) (written int64, err error) {
+	if maxSize <= 0 {
+		maxSize = defaultRelayBufferSize
+	}
+
+	buf := getRelayBuffer(min(minRelayBufferSize, maxSize))
+	defer func() { putRelayBuffer(buf) }()
+
+	for {
+		nr, er := src.Read(*buf)
+		if nr > 0 {
+			nw, ew := dst.Write((*buf)[:nr])
+			if nw < 0 || nr < nw {
+				nw, ew = 0, errInvalidWrite
+			}
+			written += int64(nw)
+			if ew != nil {
+				return written, ew
+			}
+			if nr != nw {
+				return written, io.ErrShortWrite
+			}
+
+			if nr == len(*buf) && nr < maxSize {
+				putRelayBuffer(buf)
+				buf = getRelayBuffer(min(2*nr, maxSize))
+			}
+		}
+		if er != nil {
+			if errors.Is(er, io.EOF) {
+				return written, nil
+			}
+			return written, er
+		}
+	}
+}
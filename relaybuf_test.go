@@ -0,0 +1,143 @@
+package proxyme
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func Test_sizeClass(t *testing.T) {
+	tests := []struct {
+		size int
+		want int
+	}{
+		{size: 1, want: 0},
+		{size: minRelayBufferSize, want: 0},
+		{size: minRelayBufferSize + 1, want: 1},
+		{size: 32 << 10, want: 4},
+		{size: 100 << 10, want: 6},
+		{size: maxRelayBufferSize, want: relayBufferClasses - 1},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprint(tt.size), func(t *testing.T) {
+			if got := sizeClass(tt.size); got != tt.want {
+				t.Errorf("sizeClass() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// readSizes records sizes of buffers passed to Read.
+type readSizes struct {
+	r     io.Reader
+	sizes []int
+}
+
+func (r *readSizes) Read(p []byte) (int, error) {
+	r.sizes = append(r.sizes, len(p))
+	return r.r.Read(p)
+}
+
+func Test_copyBuffer(t *testing.T) {
+	tests := []struct {
+		name    string
+		size    int // data size
+		maxSize int
+		want    []int // read buffer sizes
+	}{
+		{
+			name:    "small flow keeps small buffer",
+			size:    100,
+			maxSize: 32 << 10,
+			want:    []int{2 << 10, 2 << 10},
+		},
+		{
+			name:    "bulk flow grows buffer",
+			size:    30 << 10,
+			maxSize: 8 << 10,
+			want:    []int{2 << 10, 4 << 10, 8 << 10, 8 << 10, 8 << 10, 8 << 10},
+		},
+		{
+			name:    "max less than initial size",
+			size:    3 << 10,
+			maxSize: 1 << 10,
+			want:    []int{1 << 10, 1 << 10, 1 << 10, 1 << 10},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := bytes.Repeat([]byte("x"), tt.size)
+			src := &readSizes{r: bytes.NewReader(data)}
+			var dst bytes.Buffer
+
+			n, err := copyBuffer(&dst, src, tt.maxSize)
+			if err != nil || n != int64(tt.size) || !bytes.Equal(dst.Bytes(), data) {
+				t.Fatalf("copyBuffer() = %d, %v, want %d bytes copied", n, err, tt.size)
+			}
+			if fmt.Sprint(src.sizes) != fmt.Sprint(tt.want) {
+				t.Errorf("got read sizes %v, want %v", src.sizes, tt.want)
+			}
+		})
+	}
+}
+
+func Benchmark_copyBuffer(b *testing.B) {
+	const size = 4 << 20
+
+	for _, maxSize := range []int{4 << 10, 32 << 10, 256 << 10} {
+		b.Run(fmt.Sprintf("max=%dKB", maxSize>>10), func(b *testing.B) {
+			data := make([]byte, size)
+
+			b.SetBytes(size)
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				// hide WriterTo of the reader, so the buffer is used
+				if _, err := copyBuffer(io.Discard, struct{ io.Reader }{bytes.NewReader(data)}, maxSize); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// Benchmark_relayIdle reports memory taken by idle relayed sessions: buffers are held by
+// the copying goroutines blocked on read.
+func Benchmark_relayIdle(b *testing.B) {
+	const sessions = 1000
+
+	for _, bufferSize := range []int{minRelayBufferSize, defaultRelayBufferSize, maxRelayBufferSize} {
+		b.Run(fmt.Sprintf("max=%dKB", bufferSize>>10), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				var before, after runtime.MemStats
+				runtime.GC()
+				runtime.GC() // drop pooled buffers
+				runtime.ReadMemStats(&before)
+
+				conns := make([]net.Conn, 0, 2*sessions)
+				for j := 0; j < sessions; j++ {
+					client, clientSide := net.Pipe()
+					upstream, upstreamSide := net.Pipe()
+					conns = append(conns, client, upstream)
+
+					go link(linkOptions{bufferSize: bufferSize}, upstreamSide, clientSide)
+				}
+				time.Sleep(100 * time.Millisecond) // let sessions block on read
+
+				runtime.GC()
+				runtime.ReadMemStats(&after)
+				inuse := int64(after.HeapInuse+after.StackInuse) - int64(before.HeapInuse+before.StackInuse)
+				b.ReportMetric(float64(inuse)/sessions, "B/session")
+
+				for _, c := range conns {
+					_ = c.Close()
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,776 @@
+package proxyme
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"os"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dblokhin/proxyme/mux"
+	"github.com/dblokhin/proxyme/wire"
+)
+
+// rendezvousMagic starts the connection of the agent to the rendezvous server. The secret isn't sent,
+// both sides prove they know it with HMAC-SHA256 of the nonces, the server does it first so
+// whoever answers at the server address learns nothing from the agent:
+//
+//	agent:  MAGIC | NLEN (1) | NAME | AGENT NONCE (32)
+//	server: SERVER NONCE (32) | SERVER PROOF (32)
+//	agent:  AGENT PROOF (32)
+//	server: RFC 1929 reply
+//
+// Once authenticated the agent opens the status stream and reports its health and capacity every
+// keepalive period:
+//
+//	+---------+----------+
+//	| HEALTHY | CAPACITY |
+//	+---------+----------+
+//	|    1    |    4     |
+//	+---------+----------+
+//
+// HEALTHY is 1 if the agent is able to serve sessions, CAPACITY is the maximum number of concurrent
+// sessions (0 means unlimited). Other streams are opened by the server to tunnel sessions.
+var rendezvousMagic = []byte("PXRV\x02")
+
+const (
+	// agentStatusSize is the size of the status report of the agent.
+	agentStatusSize = 5
+	// rendezvousNonceSize is the size of handshake nonces.
+	rendezvousNonceSize = 32
+)
+
+// Roles of handshake proofs, the proof of one side can't be replayed as the proof of the other.
+const (
+	agentProof  = "agent"
+	serverProof = "server"
+)
+
+const (
+	defaultKeepAlive = 15 * time.Second
+	minAgentBackoff  = time.Second
+	maxAgentBackoff  = 30 * time.Second
+)
+
+// ErrNoAgents is returned by Rendezvous.Connect when no healthy agent with spare capacity
+// is connected.
+var ErrNoAgents = fmt.Errorf("%w: no agents available", ErrNetworkUnreachable)
+
+// errAgentDown means the agent connection is lost, the next agent is tried.
+var errAgentDown = errors.New("agent is down")
+
+// Agent is the reverse side of the rendezvous mode for machines without inbound reachability:
+// it dials out to the rendezvous server, keeps the connection open and connects to destinations
+// requested by the server from the agent's network. Sessions of SOCKS5 clients of the server
+// are multiplexed over the agent connection (see mux package).
+//
+// Example:
+//
+//	agent := &proxyme.Agent{Address: "rendezvous.example.com:7000", Secret: secret}
+//	log.Fatal(agent.Run(ctx))
+type Agent struct {
+	// Address is host:port of the rendezvous server.
+	// REQUIRED.
+	Address string
+
+	// Secret is the shared secret of the rendezvous server. It's never sent: the server proves
+	// it knows the secret before the agent does, so agents don't serve impostors of the server.
+	// Use a long random secret, proofs of weak ones can be brute-forced offline.
+	// REQUIRED.
+	Secret string
+
+	// Name identifies the agent at the rendezvous server.
+	// OPTIONAL, default the host name.
+	Name string
+
+	// Connect connects to destinations requested by the rendezvous server, apply local policies here.
+	// OPTIONAL, default dials the destination directly.
+	Connect func(addressType int, addr []byte, port int) (net.Conn, error)
+
+	// TLSConfig configures TLS of the connection to the rendezvous server, e.g. RootCAs of a private CA.
+	// OPTIONAL, default system roots verifying the host of Address.
+	TLSConfig *tls.Config
+
+	// Dial if specified, establishes the connection to the rendezvous server instead of TLS over tcp,
+	// TLSConfig isn't applied. The handshake doesn't reveal the secret anyway, but tunneled sessions
+	// are protected only by the transport Dial returns.
+	// OPTIONAL, default TLS over tcp.
+	Dial func(ctx context.Context, network, address string) (net.Conn, error)
+
+	// Capacity is the maximum number of concurrent sessions advertised to the rendezvous server,
+	// the server doesn't route more sessions through the agent.
+	// OPTIONAL, default unlimited.
+	Capacity int
+
+	// Health if specified, checks the agent is able to serve sessions (e.g. its uplink is up)
+	// every KeepAlive, the rendezvous server doesn't route sessions through unhealthy agents.
+	// OPTIONAL, default the agent is always healthy.
+	Health func() error
+
+	// KeepAlive is the period of pings detecting the lost connection and of status reports.
+	// OPTIONAL, default 15 seconds.
+	KeepAlive time.Duration
+
+	// OnError if specified, receives connection failures, which are retried with exponential
+	// backoff, errors of the tunneled sessions and their recovered panics (*SessionError).
+	// OPTIONAL.
+	OnError func(error)
+}
+
+// Run keeps the agent connected to the rendezvous server until the context is done.
+func (a *Agent) Run(ctx context.Context) error {
+	if a.Address == "" || a.Secret == "" {
+		return errors.New("agent: address and secret are required")
+	}
+	if len(a.Name) > maxCredentialSize {
+		return fmt.Errorf("agent: too long name: %d bytes", len(a.Name))
+	}
+	if a.Capacity < 0 || uint64(a.Capacity) > math.MaxUint32 {
+		return fmt.Errorf("agent: invalid capacity: %d", a.Capacity)
+	}
+
+	var delay time.Duration
+	for {
+		connected, err := a.serve(ctx)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		if connected {
+			delay = 0
+		}
+		delay = min(max(2*delay, minAgentBackoff), maxAgentBackoff)
+		a.report(fmt.Errorf("agent: %w; reconnecting in %v", err, delay))
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// serve connects to the rendezvous server and serves its requests until the connection is lost.
+func (a *Agent) serve(ctx context.Context) (connected bool, err error) {
+	dial := a.Dial
+	if dial == nil {
+		dialer := &tls.Dialer{NetDialer: &net.Dialer{Timeout: upstreamHandshakeTimeout}, Config: a.TLSConfig}
+		dial = dialer.DialContext
+	}
+
+	conn, err := dial(ctx, "tcp", a.Address)
+	if err != nil {
+		return false, err
+	}
+
+	_ = conn.SetDeadline(time.Now().Add(upstreamHandshakeTimeout))
+	if err := a.handshake(conn); err != nil {
+		_ = conn.Close()
+		return false, err
+	}
+	_ = conn.SetDeadline(time.Time{})
+
+	session := mux.Server(conn)
+	defer session.Close() // nolint
+	stop := context.AfterFunc(ctx, func() { _ = session.Close() })
+	defer stop()
+
+	status, err := session.Open()
+	if err != nil {
+		return true, err
+	}
+
+	go keepAlive(session, a.KeepAlive)
+	go a.advertise(session, status)
+
+	connect := a.Connect
+	if connect == nil {
+		connect = defaultConnect(upstreamHandshakeTimeout, nil, nil)
+	}
+
+	for {
+		stream, err := session.Accept()
+		if err != nil {
+			return true, err
+		}
+
+		go a.handle(stream, connect)
+	}
+}
+
+func (a *Agent) handshake(conn net.Conn) error {
+	name := a.Name
+	if name == "" {
+		name, _ = os.Hostname()
+		name = name[:min(len(name), maxCredentialSize)]
+	}
+
+	agentNonce := make([]byte, rendezvousNonceSize)
+	if _, err := rand.Read(agentNonce); err != nil {
+		return err
+	}
+
+	hello := make([]byte, 0, len(rendezvousMagic)+1+len(name)+rendezvousNonceSize)
+	hello = append(hello, rendezvousMagic...)
+	hello = append(hello, byte(len(name)))
+	hello = append(hello, name...)
+	hello = append(hello, agentNonce...)
+	if _, err := conn.Write(hello); err != nil {
+		return err
+	}
+
+	challenge := make([]byte, rendezvousNonceSize+sha256.Size)
+	if _, err := io.ReadFull(conn, challenge); err != nil {
+		return err
+	}
+	serverNonce, proof := challenge[:rendezvousNonceSize], challenge[rendezvousNonceSize:]
+	if !hmac.Equal(proof, rendezvousProof(a.Secret, serverProof, []byte(name), agentNonce, serverNonce)) {
+		return fmt.Errorf("%w: rendezvous server doesn't prove the secret", ErrNotAllowed)
+	}
+
+	if _, err := conn.Write(rendezvousProof(a.Secret, agentProof, []byte(name), agentNonce, serverNonce)); err != nil {
+		return err
+	}
+
+	var reply wire.LoginReply
+	if _, err := reply.ReadFrom(conn); err != nil {
+		return err
+	}
+	if reply.Status != wire.LoginSucceeded {
+		return fmt.Errorf("%w: rejected by rendezvous server", ErrNotAllowed)
+	}
+
+	return nil
+}
+
+// handle connects to the destination requested by the rendezvous server and relays the stream.
+func (a *Agent) handle(stream net.Conn, connect func(addressType int, addr []byte, port int) (net.Conn, error)) {
+	defer stream.Close() // nolint
+
+	defer func() {
+		if p := recover(); p != nil {
+			a.report(&SessionError{Client: stream.RemoteAddr(), Panic: true, Err: fmt.Errorf("%v\n%s", p, debug.Stack())})
+		}
+	}()
+
+	var req wire.CommandRequest
+	_ = stream.SetReadDeadline(time.Now().Add(upstreamHandshakeTimeout))
+	if _, err := req.ReadFrom(stream); err != nil {
+		a.report(fmt.Errorf("agent: read request: %w", err))
+		return
+	}
+	_ = stream.SetReadDeadline(time.Time{})
+
+	if req.Command != wire.CommandConnect {
+		reply := wire.CommandReply{Status: wire.StatusNotSupported, Address: zeroAddress()}
+		_, _ = reply.WriteTo(stream)
+		return
+	}
+
+	upstream, err := connect(int(req.Type), req.Addr, int(req.Port))
+	if err != nil {
+		reply := wire.CommandReply{Status: wire.Status(errorStatus(err)), Address: zeroAddress()}
+		_, _ = reply.WriteTo(stream)
+		a.report(fmt.Errorf("agent: connect %s: %w", req.Address, err))
+		return
+	}
+
+	bound, err := wire.AddressFrom(upstream.LocalAddr())
+	if err != nil {
+		bound = zeroAddress()
+	}
+	if _, err := (wire.CommandReply{Status: wire.StatusSucceeded, Address: bound}).WriteTo(stream); err != nil {
+		_ = upstream.Close()
+		return
+	}
+
+	link(linkOptions{}, upstream, stream)
+}
+
+// advertise reports the agent status to the rendezvous server every keepalive period.
+func (a *Agent) advertise(session *mux.Session, status net.Conn) {
+	interval := a.KeepAlive
+	if interval <= 0 {
+		interval = defaultKeepAlive
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		msg := make([]byte, agentStatusSize)
+		if a.Health == nil || a.Health() == nil {
+			msg[0] = 1
+		}
+		binary.BigEndian.PutUint32(msg[1:], uint32(a.Capacity)) // nolint
+
+		_ = status.SetWriteDeadline(time.Now().Add(interval))
+		if _, err := status.Write(msg); err != nil {
+			_ = session.Close()
+			return
+		}
+
+		select {
+		case <-session.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (a *Agent) report(err error) {
+	if a.OnError != nil {
+		a.OnError(err)
+	}
+}
+
+// Rendezvous is the public side of the rendezvous mode: it accepts connections of agents and tunnels
+// sessions of SOCKS5 clients through them. Use its Connect as Options.Connect to spread sessions
+// over all agents, or Egress of named agents (exit nodes) in a Router to route selected users
+// or destinations through them. Unhealthy agents and ones running at capacity are skipped,
+// new sessions fail over to the next agent once one drops.
+//
+// Another proxyme becomes an exit node of the front one by running Agent alongside its own SOCKS5.
+//
+// Example:
+//
+//	rv := &proxyme.Rendezvous{Secret: secret, TLSConfig: tlsConfig}
+//	go rv.ListenAndServe(":7000")
+//	socks5, _ := proxyme.New(proxyme.Options{
+//		Authenticate: auth,
+//		Router: proxyme.StaticRouter{
+//			Users:   map[string]proxyme.Egress{"alice": rv.Egress("office", "home")},
+//			Default: proxyme.Egress{Connect: rv.Connect},
+//		},
+//	})
+type Rendezvous struct {
+	// Secret is the shared secret agents authenticate with, see Agent.Secret.
+	// REQUIRED.
+	Secret string
+
+	// TLSConfig terminates TLS of agent connections, agents dial TLS by default.
+	// REQUIRED by ListenAndServe, Serve uses the listener as is without TLSConfig (e.g. tls.NewListener).
+	TLSConfig *tls.Config
+
+	// KeepAlive is the period of pings detecting lost agents.
+	// OPTIONAL, default 15 seconds.
+	KeepAlive time.Duration
+
+	// OnError if specified, receives rejected and disconnected agents, retried accept errors
+	// (*AcceptError) and recovered panics (*SessionError).
+	// OPTIONAL.
+	OnError func(error)
+
+	mu        sync.Mutex
+	agents    []*rendezvousAgent
+	next      int // round-robin position
+	listeners map[net.Listener]struct{}
+	closed    bool
+}
+
+type rendezvousAgent struct {
+	name     string
+	session  *mux.Session
+	healthy  atomic.Bool
+	capacity atomic.Int64 // 0 means unlimited
+}
+
+// AgentStatus describes the agent connected to Rendezvous.
+type AgentStatus struct {
+	// Name is the name the agent has introduced itself with.
+	Name string
+
+	// Healthy reports the agent is able to serve sessions.
+	Healthy bool
+
+	// Capacity is the maximum number of concurrent sessions, 0 means unlimited.
+	Capacity int
+
+	// Sessions is the number of sessions tunneled through the agent.
+	Sessions int
+}
+
+// ListenAndServe listens on tcp address for agents with TLSConfig, see Serve.
+func (r *Rendezvous) ListenAndServe(address string) error {
+	if r.TLSConfig == nil {
+		return errors.New("rendezvous: TLS config is required")
+	}
+
+	ls, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+
+	return r.Serve(ls)
+}
+
+// Serve accepts agents on the listener until it fails or the rendezvous is closed, temporary
+// accept errors are retried with exponential backoff as Server.Serve does.
+func (r *Rendezvous) Serve(ls net.Listener) error {
+	if r.Secret == "" {
+		return errors.New("rendezvous: secret is required")
+	}
+
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		_ = ls.Close()
+		return net.ErrClosed
+	}
+	if r.listeners == nil {
+		r.listeners = make(map[net.Listener]struct{})
+	}
+	r.listeners[ls] = struct{}{}
+	r.mu.Unlock()
+
+	defer func() {
+		r.mu.Lock()
+		delete(r.listeners, ls)
+		r.mu.Unlock()
+	}()
+	defer ls.Close() // nolint
+
+	var delay time.Duration
+	for {
+		conn, err := ls.Accept()
+		if err != nil {
+			if !temporary(err) {
+				return &AcceptError{Err: err}
+			}
+
+			delay = min(max(2*delay, minAcceptDelay), maxAcceptDelay)
+			r.report(&AcceptError{Temporary: true, Delay: delay, Err: err})
+			time.Sleep(delay)
+
+			continue
+		}
+		delay = 0
+
+		go r.register(conn)
+	}
+}
+
+// register authenticates the agent and keeps it available until it disconnects.
+func (r *Rendezvous) register(conn net.Conn) {
+	defer func() {
+		if p := recover(); p != nil {
+			_ = conn.Close()
+			r.report(&SessionError{Client: conn.RemoteAddr(), Panic: true, Err: fmt.Errorf("%v\n%s", p, debug.Stack())})
+		}
+	}()
+
+	if r.TLSConfig != nil {
+		conn = tls.Server(conn, r.TLSConfig)
+	}
+	_ = conn.SetDeadline(time.Now().Add(upstreamHandshakeTimeout))
+	name, err := r.handshake(conn)
+	if err != nil {
+		_ = conn.Close()
+		r.report(fmt.Errorf("rendezvous: agent %v: %w", conn.RemoteAddr(), err))
+		return
+	}
+
+	agent := &rendezvousAgent{name: name, session: mux.Client(conn)}
+
+	status, err := agent.session.Accept()
+	if err == nil {
+		err = agent.readStatus(status)
+	}
+	if err != nil {
+		_ = agent.session.Close()
+		r.report(fmt.Errorf("rendezvous: agent %s status: %w", name, err))
+		return
+	}
+	_ = conn.SetDeadline(time.Time{})
+
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		_ = agent.session.Close()
+		return
+	}
+	r.agents = append(r.agents, agent)
+	r.mu.Unlock()
+
+	go keepAlive(agent.session, r.KeepAlive)
+	go agent.watchStatus(status)
+	<-agent.session.Done()
+
+	r.mu.Lock()
+	for i, a := range r.agents {
+		if a == agent {
+			r.agents = append(r.agents[:i], r.agents[i+1:]...)
+			break
+		}
+	}
+	r.mu.Unlock()
+
+	r.report(fmt.Errorf("rendezvous: agent %s disconnected: %w", name, agent.session.Err()))
+}
+
+func (r *Rendezvous) handshake(conn net.Conn) (string, error) {
+	magic := make([]byte, len(rendezvousMagic))
+	if _, err := io.ReadFull(conn, magic); err != nil {
+		return "", err
+	}
+	if !bytes.Equal(magic, rendezvousMagic) {
+		return "", errors.New("not an agent")
+	}
+
+	size := make([]byte, 1)
+	if _, err := io.ReadFull(conn, size); err != nil {
+		return "", err
+	}
+	hello := make([]byte, int(size[0])+rendezvousNonceSize)
+	if _, err := io.ReadFull(conn, hello); err != nil {
+		return "", err
+	}
+	name, agentNonce := hello[:size[0]], hello[size[0]:]
+
+	serverNonce := make([]byte, rendezvousNonceSize)
+	if _, err := rand.Read(serverNonce); err != nil {
+		return "", err
+	}
+	challenge := append(serverNonce, rendezvousProof(r.Secret, serverProof, name, agentNonce, serverNonce)...)
+	if _, err := conn.Write(challenge); err != nil {
+		return "", err
+	}
+
+	proof := make([]byte, sha256.Size)
+	if _, err := io.ReadFull(conn, proof); err != nil {
+		return "", err
+	}
+	if !hmac.Equal(proof, rendezvousProof(r.Secret, agentProof, name, agentNonce, serverNonce)) {
+		_, _ = (wire.LoginReply{Status: uint8(denied)}).WriteTo(conn)
+		return "", ErrInvalidCredentials
+	}
+	if _, err := (wire.LoginReply{Status: wire.LoginSucceeded}).WriteTo(conn); err != nil {
+		return "", err
+	}
+
+	return string(name), nil
+}
+
+// rendezvousProof returns HMAC-SHA256 of the handshake by the shared secret on behalf of the role.
+func rendezvousProof(secret, role string, name, agentNonce, serverNonce []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(role))
+	mac.Write([]byte{byte(len(name))})
+	mac.Write(name)
+	mac.Write(agentNonce)
+	mac.Write(serverNonce)
+
+	return mac.Sum(nil)
+}
+
+// Connect tunnels the connection to the destination through a connected agent, agents are used in
+// round-robin order. It returns ErrNoAgents if no agent is available.
+func (r *Rendezvous) Connect(addressType int, addr []byte, port int) (net.Conn, error) {
+	r.mu.Lock()
+	agents := make([]*rendezvousAgent, 0, len(r.agents))
+	for i := range r.agents {
+		agents = append(agents, r.agents[(r.next+i)%len(r.agents)])
+	}
+	r.next++
+	r.mu.Unlock()
+
+	return failover(agents, addressType, addr, port)
+}
+
+// Egress returns egress through the named agents (exit nodes), they are tried in the order
+// of preference: sessions fail over to the next agent while the previous one is disconnected,
+// unhealthy or running at capacity. Several agents may share the name, they are tried in the order
+// of connection. Connect of the egress returns ErrNoAgents if none of the agents is available.
+func (r *Rendezvous) Egress(names ...string) Egress {
+	return Egress{
+		Connect: func(addressType int, addr []byte, port int) (net.Conn, error) {
+			r.mu.Lock()
+			var agents []*rendezvousAgent
+			for _, name := range names {
+				for _, a := range r.agents {
+					if a.name == name {
+						agents = append(agents, a)
+					}
+				}
+			}
+			r.mu.Unlock()
+
+			return failover(agents, addressType, addr, port)
+		},
+	}
+}
+
+// Agents returns connected agents.
+func (r *Rendezvous) Agents() []AgentStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	res := make([]AgentStatus, 0, len(r.agents))
+	for _, a := range r.agents {
+		res = append(res, AgentStatus{
+			Name:     a.name,
+			Healthy:  a.healthy.Load(),
+			Capacity: int(a.capacity.Load()),
+			Sessions: a.sessions(),
+		})
+	}
+
+	return res
+}
+
+// Close closes listeners and disconnects all agents.
+func (r *Rendezvous) Close() error {
+	r.mu.Lock()
+	r.closed = true
+
+	var err error
+	for ls := range r.listeners {
+		err = errors.Join(err, ls.Close())
+	}
+	agents := r.agents
+	r.mu.Unlock()
+
+	for _, a := range agents {
+		_ = a.session.Close()
+	}
+
+	return err
+}
+
+func (r *Rendezvous) report(err error) {
+	if r.OnError != nil {
+		r.OnError(err)
+	}
+}
+
+// failover connects through the first available agent, the next one is tried if the agent drops
+// while connecting.
+func failover(agents []*rendezvousAgent, addressType int, addr []byte, port int) (net.Conn, error) {
+	for _, agent := range agents {
+		if !agent.available() {
+			continue
+		}
+
+		conn, err := agent.connect(addressType, addr, port)
+		if errors.Is(err, errAgentDown) {
+			continue
+		}
+
+		return conn, err
+	}
+
+	return nil, ErrNoAgents
+}
+
+// readStatus reads the status report of the agent.
+func (a *rendezvousAgent) readStatus(status net.Conn) error {
+	msg := make([]byte, agentStatusSize)
+	if _, err := io.ReadFull(status, msg); err != nil {
+		return err
+	}
+
+	a.healthy.Store(msg[0] == 1)
+	a.capacity.Store(int64(binary.BigEndian.Uint32(msg[1:])))
+
+	return nil
+}
+
+// watchStatus reads status reports until the agent disconnects.
+func (a *rendezvousAgent) watchStatus(status net.Conn) {
+	for a.readStatus(status) == nil {
+	}
+
+	_ = a.session.Close()
+}
+
+// available reports the agent is connected, healthy and has spare capacity.
+func (a *rendezvousAgent) available() bool {
+	select {
+	case <-a.session.Done():
+		return false
+	default:
+	}
+
+	capacity := int(a.capacity.Load())
+	return a.healthy.Load() && (capacity == 0 || a.sessions() < capacity)
+}
+
+// sessions returns the number of sessions tunneled through the agent.
+func (a *rendezvousAgent) sessions() int {
+	return max(a.session.NumStreams()-1, 0) // except the status stream
+}
+
+// connect requests the agent to connect to the destination.
+func (a *rendezvousAgent) connect(addressType int, addr []byte, port int) (net.Conn, error) {
+	stream, err := a.session.Open()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errAgentDown, err)
+	}
+
+	_ = stream.SetDeadline(time.Now().Add(upstreamHandshakeTimeout))
+
+	req := wire.CommandRequest{
+		Command: wire.CommandConnect,
+		Address: wire.Address{Type: wire.AddressType(addressType), Addr: addr, Port: uint16(port)}, // nolint
+	}
+	if _, err := req.WriteTo(stream); err != nil {
+		_ = stream.Close()
+		return nil, fmt.Errorf("agent %s: %w: %v", a.name, errAgentDown, err)
+	}
+
+	var reply wire.CommandReply
+	if _, err := reply.ReadFrom(stream); err != nil {
+		_ = stream.Close()
+		if a.session.Err() != nil {
+			err = fmt.Errorf("%w: %v", errAgentDown, err)
+		}
+		return nil, fmt.Errorf("agent %s: %w", a.name, err)
+	}
+	if err := statusError(reply.Status); err != nil {
+		_ = stream.Close()
+		return nil, fmt.Errorf("agent %s: %w", a.name, err)
+	}
+
+	_ = stream.SetDeadline(time.Time{})
+
+	return stream, nil
+}
+
+// keepAlive pings the session every interval and closes it once the peer stops responding.
+func keepAlive(session *mux.Session, interval time.Duration) {
+	if interval <= 0 {
+		interval = defaultKeepAlive
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-session.Done():
+			return
+		case <-ticker.C:
+			if _, err := session.Ping(interval); err != nil {
+				_ = session.Close()
+				return
+			}
+		}
+	}
+}
+
+// zeroAddress is BND.ADDR of failure replies.
+func zeroAddress() wire.Address {
+	return wire.Address{Type: wire.AddressIPv4, Addr: net.IPv4zero.To4()}
+}
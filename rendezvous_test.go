@@ -0,0 +1,342 @@
+package proxyme_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dblokhin/proxyme"
+	"github.com/dblokhin/proxyme/internal/testproxy"
+	"github.com/dblokhin/proxyme/wire"
+)
+
+func TestIntegration_rendezvous(t *testing.T) {
+	echo := testproxy.Echo(t, "127.0.0.1:0")
+
+	serverTLS, clientTLS := testproxy.TLS(t)
+	rv := &proxyme.Rendezvous{Secret: "secret", KeepAlive: time.Second, TLSConfig: serverTLS}
+	ls := testproxy.Listen(t, "tcp", "127.0.0.1:0")
+	go rv.Serve(ls) // nolint
+	t.Cleanup(func() { _ = rv.Close() })
+
+	proxy := testproxy.Start(t, proxyme.Options{AllowNoAuth: true, Connect: rv.Connect})
+
+	// no agents yet
+	if reply, err := proxy.Dial(t).Connect(echo.String()); err != nil || reply.Status != byte(wire.StatusNetworkUnreachable) {
+		t.Fatalf("got reply %v, error %v, want network unreachable", reply, err)
+	}
+
+	// wrong secret is rejected
+	rejected := make(chan error, 1)
+	wrong := &proxyme.Agent{Address: ls.Addr().String(), Name: "intruder", Secret: "wrong", TLSConfig: clientTLS, OnError: func(err error) {
+		select {
+		case rejected <- err:
+		default:
+		}
+	}}
+	ctx, cancel := context.WithCancel(context.Background())
+	wrongDone := make(chan error, 1)
+	go func() { wrongDone <- wrong.Run(ctx) }()
+
+	agentDone := make(chan error, 1)
+	agent := &proxyme.Agent{Address: ls.Addr().String(), Name: "office", Secret: "secret", KeepAlive: time.Second,
+		TLSConfig: clientTLS}
+	go func() { agentDone <- agent.Run(ctx) }()
+
+	deadline := time.Now().Add(testproxy.Timeout)
+	for len(rv.Agents()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if agents := rv.Agents(); len(agents) != 1 || agents[0] != (proxyme.AgentStatus{Name: "office", Healthy: true}) {
+		t.Fatalf("got agents %v, want [office]", agents)
+	}
+
+	client := proxy.Dial(t)
+	reply, err := client.Connect(echo.String())
+	if err != nil || reply.Status != 0 {
+		t.Fatalf("got reply %v, error %v", reply, err)
+	}
+	if err := client.Echo("through the agent"); err != nil {
+		t.Fatalf("echo: %v", err)
+	}
+
+	// destination failures of the agent are replied with the same status
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	refused := closed.Addr().String()
+	_ = closed.Close()
+	if reply, err := proxy.Dial(t).Connect(refused); err != nil || reply.Status != byte(wire.StatusConnectionRefused) {
+		t.Fatalf("got reply %v, error %v, want connection refused", reply, err)
+	}
+
+	select {
+	case err := <-rejected:
+		if !errors.Is(err, proxyme.ErrNotAllowed) {
+			t.Errorf("got agent error %v, want %v", err, proxyme.ErrNotAllowed)
+		}
+	case <-time.After(testproxy.Timeout):
+		t.Errorf("agent with wrong secret isn't rejected")
+	}
+
+	cancel()
+	for _, done := range []chan error{agentDone, wrongDone} {
+		select {
+		case err := <-done:
+			if !errors.Is(err, context.Canceled) {
+				t.Errorf("got Run error %v, want %v", err, context.Canceled)
+			}
+		case <-time.After(testproxy.Timeout):
+			t.Fatalf("agent doesn't stop")
+		}
+	}
+}
+
+func TestIntegration_rendezvousHandshake(t *testing.T) {
+	serverTLS, clientTLS := testproxy.TLS(t)
+
+	t.Run("impostor server", func(t *testing.T) {
+		// the impostor answers at the server address but doesn't know the secret
+		ls := tls.NewListener(testproxy.Listen(t, "tcp", "127.0.0.1:0"), serverTLS)
+		learned := make(chan []byte, 1)
+		go func() {
+			conn, err := ls.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+
+			_ = conn.SetDeadline(time.Now().Add(testproxy.Timeout))
+			hello := make([]byte, len("PXRV\x02")+1+len("office")+32)
+			if _, err := io.ReadFull(conn, hello); err != nil {
+				return
+			}
+			challenge := make([]byte, 64)
+			_, _ = rand.Read(challenge)
+			_, _ = conn.Write(challenge)
+
+			rest, _ := io.ReadAll(conn)
+			learned <- append(hello, rest...)
+		}()
+
+		errs := make(chan error, 1)
+		agent := &proxyme.Agent{Address: ls.Addr().String(), Name: "office", Secret: "secret", TLSConfig: clientTLS,
+			OnError: func(err error) {
+				select {
+				case errs <- err:
+				default:
+				}
+			}}
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go agent.Run(ctx) // nolint
+
+		select {
+		case err := <-errs:
+			if !errors.Is(err, proxyme.ErrNotAllowed) {
+				t.Errorf("got agent error %v, want %v", err, proxyme.ErrNotAllowed)
+			}
+		case <-time.After(testproxy.Timeout):
+			t.Fatalf("agent accepted the impostor")
+		}
+		if got := <-learned; bytes.Contains(got, []byte("secret")) || len(got) != len("PXRV\x02")+1+len("office")+32 {
+			t.Errorf("impostor got %q, want the hello only", got)
+		}
+	})
+
+	t.Run("forged agent proof", func(t *testing.T) {
+		rejected := make(chan error, 1)
+		rv := &proxyme.Rendezvous{Secret: "secret", TLSConfig: serverTLS, OnError: func(err error) {
+			select {
+			case rejected <- err:
+			default:
+			}
+		}}
+		ls := testproxy.Listen(t, "tcp", "127.0.0.1:0")
+		go rv.Serve(ls) // nolint
+		t.Cleanup(func() { _ = rv.Close() })
+
+		conn, err := tls.Dial("tcp", ls.Addr().String(), clientTLS)
+		if err != nil {
+			t.Fatalf("dial: %v", err)
+		}
+		defer conn.Close()
+		_ = conn.SetDeadline(time.Now().Add(testproxy.Timeout))
+
+		hello := append([]byte("PXRV\x02\x08intruder"), make([]byte, 32)...)
+		if _, err := conn.Write(hello); err != nil {
+			t.Fatalf("write hello: %v", err)
+		}
+		if _, err := io.ReadFull(conn, make([]byte, 64)); err != nil {
+			t.Fatalf("read challenge: %v", err)
+		}
+		if _, err := conn.Write(make([]byte, 32)); err != nil {
+			t.Fatalf("write proof: %v", err)
+		}
+
+		var reply wire.LoginReply
+		if _, err := reply.ReadFrom(conn); err != nil || reply.Status == wire.LoginSucceeded {
+			t.Fatalf("got reply %v, error %v, want rejection", reply, err)
+		}
+		if err := <-rejected; !errors.Is(err, proxyme.ErrInvalidCredentials) {
+			t.Errorf("got rendezvous error %v, want %v", err, proxyme.ErrInvalidCredentials)
+		}
+		if agents := rv.Agents(); len(agents) != 0 {
+			t.Errorf("got agents %v, want none", agents)
+		}
+	})
+}
+
+func TestIntegration_rendezvousExits(t *testing.T) {
+	echo := testproxy.Echo(t, "127.0.0.1:0")
+
+	serverTLS, clientTLS := testproxy.TLS(t)
+	rv := &proxyme.Rendezvous{Secret: "secret", TLSConfig: serverTLS}
+	ls := testproxy.Listen(t, "tcp", "127.0.0.1:0")
+	go rv.Serve(ls) // nolint
+	t.Cleanup(func() { _ = rv.Close() })
+
+	// exits tag connections with their names
+	used := make(chan string, 16)
+	var officeDown atomic.Bool
+	startExit := func(ctx context.Context, name string, capacity int, health func() error) {
+		agent := &proxyme.Agent{
+			Address:   ls.Addr().String(),
+			Name:      name,
+			Secret:    "secret",
+			TLSConfig: clientTLS,
+			Capacity:  capacity,
+			Health:    health,
+			KeepAlive: 20 * time.Millisecond,
+			Connect: func(addressType int, addr []byte, port int) (net.Conn, error) {
+				used <- name
+				return net.Dial("tcp", echo.String())
+			},
+		}
+		go agent.Run(ctx) // nolint
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	officeCtx, dropOffice := context.WithCancel(ctx)
+	startExit(officeCtx, "office", 0, func() error {
+		if officeDown.Load() {
+			return errors.New("uplink is down")
+		}
+		return nil
+	})
+	startExit(ctx, "home", 1, nil)
+
+	waitAgents := func(want func([]proxyme.AgentStatus) bool) {
+		t.Helper()
+
+		deadline := time.Now().Add(testproxy.Timeout)
+		for !want(rv.Agents()) {
+			if time.Now().After(deadline) {
+				t.Fatalf("got agents %v", rv.Agents())
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	healthy := func(n int) func([]proxyme.AgentStatus) bool {
+		return func(agents []proxyme.AgentStatus) bool {
+			var count int
+			for _, a := range agents {
+				if a.Healthy {
+					count++
+				}
+			}
+			return count == n
+		}
+	}
+	waitAgents(healthy(2))
+
+	proxy := testproxy.Start(t, proxyme.Options{
+		Authenticate: proxyme.StaticCredentials(map[string]string{"alice": "pass", "bob": "pass"}),
+		Router: proxyme.StaticRouter{
+			Users:   map[string]proxyme.Egress{"alice": rv.Egress("office", "home")},
+			Default: proxyme.Egress{Connect: failConnect},
+		},
+	})
+
+	// connect returns the client of the session and the name of the exit it went through
+	connect := func(username string, wantStatus byte) (*testproxy.Client, string) {
+		t.Helper()
+
+		client := proxy.Dial(t)
+		if _, err := client.Greet(2); err != nil {
+			t.Fatalf("greet: %v", err)
+		}
+		if status, err := client.Login(username, "pass"); err != nil || status != 0 {
+			t.Fatalf("login: %d, %v", status, err)
+		}
+		host, port, _ := net.SplitHostPort(echo.String())
+		portNum, _ := strconv.Atoi(port)
+		if err := client.Request(1, host, portNum); err != nil {
+			t.Fatalf("request: %v", err)
+		}
+		reply, err := client.Reply()
+		if err != nil || reply.Status != wantStatus {
+			t.Fatalf("got reply %v, error %v, want status %d", reply, err, wantStatus)
+		}
+		if wantStatus != 0 {
+			return client, ""
+		}
+
+		return client, <-used
+	}
+
+	if _, exit := connect("alice", 0); exit != "office" {
+		t.Fatalf("got exit %q, want the preferred one", exit)
+	}
+	if _, exit := connect("bob", byte(wire.StatusNotAllowed)); exit != "" {
+		t.Fatalf("bob isn't routed through exits, got %q", exit)
+	}
+
+	// unhealthy exit is skipped
+	officeDown.Store(true)
+	waitAgents(healthy(1))
+	client, exit := connect("alice", 0)
+	if exit != "home" {
+		t.Fatalf("got exit %q, want failover to home", exit)
+	}
+
+	// home runs at capacity
+	waitAgents(func(agents []proxyme.AgentStatus) bool {
+		for _, a := range agents {
+			if a.Name == "home" {
+				return a.Sessions == 1 && a.Capacity == 1
+			}
+		}
+		return false
+	})
+	connect("alice", byte(wire.StatusNetworkUnreachable))
+	if err := client.Echo("still tunneled"); err != nil {
+		t.Fatalf("echo: %v", err)
+	}
+	_ = client.Close()
+
+	// dropped exit
+	officeDown.Store(false)
+	waitAgents(healthy(2))
+	dropOffice()
+	waitAgents(func(agents []proxyme.AgentStatus) bool {
+		return len(agents) == 1 && agents[0].Name == "home" && agents[0].Sessions == 0
+	})
+	if _, exit := connect("alice", 0); exit != "home" {
+		t.Fatalf("got exit %q, want failover to home", exit)
+	}
+}
+
+func failConnect(addressType int, addr []byte, port int) (net.Conn, error) {
+	return nil, proxyme.ErrNotAllowed
+}
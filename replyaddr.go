@@ -0,0 +1,70 @@
+package proxyme
+
+import "net"
+
+// ReplyAddress selects BND.ADDR and BND.PORT of CONNECT replies. Some clients abort on the reply
+// address of another family than the one they reached the proxy with, e.g. IPv4 local address
+// of the upstream connection replied to the client connected over IPv6.
+type ReplyAddress int
+
+const (
+	// ReplyLocalAddr replies the local address of the upstream connection as is.
+	ReplyLocalAddr ReplyAddress = iota
+
+	// ReplyTranslatedAddr replies the local address of the upstream connection translated to
+	// the family of the client connection: IPv4 address goes to IPv6 clients as IPv4-mapped one.
+	// IPv6 addresses can't be translated for IPv4 clients, they get zero address instead.
+	ReplyTranslatedAddr
+
+	// ReplyAdvertisedAddr replies the address of Options.AdvertisedAddrs of the client family
+	// along with the local port of the upstream connection. The local address is translated
+	// if none of advertised addresses is of the client family.
+	ReplyAdvertisedAddr
+
+	// ReplyZeroAddr replies zero address of the client family and zero port.
+	ReplyZeroAddr
+)
+
+// replyAddress returns BND.ADDR and BND.PORT of the upstream connection with the local address
+// for the client. Unknown client address keeps the local address as is.
+func replyAddress(mode ReplyAddress, advertised []net.IP, client net.IP, local net.Addr) (addressType, net.IP, int, error) {
+	typ, ip, port, err := parseAddress(local)
+	if err != nil || mode == ReplyLocalAddr || client == nil {
+		return typ, ip, port, err
+	}
+
+	client4 := client.To4() != nil
+	switch mode {
+	case ReplyZeroAddr:
+		typ, ip = familyAddr(nil, client4)
+		return typ, ip, 0, nil
+	case ReplyAdvertisedAddr:
+		for _, a := range advertised {
+			if (a.To4() != nil) == client4 {
+				typ, ip = familyAddr(a, client4)
+				return typ, ip, port, nil
+			}
+		}
+	}
+
+	if ip4 := ip.To4(); ip4 != nil || client4 {
+		typ, ip = familyAddr(ip4, client4)
+	}
+
+	return typ, ip, port, nil
+}
+
+// familyAddr returns the address (nil means zero address) in the given family, IPv4 addresses
+// are IPv4-mapped for IPv6 family.
+func familyAddr(ip net.IP, v4 bool) (addressType, net.IP) {
+	switch {
+	case v4 && ip != nil:
+		return ipv4, ip.To4()
+	case v4:
+		return ipv4, net.IPv4zero.To4()
+	case ip != nil:
+		return ipv6, ip.To16()
+	default:
+		return ipv6, net.IPv6zero
+	}
+}
@@ -0,0 +1,53 @@
+package proxyme
+
+import (
+	"net"
+	"testing"
+)
+
+func Test_replyAddress(t *testing.T) {
+	local4 := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 5000}
+	local6 := &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 5000}
+	client4 := net.IPv4(198, 51, 100, 1)
+	client6 := net.ParseIP("2001:db8::2")
+	advertised := []net.IP{net.IPv4(203, 0, 113, 1).To4(), net.ParseIP("2001:db8::100")}
+
+	tests := []struct {
+		name       string
+		mode       ReplyAddress
+		advertised []net.IP
+		client     net.IP
+		local      net.Addr
+		wantType   addressType
+		wantIP     string
+		wantPort   int
+	}{
+		{name: "local", mode: ReplyLocalAddr, client: client6, local: local4, wantType: ipv4, wantIP: "192.0.2.1", wantPort: 5000},
+		{name: "unknown client", mode: ReplyZeroAddr, local: local4, wantType: ipv4, wantIP: "192.0.2.1", wantPort: 5000},
+		{name: "translated same family", mode: ReplyTranslatedAddr, client: client4, local: local4, wantType: ipv4, wantIP: "192.0.2.1", wantPort: 5000},
+		{name: "translated to ipv6", mode: ReplyTranslatedAddr, client: client6, local: local4, wantType: ipv6, wantIP: "::ffff:192.0.2.1", wantPort: 5000},
+		{name: "untranslatable ipv6", mode: ReplyTranslatedAddr, client: client4, local: local6, wantType: ipv4, wantIP: "0.0.0.0", wantPort: 5000},
+		{name: "ipv6 for ipv6 client", mode: ReplyTranslatedAddr, client: client6, local: local6, wantType: ipv6, wantIP: "2001:db8::1", wantPort: 5000},
+		{name: "advertised ipv4", mode: ReplyAdvertisedAddr, advertised: advertised, client: client4, local: local6, wantType: ipv4, wantIP: "203.0.113.1", wantPort: 5000},
+		{name: "advertised ipv6", mode: ReplyAdvertisedAddr, advertised: advertised, client: client6, local: local4, wantType: ipv6, wantIP: "2001:db8::100", wantPort: 5000},
+		{name: "advertised missing family", mode: ReplyAdvertisedAddr, advertised: advertised[:1], client: client6, local: local4, wantType: ipv6, wantIP: "::ffff:192.0.2.1", wantPort: 5000},
+		{name: "zero ipv4", mode: ReplyZeroAddr, client: client4, local: local6, wantType: ipv4, wantIP: "0.0.0.0", wantPort: 0},
+		{name: "zero ipv6", mode: ReplyZeroAddr, client: client6, local: local4, wantType: ipv6, wantIP: "::", wantPort: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			typ, ip, port, err := replyAddress(tt.mode, tt.advertised, tt.client, tt.local)
+			if err != nil {
+				t.Fatalf("replyAddress() error = %v", err)
+			}
+
+			wantLen := net.IPv4len
+			if tt.wantType == ipv6 {
+				wantLen = net.IPv6len
+			}
+			if typ != tt.wantType || len(ip) != wantLen || !ip.Equal(net.ParseIP(tt.wantIP)) || port != tt.wantPort {
+				t.Errorf("replyAddress() = %d %v %d, want %d %s %d", typ, ip, port, tt.wantType, tt.wantIP, tt.wantPort)
+			}
+		})
+	}
+}
@@ -0,0 +1,202 @@
+package proxyme
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/dblokhin/proxyme/lru"
+)
+
+// defaultResolveCacheSize is the default number of domain names kept by the resolver cache.
+const defaultResolveCacheSize = 4096
+
+// resolver resolves domain name destinations for rule checks. Static hosts entries take precedence,
+// concurrent lookups of the same name are coalesced, answers are cached if the cache is enabled.
+type resolver struct {
+	hosts  map[string][]net.IP // static entries by normalized name
+	lookup func(host string) ([]net.IP, error)
+	ttl    time.Duration // answers are fresh for ttl
+	stale  time.Duration // and served stale while refreshing for another stale duration
+	cache  *lru.Cache[string, answer]
+
+	mu      sync.Mutex
+	flights map[string]*flight // lookups in progress
+}
+
+type answer struct {
+	ips     []net.IP
+	fetched time.Time
+}
+
+type flight struct {
+	done chan struct{}
+	ips  []net.IP
+	err  error
+}
+
+// newResolver returns resolver using lookup or the system resolver if lookup is nil. Zero ttl disables
+// the cache.
+func newResolver(lookup func(host string) ([]net.IP, error), ttl, stale time.Duration, size int) *resolver {
+	if lookup == nil {
+		lookup = func(host string) ([]net.IP, error) {
+			return net.DefaultResolver.LookupIP(context.Background(), "ip", host)
+		}
+	}
+
+	r := &resolver{
+		lookup:  lookup,
+		flights: make(map[string]*flight),
+	}
+
+	if ttl > 0 {
+		if size <= 0 {
+			size = defaultResolveCacheSize
+		}
+
+		r.ttl, r.stale = ttl, max(stale, 0)
+		r.cache = lru.New(lru.Options[string, answer]{Size: size, TTL: r.ttl + r.stale})
+	}
+
+	return r
+}
+
+// resolve returns addresses of the host, lookup failures are reported as ErrHostUnreachable.
+// Stale answers are returned at once while the name is refreshed in background. The addresses
+// are the caller's copy, answers are shared by the cache and concurrent lookups.
+func (r *resolver) resolve(host string) ([]net.IP, error) {
+	if ips, ok := r.pinned(host); ok {
+		return cloneIPs(ips), nil
+	}
+
+	if r.cache != nil {
+		if a, ok := r.cache.Get(host); ok {
+			if time.Since(a.fetched) >= r.ttl {
+				r.refresh(host)
+			}
+			return cloneIPs(a.ips), nil
+		}
+	}
+
+	ips, err := r.do(host)
+	if err != nil {
+		return nil, fmt.Errorf("%w: resolve %s: %v", ErrHostUnreachable, host, err)
+	}
+
+	return cloneIPs(ips), nil
+}
+
+// refresh looks the host up in background unless the lookup is in progress already, so hits
+// of a popular stale name don't spawn a goroutine each.
+func (r *resolver) refresh(host string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.flights[host]; ok {
+		return
+	}
+
+	f := &flight{done: make(chan struct{})}
+	r.flights[host] = f
+	go r.fly(host, f) // refresh failures keep the stale answer
+}
+
+// do looks the host up joining the lookup in progress if any.
+func (r *resolver) do(host string) ([]net.IP, error) {
+	r.mu.Lock()
+	if f, ok := r.flights[host]; ok {
+		r.mu.Unlock()
+
+		<-f.done
+		return f.ips, f.err
+	}
+
+	f := &flight{done: make(chan struct{})}
+	r.flights[host] = f
+	r.mu.Unlock()
+
+	r.fly(host, f)
+
+	return f.ips, f.err
+}
+
+// fly looks the host up for the registered flight and lands it, successful answers are cached.
+func (r *resolver) fly(host string, f *flight) {
+	f.ips, f.err = r.lookup(host)
+	if f.err == nil && len(f.ips) == 0 {
+		f.err = fmt.Errorf("no addresses")
+	}
+	if f.err == nil && r.cache != nil {
+		r.cache.Set(host, answer{ips: f.ips, fetched: time.Now()})
+	}
+
+	r.mu.Lock()
+	delete(r.flights, host)
+	r.mu.Unlock()
+	close(f.done)
+}
+
+// cloneIPs returns a deep copy of the addresses.
+func cloneIPs(ips []net.IP) []net.IP {
+	res := make([]net.IP, len(ips))
+	for i, ip := range ips {
+		res[i] = slices.Clone(ip)
+	}
+
+	return res
+}
+
+// pinned returns addresses of the host from static hosts entries.
+func (r *resolver) pinned(host string) ([]net.IP, bool) {
+	if len(r.hosts) == 0 {
+		return nil, false
+	}
+
+	ips, ok := r.hosts[normalizeName(host)]
+	return ips, ok
+}
+
+// isPinned reports whether the domain name has static hosts entries.
+func (r *resolver) isPinned(name []byte) bool {
+	if r == nil || len(r.hosts) == 0 {
+		return false
+	}
+
+	_, ok := r.pinned(string(name))
+	return ok
+}
+
+// parseHosts validates static hosts entries (see Options.Hosts) and returns them by normalized name.
+func parseHosts(hosts map[string][]net.IP) (map[string][]net.IP, error) {
+	if len(hosts) == 0 {
+		return nil, nil
+	}
+
+	res := make(map[string][]net.IP, len(hosts))
+	for name, ips := range hosts {
+		host := normalizeName(name)
+		if host == "" || net.ParseIP(host) != nil || !validName(host) {
+			return nil, fmt.Errorf("invalid host name %q", name)
+		}
+		if _, ok := res[host]; ok {
+			return nil, fmt.Errorf("duplicate host name %q", name)
+		}
+		if len(ips) == 0 {
+			return nil, fmt.Errorf("no addresses of host %q", name)
+		}
+
+		addrs := make([]net.IP, 0, len(ips))
+		for _, ip := range ips {
+			if len(ip) != net.IPv4len && len(ip) != net.IPv6len {
+				return nil, fmt.Errorf("invalid address %v of host %q", ip, name)
+			}
+			addrs = append(addrs, slices.Clone(ip))
+		}
+		res[host] = addrs
+	}
+
+	return res, nil
+}
@@ -0,0 +1,229 @@
+package proxyme
+
+import (
+	"errors"
+	"net"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingLookup returns lookup answering addresses of n-th call.
+func countingLookup(calls *atomic.Int32, release <-chan struct{}) func(host string) ([]net.IP, error) {
+	return func(host string) ([]net.IP, error) {
+		n := calls.Add(1)
+		if release != nil {
+			<-release
+		}
+		if host == "fail.test" {
+			return nil, errors.New("nxdomain")
+		}
+		return []net.IP{net.IPv4(192, 0, 2, byte(n))}, nil
+	}
+}
+
+func Test_resolver_singleflight(t *testing.T) {
+	var calls atomic.Int32
+	release := make(chan struct{})
+	r := newResolver(countingLookup(&calls, release), 0, 0, 0)
+
+	var wg sync.WaitGroup
+	results := make(chan net.IP, 10)
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ips, err := r.resolve("example.test")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			results <- ips[0]
+		}()
+	}
+
+	// let the lookups pile up
+	for calls.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	close(results)
+
+	if n := calls.Load(); n != 1 {
+		t.Errorf("got %d lookups, want 1", n)
+	}
+	for ip := range results {
+		if !ip.Equal(net.IPv4(192, 0, 2, 1)) {
+			t.Errorf("got %v, want the answer of the single lookup", ip)
+		}
+	}
+}
+
+func Test_resolver_cache(t *testing.T) {
+	tests := []struct {
+		name      string
+		ttl       time.Duration
+		stale     time.Duration
+		host      string
+		wait      time.Duration // between the lookups
+		wantIP    byte          // last octet of the second answer
+		wantCalls int32         // eventually
+		wantErr   bool
+	}{
+		{name: "disabled", host: "example.test", wantIP: 2, wantCalls: 2},
+		{name: "fresh", ttl: time.Hour, host: "example.test", wantIP: 1, wantCalls: 1},
+		{name: "stale served while refreshing", ttl: 20 * time.Millisecond, stale: time.Hour, host: "example.test", wait: 40 * time.Millisecond, wantIP: 1, wantCalls: 2},
+		{name: "expired", ttl: 20 * time.Millisecond, host: "example.test", wait: 40 * time.Millisecond, wantIP: 2, wantCalls: 2},
+		{name: "failures aren't cached", ttl: time.Hour, host: "fail.test", wantCalls: 2, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls atomic.Int32
+			r := newResolver(countingLookup(&calls, nil), tt.ttl, tt.stale, 0)
+
+			_, _ = r.resolve(tt.host)
+			time.Sleep(tt.wait)
+
+			ips, err := r.resolve(tt.host)
+			if tt.wantErr {
+				if !errors.Is(err, ErrHostUnreachable) {
+					t.Errorf("got error %v, want %v", err, ErrHostUnreachable)
+				}
+			} else if err != nil || !ips[0].Equal(net.IPv4(192, 0, 2, tt.wantIP)) {
+				t.Errorf("got %v, %v, want answer %d", ips, err, tt.wantIP)
+			}
+
+			deadline := time.Now().Add(5 * time.Second)
+			for calls.Load() != tt.wantCalls {
+				if time.Now().After(deadline) {
+					t.Fatalf("got %d lookups, want %d", calls.Load(), tt.wantCalls)
+				}
+				time.Sleep(time.Millisecond)
+			}
+
+			if tt.stale > 0 {
+				// the refreshed answer replaces the stale one
+				deadline := time.Now().Add(5 * time.Second)
+				for {
+					ips, _ := r.resolve(tt.host)
+					if ips[0].Equal(net.IPv4(192, 0, 2, 2)) {
+						break
+					}
+					if time.Now().After(deadline) {
+						t.Fatalf("got %v, want refreshed answer", ips)
+					}
+					time.Sleep(time.Millisecond)
+				}
+			}
+		})
+	}
+}
+
+func Test_resolver_staleRefresh(t *testing.T) {
+	var calls atomic.Int32
+	release := make(chan struct{})
+	r := newResolver(countingLookup(&calls, release), time.Second, time.Hour, 0)
+	stale := net.IPv4(192, 0, 2, 100)
+	r.cache.Set("example.test", answer{ips: []net.IP{net.IPv4(192, 0, 2, 100)}, fetched: time.Now().Add(-time.Minute)})
+
+	before := runtime.NumGoroutine()
+	for range 100 {
+		ips, err := r.resolve("example.test")
+		if err != nil || !ips[0].Equal(stale) {
+			t.Fatalf("got %v, %v, want the stale answer", ips, err)
+		}
+		// answers are copies
+		ips[0][0] = 0
+	}
+	if n := runtime.NumGoroutine() - before; n > 1 {
+		t.Errorf("got %d goroutines refreshing the name, want 1", n)
+	}
+	close(release)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		ips, _ := r.resolve("example.test")
+		if ips[0].Equal(net.IPv4(192, 0, 2, 1)) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got %v, want refreshed answer", ips)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if n := calls.Load(); n != 1 {
+		t.Errorf("got %d lookups, want 1", n)
+	}
+}
+
+func Test_resolver_hosts(t *testing.T) {
+	hosts, err := parseHosts(map[string][]net.IP{
+		"Internal.Test.": {net.IPv4(10, 0, 0, 1)},
+	})
+	if err != nil {
+		t.Fatalf("parseHosts() error = %v", err)
+	}
+
+	var calls atomic.Int32
+	r := newResolver(countingLookup(&calls, nil), time.Minute, 0, 0)
+	r.hosts = hosts
+
+	tests := []struct {
+		name      string
+		host      string
+		want      net.IP
+		wantCalls int32
+	}{
+		{name: "pinned", host: "internal.test", want: net.IPv4(10, 0, 0, 1), wantCalls: 0},
+		{name: "pinned case-insensitive", host: "INTERNAL.test.", want: net.IPv4(10, 0, 0, 1), wantCalls: 0},
+		{name: "subdomain isn't pinned", host: "www.internal.test", want: net.IPv4(192, 0, 2, 1), wantCalls: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ips, err := r.resolve(tt.host)
+			if err != nil {
+				t.Fatalf("resolve() error = %v", err)
+			}
+			if len(ips) != 1 || !ips[0].Equal(tt.want) {
+				t.Errorf("got %v, want %v", ips, tt.want)
+			}
+			if n := calls.Load(); n != tt.wantCalls {
+				t.Errorf("got %d lookups, want %d", n, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func Test_parseHosts(t *testing.T) {
+	tests := []struct {
+		name    string
+		hosts   map[string][]net.IP
+		wantErr bool
+	}{
+		{name: "nil", hosts: nil},
+		{name: "valid", hosts: map[string][]net.IP{"db.internal": {net.IPv4(10, 0, 0, 1), net.ParseIP("fd00::1")}}},
+		{name: "no addresses", hosts: map[string][]net.IP{"db.internal": nil}, wantErr: true},
+		{name: "invalid address", hosts: map[string][]net.IP{"db.internal": {net.IP{10, 0}}}, wantErr: true},
+		{name: "ip as name", hosts: map[string][]net.IP{"10.0.0.1": {net.IPv4(10, 0, 0, 1)}}, wantErr: true},
+		{name: "wildcard", hosts: map[string][]net.IP{"*.internal": {net.IPv4(10, 0, 0, 1)}}, wantErr: true},
+		{
+			name: "duplicate",
+			hosts: map[string][]net.IP{
+				"db.internal": {net.IPv4(10, 0, 0, 1)},
+				"DB.internal": {net.IPv4(10, 0, 0, 2)},
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := parseHosts(tt.hosts); (err != nil) != tt.wantErr {
+				t.Errorf("parseHosts() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,75 @@
+package proxyme
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+)
+
+// StaticRewrite returns RewriteDestination callback rewriting destinations according to the aliases map.
+// Keys are either "host:port" matching exact destination or "host" matching any port, the former takes
+// precedence. Values are "host:port" replacing both host and port or "host" keeping requested port.
+// Hosts are domain names or IP addresses. Destinations not found in the map are kept as is.
+// It returns error if any alias value is malformed.
+//
+//	rewrite, err := StaticRewrite(map[string]string{
+//	    "legacy.example.com":  "new.example.com", // any port
+//	    "db.example.com:5432": "10.0.0.5:6432",   // specific port
+//	})
+func StaticRewrite(aliases map[string]string) (func(addressType int, addr []byte, port int) (int, []byte, int, error), error) {
+	type target struct {
+		addressType int
+		addr        []byte
+		port        int // 0 means requested port
+	}
+
+	table := make(map[string]target, len(aliases))
+	for from, to := range aliases {
+		host, portStr, err := net.SplitHostPort(to)
+		if err != nil {
+			// no port specified
+			host, portStr = to, ""
+		}
+
+		port := 0
+		if portStr != "" {
+			if port, err = strconv.Atoi(portStr); err != nil || port <= 0 || port > 1<<16-1 {
+				return nil, fmt.Errorf("invalid alias %q port: %q", to, portStr)
+			}
+		}
+
+		if host == "" || len(host) > maxDomainSize {
+			return nil, fmt.Errorf("invalid alias %q host", to)
+		}
+
+		t := target{addressType: int(domainName), addr: []byte(host), port: port}
+		if ip := net.ParseIP(host); ip != nil {
+			t.addressType, t.addr = int(ipv6), ip.To16()
+			if ip4 := ip.To4(); ip4 != nil {
+				t.addressType, t.addr = int(ipv4), ip4
+			}
+		}
+
+		table[from] = t
+	}
+
+	return func(addressType int, addr []byte, port int) (int, []byte, int, error) {
+		host := string(addr)
+		if addressType != int(domainName) {
+			host = net.IP(addr).String()
+		}
+
+		t, ok := table[net.JoinHostPort(host, strconv.Itoa(port))]
+		if !ok {
+			if t, ok = table[host]; !ok {
+				return addressType, addr, port, nil
+			}
+		}
+
+		if t.port != 0 {
+			port = t.port
+		}
+
+		return t.addressType, t.addr, port, nil
+	}, nil
+}
@@ -0,0 +1,79 @@
+package proxyme
+
+import (
+	"net"
+	"testing"
+)
+
+func TestStaticRewrite(t *testing.T) {
+	rewrite, err := StaticRewrite(map[string]string{
+		"legacy.example.com":  "new.example.com",
+		"db.example.com:5432": "10.0.0.5:6432",
+		"10.0.0.1":            "[2001:db8::1]:8080",
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	type dst struct {
+		addressType int
+		addr        string
+		port        int
+	}
+	tests := []struct {
+		name string
+		from dst
+		want dst
+	}{
+		{
+			name: "host alias keeps port",
+			from: dst{int(domainName), "legacy.example.com", 443},
+			want: dst{int(domainName), "new.example.com", 443},
+		},
+		{
+			name: "exact host and port",
+			from: dst{int(domainName), "db.example.com", 5432},
+			want: dst{int(ipv4), string(net.ParseIP("10.0.0.5").To4()), 6432},
+		},
+		{
+			name: "other port is not rewritten",
+			from: dst{int(domainName), "db.example.com", 5433},
+			want: dst{int(domainName), "db.example.com", 5433},
+		},
+		{
+			name: "ip to ipv6",
+			from: dst{int(ipv4), string(net.ParseIP("10.0.0.1").To4()), 80},
+			want: dst{int(ipv6), string(net.ParseIP("2001:db8::1")), 8080},
+		},
+		{
+			name: "unknown",
+			from: dst{int(domainName), "example.com", 80},
+			want: dst{int(domainName), "example.com", 80},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addressType, addr, port, err := rewrite(tt.from.addressType, []byte(tt.from.addr), tt.from.port)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			got := dst{addressType, string(addr), port}
+			if got != tt.want {
+				t.Errorf("rewrite() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStaticRewrite_invalid(t *testing.T) {
+	tests := []map[string]string{
+		{"example.com": "new.example.com:http"},
+		{"example.com": "new.example.com:0"},
+		{"example.com": ":80"},
+	}
+	for _, aliases := range tests {
+		if _, err := StaticRewrite(aliases); err == nil {
+			t.Errorf("StaticRewrite(%v) expected error but got nil", aliases)
+		}
+	}
+}
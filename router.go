@@ -0,0 +1,112 @@
+package proxyme
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Egress is the way the session leaves the proxy to the destination.
+// Zero Egress connects with Options.Connect.
+type Egress struct {
+	// LocalIP is source address of connections to destinations (one of the proxy host addresses),
+	// such connections are made by the built-in dialer.
+	LocalIP net.IP
+
+	// Connect if specified, connects to destinations instead, e.g. through an upstream proxy
+	// (see UpstreamSOCKS5). It takes precedence over LocalIP. Domain names are passed as is
+	// even if Options.Rules resolved them.
+	Connect func(addressType int, addr []byte, port int) (net.Conn, error)
+}
+
+// Router selects egress of the session, see Options.Router.
+type Router interface {
+	// Route returns egress of the session, returned error rejects the command.
+	Route(info SessionInfo) (Egress, error)
+}
+
+// NetworkRoute is egress of clients from the network.
+type NetworkRoute struct {
+	Network *net.IPNet
+	Egress  Egress
+}
+
+// StaticRouter is map based Router: routes of authenticated usernames take precedence over
+// routes of destination hosts, then of client networks (the first matching network wins),
+// other sessions go to Default.
+//
+// Destinations are keyed by the host of the requested destination: IP address or domain name,
+// the domain name route also matches its subdomains.
+type StaticRouter struct {
+	Users        map[string]Egress
+	Destinations map[string]Egress
+	Networks     []NetworkRoute
+	Default      Egress
+}
+
+func (r StaticRouter) Route(info SessionInfo) (Egress, error) {
+	if egress, ok := r.Users[info.Username]; ok && info.Username != "" {
+		return egress, nil
+	}
+
+	if egress, ok := r.destination(info); ok {
+		return egress, nil
+	}
+
+	if ip := addrIP(info.ClientAddr); ip != nil {
+		for _, route := range r.Networks {
+			if route.Network.Contains(ip) {
+				return route.Egress, nil
+			}
+		}
+	}
+
+	return r.Default, nil
+}
+
+// destination returns egress of the destination host or its closest parent domain.
+func (r StaticRouter) destination(info SessionInfo) (Egress, bool) {
+	if len(r.Destinations) == 0 || len(info.Addr) == 0 {
+		return Egress{}, false
+	}
+
+	if info.AddressType != int(domainName) {
+		egress, ok := r.Destinations[net.IP(info.Addr).String()]
+		return egress, ok
+	}
+
+	host := normalizeName(string(info.Addr))
+	for {
+		if egress, ok := r.Destinations[host]; ok {
+			return egress, true
+		}
+
+		_, parent, found := strings.Cut(host, ".")
+		if !found {
+			return Egress{}, false
+		}
+		host = parent
+	}
+}
+
+// route returns connect callback of the session egress, custom is false for the built-in dialer.
+func route(state *state) (connect func(addressType int, addr []byte, port int) (net.Conn, error), custom bool, err error) {
+	egress, err := state.opts.router.Route(state.info())
+	if err != nil {
+		var ruleErr *RuleError
+		if !errors.As(err, &ruleErr) && !errors.Is(err, ErrNotAllowed) {
+			err = fmt.Errorf("%w: route: %v", ErrNotAllowed, err)
+		}
+		return nil, false, err
+	}
+
+	switch {
+	case egress.Connect != nil:
+		return egress.Connect, true, nil
+	case egress.LocalIP != nil:
+		return defaultConnect(state.opts.timeout, egress.LocalIP, state.opts.control), false, nil
+	}
+
+	return state.opts.connect, state.opts.custom, nil
+}
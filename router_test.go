@@ -0,0 +1,140 @@
+package proxyme
+
+import (
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestStaticRouter_Route(t *testing.T) {
+	_, office, _ := net.ParseCIDR("10.1.0.0/16")
+
+	alice := Egress{LocalIP: net.IPv4(192, 0, 2, 1)}
+	officeEgress := Egress{LocalIP: net.IPv4(192, 0, 2, 2)}
+	direct := Egress{}
+
+	bank := Egress{LocalIP: net.IPv4(192, 0, 2, 3)}
+
+	router := StaticRouter{
+		Users:        map[string]Egress{"alice": alice, "": alice},
+		Destinations: map[string]Egress{"bank.example": bank, "203.0.113.1": bank},
+		Networks:     []NetworkRoute{{Network: office, Egress: officeEgress}},
+		Default:      direct,
+	}
+
+	tests := []struct {
+		name string
+		info SessionInfo
+		want Egress
+	}{
+		{
+			name: "user route",
+			info: SessionInfo{Username: "alice", ClientAddr: &net.TCPAddr{IP: net.IPv4(10, 1, 0, 1)}},
+			want: alice,
+		},
+		{
+			name: "destination route",
+			info: SessionInfo{Username: "bob", AddressType: int(domainName), Addr: []byte("bank.example")},
+			want: bank,
+		},
+		{
+			name: "destination route of subdomain",
+			info: SessionInfo{AddressType: int(domainName), Addr: []byte("WWW.Bank.Example.")},
+			want: bank,
+		},
+		{
+			name: "destination route of ip",
+			info: SessionInfo{AddressType: int(ipv4), Addr: net.IPv4(203, 0, 113, 1).To4()},
+			want: bank,
+		},
+		{
+			name: "user route over destination route",
+			info: SessionInfo{Username: "alice", AddressType: int(domainName), Addr: []byte("bank.example")},
+			want: alice,
+		},
+		{
+			name: "network route",
+			info: SessionInfo{Username: "bob", ClientAddr: &net.TCPAddr{IP: net.IPv4(10, 1, 0, 1)}},
+			want: officeEgress,
+		},
+		{
+			name: "anonymous client isn't routed as empty username",
+			info: SessionInfo{ClientAddr: &net.TCPAddr{IP: net.IPv4(10, 2, 0, 1)}},
+			want: direct,
+		},
+		{
+			name: "unknown client address",
+			info: SessionInfo{},
+			want: direct,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := router.Route(tt.info)
+			if err != nil {
+				t.Fatalf("Route() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Route() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+type routerFunc func(info SessionInfo) (Egress, error)
+
+func (f routerFunc) Route(info SessionInfo) (Egress, error) {
+	return f(info)
+}
+
+func Test_route(t *testing.T) {
+	upstream := errors.New("upstream connect")
+	connectErr := errors.New("options connect")
+
+	tests := []struct {
+		name    string
+		route   func(info SessionInfo) (Egress, error)
+		wantErr error // error of the returned connect or route error
+	}{
+		{
+			name:    "egress connect",
+			route:   func(info SessionInfo) (Egress, error) { return Egress{Connect: failConnect(upstream)}, nil },
+			wantErr: upstream,
+		},
+		{
+			name:    "direct",
+			route:   func(info SessionInfo) (Egress, error) { return Egress{}, nil },
+			wantErr: connectErr,
+		},
+		{
+			name:    "route error",
+			route:   func(info SessionInfo) (Egress, error) { return Egress{}, errors.New("no route") },
+			wantErr: ErrNotAllowed,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &state{
+				opts: SOCKS5{
+					router:  routerFunc(tt.route),
+					connect: failConnect(connectErr),
+				},
+			}
+
+			connect, _, err := route(s)
+			if err == nil {
+				_, err = connect(int(ipv4), []byte{1, 2, 3, 4}, 80)
+			}
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("route() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func failConnect(err error) func(addressType int, addr []byte, port int) (net.Conn, error) {
+	return func(addressType int, addr []byte, port int) (net.Conn, error) {
+		return nil, err
+	}
+}
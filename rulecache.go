@@ -0,0 +1,91 @@
+package proxyme
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dblokhin/proxyme/lru"
+)
+
+// defaultRulesCacheSize is the default number of verdicts kept by CachedRules.
+const defaultRulesCacheSize = 4096
+
+// CachedRules caches verdicts of rules per identity (username and client IP) and destination, so
+// complex rulesets (large CIDR lists, regexps, remote policy services) aren't evaluated for every
+// connection of chatty clients. Use its Check method as Options.Rules:
+//
+//	rules := &proxyme.CachedRules{Rules: policy.Check, TTL: 10 * time.Second}
+//	opts := proxyme.Options{Rules: rules.Check}
+//
+// Keep TTL short: changes of the rules, resolved addresses of the destination and schedules take
+// effect after TTL.
+type CachedRules struct {
+	// Rules checks the session on cache miss.
+	// REQUIRED.
+	Rules func(info SessionInfo) error
+
+	// TTL is how long verdicts are cached.
+	// REQUIRED.
+	TTL time.Duration
+
+	// Size limits the number of cached verdicts.
+	// OPTIONAL, default 4096.
+	Size int
+
+	once   sync.Once
+	cache  *lru.Cache[rulesKey, error] // nil error is allowing verdict
+	hits   atomic.Uint64
+	misses atomic.Uint64
+}
+
+// Check returns cached verdict of the session or checks it with Rules.
+func (c *CachedRules) Check(info SessionInfo) error {
+	c.once.Do(func() {
+		size := c.Size
+		if size <= 0 {
+			size = defaultRulesCacheSize
+		}
+		c.cache = lru.New(lru.Options[rulesKey, error]{Size: size, TTL: c.TTL})
+	})
+
+	key := newRulesKey(info)
+	if err, ok := c.cache.Get(key); ok {
+		c.hits.Add(1)
+		return err
+	}
+	c.misses.Add(1)
+
+	err := c.Rules(info)
+	if c.TTL > 0 {
+		c.cache.Set(key, err)
+	}
+
+	return err
+}
+
+// Stats returns hit/miss counters of the cache.
+func (c *CachedRules) Stats() CacheStats {
+	return CacheStats{Hits: c.hits.Load(), Misses: c.misses.Load()}
+}
+
+// rulesKey is the session identity, command and destination.
+type rulesKey struct {
+	username    string
+	client      string // client IP
+	command     int
+	destination string
+}
+
+func newRulesKey(info SessionInfo) rulesKey {
+	key := rulesKey{
+		username:    info.Username,
+		command:     info.Command,
+		destination: info.Destination(),
+	}
+	if ip := addrIP(info.ClientAddr); ip != nil {
+		key.client = ip.String()
+	}
+
+	return key
+}
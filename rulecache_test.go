@@ -0,0 +1,79 @@
+package proxyme
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestCachedRules_Check(t *testing.T) {
+	denied := &RuleError{Rule: "deny smtp"}
+
+	calls := 0
+	c := &CachedRules{
+		Rules: func(info SessionInfo) error {
+			calls++
+			if info.Port == 25 {
+				return denied
+			}
+			return nil
+		},
+		TTL: time.Minute,
+	}
+
+	session := func(user, client string, port int) SessionInfo {
+		return SessionInfo{
+			ClientAddr:  &net.TCPAddr{IP: net.ParseIP(client), Port: 40000 + calls},
+			Username:    user,
+			Command:     int(connect),
+			AddressType: int(domainName),
+			Addr:        []byte("mail.example.com"),
+			Port:        port,
+		}
+	}
+
+	tests := []struct {
+		name      string
+		info      SessionInfo
+		wantErr   error
+		wantCalls int
+	}{
+		{name: "miss", info: session("alice", "192.0.2.1", 443), wantCalls: 1},
+		{name: "hit from another port of the client", info: session("alice", "192.0.2.1", 443), wantCalls: 1},
+		{name: "another user", info: session("bob", "192.0.2.1", 443), wantCalls: 2},
+		{name: "another client", info: session("alice", "192.0.2.2", 443), wantCalls: 3},
+		{name: "deny miss", info: session("alice", "192.0.2.1", 25), wantErr: denied, wantCalls: 4},
+		{name: "deny hit", info: session("alice", "192.0.2.1", 25), wantErr: denied, wantCalls: 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := c.Check(tt.info); !errors.Is(err, tt.wantErr) {
+				t.Errorf("Check() error = %v, want %v", err, tt.wantErr)
+			}
+			if calls != tt.wantCalls {
+				t.Errorf("got %d calls of the rules, want %d", calls, tt.wantCalls)
+			}
+		})
+	}
+
+	if got, want := c.Stats(), (CacheStats{Hits: 2, Misses: 4}); got != want {
+		t.Errorf("Stats() = %+v, want %+v", got, want)
+	}
+}
+
+func TestCachedRules_expired(t *testing.T) {
+	calls := 0
+	c := &CachedRules{
+		Rules: func(SessionInfo) error { calls++; return nil },
+		TTL:   time.Nanosecond,
+	}
+
+	for range 3 {
+		_ = c.Check(SessionInfo{AddressType: int(ipv4), Addr: net.IPv4(203, 0, 113, 1).To4(), Port: 443})
+		time.Sleep(time.Millisecond)
+	}
+	if calls != 3 {
+		t.Errorf("got %d calls of the rules, want 3", calls)
+	}
+}
@@ -0,0 +1,257 @@
+package proxyme
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/dblokhin/proxyme/wire"
+)
+
+// checkRules resolves domain name destination and checks it against the rules.
+// It returns destinations to connect to: resolved ips or the destination itself.
+// Names pinned by Options.Hosts are resolved even without rules.
+func checkRules(state *state, addrType int, addr []byte, port int) ([]destination, error) {
+	if err := checkPort(state, port); err != nil {
+		return nil, err
+	}
+
+	dst := append(state.dstBuf[:0], destination{addrType: addrType, addr: addr, port: port})
+	domain := addressType(addrType) == domainName //nolint
+	if state.opts.rules == nil && (!domain || !state.opts.resolver.isPinned(addr)) {
+		return dst, nil
+	}
+
+	if domain {
+		ips, err := state.opts.resolver.resolve(string(addr))
+		if err != nil {
+			return nil, err
+		}
+
+		// connect to the checked ips, not to the name that may resolve differently next time
+		dst = dst[:0]
+		for _, ip := range ips {
+			typ, ipAddr := ipv6, ip.To16()
+			if ip4 := ip.To4(); ip4 != nil {
+				typ, ipAddr = ipv4, ip4
+			}
+			dst = append(dst, destination{addrType: int(typ), addr: ipAddr, port: port})
+		}
+		state.resolved = ips
+	}
+	if state.opts.rules == nil {
+		return dst, nil
+	}
+
+	// rules check the destination to connect to, that is the rewritten one
+	info := state.info()
+	info.AddressType, info.Addr, info.Port = addrType, addr, port
+	if err := enforceRules(state, info); err != nil {
+		return nil, err
+	}
+
+	return dst, nil
+}
+
+// enforceRules checks the destination of info against the rules. Violations are counted, in dry-run
+// mode they are reported to OnRuleViolation instead of being returned.
+func enforceRules(state *state, info SessionInfo) error {
+	err := state.opts.rules(info)
+	if err == nil {
+		return nil
+	}
+
+	var ruleErr *RuleError
+	if !errors.As(err, &ruleErr) && !errors.Is(err, ErrNotAllowed) {
+		err = fmt.Errorf("%w: %v", ErrNotAllowed, err)
+	}
+
+	var rule string
+	if ruleErr != nil {
+		rule = ruleErr.Rule
+	}
+	state.opts.ruleCounts.hit(rule, state.opts.rulesDryRun)
+
+	if !state.opts.rulesDryRun {
+		return err
+	}
+	if state.opts.onRuleViolation != nil {
+		state.opts.onRuleViolation(info, err)
+	}
+
+	return nil
+}
+
+// portsRule identifies violations of Options.AllowedPorts and Options.DeniedPorts in rule counters.
+const portsRule = "ports"
+
+// portPolicy is Options.AllowedPorts and Options.DeniedPorts.
+type portPolicy struct {
+	allowed map[int]struct{} // nil means any port is allowed
+	denied  map[int]struct{}
+}
+
+// newPortPolicy returns the policy of the ports, nil if any port is allowed.
+func newPortPolicy(allowed, denied []int) *portPolicy {
+	if len(allowed) == 0 && len(denied) == 0 {
+		return nil
+	}
+
+	set := func(ports []int) map[int]struct{} {
+		if len(ports) == 0 {
+			return nil
+		}
+		m := make(map[int]struct{}, len(ports))
+		for _, p := range ports {
+			m[p] = struct{}{}
+		}
+		return m
+	}
+
+	return &portPolicy{allowed: set(allowed), denied: set(denied)}
+}
+
+// permits reports whether the destination port is allowed.
+func (p *portPolicy) permits(port int) bool {
+	if p == nil {
+		return true
+	}
+	if _, ok := p.denied[port]; ok {
+		return false
+	}
+	if p.allowed == nil {
+		return true
+	}
+	_, ok := p.allowed[port]
+
+	return ok
+}
+
+// checkPort checks the destination port against Options.AllowedPorts and Options.DeniedPorts,
+// rejections are counted as violations of portsRule.
+func checkPort(state *state, port int) error {
+	if state.opts.ports.permits(port) {
+		return nil
+	}
+	state.opts.ruleCounts.hit(portsRule, false)
+
+	return &RuleError{Status: wire.StatusNotAllowed, Reason: fmt.Sprintf("port %d isn't allowed", port), Rule: portsRule}
+}
+
+// ChainRules returns Options.Rules checking the session against the rules in order, the first
+// error rejects the command. Nil rules are skipped.
+func ChainRules(rules ...func(info SessionInfo) error) func(info SessionInfo) error {
+	return func(info SessionInfo) error {
+		for _, check := range rules {
+			if check == nil {
+				continue
+			}
+			if err := check(info); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+}
+
+// ruleCounts counts commands rejected by the rules.
+type ruleCounts struct {
+	denied  atomic.Int64 // rejected commands
+	audited atomic.Int64 // violations of dry-run rules
+
+	mu   sync.Mutex
+	hits map[string]int64 // violations by RuleError.Rule
+}
+
+// hit counts the violation of the rule, empty rule isn't counted per rule.
+func (c *ruleCounts) hit(rule string, dryRun bool) {
+	if c == nil {
+		return
+	}
+
+	if dryRun {
+		c.audited.Add(1)
+	} else {
+		c.denied.Add(1)
+	}
+
+	if rule == "" {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.hits == nil {
+		c.hits = make(map[string]int64)
+	}
+	c.hits[rule]++
+}
+
+// RuleViolations returns numbers of commands rejected by Rules and of violations let through
+// in dry-run mode (see Options.RulesDryRun).
+func (s SOCKS5) RuleViolations() (denied, audited int64) {
+	if s.ruleCounts == nil {
+		return 0, 0
+	}
+
+	return s.ruleCounts.denied.Load(), s.ruleCounts.audited.Load()
+}
+
+// RuleHits returns numbers of violations (denied or audited) per rule identified by RuleError.Rule.
+func (s SOCKS5) RuleHits() map[string]int64 {
+	res := make(map[string]int64)
+	if s.ruleCounts == nil {
+		return res
+	}
+
+	s.ruleCounts.mu.Lock()
+	defer s.ruleCounts.mu.Unlock()
+
+	for rule, n := range s.ruleCounts.hits {
+		res[rule] = n
+	}
+
+	return res
+}
+
+// destination is connect destination in terms of Connect arguments.
+type destination struct {
+	addrType int
+	addr     []byte
+	port     int
+}
+
+// RuleError rejects the command with the specific reply status. Return it from Options.Rules
+// (or Options.Connect) to make blocked destinations look like network failures.
+type RuleError struct {
+	// Status is the reply status, e.g. wire.StatusHostUnreachable.
+	// Zero (succeeded) status is replied as wire.StatusNotAllowed.
+	Status wire.Status
+
+	// Reason is human-readable reason of the rejection, it's not sent to the client
+	// but is included in the reported error.
+	Reason string
+
+	// Rule if specified, identifies the violated rule for per-rule hit counters (see SOCKS5.RuleHits).
+	Rule string
+}
+
+func (e *RuleError) Error() string {
+	if e.Reason == "" {
+		return "rule: " + e.status().String()
+	}
+
+	return "rule: " + e.status().String() + ": " + e.Reason
+}
+
+// status returns reply status of the rejection.
+func (e *RuleError) status() wire.Status {
+	if e.Status == wire.StatusSucceeded {
+		return wire.StatusNotAllowed
+	}
+
+	return e.Status
+}
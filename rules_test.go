@@ -0,0 +1,432 @@
+package proxyme
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/dblokhin/proxyme/wire"
+)
+
+func Test_checkRules(t *testing.T) {
+	internal := net.IPv4(10, 0, 0, 1)
+	public := net.ParseIP("2001:db8::1")
+
+	lookup := func(host string) ([]net.IP, error) {
+		switch host {
+		case "internal.example":
+			return []net.IP{internal}, nil
+		case "public.example":
+			return []net.IP{public, internal.To4()}, nil
+		}
+		return nil, errors.New("no such host")
+	}
+
+	// denies private networks by ip
+	denyPrivate := func(info SessionInfo) error {
+		for _, ip := range info.ResolvedIPs {
+			if ip.IsPrivate() {
+				return fmt.Errorf("private address %v", ip)
+			}
+		}
+		return nil
+	}
+
+	tests := []struct {
+		name     string
+		rules    func(info SessionInfo) error
+		addrType addressType
+		addr     []byte
+		want     []destination
+		wantIPs  []net.IP
+		wantErr  error
+	}{
+		{
+			name:     "no rules: domain as is",
+			addrType: domainName,
+			addr:     []byte("internal.example"),
+			want:     []destination{{addrType: int(domainName), addr: []byte("internal.example"), port: 80}},
+		},
+		{
+			name:     "domain resolved for rules",
+			rules:    func(info SessionInfo) error { return nil },
+			addrType: domainName,
+			addr:     []byte("public.example"),
+			want: []destination{
+				{addrType: int(ipv6), addr: public.To16(), port: 80},
+				{addrType: int(ipv4), addr: internal.To4(), port: 80},
+			},
+			wantIPs: []net.IP{public, internal.To4()},
+		},
+		{
+			name:     "domain denied by ip",
+			rules:    denyPrivate,
+			addrType: domainName,
+			addr:     []byte("internal.example"),
+			wantErr:  ErrNotAllowed,
+		},
+		{
+			name:     "ip destination is not resolved",
+			rules:    denyPrivate,
+			addrType: ipv4,
+			addr:     internal.To4(),
+			want:     []destination{{addrType: int(ipv4), addr: internal.To4(), port: 80}},
+		},
+		{
+			name:     "resolve failure",
+			rules:    denyPrivate,
+			addrType: domainName,
+			addr:     []byte("unknown.example"),
+			wantErr:  ErrHostUnreachable,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &state{
+				opts: SOCKS5{rules: tt.rules, resolver: newResolver(lookup, 0, 0, 0)},
+			}
+
+			got, err := checkRules(s, int(tt.addrType), tt.addr, 80)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("checkRules() error = %v, want %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("checkRules() = %v, want %v", got, tt.want)
+			}
+			if tt.wantErr == nil && !reflect.DeepEqual(s.resolved, tt.wantIPs) {
+				t.Fatalf("resolved = %v, want %v", s.resolved, tt.wantIPs)
+			}
+		})
+	}
+}
+
+func Test_checkDestination(t *testing.T) {
+	resolved := net.IPv4(10, 0, 0, 1).To4()
+	pinned := net.IPv4(10, 0, 0, 2).To4()
+	lookup := func(host string) ([]net.IP, error) { return []net.IP{resolved}, nil }
+	byName := []destination{{addrType: int(domainName), addr: []byte("example.com"), port: 80}}
+
+	tests := []struct {
+		name   string
+		custom bool
+		router Router
+		addr   string
+		want   []destination
+	}{
+		{
+			name: "built-in dialer gets checked ips",
+			addr: "example.com",
+			want: []destination{{addrType: int(ipv4), addr: resolved, port: 80}},
+		},
+		{
+			name:   "custom connect gets the name",
+			custom: true,
+			addr:   "example.com",
+			want:   byName,
+		},
+		{
+			name: "egress connect gets the name",
+			router: routerFunc(func(info SessionInfo) (Egress, error) {
+				return Egress{Connect: failConnect(ErrHostUnreachable)}, nil
+			}),
+			addr: "example.com",
+			want: byName,
+		},
+		{
+			name:   "pinned name is dialed by the addresses",
+			custom: true,
+			addr:   "pinned.example",
+			want:   []destination{{addrType: int(ipv4), addr: pinned, port: 80}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newResolver(lookup, 0, 0, 0)
+			r.hosts = map[string][]net.IP{"pinned.example": {pinned}}
+			s := &state{
+				opts: SOCKS5{
+					rules:    func(info SessionInfo) error { return nil },
+					resolver: r,
+					connect:  failConnect(ErrHostUnreachable),
+					custom:   tt.custom,
+					router:   tt.router,
+				},
+				command: commandRequest{commandType: connect, addressType: domainName, addr: []byte(tt.addr), port: 80},
+			}
+
+			_, got, err := checkDestination(s)
+			if err != nil {
+				t.Fatalf("checkDestination() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("checkDestination() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_checkDestination_rewrite(t *testing.T) {
+	lookup := func(host string) ([]net.IP, error) {
+		if host == "new.example" {
+			return []net.IP{net.IPv4(10, 0, 0, 2)}, nil
+		}
+		return []net.IP{net.IPv4(192, 0, 2, 1)}, nil
+	}
+	rewrite, err := StaticRewrite(map[string]string{
+		"legacy.example:80": "10.0.0.1:8080",
+		"old.example:80":    "new.example:80",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		addr     string
+		wantType addressType
+		wantAddr []byte
+		wantPort int
+		wantIPs  []net.IP
+	}{
+		{
+			name:     "rewritten to ip",
+			addr:     "legacy.example",
+			wantType: ipv4,
+			wantAddr: net.IPv4(10, 0, 0, 1).To4(),
+			wantPort: 8080,
+		},
+		{
+			name:     "rewritten to other name",
+			addr:     "old.example",
+			wantType: domainName,
+			wantAddr: []byte("new.example"),
+			wantPort: 80,
+			wantIPs:  []net.IP{net.IPv4(10, 0, 0, 2)},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got SessionInfo
+			s := &state{
+				opts: SOCKS5{
+					rules: func(info SessionInfo) error {
+						got = info
+						return nil
+					},
+					rewrite:  rewrite,
+					resolver: newResolver(lookup, 0, 0, 0),
+					connect:  failConnect(ErrHostUnreachable),
+				},
+				command: commandRequest{commandType: connect, addressType: domainName, addr: []byte(tt.addr), port: 80},
+			}
+
+			if _, _, err := checkDestination(s); err != nil {
+				t.Fatalf("checkDestination() error = %v", err)
+			}
+			if got.AddressType != int(tt.wantType) || !bytes.Equal(got.Addr, tt.wantAddr) || got.Port != tt.wantPort {
+				t.Errorf("rules got %d %v:%d, want %d %v:%d", got.AddressType, got.Addr, got.Port,
+					tt.wantType, tt.wantAddr, tt.wantPort)
+			}
+			if !reflect.DeepEqual(got.ResolvedIPs, tt.wantIPs) {
+				t.Errorf("rules got resolved ips %v, want %v", got.ResolvedIPs, tt.wantIPs)
+			}
+		})
+	}
+}
+
+func Test_checkPort(t *testing.T) {
+	tests := []struct {
+		name    string
+		allowed []int
+		denied  []int
+		port    int
+		wantErr bool
+	}{
+		{name: "no policy", port: 25},
+		{name: "allowed", allowed: []int{80, 443}, port: 443},
+		{name: "not allowed", allowed: []int{80, 443}, port: 25, wantErr: true},
+		{name: "denied", denied: []int{25}, port: 25, wantErr: true},
+		{name: "not denied", denied: []int{25}, port: 80},
+		{name: "denied takes precedence", allowed: []int{25, 80}, denied: []int{25}, port: 25, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &state{
+				opts: SOCKS5{ports: newPortPolicy(tt.allowed, tt.denied), ruleCounts: &ruleCounts{}},
+			}
+
+			err := checkPort(s, tt.port)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("checkPort() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil {
+				return
+			}
+
+			var ruleErr *RuleError
+			if !errors.As(err, &ruleErr) || ruleErr.status() != wire.StatusNotAllowed {
+				t.Errorf("checkPort() error = %v, want not allowed rule error", err)
+			}
+			if hits := s.opts.ruleCounts.hits[portsRule]; hits != 1 {
+				t.Errorf("got %d hits of %q, want 1", hits, portsRule)
+			}
+		})
+	}
+}
+
+func Test_dial_ruleError(t *testing.T) {
+	tests := []struct {
+		name       string
+		err        error
+		wantStatus commandStatus
+	}{
+		{
+			name:       "plain error",
+			err:        errors.New("blocked"),
+			wantStatus: notAllowed,
+		},
+		{
+			name:       "disguised as host unreachable",
+			err:        &RuleError{Status: wire.StatusHostUnreachable, Reason: "blocked"},
+			wantStatus: hostUnreachable,
+		},
+		{
+			name:       "wrapped connection refused",
+			err:        fmt.Errorf("tenant policy: %w", &RuleError{Status: wire.StatusConnectionRefused}),
+			wantStatus: connectionRefused,
+		},
+		{
+			name:       "zero status",
+			err:        &RuleError{Reason: "blocked"},
+			wantStatus: notAllowed,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &state{
+				opts: SOCKS5{
+					rules: func(info SessionInfo) error { return tt.err },
+					connect: func(addressType int, addr []byte, port int) (net.Conn, error) {
+						return nil, errors.New("must not connect")
+					},
+				},
+				command: commandRequest{commandType: connect, addressType: ipv4, addr: []byte{1, 2, 3, 4}, port: 80},
+			}
+
+			if _, err := dial(s); err == nil {
+				t.Fatalf("dial() expected error")
+			}
+			if s.status != tt.wantStatus {
+				t.Fatalf("dial() status = %d, want %d", s.status, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestRuleError_Error(t *testing.T) {
+	err := &RuleError{Status: wire.StatusHostUnreachable, Reason: "internal network"}
+	if got, want := err.Error(), "rule: host unreachable: internal network"; got != want {
+		t.Errorf("Error() = %q, want %q", got, want)
+	}
+}
+
+func Test_checkRules_dryRun(t *testing.T) {
+	smtp := &RuleError{Reason: "no mail", Rule: "smtp"}
+
+	tests := []struct {
+		name        string
+		dryRun      bool
+		err         error
+		wantErr     error
+		wantDenied  int64
+		wantAudited int64
+		wantHits    map[string]int64
+		wantReports int
+	}{
+		{
+			name:       "enforced",
+			err:        smtp,
+			wantErr:    ErrNotAllowed,
+			wantDenied: 1,
+			wantHits:   map[string]int64{"smtp": 1},
+		},
+		{
+			name:        "audited",
+			dryRun:      true,
+			err:         smtp,
+			wantAudited: 1,
+			wantHits:    map[string]int64{"smtp": 1},
+			wantReports: 1,
+		},
+		{
+			name:        "unnamed rule isn't counted per rule",
+			dryRun:      true,
+			err:         errors.New("blocked"),
+			wantAudited: 1,
+			wantHits:    map[string]int64{},
+			wantReports: 1,
+		},
+		{
+			name:     "allowed",
+			dryRun:   true,
+			wantHits: map[string]int64{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var reports int
+			s := &state{
+				opts: SOCKS5{
+					rules:       func(info SessionInfo) error { return tt.err },
+					rulesDryRun: tt.dryRun,
+					onRuleViolation: func(info SessionInfo, err error) {
+						if err == nil {
+							t.Errorf("reported nil error")
+						}
+						reports++
+					},
+					ruleCounts: &ruleCounts{},
+				},
+			}
+
+			_, err := checkRules(s, int(ipv4), []byte{1, 2, 3, 4}, 25)
+			if tt.wantErr == nil && err != nil || tt.wantErr != nil && err == nil {
+				t.Fatalf("checkRules() error = %v, want %v", err, tt.wantErr)
+			}
+
+			denied, audited := s.opts.RuleViolations()
+			if denied != tt.wantDenied || audited != tt.wantAudited {
+				t.Errorf("RuleViolations() = %d, %d, want %d, %d", denied, audited, tt.wantDenied, tt.wantAudited)
+			}
+			if hits := s.opts.RuleHits(); !reflect.DeepEqual(hits, tt.wantHits) {
+				t.Errorf("RuleHits() = %v, want %v", hits, tt.wantHits)
+			}
+			if reports != tt.wantReports {
+				t.Errorf("got %d reported violations, want %d", reports, tt.wantReports)
+			}
+		})
+	}
+}
+
+func TestChainRules(t *testing.T) {
+	denied := errors.New("denied")
+
+	var calls []string
+	rule := func(name string, err error) func(SessionInfo) error {
+		return func(SessionInfo) error {
+			calls = append(calls, name)
+			return err
+		}
+	}
+
+	err := ChainRules(rule("first", nil), nil, rule("second", denied), rule("third", nil))(SessionInfo{})
+	if !errors.Is(err, denied) {
+		t.Errorf("ChainRules() error = %v, want %v", err, denied)
+	}
+	if !reflect.DeepEqual(calls, []string{"first", "second"}) {
+		t.Errorf("got calls %v, want the rules till the first error", calls)
+	}
+}
@@ -0,0 +1,385 @@
+package proxyme
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// RulesFile is allow/deny rules of CONNECT destinations loaded from a file, use its Check
+// as Options.Rules. Rules are swapped atomically on Reload, sessions being checked at the moment
+// see either the old or the new rules, so rules change without restarting the proxy.
+//
+// Every line of the file is a rule: action allow or deny followed by conditions key=value.
+// The first rule whose all conditions match the session decides, sessions not matching any rule
+// are allowed. Values of the condition are comma-separated alternatives:
+//
+//	net     destination IP address or CIDR, resolved addresses of domain names are checked too
+//	domain  destination domain name, it also matches subdomains
+//	port    destination port or range of ports (from-to)
+//	user    authenticated username
+//	day     day of week (mon, tue, ...) or range of days (mon-fri) of the local clock
+//	time    time of day range (HH:MM-HH:MM) of the local clock, ranges like 22:00-06:00 wrap over midnight
+//
+// Allow rules may limit sessions they match with duration=<time.Duration>. Use Deadline
+// as Options.SessionDeadline to terminate sessions when the time range of their allow rule is over
+// or the duration has passed.
+//
+// Lines starting with # are comments. The rule without conditions matches all sessions, so
+// a trailing "deny" turns the file into allow list. Example:
+//
+//	# internal networks are for admins only
+//	allow user=admin net=10.0.0.0/8,192.168.0.0/16
+//	deny net=10.0.0.0/8,192.168.0.0/16
+//	deny port=25,465,587
+//	deny domain=example.com
+//	# kids are online on weekdays after school for an hour per session
+//	allow user=kid day=mon-fri time=15:00-20:00 duration=1h
+//	deny user=kid
+type RulesFile struct {
+	path  string
+	rules atomic.Pointer[[]fileRule]
+	now   func() time.Time // clock of schedules, time.Now if nil
+
+	mu     sync.Mutex // serializes reloading
+	loaded os.FileInfo
+}
+
+// fileRule is the rule of the file.
+type fileRule struct {
+	line    int
+	allow   bool
+	nets    []*net.IPNet
+	domains []string
+	ports   [][2]int
+	users   []string
+	days    []time.Weekday
+	times   []timeRange
+
+	duration time.Duration // max duration of allowed sessions, 0 means unlimited
+}
+
+// LoadRules loads rules from the file.
+func LoadRules(path string) (*RulesFile, error) {
+	f := &RulesFile{path: path}
+	if err := f.Reload(); err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// Reload re-reads the file and swaps the rules. On failure the current rules are kept.
+func (f *RulesFile) Reload() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.reload()
+}
+
+func (f *RulesFile) reload() error {
+	fi, err := os.Stat(f.path)
+	if err != nil {
+		return fmt.Errorf("rules: %w", err)
+	}
+
+	data, err := os.ReadFile(f.path)
+	if err != nil {
+		return fmt.Errorf("rules: %w", err)
+	}
+
+	rules, err := parseRules(data)
+	if err != nil {
+		return fmt.Errorf("rules: %s: %w", f.path, err)
+	}
+
+	f.rules.Store(&rules)
+	f.loaded = fi
+
+	return nil
+}
+
+// reloadChanged reloads the file if it has been changed (replaced, written or removed) since
+// the last load, so bursts of file system events make a single reload.
+func (f *RulesFile) reloadChanged() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	fi, err := os.Stat(f.path)
+	if err == nil && f.loaded != nil && os.SameFile(fi, f.loaded) &&
+		fi.Size() == f.loaded.Size() && fi.ModTime().Equal(f.loaded.ModTime()) {
+		return nil
+	}
+
+	return f.reload()
+}
+
+// Watch reloads the rules once the file changes until the context is done, failed reloads keep
+// the current rules and are reported to onError. Changes are watched with inotify on Linux
+// (the directory is watched, so files replaced by rename or symlink swap are picked up),
+// the file is polled on other platforms.
+func (f *RulesFile) Watch(ctx context.Context, onError func(error)) error {
+	return watchFile(ctx, f.path, func() {
+		if err := f.reloadChanged(); err != nil && onError != nil {
+			onError(err)
+		}
+	})
+}
+
+// Check returns *RuleError if the session is denied by the rules, RuleError.Rule is the file
+// name and the line of the rule.
+func (f *RulesFile) Check(info SessionInfo) error {
+	rule, ok := f.find(info, f.clock())
+	if !ok || rule.allow {
+		return nil
+	}
+
+	return &RuleError{
+		Reason: fmt.Sprintf("%s:%d", f.path, rule.line),
+		Rule:   fmt.Sprintf("%s:%d", filepath.Base(f.path), rule.line),
+	}
+}
+
+// Deadline returns the time the session allowed by the rules is terminated at: the end of
+// the time range or the duration of its allow rule from now, whichever comes first. Zero time
+// means no limit. The session denied by the rules (e.g. checked right before the time range is
+// over) gets the current time.
+func (f *RulesFile) Deadline(info SessionInfo) time.Time {
+	now := f.clock()
+
+	rule, ok := f.find(info, now)
+	switch {
+	case !ok:
+		return time.Time{}
+	case !rule.allow:
+		return now
+	}
+
+	var deadline time.Time
+	if rule.duration > 0 {
+		deadline = now.Add(rule.duration)
+	}
+	for _, r := range rule.times {
+		if end, ok := r.end(now); ok && (deadline.IsZero() || end.Before(deadline)) {
+			deadline = end
+			break
+		}
+	}
+
+	return deadline
+}
+
+// find returns the first rule matching the session at the moment.
+func (f *RulesFile) find(info SessionInfo, now time.Time) (fileRule, bool) {
+	for _, rule := range *f.rules.Load() {
+		if rule.match(info, now) {
+			return rule, true
+		}
+	}
+
+	return fileRule{}, false
+}
+
+func (f *RulesFile) clock() time.Time {
+	if f.now != nil {
+		return f.now()
+	}
+
+	return time.Now()
+}
+
+// match reports whether all conditions of the rule match the session at the moment.
+func (r fileRule) match(info SessionInfo, now time.Time) bool {
+	if len(r.days) > 0 && !slices.Contains(r.days, now.Weekday()) {
+		return false
+	}
+
+	if len(r.times) > 0 && !slices.ContainsFunc(r.times, func(t timeRange) bool {
+		_, ok := t.end(now)
+		return ok
+	}) {
+		return false
+	}
+
+	if len(r.users) > 0 && (info.Username == "" || !slices.Contains(r.users, info.Username)) {
+		return false
+	}
+
+	if len(r.ports) > 0 {
+		var ok bool
+		for _, p := range r.ports {
+			ok = ok || (info.Port >= p[0] && info.Port <= p[1])
+		}
+		if !ok {
+			return false
+		}
+	}
+
+	if len(r.domains) > 0 {
+		if info.AddressType != int(domainName) || !matchDomain(r.domains, string(info.Addr)) {
+			return false
+		}
+	}
+
+	if len(r.nets) > 0 {
+		ips := info.ResolvedIPs
+		if info.AddressType != int(domainName) {
+			ips = []net.IP{info.Addr}
+		}
+
+		var ok bool
+		for _, ip := range ips {
+			for _, n := range r.nets {
+				ok = ok || n.Contains(ip)
+			}
+		}
+		if !ok {
+			return false
+		}
+	}
+
+	return true
+}
+
+// matchDomain reports whether the name is one of the domains or their subdomain.
+func matchDomain(domains []string, name string) bool {
+	name = normalizeName(name)
+	for _, d := range domains {
+		if name == d || strings.HasSuffix(name, "."+d) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// parseRules parses rules of the file.
+func parseRules(data []byte) ([]fileRule, error) {
+	var rules []fileRule
+
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; sc.Scan(); line++ {
+		fields := strings.Fields(sc.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+
+		rule, err := parseRule(fields)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		rule.line = line
+		rules = append(rules, rule)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+
+	return rules, nil
+}
+
+func parseRule(fields []string) (fileRule, error) {
+	var rule fileRule
+
+	switch fields[0] {
+	case "allow":
+		rule.allow = true
+	case "deny":
+	default:
+		return rule, fmt.Errorf("unknown action %q", fields[0])
+	}
+
+	for _, cond := range fields[1:] {
+		key, value, ok := strings.Cut(cond, "=")
+		if !ok || value == "" {
+			return rule, fmt.Errorf("invalid condition %q", cond)
+		}
+
+		for _, v := range strings.Split(value, ",") {
+			if err := rule.add(key, v); err != nil {
+				return rule, err
+			}
+		}
+	}
+	if rule.duration > 0 && !rule.allow {
+		return rule, errors.New("duration of deny rule")
+	}
+
+	return rule, nil
+}
+
+// add adds the value to the condition of the rule.
+func (r *fileRule) add(key, value string) error {
+	switch key {
+	case "net":
+		if !strings.Contains(value, "/") {
+			ip := net.ParseIP(value)
+			if ip == nil {
+				return fmt.Errorf("invalid ip %q", value)
+			}
+			if ip4 := ip.To4(); ip4 != nil {
+				ip = ip4
+			}
+			r.nets = append(r.nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)})
+			return nil
+		}
+
+		_, n, err := net.ParseCIDR(value)
+		if err != nil {
+			return err
+		}
+		r.nets = append(r.nets, n)
+	case "domain":
+		r.domains = append(r.domains, normalizeName(value))
+	case "port":
+		from, to, isRange := strings.Cut(value, "-")
+		if !isRange {
+			to = from
+		}
+
+		lo, err := strconv.ParseUint(from, 10, 16)
+		if err != nil {
+			return fmt.Errorf("invalid port %q", value)
+		}
+		hi, err := strconv.ParseUint(to, 10, 16)
+		if err != nil || hi < lo {
+			return fmt.Errorf("invalid port %q", value)
+		}
+		r.ports = append(r.ports, [2]int{int(lo), int(hi)})
+	case "user":
+		r.users = append(r.users, value)
+	case "day":
+		days, err := parseWeekdays(value)
+		if err != nil {
+			return err
+		}
+		r.days = append(r.days, days...)
+	case "time":
+		t, err := parseTimeRange(value)
+		if err != nil {
+			return err
+		}
+		r.times = append(r.times, t)
+	case "duration":
+		d, err := time.ParseDuration(value)
+		if err != nil || d <= 0 || r.duration > 0 {
+			return fmt.Errorf("invalid duration %q", value)
+		}
+		r.duration = d
+	default:
+		return fmt.Errorf("unknown condition %q", key)
+	}
+
+	return nil
+}
@@ -0,0 +1,281 @@
+package proxyme
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRulesFile_Check(t *testing.T) {
+	const rules = `
+# internal networks are for admins only
+allow user=admin net=10.0.0.0/8,192.168.0.0/16
+deny net=10.0.0.0/8,192.168.0.0/16,2001:db8::1
+deny port=25,6000-6010
+deny domain=Example.com.
+deny domain=пример.рф,xn--mnchen-3ya.de
+`
+
+	tests := []struct {
+		name     string
+		info     SessionInfo
+		wantLine int // line of the denying rule, 0 means allowed
+	}{
+		{
+			name:     "admin to internal network",
+			info:     SessionInfo{Username: "admin", AddressType: int(ipv4), Addr: net.IPv4(10, 0, 0, 1).To4(), Port: 25},
+			wantLine: 0,
+		},
+		{
+			name:     "user to internal network",
+			info:     SessionInfo{Username: "bob", AddressType: int(ipv4), Addr: net.IPv4(10, 0, 0, 1).To4(), Port: 80},
+			wantLine: 4,
+		},
+		{
+			name:     "single ipv6 address",
+			info:     SessionInfo{AddressType: int(ipv6), Addr: net.ParseIP("2001:db8::1"), Port: 80},
+			wantLine: 4,
+		},
+		{
+			name: "domain resolved to internal network",
+			info: SessionInfo{
+				AddressType: int(domainName),
+				Addr:        []byte("intranet.test"),
+				Port:        80,
+				ResolvedIPs: []net.IP{net.IPv4(192, 168, 1, 1)},
+			},
+			wantLine: 4,
+		},
+		{
+			name:     "denied port",
+			info:     SessionInfo{AddressType: int(ipv4), Addr: net.IPv4(203, 0, 113, 1).To4(), Port: 25},
+			wantLine: 5,
+		},
+		{
+			name:     "denied port range",
+			info:     SessionInfo{AddressType: int(ipv4), Addr: net.IPv4(203, 0, 113, 1).To4(), Port: 6005},
+			wantLine: 5,
+		},
+		{
+			name:     "denied subdomain",
+			info:     SessionInfo{AddressType: int(domainName), Addr: []byte("WWW.example.com"), Port: 443},
+			wantLine: 6,
+		},
+		{
+			name:     "similar domain",
+			info:     SessionInfo{AddressType: int(domainName), Addr: []byte("notexample.com"), Port: 443},
+			wantLine: 0,
+		},
+		{
+			name:     "unicode rule, punycode request",
+			info:     SessionInfo{AddressType: int(domainName), Addr: []byte("www.xn--e1afmkfd.xn--p1ai"), Port: 443},
+			wantLine: 7,
+		},
+		{
+			name:     "punycode rule, unicode request",
+			info:     SessionInfo{AddressType: int(domainName), Addr: []byte("München.DE."), Port: 443},
+			wantLine: 7,
+		},
+		{
+			name:     "not matching",
+			info:     SessionInfo{AddressType: int(ipv4), Addr: net.IPv4(203, 0, 113, 1).To4(), Port: 443},
+			wantLine: 0,
+		},
+	}
+
+	f, err := LoadRules(writeRules(t, filepath.Join(t.TempDir(), "rules"), rules))
+	if err != nil {
+		t.Fatalf("LoadRules() error = %v", err)
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := f.Check(tt.info)
+			if tt.wantLine == 0 {
+				if err != nil {
+					t.Errorf("Check() error = %v, want allowed", err)
+				}
+				return
+			}
+
+			var ruleErr *RuleError
+			if !errors.As(err, &ruleErr) || ruleErr.Rule != "rules:"+strconv.Itoa(tt.wantLine) {
+				t.Errorf("Check() error = %v, want denied by line %d", err, tt.wantLine)
+			}
+		})
+	}
+}
+
+func TestRulesFile_Deadline(t *testing.T) {
+	const rules = `
+allow user=kid day=mon-fri time=15:00-20:00 duration=1h
+deny user=kid
+allow user=night time=22:00-06:00
+deny user=night
+allow user=weekend day=sat-sun
+deny user=weekend
+allow user=batch duration=90m
+`
+	// 2026-10-16 is Friday
+	at := func(day, hour, minute int) time.Time {
+		return time.Date(2026, 10, day, hour, minute, 0, 0, time.UTC)
+	}
+
+	tests := []struct {
+		name    string
+		user    string
+		now     time.Time
+		allowed bool
+		want    time.Time // zero means no limit
+	}{
+		{name: "duration first", user: "kid", now: at(16, 15, 30), allowed: true, want: at(16, 16, 30)},
+		{name: "time range end first", user: "kid", now: at(16, 19, 30), allowed: true, want: at(16, 20, 0)},
+		{name: "out of time range", user: "kid", now: at(16, 20, 0), want: at(16, 20, 0)},
+		{name: "out of days", user: "kid", now: at(17, 16, 0), want: at(17, 16, 0)},
+		{name: "range over midnight before", user: "night", now: at(16, 23, 0), allowed: true, want: at(17, 6, 0)},
+		{name: "range over midnight after", user: "night", now: at(17, 5, 0), allowed: true, want: at(17, 6, 0)},
+		{name: "out of range over midnight", user: "night", now: at(17, 12, 0), want: at(17, 12, 0)},
+		{name: "days over week end", user: "weekend", now: at(18, 12, 0), allowed: true},
+		{name: "duration only", user: "batch", now: at(16, 12, 0), allowed: true, want: at(16, 13, 30)},
+		{name: "not matching", user: "admin", now: at(16, 12, 0), allowed: true},
+	}
+
+	f, err := LoadRules(writeRules(t, filepath.Join(t.TempDir(), "rules"), rules))
+	if err != nil {
+		t.Fatalf("LoadRules() error = %v", err)
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f.now = func() time.Time { return tt.now }
+			info := SessionInfo{Username: tt.user, AddressType: int(ipv4), Addr: net.IPv4(203, 0, 113, 1).To4(), Port: 443}
+
+			if err := f.Check(info); (err == nil) != tt.allowed {
+				t.Errorf("Check() error = %v, want allowed %v", err, tt.allowed)
+			}
+			if got := f.Deadline(info); !got.Equal(tt.want) {
+				t.Errorf("Deadline() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadRules(t *testing.T) {
+	tests := []struct {
+		name    string
+		rules   string
+		wantErr string
+	}{
+		{name: "empty", rules: "\n# nothing\n"},
+		{name: "allow list", rules: "allow domain=example.com\ndeny"},
+		{name: "unknown action", rules: "block port=25", wantErr: "line 1: unknown action"},
+		{name: "unknown condition", rules: "\ndeny host=example.com", wantErr: "line 2: unknown condition"},
+		{name: "invalid condition", rules: "deny port", wantErr: "invalid condition"},
+		{name: "invalid cidr", rules: "deny net=10.0.0.0/33", wantErr: "invalid CIDR"},
+		{name: "invalid ip", rules: "deny net=10.0.0", wantErr: "invalid ip"},
+		{name: "invalid port", rules: "deny port=65536", wantErr: "invalid port"},
+		{name: "invalid port range", rules: "deny port=10-1", wantErr: "invalid port"},
+		{name: "schedule", rules: "allow day=mon-fri,sun time=09:00-18:00,22:00-23:30 duration=1h30m"},
+		{name: "invalid day", rules: "allow day=monday", wantErr: "invalid day"},
+		{name: "invalid time", rules: "allow time=9-18", wantErr: "invalid time range"},
+		{name: "invalid time range", rules: "allow time=09:00", wantErr: "invalid time range"},
+		{name: "invalid duration", rules: "allow duration=-1h", wantErr: "invalid duration"},
+		{name: "several durations", rules: "allow duration=1h,2h", wantErr: "invalid duration"},
+		{name: "duration of deny rule", rules: "deny duration=1h", wantErr: "duration of deny rule"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := LoadRules(writeRules(t, filepath.Join(t.TempDir(), "rules"), tt.rules))
+			if tt.wantErr == "" && err != nil {
+				t.Errorf("LoadRules() error = %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("LoadRules() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRulesFile_Reload(t *testing.T) {
+	path := writeRules(t, filepath.Join(t.TempDir(), "rules"), "deny port=25")
+	smtp := SessionInfo{AddressType: int(ipv4), Addr: net.IPv4(203, 0, 113, 1).To4(), Port: 25}
+
+	f, err := LoadRules(path)
+	if err != nil {
+		t.Fatalf("LoadRules() error = %v", err)
+	}
+
+	// broken file keeps the current rules
+	writeRules(t, path, "deny port=smtp")
+	if err := f.Reload(); err == nil {
+		t.Fatalf("Reload() of broken file succeeded")
+	}
+	if f.Check(smtp) == nil {
+		t.Fatalf("rules are lost on failed reload")
+	}
+
+	writeRules(t, path, "deny port=587")
+	if err := f.Reload(); err != nil {
+		t.Fatalf("Reload() error = %v", err)
+	}
+	if err := f.Check(smtp); err != nil {
+		t.Fatalf("Check() error = %v after reload", err)
+	}
+}
+
+func TestRulesFile_Watch(t *testing.T) {
+	dir := t.TempDir()
+	path := writeRules(t, filepath.Join(dir, "rules"), "deny port=25")
+	smtp := SessionInfo{AddressType: int(ipv4), Addr: net.IPv4(203, 0, 113, 1).To4(), Port: 25}
+
+	f, err := LoadRules(path)
+	if err != nil {
+		t.Fatalf("LoadRules() error = %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- f.Watch(ctx, func(err error) { t.Errorf("reload error: %v", err) })
+	}()
+
+	// the file is replaced by rename as editors and config managers do
+	deadline := time.Now().Add(5 * time.Second)
+	for f.Check(smtp) != nil {
+		if time.Now().After(deadline) {
+			t.Fatalf("rules aren't reloaded")
+		}
+
+		tmp := writeRules(t, filepath.Join(dir, "rules.tmp"), "deny port=587")
+		if err := os.Rename(tmp, path); err != nil {
+			t.Fatalf("rename: %v", err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	cancel()
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("Watch() error = %v, want %v", err, context.Canceled)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Watch() doesn't stop")
+	}
+}
+
+func writeRules(t *testing.T, path, rules string) string {
+	t.Helper()
+
+	if err := os.WriteFile(path, []byte(rules), 0o600); err != nil {
+		t.Fatalf("write rules: %v", err)
+	}
+
+	return path
+}
@@ -0,0 +1,151 @@
+package proxyme
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// ErrSessionExpired reports the session terminated at its deadline (see Options.SessionDeadline and
+// Options.MaxSessionDuration).
+var ErrSessionExpired = errors.New("session expired")
+
+// weekdays are names of the days of week in rules.
+var weekdays = [...]string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// timeRange is the time of day range [from, to) in minutes since midnight, ranges with to
+// not after from wrap over midnight.
+type timeRange [2]int
+
+// parseTimeRange parses HH:MM-HH:MM range.
+func parseTimeRange(value string) (timeRange, error) {
+	from, to, ok := strings.Cut(value, "-")
+	if !ok {
+		return timeRange{}, fmt.Errorf("invalid time range %q", value)
+	}
+
+	var r timeRange
+	for i, s := range []string{from, to} {
+		t, err := time.Parse("15:04", s)
+		if err != nil {
+			return timeRange{}, fmt.Errorf("invalid time range %q", value)
+		}
+		r[i] = t.Hour()*60 + t.Minute()
+	}
+
+	return r, nil
+}
+
+// end returns the end of the range containing t, ok is false if t is out of the range.
+func (r timeRange) end(t time.Time) (time.Time, bool) {
+	hour, minute, _ := t.Clock()
+	now := hour*60 + minute
+	year, month, day := t.Date()
+
+	switch {
+	case r[0] < r[1] && now >= r[0] && now < r[1]:
+	case r[0] >= r[1] && now < r[1]:
+	case r[0] >= r[1] && now >= r[0]:
+		day++ // ends tomorrow
+	default:
+		return time.Time{}, false
+	}
+
+	return time.Date(year, month, day, 0, r[1], 0, 0, t.Location()), true
+}
+
+// parseWeekdays parses the day of week or range of days (from-to), ranges may wrap over the week end.
+func parseWeekdays(value string) ([]time.Weekday, error) {
+	from, to, isRange := strings.Cut(value, "-")
+	if !isRange {
+		to = from
+	}
+
+	lo, hi := weekday(from), weekday(to)
+	if lo < 0 || hi < 0 {
+		return nil, fmt.Errorf("invalid day %q", value)
+	}
+
+	days := []time.Weekday{lo}
+	for d := lo; d != hi; {
+		d = (d + 1) % 7
+		days = append(days, d)
+	}
+
+	return days, nil
+}
+
+// weekday returns the day of week by name, -1 if unknown.
+func weekday(name string) time.Weekday {
+	for i, d := range weekdays {
+		if strings.EqualFold(name, d) {
+			return time.Weekday(i)
+		}
+	}
+
+	return -1
+}
+
+// limit arms termination of the relayed session at its deadline (see Options.SessionDeadline and
+// Options.MaxSessionDuration): the connections are closed once it's reached. The returned func
+// disarms it and returns ErrSessionExpired if the session has been terminated.
+func (s *state) limit(conns ...io.Closer) func() error {
+	info := s.info()
+	deadline, reason := sessionDeadline(s.opts.deadline, s.opts.maxDuration, info, s.started)
+	s.established(info, deadline)
+	if deadline.IsZero() {
+		return func() error { return nil }
+	}
+
+	var expired atomic.Bool
+	timer := time.AfterFunc(time.Until(deadline), func() {
+		expired.Store(true)
+		if s.opts.expired != nil {
+			s.opts.expired.Add(1)
+		}
+
+		for _, c := range conns {
+			_ = c.Close()
+		}
+	})
+
+	return func() error {
+		if timer.Stop() || !expired.Load() {
+			return nil
+		}
+
+		return fmt.Errorf("%w: %s: %s at %s", ErrSessionExpired, info.Destination(), reason, deadline.Format(time.RFC3339))
+	}
+}
+
+// sessionDeadline returns the deadline of the session started at the time and the reason of it, zero
+// time if the session isn't limited.
+func sessionDeadline(deadlineOf func(info SessionInfo) time.Time, maxDuration time.Duration, info SessionInfo,
+	started time.Time) (time.Time, string) {
+	var deadline time.Time
+	if deadlineOf != nil {
+		deadline = deadlineOf(info)
+	}
+
+	reason := "deadline"
+	if maxDuration > 0 {
+		if lifetime := started.Add(maxDuration); deadline.IsZero() || lifetime.Before(deadline) {
+			deadline, reason = lifetime, fmt.Sprintf("max session duration %v", maxDuration)
+		}
+	}
+
+	return deadline, reason
+}
+
+// ExpiredSessions returns the number of sessions terminated at their deadline (see Options.SessionDeadline
+// and Options.MaxSessionDuration).
+func (s SOCKS5) ExpiredSessions() int64 {
+	if s.expired == nil {
+		return 0
+	}
+
+	return s.expired.Load()
+}
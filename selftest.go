@@ -0,0 +1,104 @@
+package proxyme
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+
+	"github.com/dblokhin/proxyme/wire"
+)
+
+// SelfTest checks the full protocol path of the running server: it connects to one of the server
+// listeners over loopback (tcp ones are preferred to unix sockets), negotiates authentication and
+// CONNECTs to Server.CheckTarget. Use it for liveness probes instead of bare TCP connect. The check
+// is canceled with ctx.
+func (s *Server) SelfTest(ctx context.Context) error {
+	network, address, err := s.checkAddress()
+	if err != nil {
+		return err
+	}
+
+	target := s.CheckTarget
+	if target == "" && network != "tcp" {
+		return errors.New("self-test: CheckTarget is required to test unix socket listener")
+	}
+	if target == "" {
+		target = address
+	}
+	dst, err := targetAddress(target)
+	if err != nil {
+		return fmt.Errorf("self-test: %w", err)
+	}
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, network, address)
+	if err != nil {
+		return fmt.Errorf("self-test: %w", err)
+	}
+	defer conn.Close() // nolint
+
+	stop := context.AfterFunc(ctx, func() {
+		_ = conn.Close()
+	})
+	defer stop()
+
+	err = upstreamHandshake(conn, s.CheckUsername, s.CheckPassword, int(dst.Type), dst.Addr, int(dst.Port))
+	if err != nil {
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		return fmt.Errorf("self-test %s via %s: %w", target, address, err)
+	}
+
+	return nil
+}
+
+// checkAddress returns network and loopback address of one of the server listeners.
+func (s *Server) checkAddress() (string, string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var socket string
+	for ls := range s.listeners {
+		addr, ok := ls.Addr().(*net.TCPAddr)
+		if !ok {
+			if unix, ok := ls.Addr().(*net.UnixAddr); ok && unix.Net == "unix" {
+				socket = unix.Name
+			}
+			continue
+		}
+
+		// listeners of unspecified address are dual-stack
+		ip := addr.IP
+		if ip == nil || ip.IsUnspecified() {
+			ip = net.IPv4(127, 0, 0, 1)
+		}
+
+		return "tcp", net.JoinHostPort(ip.String(), strconv.Itoa(addr.Port)), nil
+	}
+	if socket != "" {
+		return "unix", socket, nil
+	}
+
+	return "", "", errors.New("self-test: server isn't serving tcp or unix socket listeners")
+}
+
+// targetAddress returns wire address of host:port.
+func targetAddress(address string) (wire.Address, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return wire.Address{}, err
+	}
+	portNum, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return wire.Address{}, fmt.Errorf("invalid port %q", port)
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		return wire.AddressFrom(&net.TCPAddr{IP: ip, Port: int(portNum)})
+	}
+
+	return wire.Address{Type: wire.AddressDomainName, Addr: []byte(host), Port: uint16(portNum)}, nil
+}
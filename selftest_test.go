@@ -0,0 +1,119 @@
+package proxyme
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServer_SelfTest(t *testing.T) {
+	refused := func(t *testing.T) string {
+		ls, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		addr := ls.Addr().String()
+		_ = ls.Close()
+		return addr
+	}
+
+	tests := []struct {
+		name    string
+		opts    Options
+		serve   bool
+		setup   func(t *testing.T, srv *Server)
+		wantErr string
+	}{
+		{
+			name:  "loopback connect",
+			opts:  Options{AllowNoAuth: true},
+			serve: true,
+		},
+		{
+			name:  "login",
+			opts:  Options{Authenticate: StaticCredentials(map[string]string{"probe": "secret"})},
+			serve: true,
+			setup: func(t *testing.T, srv *Server) {
+				srv.CheckUsername, srv.CheckPassword = "probe", "secret"
+			},
+		},
+		{
+			name:    "auth method refused",
+			opts:    Options{Authenticate: StaticCredentials(map[string]string{"probe": "secret"})},
+			serve:   true,
+			wantErr: "auth method refused",
+		},
+		{
+			name:  "unreachable target",
+			opts:  Options{AllowNoAuth: true},
+			serve: true,
+			setup: func(t *testing.T, srv *Server) {
+				srv.CheckTarget = refused(t)
+			},
+			wantErr: ErrConnectionRefused.Error(),
+		},
+		{
+			name:    "not serving",
+			opts:    Options{AllowNoAuth: true},
+			wantErr: "isn't serving",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			socks5, err := New(tt.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			srv := &Server{SOCKS5: socks5}
+			defer srv.Close() // nolint
+
+			if tt.setup != nil {
+				tt.setup(t, srv)
+			}
+			if tt.serve {
+				ls, err := net.Listen("tcp", "127.0.0.1:0")
+				if err != nil {
+					t.Fatal(err)
+				}
+				// register the listener before the check
+				if !srv.trackListener(ls, true) {
+					t.Fatal("server closed")
+				}
+				go srv.Serve(ls) // nolint
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			err = srv.SelfTest(ctx)
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Errorf("SelfTest() error = %v", err)
+			case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+				t.Errorf("SelfTest() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestServer_SelfTest_canceled(t *testing.T) {
+	// the listener accepts but never replies
+	ls, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ls.Close() // nolint
+
+	srv := &Server{SOCKS5: &SOCKS5{}}
+	srv.trackListener(ls, true)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	if err := srv.SelfTest(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("SelfTest() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+}
@@ -0,0 +1,389 @@
+package proxyme
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+const (
+	minAcceptDelay = 5 * time.Millisecond
+	maxAcceptDelay = time.Second
+
+	shutdownPollInterval = 50 * time.Millisecond
+)
+
+// ErrServerClosed is returned by Serve and ListenAndServe once the server is closed by Close or
+// Shutdown, so supervisors tell clean shutdown from listener failures. It wraps net.ErrClosed.
+var ErrServerClosed = fmt.Errorf("server closed: %w", net.ErrClosed)
+
+// AcceptError is failure of the listener: Serve returns fatal ones, temporary ones (e.g. too many
+// open files) are retried and reported to Server.OnError.
+type AcceptError struct {
+	Temporary bool
+	Delay     time.Duration // backoff before retrying the temporary error
+	Err       error
+}
+
+func (e *AcceptError) Error() string {
+	if e.Temporary {
+		return fmt.Sprintf("accept: %v; retrying in %v", e.Err, e.Delay)
+	}
+
+	return "accept: " + e.Err.Error()
+}
+
+func (e *AcceptError) Unwrap() error {
+	return e.Err
+}
+
+// SessionError is error of the client session reported to Server.OnError, Panic is set if the
+// session has panicked (Err has the stack trace then).
+type SessionError struct {
+	Client net.Addr
+	Panic  bool
+	Err    error
+}
+
+func (e *SessionError) Error() string {
+	if e.Panic {
+		return fmt.Sprintf("panic serving %v: %v", e.Client, e.Err)
+	}
+
+	return fmt.Sprintf("session %v: %v", e.Client, e.Err)
+}
+
+func (e *SessionError) Unwrap() error {
+	return e.Err
+}
+
+// Server accepts clients on listeners and serves them with SOCKS5 protocol.
+//
+// Temporary accept errors (e.g. too many open files) are retried with exponential backoff,
+// panics of client sessions are recovered and reported, so a single failure doesn't bring
+// the whole proxy down.
+//
+// Example:
+//
+//	socks5, _ := proxyme.New(opts)
+//	srv := &proxyme.Server{SOCKS5: socks5}
+//	log.Fatal(srv.ListenAndServe(":1080"))
+type Server struct {
+	// SOCKS5 serves accepted connections.
+	// REQUIRED.
+	SOCKS5 *SOCKS5
+
+	// OnError if specified, receives errors of client sessions and recovered panics as *SessionError,
+	// temporary accept errors which are retried as *AcceptError.
+	// OPTIONAL.
+	OnError func(error)
+
+	// CheckTarget is address (host:port) SelfTest CONNECTs to through the proxy.
+	// OPTIONAL, default is the proxy listener itself.
+	CheckTarget string
+
+	// CheckUsername and CheckPassword are credentials of SelfTest if the proxy requires
+	// username/password authentication.
+	// OPTIONAL, default is no authentication.
+	CheckUsername string
+	CheckPassword string
+
+	// Metrics receives Stats of the server every StatsInterval while it's serving.
+	// OPTIONAL, default stats aren't reported (see expvarsink package to publish them in expvar).
+	Metrics MetricsSink
+
+	// StatsInterval is the period of reporting Stats to Metrics.
+	// OPTIONAL, default 10 seconds.
+	StatsInterval time.Duration
+
+	// DrainIdle if specified, makes Shutdown half-close client connections idle (no data sent or
+	// received) for DrainIdle: clients get FIN and reconnect elsewhere (e.g. to another instance
+	// behind the load balancer) while busy sessions go on until the shutdown deadline. Idle time
+	// is known for tcp connections on Linux only.
+	// OPTIONAL, default Shutdown doesn't signal clients.
+	DrainIdle time.Duration
+
+	// UnixSocketMode is the permissions of unix sockets created by ListenAndServe, e.g. 0660 lets only
+	// the owner and the group connect (sidecars sharing the group). The mode is set right after the
+	// socket is created, put the socket into the directory of restricted access if clients must not
+	// connect even meanwhile.
+	// OPTIONAL, default 0777 masked by umask.
+	UnixSocketMode os.FileMode
+
+	// ListenerOptions tune tcp listeners of ListenAndServe (deferred accept, TCP Fast Open), listeners
+	// passed to Serve are used as is.
+	// OPTIONAL, default the system defaults.
+	ListenerOptions ListenerOptions
+
+	// TLSConfig if specified, terminates TLS of accepted connections: clients speak SOCKS5 over TLS.
+	// Serving the listener of tls.NewListener works the same way.
+	// OPTIONAL, default connections are served as is.
+	TLSConfig *tls.Config
+
+	// VirtualHosts serves TLS clients by the server name they connect to (SNI) with SOCKS5 instances
+	// of their own, so one listener serves several logical proxies of different authentication, rules
+	// and egress, e.g. {"eu.proxy.example.com": eu, "*.us.proxy.example.com": us}. Wildcards *.name
+	// match subdomains, exact names take precedence. Clients of unknown server names, without SNI or
+	// TLS are served by SOCKS5. Stats and diagnostics of the server are the ones of SOCKS5.
+	// OPTIONAL, default SOCKS5 serves all clients.
+	VirtualHosts map[string]*SOCKS5
+
+	// TLSHandshakeTimeout limits TLS handshake of clients choosing the virtual host.
+	// OPTIONAL, default 10 seconds.
+	TLSHandshakeTimeout time.Duration
+
+	mu        sync.Mutex
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn]bool // client connections, true once half-closed by Shutdown
+	closed    bool
+	reporting bool // stats are being reported to Metrics
+}
+
+// ListenAndServe listens on tcp address (host:port) or unix socket (unix:///path/to/socket) and
+// serves clients, see Serve. The stale socket file of the crashed process is replaced, the socket
+// file is removed once the server is closed.
+func (s *Server) ListenAndServe(address string) error {
+	ls, err := s.listen(address)
+	if err != nil {
+		return err
+	}
+
+	return s.Serve(ls)
+}
+
+// Serve accepts clients on the listener and serves each of them in its own goroutine.
+// It returns *AcceptError on fatal listener error or ErrServerClosed once the server is closed,
+// the listener is closed on return.
+func (s *Server) Serve(ls net.Listener) error {
+	if s.SOCKS5 == nil {
+		return errors.New("server: nil SOCKS5")
+	}
+	hosts, err := parseVirtualHosts(s.VirtualHosts)
+	if err != nil {
+		return fmt.Errorf("server: %w", err)
+	}
+
+	if !s.trackListener(ls, true) {
+		_ = ls.Close()
+		return ErrServerClosed
+	}
+	defer s.trackListener(ls, false)
+	defer ls.Close() // nolint
+
+	var delay time.Duration
+	for {
+		conn, err := ls.Accept()
+		if err != nil {
+			if s.isClosed() {
+				return ErrServerClosed
+			}
+			if !temporary(err) {
+				return &AcceptError{Err: err}
+			}
+
+			delay = min(max(2*delay, minAcceptDelay), maxAcceptDelay)
+			s.report(&AcceptError{Temporary: true, Delay: delay, Err: err})
+			time.Sleep(delay)
+
+			continue
+		}
+		delay = 0
+
+		if !s.trackConn(conn, true) {
+			_ = conn.Close()
+			continue
+		}
+
+		go s.handle(conn, hosts)
+	}
+}
+
+// Close immediately closes all listeners and client connections, it doesn't wait for
+// the sessions to finish. Serve returns ErrServerClosed after the server is closed.
+func (s *Server) Close() error {
+	err := s.closeListeners()
+	s.closeConns()
+
+	return err
+}
+
+// Shutdown gracefully shuts the server down: it closes listeners and waits for client sessions
+// to finish. Once the context is done, the remaining sessions are closed and the context error
+// is returned. Idle sessions are half-closed meanwhile if DrainIdle is set. Serve returns
+// ErrServerClosed after the server is shut down.
+func (s *Server) Shutdown(ctx context.Context) error {
+	err := s.closeListeners()
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+
+	for {
+		if s.drainIdle() == 0 {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			s.closeConns()
+			return errors.Join(err, ctx.Err())
+		case <-ticker.C:
+		}
+	}
+}
+
+// closeListeners marks the server closed and closes its listeners.
+func (s *Server) closeListeners() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+
+	var err error
+	for ls := range s.listeners {
+		err = errors.Join(err, ls.Close())
+	}
+
+	return err
+}
+
+func (s *Server) closeConns() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for conn := range s.conns {
+		_ = conn.Close()
+	}
+}
+
+// drainIdle half-closes client connections idle for DrainIdle, it returns the number of open
+// client connections.
+func (s *Server) drainIdle() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.DrainIdle <= 0 {
+		return len(s.conns)
+	}
+
+	for conn, drained := range s.conns {
+		if drained {
+			continue
+		}
+
+		idle, ok := idleTime(conn)
+		if !ok || idle < s.DrainIdle {
+			continue
+		}
+		if cw, ok := conn.(closeWriter); ok && cw.CloseWrite() == nil {
+			s.conns[conn] = true
+		}
+	}
+
+	return len(s.conns)
+}
+
+// handle serves the client recovering panics, TLS is terminated if configured.
+func (s *Server) handle(conn net.Conn, hosts virtualHosts) {
+	defer s.trackConn(conn, false)
+	defer conn.Close() // nolint
+
+	defer func() {
+		if r := recover(); r != nil {
+			s.report(&SessionError{Client: conn.RemoteAddr(), Panic: true, Err: fmt.Errorf("%v\n%s", r, debug.Stack())})
+		}
+	}()
+
+	var onError func(error)
+	if s.OnError != nil {
+		onError = func(err error) {
+			s.OnError(&SessionError{Client: conn.RemoteAddr(), Err: err})
+		}
+	}
+
+	if s.TLSConfig != nil {
+		conn = tls.Server(conn, s.TLSConfig)
+	}
+
+	socks5, err := s.route(conn, hosts)
+	if err != nil {
+		if onError != nil {
+			onError(err)
+		}
+		return
+	}
+
+	socks5.Handle(conn, onError)
+}
+
+func (s *Server) report(err error) {
+	if s.OnError != nil {
+		s.OnError(err)
+	}
+}
+
+func (s *Server) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.closed
+}
+
+// trackListener adds or removes the listener, it reports false if the server is closed.
+func (s *Server) trackListener(ls net.Listener, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !add {
+		delete(s.listeners, ls)
+		return true
+	}
+
+	if s.closed {
+		return false
+	}
+	if s.listeners == nil {
+		s.listeners = make(map[net.Listener]struct{})
+	}
+	s.listeners[ls] = struct{}{}
+
+	if s.Metrics != nil && !s.reporting {
+		s.reporting = true
+		go s.reportStats()
+	}
+
+	return true
+}
+
+// trackConn adds or removes the client connection, it reports false if the server is closed.
+func (s *Server) trackConn(conn net.Conn, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !add {
+		delete(s.conns, conn)
+		return true
+	}
+
+	if s.closed {
+		return false
+	}
+	if s.conns == nil {
+		s.conns = make(map[net.Conn]bool)
+	}
+	s.conns[conn] = false
+
+	return true
+}
+
+// temporary reports whether accept error is temporary (e.g. EMFILE, ECONNABORTED) and the listener
+// is still usable.
+func temporary(err error) bool {
+	var te interface{ Temporary() bool }
+	return errors.As(err, &te) && te.Temporary()
+}
@@ -0,0 +1,480 @@
+package proxyme
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/dblokhin/proxyme/testsupport"
+)
+
+// fakeListener returns queued results of Accept, then blocks until closed.
+type fakeListener struct {
+	results chan acceptResult
+	done    chan struct{}
+	once    sync.Once
+}
+
+type acceptResult struct {
+	conn net.Conn
+	err  error
+}
+
+func newFakeListener() *fakeListener {
+	return &fakeListener{
+		results: make(chan acceptResult, 8),
+		done:    make(chan struct{}),
+	}
+}
+
+func (l *fakeListener) Accept() (net.Conn, error) {
+	select {
+	case r := <-l.results:
+		return r.conn, r.err
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *fakeListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *fakeListener) Addr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1080}
+}
+
+// errorRecorder collects reported errors.
+type errorRecorder struct {
+	mu   sync.Mutex
+	errs []error
+}
+
+func (r *errorRecorder) report(err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.errs = append(r.errs, err)
+}
+
+func (r *errorRecorder) errors() []error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return append([]error(nil), r.errs...)
+}
+
+func TestServer_Serve(t *testing.T) {
+	temporaryErr := &net.OpError{Op: "accept", Net: "tcp", Err: syscall.EMFILE}
+	fatalErr := errors.New("listener broken")
+
+	tests := []struct {
+		name  string
+		auth  func(conn io.ReadWriteCloser) (io.ReadWriteCloser, error)
+		check func(ls *fakeListener, srv *Server, rec *errorRecorder) error
+	}{
+		{
+			name: "temporary errors are retried",
+			check: func(ls *fakeListener, srv *Server, rec *errorRecorder) error {
+				ls.results <- acceptResult{err: temporaryErr}
+				ls.results <- acceptResult{err: temporaryErr}
+				ls.results <- acceptResult{err: fatalErr}
+
+				err := srv.Serve(ls)
+				var acceptErr *AcceptError
+				if !errors.Is(err, fatalErr) || !errors.As(err, &acceptErr) || acceptErr.Temporary {
+					return fmt.Errorf("got error %v, want fatal accept error %v", err, fatalErr)
+				}
+
+				errs := rec.errors()
+				if len(errs) != 2 || !errors.Is(errs[0], syscall.EMFILE) {
+					return fmt.Errorf("got reported errors %v, want 2 temporary errors", errs)
+				}
+				if !errors.As(errs[0], &acceptErr) || !acceptErr.Temporary || acceptErr.Delay <= 0 {
+					return fmt.Errorf("got reported error %#v, want temporary accept error", errs[0])
+				}
+				return nil
+			},
+		},
+		{
+			name: "panic recovered",
+			auth: func(conn io.ReadWriteCloser) (io.ReadWriteCloser, error) {
+				panic("broken auth")
+			},
+			check: func(ls *fakeListener, srv *Server, rec *errorRecorder) error {
+				client, server := net.Pipe()
+				defer client.Close()
+				ls.results <- acceptResult{conn: server}
+
+				errc := make(chan error, 1)
+				go func() {
+					errc <- srv.Serve(ls)
+				}()
+
+				if _, err := client.Write([]byte{protoVersion, 1, byte(typeNoAuth)}); err != nil {
+					return fmt.Errorf("client write: %w", err)
+				}
+				// method reply and then the conn is closed
+				if _, err := io.ReadAll(client); err != nil {
+					return fmt.Errorf("client read: %w", err)
+				}
+
+				errs := rec.errors()
+				var sessionErr *SessionError
+				if len(errs) != 1 || !strings.Contains(errs[0].Error(), "broken auth") ||
+					!errors.As(errs[0], &sessionErr) || !sessionErr.Panic {
+					return fmt.Errorf("got reported errors %v, want recovered panic", errs)
+				}
+
+				// server is still serving
+				select {
+				case err := <-errc:
+					return fmt.Errorf("serve returned: %w", err)
+				default:
+				}
+
+				_ = srv.Close()
+				if err := <-errc; !errors.Is(err, ErrServerClosed) {
+					return fmt.Errorf("got error %v, want %v", err, ErrServerClosed)
+				}
+				return nil
+			},
+		},
+		{
+			name: "closed server",
+			check: func(ls *fakeListener, srv *Server, rec *errorRecorder) error {
+				_ = srv.Close()
+
+				if err := srv.Serve(ls); !errors.Is(err, ErrServerClosed) || !errors.Is(err, net.ErrClosed) {
+					return fmt.Errorf("got error %v, want %v", err, ErrServerClosed)
+				}
+				return nil
+			},
+		},
+		{
+			name: "session errors",
+			auth: func(conn io.ReadWriteCloser) (io.ReadWriteCloser, error) {
+				return nil, errors.New("denied")
+			},
+			check: func(ls *fakeListener, srv *Server, rec *errorRecorder) error {
+				client, server := net.Pipe()
+				defer client.Close()
+				ls.results <- acceptResult{conn: server}
+
+				errc := make(chan error, 1)
+				go func() {
+					errc <- srv.Serve(ls)
+				}()
+
+				if _, err := client.Write([]byte{protoVersion, 1, byte(typeNoAuth)}); err != nil {
+					return fmt.Errorf("client write: %w", err)
+				}
+				if _, err := io.ReadAll(client); err != nil {
+					return fmt.Errorf("client read: %w", err)
+				}
+
+				var sessionErr *SessionError
+				for deadline := time.Now().Add(time.Second); len(rec.errors()) == 0 && time.Now().Before(deadline); {
+					time.Sleep(10 * time.Millisecond)
+				}
+				errs := rec.errors()
+				if len(errs) != 1 || !errors.As(errs[0], &sessionErr) || sessionErr.Panic ||
+					sessionErr.Client != server.RemoteAddr() {
+					return fmt.Errorf("got reported errors %v, want session error", errs)
+				}
+
+				_ = srv.Close()
+				if err := <-errc; !errors.Is(err, ErrServerClosed) {
+					return fmt.Errorf("got error %v, want %v", err, ErrServerClosed)
+				}
+				return nil
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			auth := tt.auth
+			if auth == nil {
+				auth = func(conn io.ReadWriteCloser) (io.ReadWriteCloser, error) {
+					return conn, nil
+				}
+			}
+
+			var rec errorRecorder
+			srv := &Server{
+				SOCKS5: &SOCKS5{
+					auth: map[authMethod]authHandler{
+						typeNoAuth: fakeAuth{
+							fnMethod: func() authMethod { return typeNoAuth },
+							fnAuth:   auth,
+						},
+					},
+				},
+				OnError: rec.report,
+			}
+
+			done := make(chan error, 1)
+			go func() {
+				done <- tt.check(newFakeListener(), srv, &rec)
+			}()
+
+			select {
+			case err := <-done:
+				if err != nil {
+					t.Errorf("Serve() error = %v", err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("Serve() hangs")
+			}
+		})
+	}
+}
+
+func TestServer_Shutdown(t *testing.T) {
+	socks5, err := New(Options{AllowNoAuth: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// echo upstream
+	upstream, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer upstream.Close() // nolint
+	go func() {
+		for {
+			conn, err := upstream.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close() // nolint
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	ls, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &Server{SOCKS5: socks5, DrainIdle: 100 * time.Millisecond}
+	served := make(chan error, 1)
+	go func() { served <- srv.Serve(ls) }()
+
+	connect := func() *testsupport.Client {
+		client, err := testsupport.Dial(ls.Addr().String(), 5*time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reply, err := client.Connect(upstream.Addr().String()); err != nil || reply.Status != 0 {
+			t.Fatalf("got reply %v, error %v", reply, err)
+		}
+		if err := client.Echo("ping"); err != nil {
+			t.Fatalf("echo: %v", err)
+		}
+		return client
+	}
+
+	idle, busy := connect(), connect()
+	defer idle.Close() // nolint
+	defer busy.Close() // nolint
+
+	stop := make(chan struct{})
+	busyErr := make(chan error, 1)
+	go func() {
+		for {
+			select {
+			case <-stop:
+				busyErr <- nil
+				return
+			case <-time.After(20 * time.Millisecond):
+			}
+			if err := busy.Echo("busy"); err != nil {
+				busyErr <- err
+				return
+			}
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- srv.Shutdown(ctx) }()
+
+	if _, ok := idleTime(idle.Conn); ok {
+		// the idle client gets FIN and leaves
+		if err := idle.Closed(); err != nil {
+			t.Errorf("idle client: %v", err)
+		}
+		_ = idle.Close()
+	}
+
+	// the busy session goes on until the deadline
+	time.Sleep(500 * time.Millisecond)
+	close(stop)
+	if err := <-busyErr; err != nil {
+		t.Errorf("busy session is interrupted: %v", err)
+	}
+
+	if err := <-shutdown; !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Shutdown() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if err := busy.Closed(); err != nil {
+		t.Errorf("busy client: %v", err)
+	}
+	if err := <-served; !errors.Is(err, net.ErrClosed) {
+		t.Errorf("Serve() error = %v, want %v", err, net.ErrClosed)
+	}
+}
+
+func TestServer_Shutdown_idle(t *testing.T) {
+	socks5, err := New(Options{AllowNoAuth: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ls := newFakeListener()
+	srv := &Server{SOCKS5: socks5}
+	served := make(chan error, 1)
+	go func() { served <- srv.Serve(ls) }()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	// no sessions, nothing to wait for
+	if err := srv.Shutdown(ctx); err != nil {
+		t.Errorf("Shutdown() error = %v", err)
+	}
+	if err := <-served; !errors.Is(err, net.ErrClosed) {
+		t.Errorf("Serve() error = %v, want %v", err, net.ErrClosed)
+	}
+}
+
+func TestServer_ListenAndServe_unix(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("unix socket permissions aren't supported")
+	}
+
+	socks5, err := New(Options{AllowNoAuth: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	upstream, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer upstream.Close() // nolint
+	go func() {
+		for {
+			conn, err := upstream.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close() // nolint
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	// stale socket of the crashed process
+	path := filepath.Join(t.TempDir(), "proxy.sock")
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	_ = stale.Close()
+
+	srv := &Server{SOCKS5: socks5, UnixSocketMode: 0600, CheckTarget: upstream.Addr().String()}
+	served := make(chan error, 1)
+	go func() { served <- srv.ListenAndServe("unix://" + path) }()
+
+	var conn net.Conn
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if conn, err = net.Dial("unix", path); err == nil || time.Now().After(deadline) {
+			break
+		}
+	}
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	client := &testsupport.Client{Conn: conn}
+	defer client.Close() // nolint
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Errorf("got socket mode %v, want %v", fi.Mode().Perm(), os.FileMode(0600))
+	}
+
+	if reply, err := client.Connect(upstream.Addr().String()); err != nil || reply.Status != 0 {
+		t.Fatalf("got reply %v, error %v", reply, err)
+	}
+	if err := client.Echo("ping"); err != nil {
+		t.Fatalf("echo: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := srv.SelfTest(ctx); err != nil {
+		t.Errorf("SelfTest() error = %v", err)
+	}
+
+	// the socket is busy
+	if err := (&Server{SOCKS5: socks5}).ListenAndServe("unix://" + path); err == nil {
+		t.Error("expected error listening on the socket in use")
+	}
+
+	_ = srv.Close()
+	if err := <-served; !errors.Is(err, net.ErrClosed) {
+		t.Errorf("ListenAndServe() error = %v, want %v", err, net.ErrClosed)
+	}
+	if _, err := os.Lstat(path); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("socket file isn't removed: %v", err)
+	}
+
+	// regular files aren't replaced
+	if err := os.WriteFile(path, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := (&Server{SOCKS5: socks5}).ListenAndServe("unix://" + path); err == nil {
+		t.Error("expected error listening on the regular file")
+	}
+}
+
+func Test_temporary(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "emfile", err: &net.OpError{Op: "accept", Err: syscall.EMFILE}, want: true},
+		{name: "connection aborted", err: &net.OpError{Op: "accept", Err: syscall.ECONNABORTED}, want: true},
+		{name: "closed", err: &net.OpError{Op: "accept", Err: net.ErrClosed}, want: false},
+		{name: "other", err: errors.New("other"), want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := temporary(tt.err); got != tt.want {
+				t.Errorf("temporary() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -1,9 +1,16 @@
 package proxyme
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"io"
 	"net"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/dblokhin/proxyme/wire"
 )
 
 // GSSAPI provides contract to implement GSSAPI boilerplate.
@@ -72,18 +79,311 @@ type Options struct {
 	// OPTIONAL, default disabled.
 	AllowNoAuth bool
 
+	// NoAuthNetworks if specified, restricts 'NO AUTHENTICATION REQUIRED' method to clients connecting
+	// from these networks (e.g. noauth for localhost or LAN, login required elsewhere). Client address
+	// is taken from RemoteAddr of the connection passed to Handle, the connections without address
+	// never get noauth method.
+	// OPTIONAL, default noauth is permitted for everyone when AllowNoAuth is set.
+	NoAuthNetworks []*net.IPNet
+
+	// Strict if set to true, disallows combining AllowNoAuth with other authentication methods unless
+	// NoAuthNetworks is specified: otherwise any client could bypass stronger auth by offering noauth.
+	// OPTIONAL, default disabled.
+	Strict bool
+
+	// PreferAuthentication if set to true, chooses the method identifying the client (username/password,
+	// GSSAPI, token) over 'NO AUTHENTICATION REQUIRED' when the client offers both, so the username is
+	// captured for logging, rules and quotas even though noauth would suffice. Noauth is chosen only if
+	// none of the other offered methods is enabled.
+	// OPTIONAL, default the first enabled method in the client preference order.
+	PreferAuthentication bool
+
 	// Authenticate If provided, enables USERNAME/PASSWORD authentication. This function
 	// checks user credentials and returns an error if authentication fails, causing the
 	// client to receive a DENIED status.
 	// OPTIONAL, default disabled.
 	Authenticate func(username, password []byte) error
 
+	// AuthenticateContext is Authenticate receiving context of the session: it carries AuthTimeout
+	// deadline, is canceled on session teardown, and SessionFromContext returns the session ID and
+	// client address of it. Use it for backends (SQL, LDAP) which have to respect timeouts or make
+	// per-client decisions. Mutually exclusive with Authenticate.
+	// OPTIONAL, default disabled.
+	AuthenticateContext func(ctx context.Context, username, password []byte) error
+
+	// MinCredentialLength and MaxCredentialLength bound the length in bytes of username and password
+	// received in USERNAME/PASSWORD subnegotiation. RFC 1929 allows from 1 up to 255 bytes, zero values
+	// stand for these bounds.
+	// OPTIONAL.
+	MinCredentialLength int
+	MaxCredentialLength int
+
+	// AllowEmptyCredentials if set to true, accepts empty username or password (ULEN or PLEN is 0).
+	// It deviates from RFC 1929, but some clients send empty password.
+	// OPTIONAL, default disabled.
+	AllowEmptyCredentials bool
+
+	// ValidateUTF8 if set to true, rejects username and password which are not valid UTF-8 strings.
+	// OPTIONAL, default disabled.
+	ValidateUTF8 bool
+
 	// GSSAPI enables GSS-API authentication method.
 	// This func is wantCalled whenever new GSSAPI client connects to get an object
 	// implementing GSSAPI interface.
 	// OPTIONAL, default disabled.
 	GSSAPI func() (GSSAPI, error)
 
+	// GSSAPIContext is GSSAPI receiving context of the session (see AuthenticateContext).
+	// Mutually exclusive with GSSAPI.
+	// OPTIONAL, default disabled.
+	GSSAPIContext func(ctx context.Context) (GSSAPI, error)
+
+	// Token if specified, enables shared secret authentication of private method TokenMethod for
+	// trusted sidecars where user databases are overkill but noauth is too permissive. The client
+	// sends VER X'01', LEN, TOKEN and gets the reply of username/password method. For clients which
+	// can't speak private methods use TokenAuthenticator as Authenticate.
+	// OPTIONAL, default disabled.
+	Token string
+
+	// TokenMethod is the method code of Token authentication (X'80' to X'FE').
+	// OPTIONAL, default X'80'.
+	TokenMethod byte
+
+	// AuthTimeout limits the time authentication of the client takes, it's the deadline of the context
+	// passed to AuthenticateContext and GSSAPIContext.
+	// OPTIONAL, default no timeout.
+	AuthTimeout time.Duration
+
+	// AuthCacheTTL if set, remembers client IPs for AuthCacheTTL after successful USERNAME/PASSWORD
+	// login: subsequent sessions from the IP offering 'NO AUTHENTICATION REQUIRED' method skip
+	// authentication and get the username of the login (even if AllowNoAuth is disabled). It spares
+	// slow auth backends from browsers opening dozens of parallel tunnels. Don't enable it if clients
+	// share IPs (NAT, other proxies): anyone behind the IP gets access of the logged in user.
+	// OPTIONAL, default disabled.
+	AuthCacheTTL time.Duration
+
+	// AuthCacheSize limits the number of client IPs remembered by AuthCacheTTL, the least recently
+	// used ones are forgotten first.
+	// OPTIONAL, default 4096.
+	AuthCacheSize int
+
+	// MaxGSSTokenSize limits size of GSSAPI tokens accepted from the client during authentication and
+	// of the encapsulated messages afterward, so a malicious client can't force 64KB allocation per
+	// message. Oversized tokens are refused with GSSAPI abort message (RFC 1961).
+	// OPTIONAL, default 65535 bytes (protocol maximum).
+	MaxGSSTokenSize int
+
+	// GSSAPINEC enables compatibility with legacy clients of "GSSAPI (NEC)" variant: the protection
+	// level message carrying the bare octet instead of gss_wrap() token is accepted and replied in
+	// kind, and GSSAPI is offered under private method X'86' as well. RFC 1961 clients are served
+	// as usual. Requires GSSAPI or GSSAPIContext.
+	// OPTIONAL, default disabled.
+	GSSAPINEC bool
+
+	// AuthFailureDelay delays the failure reply of rejected credentials by random time up to
+	// AuthFailureDelay (RFC 1928 allows closing within 10 seconds), the jitter makes response timing
+	// useless to tell which credentials check has failed. Read errors and malformed messages close
+	// the connection at once.
+	// OPTIONAL, default closes the connection immediately.
+	AuthFailureDelay time.Duration
+
+	// ReplyAddress selects BND.ADDR of CONNECT replies for clients picky about the address family,
+	// see ReplyAddress.
+	// OPTIONAL, default the local address of the upstream connection.
+	ReplyAddress ReplyAddress
+
+	// AdvertisedAddrs are IPv4 and IPv6 addresses replied with ReplyAdvertisedAddr, e.g. public
+	// addresses of the proxy behind NAT.
+	// OPTIONAL.
+	AdvertisedAddrs []net.IP
+
+	// FailureStatus if set, replaces status of every command failure reply, so external scanners
+	// can't fingerprint rule sets or enumerate internal networks by distinct reply codes
+	// (e.g. wire.StatusHostUnreachable for everything). Errors passed to onError keep the real cause.
+	// OPTIONAL, default the status tells the failure reason.
+	FailureStatus wire.Status
+
+	// FailureJitter delays command failure replies by random time up to FailureJitter (no more than
+	// 10 seconds), so the reply timing doesn't tell refused destinations from denied ones.
+	// OPTIONAL, default failures are replied immediately.
+	FailureJitter time.Duration
+
+	// FailureLinger is the max time the proxy waits for the client to close the connection after
+	// command failure reply: the proxy half-closes the connection and drains the client, so the reply
+	// isn't lost to RST of unread data, clients not closing in time are reset. Along with FailureJitter
+	// it's limited by 10 seconds RFC 1928 allows to terminate the connection after the failure.
+	// OPTIONAL, default the connection is closed right after the reply.
+	FailureLinger time.Duration
+
+	// TarpitDuration if specified, holds connections of clients failing authentication or denied
+	// (not allowed reply) open for TarpitDuration after the failure reply, reading them slowly,
+	// to slow down scanners. It departs from RFC 1928 which expects the connection to be closed within
+	// 10 seconds after the failure, so enable it on public-facing proxies only.
+	// OPTIONAL, default connections are closed as usual.
+	TarpitDuration time.Duration
+
+	// TarpitMaxConns limits the number of connections held in the tarpit at once, denied clients
+	// beyond it are closed as usual. See SOCKS5.Tarpitted.
+	// OPTIONAL, default 256.
+	TarpitMaxConns int
+
+	// MessageTimeout limits the time each client protocol message (greeting, authentication messages,
+	// request) takes to arrive after the previous reply, so slowloris clients dribbling the handshake
+	// byte by byte can't hold sessions. It's applied to connections supporting read deadlines (net.Conn).
+	// OPTIONAL, default no timeout.
+	MessageTimeout time.Duration
+
+	// MaxNegotiationBytes limits total bytes the client may send during negotiation (greeting,
+	// authentication, request): the session is aborted past the limit, so the client can't burn
+	// resources with long method lists or repeated GSSAPI exchanges.
+	// OPTIONAL, default no limit.
+	MaxNegotiationBytes int
+
+	// LenientParsing if set to true, tolerates violations of RFC 1928 in client requests known of
+	// embedded-device clients: non-zero RSV, domain names padded with NUL bytes or longer than
+	// 253 bytes. Tolerated violations are reported to onError of Handle as ErrProtocolDeviation
+	// and the session goes on.
+	// OPTIONAL, default requests are validated strictly.
+	LenientParsing bool
+
+	// Quirks is compatibility settings for broken clients (reply timing, coalescing of writes,
+	// tolerance of malformed requests). Use SOCKS5.WithQuirks to apply them to some listeners only.
+	// OPTIONAL, default the standard behavior.
+	Quirks Quirks
+
+	// EarlyData selects how data the client sends after the CONNECT request before the reply is
+	// handled: relayed after the reply, forwarded to the destination right after connecting or
+	// rejected (see EarlyData).
+	// OPTIONAL, default EarlyDataRelay.
+	EarlyData EarlyData
+
+	// FastOpen if set to true, replies CONNECT succeeded once the destination has passed canaries and
+	// rules but before connecting to it, so clients send their first bytes (e.g. TLS ClientHello)
+	// meanwhile and save a round trip. The data is held until the connection is established and then
+	// goes to the destination at once. The reply carries zero address, and connect failures can't be
+	// replied: the client connection is closed (reset if the client has sent data) and the error is
+	// reported to onError of Handle.
+	// OPTIONAL, default CONNECT is replied once connected.
+	FastOpen bool
+
+	// Sessions is registry of live sessions, see SessionStore. Sessions are listed and killed with
+	// SOCKS5.Sessions and SOCKS5.Kill.
+	// OPTIONAL, default in-memory store of the process.
+	Sessions SessionStore
+
+	// MaxSessionsPerUser if positive, limits concurrent sessions of each authenticated username:
+	// commands beyond the limit wait for a slot up to SessionQueueTimeout and are rejected with
+	// notAllowed status and ErrTooManySessions then. Sessions without username (noauth) aren't
+	// limited. See SOCKS5.UserSessions.
+	// OPTIONAL, default unlimited.
+	MaxSessionsPerUser int
+
+	// SessionQueueTimeout is the max time the command beyond MaxSessionsPerUser waits for a session
+	// of the user to finish.
+	// OPTIONAL, default commands beyond the limit are rejected immediately.
+	SessionQueueTimeout time.Duration
+
+	// Rules if specified, checks CONNECT destination before connecting, returned error rejects
+	// the command with notAllowed status or the status of returned *RuleError. Domain name destinations are resolved first so the rules
+	// see resolved addresses (SessionInfo.ResolvedIPs) and IP based deny lists apply to them too:
+	// the built-in dialer then connects to the checked IP addresses instead of the domain name.
+	// Custom Connect and Egress.Connect still get the domain name, they may resolve it elsewhere.
+	// OPTIONAL.
+	Rules func(info SessionInfo) error
+
+	// RulesDryRun if set to true, makes Rules audit-only: violations are counted (see
+	// SOCKS5.RuleViolations and SOCKS5.RuleHits) and reported to OnRuleViolation, but the commands
+	// go on. Use it to validate a new ruleset against production traffic before enforcing it.
+	// OPTIONAL, default rules are enforced.
+	RulesDryRun bool
+
+	// OnRuleViolation if specified, is called with the session and the error of Rules let through
+	// in dry-run mode. Enforced violations are reported to onError of Handle as usual.
+	// OPTIONAL.
+	OnRuleViolation func(info SessionInfo, err error)
+
+	// AllowedPorts if specified, limits destination ports of CONNECT and UDP datagrams to the listed
+	// ones, e.g. []int{80, 443, 993}. Ports are checked before Rules and aren't affected by
+	// RulesDryRun, rejected commands are replied with notAllowed status and counted as violations of
+	// rule "ports" (see SOCKS5.RuleHits).
+	// OPTIONAL, default any port is allowed.
+	AllowedPorts []int
+
+	// DeniedPorts rejects destination ports as AllowedPorts does, e.g. []int{25, 465, 587}. It
+	// takes precedence over AllowedPorts.
+	// OPTIONAL.
+	DeniedPorts []int
+
+	// SessionDeadline if specified, returns the time the established session is terminated at,
+	// zero time means no limit. Both connections are closed at the deadline and ErrSessionExpired
+	// is reported to onError of Handle (see SOCKS5.ExpiredSessions). Use RulesFile.Deadline for
+	// time of day schedules and max session durations of the rules. The deadline isn't enforced
+	// when OnEstablished takes over the tunnel.
+	// OPTIONAL.
+	SessionDeadline func(info SessionInfo) time.Time
+
+	// MaxSessionDuration if specified, limits the lifetime of sessions counted from the accept: the
+	// established tunnel is terminated once it's over as SessionDeadline does (the earlier of both
+	// applies), ErrSessionExpired tells the limit. It protects from forgotten tunnels and recycles
+	// connections predictably, e.g. for egress IP rotation.
+	// OPTIONAL, default unlimited.
+	MaxSessionDuration time.Duration
+
+	// IdleTimeout if specified, closes established sessions (CONNECT and BIND tunnels) which have
+	// neither sent nor received data for that long, ErrSessionIdle tells the reason (see
+	// SOCKS5.ReapedSessions). Sessions are checked by the reaper every ReapInterval, so they may
+	// stay idle up to IdleTimeout+ReapInterval. Idle time is known for tcp connections on Linux only.
+	// OPTIONAL, default idle sessions aren't closed.
+	IdleTimeout time.Duration
+
+	// ReapInterval is the period the reaper checks established sessions for IdleTimeout. The reaper
+	// rechecks SessionDeadline and MaxSessionDuration as well, so the sessions outliving deadlines
+	// moved earlier since their tunnels were established (e.g. by the reloaded rules) are terminated.
+	// OPTIONAL, default 10 seconds (or IdleTimeout if shorter) when IdleTimeout is set, otherwise
+	// the reaper is disabled.
+	ReapInterval time.Duration
+
+	// Canaries if specified, marks decoy destinations: CONNECT attempts to them are reported to
+	// Canaries.Alert with the session details and replied with Canaries.Status, so compromised
+	// credentials or clients probing the network are detected. Canaries are checked before Rules
+	// and RewriteDestination. See SOCKS5.CanaryHits.
+	// OPTIONAL.
+	Canaries *Canaries
+
+	// Resolve resolves domain name destinations for Rules. Concurrent lookups of the same name
+	// are coalesced into a single call.
+	// OPTIONAL, default system resolver.
+	Resolve func(host string) ([]net.IP, error)
+
+	// Hosts pins domain names (case-insensitive, without wildcards) to addresses, e.g. internal IPs of
+	// split-horizon DNS, without touching /etc/hosts of the proxy machine. The entries are consulted
+	// before Resolve and aren't cached: CONNECT to pinned names dials the addresses whether or not
+	// Rules are specified, Rules see them as ResolvedIPs and RESOLVE command answers them.
+	// OPTIONAL.
+	Hosts map[string][]net.IP
+
+	// ResolveCacheTTL if set, caches answers of Resolve for ResolveCacheTTL. Answers older than that
+	// are still served for ResolveStaleTTL while the name is refreshed in background, so popular
+	// domains never wait for DNS. Failed lookups aren't cached.
+	// OPTIONAL, default answers aren't cached.
+	ResolveCacheTTL time.Duration
+	ResolveStaleTTL time.Duration
+
+	// ResolveCacheSize limits the number of cached domain names.
+	// OPTIONAL, default 4096.
+	ResolveCacheSize int
+
+	// AllowResolve if set to true, enables Tor extension commands RESOLVE (X'F0') and RESOLVE_PTR
+	// (X'F1'), so clients offload DNS to the proxy: the answer is returned in BND.ADDR of the reply
+	// (IPv4 address preferred). Names are resolved with Resolve, Rules don't apply. Enable it only
+	// if clients may see answers of the proxy DNS (e.g. names of the internal network).
+	// OPTIONAL, default disabled.
+	AllowResolve bool
+
+	// ResolvePTR resolves addresses to names for RESOLVE_PTR command.
+	// OPTIONAL, default system resolver.
+	ResolvePTR func(ip net.IP) ([]string, error)
+
 	// Connect establishes tcp sock connection to remote server. If not specified, default connect
 	// will be used that just use net.Dial to remote server.
 	//
@@ -99,6 +399,7 @@ type Options struct {
 	//  o  X'04' Host unreachable
 	//  o  X'05' Connection refused
 	//  o  X'06' TTL expired
+	// *RuleError sets the reply status explicitly.
 	//
 	// addressType here is type of addr in terms of SOCKS5 RFC1928, it's guarantee that value will be on of those:
 	// o  ATYP   address type of following address
@@ -108,11 +409,217 @@ type Options struct {
 	// OPTIONAL
 	Connect func(addressType int, addr []byte, port int) (net.Conn, error)
 
+	// ConnectTimeout limits the time the default Connect waits for the connection to the destination.
+	// On timeout the client gets TTL expired reply. It's not applied to custom Connect.
+	// OPTIONAL, default only operating system timeout applies (which may be minutes).
+	ConnectTimeout time.Duration
+
+	// DialerControl if specified, is called by the default Connect (and egresses of Router with LocalIP)
+	// on each socket before connecting, see net.Dialer.Control. Use it to set socket options,
+	// e.g. BindToDevice to egress via the specific interface on hosts with multiple WAN links.
+	// It's not applied to custom Connect.
+	// OPTIONAL.
+	DialerControl func(network, address string, c syscall.RawConn) error
+
+	// SocketOptions tune tcp sockets of client and upstream connections (TCP_NODELAY, buffer sizes,
+	// DSCP marking, TCP_USER_TIMEOUT).
+	// OPTIONAL, default system defaults.
+	SocketOptions SocketOptions
+
+	// Router if specified, selects egress of the session by its authenticated username or client address:
+	// direct connection, connection from the specific local IP or through an upstream proxy.
+	// See StaticRouter for map based implementation. Returned error rejects the command the same way
+	// Rules errors do.
+	// OPTIONAL, default all sessions connect with Connect.
+	Router Router
+
+	// RewriteDestination if specified, is called before Connect to rewrite the requested destination
+	// (map legacy hostnames to new ones, force specific ports for staged migrations behind the proxy).
+	// It gets and returns destination in terms of Connect arguments. Replies to the client still carry
+	// the requested destination. Returned error rejects the command the same way Connect errors do.
+	// Rules and AllowedPorts check the rewritten destination (resolved addresses are of the rewritten
+	// name), canaries check the requested one. See StaticRewrite for map based implementation.
+	// OPTIONAL.
+	RewriteDestination func(addressType int, addr []byte, port int) (int, []byte, int, error)
+
 	// Listen returns listener to accept incoming connections for protocol BIND operation:
-	// incoming traffic from outside to client sock.
+	// incoming traffic from outside to client sock. Info has the client identity and the requested
+	// DST.ADDR & DST.PORT, so the listener port or interface can be chosen per client.
 	// If not specified the SOCKS5 BIND operation will be rejected with notAllowed status.
 	// OPTIONAL.
-	Listen func() (net.Listener, error)
+	Listen func(info SessionInfo) (net.Listener, error)
+
+	// BindTimeout limits the time BIND command waits for the incoming connection after the first
+	// reply, on timeout the client gets TTL expired second reply.
+	// OPTIONAL, default waits until the client closes the connection.
+	BindTimeout time.Duration
+
+	// BindExpectPeer makes BIND command wait for the incoming connection from the address requested
+	// by the client (DST.ADDR) instead of binding to the first arrival: connections from other peers
+	// are closed and accepting goes on until the expected peer connects or BindTimeout expires.
+	// Unspecified DST.ADDR (0.0.0.0 or ::) matches any peer, domain names are resolved.
+	// OPTIONAL, default binds to the first incoming connection.
+	BindExpectPeer bool
+
+	// OnBind if specified, reports BIND command progress: it's called when the listener is opened and
+	// the first reply is sent (event.Peer is nil), and then when the incoming connection is accepted or
+	// accepting fails (event.Err is set). Closed connections from unexpected peers (see BindExpectPeer)
+	// are reported with both event.Peer and event.Err set.
+	// Use it to coordinate with the peer or collect timings.
+	// OPTIONAL.
+	OnBind func(info SessionInfo, event BindEvent)
+
+	// AllowUDPAssociate enables UDP ASSOCIATE command: datagrams of the client are relayed through
+	// a UDP socket opened per association until the control connection is closed. Destinations of
+	// datagrams are checked by Rules (SessionInfo has the datagram destination), replies are accepted
+	// only from the destinations the client has sent datagrams to. Fragmented datagrams are dropped.
+	// OnEstablished and Filter don't apply to UDP associations.
+	// OPTIONAL, default UDP ASSOCIATE is replied with command not supported status.
+	AllowUDPAssociate bool
+
+	// UDPPortRange limits ports of the sockets clients send datagrams to, so firewalls open the range
+	// only. Associations are rejected when all ports of the range are taken.
+	// OPTIONAL, default ports are chosen by the system.
+	UDPPortRange PortRange
+
+	// UDPMaxDatagramSize limits payload of relayed datagrams (up to 65507 bytes), larger ones are
+	// dropped. Each association takes two buffers of that size.
+	// OPTIONAL, default 65507 bytes.
+	UDPMaxDatagramSize int
+
+	// UDPBufferSize sets receive and send buffers of UDP relay sockets (SO_RCVBUF and SO_SNDBUF),
+	// raise it for bursty traffic so datagrams aren't dropped by the kernel.
+	// OPTIONAL, default system buffers.
+	UDPBufferSize int
+
+	// UDPIdleTimeout terminates associations which haven't relayed datagrams in either direction
+	// for that long, the control connection is closed.
+	// OPTIONAL, default associations live as long as the control connection.
+	UDPIdleTimeout time.Duration
+
+	// UDPBatchSize is the max number of datagrams read or written per syscall (recvmmsg and sendmmsg
+	// on Linux), so floods of small datagrams (DNS, QUIC) take fewer syscalls. Buffers of batches
+	// are shared by associations and taken only while datagrams are relayed. Other platforms relay
+	// datagrams one by one.
+	// OPTIONAL, default 32, 1 disables batching.
+	UDPBatchSize int
+
+	// MaxUDPAssociationsPerClient limits concurrent UDP associations per client IP, further requests
+	// are rejected with not allowed status.
+	// OPTIONAL, default unlimited.
+	MaxUDPAssociationsPerClient int
+
+	// UDPInterceptDNS answers A and AAAA queries of datagrams sent to port 53 from the resolver of
+	// the proxy (see Hosts and ResolveCacheTTL) instead of relaying them, so clients get the same
+	// answers and policy as the proxy itself. Queried names are checked against Rules as domain
+	// destinations of port 53: denied names are answered REFUSED, queries of other types are
+	// relayed for allowed names only. Set it per listener with the Options of each SOCKS5 instance.
+	// OPTIONAL, default DNS queries are relayed as other datagrams.
+	UDPInterceptDNS bool
+
+	// OnEstablished if specified, takes over the tunnel after successful CONNECT or BIND command
+	// instead of the built-in relay. It's called once the success reply has been sent to the client,
+	// so client and upstream are ready to transfer data: use it to implement custom relaying
+	// (traffic inspection, debugging, protocol-aware routing).
+	//
+	// OnEstablished owns both connections and is responsible for closing them.
+	// OPTIONAL, default relay copies data in both directions propagating half-close.
+	OnEstablished func(client io.ReadWriteCloser, upstream net.Conn, info SessionInfo)
+
+	// OnAuthenticated if specified, is called after successful authentication before the client
+	// request is read, info has the authenticated identity only. Returned error closes the session.
+	// Use it for per-identity checks which don't depend on the destination (quotas, schedules).
+	// OPTIONAL.
+	OnAuthenticated func(info SessionInfo) error
+
+	// Commands registers handlers of custom command codes (e.g. reserved X'F0'..X'FF' of protocol
+	// extensions), built-in CONNECT, BIND and UDP ASSOCIATE can't be overridden. The request is parsed
+	// and validated as usual except DST.PORT may be zero, then the handler takes over the session.
+	// OPTIONAL, default unknown commands are replied with command not supported status.
+	Commands map[byte]func(cmd Command) error
+
+	// CommandHandlers replaces handling of the commands by code, including built-in CONNECT, BIND and
+	// UDP ASSOCIATE (e.g. BIND allocating listeners from a port broker). Unlike Commands the package
+	// still parses and validates the request, encodes the replies and relays the tunnel, see
+	// CommandHandler. Codes other than built-in ones may have zero DST.PORT as in Commands.
+	// OPTIONAL, default built-in handling.
+	CommandHandlers map[byte]CommandHandler
+
+	// Filter if specified, is called per session once the tunnel is established to get StreamFilter
+	// plugged into the built-in relay (TLS SNI sniffing, data-loss-prevention scanning, rewriting).
+	// Returning nil filter relays the session as is, returning error closes the tunnel.
+	// Filter is not applied when OnEstablished takes over the tunnel.
+	// OPTIONAL.
+	Filter func(info SessionInfo) (StreamFilter, error)
+
+	// RelayBufferSize is the max size of buffers of the built-in relay (up to 1MB). Buffers start
+	// small and grow for high-throughput flows, so idle sessions take little memory. Sessions between
+	// tcp connections on Linux are relayed with zero-copy splice(2) without buffers.
+	// OPTIONAL, default 32KB.
+	RelayBufferSize int
+
+	// BandwidthLimit limits relay bandwidth of all sessions in bytes per second (both directions).
+	// The bandwidth is shared fairly instead of first-come-first-served: active users get shares
+	// proportional to their weights (see UserBandwidth) and sessions of the user share it equally,
+	// so heavy sessions don't starve the others. Limited sessions are copied in user space instead
+	// of splice(2). UDP associations aren't limited.
+	// OPTIONAL, default unlimited.
+	BandwidthLimit int64
+
+	// UserBandwidth returns the weight and the bandwidth limit of the user (see Bandwidth), it's
+	// called when the first session of the user is relayed. Sessions without username are
+	// accounted to the user "".
+	// OPTIONAL, default users have weight 1 and no limit of their own.
+	UserBandwidth func(username string) Bandwidth
+
+	// SessionBandwidthLimit limits bandwidth of every relayed session in bytes per second.
+	// OPTIONAL, default unlimited.
+	SessionBandwidthLimit int64
+
+	// Metrics if specified, receives live transfer rates of relayed sessions every ThroughputInterval
+	// while they are active: gauges "relay.<session id>.up" (client to destination) and
+	// "relay.<session id>.down" in bytes per second, zeroed once the session is over. Session IDs map
+	// to SOCKS5.Sessions, so the sink can label top talkers by user or client. Metered sessions are
+	// copied in user space instead of splice(2) to count bytes as they go.
+	// Latencies of sessions are reported as "latency.auth", "latency.dial" and "latency.ttfb" gauges
+	// in seconds (see SessionInfo.Timings).
+	// OPTIONAL, default throughput and latencies aren't reported.
+	Metrics MetricsSink
+
+	// ThroughputInterval is the period of reporting transfer rates to Metrics.
+	// OPTIONAL, default 10 seconds.
+	ThroughputInterval time.Duration
+
+	// TopStatsSize if positive, enables rolling statistics of the most requested destinations and
+	// users transferred the most bytes (see SOCKS5.TopStats). Memory is bounded: up to TopStatsSize
+	// destinations and users are counted per window, rare ones give way to frequent ones. Relayed
+	// sessions of authenticated users are copied in user space instead of splice(2) to count bytes.
+	// OPTIONAL, default disabled.
+	TopStatsSize int
+
+	// TopStatsWindow is the period of top statistics: counts of the current and the previous
+	// windows are reported.
+	// OPTIONAL, default 1 hour.
+	TopStatsWindow time.Duration
+
+	// EventLogSize if positive, keeps up to EventLogSize recent session events (accepted, method
+	// chosen, command, reply, errors, close reason) in memory, see SOCKS5.Events and RegisterDebug.
+	// Use it to debug failing clients without verbose logging of the whole fleet.
+	// OPTIONAL, default disabled.
+	EventLogSize int
+
+	// SessionEvents if specified, receives start and end events of sessions: the start once the
+	// tunnel is established (CONNECT, BIND, UDP ASSOCIATE and transparent sessions), the end with
+	// relayed bytes and the close reason once the session is over. Sessions failed before the tunnel
+	// is established aren't reported. Use WebhookSink to post the events to external systems.
+	// OPTIONAL, default events aren't reported.
+	SessionEvents SessionEventSink
+
+	// LeakTimeout if specified, enables the debug check of goroutines spawned by sessions (relay
+	// copying): sessions whose goroutines are still running LeakTimeout after the session is over
+	// are reported to onError of Handle as ErrGoroutineLeak and counted by SOCKS5.Goroutines.
+	// OPTIONAL, default disabled.
+	LeakTimeout time.Duration
 }
 
 // New creates and returns a new object implemented the SOCKS5 protocol handler configured with the provided options.
@@ -153,16 +660,248 @@ func New(opts Options) (*SOCKS5, error) {
 	}
 
 	// set up CONNECT command callback
-	connectFn := defaultConnect
+	connectFn := defaultConnect(opts.ConnectTimeout, nil, opts.DialerControl)
 	if opts.Connect != nil {
 		// use custom fn
 		connectFn = opts.Connect
 	}
 
+	if opts.AuthFailureDelay < 0 || opts.AuthFailureDelay > maxFailureDelay {
+		return nil, fmt.Errorf("invalid auth failure delay: %v", opts.AuthFailureDelay)
+	}
+
+	for code := range opts.Commands {
+		switch commandType(code) {
+		case connect, bind, udpAssoc:
+			return nil, fmt.Errorf("custom command %d overrides built-in one", code)
+		case resolveName, resolvePTR:
+			if opts.AllowResolve {
+				return nil, fmt.Errorf("custom command %d overrides resolve extension", code)
+			}
+		}
+	}
+
+	for code, handler := range opts.CommandHandlers {
+		if handler == nil {
+			return nil, fmt.Errorf("nil handler of command %d", code)
+		}
+		if _, ok := opts.Commands[code]; ok {
+			return nil, fmt.Errorf("command %d has both custom command and handler", code)
+		}
+		if opts.AllowResolve && (commandType(code) == resolveName || commandType(code) == resolvePTR) {
+			return nil, fmt.Errorf("command handler %d overrides resolve extension", code)
+		}
+	}
+
+	hosts, err := parseHosts(opts.Hosts)
+	if err != nil {
+		return nil, fmt.Errorf("invalid hosts: %v", err)
+	}
+	resolver := newResolver(opts.Resolve, opts.ResolveCacheTTL, opts.ResolveStaleTTL, opts.ResolveCacheSize)
+	resolver.hosts = hosts
+
+	lookupAddr := opts.ResolvePTR
+	if lookupAddr == nil {
+		lookupAddr = func(ip net.IP) ([]string, error) {
+			return net.DefaultResolver.LookupAddr(context.Background(), ip.String())
+		}
+	}
+
+	if err := opts.SocketOptions.validate(); err != nil {
+		return nil, err
+	}
+
+	if opts.ReplyAddress < ReplyLocalAddr || opts.ReplyAddress > ReplyZeroAddr {
+		return nil, fmt.Errorf("invalid reply address: %d", opts.ReplyAddress)
+	}
+	for _, ip := range opts.AdvertisedAddrs {
+		if len(ip) != net.IPv4len && len(ip) != net.IPv6len {
+			return nil, fmt.Errorf("invalid advertised address: %v", ip)
+		}
+	}
+
+	if opts.FailureStatus > wire.StatusAddressNotSupported {
+		return nil, fmt.Errorf("invalid failure status: %d", opts.FailureStatus)
+	}
+	if opts.FailureJitter < 0 || opts.FailureJitter > maxFailureDelay {
+		return nil, fmt.Errorf("invalid failure jitter: %v", opts.FailureJitter)
+	}
+	if opts.FailureLinger < 0 || opts.FailureJitter+opts.FailureLinger > maxFailureDelay {
+		return nil, fmt.Errorf("invalid failure linger: %v", opts.FailureLinger)
+	}
+
+	for _, ports := range [][]int{opts.AllowedPorts, opts.DeniedPorts} {
+		for _, port := range ports {
+			if port < 1 || port > 65535 {
+				return nil, fmt.Errorf("invalid port: %d", port)
+			}
+		}
+	}
+
+	if opts.Canaries != nil && opts.Canaries.Status > wire.StatusAddressNotSupported {
+		return nil, fmt.Errorf("invalid canary status: %d", opts.Canaries.Status)
+	}
+
+	if opts.EarlyData < EarlyDataRelay || opts.EarlyData > EarlyDataReject {
+		return nil, fmt.Errorf("invalid early data handling: %d", opts.EarlyData)
+	}
+
+	if opts.TarpitDuration < 0 {
+		return nil, fmt.Errorf("invalid tarpit duration: %v", opts.TarpitDuration)
+	}
+	if opts.TarpitMaxConns < 0 {
+		return nil, fmt.Errorf("invalid tarpit max conns: %d", opts.TarpitMaxConns)
+	}
+
+	if opts.TopStatsSize < 0 {
+		return nil, fmt.Errorf("invalid top stats size: %d", opts.TopStatsSize)
+	}
+	if opts.TopStatsWindow < 0 {
+		return nil, fmt.Errorf("invalid top stats window: %v", opts.TopStatsWindow)
+	}
+	if opts.MaxSessionDuration < 0 {
+		return nil, fmt.Errorf("invalid max session duration: %v", opts.MaxSessionDuration)
+	}
+	if opts.EventLogSize < 0 {
+		return nil, fmt.Errorf("invalid event log size: %d", opts.EventLogSize)
+	}
+	if opts.MaxSessionsPerUser < 0 {
+		return nil, fmt.Errorf("invalid max sessions per user: %d", opts.MaxSessionsPerUser)
+	}
+	if opts.SessionQueueTimeout < 0 {
+		return nil, fmt.Errorf("invalid session queue timeout: %v", opts.SessionQueueTimeout)
+	}
+	if opts.RelayBufferSize < 0 || opts.RelayBufferSize > maxRelayBufferSize {
+		return nil, fmt.Errorf("invalid relay buffer size: %d", opts.RelayBufferSize)
+	}
+
+	if opts.BandwidthLimit < 0 {
+		return nil, fmt.Errorf("invalid bandwidth limit: %d", opts.BandwidthLimit)
+	}
+	if opts.SessionBandwidthLimit < 0 {
+		return nil, fmt.Errorf("invalid session bandwidth limit: %d", opts.SessionBandwidthLimit)
+	}
+
+	if opts.IdleTimeout < 0 {
+		return nil, fmt.Errorf("invalid idle timeout: %v", opts.IdleTimeout)
+	}
+	if opts.ReapInterval < 0 {
+		return nil, fmt.Errorf("invalid reap interval: %v", opts.ReapInterval)
+	}
+
+	if opts.LeakTimeout < 0 {
+		return nil, fmt.Errorf("invalid leak timeout: %v", opts.LeakTimeout)
+	}
+
+	if opts.MaxNegotiationBytes < 0 {
+		return nil, fmt.Errorf("invalid max negotiation bytes: %d", opts.MaxNegotiationBytes)
+	}
+
+	if !opts.UDPPortRange.valid() {
+		return nil, fmt.Errorf("invalid udp port range: %d-%d", opts.UDPPortRange.Min, opts.UDPPortRange.Max)
+	}
+	if opts.UDPMaxDatagramSize < 0 || opts.UDPMaxDatagramSize > maxUDPDatagramSize {
+		return nil, fmt.Errorf("invalid udp max datagram size: %d", opts.UDPMaxDatagramSize)
+	}
+	if opts.UDPBufferSize < 0 {
+		return nil, fmt.Errorf("invalid udp buffer size: %d", opts.UDPBufferSize)
+	}
+	if opts.UDPBatchSize < 0 || opts.UDPBatchSize > maxUDPBatchSize {
+		return nil, fmt.Errorf("invalid udp batch size: %d", opts.UDPBatchSize)
+	}
+	if opts.UDPIdleTimeout < 0 {
+		return nil, fmt.Errorf("invalid udp idle timeout: %v", opts.UDPIdleTimeout)
+	}
+	if opts.MaxUDPAssociationsPerClient < 0 {
+		return nil, fmt.Errorf("invalid max udp associations per client: %d", opts.MaxUDPAssociationsPerClient)
+	}
+
+	if opts.Quirks.MethodReplyDelay < 0 {
+		return nil, fmt.Errorf("invalid method reply delay: %v", opts.Quirks.MethodReplyDelay)
+	}
+
+	var sessions SessionStore = &MemorySessions{}
+	if opts.Sessions != nil {
+		sessions = opts.Sessions
+	}
+
+	if opts.Strict && opts.AllowNoAuth && len(auth) > 1 && len(opts.NoAuthNetworks) == 0 {
+		return nil, errors.New("strict mode: noauth along with other methods requires NoAuthNetworks")
+	}
+
+	expired := &atomic.Int64{}
+
 	return &SOCKS5{
-		auth:    auth,
-		listen:  opts.Listen,
-		connect: connectFn,
+		auth:       auth,
+		noAuthNets: opts.NoAuthNetworks,
+		preferAuth: opts.PreferAuthentication,
+		listen:     opts.Listen,
+		connect:    connectFn,
+		custom:     opts.Connect != nil,
+		router:     opts.Router,
+		timeout:    opts.ConnectTimeout,
+		control:    opts.DialerControl,
+		sockopts:   opts.SocketOptions,
+
+		onEstablished:  opts.OnEstablished,
+		onAuth:         opts.OnAuthenticated,
+		commands:       opts.Commands,
+		handlers:       opts.CommandHandlers,
+		filter:         opts.Filter,
+		rewrite:        opts.RewriteDestination,
+		onBind:         opts.OnBind,
+		bindTimeout:    opts.BindTimeout,
+		bindExpectPeer: opts.BindExpectPeer,
+		udp:            newUDPRelay(opts),
+
+		authTimeout:         opts.AuthTimeout,
+		authCache:           newAuthCache(opts.AuthCacheTTL, opts.AuthCacheSize),
+		authFailures:        newAuthFailureCounts(),
+		replyAddress:        opts.ReplyAddress,
+		advertisedAddrs:     opts.AdvertisedAddrs,
+		failureStatus:       commandStatus(opts.FailureStatus),
+		failureJitter:       opts.FailureJitter,
+		failureLinger:       opts.FailureLinger,
+		tarpit:              newTarpit(opts.TarpitDuration, opts.TarpitMaxConns),
+		messageTimeout:      opts.MessageTimeout,
+		maxNegotiationBytes: opts.MaxNegotiationBytes,
+		quirks:              opts.Quirks,
+		lenientParsing:      opts.LenientParsing,
+		earlyData:           opts.EarlyData,
+		fastOpen:            opts.FastOpen,
+
+		sessions:        sessions,
+		userSlots:       newUserSlots(opts.MaxSessionsPerUser, opts.SessionQueueTimeout),
+		rules:           opts.Rules,
+		rulesDryRun:     opts.RulesDryRun,
+		onRuleViolation: opts.OnRuleViolation,
+		ruleCounts:      &ruleCounts{},
+		ports:           newPortPolicy(opts.AllowedPorts, opts.DeniedPorts),
+		deadline:        opts.SessionDeadline,
+		maxDuration:     opts.MaxSessionDuration,
+		expired:         expired,
+		reaper:          newReaper(opts, expired),
+		resolver:        resolver,
+		canaries:        opts.Canaries.normalized(),
+		canaryHits:      &atomic.Int64{},
+
+		allowResolve: opts.AllowResolve,
+		lookupAddr:   lookupAddr,
+
+		stages:      &stageCounts{},
+		counts:      &sessionCounts{},
+		goroutines:  &goroutineCounts{},
+		spoofed:     &spoofCounts{},
+		leakTimeout: opts.LeakTimeout,
+		relayBuffer: opts.RelayBufferSize,
+		bandwidth:   newScheduler(opts),
+
+		metrics:            opts.Metrics,
+		throughputInterval: opts.ThroughputInterval,
+		replies:            &replyCounts{},
+		topStats:           newTopStats(opts.TopStatsSize, opts.TopStatsWindow),
+		events:             newEventLog(opts.EventLogSize),
+		sessionEvents:      opts.SessionEvents,
 	}, nil
 }
 
@@ -173,16 +912,84 @@ func getAuthHandlers(opts Options) (map[authMethod]authHandler, error) {
 		// enable no authenticate method
 		res[typeNoAuth] = &noAuth{}
 	}
+	if opts.Authenticate != nil && opts.AuthenticateContext != nil {
+		return nil, errors.New("both Authenticate and AuthenticateContext are specified")
+	}
+	if opts.GSSAPI != nil && opts.GSSAPIContext != nil {
+		return nil, errors.New("both GSSAPI and GSSAPIContext are specified")
+	}
+
+	authenticate := opts.AuthenticateContext
 	if opts.Authenticate != nil {
+		authenticate = func(_ context.Context, username, password []byte) error {
+			return opts.Authenticate(username, password)
+		}
+	}
+	gssapi := opts.GSSAPIContext
+	if opts.GSSAPI != nil {
+		gssapi = func(context.Context) (GSSAPI, error) {
+			return opts.GSSAPI()
+		}
+	}
+
+	if authenticate != nil {
 		// enable username/password method
+		policy, err := getCredentialPolicy(opts)
+		if err != nil {
+			return nil, err
+		}
+
 		res[typeLogin] = &usernameAuth{
-			authenticator: opts.Authenticate,
+			authenticator: authenticate,
+			policy:        policy,
+			rejectDelay:   opts.AuthFailureDelay,
 		}
 	}
-	if opts.GSSAPI != nil {
+	if gssapi != nil {
 		// enable gssapi interface
+		if opts.MaxGSSTokenSize < 0 || opts.MaxGSSTokenSize > gssMaxTokenSize {
+			return nil, fmt.Errorf("invalid max gssapi token size: %d", opts.MaxGSSTokenSize)
+		}
+
 		res[typeGSSAPI] = &gssapiAuth{
-			gssapi: opts.GSSAPI,
+			gssapi:       gssapi,
+			maxTokenSize: opts.MaxGSSTokenSize,
+			nec:          opts.GSSAPINEC,
+			rejectDelay:  opts.AuthFailureDelay,
+		}
+		if opts.GSSAPINEC {
+			res[necGSSAPIMethod] = &gssapiAuth{
+				gssapi:       gssapi,
+				maxTokenSize: opts.MaxGSSTokenSize,
+				code:         necGSSAPIMethod,
+				nec:          true,
+				rejectDelay:  opts.AuthFailureDelay,
+			}
+		}
+	} else if opts.GSSAPINEC {
+		return nil, errors.New("GSSAPINEC requires GSSAPI or GSSAPIContext")
+	}
+
+	if opts.Token != "" {
+		// enable shared secret private method
+		code := authMethod(defaultTokenMethod)
+		if opts.TokenMethod != 0 {
+			code = authMethod(opts.TokenMethod)
+		}
+		if code < minPrivateMethod || code > maxPrivateMethod {
+			return nil, fmt.Errorf("invalid token method: %#x", opts.TokenMethod)
+		}
+		if _, ok := res[code]; ok {
+			return nil, fmt.Errorf("token method %#x is taken by GSSAPI (NEC)", byte(code))
+		}
+		if len(opts.Token) > maxCredentialSize {
+			return nil, fmt.Errorf("too long token: %d bytes", len(opts.Token))
+		}
+
+		res[code] = &tokenAuth{
+			code:        code,
+			token:       []byte(opts.Token),
+			rejectDelay: opts.AuthFailureDelay,
 		}
 	}
 
@@ -193,6 +1000,27 @@ func getAuthHandlers(opts Options) (map[authMethod]authHandler, error) {
 	return res, nil
 }
 
+func getCredentialPolicy(opts Options) (credentialPolicy, error) {
+	minLength, maxLength := opts.MinCredentialLength, opts.MaxCredentialLength
+
+	if minLength < 0 || minLength > maxCredentialSize {
+		return credentialPolicy{}, fmt.Errorf("invalid min credential length: %d", minLength)
+	}
+	if maxLength < 0 || maxLength > maxCredentialSize {
+		return credentialPolicy{}, fmt.Errorf("invalid max credential length: %d", maxLength)
+	}
+	if maxLength > 0 && minLength > maxLength {
+		return credentialPolicy{}, fmt.Errorf("min credential length %d exceeds max %d", minLength, maxLength)
+	}
+
+	return credentialPolicy{
+		allowEmpty: opts.AllowEmptyCredentials,
+		minLength:  minLength,
+		maxLength:  maxLength,
+		utf8:       opts.ValidateUTF8,
+	}, nil
+}
+
 // Handle initiates and processes the SOCKS5 protocol over the given connection. User must close
 // the connection himself.
 // This function manages all stages of the SOCKS5 protocol, including:
@@ -210,21 +1038,135 @@ func getAuthHandlers(opts Options) (map[authMethod]authHandler, error) {
 //	         the handling of the SOCKS5 protocol. The error is passed to this function for
 //	         logging or handling purposes. Use nil here if it doesn't need.
 func (s SOCKS5) Handle(conn io.ReadWriteCloser, onError func(error)) {
+	s.handle(conn, "", onError)
+}
+
+// HandleAuthenticated is Handle of the client authenticated at a higher layer (e.g. by TLS client
+// certificate or WebSocket auth) with the identity username. The wire handshake still takes place,
+// but 'NO AUTHENTICATION REQUIRED' method is forced whatever methods are enabled by Options: the
+// session gets the username as if the client has logged in, so rules, per-user limits, statistics
+// and OnAuthenticated see it. Clients not offering noauth method are rejected. User must close the
+// connection himself.
+func (s SOCKS5) HandleAuthenticated(conn io.ReadWriteCloser, username string, onError func(error)) {
+	if username == "" {
+		if onError != nil {
+			onError(errors.New("handle authenticated: empty username"))
+		}
+		return
+	}
+
+	s.handle(conn, username, onError)
+}
+
+// handle serves the client connection, non-empty identity is the username the client has been
+// authenticated with by the embedder.
+func (s SOCKS5) handle(conn io.ReadWriteCloser, identity string, onError func(error)) {
 	state := state{
-		opts: s,
-		conn: conn,
+		opts:        s,
+		identity:    identity,
+		negotiation: newNegotiationConn(conn, s.messageTimeout, s.maxNegotiationBytes),
+		started:     time.Now(),
 	}
 
-	fnState, err := initial(&state)
-	for {
-		if err != nil && onError != nil {
-			onError(err)
+	state.conn = conn
+	if state.negotiation != nil {
+		state.conn = state.negotiation
+	}
+	if !s.quirks.WriteThrough {
+		state.buffered.ReadWriteCloser = state.conn
+		state.conn = &state.buffered
+	}
+
+	if c, ok := conn.(interface{ RemoteAddr() net.Addr }); ok {
+		state.clientAddr = c.RemoteAddr()
+	}
+
+	if err := s.sockopts.apply(conn); err != nil {
+		if onError != nil {
+			onError(fmt.Errorf("client socket options: %w", err))
 		}
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	state.ctx = ctx
+
+	kill := func() {
+		cancel()
+		_ = conn.Close()
+	}
+	defer state.register(kill)()
+	// replies held for pipelined messages go to the client before it's closed
+	defer func() { _ = flush(state.conn) }()
+
+	defer state.traceSession()()
+	defer state.notifySession()()
+	defer state.watchLeaks(onError)
+	defer state.freeSlot()
+	defer state.reap(conn, kill, onError)()
+
+	state.enter(stageGreeting)
+	defer state.enter(stageNone)
+
+	s.run(&state, initial, onError)
+}
 
-		if fnState == nil {
-			break
+// HandleTransparent tunnels the connection which has been transparently redirected to the proxy
+// (iptables REDIRECT/TPROXY) to its original destination dst. Redirected clients don't speak SOCKS5,
+// so no negotiation takes place: the session is handled as authenticated CONNECT command going through
+// the same Connect callback, StreamFilter and hooks as SOCKS5 sessions. User must close the connection
+// himself. See transparent subpackage to obtain original destination of the connection.
+func (s SOCKS5) HandleTransparent(conn net.Conn, dst net.Addr, onError func(error)) {
+	addrType, addr, port, err := parseAddress(dst)
+	if err != nil {
+		if onError != nil {
+			onError(fmt.Errorf("original destination: %w", err))
 		}
+		return
+	}
+
+	state := state{
+		opts:       s,
+		conn:       conn,
+		clientAddr: conn.RemoteAddr(),
+		redirected: true,
+		started:    time.Now(),
+		command: commandRequest{
+			version:     protoVersion,
+			commandType: connect,
+			addressType: addrType,
+			addr:        addr,
+			port:        uint16(port), // nolint
+		},
+	}
+
+	kill := func() { _ = conn.Close() }
 
-		fnState, err = fnState(&state)
+	defer state.traceSession()()
+	defer state.notifySession()()
+	defer state.watchLeaks(onError)
+	defer state.register(kill)()
+	defer state.reap(conn, kill, onError)()
+	defer state.enter(stageNone)
+
+	s.run(&state, runTransparent, onError)
+}
+
+// run runs the protocol state machine from the given transition.
+func (s SOCKS5) run(state *state, fnState transition, onError func(error)) {
+	s.counts.started()
+
+	for fnState != nil {
+		var err error
+
+		fnState, err = fnState(state)
+		if err != nil {
+			state.traceError(err)
+			state.opts.counts.failed(state.stage)
+		}
+		if err != nil && onError != nil {
+			onError(err)
+		}
 	}
 }
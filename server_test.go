@@ -1,11 +1,16 @@
 package proxyme
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"net"
 	"testing"
+	"time"
+
+	"github.com/dblokhin/proxyme/testsupport"
+	"github.com/dblokhin/proxyme/wire"
 )
 
 func Test_getAuthHandlers(t *testing.T) {
@@ -147,6 +152,9 @@ func TestNew(t *testing.T) {
 	type args struct {
 		opts Options
 	}
+	// allowed ports of spare capacity, New must not write into it
+	spare := append(make([]int, 0, 2), 80)
+
 	tests := []struct {
 		name  string
 		args  args
@@ -165,6 +173,560 @@ func TestNew(t *testing.T) {
 				return nil
 			},
 		},
+		{
+			name: "invalid credential length bounds",
+			args: args{
+				opts: Options{
+					Authenticate: func(username, password []byte) error {
+						return nil
+					},
+					MinCredentialLength: 10,
+					MaxCredentialLength: 5,
+				},
+			},
+			check: func(socks5 *SOCKS5, err error) error {
+				if err == nil {
+					return fmt.Errorf("expected error but got nil")
+				}
+				if socks5 != nil {
+					return fmt.Errorf("expected nil return")
+				}
+				return nil
+			},
+		},
+		{
+			name: "invalid max gssapi token size",
+			args: args{
+				opts: Options{
+					GSSAPI: func() (GSSAPI, error) {
+						return nil, nil
+					},
+					MaxGSSTokenSize: 1 << 16,
+				},
+			},
+			check: func(socks5 *SOCKS5, err error) error {
+				if err == nil {
+					return fmt.Errorf("expected error but got nil")
+				}
+				return nil
+			},
+		},
+		{
+			name: "both authenticate callbacks",
+			args: args{
+				opts: Options{
+					Authenticate: func(username, password []byte) error {
+						return nil
+					},
+					AuthenticateContext: func(ctx context.Context, username, password []byte) error {
+						return nil
+					},
+				},
+			},
+			check: func(socks5 *SOCKS5, err error) error {
+				if err == nil {
+					return fmt.Errorf("expected error but got nil")
+				}
+				return nil
+			},
+		},
+		{
+			name: "context authenticate",
+			args: args{
+				opts: Options{
+					AuthenticateContext: func(ctx context.Context, username, password []byte) error {
+						return nil
+					},
+				},
+			},
+			check: func(socks5 *SOCKS5, err error) error {
+				if err != nil {
+					return fmt.Errorf("unexpected error: %w", err)
+				}
+				if _, ok := socks5.auth[typeLogin]; !ok {
+					return fmt.Errorf("username/password method isn't enabled")
+				}
+				return nil
+			},
+		},
+		{
+			name: "custom command overrides built-in one",
+			args: args{
+				opts: Options{
+					AllowNoAuth: true,
+					Commands: map[byte]func(cmd Command) error{
+						byte(connect): func(cmd Command) error { return nil },
+					},
+				},
+			},
+			check: func(socks5 *SOCKS5, err error) error {
+				if err == nil {
+					return fmt.Errorf("expected error but got nil")
+				}
+				return nil
+			},
+		},
+		{
+			name: "command handler along with custom command",
+			args: args{
+				opts: Options{
+					AllowNoAuth: true,
+					Commands: map[byte]func(cmd Command) error{
+						0xF0: func(cmd Command) error { return nil },
+					},
+					CommandHandlers: map[byte]CommandHandler{
+						0xF0: CommandHandlerFunc(func(s *CommandSession) error { return nil }),
+					},
+				},
+			},
+			check: func(socks5 *SOCKS5, err error) error {
+				if err == nil {
+					return fmt.Errorf("expected error but got nil")
+				}
+				return nil
+			},
+		},
+		{
+			name: "nil command handler",
+			args: args{
+				opts: Options{
+					AllowNoAuth:     true,
+					CommandHandlers: map[byte]CommandHandler{byte(bind): nil},
+				},
+			},
+			check: func(socks5 *SOCKS5, err error) error {
+				if err == nil {
+					return fmt.Errorf("expected error but got nil")
+				}
+				return nil
+			},
+		},
+		{
+			name: "invalid failure status",
+			args: args{
+				opts: Options{
+					AllowNoAuth:   true,
+					FailureStatus: 0x80,
+				},
+			},
+			check: func(socks5 *SOCKS5, err error) error {
+				if err == nil {
+					return fmt.Errorf("expected error but got nil")
+				}
+				return nil
+			},
+		},
+		{
+			name: "failure jitter exceeds rfc limit",
+			args: args{
+				opts: Options{
+					AllowNoAuth:   true,
+					FailureJitter: time.Minute,
+				},
+			},
+			check: func(socks5 *SOCKS5, err error) error {
+				if err == nil {
+					return fmt.Errorf("expected error but got nil")
+				}
+				return nil
+			},
+		},
+		{
+			name: "token method isn't private",
+			args: args{
+				opts: Options{
+					Token:       "secret",
+					TokenMethod: byte(typeLogin),
+				},
+			},
+			check: func(socks5 *SOCKS5, err error) error {
+				if err == nil {
+					return fmt.Errorf("expected error but got nil")
+				}
+				return nil
+			},
+		},
+		{
+			name: "gssapi nec without gssapi",
+			args: args{
+				opts: Options{
+					AllowNoAuth: true,
+					GSSAPINEC:   true,
+				},
+			},
+			check: func(socks5 *SOCKS5, err error) error {
+				if err == nil {
+					return fmt.Errorf("expected error but got nil")
+				}
+				return nil
+			},
+		},
+		{
+			name: "gssapi nec takes token method",
+			args: args{
+				opts: Options{
+					GSSAPI:      func() (GSSAPI, error) { return xorGSSAPI{}, nil },
+					GSSAPINEC:   true,
+					Token:       "secret",
+					TokenMethod: necGSSAPIMethod,
+				},
+			},
+			check: func(socks5 *SOCKS5, err error) error {
+				if err == nil {
+					return fmt.Errorf("expected error but got nil")
+				}
+				return nil
+			},
+		},
+		{
+			name: "gssapi nec",
+			args: args{
+				opts: Options{
+					GSSAPI:    func() (GSSAPI, error) { return xorGSSAPI{}, nil },
+					GSSAPINEC: true,
+				},
+			},
+			check: func(socks5 *SOCKS5, err error) error {
+				if err != nil {
+					return fmt.Errorf("unexpected error: %w", err)
+				}
+				if a := socks5.auth[necGSSAPIMethod]; a == nil || a.method() != necGSSAPIMethod {
+					return fmt.Errorf("nec method isn't enabled")
+				}
+				return nil
+			},
+		},
+		{
+			name: "reversed udp port range",
+			args: args{
+				opts: Options{
+					AllowNoAuth:       true,
+					AllowUDPAssociate: true,
+					UDPPortRange:      PortRange{Min: 40001, Max: 40000},
+				},
+			},
+			check: func(socks5 *SOCKS5, err error) error {
+				if err == nil {
+					return fmt.Errorf("expected error but got nil")
+				}
+				return nil
+			},
+		},
+		{
+			name: "udp datagram size over max",
+			args: args{
+				opts: Options{
+					AllowNoAuth:        true,
+					AllowUDPAssociate:  true,
+					UDPMaxDatagramSize: maxUDPDatagramSize + 1,
+				},
+			},
+			check: func(socks5 *SOCKS5, err error) error {
+				if err == nil {
+					return fmt.Errorf("expected error but got nil")
+				}
+				return nil
+			},
+		},
+		{
+			name: "udp associate",
+			args: args{
+				opts: Options{
+					AllowNoAuth:       true,
+					AllowUDPAssociate: true,
+					UDPPortRange:      PortRange{Min: 40000, Max: 40100},
+				},
+			},
+			check: func(socks5 *SOCKS5, err error) error {
+				if err != nil {
+					return fmt.Errorf("unexpected error: %w", err)
+				}
+				if socks5.udp == nil || socks5.udp.maxDatagram != maxUDPDatagramSize {
+					return fmt.Errorf("udp relay isn't configured with defaults")
+				}
+				return nil
+			},
+		},
+		{
+			name: "token only",
+			args: args{
+				opts: Options{
+					Token: "secret",
+				},
+			},
+			check: func(socks5 *SOCKS5, err error) error {
+				if err != nil {
+					return fmt.Errorf("unexpected error: %w", err)
+				}
+				if _, ok := socks5.auth[defaultTokenMethod]; !ok {
+					return fmt.Errorf("token method isn't enabled")
+				}
+				return nil
+			},
+		},
+		{
+			name: "failure jitter and linger exceed rfc limit",
+			args: args{
+				opts: Options{
+					AllowNoAuth:   true,
+					FailureJitter: 5 * time.Second,
+					FailureLinger: 6 * time.Second,
+				},
+			},
+			check: func(socks5 *SOCKS5, err error) error {
+				if err == nil {
+					return fmt.Errorf("expected error but got nil")
+				}
+				return nil
+			},
+		},
+		{
+			name: "invalid early data handling",
+			args: args{
+				opts: Options{
+					AllowNoAuth: true,
+					EarlyData:   EarlyDataReject + 1,
+				},
+			},
+			check: func(socks5 *SOCKS5, err error) error {
+				if err == nil {
+					return fmt.Errorf("expected error but got nil")
+				}
+				return nil
+			},
+		},
+		{
+			name: "negative tarpit duration",
+			args: args{
+				opts: Options{
+					AllowNoAuth:    true,
+					TarpitDuration: -time.Second,
+				},
+			},
+			check: func(socks5 *SOCKS5, err error) error {
+				if err == nil {
+					return fmt.Errorf("expected error but got nil")
+				}
+				return nil
+			},
+		},
+		{
+			name: "invalid reply address",
+			args: args{
+				opts: Options{
+					AllowNoAuth:  true,
+					ReplyAddress: ReplyZeroAddr + 1,
+				},
+			},
+			check: func(socks5 *SOCKS5, err error) error {
+				if err == nil {
+					return fmt.Errorf("expected error but got nil")
+				}
+				return nil
+			},
+		},
+		{
+			name: "negative method reply delay",
+			args: args{
+				opts: Options{
+					AllowNoAuth: true,
+					Quirks:      Quirks{MethodReplyDelay: -time.Second},
+				},
+			},
+			check: func(socks5 *SOCKS5, err error) error {
+				if err == nil {
+					return fmt.Errorf("expected error but got nil")
+				}
+				return nil
+			},
+		},
+		{
+			name: "negative session queue timeout",
+			args: args{
+				opts: Options{
+					AllowNoAuth:         true,
+					MaxSessionsPerUser:  1,
+					SessionQueueTimeout: -time.Second,
+				},
+			},
+			check: func(socks5 *SOCKS5, err error) error {
+				if err == nil {
+					return fmt.Errorf("expected error but got nil")
+				}
+				return nil
+			},
+		},
+		{
+			name: "relay buffer size too large",
+			args: args{
+				opts: Options{
+					AllowNoAuth:     true,
+					RelayBufferSize: 2 * maxRelayBufferSize,
+				},
+			},
+			check: func(socks5 *SOCKS5, err error) error {
+				if err == nil {
+					return fmt.Errorf("expected error but got nil")
+				}
+				return nil
+			},
+		},
+		{
+			name: "port lists aren't modified",
+			args: args{
+				opts: Options{
+					AllowNoAuth:  true,
+					AllowedPorts: spare,
+					DeniedPorts:  []int{25},
+				},
+			},
+			check: func(socks5 *SOCKS5, err error) error {
+				if err != nil {
+					return fmt.Errorf("unexpected error: %w", err)
+				}
+				if got := spare[:2]; got[1] != 0 {
+					return fmt.Errorf("allowed ports backing array got %v", got)
+				}
+				return nil
+			},
+		},
+		{
+			name: "invalid denied port",
+			args: args{
+				opts: Options{
+					AllowNoAuth:  true,
+					AllowedPorts: []int{80, 443},
+					DeniedPorts:  []int{0},
+				},
+			},
+			check: func(socks5 *SOCKS5, err error) error {
+				if err == nil {
+					return fmt.Errorf("expected error but got nil")
+				}
+				return nil
+			},
+		},
+		{
+			name: "negative idle timeout",
+			args: args{
+				opts: Options{
+					AllowNoAuth: true,
+					IdleTimeout: -time.Second,
+				},
+			},
+			check: func(socks5 *SOCKS5, err error) error {
+				if err == nil {
+					return fmt.Errorf("expected error but got nil")
+				}
+				return nil
+			},
+		},
+		{
+			name: "negative reap interval",
+			args: args{
+				opts: Options{
+					AllowNoAuth:  true,
+					ReapInterval: -time.Second,
+				},
+			},
+			check: func(socks5 *SOCKS5, err error) error {
+				if err == nil {
+					return fmt.Errorf("expected error but got nil")
+				}
+				return nil
+			},
+		},
+		{
+			name: "negative bandwidth limit",
+			args: args{
+				opts: Options{
+					AllowNoAuth:    true,
+					BandwidthLimit: -1,
+				},
+			},
+			check: func(socks5 *SOCKS5, err error) error {
+				if err == nil {
+					return fmt.Errorf("expected error but got nil")
+				}
+				return nil
+			},
+		},
+		{
+			name: "session bandwidth limit",
+			args: args{
+				opts: Options{
+					AllowNoAuth:           true,
+					SessionBandwidthLimit: 1 << 20,
+				},
+			},
+			check: func(socks5 *SOCKS5, err error) error {
+				if err != nil {
+					return fmt.Errorf("unexpected error: %w", err)
+				}
+				if socks5.bandwidth == nil {
+					return fmt.Errorf("bandwidth scheduler isn't configured")
+				}
+				return nil
+			},
+		},
+		{
+			name: "auth failure delay exceeds rfc limit",
+			args: args{
+				opts: Options{
+					AllowNoAuth:      true,
+					AuthFailureDelay: 11 * time.Second,
+				},
+			},
+			check: func(socks5 *SOCKS5, err error) error {
+				if err == nil {
+					return fmt.Errorf("expected error but got nil")
+				}
+				return nil
+			},
+		},
+		{
+			name: "strict: noauth with login requires networks",
+			args: args{
+				opts: Options{
+					AllowNoAuth: true,
+					Authenticate: func(username, password []byte) error {
+						return nil
+					},
+					Strict: true,
+				},
+			},
+			check: func(socks5 *SOCKS5, err error) error {
+				if err == nil {
+					return fmt.Errorf("expected error but got nil")
+				}
+				if socks5 != nil {
+					return fmt.Errorf("expected nil return")
+				}
+				return nil
+			},
+		},
+		{
+			name: "strict: noauth with login from networks",
+			args: args{
+				opts: Options{
+					AllowNoAuth: true,
+					Authenticate: func(username, password []byte) error {
+						return nil
+					},
+					NoAuthNetworks: []*net.IPNet{{IP: net.IPv4(127, 0, 0, 0), Mask: net.CIDRMask(8, 32)}},
+					Strict:         true,
+				},
+			},
+			check: func(socks5 *SOCKS5, err error) error {
+				if err != nil {
+					return fmt.Errorf("unexpected error: %w", err)
+				}
+				if len(socks5.noAuthNets) != 1 {
+					return fmt.Errorf("got %d noauth networks, want 1", len(socks5.noAuthNets))
+				}
+				return nil
+			},
+		},
 		{
 			name: "common case",
 			args: args{
@@ -194,7 +756,7 @@ func TestNew(t *testing.T) {
 			args: args{
 				opts: Options{
 					AllowNoAuth: true,
-					Listen: func() (net.Listener, error) {
+					Listen: func(info SessionInfo) (net.Listener, error) {
 						return nil, nil
 					}},
 			},
@@ -234,7 +796,7 @@ func TestSOCKS5_Handle(t *testing.T) {
 
 	type fields struct {
 		auth    map[authMethod]authHandler
-		listen  func() (net.Listener, error)
+		listen  func(info SessionInfo) (net.Listener, error)
 		connect func(addressType int, addr []byte, port int) (net.Conn, error)
 	}
 	type args struct {
@@ -287,3 +849,135 @@ func TestSOCKS5_Handle(t *testing.T) {
 		})
 	}
 }
+
+func TestSOCKS5_HandleTransparent(t *testing.T) {
+	upstream, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer upstream.Close()
+
+	go func() {
+		conn, err := upstream.Accept()
+		if err != nil {
+			return
+		}
+		_, _ = conn.Write([]byte("hello"))
+		_ = conn.Close()
+	}()
+
+	var info SessionInfo
+
+	s, err := New(Options{
+		AllowNoAuth: true,
+		OnEstablished: func(client io.ReadWriteCloser, upstream net.Conn, i SessionInfo) {
+			info = i
+			link(linkOptions{}, upstream, client)
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	client, conn := net.Pipe()
+	defer client.Close()
+
+	go s.HandleTransparent(conn, upstream.Addr(), func(err error) {
+		t.Errorf("unexpected error: %v", err)
+	})
+
+	got, err := io.ReadAll(client)
+	if err != nil {
+		t.Fatalf("client read: %v", err)
+	}
+	if string(got) != "hello" {
+		t.Errorf("got %q, want %q", got, "hello")
+	}
+	if !info.Transparent || info.Command != int(connect) || info.Destination() != upstream.Addr().String() {
+		t.Errorf("unexpected session info: %+v", info)
+	}
+}
+
+func TestSOCKS5_HandleAuthenticated(t *testing.T) {
+	upstream, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer upstream.Close()
+
+	usernames := make(chan string, 1)
+	s, err := New(Options{
+		// the identity is injected, passwords are never checked
+		Authenticate: func(username, password []byte) error {
+			return errors.New("unexpected login")
+		},
+		OnEstablished: func(client io.ReadWriteCloser, upstream net.Conn, info SessionInfo) {
+			usernames <- info.Username
+			_ = upstream.Close()
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		username string
+		steps    []testsupport.Step
+		wantUser string
+		wantErr  bool
+	}{
+		{
+			name:     "noauth carries identity",
+			username: "alice",
+			steps: []testsupport.Step{
+				testsupport.Greeting(wire.MethodLogin, wire.MethodNoAuth),
+				testsupport.ExpectMethod(wire.MethodNoAuth),
+				testsupport.Request(wire.CommandConnect, upstream.Addr().String()),
+				testsupport.ExpectReply(wire.StatusSucceeded),
+			},
+			wantUser: "alice",
+		},
+		{
+			name:     "noauth isn't offered",
+			username: "alice",
+			steps: []testsupport.Step{
+				testsupport.Greeting(wire.MethodLogin),
+				testsupport.ExpectMethod(wire.MethodNoAcceptable),
+				testsupport.ExpectClosed(),
+			},
+			wantErr: true,
+		},
+		{
+			name:     "empty username",
+			username: "",
+			steps:    []testsupport.Step{testsupport.ExpectClosed()},
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, conn := net.Pipe()
+			defer client.Close()
+
+			errs := make(chan error, 1)
+			go func() {
+				defer conn.Close()
+				s.HandleAuthenticated(conn, tt.username, func(err error) { errs <- err })
+				close(errs)
+			}()
+
+			if err := (&testsupport.Client{Conn: client}).Run(tt.steps...); err != nil {
+				t.Fatal(err)
+			}
+			if tt.wantUser != "" {
+				if got := <-usernames; got != tt.wantUser {
+					t.Errorf("got username %q, want %q", got, tt.wantUser)
+				}
+			}
+			if err := <-errs; (err != nil) != tt.wantErr {
+				t.Errorf("HandleAuthenticated() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,172 @@
+package proxyme
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// SessionInfo describes SOCKS5 client session and its command request.
+type SessionInfo struct {
+	// ClientAddr is remote address of the client connection, nil if unknown.
+	ClientAddr net.Addr
+
+	// Method is the authentication method chosen for the session (RFC 1928 METHOD).
+	Method int
+
+	// Username is the authenticated username (USERNAME/PASSWORD method), empty for other methods.
+	Username string
+
+	// Command is the requested command: CONNECT X'01', BIND X'02', UDP ASSOCIATE X'03'.
+	Command int
+
+	// AddressType, Addr and Port are requested destination (DST.ADDR & DST.PORT) in terms of
+	// the same values passed to Options.Connect.
+	AddressType int
+	Addr        []byte
+	Port        int
+
+	// ResolvedIPs are addresses the domain name destination has been resolved to for rule checks
+	// (see Options.Rules), nil if the proxy doesn't resolve the destination itself. They are the
+	// session's own copy, not shared with the resolver cache.
+	ResolvedIPs []net.IP
+
+	// Upstream is remote address of the connection to the destination (the chosen ip),
+	// nil until connected.
+	Upstream net.Addr
+
+	// Transparent reports the connection has been transparently redirected to the proxy
+	// (see SOCKS5.HandleTransparent): no SOCKS5 negotiation took place, Command is CONNECT.
+	Transparent bool
+
+	// Timings are latencies of the session (time to authenticate, to dial the destination,
+	// to the first byte through the tunnel), the ones of stages in progress are zero.
+	Timings Timings
+
+	// Metadata is key/value store of the session shared by its hooks (see Metadata).
+	Metadata *Metadata
+}
+
+// Destination returns requested destination in net.Dial format.
+func (s SessionInfo) Destination() string {
+	return buildDialAddress(s.AddressType, s.Addr, s.Port)
+}
+
+// info returns session info of the current state.
+func (s *state) info() SessionInfo {
+	info := SessionInfo{
+		ClientAddr:  s.clientAddr,
+		Username:    s.username,
+		Command:     int(s.command.commandType),
+		AddressType: int(s.command.addressType),
+		Addr:        s.command.addr,
+		Port:        int(s.command.port),
+		ResolvedIPs: s.resolved,
+		Upstream:    s.upstream,
+		Transparent: s.redirected,
+		Timings:     s.timings,
+		Metadata:    &s.metadata,
+	}
+	if s.method != nil {
+		info.Method = int(s.method.method())
+	}
+
+	return info
+}
+
+// StreamFilter plugs into the relay path to inspect, scan or rewrite tunnel traffic
+// without reimplementing the protocol. Each wrapped side is read by the relay and the
+// data is written to the opposite side.
+type StreamFilter interface {
+	// WrapClient wraps client side of the tunnel.
+	WrapClient(rw io.ReadWriter) io.ReadWriter
+
+	// WrapUpstream wraps upstream (remote server) side of the tunnel.
+	WrapUpstream(rw io.ReadWriter) io.ReadWriter
+}
+
+// filteredConn is a connection side wrapped with StreamFilter.
+type filteredConn struct {
+	io.ReadWriter
+	io.Closer
+}
+
+// CloseWrite propagates half-close to connections supporting it.
+func (c filteredConn) CloseWrite() error {
+	if cw, ok := c.Closer.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+
+	return errNoHalfClose
+}
+
+// relay transfers data between client and upstream once the tunnel is established.
+func relay(state *state, upstream net.Conn) error {
+	// all protocol messages are flushed, relay the raw client conn
+	if state.negotiation != nil {
+		state.negotiation.stop()
+	}
+	client := unwrap(state.conn)
+	state.enter(stageRelay)
+	state.notifyStart()
+
+	if state.opts.onEstablished != nil {
+		state.opts.onEstablished(client, upstream, state.info())
+		return nil
+	}
+
+	var remote io.ReadWriteCloser = upstream
+
+	if state.opts.filter != nil {
+		filter, err := state.opts.filter(state.info())
+		if err != nil {
+			_ = upstream.Close()
+			_ = client.Close()
+
+			return fmt.Errorf("stream filter: %w", err)
+		}
+
+		if filter != nil {
+			client = filteredConn{ReadWriter: filter.WrapClient(client), Closer: client}
+			remote = filteredConn{ReadWriter: filter.WrapUpstream(remote), Closer: remote}
+		}
+	}
+
+	if state.opts.bandwidth != nil {
+		throttle := state.opts.bandwidth.open(state.username)
+		defer throttle.close()
+
+		client = throttledConn{ReadWriteCloser: client, throttle: throttle}
+		remote = throttledConn{ReadWriteCloser: remote, throttle: throttle}
+	}
+
+	established := time.Now()
+	opts := linkOptions{
+		spawn:      state.spawn,
+		bufferSize: state.opts.relayBuffer,
+		firstByte: func() {
+			state.timed("ttfb", time.Since(established))
+		},
+	}
+	// top statistics count bytes of authenticated users
+	if state.opts.metrics != nil || (state.opts.topStats != nil && state.username != "") {
+		opts.up, opts.down = new(atomic.Int64), new(atomic.Int64)
+	}
+	if state.opts.metrics != nil {
+		stop := state.meter(opts.up, opts.down)
+		defer stop()
+	}
+
+	expire := state.limit(remote, client)
+	up, down := link(opts, remote, client)
+	state.up, state.down = up+int64(len(state.early)), down
+	state.opts.counts.relayed(state.up, state.down)
+
+	if opts.up != nil {
+		state.opts.topStats.transferred(state.username, opts.up.Load()+opts.down.Load())
+	}
+
+	return expire()
+}
@@ -0,0 +1,239 @@
+package proxyme
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func Test_state_info(t *testing.T) {
+	client := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 5555}
+
+	tests := []struct {
+		name  string
+		state *state
+		want  SessionInfo
+	}{
+		{
+			name:  "before authentication",
+			state: &state{clientAddr: client},
+			want:  SessionInfo{ClientAddr: client},
+		},
+		{
+			name: "command",
+			state: &state{
+				clientAddr: client,
+				method:     &noAuth{},
+				command: commandRequest{
+					commandType: bind,
+					addressType: domainName,
+					addr:        []byte("example.com"),
+					port:        21,
+				},
+			},
+			want: SessionInfo{
+				ClientAddr:  client,
+				Method:      int(typeNoAuth),
+				Command:     int(bind),
+				AddressType: int(domainName),
+				Addr:        []byte("example.com"),
+				Port:        21,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.want.Metadata = &tt.state.metadata
+			if got := tt.state.info(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("info() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// upperFilter converts client data into upper case.
+type upperFilter struct{}
+
+func (upperFilter) WrapClient(rw io.ReadWriter) io.ReadWriter {
+	return struct {
+		io.Reader
+		io.Writer
+	}{
+		Reader: readerFunc(func(p []byte) (int, error) {
+			n, err := rw.Read(p)
+			copy(p, bytes.ToUpper(p[:n]))
+			return n, err
+		}),
+		Writer: rw,
+	}
+}
+
+func (upperFilter) WrapUpstream(rw io.ReadWriter) io.ReadWriter {
+	return rw
+}
+
+type readerFunc func(p []byte) (int, error)
+
+func (f readerFunc) Read(p []byte) (int, error) {
+	return f(p)
+}
+
+func Test_relay(t *testing.T) {
+	sniFilter := SNIFilter(func(serverName string, info SessionInfo) error { return nil })
+	request := append(clientHello("example.com"), "request"...)
+
+	// client sends request and half-closes, the response comes after upstream sees EOF
+	halfClose := func(client, upstream net.Conn, err error) error {
+		if err != nil {
+			return fmt.Errorf("unexpected error: %w", err)
+		}
+		if _, err := client.Write(request); err != nil {
+			return fmt.Errorf("client write: %w", err)
+		}
+		if err := client.(*net.TCPConn).CloseWrite(); err != nil {
+			return fmt.Errorf("client close write: %w", err)
+		}
+
+		req, err := io.ReadAll(upstream)
+		if err != nil {
+			return fmt.Errorf("upstream read: %w", err)
+		}
+		if !bytes.Equal(req, request) {
+			return fmt.Errorf("upstream got %q, want %q", req, request)
+		}
+
+		if _, err := upstream.Write([]byte("response")); err != nil {
+			return fmt.Errorf("upstream write: %w", err)
+		}
+		_ = upstream.Close()
+
+		resp, err := io.ReadAll(client)
+		if err != nil {
+			return fmt.Errorf("client read: %w", err)
+		}
+		if string(resp) != "response" {
+			return fmt.Errorf("client got %q, want %q", resp, "response")
+		}
+		return nil
+	}
+
+	tests := []struct {
+		name      string
+		filter    func(info SessionInfo) (StreamFilter, error)
+		bandwidth int64
+		pair      func(tb testing.TB) (net.Conn, net.Conn)
+		check     func(client, upstream net.Conn, err error) error
+	}{
+		{
+			name: "filter applied",
+			filter: func(info SessionInfo) (StreamFilter, error) {
+				return upperFilter{}, nil
+			},
+			check: func(client, upstream net.Conn, err error) error {
+				if err != nil {
+					return fmt.Errorf("unexpected error: %w", err)
+				}
+				go func() {
+					_, _ = client.Write([]byte("hello"))
+				}()
+				p := make([]byte, 5)
+				if _, err := io.ReadFull(upstream, p); err != nil {
+					return fmt.Errorf("upstream read: %w", err)
+				}
+				if string(p) != "HELLO" {
+					return fmt.Errorf("got %q, want %q", p, "HELLO")
+				}
+				return nil
+			},
+		},
+		{
+			name: "no filter for session",
+			filter: func(info SessionInfo) (StreamFilter, error) {
+				return nil, nil
+			},
+			check: func(client, upstream net.Conn, err error) error {
+				if err != nil {
+					return fmt.Errorf("unexpected error: %w", err)
+				}
+				go func() {
+					_, _ = upstream.Write([]byte("hello"))
+				}()
+				p := make([]byte, 5)
+				if _, err := io.ReadFull(client, p); err != nil {
+					return fmt.Errorf("client read: %w", err)
+				}
+				if string(p) != "hello" {
+					return fmt.Errorf("got %q, want %q", p, "hello")
+				}
+				return nil
+			},
+		},
+		{
+			name: "filter error",
+			filter: func(info SessionInfo) (StreamFilter, error) {
+				return nil, errors.ErrUnsupported
+			},
+			check: func(client, upstream net.Conn, err error) error {
+				if !errors.Is(err, errors.ErrUnsupported) {
+					return fmt.Errorf("got error %v, want %v", err, errors.ErrUnsupported)
+				}
+				if _, err := client.Read(make([]byte, 1)); !errors.Is(err, io.EOF) {
+					return fmt.Errorf("client conn must be closed, got %v", err)
+				}
+				return nil
+			},
+		},
+		{
+			name:   "half-close through sni filter",
+			filter: sniFilter,
+			pair:   tcpPair,
+			check:  halfClose,
+		},
+		{
+			name:      "half-close through sni filter and bandwidth limit",
+			filter:    sniFilter,
+			bandwidth: 1 << 20,
+			pair:      tcpPair,
+			check:     halfClose,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pair := tt.pair
+			if pair == nil {
+				pair = func(tb testing.TB) (net.Conn, net.Conn) { return net.Pipe() }
+			}
+			client, clientSide := pair(t)
+			upstream, upstreamSide := pair(t)
+			defer client.Close()
+			defer upstream.Close()
+
+			s := &state{
+				opts:    SOCKS5{filter: tt.filter, bandwidth: newScheduler(Options{BandwidthLimit: tt.bandwidth})},
+				conn:    clientSide,
+				command: commandRequest{commandType: connect},
+			}
+
+			errc := make(chan error, 1)
+			go func() {
+				errc <- relay(s, upstreamSide)
+			}()
+
+			var err error
+			select {
+			case err = <-errc:
+			case <-time.After(50 * time.Millisecond):
+				// relay is running
+			}
+
+			if err := tt.check(client, upstream, err); err != nil {
+				t.Errorf("relay() error = %v", err)
+			}
+		})
+	}
+}
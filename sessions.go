@@ -0,0 +1,224 @@
+package proxyme
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+// Session is a live client session.
+type Session struct {
+	// ID identifies the session, it's random so IDs of the fleet of proxies don't collide.
+	ID string
+
+	// Info describes the session, command fields are zero until the client sends the request.
+	Info SessionInfo
+
+	// Started is the time the session has been accepted.
+	Started time.Time
+}
+
+// SessionStore is registry of live sessions. Implement it to publish sessions of multi-instance
+// deployments to a shared storage (Redis, etcd) to get fleet-wide view of connected clients
+// and kill sessions remotely.
+//
+// Methods are called concurrently from session goroutines and must not block for long.
+type SessionStore interface {
+	// Put registers new session or updates its info. Call kill to terminate the session,
+	// it's safe to call it from any goroutine any number of times.
+	Put(session Session, kill func())
+
+	// Delete removes finished session.
+	Delete(id string)
+
+	// Sessions returns live sessions.
+	Sessions() []Session
+
+	// Kill terminates the session and reports whether the session has been found.
+	Kill(id string) bool
+}
+
+// MemorySessions is in-memory SessionStore of the process, it's used by default.
+// The zero value is ready to use.
+type MemorySessions struct {
+	mu       sync.Mutex
+	sessions map[string]memorySession
+}
+
+type memorySession struct {
+	Session
+	kill func()
+}
+
+func (m *MemorySessions) Put(session Session, kill func()) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.sessions == nil {
+		m.sessions = make(map[string]memorySession)
+	}
+	m.sessions[session.ID] = memorySession{Session: session, kill: kill}
+}
+
+func (m *MemorySessions) Delete(id string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.sessions, id)
+}
+
+func (m *MemorySessions) Sessions() []Session {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	res := make([]Session, 0, len(m.sessions))
+	for _, s := range m.sessions {
+		res = append(res, s.Session)
+	}
+
+	return res
+}
+
+func (m *MemorySessions) Kill(id string) bool {
+	m.mu.Lock()
+	s, ok := m.sessions[id]
+	m.mu.Unlock()
+
+	if ok && s.kill != nil {
+		// kill outside the lock: the session deletes itself on exit
+		s.kill()
+	}
+
+	return ok
+}
+
+// Sessions returns live sessions of the store (see Options.Sessions).
+func (s SOCKS5) Sessions() []Session {
+	if s.sessions == nil {
+		return nil
+	}
+
+	return s.sessions.Sessions()
+}
+
+// Kill terminates the session by ID and reports whether the session has been found.
+func (s SOCKS5) Kill(id string) bool {
+	return s.sessions != nil && s.sessions.Kill(id)
+}
+
+// newSessionID returns random session ID.
+func newSessionID() string {
+	var id [8]byte
+	_, _ = rand.Read(id[:])
+
+	return hex.EncodeToString(id[:])
+}
+
+// register puts new session of the state to the store, the returned func removes it.
+func (s *state) register(kill func()) func() {
+	if s.opts.sessions == nil {
+		return func() {}
+	}
+
+	s.session = Session{
+		ID:      newSessionID(),
+		Started: time.Now(),
+	}
+	s.kill = kill
+	s.publish()
+
+	return func() {
+		s.opts.sessions.Delete(s.session.ID)
+	}
+}
+
+// publish updates session info in the store.
+func (s *state) publish() {
+	if s.opts.sessions == nil || s.session.ID == "" {
+		return
+	}
+
+	s.session.Info = s.info()
+	s.opts.sessions.Put(s.session, s.kill)
+}
+
+// SessionEventType is the type of session events reported to SessionEventSink.
+type SessionEventType string
+
+const (
+	SessionStart SessionEventType = "session.start" // the tunnel is established
+	SessionEnd   SessionEventType = "session.end"   // the established session is over
+)
+
+// SessionEvent is the start or the end of the session (see Options.SessionEvents).
+type SessionEvent struct {
+	Type SessionEventType
+	Time time.Time
+
+	// ID correlates the start and the end of the session, it's Session.ID if the session is
+	// registered (see Options.Sessions), random otherwise.
+	ID string
+
+	// Info describes the session. It refers to the live session state, so sinks must not keep it
+	// past the call.
+	Info SessionInfo
+
+	// Duration is the lifetime of the session counted from the accept, BytesUp and BytesDown are
+	// relayed bytes (client to destination and back) and Err is the close reason, nil if the session
+	// ended normally. They are set for SessionEnd only.
+	Duration  time.Duration
+	BytesUp   int64
+	BytesDown int64
+	Err       error
+}
+
+// SessionEventSink receives start and end events of sessions, e.g. to feed billing or fraud
+// detection (see WebhookSink). SessionEvent is called from session goroutines and must not block.
+type SessionEventSink interface {
+	SessionEvent(e SessionEvent)
+}
+
+// notifySession returns the func reporting the end of the session to Options.SessionEvents if its
+// start has been reported (see notifyStart).
+func (s *state) notifySession() func() {
+	if s.opts.sessionEvents == nil {
+		return func() {}
+	}
+
+	return func() {
+		if !s.notified {
+			return
+		}
+
+		s.opts.sessionEvents.SessionEvent(SessionEvent{
+			Type:      SessionEnd,
+			Time:      time.Now(),
+			ID:        s.session.ID,
+			Info:      s.info(),
+			Duration:  time.Since(s.started),
+			BytesUp:   s.up,
+			BytesDown: s.down,
+			Err:       s.lastErr,
+		})
+	}
+}
+
+// notifyStart reports the established session to Options.SessionEvents.
+func (s *state) notifyStart() {
+	if s.opts.sessionEvents == nil {
+		return
+	}
+
+	if s.session.ID == "" {
+		s.session.ID = newSessionID()
+	}
+	s.notified = true
+
+	s.opts.sessionEvents.SessionEvent(SessionEvent{
+		Type: SessionStart,
+		Time: time.Now(),
+		ID:   s.session.ID,
+		Info: s.info(),
+	})
+}
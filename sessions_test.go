@@ -0,0 +1,67 @@
+package proxyme
+
+import (
+	"net"
+	"testing"
+)
+
+func TestMemorySessions(t *testing.T) {
+	var store MemorySessions
+
+	if got := store.Sessions(); len(got) != 0 {
+		t.Fatalf("Sessions() = %v, want empty", got)
+	}
+	if store.Kill("unknown") {
+		t.Fatalf("Kill() of unknown session = true")
+	}
+
+	var killed int
+	store.Put(Session{ID: "a"}, func() { killed++ })
+	store.Put(Session{ID: "a", Info: SessionInfo{Port: 443}}, func() { killed++ })
+
+	got := store.Sessions()
+	if len(got) != 1 || got[0].Info.Port != 443 {
+		t.Fatalf("Sessions() = %v, want updated session", got)
+	}
+
+	if !store.Kill("a") || killed != 1 {
+		t.Fatalf("Kill() killed %d times, want 1", killed)
+	}
+
+	store.Delete("a")
+	if got := store.Sessions(); len(got) != 0 {
+		t.Fatalf("Sessions() = %v, want empty", got)
+	}
+}
+
+func Test_state_register(t *testing.T) {
+	var store MemorySessions
+	client := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 5000}
+
+	s := &state{
+		opts:       SOCKS5{sessions: &store},
+		clientAddr: client,
+	}
+
+	done := s.register(func() {})
+	sessions := store.Sessions()
+	if len(sessions) != 1 || sessions[0].ID == "" || sessions[0].Info.ClientAddr != client {
+		t.Fatalf("registered sessions = %v, want client session", sessions)
+	}
+
+	s.command = commandRequest{commandType: connect, addressType: ipv4, addr: []byte{1, 1, 1, 1}, port: 53}
+	s.publish()
+	if got := store.Sessions()[0].Info.Destination(); got != "1.1.1.1:53" {
+		t.Fatalf("published destination = %s, want %s", got, "1.1.1.1:53")
+	}
+
+	done()
+	if got := store.Sessions(); len(got) != 0 {
+		t.Fatalf("Sessions() = %v, want empty", got)
+	}
+
+	// no store
+	s = &state{}
+	s.register(func() {})()
+	s.publish()
+}
@@ -0,0 +1,63 @@
+package proxyme
+
+import "sync/atomic"
+
+// Snapshot is totals of the sessions served since the start (see SOCKS5.Snapshot).
+type Snapshot struct {
+	Sessions  int64            // accepted sessions
+	Active    int64            // sessions in progress
+	BytesUp   int64            // relayed from clients to destinations
+	BytesDown int64            // relayed from destinations to clients
+	Errors    map[string]int64 // session errors by state machine stage they occurred at
+}
+
+// sessionCounts counts sessions, relayed bytes and errors.
+type sessionCounts struct {
+	sessions atomic.Int64
+	up, down atomic.Int64
+	errors   [stageCount]atomic.Int64
+}
+
+// started counts the new session.
+func (c *sessionCounts) started() {
+	if c != nil {
+		c.sessions.Add(1)
+	}
+}
+
+// relayed counts bytes relayed by the session.
+func (c *sessionCounts) relayed(up, down int64) {
+	if c != nil {
+		c.up.Add(up)
+		c.down.Add(down)
+	}
+}
+
+// failed counts the session error at the stage.
+func (c *sessionCounts) failed(st stage) {
+	if c != nil {
+		c.errors[st].Add(1)
+	}
+}
+
+// Snapshot returns totals of the sessions: accepted, in progress, relayed bytes (once the tunnel
+// is closed, see Options.Metrics for live throughput) and errors by stage (see SOCKS5.Stages).
+func (s SOCKS5) Snapshot() Snapshot {
+	res := Snapshot{Errors: make(map[string]int64)}
+	for _, n := range s.Stages() {
+		res.Active += n
+	}
+	if s.counts == nil {
+		return res
+	}
+
+	res.Sessions = s.counts.sessions.Load()
+	res.BytesUp, res.BytesDown = s.counts.up.Load(), s.counts.down.Load()
+	for st := range s.counts.errors {
+		if n := s.counts.errors[st].Load(); n > 0 {
+			res.Errors[stageNames[st]] = n
+		}
+	}
+
+	return res
+}
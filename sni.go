@@ -0,0 +1,236 @@
+package proxyme
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// as defined https://www.rfc-editor.org/rfc/rfc8446 and https://www.rfc-editor.org/rfc/rfc6066
+
+const (
+	tlsRecordHeaderSize      = 5
+	tlsRecordHandshake       = 22
+	tlsHandshakeHeaderSize   = 4
+	tlsHandshakeClientHello  = 1
+	tlsClientHelloRandomSize = 32
+	tlsExtensionServerName   = 0
+	tlsServerNameTypeHost    = 0
+
+	maxClientHelloSize = 1 << 16
+)
+
+var errInvalidClientHello = errors.New("invalid tls client hello")
+
+// SNIFilter returns Options.Filter callback which peeks TLS ClientHello sent by the client through
+// CONNECT tunnels to extract SNI (server name indication). allow is called with the server name
+// before any client data is relayed upstream, so hostname based rules apply even when the client
+// connected by IP address. Server name is empty if the client doesn't speak TLS or sends no SNI.
+// Non-nil error returned by allow terminates the tunnel.
+func SNIFilter(allow func(serverName string, info SessionInfo) error) func(info SessionInfo) (StreamFilter, error) {
+	return func(info SessionInfo) (StreamFilter, error) {
+		if info.Command != int(connect) {
+			return nil, nil
+		}
+
+		return sniFilter{
+			info:  info,
+			allow: allow,
+		}, nil
+	}
+}
+
+type sniFilter struct {
+	info  SessionInfo
+	allow func(serverName string, info SessionInfo) error
+}
+
+func (f sniFilter) WrapClient(rw io.ReadWriter) io.ReadWriter {
+	return &sniReader{
+		rw:     rw,
+		filter: f,
+	}
+}
+
+func (f sniFilter) WrapUpstream(rw io.ReadWriter) io.ReadWriter {
+	return rw
+}
+
+// sniReader holds client data until server name is checked.
+type sniReader struct {
+	rw      io.ReadWriter
+	filter  sniFilter
+	checked bool
+	buf     []byte // peeked client data to be relayed first
+	parsed  int    // size of parsed data in buf
+}
+
+func (r *sniReader) Read(p []byte) (int, error) {
+	if !r.checked {
+		r.checked = true
+
+		serverName, err := r.peek()
+		if err != nil {
+			return 0, err
+		}
+
+		if err := r.filter.allow(serverName, r.filter.info); err != nil {
+			return 0, fmt.Errorf("sni %q: %w", serverName, err)
+		}
+	}
+
+	if len(r.buf) > 0 {
+		n := copy(p, r.buf)
+		r.buf = r.buf[n:]
+
+		return n, nil
+	}
+
+	return r.rw.Read(p)
+}
+
+func (r *sniReader) Write(p []byte) (int, error) {
+	return r.rw.Write(p)
+}
+
+// peek reads client hello into the buffer and returns the server name.
+// Non TLS traffic is passed as is after the first read.
+func (r *sniReader) peek() (string, error) {
+	first := make([]byte, tlsRecordHeaderSize)
+
+	n, err := r.rw.Read(first)
+	r.buf = first[:n]
+	if err != nil {
+		return "", err
+	}
+
+	if n == 0 || first[0] != tlsRecordHandshake {
+		// not tls
+		return "", nil
+	}
+
+	// collect handshake payload from tls records until client hello is complete
+	var hello []byte
+
+	for {
+		header, err := r.read(tlsRecordHeaderSize)
+		if err != nil {
+			return "", err
+		}
+		if header[0] != tlsRecordHandshake {
+			return "", errInvalidClientHello
+		}
+
+		fragment, err := r.read(int(binary.BigEndian.Uint16(header[3:])))
+		if err != nil {
+			return "", err
+		}
+
+		hello = append(hello, fragment...)
+		if len(hello) > maxClientHelloSize {
+			return "", errInvalidClientHello
+		}
+
+		if len(hello) < tlsHandshakeHeaderSize {
+			continue
+		}
+
+		size := tlsHandshakeHeaderSize + (int(hello[1])<<16 | int(hello[2])<<8 | int(hello[3]))
+		if len(hello) >= size {
+			return parseServerName(hello[:size])
+		}
+	}
+}
+
+// read returns next size bytes of client data reading more from the client if needed.
+func (r *sniReader) read(size int) ([]byte, error) {
+	if missing := r.parsed + size - len(r.buf); missing > 0 {
+		chunk := make([]byte, missing)
+		n, err := io.ReadFull(r.rw, chunk)
+		r.buf = append(r.buf, chunk[:n]...)
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	data := r.buf[r.parsed : r.parsed+size]
+	r.parsed += size
+
+	return data, nil
+}
+
+// parseServerName returns host name from SNI extension of TLS ClientHello handshake message.
+func parseServerName(hello []byte) (string, error) {
+	msg := &cursor{data: hello}
+
+	if msg.byte() != tlsHandshakeClientHello {
+		return "", errInvalidClientHello
+	}
+
+	msg.next(3 + 2 + tlsClientHelloRandomSize) // length, version, random
+	msg.next(int(msg.byte()))                  // session id
+	msg.next(int(msg.uint16()))                // cipher suites
+	msg.next(int(msg.byte()))                  // compression methods
+
+	extensions := &cursor{data: msg.next(int(msg.uint16()))}
+	for !msg.invalid && len(extensions.data) > 0 {
+		typ := extensions.uint16()
+		ext := &cursor{data: extensions.next(int(extensions.uint16()))}
+
+		if typ != tlsExtensionServerName {
+			continue
+		}
+
+		names := &cursor{data: ext.next(int(ext.uint16()))}
+		for !names.invalid && len(names.data) > 0 {
+			nameType := names.byte()
+			name := names.next(int(names.uint16()))
+
+			if nameType == tlsServerNameTypeHost && len(name) > 0 && !names.invalid {
+				return string(name), nil
+			}
+		}
+	}
+
+	if msg.invalid || extensions.invalid {
+		return "", errInvalidClientHello
+	}
+
+	return "", nil
+}
+
+// cursor reads big endian values from the data, reading out of bounds marks it invalid.
+type cursor struct {
+	data    []byte
+	invalid bool
+}
+
+func (c *cursor) next(n int) []byte {
+	if n > len(c.data) {
+		c.invalid = true
+		c.data = nil
+
+		return nil
+	}
+
+	res := c.data[:n]
+	c.data = c.data[n:]
+
+	return res
+}
+
+func (c *cursor) byte() uint8 {
+	if p := c.next(1); p != nil {
+		return p[0]
+	}
+	return 0
+}
+
+func (c *cursor) uint16() uint16 {
+	if p := c.next(2); p != nil {
+		return binary.BigEndian.Uint16(p)
+	}
+	return 0
+}
@@ -0,0 +1,163 @@
+package proxyme
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+)
+
+// clientHello returns TLS ClientHello produced by crypto/tls client.
+func clientHello(serverName string) []byte {
+	client, server := net.Pipe()
+	defer server.Close()
+
+	go func() {
+		conn := tls.Client(client, &tls.Config{ServerName: serverName, InsecureSkipVerify: true}) //nolint
+		_ = conn.Handshake()
+		_ = client.Close()
+	}()
+
+	header := make([]byte, tlsRecordHeaderSize)
+	if _, err := io.ReadFull(server, header); err != nil {
+		return nil
+	}
+
+	record := make([]byte, int(header[3])<<8|int(header[4]))
+	if _, err := io.ReadFull(server, record); err != nil {
+		return nil
+	}
+
+	return append(header, record...)
+}
+
+func TestSNIFilter(t *testing.T) {
+	hello := clientHello("example.com")
+	helloNoSNI := clientHello("")
+	plain := []byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+
+	tests := []struct {
+		name     string
+		info     SessionInfo
+		data     []byte
+		allow    func(serverName string, info SessionInfo) error
+		wantName string
+		wantErr  error
+	}{
+		{
+			name: "tls with sni",
+			info: SessionInfo{Command: int(connect)},
+			data: hello,
+			allow: func(serverName string, info SessionInfo) error {
+				return nil
+			},
+			wantName: "example.com",
+		},
+		{
+			name: "tls without sni",
+			info: SessionInfo{Command: int(connect)},
+			data: helloNoSNI,
+			allow: func(serverName string, info SessionInfo) error {
+				return nil
+			},
+			wantName: "",
+		},
+		{
+			name: "plain traffic",
+			info: SessionInfo{Command: int(connect)},
+			data: plain,
+			allow: func(serverName string, info SessionInfo) error {
+				return nil
+			},
+			wantName: "",
+		},
+		{
+			name: "denied",
+			info: SessionInfo{Command: int(connect)},
+			data: hello,
+			allow: func(serverName string, info SessionInfo) error {
+				return ErrNotAllowed
+			},
+			wantName: "example.com",
+			wantErr:  ErrNotAllowed,
+		},
+		{
+			name: "truncated client hello",
+			info: SessionInfo{Command: int(connect)},
+			data: hello[:len(hello)/2],
+			allow: func(serverName string, info SessionInfo) error {
+				return nil
+			},
+			wantErr: io.ErrUnexpectedEOF,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var gotName string
+
+			filter, err := SNIFilter(func(serverName string, info SessionInfo) error {
+				gotName = serverName
+				return tt.allow(serverName, info)
+			})(tt.info)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			rw := filter.WrapClient(&bytes.Buffer{})
+			if _, err := rw.Write(tt.data); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			got, err := io.ReadAll(rw)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+			if gotName != tt.wantName {
+				t.Errorf("got server name %q, want %q", gotName, tt.wantName)
+			}
+			if tt.wantErr == nil && !bytes.Equal(got, tt.data) {
+				t.Errorf("relayed data differs from the client data")
+			}
+		})
+	}
+}
+
+func TestSNIFilter_command(t *testing.T) {
+	filter, err := SNIFilter(func(serverName string, info SessionInfo) error {
+		return fmt.Errorf("must not be called")
+	})(SessionInfo{Command: int(bind)})
+
+	if err != nil || filter != nil {
+		t.Errorf("got filter %v and error %v, want nil filter for BIND", filter, err)
+	}
+}
+
+func Test_parseServerName(t *testing.T) {
+	hello := clientHello("example.com")[tlsRecordHeaderSize:]
+
+	tests := []struct {
+		name    string
+		hello   []byte
+		want    string
+		wantErr bool
+	}{
+		{name: "common", hello: hello, want: "example.com"},
+		{name: "empty", hello: nil, wantErr: true},
+		{name: "not client hello", hello: []byte{2, 0, 0, 0}, wantErr: true},
+		{name: "truncated", hello: hello[:50], wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseServerName(tt.hello)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseServerName() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("parseServerName() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,145 @@
+package proxyme
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"syscall"
+	"time"
+)
+
+// maxDSCP is the max DiffServ code point (6 bits).
+const maxDSCP = 63
+
+// SocketOptions tune tcp sockets of sessions: client connections passed to Handle and connections
+// to destinations returned by Connect (tcp ones). Zero fields keep the system defaults, which suit
+// most of the deployments.
+type SocketOptions struct {
+	// DisableNoDelay enables Nagle's algorithm (Go disables it with TCP_NODELAY by default):
+	// fewer packets for flows of small writes at the cost of latency.
+	DisableNoDelay bool
+
+	// ReadBuffer and WriteBuffer set SO_RCVBUF and SO_SNDBUF sizes in bytes. Large buffers speed up
+	// bulk transfers over high latency links, small ones save memory of many idle sessions.
+	ReadBuffer  int
+	WriteBuffer int
+
+	// DSCP marks outgoing packets with DiffServ code point (0-63) for QoS. Linux only.
+	DSCP int
+
+	// UserTimeout sets TCP_USER_TIMEOUT: the connection is dropped if sent data isn't acknowledged
+	// in time, so dead peers are detected faster than with retransmission defaults. Linux only.
+	UserTimeout time.Duration
+}
+
+func (o SocketOptions) validate() error {
+	if o.ReadBuffer < 0 || o.WriteBuffer < 0 {
+		return fmt.Errorf("invalid socket buffer sizes: %d, %d", o.ReadBuffer, o.WriteBuffer)
+	}
+	if o.DSCP < 0 || o.DSCP > maxDSCP {
+		return fmt.Errorf("invalid dscp: %d", o.DSCP)
+	}
+	if o.UserTimeout < 0 {
+		return fmt.Errorf("invalid user timeout: %v", o.UserTimeout)
+	}
+	if (o.DSCP != 0 || o.UserTimeout != 0) && !platformSockopts {
+		return fmt.Errorf("dscp and user timeout socket options aren't supported on the platform")
+	}
+
+	return nil
+}
+
+// apply sets the options on tcp connections, other connections are left as is.
+func (o SocketOptions) apply(conn any) error {
+	tcp, ok := conn.(*net.TCPConn)
+	if !ok || o == (SocketOptions{}) {
+		return nil
+	}
+
+	if o.DisableNoDelay {
+		if err := tcp.SetNoDelay(false); err != nil {
+			return fmt.Errorf("set no delay: %w", err)
+		}
+	}
+	if o.ReadBuffer > 0 {
+		if err := tcp.SetReadBuffer(o.ReadBuffer); err != nil {
+			return fmt.Errorf("set read buffer: %w", err)
+		}
+	}
+	if o.WriteBuffer > 0 {
+		if err := tcp.SetWriteBuffer(o.WriteBuffer); err != nil {
+			return fmt.Errorf("set write buffer: %w", err)
+		}
+	}
+
+	if o.DSCP == 0 && o.UserTimeout == 0 {
+		return nil
+	}
+
+	raw, err := tcp.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		sockErr = o.applyPlatform(fd, isIPv6(tcp.LocalAddr()))
+	})
+	if err != nil {
+		return err
+	}
+
+	return sockErr
+}
+
+func isIPv6(addr net.Addr) bool {
+	ip := addrIP(addr)
+	return ip != nil && ip.To4() == nil
+}
+
+// ListenerOptions tune tcp listeners of Server.ListenAndServe. The options are Linux only, they are
+// ignored elsewhere, so the same configuration serves everywhere.
+type ListenerOptions struct {
+	// DeferAccept sets TCP_DEFER_ACCEPT: connections are accepted once the client has sent the greeting
+	// rather than on the handshake, so connections staying silent for DeferAccept (scanners, half-dead
+	// clients) take neither goroutines nor session memory. The time is rounded up to seconds.
+	// OPTIONAL, default connections are accepted on the handshake.
+	DeferAccept time.Duration
+
+	// FastOpenQueue enables TCP Fast Open (TCP_FASTOPEN) with the max number of pending fast open
+	// requests: returning clients send the greeting within SYN and save a round trip. Clients need
+	// fast open enabled by net.ipv4.tcp_fastopen sysctl as well.
+	// OPTIONAL, default fast open is disabled.
+	FastOpenQueue int
+}
+
+func (o ListenerOptions) validate() error {
+	if o.DeferAccept < 0 {
+		return fmt.Errorf("invalid defer accept: %v", o.DeferAccept)
+	}
+	if o.FastOpenQueue < 0 {
+		return fmt.Errorf("invalid fast open queue: %d", o.FastOpenQueue)
+	}
+
+	return nil
+}
+
+// listen listens on tcp address with the options set on the listening socket.
+func (o ListenerOptions) listen(address string) (net.Listener, error) {
+	if err := o.validate(); err != nil {
+		return nil, err
+	}
+
+	var lc net.ListenConfig
+	if o != (ListenerOptions{}) {
+		lc.Control = func(_, _ string, c syscall.RawConn) error {
+			var sockErr error
+			if err := c.Control(func(fd uintptr) { sockErr = o.applyPlatform(fd) }); err != nil {
+				return err
+			}
+			return sockErr
+		}
+	}
+
+	return lc.Listen(context.Background(), "tcp", address)
+}
@@ -0,0 +1,63 @@
+//go:build linux
+
+package proxyme
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+	"time"
+)
+
+const (
+	platformSockopts = true
+
+	tcpUserTimeout = 0x12 // TCP_USER_TIMEOUT from linux/tcp.h
+	tcpFastOpen    = 0x17 // TCP_FASTOPEN from linux/tcp.h
+)
+
+// applyPlatform sets DSCP and TCP_USER_TIMEOUT on the socket.
+func (o SocketOptions) applyPlatform(fd uintptr, ipv6 bool) error {
+	if o.DSCP != 0 {
+		tos := o.DSCP << 2 // DSCP is upper 6 bits of TOS byte
+
+		var err error
+		if ipv6 {
+			err = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_TCLASS, tos)
+		} else {
+			err = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_TOS, tos)
+		}
+		if err != nil {
+			return fmt.Errorf("set dscp: %w", err)
+		}
+	}
+
+	if o.UserTimeout != 0 {
+		ms := int(o.UserTimeout.Milliseconds())
+		if err := syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, tcpUserTimeout, ms); err != nil {
+			return fmt.Errorf("set user timeout: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// applyPlatform sets TCP_DEFER_ACCEPT and TCP_FASTOPEN on the listening socket. Kernels built without
+// fast open are left as is.
+func (o ListenerOptions) applyPlatform(fd uintptr) error {
+	if o.DeferAccept > 0 {
+		secs := int((o.DeferAccept + time.Second - 1) / time.Second)
+		if err := syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_DEFER_ACCEPT, secs); err != nil {
+			return fmt.Errorf("set defer accept: %w", err)
+		}
+	}
+
+	if o.FastOpenQueue > 0 {
+		err := syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, tcpFastOpen, o.FastOpenQueue)
+		if err != nil && !errors.Is(err, syscall.ENOPROTOOPT) {
+			return fmt.Errorf("set fast open: %w", err)
+		}
+	}
+
+	return nil
+}
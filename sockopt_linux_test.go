@@ -0,0 +1,114 @@
+//go:build linux
+
+package proxyme
+
+import (
+	"errors"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestSocketOptions_apply(t *testing.T) {
+	ls, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ls.Close() // nolint
+
+	conn, err := net.Dial("tcp", ls.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close() // nolint
+
+	opts := SocketOptions{
+		DisableNoDelay: true,
+		ReadBuffer:     64 << 10,
+		DSCP:           46, // expedited forwarding
+		UserTimeout:    1500 * time.Millisecond,
+	}
+	if err := opts.apply(conn); err != nil {
+		t.Fatalf("apply() error = %v", err)
+	}
+
+	raw, err := conn.(*net.TCPConn).SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		level int
+		opt   int
+		check func(v int) bool
+	}{
+		{name: "nodelay", level: syscall.IPPROTO_TCP, opt: syscall.TCP_NODELAY, check: func(v int) bool { return v == 0 }},
+		// the kernel doubles the requested size
+		{name: "rcvbuf", level: syscall.SOL_SOCKET, opt: syscall.SO_RCVBUF, check: func(v int) bool { return v >= 64<<10 }},
+		{name: "tos", level: syscall.IPPROTO_IP, opt: syscall.IP_TOS, check: func(v int) bool { return v == 46<<2 }},
+		{name: "user timeout", level: syscall.IPPROTO_TCP, opt: tcpUserTimeout, check: func(v int) bool { return v == 1500 }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var (
+				v      int
+				getErr error
+			)
+			err := raw.Control(func(fd uintptr) {
+				v, getErr = syscall.GetsockoptInt(int(fd), tt.level, tt.opt)
+			})
+			if err != nil || getErr != nil {
+				t.Fatalf("getsockopt: %v, %v", err, getErr)
+			}
+			if !tt.check(v) {
+				t.Errorf("got %d", v)
+			}
+		})
+	}
+}
+
+func TestListenerOptions_applyPlatform(t *testing.T) {
+	ls, err := ListenerOptions{DeferAccept: 1500 * time.Millisecond, FastOpenQueue: 16}.listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ls.Close() // nolint
+
+	raw, err := ls.(*net.TCPListener).SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		opt   int
+		check func(v int) bool
+	}{
+		// the kernel keeps retransmissions covering the time, the seconds read back are rounded
+		{name: "defer accept", opt: syscall.TCP_DEFER_ACCEPT, check: func(v int) bool { return v >= 2 }},
+		// kernels without fast open refuse the option
+		{name: "fast open", opt: tcpFastOpen, check: func(v int) bool { return v == 16 }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var (
+				v      int
+				getErr error
+			)
+			err := raw.Control(func(fd uintptr) {
+				v, getErr = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_TCP, tt.opt)
+			})
+			if errors.Is(getErr, syscall.ENOPROTOOPT) {
+				t.Skipf("not supported by the kernel: %v", getErr)
+			}
+			if err != nil || getErr != nil {
+				t.Fatalf("getsockopt: %v, %v", err, getErr)
+			}
+			if !tt.check(v) {
+				t.Errorf("got %d", v)
+			}
+		})
+	}
+}
@@ -0,0 +1,17 @@
+//go:build !linux
+
+package proxyme
+
+import "errors"
+
+const platformSockopts = false
+
+// applyPlatform isn't supported, SocketOptions.validate refuses DSCP and UserTimeout.
+func (o SocketOptions) applyPlatform(uintptr, bool) error {
+	return errors.ErrUnsupported
+}
+
+// applyPlatform isn't supported, listener options are ignored.
+func (o ListenerOptions) applyPlatform(uintptr) error {
+	return nil
+}
@@ -0,0 +1,101 @@
+package proxyme
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSocketOptions_validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		opts    SocketOptions
+		wantErr bool
+	}{
+		{name: "zero", opts: SocketOptions{}},
+		{name: "buffers", opts: SocketOptions{ReadBuffer: 1 << 20, WriteBuffer: 1 << 20}},
+		{name: "negative buffer", opts: SocketOptions{ReadBuffer: -1}, wantErr: true},
+		{name: "dscp out of range", opts: SocketOptions{DSCP: 64}, wantErr: true},
+		{name: "negative user timeout", opts: SocketOptions{UserTimeout: -time.Second}, wantErr: true},
+		{name: "platform options", opts: SocketOptions{DSCP: 46, UserTimeout: time.Second}, wantErr: !platformSockopts},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.opts.validate(); (err != nil) != tt.wantErr {
+				t.Errorf("validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSocketOptions_apply_notTCP(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close() // nolint
+	defer server.Close() // nolint
+
+	if err := (SocketOptions{ReadBuffer: 1024, DSCP: 46}).apply(client); err != nil {
+		t.Errorf("apply() error = %v, want non tcp connections skipped", err)
+	}
+}
+
+func TestListenerOptions_listen(t *testing.T) {
+	tests := []struct {
+		name    string
+		opts    ListenerOptions
+		wantErr bool
+	}{
+		{name: "zero"},
+		{name: "tuned", opts: ListenerOptions{DeferAccept: 1500 * time.Millisecond, FastOpenQueue: 16}},
+		{name: "negative defer accept", opts: ListenerOptions{DeferAccept: -time.Second}, wantErr: true},
+		{name: "negative fast open queue", opts: ListenerOptions{FastOpenQueue: -1}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ls, err := tt.opts.listen("127.0.0.1:0")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("listen() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			defer ls.Close() // nolint
+
+			// the client sending data is accepted whatever options are supported
+			conn, err := net.Dial("tcp", ls.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close() // nolint
+			if _, err := conn.Write([]byte{5, 1, 0}); err != nil {
+				t.Fatal(err)
+			}
+
+			accepted, err := ls.Accept()
+			if err != nil {
+				t.Fatalf("accept: %v", err)
+			}
+			_ = accepted.Close()
+		})
+	}
+}
+
+func BenchmarkRelay_socketOptions(b *testing.B) {
+	variants := []struct {
+		name string
+		opts SocketOptions
+	}{
+		{name: "default"},
+		{name: "nagle", opts: SocketOptions{DisableNoDelay: true}},
+		{name: "small buffers", opts: SocketOptions{ReadBuffer: 16 << 10, WriteBuffer: 16 << 10}},
+		{name: "large buffers", opts: SocketOptions{ReadBuffer: 4 << 20, WriteBuffer: 4 << 20}},
+	}
+
+	for _, v := range variants {
+		for _, size := range []int{1 << 10, 256 << 10} {
+			b.Run(fmt.Sprintf("%s/%dKB", v.name, size>>10), func(b *testing.B) {
+				benchmarkRelay(b, Options{AllowNoAuth: true, SocketOptions: v.opts}, size, 1)
+			})
+		}
+	}
+}
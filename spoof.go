@@ -0,0 +1,80 @@
+package proxyme
+
+import (
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+)
+
+// spoofCounts counts traffic dropped by the client address spoof protection.
+type spoofCounts struct {
+	bindPeers atomic.Int64 // BIND incoming connections from unexpected peers
+	datagrams atomic.Int64 // UDP datagrams from addresses other than the client's
+}
+
+// Spoofed returns numbers of BIND incoming connections closed because they came from peers other than
+// the expected one (see Options.BindExpectPeer) and UDP datagrams dropped because they came from
+// addresses other than the associated client's one.
+func (s SOCKS5) Spoofed() (bindPeers, datagrams int64) {
+	if s.spoofed == nil {
+		return 0, 0
+	}
+
+	return s.spoofed.bindPeers.Load(), s.spoofed.datagrams.Load()
+}
+
+// udpSource validates sources of datagrams relayed for the client, so the relay doesn't become
+// an open reflector. Datagrams are accepted from DST.ADDR & DST.PORT of UDP ASSOCIATE request only:
+// unspecified address means the address of the client connection, zero port (and the address if
+// the client one is unknown) is learned from the first datagram.
+type udpSource struct {
+	mu   sync.Mutex
+	ip   netip.Addr // invalid until learned
+	port uint16     // zero until learned
+}
+
+// newUDPSource returns validator of the request sources, clientIP is the address of the client
+// connection, nil if unknown.
+func newUDPSource(cmd commandRequest, clientIP net.IP) *udpSource {
+	src := &udpSource{port: cmd.port}
+
+	ip := net.IP(cmd.addr)
+	if cmd.addressType == domainName || ip.IsUnspecified() {
+		// datagrams don't come from names, pin the client connection address
+		ip = clientIP
+	}
+	if addr, ok := netip.AddrFromSlice(ip); ok {
+		src.ip = addr.Unmap()
+	}
+
+	return src
+}
+
+// accept reports whether the datagram from addr is relayed, unknown parts of the source are learned
+// from the first datagram.
+func (u *udpSource) accept(addr netip.AddrPort) bool {
+	ip := addr.Addr().Unmap()
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.ip.IsValid() && u.ip != ip {
+		return false
+	}
+	if u.port != 0 && u.port != addr.Port() {
+		return false
+	}
+
+	u.ip, u.port = ip, addr.Port()
+
+	return true
+}
+
+// addr returns the learned source, replies are sent to it.
+func (u *udpSource) addr() netip.AddrPort {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	return netip.AddrPortFrom(u.ip, u.port)
+}
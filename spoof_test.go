@@ -0,0 +1,63 @@
+package proxyme
+
+import (
+	"net"
+	"testing"
+)
+
+func Test_udpSource_accept(t *testing.T) {
+	client := net.IPv4(10, 0, 0, 1)
+	other := net.IPv4(10, 0, 0, 2)
+
+	tests := []struct {
+		name     string
+		cmd      commandRequest
+		clientIP net.IP
+		sources  []*net.UDPAddr
+		want     []bool
+	}{
+		{
+			name:    "address and port of the request",
+			cmd:     commandRequest{addressType: ipv4, addr: client.To4(), port: 5000},
+			sources: []*net.UDPAddr{{IP: client, Port: 5000}, {IP: client, Port: 5001}, {IP: other, Port: 5000}},
+			want:    []bool{true, false, false},
+		},
+		{
+			name:     "zero port learned from the first datagram",
+			cmd:      commandRequest{addressType: ipv4, addr: client.To4()},
+			clientIP: client,
+			sources:  []*net.UDPAddr{{IP: client, Port: 5000}, {IP: client, Port: 5000}, {IP: client, Port: 6000}},
+			want:     []bool{true, true, false},
+		},
+		{
+			name:     "unspecified address pinned to the client connection",
+			cmd:      commandRequest{addressType: ipv4, addr: net.IPv4zero.To4()},
+			clientIP: client,
+			sources:  []*net.UDPAddr{{IP: other, Port: 5000}, {IP: client, Port: 5000}, {IP: client, Port: 6000}},
+			want:     []bool{false, true, false},
+		},
+		{
+			name:    "unknown client learned from the first datagram",
+			cmd:     commandRequest{addressType: ipv6, addr: net.IPv6unspecified},
+			sources: []*net.UDPAddr{{IP: other, Port: 5000}, {IP: client, Port: 5000}, {IP: other, Port: 5000}},
+			want:    []bool{true, false, true},
+		},
+		{
+			name:     "domain name pinned to the client connection",
+			cmd:      commandRequest{addressType: domainName, addr: []byte("example.com"), port: 5000},
+			clientIP: client,
+			sources:  []*net.UDPAddr{{IP: other, Port: 5000}, {IP: client, Port: 5000}},
+			want:     []bool{false, true},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src := newUDPSource(tt.cmd, tt.clientIP)
+			for i, addr := range tt.sources {
+				if got := src.accept(addr.AddrPort()); got != tt.want[i] {
+					t.Errorf("accept(%v) = %v, want %v", addr, got, tt.want[i])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,61 @@
+package proxyme
+
+import "sync/atomic"
+
+// stage is a coarse stage of the protocol state machine the session is at.
+type stage int
+
+const (
+	stageNone stage = iota
+	stageGreeting
+	stageAuth
+	stageCommand
+	stageConnect
+	stageBind
+	stageRelay
+	stageCount
+)
+
+var stageNames = [stageCount]string{
+	stageNone:     "none",
+	stageGreeting: "greeting",
+	stageAuth:     "auth",
+	stageCommand:  "command",
+	stageConnect:  "connect",
+	stageBind:     "bind",
+	stageRelay:    "relay",
+}
+
+// stageCounts counts live sessions per stage.
+type stageCounts [stageCount]atomic.Int64
+
+// enter moves the session to the stage, stageNone leaves the state machine.
+func (s *state) enter(st stage) {
+	counts := s.opts.stages
+	if counts == nil || s.stage == st {
+		return
+	}
+
+	if s.stage != stageNone {
+		counts[s.stage].Add(-1)
+	}
+	if st != stageNone {
+		counts[st].Add(1)
+	}
+	s.stage = st
+}
+
+// Stages returns numbers of live sessions per state machine stage (greeting, auth, command,
+// connect, bind, relay). Sessions piling up at a stage point to what they are stuck at.
+func (s SOCKS5) Stages() map[string]int64 {
+	res := make(map[string]int64, stageCount-1)
+	for st := stageNone + 1; st < stageCount; st++ {
+		var n int64
+		if s.stages != nil {
+			n = s.stages[st].Load()
+		}
+		res[stageNames[st]] = n
+	}
+
+	return res
+}
@@ -0,0 +1,62 @@
+package proxyme
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSOCKS5_Stages(t *testing.T) {
+	s, err := New(Options{AllowNoAuth: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	waitStage := func(t *testing.T, name string, want int64) {
+		t.Helper()
+
+		deadline := time.Now().Add(5 * time.Second)
+		for s.Stages()[name] != want {
+			if time.Now().After(deadline) {
+				t.Fatalf("got stages %v, want %s = %d", s.Stages(), name, want)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	client, server := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		s.Handle(server, nil)
+		close(done)
+	}()
+
+	waitStage(t, "greeting", 1)
+
+	if _, err := client.Write([]byte{protoVersion, 1, byte(typeNoAuth)}); err != nil {
+		t.Fatal(err)
+	}
+	reply := make([]byte, 2)
+	if _, err := client.Read(reply); err != nil {
+		t.Fatal(err)
+	}
+
+	waitStage(t, "command", 1)
+	waitStage(t, "greeting", 0)
+
+	_ = client.Close()
+	<-done
+
+	for name, n := range s.Stages() {
+		if n != 0 {
+			t.Errorf("got %d sessions at %s after the session finished", n, name)
+		}
+	}
+}
+
+func TestSOCKS5_Stages_zero(t *testing.T) {
+	stages := SOCKS5{}.Stages()
+	if len(stages) != int(stageCount)-1 {
+		t.Errorf("got stages %v, want all of them", stages)
+	}
+}
@@ -0,0 +1,100 @@
+package proxyme
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultTarpitMaxConns = 256
+	tarpitReadInterval    = time.Second // the client gets a byte read per interval
+	tarpitReadBuffer      = 512         // shrinks receive window so client writes stall soon
+)
+
+// tarpit holds connections of denied clients open to waste time of scanners.
+type tarpit struct {
+	duration time.Duration
+	max      int64
+	active   atomic.Int64
+}
+
+// newTarpit returns tarpit holding connections for duration, nil if duration is zero.
+func newTarpit(duration time.Duration, maxConns int) *tarpit {
+	if duration <= 0 {
+		return nil
+	}
+	if maxConns <= 0 {
+		maxConns = defaultTarpitMaxConns
+	}
+
+	return &tarpit{duration: duration, max: int64(maxConns)}
+}
+
+// acquire takes the tarpit slot, it reports false if the tarpit is full.
+func (t *tarpit) acquire() bool {
+	if t.active.Add(1) > t.max {
+		t.active.Add(-1)
+		return false
+	}
+
+	return true
+}
+
+func (t *tarpit) release() {
+	t.active.Add(-1)
+}
+
+// Tarpitted returns the number of connections being held in the tarpit (see Options.TarpitDuration).
+func (s SOCKS5) Tarpitted() int64 {
+	if s.tarpit == nil {
+		return 0
+	}
+
+	return s.tarpit.active.Load()
+}
+
+// tarpit holds the connection of the denied client open reading it slowly until the tarpit duration
+// expires, the client closes or the session is killed. The connection is closed on return.
+// It reports false without holding if the tarpit is disabled or full.
+func (s *state) tarpit() bool {
+	t := s.opts.tarpit
+	if t == nil || !t.acquire() {
+		return false
+	}
+	defer t.release()
+
+	if s.negotiation != nil {
+		s.negotiation.stop()
+	}
+	conn := unwrap(s.conn)
+	if tcp, ok := conn.(*net.TCPConn); ok {
+		_ = tcp.SetReadBuffer(tarpitReadBuffer)
+	}
+
+	base := s.ctx
+	if base == nil {
+		base = context.Background()
+	}
+	ctx, cancel := context.WithTimeout(base, t.duration)
+	defer cancel()
+
+	// interrupts the blocked read
+	stop := context.AfterFunc(ctx, func() { _ = conn.Close() })
+	defer stop()
+	defer conn.Close() // nolint
+
+	buf := make([]byte, 1)
+	for {
+		if _, err := conn.Read(buf); err != nil {
+			return true
+		}
+
+		select {
+		case <-ctx.Done():
+			return true
+		case <-time.After(tarpitReadInterval):
+		}
+	}
+}
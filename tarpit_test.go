@@ -0,0 +1,105 @@
+package proxyme
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func Test_state_tarpit(t *testing.T) {
+	tests := []struct {
+		name        string
+		tarpit      func() *tarpit
+		client      func(client net.Conn) error
+		wantHeld    bool
+		minDuration time.Duration
+		maxDuration time.Duration
+	}{
+		{
+			name:        "disabled",
+			tarpit:      func() *tarpit { return nil },
+			client:      func(client net.Conn) error { return nil },
+			maxDuration: time.Second,
+		},
+		{
+			name:   "held for the duration",
+			tarpit: func() *tarpit { return newTarpit(300*time.Millisecond, 0) },
+			client: func(client net.Conn) error {
+				// the first byte is read at once, the rest waits
+				if _, err := client.Write([]byte("x")); err != nil {
+					return err
+				}
+				_ = client.SetWriteDeadline(time.Now().Add(100 * time.Millisecond))
+				if _, err := client.Write([]byte("y")); err == nil {
+					return fmt.Errorf("the second byte is read at once")
+				}
+				_ = client.SetWriteDeadline(time.Time{})
+
+				// closed once the duration expires
+				if _, err := io.Copy(io.Discard, client); err != nil {
+					return err
+				}
+				return nil
+			},
+			wantHeld:    true,
+			minDuration: 300 * time.Millisecond,
+			maxDuration: 2 * time.Second,
+		},
+		{
+			name:   "client closes",
+			tarpit: func() *tarpit { return newTarpit(time.Minute, 0) },
+			client: func(client net.Conn) error {
+				return client.Close()
+			},
+			wantHeld:    true,
+			maxDuration: time.Second,
+		},
+		{
+			name: "full",
+			tarpit: func() *tarpit {
+				t := newTarpit(time.Minute, 1)
+				t.acquire()
+				return t
+			},
+			client:      func(client net.Conn) error { return nil },
+			maxDuration: time.Second,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+
+			s := &state{
+				opts: SOCKS5{tarpit: tt.tarpit()},
+				conn: server,
+			}
+
+			errc := make(chan error, 1)
+			go func() {
+				errc <- tt.client(client)
+			}()
+
+			started := time.Now()
+			held := s.tarpit()
+			elapsed := time.Since(started)
+
+			if held != tt.wantHeld {
+				t.Fatalf("tarpit() = %v, want %v", held, tt.wantHeld)
+			}
+			if elapsed < tt.minDuration || elapsed > tt.maxDuration {
+				t.Errorf("tarpit() took %v, want %v..%v", elapsed, tt.minDuration, tt.maxDuration)
+			}
+			if held {
+				if err := <-errc; err != nil {
+					t.Errorf("client error: %v", err)
+				}
+			}
+			if n := s.opts.Tarpitted(); tt.wantHeld && n != 0 {
+				t.Errorf("Tarpitted() = %d after release", n)
+			}
+		})
+	}
+}
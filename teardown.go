@@ -0,0 +1,53 @@
+package proxyme
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"time"
+)
+
+const (
+	maxRequestSize = 4 + 1 + maxDomainSize + 2 // request header, domain name and port
+	drainTimeout   = 100 * time.Millisecond    // max wait for the rest of the drained request
+)
+
+// drain discards up to limit bytes the client has sent, the rest of the message is awaited
+// for timeout. Connections without read deadlines aren't drained.
+func drain(conn io.Reader, limit int64, timeout time.Duration) {
+	d, ok := conn.(interface{ SetReadDeadline(t time.Time) error })
+	if !ok {
+		return
+	}
+
+	_ = d.SetReadDeadline(time.Now().Add(timeout))
+	_, _ = io.Copy(io.Discard, io.LimitReader(conn, limit))
+	_ = d.SetReadDeadline(time.Time{})
+}
+
+// teardown terminates the client connection after failure reply. If linger is set the proxy
+// half-closes the connection and waits up to linger for the client to close its side, so the reply
+// isn't lost to RST caused by unread client data; clients which don't close in time are reset.
+// Connections without half-close support are closed at once.
+func teardown(conn io.ReadWriteCloser, linger time.Duration) {
+	tcp, ok := conn.(*net.TCPConn)
+	if !ok || linger <= 0 {
+		_ = conn.Close()
+		return
+	}
+
+	if err := tcp.CloseWrite(); err != nil {
+		_ = tcp.Close()
+		return
+	}
+
+	// drain the client until it closes or linger expires
+	_ = tcp.SetReadDeadline(time.Now().Add(linger))
+	if _, err := io.Copy(io.Discard, tcp); errors.Is(err, os.ErrDeadlineExceeded) {
+		// don't keep the socket in FIN_WAIT for the unresponsive client
+		_ = tcp.SetLinger(0)
+	}
+
+	_ = tcp.Close()
+}
@@ -0,0 +1,122 @@
+package proxyme
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func Test_teardown(t *testing.T) {
+	reply := []byte{protoVersion, byte(connectionRefused), 0, byte(ipv4), 0, 0, 0, 0, 0, 0}
+
+	tests := []struct {
+		name   string
+		linger time.Duration
+		client func(client net.Conn) error
+		check  func(elapsed time.Duration) error
+	}{
+		{
+			name: "closed right after reply",
+			client: func(client net.Conn) error {
+				return readReply(client, reply)
+			},
+		},
+		{
+			name:   "client closes in time",
+			linger: 5 * time.Second,
+			client: func(client net.Conn) error {
+				if _, err := client.Write([]byte("pipelined request")); err != nil {
+					return err
+				}
+				if err := readReply(client, reply); err != nil {
+					return err
+				}
+				return client.Close()
+			},
+			check: func(elapsed time.Duration) error {
+				if elapsed >= time.Second {
+					return fmt.Errorf("teardown took %v, want it to finish once the client closes", elapsed)
+				}
+				return nil
+			},
+		},
+		{
+			name:   "unresponsive client is reset",
+			linger: 100 * time.Millisecond,
+			client: func(client net.Conn) error {
+				if err := readReply(client, reply); err != nil {
+					return err
+				}
+
+				// the connection is reset after linger, writes fail
+				deadline := time.Now().Add(5 * time.Second)
+				for time.Now().Before(deadline) {
+					if _, err := client.Write([]byte("x")); err != nil {
+						if !errors.Is(err, syscall.ECONNRESET) && !errors.Is(err, syscall.EPIPE) {
+							return fmt.Errorf("got write error %v, want connection reset", err)
+						}
+						return nil
+					}
+					time.Sleep(10 * time.Millisecond)
+				}
+				return fmt.Errorf("connection isn't reset")
+			},
+			check: func(elapsed time.Duration) error {
+				if elapsed < 100*time.Millisecond {
+					return fmt.Errorf("teardown took %v, want linger", elapsed)
+				}
+				return nil
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := tcpPair(t)
+			defer client.Close() // nolint
+
+			if _, err := server.Write(reply); err != nil {
+				t.Fatal(err)
+			}
+
+			errc := make(chan error, 1)
+			go func() {
+				errc <- tt.client(client)
+			}()
+
+			start := time.Now()
+			teardown(server, tt.linger)
+			elapsed := time.Since(start)
+
+			if err := <-errc; err != nil {
+				t.Errorf("client: %v", err)
+			}
+			if tt.check != nil {
+				if err := tt.check(elapsed); err != nil {
+					t.Error(err)
+				}
+			}
+			if _, err := server.Write(reply); !errors.Is(err, net.ErrClosed) {
+				t.Errorf("got server write error %v, want closed connection", err)
+			}
+		})
+	}
+}
+
+// readReply reads the reply followed by EOF.
+func readReply(client net.Conn, want []byte) error {
+	_ = client.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	got, err := io.ReadAll(client)
+	if err != nil {
+		return fmt.Errorf("read: %w", err)
+	}
+	if string(got) != string(want) {
+		return fmt.Errorf("got %v, want reply %v", got, want)
+	}
+
+	return nil
+}
@@ -0,0 +1,352 @@
+// Package testsupport is a scriptable SOCKS5 client to test proxies against a real handshake,
+// e.g. to check that proxyme Options (rules, authentication etc.) are wired as intended.
+//
+// Negotiation is a script of steps sending protocol messages or expecting the proxy replies.
+// Bytes of any step may be patched or truncated to test how the proxy treats malformed input:
+//
+//	client, _ := testsupport.Dial(proxyAddr, 5*time.Second)
+//	err := client.Run(
+//		testsupport.Greeting(wire.MethodLogin),
+//		testsupport.ExpectMethod(wire.MethodLogin),
+//		testsupport.Login("user", "secret"),
+//		testsupport.ExpectLogin(wire.LoginSucceeded),
+//		testsupport.Request(wire.CommandConnect, "10.0.0.1:22"),
+//		testsupport.ExpectReply(wire.StatusNotAllowed),
+//		testsupport.ExpectClosed(),
+//	)
+package testsupport
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/dblokhin/proxyme/wire"
+)
+
+// Step is a step of the negotiation script: Send is written to the proxy, then Expect checks
+// the proxy response. Either of them may be empty.
+type Step struct {
+	Name   string
+	Send   []byte
+	Expect func(c *Client) error
+}
+
+// Raw returns step sending arbitrary bytes.
+func Raw(name string, b ...byte) Step {
+	return Step{Name: name, Send: b}
+}
+
+// Greeting returns step offering authentication methods.
+func Greeting(methods ...wire.Method) Step {
+	b := []byte{wire.Version, byte(len(methods))}
+	for _, m := range methods {
+		b = append(b, byte(m))
+	}
+
+	return Step{Name: "greeting", Send: b}
+}
+
+// Login returns step sending username/password subnegotiation request (RFC 1929).
+func Login(username, password string) Step {
+	b := []byte{wire.SubnegotiationVersion, byte(len(username))}
+	b = append(b, username...)
+	b = append(b, byte(len(password)))
+	b = append(b, password...)
+
+	return Step{Name: "login", Send: b}
+}
+
+// Request returns step sending the command request to the address (host:port), the host is
+// either ip address or domain name. Invalid address is sent as domain name with zero port.
+func Request(command wire.Command, address string) Step {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		host = address
+	}
+	p, _ := strconv.ParseUint(port, 10, 16)
+
+	return Step{Name: "request", Send: request(command, host, int(p))}
+}
+
+// request encodes the command request to the host (ip or domain name) and port.
+func request(command wire.Command, host string, port int) []byte {
+	b := []byte{wire.Version, byte(command), 0}
+
+	ip := net.ParseIP(host)
+	switch {
+	case ip == nil:
+		b = append(b, byte(wire.AddressDomainName), byte(len(host)))
+		b = append(b, host...)
+	case ip.To4() != nil:
+		b = append(b, byte(wire.AddressIPv4))
+		b = append(b, ip.To4()...)
+	default:
+		b = append(b, byte(wire.AddressIPv6))
+		b = append(b, ip.To16()...)
+	}
+
+	return binary.BigEndian.AppendUint16(b, uint16(port)) // nolint
+}
+
+// Patch returns copy of the step with bytes at offset replaced by b, the message is extended
+// if needed.
+func (s Step) Patch(offset int, b ...byte) Step {
+	send := make([]byte, max(len(s.Send), offset+len(b)))
+	copy(send, s.Send)
+	copy(send[offset:], b)
+	s.Send = send
+
+	return s
+}
+
+// Truncate returns copy of the step sending only first n bytes of the message.
+func (s Step) Truncate(n int) Step {
+	s.Send = s.Send[:min(n, len(s.Send))]
+	return s
+}
+
+// ExpectMethod returns step reading method selection reply and checking the chosen method.
+func ExpectMethod(method wire.Method) Step {
+	return Step{Name: "method reply", Expect: func(c *Client) error {
+		got, err := c.method()
+		if err == nil && got != byte(method) {
+			err = fmt.Errorf("got method %d, want %d", got, method)
+		}
+
+		return err
+	}}
+}
+
+// ExpectLogin returns step reading username/password subnegotiation reply and checking its status.
+func ExpectLogin(status uint8) Step {
+	return Step{Name: "login reply", Expect: func(c *Client) error {
+		got, err := c.loginStatus()
+		if err == nil && got != status {
+			err = fmt.Errorf("got login status %d, want %d", got, status)
+		}
+
+		return err
+	}}
+}
+
+// ExpectReply returns step reading the command reply and checking its status.
+func ExpectReply(status wire.Status) Step {
+	return Step{Name: "command reply", Expect: func(c *Client) error {
+		reply, err := c.Reply()
+		if err == nil && reply.Status != byte(status) {
+			err = fmt.Errorf("got status %d (%v), want %d (%v)", reply.Status, wire.Status(reply.Status), status, status)
+		}
+
+		return err
+	}}
+}
+
+// ExpectClosed returns step checking the proxy has closed the connection.
+func ExpectClosed() Step {
+	return Step{Name: "close", Expect: (*Client).Closed}
+}
+
+// Client is SOCKS5 client connection.
+type Client struct {
+	net.Conn
+}
+
+// Dial connects to the proxy, every operation of the client must complete within timeout.
+func Dial(address string, timeout time.Duration) (*Client, error) {
+	conn, err := net.DialTimeout("tcp", address, timeout)
+	if err != nil {
+		return nil, err
+	}
+	_ = conn.SetDeadline(time.Now().Add(timeout))
+
+	return &Client{Conn: conn}, nil
+}
+
+// Run runs the steps in order until the first failure.
+func (c *Client) Run(steps ...Step) error {
+	for i, s := range steps {
+		if len(s.Send) > 0 {
+			if _, err := c.Write(s.Send); err != nil {
+				return fmt.Errorf("step %d (%s): %w", i, s.Name, err)
+			}
+		}
+		if s.Expect != nil {
+			if err := s.Expect(c); err != nil {
+				return fmt.Errorf("step %d (%s): %w", i, s.Name, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Reply is server reply on the command.
+type Reply struct {
+	Status      byte
+	AddressType byte
+	Addr        []byte // ip or domain name
+	Port        int
+}
+
+// Address returns reply address in net.Dial format.
+func (r Reply) Address() string {
+	host := string(r.Addr)
+	if r.AddressType != byte(wire.AddressDomainName) {
+		host = net.IP(r.Addr).String()
+	}
+
+	return net.JoinHostPort(host, strconv.Itoa(r.Port))
+}
+
+// Greet offers authentication methods and returns the chosen one.
+func (c *Client) Greet(methods ...byte) (byte, error) {
+	req := append([]byte{wire.Version, byte(len(methods))}, methods...)
+	if _, err := c.Write(req); err != nil {
+		return 0, err
+	}
+
+	return c.method()
+}
+
+func (c *Client) method() (byte, error) {
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(c, reply); err != nil {
+		return 0, err
+	}
+	if reply[0] != wire.Version {
+		return 0, fmt.Errorf("invalid version: %d", reply[0])
+	}
+
+	return reply[1], nil
+}
+
+// Login passes username/password subnegotiation and returns the status.
+func (c *Client) Login(username, password string) (byte, error) {
+	if _, err := c.Write(Login(username, password).Send); err != nil {
+		return 0, err
+	}
+
+	return c.loginStatus()
+}
+
+func (c *Client) loginStatus() (byte, error) {
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(c, reply); err != nil {
+		return 0, err
+	}
+
+	return reply[1], nil
+}
+
+// Request sends the command request to the host (ip or domain name) and port.
+func (c *Client) Request(command byte, host string, port int) error {
+	_, err := c.Write(request(wire.Command(command), host, port))
+	return err
+}
+
+// Reply reads server reply on the command.
+func (c *Client) Reply() (Reply, error) {
+	var r Reply
+
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(c, header); err != nil {
+		return r, err
+	}
+	if header[0] != wire.Version {
+		return r, fmt.Errorf("invalid version: %d", header[0])
+	}
+
+	r.Status, r.AddressType = header[1], header[3]
+
+	var size int
+	switch wire.AddressType(r.AddressType) {
+	case wire.AddressIPv4:
+		size = net.IPv4len
+	case wire.AddressIPv6:
+		size = net.IPv6len
+	case wire.AddressDomainName:
+		b := make([]byte, 1)
+		if _, err := io.ReadFull(c, b); err != nil {
+			return r, err
+		}
+		size = int(b[0])
+	default:
+		return r, fmt.Errorf("invalid address type: %d", r.AddressType)
+	}
+
+	payload := make([]byte, size+2)
+	if _, err := io.ReadFull(c, payload); err != nil {
+		return r, err
+	}
+
+	r.Addr = payload[:size]
+	r.Port = int(binary.BigEndian.Uint16(payload[size:]))
+
+	return r, nil
+}
+
+// Connect negotiates noauth CONNECT command to the address.
+func (c *Client) Connect(address string) (Reply, error) {
+	method, err := c.Greet(byte(wire.MethodNoAuth))
+	if err != nil {
+		return Reply{}, err
+	}
+	if method != byte(wire.MethodNoAuth) {
+		return Reply{}, fmt.Errorf("unexpected method: %d", method)
+	}
+
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return Reply{}, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return Reply{}, err
+	}
+
+	if err := c.Request(byte(wire.CommandConnect), host, port); err != nil {
+		return Reply{}, err
+	}
+
+	return c.Reply()
+}
+
+// Echo writes msg and checks it's echoed back.
+func (c *Client) Echo(msg string) error {
+	if _, err := c.Write([]byte(msg)); err != nil {
+		return err
+	}
+
+	got := make([]byte, len(msg))
+	if _, err := io.ReadFull(c, got); err != nil {
+		return err
+	}
+	if string(got) != msg {
+		return fmt.Errorf("got %q, want %q", got, msg)
+	}
+
+	return nil
+}
+
+// Closed checks that server closed the connection.
+func (c *Client) Closed() error {
+	n, err := c.Read(make([]byte, 1))
+	if n > 0 {
+		return errors.New("unexpected data from server")
+	}
+	if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) && !isReset(err) {
+		return fmt.Errorf("expected closed connection, got %v", err)
+	}
+
+	return nil
+}
+
+func isReset(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && !opErr.Timeout()
+}
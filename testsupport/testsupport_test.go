@@ -0,0 +1,166 @@
+package testsupport_test
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/dblokhin/proxyme"
+	"github.com/dblokhin/proxyme/testsupport"
+	"github.com/dblokhin/proxyme/wire"
+)
+
+func TestStep(t *testing.T) {
+	tests := []struct {
+		name string
+		step testsupport.Step
+		want []byte
+	}{
+		{
+			name: "greeting",
+			step: testsupport.Greeting(wire.MethodNoAuth, wire.MethodLogin),
+			want: []byte{5, 2, 0, 2},
+		},
+		{
+			name: "login",
+			step: testsupport.Login("u", "pw"),
+			want: []byte{1, 1, 'u', 2, 'p', 'w'},
+		},
+		{
+			name: "ipv4 request",
+			step: testsupport.Request(wire.CommandConnect, "127.0.0.1:80"),
+			want: []byte{5, 1, 0, 1, 127, 0, 0, 1, 0, 80},
+		},
+		{
+			name: "domain request",
+			step: testsupport.Request(wire.CommandBind, "ex.com:443"),
+			want: []byte{5, 2, 0, 3, 6, 'e', 'x', '.', 'c', 'o', 'm', 1, 187},
+		},
+		{
+			name: "patched",
+			step: testsupport.Greeting(wire.MethodNoAuth).Patch(1, 9),
+			want: []byte{5, 9, 0},
+		},
+		{
+			name: "extended",
+			step: testsupport.Greeting(wire.MethodNoAuth).Patch(3, 1, 2),
+			want: []byte{5, 1, 0, 1, 2},
+		},
+		{
+			name: "truncated",
+			step: testsupport.Request(wire.CommandConnect, "127.0.0.1:80").Truncate(5),
+			want: []byte{5, 1, 0, 1, 127},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if !bytes.Equal(tt.step.Send, tt.want) {
+				t.Errorf("got % x, want % x", tt.step.Send, tt.want)
+			}
+		})
+	}
+}
+
+func TestClient_Run(t *testing.T) {
+	addr := serve(t, proxyme.Options{
+		Authenticate: proxyme.StaticCredentials(map[string]string{"user": "secret"}),
+	})
+
+	tests := []struct {
+		name    string
+		steps   []testsupport.Step
+		wantErr bool
+	}{
+		{
+			name: "login",
+			steps: []testsupport.Step{
+				testsupport.Greeting(wire.MethodLogin),
+				testsupport.ExpectMethod(wire.MethodLogin),
+				testsupport.Login("user", "secret"),
+				testsupport.ExpectLogin(wire.LoginSucceeded),
+			},
+		},
+		{
+			name: "wrong expectation",
+			steps: []testsupport.Step{
+				testsupport.Greeting(wire.MethodNoAuth),
+				testsupport.ExpectMethod(wire.MethodNoAuth),
+			},
+			wantErr: true,
+		},
+		{
+			name: "malformed greeting",
+			steps: []testsupport.Step{
+				testsupport.Greeting(wire.MethodLogin).Patch(0, 4),
+				testsupport.ExpectClosed(),
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, err := testsupport.Dial(addr, 5*time.Second)
+			if err != nil {
+				t.Fatalf("Dial() error = %v", err)
+			}
+			defer client.Close()
+
+			if err := client.Run(tt.steps...); (err != nil) != tt.wantErr {
+				t.Errorf("Run() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func ExampleClient_Run() {
+	socks5, _ := proxyme.New(proxyme.Options{
+		AllowNoAuth: true,
+		Rules: func(info proxyme.SessionInfo) error {
+			return proxyme.ErrNotAllowed
+		},
+	})
+
+	ls, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer ls.Close()
+	go func() {
+		conn, _ := ls.Accept()
+		socks5.Handle(conn, nil)
+		_ = conn.Close()
+	}()
+
+	client, _ := testsupport.Dial(ls.Addr().String(), 5*time.Second)
+	defer client.Close()
+
+	err := client.Run(
+		testsupport.Greeting(wire.MethodNoAuth),
+		testsupport.ExpectMethod(wire.MethodNoAuth),
+		testsupport.Request(wire.CommandConnect, "10.0.0.1:22"),
+		testsupport.ExpectReply(wire.StatusNotAllowed),
+		testsupport.ExpectClosed(),
+	)
+	fmt.Println(err)
+	// Output: <nil>
+}
+
+// serve runs the SOCKS5 server on the loopback until the test ends.
+func serve(t *testing.T, opts proxyme.Options) string {
+	t.Helper()
+
+	socks5, err := proxyme.New(opts)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+
+	ls, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { _ = ls.Close() })
+
+	srv := &proxyme.Server{SOCKS5: socks5}
+	go srv.Serve(ls) // nolint
+	t.Cleanup(func() { _ = srv.Close() })
+
+	return ls.Addr().String()
+}
@@ -0,0 +1,34 @@
+package proxyme
+
+import "time"
+
+// Timings are latencies of the session stages, a field is zero until the stage is over.
+type Timings struct {
+	// Auth is the time from accepting the client to successful authentication.
+	Auth time.Duration
+
+	// Dial is the time of connecting to the destination.
+	Dial time.Duration
+
+	// FirstByte is the time from the tunnel establishment to the first byte received from
+	// the destination (TTFB through the tunnel).
+	FirstByte time.Duration
+}
+
+// timed records latency of the session stage, publishes it to the sessions store and reports
+// "latency.<stage>" gauge in seconds to the metrics sink.
+func (s *state) timed(stage string, d time.Duration) {
+	switch stage {
+	case "auth":
+		s.timings.Auth = d
+	case "dial":
+		s.timings.Dial = d
+	case "ttfb":
+		s.timings.FirstByte = d
+	}
+
+	s.publish()
+	if s.opts.metrics != nil {
+		s.opts.metrics.Gauge("latency."+stage, d.Seconds())
+	}
+}
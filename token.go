@@ -0,0 +1,99 @@
+package proxyme
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+)
+
+const (
+	// defaultTokenMethod is the private method code of shared secret authentication.
+	defaultTokenMethod = 0x80
+
+	minPrivateMethod = 0x80 // X'80' to X'FE' RESERVED FOR PRIVATE METHODS
+	maxPrivateMethod = 0xFE
+)
+
+// tokenAuth is shared secret authentication of private method for trusted sidecars. The client sends
+// the token in the message similar to RFC 1929 request:
+//
+//	+----+-----+----------+
+//	|VER | LEN |  TOKEN   |
+//	+----+-----+----------+
+//	| 1  |  1  | 1 to 255 |
+//	+----+-----+----------+
+//
+// and gets the same reply as username/password method: VER X'01', STATUS X'00' on success.
+type tokenAuth struct {
+	code        authMethod
+	token       []byte
+	rejectDelay time.Duration // max delay of the failure reply (see Options.AuthFailureDelay)
+}
+
+func (a tokenAuth) method() authMethod {
+	return a.code
+}
+
+func (a tokenAuth) auth(_ context.Context, conn io.ReadWriteCloser) (io.ReadWriteCloser, string, error) {
+	var req tokenRequest
+	if _, err := req.ReadFrom(conn); err != nil {
+		return conn, "", fmt.Errorf("sock read: %w", err)
+	}
+
+	if req.version != subnVersion {
+		return conn, "", fmt.Errorf("%w: invalid subnegotion version: %d", errMalformed, req.version)
+	}
+
+	if subtle.ConstantTimeCompare(req.token, a.token) != 1 {
+		reject(conn, loginReply{denied}, a.rejectDelay)
+		return conn, "", ErrInvalidCredentials
+	}
+
+	if err := sendPipelined(conn, loginReply{success}); err != nil {
+		return conn, "", fmt.Errorf("sock write: %w", err)
+	}
+
+	return conn, "", nil
+}
+
+// tokenRequest is the client message of shared secret authentication.
+type tokenRequest struct {
+	version uint8 // MUST BE 1
+	token   []byte
+}
+
+func (r *tokenRequest) ReadFrom(reader io.Reader) (n int64, err error) {
+	if err = binary.Read(reader, binary.BigEndian, &r.version); err != nil {
+		return
+	}
+	n++
+
+	var size uint8
+	if err = binary.Read(reader, binary.BigEndian, &size); err != nil {
+		return
+	}
+	n++
+
+	r.token = make([]byte, size)
+	if _, err = io.ReadFull(reader, r.token); err != nil {
+		return
+	}
+	n += int64(size) //nolint
+
+	return
+}
+
+// TokenAuthenticator returns Options.Authenticate callback accepting clients which send the shared
+// secret token as username, the password is ignored. Use it for clients which can't speak private
+// methods (see Options.Token).
+func TokenAuthenticator(token string) func(username, password []byte) error {
+	return func(username, _ []byte) error {
+		if token == "" || subtle.ConstantTimeCompare(username, []byte(token)) != 1 {
+			return ErrInvalidCredentials
+		}
+		return nil
+	}
+}
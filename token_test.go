@@ -0,0 +1,72 @@
+package proxyme
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"testing"
+)
+
+// scriptedConn reads the script and records writes.
+type scriptedConn struct {
+	r io.Reader
+	w bytes.Buffer
+}
+
+func (c *scriptedConn) Read(p []byte) (int, error)  { return c.r.Read(p) }
+func (c *scriptedConn) Write(p []byte) (int, error) { return c.w.Write(p) }
+func (c *scriptedConn) Close() error                { return nil }
+
+func Test_tokenAuth_auth(t *testing.T) {
+	tests := []struct {
+		name      string
+		request   []byte
+		wantReply []byte
+		wantErr   bool
+	}{
+		{name: "valid token", request: []byte{subnVersion, 3, 'a', 'b', 'c'}, wantReply: []byte{subnVersion, 0}},
+		{name: "wrong token", request: []byte{subnVersion, 3, 'a', 'b', 'x'}, wantReply: []byte{subnVersion, 0xff}, wantErr: true},
+		{name: "empty token", request: []byte{subnVersion, 0}, wantReply: []byte{subnVersion, 0xff}, wantErr: true},
+		{name: "invalid version", request: []byte{5, 3, 'a', 'b', 'c'}, wantErr: true},
+		{name: "truncated", request: []byte{subnVersion, 3, 'a'}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := &scriptedConn{r: bytes.NewReader(tt.request)}
+			a := tokenAuth{code: defaultTokenMethod, token: []byte("abc")}
+
+			_, username, err := a.auth(context.Background(), conn)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("auth() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if username != "" {
+				t.Errorf("got username %q, want empty", username)
+			}
+			if !bytes.Equal(conn.w.Bytes(), tt.wantReply) {
+				t.Errorf("got reply %v, want %v", conn.w.Bytes(), tt.wantReply)
+			}
+		})
+	}
+}
+
+func TestTokenAuthenticator(t *testing.T) {
+	tests := []struct {
+		name     string
+		token    string
+		username string
+		wantErr  bool
+	}{
+		{name: "valid", token: "abc", username: "abc"},
+		{name: "invalid", token: "abc", username: "abd", wantErr: true},
+		{name: "empty token never matches", token: "", username: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := TokenAuthenticator(tt.token)([]byte(tt.username), []byte("ignored"))
+			if (err != nil) != tt.wantErr || (err != nil && !errors.Is(err, ErrInvalidCredentials)) {
+				t.Errorf("got error %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,200 @@
+package proxyme
+
+import (
+	"cmp"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// defaultTopStatsWindow is the default period of top statistics.
+const defaultTopStatsWindow = time.Hour
+
+// TopStats is rolling statistics of the recent sessions (see Options.TopStatsSize).
+type TopStats struct {
+	// Destinations are the most requested destinations (host:port) by the number of commands.
+	Destinations []TopEntry
+
+	// Users are authenticated users by bytes transferred through their tunnels in both directions.
+	Users []TopEntry
+}
+
+// TopEntry is the key of top statistics and its count.
+type TopEntry struct {
+	Key   string
+	Count int64
+}
+
+// topStats counts destinations and users over the current and the previous windows.
+type topStats struct {
+	size   int
+	window time.Duration
+
+	mu      sync.Mutex
+	started time.Time      // start of the current window
+	dst     [2]*topCounter // current and previous windows
+	users   [2]*topCounter
+}
+
+// newTopStats returns top statistics keeping up to size keys per window, nil if disabled.
+func newTopStats(size int, window time.Duration) *topStats {
+	if size <= 0 {
+		return nil
+	}
+	if window <= 0 {
+		window = defaultTopStatsWindow
+	}
+
+	return &topStats{
+		size:    size,
+		window:  window,
+		started: time.Now(),
+		dst:     [2]*topCounter{newTopCounter(size), newTopCounter(size)},
+		users:   [2]*topCounter{newTopCounter(size), newTopCounter(size)},
+	}
+}
+
+// rotate starts the new window if the current one is over, the lock must be held.
+func (t *topStats) rotate(now time.Time) {
+	elapsed := now.Sub(t.started)
+	if elapsed < t.window {
+		return
+	}
+
+	t.dst[1], t.users[1] = t.dst[0], t.users[0]
+	if elapsed >= 2*t.window {
+		// nothing has been counted for the whole window
+		t.dst[1], t.users[1] = newTopCounter(t.size), newTopCounter(t.size)
+	}
+	t.dst[0], t.users[0] = newTopCounter(t.size), newTopCounter(t.size)
+	t.started = now.Add(-elapsed % t.window)
+}
+
+// request counts the command to the destination.
+func (t *topStats) request(dst string) {
+	if t == nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.rotate(time.Now())
+	t.dst[0].add(dst, 1)
+}
+
+// transferred counts bytes transferred by the user.
+func (t *topStats) transferred(user string, n int64) {
+	if t == nil || user == "" || n == 0 {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.rotate(time.Now())
+	t.users[0].add(user, n)
+}
+
+// top returns up to n top keys of both windows.
+func (t *topStats) top(n int) TopStats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.rotate(time.Now())
+
+	return TopStats{
+		Destinations: topOf(n, t.dst[0], t.dst[1]),
+		Users:        topOf(n, t.users[0], t.users[1]),
+	}
+}
+
+// topOf merges the counters and returns up to n keys by descending count.
+func topOf(n int, counters ...*topCounter) []TopEntry {
+	merged := make(map[string]int64)
+	for _, c := range counters {
+		for key, count := range c.counts {
+			merged[key] += count
+		}
+	}
+
+	res := make([]TopEntry, 0, len(merged))
+	for key, count := range merged {
+		res = append(res, TopEntry{Key: key, Count: count})
+	}
+	slices.SortFunc(res, func(a, b TopEntry) int {
+		if c := cmp.Compare(b.Count, a.Count); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.Key, b.Key)
+	})
+
+	return res[:min(n, len(res))]
+}
+
+// topCounter counts keys in bounded memory with the space-saving algorithm: once full, the key
+// of the least count is replaced by the new one inheriting its count. Frequent keys stay counted,
+// counts of rare ones may be overestimated.
+type topCounter struct {
+	size   int
+	counts map[string]int64
+}
+
+func newTopCounter(size int) *topCounter {
+	return &topCounter{size: size, counts: make(map[string]int64, size)}
+}
+
+func (c *topCounter) add(key string, n int64) {
+	if _, ok := c.counts[key]; ok || len(c.counts) < c.size {
+		c.counts[key] += n
+		return
+	}
+
+	var (
+		minKey   string
+		minCount int64 = -1
+	)
+	for k, count := range c.counts {
+		if minCount < 0 || count < minCount {
+			minKey, minCount = k, count
+		}
+	}
+	delete(c.counts, minKey)
+	c.counts[key] = minCount + n
+}
+
+// replyCounts counts command replies by status.
+type replyCounts [256]atomic.Int64
+
+func (c *replyCounts) add(status commandStatus) {
+	if c != nil {
+		c[status].Add(1)
+	}
+}
+
+// TopStats returns up to n most requested destinations and users transferred the most bytes over
+// the recent sessions (see Options.TopStatsSize), zero TopStats if disabled.
+func (s SOCKS5) TopStats(n int) TopStats {
+	if s.topStats == nil {
+		return TopStats{}
+	}
+
+	return s.topStats.top(n)
+}
+
+// Replies returns the numbers of command replies sent to clients by status (REP field).
+func (s SOCKS5) Replies() map[int]int64 {
+	res := make(map[int]int64)
+	if s.replies == nil {
+		return res
+	}
+
+	for status := range s.replies {
+		if n := s.replies[status].Load(); n > 0 {
+			res[status] = n
+		}
+	}
+
+	return res
+}
@@ -0,0 +1,65 @@
+package proxyme
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func Test_topCounter(t *testing.T) {
+	c := newTopCounter(2)
+	c.add("a", 5)
+	c.add("b", 1)
+	c.add("a", 1)
+	c.add("c", 1) // replaces b of the least count
+
+	want := map[string]int64{"a": 6, "c": 2}
+	if !reflect.DeepEqual(c.counts, want) {
+		t.Errorf("counts = %v, want %v", c.counts, want)
+	}
+}
+
+func Test_topStats(t *testing.T) {
+	top := newTopStats(10, time.Hour)
+
+	for range 3 {
+		top.request("example.com:443")
+	}
+	top.request("example.org:80")
+	top.transferred("alice", 100)
+	top.transferred("bob", 300)
+	top.transferred("", 1000) // unauthenticated
+
+	want := TopStats{
+		Destinations: []TopEntry{{Key: "example.com:443", Count: 3}},
+		Users:        []TopEntry{{Key: "bob", Count: 300}},
+	}
+	if got := top.top(1); !reflect.DeepEqual(got, want) {
+		t.Errorf("top(1) = %+v, want %+v", got, want)
+	}
+
+	// the previous window is still reported
+	top.started = top.started.Add(-time.Hour)
+	top.request("example.org:80")
+	if got := top.top(10).Destinations; len(got) != 2 || got[1] != (TopEntry{Key: "example.org:80", Count: 2}) {
+		t.Errorf("top(10) destinations = %+v, want counts of both windows", got)
+	}
+
+	// windows without traffic are dropped
+	top.started = top.started.Add(-2 * time.Hour)
+	if got := top.top(10); len(got.Destinations) != 0 || len(got.Users) != 0 {
+		t.Errorf("top(10) = %+v, want empty", got)
+	}
+}
+
+func TestSOCKS5_Replies(t *testing.T) {
+	s := SOCKS5{replies: &replyCounts{}}
+	s.replies.add(succeeded)
+	s.replies.add(succeeded)
+	s.replies.add(hostUnreachable)
+
+	want := map[int]int64{int(succeeded): 2, int(hostUnreachable): 1}
+	if got := s.Replies(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Replies() = %v, want %v", got, want)
+	}
+}
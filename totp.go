@@ -0,0 +1,76 @@
+package proxyme
+
+import (
+	"crypto/hmac"
+	"crypto/sha1" // nolint: RFC 6238 default algorithm
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+const (
+	totpDigits = 6
+	totpStep   = 30 * time.Second
+	totpSkew   = 1 // accepted time steps before and after the current one (clock drift)
+)
+
+// TOTP returns Authenticate callback adding TOTP second factor (RFC 6238: HMAC-SHA1, 30 seconds step,
+// 6 digits) to authenticate: clients append the current code to the password, e.g. "secret123456",
+// so no protocol changes are needed. The password without the code is checked by authenticate,
+// the code is checked against the user secret returned by secret (raw key bytes, decode base32
+// secrets of authenticator apps first). Codes of adjacent time steps are accepted for clock drift.
+func TOTP(authenticate func(username, password []byte) error, secret func(username []byte) ([]byte, error)) func(username, password []byte) error {
+	return func(username, password []byte) error {
+		if len(password) <= totpDigits {
+			return ErrInvalidCredentials
+		}
+		password, code := password[:len(password)-totpDigits], password[len(password)-totpDigits:]
+
+		if err := authenticate(username, password); err != nil {
+			return err
+		}
+
+		key, err := secret(username)
+		if err != nil {
+			return fmt.Errorf("totp secret: %w", err)
+		}
+		if !checkTOTP(key, code, time.Now()) {
+			return ErrInvalidCredentials
+		}
+
+		return nil
+	}
+}
+
+// checkTOTP reports whether code is valid at the moment.
+func checkTOTP(key, code []byte, now time.Time) bool {
+	counter := uint64(now.Unix() / int64(totpStep/time.Second)) // nolint
+
+	valid := false
+	for i := -totpSkew; i <= totpSkew; i++ {
+		// check all the steps to keep timing the same
+		if EqualCredentials(totpCode(key, counter+uint64(i), totpDigits), code) { // nolint
+			valid = true
+		}
+	}
+
+	return valid
+}
+
+// totpCode returns HOTP value of the counter (RFC 4226).
+func totpCode(key []byte, counter uint64, digits int) []byte {
+	mac := hmac.New(sha1.New, key)
+	_ = binary.Write(mac, binary.BigEndian, counter)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:]) & 0x7fffffff
+
+	code := make([]byte, digits)
+	for i := digits - 1; i >= 0; i-- {
+		code[i] = byte('0' + value%10)
+		value /= 10
+	}
+
+	return code
+}
@@ -0,0 +1,93 @@
+package proxyme
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// test vectors of RFC 6238 (SHA1)
+func Test_totpCode(t *testing.T) {
+	key := []byte("12345678901234567890")
+
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{unix: 59, want: "94287082"},
+		{unix: 1111111109, want: "07081804"},
+		{unix: 1234567890, want: "89005924"},
+		{unix: 20000000000, want: "65353130"},
+	}
+	for _, tt := range tests {
+		if got := totpCode(key, uint64(tt.unix/30), 8); string(got) != tt.want { // nolint
+			t.Errorf("totpCode(%d) = %s, want %s", tt.unix, got, tt.want)
+		}
+	}
+}
+
+func Test_checkTOTP(t *testing.T) {
+	key := []byte("12345678901234567890")
+	now := time.Unix(1234567890, 0)
+	code := func(at time.Time) []byte {
+		return totpCode(key, uint64(at.Unix()/30), totpDigits) // nolint
+	}
+
+	tests := []struct {
+		name string
+		code []byte
+		want bool
+	}{
+		{name: "current", code: code(now), want: true},
+		{name: "previous step", code: code(now.Add(-totpStep)), want: true},
+		{name: "next step", code: code(now.Add(totpStep)), want: true},
+		{name: "expired", code: code(now.Add(-3 * totpStep)), want: false},
+		{name: "wrong", code: []byte("000000"), want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := checkTOTP(key, tt.code, now); got != tt.want {
+				t.Errorf("checkTOTP() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTOTP(t *testing.T) {
+	key := []byte("12345678901234567890")
+	errNoSecret := errors.New("no secret")
+
+	auth := TOTP(StaticCredentials(map[string]string{"user": "pass", "nokey": "pass"}), func(username []byte) ([]byte, error) {
+		if string(username) == "user" {
+			return key, nil
+		}
+		return nil, errNoSecret
+	})
+	code := string(totpCode(key, uint64(time.Now().Unix()/30), totpDigits)) // nolint
+
+	tests := []struct {
+		name     string
+		username string
+		password string
+		wantErr  error
+	}{
+		{name: "valid", username: "user", password: "pass" + code},
+		{name: "wrong password", username: "user", password: "wrong" + code, wantErr: ErrInvalidCredentials},
+		{name: "missing code", username: "user", password: "pass", wantErr: ErrInvalidCredentials},
+		{name: "wrong code", username: "user", password: "pass000000", wantErr: ErrInvalidCredentials},
+		{name: "no secret", username: "nokey", password: "pass" + code, wantErr: errNoSecret},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// the code may be rejected if "wrong code" is accidentally valid, ignore such case
+			if tt.name == "wrong code" && checkTOTP(key, []byte("000000"), time.Now()) {
+				t.Skip("000000 is valid code at the moment")
+			}
+
+			err := auth([]byte(tt.username), []byte(tt.password))
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("auth() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,91 @@
+//go:build linux && !386
+
+package transparent
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	soOriginalDst     = 80 // SO_ORIGINAL_DST from linux/netfilter_ipv4.h
+	ip6tSoOriginalDst = 80 // IP6T_SO_ORIGINAL_DST from linux/netfilter_ipv6/ip6_tables.h
+)
+
+func originalDst(conn *net.TCPConn) (*net.TCPAddr, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+
+	local, ok := conn.LocalAddr().(*net.TCPAddr)
+	if !ok {
+		return nil, fmt.Errorf("unexpected local address: %v", conn.LocalAddr())
+	}
+
+	var (
+		addr    *net.TCPAddr
+		sockErr error
+	)
+
+	err = raw.Control(func(fd uintptr) {
+		if local.IP.To4() != nil {
+			addr, sockErr = getOriginalDst4(fd)
+		} else {
+			addr, sockErr = getOriginalDst6(fd)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return addr, sockErr
+}
+
+func getOriginalDst4(fd uintptr) (*net.TCPAddr, error) {
+	var sa syscall.RawSockaddrInet4
+
+	if err := getsockopt(fd, syscall.SOL_IP, soOriginalDst, unsafe.Pointer(&sa), unsafe.Sizeof(sa)); err != nil {
+		return nil, fmt.Errorf("getsockopt SO_ORIGINAL_DST: %w", err)
+	}
+
+	return &net.TCPAddr{
+		IP:   net.IPv4(sa.Addr[0], sa.Addr[1], sa.Addr[2], sa.Addr[3]),
+		Port: int(ntohs(sa.Port)),
+	}, nil
+}
+
+func getOriginalDst6(fd uintptr) (*net.TCPAddr, error) {
+	var sa syscall.RawSockaddrInet6
+
+	if err := getsockopt(fd, syscall.SOL_IPV6, ip6tSoOriginalDst, unsafe.Pointer(&sa), unsafe.Sizeof(sa)); err != nil {
+		return nil, fmt.Errorf("getsockopt IP6T_SO_ORIGINAL_DST: %w", err)
+	}
+
+	return &net.TCPAddr{
+		IP:   net.IP(sa.Addr[:]),
+		Port: int(ntohs(sa.Port)),
+	}, nil
+}
+
+func getsockopt(fd uintptr, level, name int, value unsafe.Pointer, size uintptr) error {
+	length := uint32(size) // nolint
+	_, _, errno := syscall.Syscall6(syscall.SYS_GETSOCKOPT, fd, uintptr(level), uintptr(name),
+		uintptr(value), uintptr(unsafe.Pointer(&length)), 0)
+	if errno != 0 {
+		return errno
+	}
+
+	return nil
+}
+
+// ntohs converts port from network byte order stored as native uint16.
+func ntohs(port uint16) uint16 {
+	var p [2]byte
+	*(*uint16)(unsafe.Pointer(&p[0])) = port // nolint
+
+	return binary.BigEndian.Uint16(p[:])
+}
@@ -0,0 +1,10 @@
+//go:build linux && 386
+
+package transparent
+
+import "net"
+
+// originalDst isn't supported on linux/386: getsockopt(2) goes through socketcall(2) there.
+func originalDst(*net.TCPConn) (*net.TCPAddr, error) {
+	return nil, ErrUnsupported
+}
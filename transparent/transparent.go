@@ -0,0 +1,117 @@
+// Package transparent accepts TCP connections transparently redirected to the proxy by the firewall
+// (iptables REDIRECT or TPROXY targets) and feeds them into proxyme SOCKS5 handler, so the same
+// Connect callback, filters and hooks serve both explicit SOCKS5 clients and redirected traffic.
+//
+// Original destination is available on Linux only: REDIRECT connections are resolved with
+// SO_ORIGINAL_DST socket option (except linux/386), TPROXY connections keep it as the local address.
+// Other platforms return ErrUnsupported.
+package transparent
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"runtime/debug"
+	"time"
+
+	"github.com/dblokhin/proxyme"
+)
+
+// Backoff of temporary accept errors, the same as proxyme.Server has.
+const (
+	minAcceptDelay = 5 * time.Millisecond
+	maxAcceptDelay = time.Second
+)
+
+// ErrUnsupported is returned on platforms without transparent proxy support.
+var ErrUnsupported = errors.New("transparent proxy is not supported on this platform")
+
+// Mode is the way connections are redirected to the proxy.
+type Mode int
+
+const (
+	// Redirect is for iptables REDIRECT (DNAT) target: original destination is taken from conntrack.
+	Redirect Mode = iota
+
+	// TPROXY is for iptables TPROXY target: original destination is the local address of the connection.
+	// Listener must be created with ListenTPROXY.
+	TPROXY
+)
+
+// OriginalDst returns original destination of the redirected connection.
+func OriginalDst(conn *net.TCPConn, mode Mode) (*net.TCPAddr, error) {
+	switch mode {
+	case Redirect:
+		return originalDst(conn)
+	case TPROXY:
+		addr, ok := conn.LocalAddr().(*net.TCPAddr)
+		if !ok {
+			return nil, fmt.Errorf("unexpected local address: %v", conn.LocalAddr())
+		}
+		return addr, nil
+	default:
+		return nil, fmt.Errorf("unknown mode: %d", mode)
+	}
+}
+
+// Serve accepts redirected connections on the listener and handles each of them by socks5 in
+// a new goroutine. Serve always returns non-nil *proxyme.AcceptError. Temporary accept errors
+// (e.g. too many open files) are retried with exponential backoff. onError is called on
+// per-connection errors, recovered panics (as *proxyme.SessionError) and retried accept errors,
+// use nil here if it doesn't need.
+func Serve(ls net.Listener, socks5 *proxyme.SOCKS5, mode Mode, onError func(error)) error {
+	var delay time.Duration
+	for {
+		conn, err := ls.Accept()
+		if err != nil {
+			if !temporary(err) {
+				return &proxyme.AcceptError{Err: err}
+			}
+
+			delay = min(max(2*delay, minAcceptDelay), maxAcceptDelay)
+			if onError != nil {
+				onError(&proxyme.AcceptError{Temporary: true, Delay: delay, Err: err})
+			}
+			time.Sleep(delay)
+
+			continue
+		}
+		delay = 0
+
+		go handle(conn, socks5, mode, onError)
+	}
+}
+
+// temporary reports whether accept error is temporary and the listener is still usable.
+func temporary(err error) bool {
+	var te interface{ Temporary() bool }
+	return errors.As(err, &te) && te.Temporary()
+}
+
+func handle(conn net.Conn, socks5 *proxyme.SOCKS5, mode Mode, onError func(error)) {
+	defer conn.Close() // nolint
+
+	defer func() {
+		if r := recover(); r != nil && onError != nil {
+			onError(&proxyme.SessionError{Client: conn.RemoteAddr(), Panic: true, Err: fmt.Errorf("%v\n%s", r, debug.Stack())})
+		}
+	}()
+
+	tcp, ok := conn.(*net.TCPConn)
+	if !ok {
+		if onError != nil {
+			onError(fmt.Errorf("not tcp connection: %v", conn.RemoteAddr()))
+		}
+		return
+	}
+
+	dst, err := OriginalDst(tcp, mode)
+	if err != nil {
+		if onError != nil {
+			onError(fmt.Errorf("original destination: %w", err))
+		}
+		return
+	}
+
+	socks5.HandleTransparent(conn, dst, onError)
+}
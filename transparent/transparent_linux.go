@@ -0,0 +1,36 @@
+//go:build linux
+
+package transparent
+
+import (
+	"context"
+	"net"
+	"syscall"
+)
+
+// ipv6Transparent is IPV6_TRANSPARENT from linux/in6.h.
+const ipv6Transparent = 75
+
+// ListenTPROXY announces on the local address with IP_TRANSPARENT socket option set
+// to accept connections redirected by iptables TPROXY target. It requires CAP_NET_ADMIN.
+func ListenTPROXY(ctx context.Context, network, address string) (net.Listener, error) {
+	lc := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			var sockErr error
+
+			err := c.Control(func(fd uintptr) {
+				sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_IP, syscall.IP_TRANSPARENT, 1)
+				if sockErr == nil && network == "tcp6" {
+					sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_IPV6, ipv6Transparent, 1)
+				}
+			})
+			if err != nil {
+				return err
+			}
+
+			return sockErr
+		},
+	}
+
+	return lc.Listen(ctx, network, address)
+}
@@ -0,0 +1,18 @@
+//go:build !linux
+
+package transparent
+
+import (
+	"context"
+	"net"
+)
+
+func originalDst(*net.TCPConn) (*net.TCPAddr, error) {
+	return nil, ErrUnsupported
+}
+
+// ListenTPROXY announces on the local address with IP_TRANSPARENT socket option set
+// to accept connections redirected by iptables TPROXY target. It's supported on Linux only.
+func ListenTPROXY(context.Context, string, string) (net.Listener, error) {
+	return nil, ErrUnsupported
+}
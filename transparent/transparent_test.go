@@ -0,0 +1,147 @@
+package transparent
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/dblokhin/proxyme"
+)
+
+func TestOriginalDst(t *testing.T) {
+	ls, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ls.Close()
+
+	go func() {
+		conn, err := net.Dial("tcp", ls.Addr().String())
+		if err == nil {
+			defer conn.Close()
+			_, _ = conn.Read(make([]byte, 1))
+		}
+	}()
+
+	conn, err := ls.Accept()
+	if err != nil {
+		t.Fatalf("accept: %v", err)
+	}
+	defer conn.Close()
+
+	tests := []struct {
+		name    string
+		mode    Mode
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "tproxy: local address",
+			mode: TPROXY,
+			want: ls.Addr().String(),
+		},
+		{
+			name:    "redirect: connection is not redirected",
+			mode:    Redirect,
+			wantErr: true,
+		},
+		{
+			name:    "unknown mode",
+			mode:    Mode(100),
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := OriginalDst(conn.(*net.TCPConn), tt.mode)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("OriginalDst() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && got.String() != tt.want {
+				t.Errorf("OriginalDst() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// flakyListener fails the first accepts with errs.
+type flakyListener struct {
+	net.Listener
+	errs []error
+}
+
+func (l *flakyListener) Accept() (net.Conn, error) {
+	if len(l.errs) > 0 {
+		err := l.errs[0]
+		l.errs = l.errs[1:]
+		return nil, err
+	}
+
+	return l.Listener.Accept()
+}
+
+func TestServe(t *testing.T) {
+	temporaryErr := &net.OpError{Op: "accept", Net: "tcp", Err: syscall.EMFILE}
+
+	socks5, err := proxyme.New(proxyme.Options{
+		AllowNoAuth: true,
+		Connect: func(addressType int, addr []byte, port int) (net.Conn, error) {
+			panic("broken connect")
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ls, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ls.Close()
+
+	reported := make(chan error, 8)
+	served := make(chan error, 1)
+	go func() {
+		served <- Serve(&flakyListener{Listener: ls, errs: []error{temporaryErr, temporaryErr}}, socks5, TPROXY,
+			func(err error) { reported <- err })
+	}()
+
+	conn, err := net.Dial("tcp", ls.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+
+	var temporary int
+	for panicked := false; !panicked; {
+		select {
+		case err := <-reported:
+			var acceptErr *proxyme.AcceptError
+			var sessionErr *proxyme.SessionError
+			switch {
+			case errors.As(err, &acceptErr) && acceptErr.Temporary && errors.Is(err, syscall.EMFILE):
+				temporary++
+			case errors.As(err, &sessionErr) && sessionErr.Panic && strings.Contains(err.Error(), "broken connect"):
+				panicked = true
+			default:
+				t.Fatalf("got reported error %v", err)
+			}
+		case err := <-served:
+			t.Fatalf("serve returned: %v", err)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("panic isn't recovered")
+		}
+	}
+	if temporary != 2 {
+		t.Errorf("got %d temporary accept errors, want 2", temporary)
+	}
+
+	_ = ls.Close()
+	var acceptErr *proxyme.AcceptError
+	if err := <-served; !errors.As(err, &acceptErr) || acceptErr.Temporary || !errors.Is(err, net.ErrClosed) {
+		t.Errorf("got error %v, want fatal accept error", err)
+	}
+}
@@ -0,0 +1,575 @@
+package proxyme
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/netip"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dblokhin/proxyme/wire"
+)
+
+const (
+	// maxUDPDatagramSize is the max payload of UDP over IPv4: 65535 bytes less IP and UDP headers.
+	maxUDPDatagramSize = 65507
+	// maxUDPHeaderSize is the size of the longest UDP request header: domain name address.
+	maxUDPHeaderSize = 4 + 1 + maxDomainSize + 2
+	// maxUDPDestinations bounds destinations remembered by an association, the memory is
+	// reset once it's full.
+	maxUDPDestinations = 1024
+)
+
+// errUDPAssociations is returned when the client has reached Options.MaxUDPAssociationsPerClient.
+var errUDPAssociations = errors.New("too many udp associations")
+
+// PortRange is the range of ports [Min, Max], zero range means ports chosen by the system.
+type PortRange struct {
+	Min int
+	Max int
+}
+
+// valid reports whether the range is zero or ports are in order within 1-65535.
+func (r PortRange) valid() bool {
+	return r == (PortRange{}) || r.Min > 0 && r.Min <= r.Max && r.Max <= 65535
+}
+
+// reasons of dropped datagrams
+const (
+	udpOversized   = iota // payload exceeds Options.UDPMaxDatagramSize
+	udpFragmented         // fragments (FRAG other than 0) aren't supported
+	udpMalformed          // invalid UDP request header
+	udpDenied             // destination is denied by rules or can't be resolved
+	udpUnsolicited        // replies from addresses the client hasn't sent datagrams to
+	udpDropCount
+)
+
+var udpDropNames = [udpDropCount]string{
+	udpOversized:   "oversized",
+	udpFragmented:  "fragmented",
+	udpMalformed:   "malformed",
+	udpDenied:      "denied",
+	udpUnsolicited: "unsolicited",
+}
+
+// udpRelay is configuration and counters of UDP ASSOCIATE relays.
+type udpRelay struct {
+	ports        PortRange
+	maxDatagram  int           // max payload of relayed datagrams
+	bufferSize   int           // SO_RCVBUF and SO_SNDBUF of relay sockets, 0 means system default
+	idleTimeout  time.Duration // 0 means associations live as long as the control connection
+	maxPerClient int           // 0 means unlimited
+	interceptDNS bool          // answer DNS queries to port 53 from the resolver
+	batches      *udpBatches   // datagram buffers shared by associations
+
+	mu      sync.Mutex
+	clients map[string]int // associations by client ip
+	active  atomic.Int64
+	drops   [udpDropCount]atomic.Int64
+}
+
+// newUDPRelay returns UDP ASSOCIATE relay configured by the options, nil if the command is disabled.
+func newUDPRelay(opts Options) *udpRelay {
+	if !opts.AllowUDPAssociate {
+		return nil
+	}
+
+	maxDatagram := opts.UDPMaxDatagramSize
+	if maxDatagram == 0 {
+		maxDatagram = maxUDPDatagramSize
+	}
+
+	return &udpRelay{
+		ports:        opts.UDPPortRange,
+		maxDatagram:  maxDatagram,
+		bufferSize:   opts.UDPBufferSize,
+		idleTimeout:  opts.UDPIdleTimeout,
+		maxPerClient: opts.MaxUDPAssociationsPerClient,
+		interceptDNS: opts.UDPInterceptDNS,
+		batches:      newUDPBatches(opts.UDPBatchSize, maxUDPHeaderSize+maxDatagram+1),
+		clients:      make(map[string]int),
+	}
+}
+
+// associate takes an association slot of the client, the returned func frees it.
+func (u *udpRelay) associate(client net.IP) (func(), error) {
+	key := client.String()
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.maxPerClient > 0 && client != nil && u.clients[key] >= u.maxPerClient {
+		return nil, fmt.Errorf("%w: %s has %d", errUDPAssociations, key, u.clients[key])
+	}
+	u.clients[key]++
+	u.active.Add(1)
+
+	return func() {
+		u.mu.Lock()
+		defer u.mu.Unlock()
+
+		if u.clients[key]--; u.clients[key] <= 0 {
+			delete(u.clients, key)
+		}
+		u.active.Add(-1)
+	}, nil
+}
+
+// listen opens the client side socket of the association on a free port of the range.
+func (u *udpRelay) listen(ip net.IP) (*net.UDPConn, error) {
+	if u.ports.Min == 0 {
+		return u.open(&net.UDPAddr{IP: ip})
+	}
+
+	// start at random port, so concurrent associations don't race for the same ones
+	size := u.ports.Max - u.ports.Min + 1
+	first := rand.IntN(size)
+
+	var err error
+	for i := range size {
+		port := u.ports.Min + (first+i)%size
+
+		var conn *net.UDPConn
+		if conn, err = u.open(&net.UDPAddr{IP: ip, Port: port}); err == nil {
+			return conn, nil
+		}
+	}
+
+	return nil, fmt.Errorf("no free port in %d-%d: %w", u.ports.Min, u.ports.Max, err)
+}
+
+// open opens the relay socket with the configured buffers.
+func (u *udpRelay) open(addr *net.UDPAddr) (*net.UDPConn, error) {
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil || u.bufferSize == 0 {
+		return conn, err
+	}
+
+	if err := conn.SetReadBuffer(u.bufferSize); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	if err := conn.SetWriteBuffer(u.bufferSize); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+func (u *udpRelay) drop(reason int) {
+	u.drops[reason].Add(1)
+}
+
+// UDPAssociations returns the number of active UDP associations.
+func (s SOCKS5) UDPAssociations() int64 {
+	if s.udp == nil {
+		return 0
+	}
+
+	return s.udp.active.Load()
+}
+
+// UDPDrops returns numbers of datagrams dropped by UDP ASSOCIATE relays by reason: "oversized"
+// (see Options.UDPMaxDatagramSize), "fragmented", "malformed" (invalid UDP request header), "denied"
+// (the destination is denied by rules or can't be resolved) and "unsolicited" (replies from
+// addresses the client hasn't sent datagrams to). Datagrams of spoofed clients are counted by
+// SOCKS5.Spoofed.
+func (s SOCKS5) UDPDrops() map[string]int64 {
+	res := make(map[string]int64, udpDropCount)
+	for reason, name := range udpDropNames {
+		var n int64
+		if s.udp != nil {
+			n = s.udp.drops[reason].Load()
+		}
+		res[name] = n
+	}
+
+	return res
+}
+
+func runUDPAssoc(state *state) (transition, error) {
+	relay := state.opts.udp
+	if relay == nil {
+		state.status = notSupported
+		return failCommand, nil
+	}
+
+	clientIP := addrIP(state.clientAddr)
+	release, err := relay.associate(clientIP)
+	if err != nil {
+		state.status = notAllowed
+		return failCommand, err
+	}
+	defer release()
+
+	// the relay listens on the address the client has connected to
+	var localIP net.IP
+	if c, ok := unwrap(state.conn).(interface{ LocalAddr() net.Addr }); ok {
+		localIP = addrIP(c.LocalAddr())
+	}
+
+	client, err := relay.listen(localIP)
+	if err != nil {
+		state.status = sockFailure
+		return failCommand, fmt.Errorf("udp listen: %w", err)
+	}
+	defer client.Close() // nolint
+
+	upstream, err := relay.open(nil)
+	if err != nil {
+		state.status = sockFailure
+		return failCommand, fmt.Errorf("udp listen: %w", err)
+	}
+	defer upstream.Close() // nolint
+
+	assoc := &udpAssociation{
+		state:  state,
+		relay:  relay,
+		source: newUDPSource(state.command, clientIP),
+		dst:    make(map[string]netip.AddrPort),
+		peers:  make(map[netip.AddrPort]struct{}),
+	}
+	if assoc.client, err = newBatchConn(client, relay.batches); err == nil {
+		assoc.upstream, err = newBatchConn(upstream, relay.batches)
+	}
+	if err != nil {
+		state.status = sockFailure
+		return failCommand, fmt.Errorf("udp socket: %w", err)
+	}
+
+	// replyAddress parses tcp addresses only
+	local := client.LocalAddr().(*net.UDPAddr)
+	bndAddrType, bndAddr, bndPort, err := replyAddress(state.opts.replyAddress, state.opts.advertisedAddrs,
+		clientIP, &net.TCPAddr{IP: local.IP, Port: local.Port})
+	if err != nil {
+		return nil, fmt.Errorf("local address: %w", err)
+	}
+	if bndPort == 0 {
+		// the address may be hidden, but the client can't reach the relay without its port
+		bndPort = local.Port
+	}
+
+	reply := commandReply{
+		rep:         succeeded,
+		rsv:         0,
+		addressType: bndAddrType,
+		addr:        bndAddr,
+		port:        uint16(bndPort), // nolint
+	}
+
+	if err := state.sendCommandReply(reply); err != nil {
+		return nil, fmt.Errorf("sock write: %w", err)
+	}
+
+	return nil, assoc.run()
+}
+
+// udpAssociation relays datagrams between the client and destinations.
+type udpAssociation struct {
+	state    *state
+	relay    *udpRelay
+	client   *batchConn // receives datagrams of the client
+	upstream *batchConn // exchanges datagrams with destinations
+	source   *udpSource
+
+	dst map[string]netip.AddrPort // checked destinations by host:port, invalid ones are denied
+
+	mu    sync.Mutex
+	peers map[netip.AddrPort]struct{} // addresses replies are accepted from
+
+	last     atomic.Int64 // unix time of the last relayed datagram, nanoseconds
+	up, down atomic.Int64 // relayed bytes of payload
+}
+
+// run relays datagrams until the control connection is closed or the association is idle
+// for too long.
+func (a *udpAssociation) run() error {
+	state := a.state
+	if state.negotiation != nil {
+		state.negotiation.stop()
+	}
+	control := unwrap(state.conn)
+	state.enter(stageRelay)
+	state.notifyStart()
+
+	var once sync.Once
+	stop := func() {
+		once.Do(func() {
+			_ = a.client.Close()
+			_ = a.upstream.Close()
+			_ = control.Close()
+		})
+	}
+
+	expire := state.limit(a.client, a.upstream, control)
+	a.touch()
+	if timeout := a.relay.idleTimeout; timeout > 0 {
+		deadline := time.Now().Add(timeout)
+		_ = a.client.SetReadDeadline(deadline)
+		_ = a.upstream.SetReadDeadline(deadline)
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	for _, fn := range []func(){a.forward, a.backward} {
+		state.spawn(func() {
+			defer wg.Done()
+			defer stop()
+
+			fn()
+		})
+	}
+
+	// the association terminates with the control connection (RFC 1928 section 7)
+	_, _ = io.Copy(io.Discard, control)
+	stop()
+	wg.Wait()
+
+	state.up, state.down = a.up.Load(), a.down.Load()
+	state.opts.counts.relayed(state.up, state.down)
+
+	return expire()
+}
+
+// forward relays datagrams of the client to their destinations.
+func (a *udpAssociation) forward() {
+	for {
+		b, err := a.client.read(0)
+		if err != nil {
+			if a.active(err) {
+				continue
+			}
+			return
+		}
+
+		// datagrams to send replace the received ones in place, answers to intercepted DNS queries
+		// are sent back to the client
+		out, size := b.msgs[:0], 0
+		var answers *udpBatch
+		for _, m := range b.msgs {
+			if !a.source.accept(m.addr) {
+				if a.state.opts.spoofed != nil {
+					a.state.opts.spoofed.datagrams.Add(1)
+				}
+				continue
+			}
+
+			d, err := wire.ParseDatagram(m.buf)
+			switch {
+			case err != nil:
+				a.relay.drop(udpMalformed)
+				continue
+			case d.Frag != 0:
+				a.relay.drop(udpFragmented)
+				continue
+			case len(d.Data) > a.relay.maxDatagram:
+				a.relay.drop(udpOversized)
+				continue
+			}
+
+			if a.relay.interceptDNS && d.Port == dnsPort {
+				if answers == nil {
+					answers = a.relay.batches.get()
+				}
+				if buf, ok := a.interceptDNS(answers.bufs[len(answers.msgs)][:0], d); ok {
+					answers.msgs = append(answers.msgs, udpMessage{buf: buf, addr: m.addr})
+					a.up.Add(int64(len(d.Data)))
+					a.down.Add(int64(len(buf)))
+					continue
+				}
+			}
+
+			dst, ok := a.destination(d.Address)
+			if !ok {
+				a.relay.drop(udpDenied)
+				continue
+			}
+			out, size = append(out, udpMessage{buf: d.Data, addr: dst}), size+len(d.Data)
+		}
+		b.msgs = out
+
+		if answers != nil {
+			err = a.client.write(answers)
+			a.relay.batches.put(answers)
+			if err != nil {
+				return
+			}
+			a.touch()
+		}
+
+		// unreachable destinations don't terminate the association
+		err = a.upstream.write(b)
+		a.relay.batches.put(b)
+		if err != nil {
+			return
+		}
+		if len(out) > 0 {
+			a.up.Add(int64(size))
+			a.touch()
+		}
+	}
+}
+
+// backward relays replies of destinations to the client.
+func (a *udpAssociation) backward() {
+	var header [maxUDPHeaderSize]byte
+
+	for {
+		b, err := a.upstream.read(maxUDPHeaderSize)
+		if err != nil {
+			if a.active(err) {
+				continue
+			}
+			return
+		}
+
+		client := a.source.addr()
+		out, size := b.msgs[:0], 0
+		for i, m := range b.msgs {
+			if !a.solicited(m.addr) {
+				a.relay.drop(udpUnsolicited)
+				continue
+			}
+			if len(m.buf) > a.relay.maxDatagram {
+				a.relay.drop(udpOversized)
+				continue
+			}
+
+			// the header goes right before the data read at maxUDPHeaderSize of the buffer
+			h, err := udpHeader(header[:0], m.addr)
+			if err != nil {
+				continue
+			}
+			start := maxUDPHeaderSize - len(h)
+			copy(b.bufs[i][start:], h)
+
+			out = append(out, udpMessage{buf: b.bufs[i][start : maxUDPHeaderSize+len(m.buf)], addr: client})
+			size += len(m.buf)
+		}
+		b.msgs = out
+
+		err = a.client.write(b)
+		a.relay.batches.put(b)
+		if err != nil {
+			return
+		}
+		if len(out) > 0 {
+			a.down.Add(int64(size))
+			a.touch()
+		}
+	}
+}
+
+// active arms the read deadline of the idle timeout and reports whether the association goes on
+// after the read error: deadlines expire while the other direction is still relaying.
+func (a *udpAssociation) active(err error) bool {
+	timeout := a.relay.idleTimeout
+	if timeout <= 0 || !errors.Is(err, os.ErrDeadlineExceeded) {
+		return false
+	}
+
+	idle := time.Since(time.Unix(0, a.last.Load()))
+	if idle >= timeout {
+		return false
+	}
+
+	deadline := time.Now().Add(timeout - idle)
+	_ = a.client.SetReadDeadline(deadline)
+	_ = a.upstream.SetReadDeadline(deadline)
+
+	return true
+}
+
+// touch marks the association active and moves the idle deadline.
+func (a *udpAssociation) touch() {
+	a.last.Store(time.Now().UnixNano())
+}
+
+// destination returns the address of the checked destination, ok is false if it's denied.
+// Only the forward direction calls it.
+func (a *udpAssociation) destination(addr wire.Address) (netip.AddrPort, bool) {
+	key := addr.String()
+	if dst, ok := a.dst[key]; ok {
+		return dst, dst.IsValid()
+	}
+
+	dst := a.check(addr)
+
+	a.mu.Lock()
+	if len(a.dst) >= maxUDPDestinations {
+		clear(a.dst)
+		clear(a.peers)
+	}
+	a.dst[key] = dst
+	if dst.IsValid() {
+		a.peers[dst] = struct{}{}
+	}
+	a.mu.Unlock()
+
+	return dst, dst.IsValid()
+}
+
+// check resolves the destination and checks it against the rules, the result is invalid if
+// the destination is denied.
+func (a *udpAssociation) check(addr wire.Address) netip.AddrPort {
+	state := a.state
+
+	info := state.info()
+	info.AddressType, info.Addr, info.Port = int(addr.Type), bytes.Clone(addr.Addr), int(addr.Port)
+
+	if checkPort(state, info.Port) != nil {
+		return netip.AddrPort{}
+	}
+
+	ip := net.IP(info.Addr)
+	if addr.Type == wire.AddressDomainName {
+		ips, err := state.opts.resolver.resolve(string(info.Addr))
+		if err != nil || len(ips) == 0 {
+			return netip.AddrPort{}
+		}
+		info.ResolvedIPs, ip = ips, ips[0]
+	}
+
+	if state.opts.rules != nil && enforceRules(state, info) != nil {
+		return netip.AddrPort{}
+	}
+
+	dst, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return netip.AddrPort{}
+	}
+
+	return netip.AddrPortFrom(dst.Unmap(), addr.Port)
+}
+
+// solicited reports whether the client has sent datagrams to the address.
+func (a *udpAssociation) solicited(from netip.AddrPort) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	_, ok := a.peers[from]
+	return ok
+}
+
+// udpHeader appends UDP request header of the reply from the address.
+func udpHeader(b []byte, from netip.AddrPort) ([]byte, error) {
+	d := wire.Datagram{Address: wire.Address{Type: wire.AddressIPv6, Port: from.Port()}}
+
+	ip := from.Addr()
+	if ip.Is4() {
+		ip4 := ip.As4()
+		d.Type, d.Addr = wire.AddressIPv4, ip4[:]
+	} else {
+		ip16 := ip.As16()
+		d.Addr = ip16[:]
+	}
+
+	return d.AppendTo(b)
+}
@@ -0,0 +1,145 @@
+package proxyme
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"net/netip"
+	"testing"
+)
+
+func Test_udpRelay_associate(t *testing.T) {
+	client := net.IPv4(10, 0, 0, 1)
+	other := net.IPv4(10, 0, 0, 2)
+
+	tests := []struct {
+		name         string
+		maxPerClient int
+		clients      []net.IP
+		wantErr      []bool
+	}{
+		{
+			name:    "unlimited",
+			clients: []net.IP{client, client, client},
+			wantErr: []bool{false, false, false},
+		},
+		{
+			name:         "limited per client",
+			maxPerClient: 1,
+			clients:      []net.IP{client, other, client},
+			wantErr:      []bool{false, false, true},
+		},
+		{
+			name:         "unknown client isn't limited",
+			maxPerClient: 1,
+			clients:      []net.IP{nil, nil},
+			wantErr:      []bool{false, false},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u := newUDPRelay(Options{AllowUDPAssociate: true, MaxUDPAssociationsPerClient: tt.maxPerClient})
+
+			var releases []func()
+			for i, ip := range tt.clients {
+				release, err := u.associate(ip)
+				if (err != nil) != tt.wantErr[i] {
+					t.Fatalf("associate(%v) error = %v, wantErr %v", ip, err, tt.wantErr[i])
+				}
+				if err != nil {
+					if !errors.Is(err, errUDPAssociations) {
+						t.Errorf("associate(%v) error = %v, want %v", ip, err, errUDPAssociations)
+					}
+					continue
+				}
+				releases = append(releases, release)
+			}
+
+			if got := u.active.Load(); got != int64(len(releases)) {
+				t.Errorf("got %d active associations, want %d", got, len(releases))
+			}
+			for _, release := range releases {
+				release()
+			}
+			if got := u.active.Load(); got != 0 || len(u.clients) != 0 {
+				t.Errorf("got %d active associations of %d clients after release", got, len(u.clients))
+			}
+		})
+	}
+}
+
+func Test_udpRelay_listen(t *testing.T) {
+	taken, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer taken.Close()
+	port := taken.LocalAddr().(*net.UDPAddr).Port
+
+	tests := []struct {
+		name    string
+		ports   PortRange
+		want    func(port int) bool
+		wantErr bool
+	}{
+		{
+			name: "system port",
+			want: func(p int) bool { return p > 0 },
+		},
+		{
+			name:    "all ports of the range taken",
+			ports:   PortRange{Min: port, Max: port},
+			wantErr: true,
+		},
+		{
+			name:  "free port of the range",
+			ports: PortRange{Min: port, Max: port + 1},
+			want:  func(p int) bool { return p == port+1 },
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u := newUDPRelay(Options{AllowUDPAssociate: true, UDPPortRange: tt.ports, UDPBufferSize: 64 << 10})
+
+			conn, err := u.listen(net.IPv4(127, 0, 0, 1))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("listen() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+
+			if got := conn.LocalAddr().(*net.UDPAddr).Port; !tt.want(got) {
+				t.Errorf("listen() port = %d", got)
+			}
+		})
+	}
+}
+
+func Test_udpHeader(t *testing.T) {
+	tests := []struct {
+		name string
+		from netip.AddrPort
+		want []byte
+	}{
+		{
+			name: "ipv4",
+			from: netip.MustParseAddrPort("192.0.2.1:53"),
+			want: []byte{0, 0, 0, 1, 192, 0, 2, 1, 0, 53},
+		},
+		{
+			name: "ipv6",
+			from: netip.MustParseAddrPort("[2001:db8::1]:443"),
+			want: []byte{0, 0, 0, 4, 0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 1, 187},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := udpHeader(nil, tt.from)
+			if err != nil || !bytes.Equal(got, tt.want) {
+				t.Errorf("udpHeader() = %v, error %v, want %v", got, err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,70 @@
+package proxyme
+
+import (
+	"net/netip"
+	"sync"
+)
+
+const (
+	// defaultUDPBatchSize is the default number of datagrams read or written per syscall.
+	defaultUDPBatchSize = 32
+	// maxUDPBatchSize is the max number of datagrams per syscall (UIO_MAXIOV of Linux).
+	maxUDPBatchSize = 1024
+)
+
+// udpMessage is a datagram of batched reads and writes.
+type udpMessage struct {
+	buf  []byte         // datagram data
+	addr netip.AddrPort // source of read datagrams, destination of written ones
+}
+
+// udpBatch is datagram buffers and syscall scratch of batched reads and writes.
+type udpBatch struct {
+	bufs [][]byte     // datagram buffers
+	msgs []udpMessage // read datagrams or datagrams to write
+	sys  batchSys     // platform specific scratch
+}
+
+// udpBatches pools batches shared by all associations of the relay: batches are taken once
+// datagrams arrive and returned when they are relayed, so idle associations hold no buffers
+// where the platform reads batches (recvmmsg on Linux).
+type udpBatches struct {
+	size    int // datagrams per batch
+	bufSize int // size of datagram buffers
+	pool    sync.Pool
+}
+
+// newUDPBatches returns pool of batches of up to size datagrams, the size is 1 where batching
+// isn't supported.
+func newUDPBatches(size, bufSize int) *udpBatches {
+	if size <= 0 {
+		size = defaultUDPBatchSize
+	}
+	if !batchSupported {
+		size = 1
+	}
+
+	return &udpBatches{size: size, bufSize: bufSize}
+}
+
+func (p *udpBatches) get() *udpBatch {
+	if b, ok := p.pool.Get().(*udpBatch); ok {
+		return b
+	}
+
+	b := &udpBatch{
+		bufs: make([][]byte, p.size),
+		msgs: make([]udpMessage, 0, p.size),
+		sys:  newBatchSys(p.size),
+	}
+	for i := range b.bufs {
+		b.bufs[i] = make([]byte, p.bufSize)
+	}
+
+	return b
+}
+
+func (p *udpBatches) put(b *udpBatch) {
+	b.msgs = b.msgs[:0]
+	p.pool.Put(b)
+}
@@ -0,0 +1,101 @@
+package proxyme
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func Test_batchConn(t *testing.T) {
+	tests := []struct {
+		name     string
+		sender   string // address of the sending socket
+		receiver string
+		size     int // batch size
+		count    int // datagrams sent
+	}{
+		{
+			name:     "ipv4",
+			sender:   "127.0.0.1:0",
+			receiver: "127.0.0.1:0",
+			size:     8,
+			count:    20,
+		},
+		{
+			name:     "dual stack sender",
+			sender:   ":0",
+			receiver: "127.0.0.1:0",
+			size:     8,
+			count:    3,
+		},
+		{
+			name:     "single datagram batches",
+			sender:   "127.0.0.1:0",
+			receiver: "127.0.0.1:0",
+			size:     1,
+			count:    3,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			batches := newUDPBatches(tt.size, 64)
+			sender := listenBatchConn(t, tt.sender, batches)
+			receiver := listenBatchConn(t, tt.receiver, batches)
+			_ = receiver.SetReadDeadline(time.Now().Add(time.Second))
+
+			dst := receiver.LocalAddr().(*net.UDPAddr).AddrPort()
+			src := netip.AddrPortFrom(netip.MustParseAddr("127.0.0.1"), sender.LocalAddr().(*net.UDPAddr).AddrPort().Port())
+
+			for i := 0; i < tt.count; {
+				b := batches.get()
+				for ; i < tt.count && len(b.msgs) < batches.size; i++ {
+					b.msgs = append(b.msgs, udpMessage{buf: []byte(fmt.Sprint(i)), addr: dst})
+				}
+				if err := sender.write(b); err != nil {
+					t.Fatalf("write() error = %v", err)
+				}
+				batches.put(b)
+			}
+
+			for i := 0; i < tt.count; {
+				b, err := receiver.read(2)
+				if err != nil {
+					t.Fatalf("read() error = %v", err)
+				}
+				if len(b.msgs) > batches.size {
+					t.Fatalf("read() %d datagrams, want up to %d", len(b.msgs), batches.size)
+				}
+				for _, m := range b.msgs {
+					if got, want := string(m.buf), fmt.Sprint(i); got != want || m.addr != src {
+						t.Fatalf("read() %q from %v, want %q from %v", got, m.addr, want, src)
+					}
+					i++
+				}
+				batches.put(b)
+			}
+		})
+	}
+}
+
+func listenBatchConn(tb testing.TB, address string, batches *udpBatches) *batchConn {
+	tb.Helper()
+
+	addr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		tb.Fatalf("listen udp %s: %v", address, err)
+	}
+	tb.Cleanup(func() { _ = conn.Close() })
+
+	c, err := newBatchConn(conn, batches)
+	if err != nil {
+		tb.Fatalf("batch conn: %v", err)
+	}
+
+	return c
+}
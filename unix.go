@@ -0,0 +1,59 @@
+package proxyme
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+// unixScheme is the prefix of unix socket addresses of Server.ListenAndServe.
+const unixScheme = "unix://"
+
+// listen listens on tcp address (host:port) or unix socket (unix:///path/to/socket).
+func (s *Server) listen(address string) (net.Listener, error) {
+	path, ok := strings.CutPrefix(address, unixScheme)
+	if !ok {
+		return s.ListenerOptions.listen(address)
+	}
+
+	return listenUnix(path, s.UnixSocketMode)
+}
+
+// listenUnix listens on unix socket replacing the stale socket file left by the crashed process,
+// the file is removed once the listener is closed. Non-zero mode is set to the socket file.
+func listenUnix(path string, mode os.FileMode) (net.Listener, error) {
+	if path == "" {
+		return nil, errors.New("listen unix: empty socket path")
+	}
+
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode().Type() != os.ModeSocket {
+			return nil, fmt.Errorf("listen unix %s: file exists and isn't a socket", path)
+		}
+
+		// the socket is stale unless somebody listens on it
+		if conn, err := net.Dial("unix", path); err == nil {
+			_ = conn.Close()
+			return nil, fmt.Errorf("listen unix %s: address already in use", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("listen unix: %w", err)
+		}
+	}
+
+	ls, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	if mode != 0 {
+		if err := os.Chmod(path, mode); err != nil {
+			_ = ls.Close()
+			return nil, fmt.Errorf("listen unix: %w", err)
+		}
+	}
+
+	return ls, nil
+}
@@ -0,0 +1,112 @@
+package proxyme
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/dblokhin/proxyme/wire"
+)
+
+// upstreamHandshakeTimeout limits negotiation with the upstream proxy.
+const upstreamHandshakeTimeout = 30 * time.Second
+
+// UpstreamSOCKS5 returns Connect callback tunneling connections through the upstream SOCKS5 proxy
+// at address, use it as Egress.Connect to chain proxies. Username/password authentication is used
+// if username isn't empty. Failure reply statuses of the upstream are returned as the corresponding
+// errors (ErrHostUnreachable etc.), so the client gets the same status.
+func UpstreamSOCKS5(address, username, password string) func(addressType int, addr []byte, port int) (net.Conn, error) {
+	dialer := net.Dialer{Timeout: upstreamHandshakeTimeout}
+
+	return func(addressType int, addr []byte, port int) (net.Conn, error) {
+		conn, err := dialer.Dial("tcp", address)
+		if err != nil {
+			return nil, fmt.Errorf("upstream: %w", dialError(err))
+		}
+
+		_ = conn.SetDeadline(time.Now().Add(upstreamHandshakeTimeout))
+		if err := upstreamHandshake(conn, username, password, addressType, addr, port); err != nil {
+			_ = conn.Close()
+			return nil, fmt.Errorf("upstream %s: %w", address, err)
+		}
+		_ = conn.SetDeadline(time.Time{})
+
+		return conn, nil
+	}
+}
+
+// upstreamHandshake negotiates CONNECT command with the upstream proxy.
+func upstreamHandshake(conn net.Conn, username, password string, addressType int, addr []byte, port int) error {
+	method := wire.MethodNoAuth
+	if username != "" {
+		method = wire.MethodLogin
+	}
+
+	if _, err := (wire.AuthRequest{Methods: []wire.Method{method}}).WriteTo(conn); err != nil {
+		return err
+	}
+
+	var authReply wire.AuthReply
+	if _, err := authReply.ReadFrom(conn); err != nil {
+		return err
+	}
+	if authReply.Method != method {
+		return fmt.Errorf("%w: auth method refused", ErrNotAllowed)
+	}
+
+	if method == wire.MethodLogin {
+		login := wire.LoginRequest{Username: []byte(username), Password: []byte(password)}
+		if _, err := login.WriteTo(conn); err != nil {
+			return err
+		}
+
+		var loginReply wire.LoginReply
+		if _, err := loginReply.ReadFrom(conn); err != nil {
+			return err
+		}
+		if loginReply.Status != wire.LoginSucceeded {
+			return fmt.Errorf("%w: invalid upstream credentials", ErrNotAllowed)
+		}
+	}
+
+	req := wire.CommandRequest{
+		Command: wire.CommandConnect,
+		Address: wire.Address{Type: wire.AddressType(addressType), Addr: addr, Port: uint16(port)}, // nolint
+	}
+	if _, err := req.WriteTo(conn); err != nil {
+		return err
+	}
+
+	var reply wire.CommandReply
+	if _, err := reply.ReadFrom(conn); err != nil {
+		return err
+	}
+
+	return statusError(reply.Status)
+}
+
+// statusError returns error of the failure reply status, the error is mapped back to
+// the same status replying to the client.
+func statusError(status wire.Status) error {
+	var err error
+
+	switch status {
+	case wire.StatusSucceeded:
+		return nil
+	case wire.StatusNotAllowed:
+		err = ErrNotAllowed
+	case wire.StatusNetworkUnreachable:
+		err = ErrNetworkUnreachable
+	case wire.StatusHostUnreachable:
+		err = ErrHostUnreachable
+	case wire.StatusConnectionRefused:
+		err = ErrConnectionRefused
+	case wire.StatusTTLExpired:
+		err = ErrTTLExpired
+	default:
+		err = errors.New(status.String())
+	}
+
+	return fmt.Errorf("reply: %w", err)
+}
@@ -0,0 +1,151 @@
+package proxyme
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ErrTooManySessions rejects the command of the user having Options.MaxSessionsPerUser sessions.
+var ErrTooManySessions = fmt.Errorf("%w: too many sessions of the user", ErrNotAllowed)
+
+// UserSessions is usage of the session limit by the user (see Options.MaxSessionsPerUser).
+type UserSessions struct {
+	Active int // sessions holding a slot
+	Queued int // commands waiting for a slot
+}
+
+// userSlots limits concurrent sessions per username.
+type userSlots struct {
+	max     int           // max sessions per user
+	timeout time.Duration // max time to wait for a slot, 0 means no waiting
+
+	mu    sync.Mutex
+	users map[string]*userSlot
+}
+
+// userSlot is the semaphore of the user, it's removed once nobody holds or waits for it.
+type userSlot struct {
+	sem  chan struct{}
+	refs int // holders and waiters
+}
+
+// newUserSlots returns the limiter of max sessions per user, nil if unlimited.
+func newUserSlots(max int, timeout time.Duration) *userSlots {
+	if max <= 0 {
+		return nil
+	}
+
+	return &userSlots{
+		max:     max,
+		timeout: timeout,
+		users:   make(map[string]*userSlot),
+	}
+}
+
+// acquire takes a slot of the user waiting up to the timeout, the returned func frees it.
+func (l *userSlots) acquire(ctx context.Context, user string) (func(), error) {
+	l.mu.Lock()
+	slot, ok := l.users[user]
+	if !ok {
+		slot = &userSlot{sem: make(chan struct{}, l.max)}
+		l.users[user] = slot
+	}
+	slot.refs++
+	l.mu.Unlock()
+
+	if err := slot.take(ctx, l.timeout); err != nil {
+		l.unref(user, slot)
+		return nil, err
+	}
+
+	return func() {
+		<-slot.sem
+		l.unref(user, slot)
+	}, nil
+}
+
+func (s *userSlot) take(ctx context.Context, timeout time.Duration) error {
+	select {
+	case s.sem <- struct{}{}:
+		return nil
+	default:
+	}
+	if timeout <= 0 {
+		return ErrTooManySessions
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case s.sem <- struct{}{}:
+		return nil
+	case <-timer.C:
+		return fmt.Errorf("%w: no slot in %v", ErrTooManySessions, timeout)
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (l *userSlots) unref(user string, slot *userSlot) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if slot.refs--; slot.refs == 0 {
+		delete(l.users, user)
+	}
+}
+
+// usage returns usage of the users having sessions or waiting for them.
+func (l *userSlots) usage() map[string]UserSessions {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	res := make(map[string]UserSessions, len(l.users))
+	for user, slot := range l.users {
+		active := len(slot.sem)
+		res[user] = UserSessions{Active: active, Queued: max(slot.refs-active, 0)}
+	}
+
+	return res
+}
+
+// takeSlot takes a session slot of the authenticated user, sessions without username aren't limited.
+func (s *state) takeSlot() error {
+	if s.opts.userSlots == nil || s.username == "" {
+		return nil
+	}
+
+	ctx := s.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	release, err := s.opts.userSlots.acquire(ctx, s.username)
+	if err != nil {
+		return fmt.Errorf("user %q: %w", s.username, err)
+	}
+	s.releaseSlot = release
+
+	return nil
+}
+
+// freeSlot frees the session slot of the user if taken.
+func (s *state) freeSlot() {
+	if s.releaseSlot != nil {
+		s.releaseSlot()
+		s.releaseSlot = nil
+	}
+}
+
+// UserSessions returns usage of the session limit by users having sessions or waiting for them
+// (see Options.MaxSessionsPerUser), nil if sessions aren't limited.
+func (s SOCKS5) UserSessions() map[string]UserSessions {
+	if s.userSlots == nil {
+		return nil
+	}
+
+	return s.userSlots.usage()
+}
@@ -0,0 +1,89 @@
+package proxyme
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func Test_userSlots(t *testing.T) {
+	slots := newUserSlots(2, 0)
+
+	first, err := slots.acquire(context.Background(), "alice")
+	if err != nil {
+		t.Fatalf("acquire() error = %v", err)
+	}
+	if _, err := slots.acquire(context.Background(), "alice"); err != nil {
+		t.Fatalf("acquire() error = %v", err)
+	}
+	if _, err := slots.acquire(context.Background(), "alice"); !errors.Is(err, ErrTooManySessions) || !errors.Is(err, ErrNotAllowed) {
+		t.Fatalf("acquire() error = %v, want %v", err, ErrTooManySessions)
+	}
+
+	// other users have their own slots
+	bob, err := slots.acquire(context.Background(), "bob")
+	if err != nil {
+		t.Fatalf("acquire() error = %v", err)
+	}
+
+	want := map[string]UserSessions{"alice": {Active: 2}, "bob": {Active: 1}}
+	if got := slots.usage(); len(got) != len(want) || got["alice"] != want["alice"] || got["bob"] != want["bob"] {
+		t.Errorf("usage() = %v, want %v", got, want)
+	}
+
+	first()
+	if _, err := slots.acquire(context.Background(), "alice"); err != nil {
+		t.Errorf("acquire() of freed slot error = %v", err)
+	}
+
+	bob()
+	if _, ok := slots.usage()["bob"]; ok {
+		t.Errorf("usage() has user without sessions")
+	}
+}
+
+func Test_userSlots_queue(t *testing.T) {
+	slots := newUserSlots(1, time.Second)
+
+	release, err := slots.acquire(context.Background(), "alice")
+	if err != nil {
+		t.Fatalf("acquire() error = %v", err)
+	}
+
+	acquired := make(chan error, 1)
+	go func() {
+		_, err := slots.acquire(context.Background(), "alice")
+		acquired <- err
+	}()
+
+	deadline := time.Now().Add(time.Second)
+	for slots.usage()["alice"].Queued != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("command isn't queued: %v", slots.usage())
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	release()
+	if err := <-acquired; err != nil {
+		t.Fatalf("queued acquire() error = %v", err)
+	}
+
+	// queue timeout
+	slots.timeout = 50 * time.Millisecond
+	if _, err := slots.acquire(context.Background(), "alice"); !errors.Is(err, ErrTooManySessions) {
+		t.Errorf("acquire() error = %v, want %v", err, ErrTooManySessions)
+	}
+
+	// the session is killed while waiting
+	slots.timeout = time.Minute
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := slots.acquire(ctx, "alice"); !errors.Is(err, context.Canceled) {
+		t.Errorf("acquire() error = %v, want %v", err, context.Canceled)
+	}
+	if got := slots.usage()["alice"]; got != (UserSessions{Active: 1}) {
+		t.Errorf("usage() = %v, want the waiters gone", got)
+	}
+}
@@ -0,0 +1,119 @@
+package userstore
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+)
+
+const (
+	// hashScheme prefixes hashes produced by HashPassword.
+	hashScheme = "pbkdf2-sha256"
+
+	// Iterations is PBKDF2 iteration count of HashPassword.
+	Iterations = 100_000
+
+	saltSize = 16
+	keySize  = sha256.Size
+)
+
+// ErrMismatchedPassword is returned by VerifyPassword if the password doesn't match the hash.
+var ErrMismatchedPassword = errors.New("password doesn't match the hash")
+
+// HashPassword returns salted PBKDF2-HMAC-SHA256 hash of the password in the format
+// "pbkdf2-sha256$<iterations>$<salt>$<key>" (base64 salt and key).
+func HashPassword(password []byte) ([]byte, error) {
+	salt := make([]byte, saltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+
+	return encodeHash(Iterations, salt, pbkdf2(password, salt, Iterations)), nil
+}
+
+// VerifyPassword compares the hash produced by HashPassword with the password, it returns
+// ErrMismatchedPassword if they don't match.
+func VerifyPassword(hash, password []byte) error {
+	iterations, salt, key, err := decodeHash(hash)
+	if err != nil {
+		return err
+	}
+
+	if subtle.ConstantTimeCompare(pbkdf2(password, salt, iterations), key) != 1 {
+		return ErrMismatchedPassword
+	}
+
+	return nil
+}
+
+func encodeHash(iterations int, salt, key []byte) []byte {
+	enc := base64.RawStdEncoding
+
+	return fmt.Appendf(nil, "%s$%d$%s$%s", hashScheme, iterations, enc.EncodeToString(salt), enc.EncodeToString(key))
+}
+
+func decodeHash(hash []byte) (iterations int, salt, key []byte, err error) {
+	parts := bytes.Split(hash, []byte("$"))
+	if len(parts) != 4 || string(parts[0]) != hashScheme {
+		return 0, nil, nil, errors.New("unknown password hash format")
+	}
+
+	iterations, err = strconv.Atoi(string(parts[1]))
+	if err != nil || iterations < 1 {
+		return 0, nil, nil, fmt.Errorf("invalid password hash iterations: %q", parts[1])
+	}
+
+	enc := base64.RawStdEncoding
+	if salt, err = enc.DecodeString(string(parts[2])); err != nil {
+		return 0, nil, nil, fmt.Errorf("invalid password hash salt: %w", err)
+	}
+	if key, err = enc.DecodeString(string(parts[3])); err != nil || len(key) != keySize {
+		return 0, nil, nil, fmt.Errorf("invalid password hash key")
+	}
+
+	return iterations, salt, key, nil
+}
+
+// pbkdf2 derives the key of sha256 size from the password (RFC 8018).
+func pbkdf2(password, salt []byte, iterations int) []byte {
+	mac := hmac.New(sha256.New, password)
+	mac.Write(salt)
+	mac.Write(binary.BigEndian.AppendUint32(nil, 1)) // the only block
+
+	u := mac.Sum(nil)
+	key := bytes.Clone(u)
+
+	for i := 1; i < iterations; i++ {
+		mac.Reset()
+		mac.Write(u)
+		u = mac.Sum(u[:0])
+
+		for j := range key {
+			key[j] ^= u[j]
+		}
+	}
+
+	return key
+}
+
+var (
+	dummyOnce sync.Once
+	dummy     []byte
+)
+
+// dummyHash returns the hash verified for unknown users to equalize the timing.
+func dummyHash() []byte {
+	dummyOnce.Do(func() {
+		dummy = encodeHash(Iterations, make([]byte, saltSize), make([]byte, keySize))
+	})
+
+	return dummy
+}
@@ -0,0 +1,63 @@
+package userstore
+
+import (
+	"encoding/hex"
+	"errors"
+	"testing"
+)
+
+func Test_pbkdf2(t *testing.T) {
+	// RFC 7914 section 11 and widely published PBKDF2-HMAC-SHA256 vectors
+	tests := []struct {
+		password   string
+		salt       string
+		iterations int
+		want       string
+	}{
+		{password: "password", salt: "salt", iterations: 1, want: "120fb6cffcf8b32c43e7225256c4f837a86548c92ccc35480805987cb70be17b"},
+		{password: "password", salt: "salt", iterations: 2, want: "ae4d0c95af6b46d32d0adff928f06dd02a303f8ef3c251dfd6e2d85a95474c43"},
+		{password: "password", salt: "salt", iterations: 4096, want: "c5e478d59288c841aa530db6845c4c8d962893a001ce4e11a4963873aa98134a"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.want[:8], func(t *testing.T) {
+			got := hex.EncodeToString(pbkdf2([]byte(tt.password), []byte(tt.salt), tt.iterations))
+			if got != tt.want {
+				t.Errorf("pbkdf2() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHashPassword(t *testing.T) {
+	hash, err := HashPassword([]byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := VerifyPassword(hash, []byte("secret")); err != nil {
+		t.Errorf("VerifyPassword() error = %v", err)
+	}
+	if err := VerifyPassword(hash, []byte("wrong")); !errors.Is(err, ErrMismatchedPassword) {
+		t.Errorf("got %v, want %v", err, ErrMismatchedPassword)
+	}
+
+	other, _ := HashPassword([]byte("secret"))
+	if string(other) == string(hash) {
+		t.Errorf("hashes of the same password aren't salted")
+	}
+}
+
+func TestVerifyPassword_invalidHash(t *testing.T) {
+	for _, hash := range []string{
+		"",
+		"secret",
+		"bcrypt$1$c2FsdA$a2V5",
+		"pbkdf2-sha256$0$c2FsdA$a2V5",
+		"pbkdf2-sha256$1$!$a2V5",
+		"pbkdf2-sha256$1$c2FsdA$a2V5", // short key
+	} {
+		if err := VerifyPassword([]byte(hash), []byte("secret")); err == nil || errors.Is(err, ErrMismatchedPassword) {
+			t.Errorf("VerifyPassword(%q) error = %v, want invalid hash", hash, err)
+		}
+	}
+}
@@ -0,0 +1,188 @@
+// Package userstore provides concurrency safe in-memory user database backing username/password
+// authentication of proxyme. Users are kept with password hashes only, the whole set can be
+// replaced atomically on reload of the users file. Use Store.Authenticate as Options.Authenticate:
+//
+//	users := userstore.New(nil)
+//	_ = users.Replace(loadUsers())
+//	opts := proxyme.Options{Authenticate: users.Authenticate}
+package userstore
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+
+	"github.com/dblokhin/proxyme"
+)
+
+var (
+	// ErrUserExists is returned by Add if the user is already in the store.
+	ErrUserExists = errors.New("user exists")
+
+	// ErrUserNotFound is returned by Remove if the user isn't in the store.
+	ErrUserNotFound = errors.New("user not found")
+)
+
+// Op is the kind of change of the store.
+type Op int
+
+const (
+	OpAdd     Op = iota + 1 // the user has been added
+	OpRemove                // the user has been removed
+	OpReplace               // the whole set of users has been replaced
+)
+
+// Change describes the change of the store passed to subscribers.
+type Change struct {
+	Op Op
+
+	// Username is the added or removed user, empty on replace.
+	Username string
+}
+
+// Store is concurrency safe in-memory user database, the zero value isn't usable, see New.
+type Store struct {
+	verify func(hash, password []byte) error
+
+	mu    sync.RWMutex
+	users map[string][]byte // username -> password hash
+
+	subMu  sync.Mutex
+	subs   map[int]func(Change)
+	nextID int
+}
+
+// New returns empty store verifying passwords with verify, e.g. bcrypt.CompareHashAndPassword
+// to keep bcrypt hashes. Nil verify means VerifyPassword of hashes produced by HashPassword.
+func New(verify func(hash, password []byte) error) *Store {
+	if verify == nil {
+		verify = VerifyPassword
+	}
+
+	return &Store{
+		verify: verify,
+		users:  make(map[string][]byte),
+		subs:   make(map[int]func(Change)),
+	}
+}
+
+// Add adds the user with the password hash, it returns ErrUserExists if the user is in the store.
+func (s *Store) Add(username string, hash []byte) error {
+	if username == "" || len(hash) == 0 {
+		return fmt.Errorf("empty username or password hash")
+	}
+
+	s.mu.Lock()
+	if _, ok := s.users[username]; ok {
+		s.mu.Unlock()
+		return fmt.Errorf("%w: %s", ErrUserExists, username)
+	}
+	s.users[username] = slices.Clone(hash)
+	s.mu.Unlock()
+
+	s.notify(Change{Op: OpAdd, Username: username})
+
+	return nil
+}
+
+// Remove removes the user, it returns ErrUserNotFound if there is no such user.
+func (s *Store) Remove(username string) error {
+	s.mu.Lock()
+	if _, ok := s.users[username]; !ok {
+		s.mu.Unlock()
+		return fmt.Errorf("%w: %s", ErrUserNotFound, username)
+	}
+	delete(s.users, username)
+	s.mu.Unlock()
+
+	s.notify(Change{Op: OpRemove, Username: username})
+
+	return nil
+}
+
+// Replace atomically replaces all users of the store with users (username -> password hash):
+// concurrent authentications see either the old set or the new one. The store is left intact
+// if users are invalid.
+func (s *Store) Replace(users map[string][]byte) error {
+	next := make(map[string][]byte, len(users))
+	for username, hash := range users {
+		if username == "" || len(hash) == 0 {
+			return fmt.Errorf("empty username or password hash")
+		}
+		next[username] = slices.Clone(hash)
+	}
+
+	s.mu.Lock()
+	s.users = next
+	s.mu.Unlock()
+
+	s.notify(Change{Op: OpReplace})
+
+	return nil
+}
+
+// Users returns sorted usernames of the store.
+func (s *Store) Users() []string {
+	s.mu.RLock()
+	res := make([]string, 0, len(s.users))
+	for username := range s.users {
+		res = append(res, username)
+	}
+	s.mu.RUnlock()
+
+	slices.Sort(res)
+
+	return res
+}
+
+// Authenticate verifies the credentials, it's Options.Authenticate callback. It returns
+// proxyme.ErrUnknownUser or proxyme.ErrBadPassword (both are proxyme.ErrInvalidCredentials). Unknown users are verified
+// against a dummy hash, so the timing doesn't reveal existing usernames (with HashPassword hashes).
+func (s *Store) Authenticate(username, password []byte) error {
+	s.mu.RLock()
+	hash, ok := s.users[string(username)]
+	s.mu.RUnlock()
+
+	if !ok {
+		_ = VerifyPassword(dummyHash(), password)
+		return proxyme.ErrUnknownUser
+	}
+
+	if err := s.verify(hash, password); err != nil {
+		return proxyme.ErrBadPassword
+	}
+
+	return nil
+}
+
+// Subscribe registers fn to be notified of changes of the store, the returned func unsubscribes.
+// Notifications are delivered synchronously after the change is applied, fn must not block.
+func (s *Store) Subscribe(fn func(Change)) (unsubscribe func()) {
+	s.subMu.Lock()
+	defer s.subMu.Unlock()
+
+	id := s.nextID
+	s.nextID++
+	s.subs[id] = fn
+
+	return func() {
+		s.subMu.Lock()
+		defer s.subMu.Unlock()
+
+		delete(s.subs, id)
+	}
+}
+
+func (s *Store) notify(change Change) {
+	s.subMu.Lock()
+	subs := make([]func(Change), 0, len(s.subs))
+	for _, fn := range s.subs {
+		subs = append(subs, fn)
+	}
+	s.subMu.Unlock()
+
+	for _, fn := range subs {
+		fn(change)
+	}
+}
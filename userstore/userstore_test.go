@@ -0,0 +1,150 @@
+package userstore
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"testing"
+
+	"github.com/dblokhin/proxyme"
+)
+
+// plain is verifier of plain text "hashes" to keep tests fast.
+func plain(hash, password []byte) error {
+	if string(hash) != string(password) {
+		return ErrMismatchedPassword
+	}
+	return nil
+}
+
+func TestStore(t *testing.T) {
+	tests := []struct {
+		name  string
+		check func(s *Store) error
+	}{
+		{
+			name: "add and authenticate",
+			check: func(s *Store) error {
+				if err := s.Add("alice", []byte("secret")); err != nil {
+					return err
+				}
+				if err := s.Authenticate([]byte("alice"), []byte("secret")); err != nil {
+					return fmt.Errorf("valid credentials: %w", err)
+				}
+				if err := s.Authenticate([]byte("alice"), []byte("wrong")); !errors.Is(err, proxyme.ErrInvalidCredentials) {
+					return fmt.Errorf("got %v, want invalid credentials on wrong password", err)
+				}
+				if err := s.Authenticate([]byte("bob"), []byte("secret")); !errors.Is(err, proxyme.ErrInvalidCredentials) {
+					return fmt.Errorf("got %v, want invalid credentials on unknown user", err)
+				}
+				return nil
+			},
+		},
+		{
+			name: "add existing user",
+			check: func(s *Store) error {
+				_ = s.Add("alice", []byte("secret"))
+				if err := s.Add("alice", []byte("other")); !errors.Is(err, ErrUserExists) {
+					return fmt.Errorf("got %v, want %v", err, ErrUserExists)
+				}
+				return s.Authenticate([]byte("alice"), []byte("secret"))
+			},
+		},
+		{
+			name: "remove",
+			check: func(s *Store) error {
+				_ = s.Add("alice", []byte("secret"))
+				if err := s.Remove("alice"); err != nil {
+					return err
+				}
+				if err := s.Remove("alice"); !errors.Is(err, ErrUserNotFound) {
+					return fmt.Errorf("got %v, want %v", err, ErrUserNotFound)
+				}
+				if err := s.Authenticate([]byte("alice"), []byte("secret")); err == nil {
+					return fmt.Errorf("removed user authenticated")
+				}
+				return nil
+			},
+		},
+		{
+			name: "replace",
+			check: func(s *Store) error {
+				_ = s.Add("alice", []byte("secret"))
+				if err := s.Replace(map[string][]byte{"bob": []byte("b"), "carol": []byte("c")}); err != nil {
+					return err
+				}
+				if got := s.Users(); !slices.Equal(got, []string{"bob", "carol"}) {
+					return fmt.Errorf("got users %v after replace", got)
+				}
+				return s.Authenticate([]byte("carol"), []byte("c"))
+			},
+		},
+		{
+			name: "invalid replace keeps the store",
+			check: func(s *Store) error {
+				_ = s.Add("alice", []byte("secret"))
+				if err := s.Replace(map[string][]byte{"bob": nil}); err == nil {
+					return fmt.Errorf("empty hash accepted")
+				}
+				if got := s.Users(); !slices.Equal(got, []string{"alice"}) {
+					return fmt.Errorf("got users %v after failed replace", got)
+				}
+				return nil
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.check(New(plain)); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestStore_Subscribe(t *testing.T) {
+	s := New(plain)
+
+	var changes []Change
+	unsubscribe := s.Subscribe(func(c Change) {
+		changes = append(changes, c)
+	})
+
+	_ = s.Add("alice", []byte("a"))
+	_ = s.Remove("alice")
+	_ = s.Replace(map[string][]byte{"bob": []byte("b")})
+	unsubscribe()
+	_ = s.Add("carol", []byte("c"))
+
+	want := []Change{{Op: OpAdd, Username: "alice"}, {Op: OpRemove, Username: "alice"}, {Op: OpReplace}}
+	if !slices.Equal(changes, want) {
+		t.Errorf("got changes %v, want %v", changes, want)
+	}
+}
+
+func TestStore_race(t *testing.T) {
+	s := New(plain)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				_ = s.Replace(map[string][]byte{"alice": []byte("a")})
+				_ = s.Add(fmt.Sprint("user", j), []byte("x"))
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				if err := s.Authenticate([]byte("alice"), []byte("a")); err != nil && !errors.Is(err, proxyme.ErrInvalidCredentials) {
+					t.Errorf("authenticate: %v", err)
+				}
+				_ = s.Users()
+			}
+		}()
+	}
+	wg.Wait()
+}
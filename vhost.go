@@ -0,0 +1,87 @@
+package proxyme
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// defaultTLSHandshakeTimeout limits TLS handshake of clients choosing virtual hosts.
+const defaultTLSHandshakeTimeout = 10 * time.Second
+
+// virtualHosts is the registry of SOCKS5 instances by normalized server name, wildcard names
+// *.name match subdomains.
+type virtualHosts map[string]*SOCKS5
+
+// parseVirtualHosts validates and normalizes names of Server.VirtualHosts.
+func parseVirtualHosts(hosts map[string]*SOCKS5) (virtualHosts, error) {
+	if len(hosts) == 0 {
+		return nil, nil
+	}
+
+	res := make(virtualHosts, len(hosts))
+	for name, socks5 := range hosts {
+		if socks5 == nil {
+			return nil, fmt.Errorf("virtual host %q: nil SOCKS5", name)
+		}
+
+		host := normalizeName(name)
+		if bare := strings.TrimPrefix(host, "*."); bare == "" || !validName(bare) {
+			return nil, fmt.Errorf("virtual host %q: invalid name", name)
+		}
+		if _, ok := res[host]; ok {
+			return nil, fmt.Errorf("virtual host %q: duplicate name", name)
+		}
+		res[host] = socks5
+	}
+
+	return res, nil
+}
+
+// lookup returns SOCKS5 of the server name: exact names take precedence over wildcards, the closest
+// wildcard wins. It's nil if the name isn't registered.
+func (v virtualHosts) lookup(serverName string) *SOCKS5 {
+	name := normalizeName(serverName)
+	if socks5, ok := v[name]; ok {
+		return socks5
+	}
+
+	for i := strings.IndexByte(name, '.'); i >= 0; i = strings.IndexByte(name, '.') {
+		name = name[i+1:]
+		if socks5, ok := v["*."+name]; ok {
+			return socks5
+		}
+	}
+
+	return nil
+}
+
+// route returns SOCKS5 serving the client connection: clients of TLS listeners are served by
+// the virtual host of the server name they have connected to (SNI), Server.SOCKS5 serves the others.
+func (s *Server) route(conn net.Conn, hosts virtualHosts) (*SOCKS5, error) {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok || len(hosts) == 0 {
+		return s.SOCKS5, nil
+	}
+
+	timeout := s.TLSHandshakeTimeout
+	if timeout <= 0 {
+		timeout = defaultTLSHandshakeTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		return nil, fmt.Errorf("tls handshake: %w", err)
+	}
+
+	serverName := tlsConn.ConnectionState().ServerName
+	if socks5 := hosts.lookup(serverName); socks5 != nil {
+		return socks5, nil
+	}
+
+	return s.SOCKS5, nil
+}
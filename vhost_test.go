@@ -0,0 +1,171 @@
+package proxyme
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/dblokhin/proxyme/testsupport"
+)
+
+func Test_parseVirtualHosts(t *testing.T) {
+	socks5 := &SOCKS5{}
+
+	tests := []struct {
+		name    string
+		hosts   map[string]*SOCKS5
+		want    []string
+		wantErr bool
+	}{
+		{name: "empty"},
+		{
+			name:  "normalized names",
+			hosts: map[string]*SOCKS5{"EU.Proxy.Example.com.": socks5, "*.us.example.com": socks5},
+			want:  []string{"eu.proxy.example.com", "*.us.example.com"},
+		},
+		{name: "nil socks5", hosts: map[string]*SOCKS5{"proxy.example.com": nil}, wantErr: true},
+		{name: "invalid name", hosts: map[string]*SOCKS5{"proxy example": socks5}, wantErr: true},
+		{name: "bare wildcard", hosts: map[string]*SOCKS5{"*.": socks5}, wantErr: true},
+		{name: "duplicate", hosts: map[string]*SOCKS5{"proxy.example.com": socks5, "PROXY.example.com": socks5}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseVirtualHosts(tt.hosts)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseVirtualHosts() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("parseVirtualHosts() = %v, want %v", got, tt.want)
+			}
+			for _, name := range tt.want {
+				if got[name] == nil {
+					t.Errorf("parseVirtualHosts() has no %q", name)
+				}
+			}
+		})
+	}
+}
+
+func Test_virtualHosts_lookup(t *testing.T) {
+	exact, wildcard, nested := &SOCKS5{}, &SOCKS5{}, &SOCKS5{}
+	hosts := virtualHosts{
+		"proxy.example.com":     exact,
+		"*.example.com":         wildcard,
+		"*.eu.example.com":      nested,
+		"api.eu.example.com":    exact,
+		"xn--bcher-kva.example": exact,
+	}
+
+	tests := []struct {
+		serverName string
+		want       *SOCKS5
+	}{
+		{serverName: "proxy.example.com", want: exact},
+		{serverName: "Proxy.Example.COM.", want: exact},
+		{serverName: "other.example.com", want: wildcard},
+		{serverName: "a.b.example.com", want: wildcard},
+		{serverName: "fr.eu.example.com", want: nested},
+		{serverName: "api.eu.example.com", want: exact},
+		{serverName: "bücher.example", want: exact},
+		{serverName: "example.com"},
+		{serverName: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.serverName, func(t *testing.T) {
+			if got := hosts.lookup(tt.serverName); got != tt.want {
+				t.Errorf("lookup(%q) = %p, want %p", tt.serverName, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestServer_Serve_virtualHosts(t *testing.T) {
+	newSOCKS5 := func(opts Options) *SOCKS5 {
+		socks5, err := New(opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return socks5
+	}
+	login := newSOCKS5(Options{Authenticate: func(username, password []byte) error { return nil }})
+	anonymous := newSOCKS5(Options{AllowNoAuth: true})
+
+	ls, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := selfSignedCert(t)
+	srv := &Server{
+		SOCKS5:       anonymous,
+		TLSConfig:    &tls.Config{Certificates: []tls.Certificate{cert}},
+		VirtualHosts: map[string]*SOCKS5{"login.proxy.test": login},
+	}
+	served := make(chan error, 1)
+	go func() { served <- srv.Serve(ls) }()
+
+	tests := []struct {
+		serverName string
+		want       byte
+	}{
+		{serverName: "login.proxy.test", want: byte(typeLogin)},
+		{serverName: "LOGIN.proxy.test", want: byte(typeLogin)},
+		{serverName: "other.proxy.test", want: byte(typeNoAuth)},
+		{serverName: "", want: byte(typeNoAuth)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.serverName, func(t *testing.T) {
+			conn, err := tls.Dial("tcp", ls.Addr().String(), &tls.Config{ServerName: tt.serverName, InsecureSkipVerify: true}) // nolint
+			if err != nil {
+				t.Fatalf("dial: %v", err)
+			}
+			defer conn.Close() // nolint
+			_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+			client := &testsupport.Client{Conn: conn}
+			if method, err := client.Greet(byte(typeNoAuth), byte(typeLogin)); err != nil || method != tt.want {
+				t.Errorf("got method %d, error %v, want %d", method, err, tt.want)
+			}
+		})
+	}
+
+	_ = srv.Close()
+	if err := <-served; !errors.Is(err, ErrServerClosed) {
+		t.Errorf("Serve() error = %v, want %v", err, ErrServerClosed)
+	}
+
+	srv = &Server{SOCKS5: anonymous, VirtualHosts: map[string]*SOCKS5{"proxy.test": nil}}
+	if err := srv.Serve(&fakeListener{}); err == nil {
+		t.Error("Serve() expected error of nil virtual host")
+	}
+}
+
+// selfSignedCert returns certificate for tests.
+func selfSignedCert(t *testing.T) tls.Certificate {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "proxy.test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{"*.proxy.test"},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
@@ -0,0 +1,46 @@
+//go:build linux
+
+package proxyme
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// watchFile calls changed on inotify events of the file directory until the context is done.
+// The directory is watched instead of the file: editors and config managers replace files by rename,
+// which would silently detach the watch of the file itself.
+func watchFile(ctx context.Context, path string, changed func()) error {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return fmt.Errorf("watch %s: inotify: %w", path, err)
+	}
+
+	// non-blocking descriptor goes to the runtime poller, so Close interrupts Read
+	f := os.NewFile(uintptr(fd), "inotify")
+	defer f.Close() // nolint
+
+	mask := uint32(syscall.IN_CLOSE_WRITE | syscall.IN_MOVED_TO | syscall.IN_CREATE | syscall.IN_DELETE)
+	if _, err := syscall.InotifyAddWatch(fd, filepath.Dir(path), mask); err != nil {
+		return fmt.Errorf("watch %s: %w", path, err)
+	}
+
+	stop := context.AfterFunc(ctx, func() { _ = f.Close() })
+	defer stop()
+
+	buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+	for {
+		// events aren't parsed: changes of the file are told apart by reloadChanged
+		if _, err := f.Read(buf); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return fmt.Errorf("watch %s: %w", path, err)
+		}
+
+		changed()
+	}
+}
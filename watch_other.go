@@ -0,0 +1,26 @@
+//go:build !linux
+
+package proxyme
+
+import (
+	"context"
+	"time"
+)
+
+// watchPeriod is the period of polling the watched file.
+const watchPeriod = 2 * time.Second
+
+// watchFile calls changed every watchPeriod until the context is done.
+func watchFile(ctx context.Context, path string, changed func()) error {
+	ticker := time.NewTicker(watchPeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+			changed()
+		}
+	}
+}
@@ -0,0 +1,353 @@
+package proxyme
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultWebhookBatchSize     = 100
+	defaultWebhookFlushInterval = time.Second
+	defaultWebhookQueueSize     = 10000
+	defaultWebhookRetries       = 3
+	defaultWebhookRetryDelay    = time.Second
+	defaultWebhookTimeout       = 10 * time.Second
+)
+
+// WebhookSink is SessionEventSink posting session events to the HTTP endpoint as JSON arrays,
+// e.g.
+//
+//	[{"type":"session.start","time":"2024-05-01T10:00:00Z","id":"3f2a9c1b7d4e8a60",
+//	  "session":{"client":"10.0.0.7:51234","method":2,"username":"alice","command":1,
+//	  "destination":"example.com:443","upstream":"93.184.216.34:443","timings":{"auth":0.002,"dial":0.031}}},
+//	 {"type":"session.end","time":"2024-05-01T10:05:00Z","id":"3f2a9c1b7d4e8a60","session":{...},
+//	  "duration":300.2,"bytes_up":5120,"bytes_down":1048576,"error":"session expired: ..."}]
+//
+// Durations and timings are in seconds, metadata values of the session are included if they
+// marshal to JSON. Events are queued and posted in batches by a background goroutine started with
+// the first event, so sessions don't wait for the endpoint. Failed posts are retried with
+// exponential backoff on network errors, 429 and 5xx responses. Events beyond the queue are dropped.
+//
+// Set the fields before the first event, they must not be changed afterward. Close flushes the queue.
+type WebhookSink struct {
+	// URL is the endpoint events are posted to.
+	URL string
+
+	// Header is added to the requests, e.g. Authorization.
+	// OPTIONAL.
+	Header http.Header
+
+	// Client posts the events.
+	// OPTIONAL, default client of 10 seconds timeout.
+	Client *http.Client
+
+	// BatchSize is the max number of events per post.
+	// OPTIONAL, default 100.
+	BatchSize int
+
+	// FlushInterval is the max time events wait for the batch to fill up.
+	// OPTIONAL, default 1 second.
+	FlushInterval time.Duration
+
+	// QueueSize is the max number of events waiting to be posted.
+	// OPTIONAL, default 10000.
+	QueueSize int
+
+	// MaxRetries is the number of retries of failed posts, negative disables retries.
+	// OPTIONAL, default 3.
+	MaxRetries int
+
+	// RetryDelay is the delay of the first retry, it doubles for the next ones.
+	// OPTIONAL, default 1 second.
+	RetryDelay time.Duration
+
+	// OnError if specified, receives failed posts, events of the batch are dropped.
+	// OPTIONAL.
+	OnError func(error)
+
+	once   sync.Once
+	client *http.Client
+	ctx    context.Context // canceled when Close gives up flushing
+	cancel context.CancelFunc
+	done   chan struct{} // closed once the queue is flushed
+
+	mu     sync.Mutex
+	queue  chan json.RawMessage
+	closed bool
+
+	dropped atomic.Int64
+	failed  atomic.Int64
+}
+
+// webhookEvent is JSON of SessionEvent.
+type webhookEvent struct {
+	Type      SessionEventType `json:"type"`
+	Time      time.Time        `json:"time"`
+	ID        string           `json:"id"`
+	Session   webhookSession   `json:"session"`
+	Duration  float64          `json:"duration,omitempty"`
+	BytesUp   int64            `json:"bytes_up,omitempty"`
+	BytesDown int64            `json:"bytes_down,omitempty"`
+	Error     string           `json:"error,omitempty"`
+}
+
+// webhookSession is JSON of SessionInfo.
+type webhookSession struct {
+	Client      string                     `json:"client,omitempty"`
+	Method      int                        `json:"method"`
+	Username    string                     `json:"username,omitempty"`
+	Command     int                        `json:"command"`
+	Destination string                     `json:"destination"`
+	ResolvedIPs []string                   `json:"resolved_ips,omitempty"`
+	Upstream    string                     `json:"upstream,omitempty"`
+	Transparent bool                       `json:"transparent,omitempty"`
+	Timings     webhookTimings             `json:"timings"`
+	Metadata    map[string]json.RawMessage `json:"metadata,omitempty"`
+}
+
+// webhookTimings is JSON of Timings.
+type webhookTimings struct {
+	Auth      float64 `json:"auth,omitempty"`
+	Dial      float64 `json:"dial,omitempty"`
+	FirstByte float64 `json:"first_byte,omitempty"`
+}
+
+// newWebhookEvent returns JSON view of the event.
+func newWebhookEvent(e SessionEvent) webhookEvent {
+	info := e.Info
+	res := webhookEvent{
+		Type:      e.Type,
+		Time:      e.Time,
+		ID:        e.ID,
+		Duration:  e.Duration.Seconds(),
+		BytesUp:   e.BytesUp,
+		BytesDown: e.BytesDown,
+		Session: webhookSession{
+			Method:      info.Method,
+			Username:    info.Username,
+			Command:     info.Command,
+			Destination: info.Destination(),
+			Transparent: info.Transparent,
+			Timings: webhookTimings{
+				Auth:      info.Timings.Auth.Seconds(),
+				Dial:      info.Timings.Dial.Seconds(),
+				FirstByte: info.Timings.FirstByte.Seconds(),
+			},
+		},
+	}
+	if e.Err != nil {
+		res.Error = e.Err.Error()
+	}
+	if info.ClientAddr != nil {
+		res.Session.Client = info.ClientAddr.String()
+	}
+	if info.Upstream != nil {
+		res.Session.Upstream = info.Upstream.String()
+	}
+	for _, ip := range info.ResolvedIPs {
+		res.Session.ResolvedIPs = append(res.Session.ResolvedIPs, ip.String())
+	}
+	info.Metadata.Range(func(key string, value any) bool {
+		if b, err := json.Marshal(value); err == nil {
+			if res.Session.Metadata == nil {
+				res.Session.Metadata = make(map[string]json.RawMessage)
+			}
+			res.Session.Metadata[key] = b
+		}
+		return true
+	})
+
+	return res
+}
+
+// SessionEvent queues the event to be posted, it's dropped if the queue is full or the sink is closed.
+func (w *WebhookSink) SessionEvent(e SessionEvent) {
+	w.once.Do(w.start)
+
+	// the session info refers to the live session, so it's marshaled right away
+	b, err := json.Marshal(newWebhookEvent(e))
+	if err != nil {
+		w.dropped.Add(1)
+		return
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed {
+		w.dropped.Add(1)
+		return
+	}
+
+	select {
+	case w.queue <- b:
+	default:
+		w.dropped.Add(1)
+	}
+}
+
+// Close posts queued events and stops the sink. If the context is done first, pending posts are
+// aborted and the context error is returned.
+func (w *WebhookSink) Close(ctx context.Context) error {
+	w.once.Do(w.start)
+
+	w.mu.Lock()
+	if !w.closed {
+		w.closed = true
+		close(w.queue)
+	}
+	w.mu.Unlock()
+
+	select {
+	case <-w.done:
+		return nil
+	case <-ctx.Done():
+		w.cancel()
+		<-w.done
+		return ctx.Err()
+	}
+}
+
+// Dropped returns the number of events dropped for the full queue or the closed sink.
+func (w *WebhookSink) Dropped() int64 {
+	return w.dropped.Load()
+}
+
+// Failed returns the number of events dropped for failed posts.
+func (w *WebhookSink) Failed() int64 {
+	return w.failed.Load()
+}
+
+// start starts posting of the queue.
+func (w *WebhookSink) start() {
+	size := w.QueueSize
+	if size <= 0 {
+		size = defaultWebhookQueueSize
+	}
+
+	w.client = w.Client
+	if w.client == nil {
+		w.client = &http.Client{Timeout: defaultWebhookTimeout}
+	}
+	w.ctx, w.cancel = context.WithCancel(context.Background())
+	w.queue = make(chan json.RawMessage, size)
+	w.done = make(chan struct{})
+
+	go w.run()
+}
+
+// run posts the queued events in batches until the queue is closed.
+func (w *WebhookSink) run() {
+	defer close(w.done)
+	defer w.cancel()
+
+	size := w.BatchSize
+	if size <= 0 {
+		size = defaultWebhookBatchSize
+	}
+	interval := w.FlushInterval
+	if interval <= 0 {
+		interval = defaultWebhookFlushInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	batch := make([]json.RawMessage, 0, size)
+	for {
+		select {
+		case e, ok := <-w.queue:
+			if !ok {
+				w.flush(batch)
+				return
+			}
+			if batch = append(batch, e); len(batch) < size {
+				continue
+			}
+		case <-ticker.C:
+		}
+
+		w.flush(batch)
+		batch = batch[:0]
+	}
+}
+
+// flush posts the batch retrying failures, events of the failed batch are dropped.
+func (w *WebhookSink) flush(batch []json.RawMessage) {
+	if len(batch) == 0 {
+		return
+	}
+
+	body, err := json.Marshal(batch)
+	if err == nil {
+		err = w.post(body)
+	}
+	if err == nil {
+		return
+	}
+
+	w.failed.Add(int64(len(batch)))
+	if w.OnError != nil {
+		w.OnError(fmt.Errorf("webhook: %d events dropped: %w", len(batch), err))
+	}
+}
+
+// post posts the body retrying failures.
+func (w *WebhookSink) post(body []byte) error {
+	retries := w.MaxRetries
+	if retries == 0 {
+		retries = defaultWebhookRetries
+	}
+	delay := w.RetryDelay
+	if delay <= 0 {
+		delay = defaultWebhookRetryDelay
+	}
+
+	for attempt := 0; ; attempt++ {
+		retry, err := w.send(body)
+		if err == nil || !retry || attempt >= retries {
+			return err
+		}
+
+		select {
+		case <-time.After(delay << attempt):
+		case <-w.ctx.Done():
+			return err
+		}
+	}
+}
+
+// send posts the body once and reports whether the failure is worth retrying.
+func (w *WebhookSink) send(body []byte) (retry bool, err error) {
+	req, err := http.NewRequestWithContext(w.ctx, http.MethodPost, w.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	for key, values := range w.Header {
+		req.Header[key] = values
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return w.ctx.Err() == nil, err
+	}
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 4<<10))
+	_ = resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return true, fmt.Errorf("%s: %s", w.URL, resp.Status)
+	default:
+		return false, fmt.Errorf("%s: %s", w.URL, resp.Status)
+	}
+}
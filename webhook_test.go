@@ -0,0 +1,144 @@
+package proxyme
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWebhookSink(t *testing.T) {
+	tests := []struct {
+		name        string
+		statuses    []int // response statuses of the posts in order, 200 afterward
+		events      int
+		batchSize   int
+		wantPosts   int
+		wantEvents  int // events received by the endpoint
+		wantFailed  int64
+		wantOnError bool
+	}{
+		{name: "batched", events: 5, batchSize: 2, wantPosts: 3, wantEvents: 5},
+		{name: "retried", statuses: []int{http.StatusServiceUnavailable, http.StatusTooManyRequests}, events: 1, wantPosts: 3, wantEvents: 1},
+		{name: "retries exhausted", statuses: []int{http.StatusInternalServerError, http.StatusInternalServerError, http.StatusInternalServerError}, events: 1, wantPosts: 3, wantFailed: 1, wantOnError: true},
+		{name: "not retried", statuses: []int{http.StatusBadRequest}, events: 2, wantPosts: 1, wantFailed: 2, wantOnError: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var (
+				mu     sync.Mutex
+				posts  int
+				events []map[string]any
+			)
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				var batch []map[string]any
+				if err := json.NewDecoder(r.Body).Decode(&batch); err != nil || r.Header.Get("Authorization") != "Bearer token" {
+					t.Errorf("bad request: %v, headers %v", err, r.Header)
+				}
+
+				mu.Lock()
+				defer mu.Unlock()
+
+				status := http.StatusOK
+				if posts < len(tt.statuses) {
+					status = tt.statuses[posts]
+				}
+				posts++
+				if status == http.StatusOK {
+					events = append(events, batch...)
+				}
+				w.WriteHeader(status)
+			}))
+			defer srv.Close()
+
+			var onError error
+			w := &WebhookSink{
+				URL:           srv.URL,
+				Header:        http.Header{"Authorization": {"Bearer token"}},
+				BatchSize:     tt.batchSize,
+				FlushInterval: time.Hour, // batches are flushed when full or closed
+				MaxRetries:    2,
+				RetryDelay:    time.Millisecond,
+				OnError:       func(err error) { onError = err },
+			}
+
+			var metadata Metadata
+			metadata.Set("tenant", "acme")
+			metadata.Set("unsupported", func() {})
+			for i := range tt.events {
+				w.SessionEvent(SessionEvent{
+					Type: SessionEnd,
+					ID:   "id",
+					Info: SessionInfo{
+						ClientAddr:  &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1000},
+						Command:     int(connect),
+						AddressType: int(domainName),
+						Addr:        []byte("example.com"),
+						Port:        443,
+						Metadata:    &metadata,
+					},
+					BytesUp: int64(i),
+					Err:     errors.New("closed"),
+				})
+			}
+			if err := w.Close(context.Background()); err != nil {
+				t.Fatalf("Close() error = %v", err)
+			}
+
+			if posts != tt.wantPosts || len(events) != tt.wantEvents {
+				t.Fatalf("got %d posts of %d events, want %d posts of %d events", posts, len(events), tt.wantPosts, tt.wantEvents)
+			}
+			if w.Failed() != tt.wantFailed || (onError != nil) != tt.wantOnError {
+				t.Errorf("got %d failed events, error %v", w.Failed(), onError)
+			}
+			if len(events) == 0 {
+				return
+			}
+
+			e := events[0]
+			session, _ := e["session"].(map[string]any)
+			values, _ := session["metadata"].(map[string]any)
+			if e["type"] != string(SessionEnd) || e["error"] != "closed" || session["destination"] != "example.com:443" ||
+				session["client"] != "10.0.0.1:1000" || values["tenant"] != "acme" || len(values) != 1 {
+				t.Errorf("got event %v", e)
+			}
+		})
+	}
+}
+
+func TestWebhookSink_Close(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	w := &WebhookSink{URL: srv.URL, QueueSize: 1, FlushInterval: time.Millisecond}
+	w.SessionEvent(SessionEvent{Type: SessionStart})
+
+	// the post hangs: Close gives up at the deadline
+	time.Sleep(50 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := w.Close(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Close() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if w.Failed() != 1 {
+		t.Errorf("got %d failed events, want 1", w.Failed())
+	}
+
+	// events of the closed sink are dropped
+	w.SessionEvent(SessionEvent{Type: SessionStart})
+	if w.Dropped() != 1 {
+		t.Errorf("got %d dropped events, want 1", w.Dropped())
+	}
+}
@@ -0,0 +1,494 @@
+package wire
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+)
+
+// AuthRequest is the client greeting offering authentication methods.
+type AuthRequest struct {
+	Methods []Method
+}
+
+func (a *AuthRequest) ReadFrom(r io.Reader) (n int64, err error) {
+	var head [2]byte
+	nn, err := io.ReadFull(r, head[:])
+	n += int64(nn)
+	if err != nil {
+		return n, err
+	}
+
+	if head[0] != Version {
+		return n, fmt.Errorf("%w: %d", ErrInvalidVersion, head[0])
+	}
+	if head[1] == 0 {
+		return n, fmt.Errorf("%w: no methods", ErrInvalidLength)
+	}
+
+	methods := make([]byte, head[1])
+	nn, err = io.ReadFull(r, methods)
+	n += int64(nn)
+	if err != nil {
+		return n, err
+	}
+
+	a.Methods = make([]Method, len(methods))
+	for i, m := range methods {
+		a.Methods[i] = Method(m)
+	}
+
+	return n, nil
+}
+
+func (a AuthRequest) WriteTo(w io.Writer) (n int64, err error) {
+	if len(a.Methods) == 0 || len(a.Methods) > MaxMethods {
+		return 0, fmt.Errorf("%w: %d methods", ErrInvalidLength, len(a.Methods))
+	}
+
+	buf := make([]byte, 0, 2+len(a.Methods))
+	buf = append(buf, Version, uint8(len(a.Methods)))
+	for _, m := range a.Methods {
+		buf = append(buf, uint8(m))
+	}
+
+	return write(w, buf)
+}
+
+// AuthReply is the server choice of authentication method.
+type AuthReply struct {
+	Method Method
+}
+
+func (a *AuthReply) ReadFrom(r io.Reader) (n int64, err error) {
+	var buf [2]byte
+	nn, err := io.ReadFull(r, buf[:])
+	n += int64(nn)
+	if err != nil {
+		return n, err
+	}
+
+	if buf[0] != Version {
+		return n, fmt.Errorf("%w: %d", ErrInvalidVersion, buf[0])
+	}
+	a.Method = Method(buf[1])
+
+	return n, nil
+}
+
+func (a AuthReply) WriteTo(w io.Writer) (n int64, err error) {
+	return write(w, []byte{Version, uint8(a.Method)})
+}
+
+// Address is destination or bound address of commands (ATYP, ADDR and PORT fields).
+type Address struct {
+	Type AddressType
+	Addr []byte // 4 or 16 bytes of ip address or domain name
+	Port uint16
+}
+
+// AddressFrom converts tcp or udp address to Address.
+func AddressFrom(addr net.Addr) (Address, error) {
+	var (
+		ip   net.IP
+		port int
+	)
+
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip, port = a.IP, a.Port
+	case *net.UDPAddr:
+		ip, port = a.IP, a.Port
+	default:
+		return Address{}, fmt.Errorf("%w: %v", ErrInvalidAddress, addr)
+	}
+
+	if ip4 := ip.To4(); ip4 != nil {
+		return Address{Type: AddressIPv4, Addr: ip4, Port: uint16(port)}, nil // nolint
+	}
+	if ip6 := ip.To16(); ip6 != nil {
+		return Address{Type: AddressIPv6, Addr: ip6, Port: uint16(port)}, nil // nolint
+	}
+
+	return Address{}, fmt.Errorf("%w: %v", ErrInvalidAddress, addr)
+}
+
+// String returns host:port representation of the address.
+func (a Address) String() string {
+	host := string(a.Addr)
+	if a.Type == AddressIPv4 || a.Type == AddressIPv6 {
+		host = net.IP(a.Addr).String()
+	}
+
+	return net.JoinHostPort(host, strconv.Itoa(int(a.Port)))
+}
+
+func (a Address) validate() error {
+	switch a.Type {
+	case AddressIPv4:
+		if len(a.Addr) != net.IPv4len {
+			return fmt.Errorf("%w: %d bytes of ipv4", ErrInvalidAddress, len(a.Addr))
+		}
+	case AddressIPv6:
+		if len(a.Addr) != net.IPv6len {
+			return fmt.Errorf("%w: %d bytes of ipv6", ErrInvalidAddress, len(a.Addr))
+		}
+	case AddressDomainName:
+		if len(a.Addr) == 0 || len(a.Addr) > MaxDomainSize {
+			return fmt.Errorf("%w: %d bytes of domain name", ErrInvalidAddress, len(a.Addr))
+		}
+	default:
+		return fmt.Errorf("%w: %d", ErrInvalidAddressType, a.Type)
+	}
+
+	return nil
+}
+
+// appendTo appends wire representation of the address.
+func (a Address) appendTo(buf []byte) []byte {
+	buf = append(buf, uint8(a.Type))
+	if a.Type == AddressDomainName {
+		buf = append(buf, uint8(len(a.Addr)))
+	}
+	buf = append(buf, a.Addr...)
+
+	return binary.BigEndian.AppendUint16(buf, a.Port)
+}
+
+// readAddress reads address with the given type.
+func readAddress(r io.Reader, typ AddressType) (Address, int64, error) {
+	var (
+		n    int64
+		size int
+	)
+
+	switch typ {
+	case AddressIPv4:
+		size = net.IPv4len
+	case AddressIPv6:
+		size = net.IPv6len
+	case AddressDomainName:
+		var b [1]byte
+		nn, err := io.ReadFull(r, b[:])
+		n += int64(nn)
+		if err != nil {
+			return Address{}, n, err
+		}
+		if b[0] == 0 {
+			return Address{}, n, fmt.Errorf("%w: empty domain name", ErrInvalidAddress)
+		}
+		size = int(b[0])
+	default:
+		return Address{}, n, fmt.Errorf("%w: %d", ErrInvalidAddressType, typ)
+	}
+
+	buf := make([]byte, size+2)
+	nn, err := io.ReadFull(r, buf)
+	n += int64(nn)
+	if err != nil {
+		return Address{}, n, err
+	}
+
+	return Address{
+		Type: typ,
+		Addr: buf[:size:size],
+		Port: binary.BigEndian.Uint16(buf[size:]),
+	}, n, nil
+}
+
+// CommandRequest is the client request (CMD, DST.ADDR and DST.PORT).
+type CommandRequest struct {
+	Command Command
+	Address
+}
+
+func (c *CommandRequest) ReadFrom(r io.Reader) (n int64, err error) {
+	var head [4]byte
+	nn, err := io.ReadFull(r, head[:])
+	n += int64(nn)
+	if err != nil {
+		return n, err
+	}
+
+	if head[0] != Version {
+		return n, fmt.Errorf("%w: %d", ErrInvalidVersion, head[0])
+	}
+	if head[2] != 0 {
+		return n, fmt.Errorf("%w: %d", ErrInvalidReserved, head[2])
+	}
+
+	addr, nr, err := readAddress(r, AddressType(head[3]))
+	n += nr
+	if err != nil {
+		return n, err
+	}
+
+	c.Command = Command(head[1])
+	c.Address = addr
+
+	return n, nil
+}
+
+func (c CommandRequest) WriteTo(w io.Writer) (n int64, err error) {
+	if err := c.Address.validate(); err != nil {
+		return 0, err
+	}
+
+	buf := make([]byte, 0, 6+1+len(c.Addr))
+	buf = append(buf, Version, uint8(c.Command), 0)
+	buf = c.Address.appendTo(buf)
+
+	return write(w, buf)
+}
+
+// CommandReply is the server reply (REP, BND.ADDR and BND.PORT).
+type CommandReply struct {
+	Status Status
+	Address
+}
+
+func (c *CommandReply) ReadFrom(r io.Reader) (n int64, err error) {
+	var head [4]byte
+	nn, err := io.ReadFull(r, head[:])
+	n += int64(nn)
+	if err != nil {
+		return n, err
+	}
+
+	if head[0] != Version {
+		return n, fmt.Errorf("%w: %d", ErrInvalidVersion, head[0])
+	}
+	if head[2] != 0 {
+		return n, fmt.Errorf("%w: %d", ErrInvalidReserved, head[2])
+	}
+
+	addr, nr, err := readAddress(r, AddressType(head[3]))
+	n += nr
+	if err != nil {
+		return n, err
+	}
+
+	c.Status = Status(head[1])
+	c.Address = addr
+
+	return n, nil
+}
+
+func (c CommandReply) WriteTo(w io.Writer) (n int64, err error) {
+	if err := c.Address.validate(); err != nil {
+		return 0, err
+	}
+
+	buf := make([]byte, 0, 6+1+len(c.Addr))
+	buf = append(buf, Version, uint8(c.Status), 0)
+	buf = c.Address.appendTo(buf)
+
+	return write(w, buf)
+}
+
+// Datagram is UDP request header and data of datagrams relayed by UDP ASSOCIATE (RFC 1928 section 7):
+// the client sends datagrams with destination address, the server relays replies with source address.
+type Datagram struct {
+	Frag uint8 // fragment number, 0 means standalone datagram
+	Address
+	Data []byte
+}
+
+// ParseDatagram parses the datagram, Address and Data of the result refer to b.
+func ParseDatagram(b []byte) (Datagram, error) {
+	if len(b) < 4 {
+		return Datagram{}, fmt.Errorf("%w: %d bytes of datagram", ErrInvalidLength, len(b))
+	}
+	if b[0] != 0 || b[1] != 0 {
+		return Datagram{}, fmt.Errorf("%w: %d", ErrInvalidReserved, binary.BigEndian.Uint16(b))
+	}
+
+	frag, typ, b := b[2], AddressType(b[3]), b[4:]
+
+	var size int
+	switch typ {
+	case AddressIPv4:
+		size = net.IPv4len
+	case AddressIPv6:
+		size = net.IPv6len
+	case AddressDomainName:
+		if len(b) > 0 && b[0] == 0 {
+			return Datagram{}, fmt.Errorf("%w: empty domain name", ErrInvalidAddress)
+		}
+		if len(b) > 0 {
+			size, b = int(b[0]), b[1:]
+		}
+	default:
+		return Datagram{}, fmt.Errorf("%w: %d", ErrInvalidAddressType, typ)
+	}
+	if size == 0 || len(b) < size+2 {
+		return Datagram{}, fmt.Errorf("%w: truncated datagram header", ErrInvalidLength)
+	}
+
+	return Datagram{
+		Frag: frag,
+		Address: Address{
+			Type: typ,
+			Addr: b[:size:size],
+			Port: binary.BigEndian.Uint16(b[size:]),
+		},
+		Data: b[size+2:],
+	}, nil
+}
+
+// AppendTo appends wire representation of the datagram to b.
+func (d Datagram) AppendTo(b []byte) ([]byte, error) {
+	if err := d.Address.validate(); err != nil {
+		return b, err
+	}
+
+	b = append(b, 0, 0, d.Frag)
+	b = d.Address.appendTo(b)
+
+	return append(b, d.Data...), nil
+}
+
+// LoginRequest is username/password authentication request (RFC 1929).
+type LoginRequest struct {
+	Username []byte
+	Password []byte
+}
+
+func (l *LoginRequest) ReadFrom(r io.Reader) (n int64, err error) {
+	var b [1]byte
+	nn, err := io.ReadFull(r, b[:])
+	n += int64(nn)
+	if err != nil {
+		return n, err
+	}
+
+	if b[0] != SubnegotiationVersion {
+		return n, fmt.Errorf("%w: %d", ErrInvalidVersion, b[0])
+	}
+
+	var nr int64
+	if l.Username, nr, err = readField(r); err != nil {
+		return n + nr, err
+	}
+	n += nr
+
+	l.Password, nr, err = readField(r)
+
+	return n + nr, err
+}
+
+func (l LoginRequest) WriteTo(w io.Writer) (n int64, err error) {
+	if len(l.Username) > MaxCredentialLen || len(l.Password) > MaxCredentialLen {
+		return 0, fmt.Errorf("%w: credentials longer %d bytes", ErrInvalidLength, MaxCredentialLen)
+	}
+
+	buf := make([]byte, 0, 3+len(l.Username)+len(l.Password))
+	buf = append(buf, SubnegotiationVersion, uint8(len(l.Username)))
+	buf = append(buf, l.Username...)
+	buf = append(buf, uint8(len(l.Password)))
+	buf = append(buf, l.Password...)
+
+	return write(w, buf)
+}
+
+// LoginReply is username/password authentication result, see LoginSucceeded.
+type LoginReply struct {
+	Status uint8
+}
+
+func (l *LoginReply) ReadFrom(r io.Reader) (n int64, err error) {
+	var buf [2]byte
+	nn, err := io.ReadFull(r, buf[:])
+	n += int64(nn)
+	if err != nil {
+		return n, err
+	}
+
+	if buf[0] != SubnegotiationVersion {
+		return n, fmt.Errorf("%w: %d", ErrInvalidVersion, buf[0])
+	}
+	l.Status = buf[1]
+
+	return n, nil
+}
+
+func (l LoginReply) WriteTo(w io.Writer) (n int64, err error) {
+	return write(w, []byte{SubnegotiationVersion, l.Status})
+}
+
+// GSSAPIMessage is GSSAPI subnegotiation message (RFC 1961).
+// Abort message (GSSAbort type) has no token.
+type GSSAPIMessage struct {
+	Type  uint8
+	Token []byte
+}
+
+func (m *GSSAPIMessage) ReadFrom(r io.Reader) (n int64, err error) {
+	var head [2]byte
+	nn, err := io.ReadFull(r, head[:])
+	n += int64(nn)
+	if err != nil {
+		return n, err
+	}
+
+	if head[0] != SubnegotiationVersion {
+		return n, fmt.Errorf("%w: %d", ErrInvalidVersion, head[0])
+	}
+
+	m.Type = head[1]
+	m.Token = nil
+	if m.Type == GSSAbort {
+		return n, nil
+	}
+
+	var size [2]byte
+	nn, err = io.ReadFull(r, size[:])
+	n += int64(nn)
+	if err != nil {
+		return n, err
+	}
+
+	m.Token = make([]byte, binary.BigEndian.Uint16(size[:]))
+	nn, err = io.ReadFull(r, m.Token)
+
+	return n + int64(nn), err
+}
+
+func (m GSSAPIMessage) WriteTo(w io.Writer) (n int64, err error) {
+	if m.Type == GSSAbort {
+		return write(w, []byte{SubnegotiationVersion, GSSAbort})
+	}
+
+	if len(m.Token) > MaxTokenSize {
+		return 0, fmt.Errorf("%w: %d bytes of token", ErrInvalidLength, len(m.Token))
+	}
+
+	buf := make([]byte, 0, 4+len(m.Token))
+	buf = append(buf, SubnegotiationVersion, m.Type)
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(m.Token))) // nolint
+	buf = append(buf, m.Token...)
+
+	return write(w, buf)
+}
+
+// readField reads one byte length prefixed field.
+func readField(r io.Reader) ([]byte, int64, error) {
+	var size [1]byte
+	nn, err := io.ReadFull(r, size[:])
+	if err != nil {
+		return nil, int64(nn), err
+	}
+
+	field := make([]byte, size[0])
+	nn, err = io.ReadFull(r, field)
+
+	return field, int64(nn) + 1, err
+}
+
+// write writes the whole message at once.
+func write(w io.Writer, buf []byte) (int64, error) {
+	n, err := w.Write(buf)
+	return int64(n), err
+}
@@ -0,0 +1,323 @@
+package wire
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"reflect"
+	"testing"
+)
+
+type message interface {
+	io.ReaderFrom
+	io.WriterTo
+}
+
+func TestMessages_roundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  message
+		want []byte
+	}{
+		{
+			name: "auth request",
+			msg:  &AuthRequest{Methods: []Method{MethodNoAuth, MethodLogin}},
+			want: []byte{5, 2, 0, 2},
+		},
+		{
+			name: "auth reply",
+			msg:  &AuthReply{Method: MethodNoAcceptable},
+			want: []byte{5, 0xff},
+		},
+		{
+			name: "command request ipv4",
+			msg: &CommandRequest{
+				Command: CommandConnect,
+				Address: Address{Type: AddressIPv4, Addr: []byte{127, 0, 0, 1}, Port: 80},
+			},
+			want: []byte{5, 1, 0, 1, 127, 0, 0, 1, 0, 80},
+		},
+		{
+			name: "command request domain",
+			msg: &CommandRequest{
+				Command: CommandBind,
+				Address: Address{Type: AddressDomainName, Addr: []byte("a.io"), Port: 443},
+			},
+			want: []byte{5, 2, 0, 3, 4, 'a', '.', 'i', 'o', 1, 187},
+		},
+		{
+			name: "command reply ipv6",
+			msg: &CommandReply{
+				Status:  StatusHostUnreachable,
+				Address: Address{Type: AddressIPv6, Addr: net.IPv6loopback, Port: 1},
+			},
+			want: []byte{5, 4, 0, 4, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0, 1},
+		},
+		{
+			name: "login request",
+			msg:  &LoginRequest{Username: []byte("u"), Password: []byte("pw")},
+			want: []byte{1, 1, 'u', 2, 'p', 'w'},
+		},
+		{
+			name: "login reply",
+			msg:  &LoginReply{Status: LoginFailure},
+			want: []byte{1, 0xff},
+		},
+		{
+			name: "gssapi message",
+			msg:  &GSSAPIMessage{Type: GSSAuthentication, Token: []byte{1, 2, 3}},
+			want: []byte{1, 1, 0, 3, 1, 2, 3},
+		},
+		{
+			name: "gssapi abort",
+			msg:  &GSSAPIMessage{Type: GSSAbort},
+			want: []byte{1, 0xff},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			n, err := tt.msg.WriteTo(&buf)
+			if err != nil {
+				t.Fatalf("WriteTo() error = %v", err)
+			}
+			if !bytes.Equal(buf.Bytes(), tt.want) || n != int64(len(tt.want)) {
+				t.Fatalf("WriteTo() = %v (%d), want %v", buf.Bytes(), n, tt.want)
+			}
+
+			got := reflect.New(reflect.TypeOf(tt.msg).Elem()).Interface().(message)
+			n, err = got.ReadFrom(bytes.NewReader(tt.want))
+			if err != nil {
+				t.Fatalf("ReadFrom() error = %v", err)
+			}
+			if n != int64(len(tt.want)) {
+				t.Fatalf("ReadFrom() read %d bytes, want %d", n, len(tt.want))
+			}
+			if !reflect.DeepEqual(got, tt.msg) {
+				t.Fatalf("ReadFrom() = %+v, want %+v", got, tt.msg)
+			}
+		})
+	}
+}
+
+func TestMessages_readInvalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		msg     message
+		data    []byte
+		wantErr error
+	}{
+		{
+			name:    "auth request version",
+			msg:     &AuthRequest{},
+			data:    []byte{4, 1, 0},
+			wantErr: ErrInvalidVersion,
+		},
+		{
+			name:    "auth request no methods",
+			msg:     &AuthRequest{},
+			data:    []byte{5, 0},
+			wantErr: ErrInvalidLength,
+		},
+		{
+			name:    "command request reserved",
+			msg:     &CommandRequest{},
+			data:    []byte{5, 1, 1, 1, 127, 0, 0, 1, 0, 80},
+			wantErr: ErrInvalidReserved,
+		},
+		{
+			name:    "command request address type",
+			msg:     &CommandRequest{},
+			data:    []byte{5, 1, 0, 2, 127, 0, 0, 1, 0, 80},
+			wantErr: ErrInvalidAddressType,
+		},
+		{
+			name:    "command request empty domain",
+			msg:     &CommandRequest{},
+			data:    []byte{5, 1, 0, 3, 0, 0, 80},
+			wantErr: ErrInvalidAddress,
+		},
+		{
+			name:    "command reply truncated",
+			msg:     &CommandReply{},
+			data:    []byte{5, 0, 0, 1, 127, 0},
+			wantErr: io.ErrUnexpectedEOF,
+		},
+		{
+			name:    "login request version",
+			msg:     &LoginRequest{},
+			data:    []byte{5, 1, 'u', 1, 'p'},
+			wantErr: ErrInvalidVersion,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := tt.msg.ReadFrom(bytes.NewReader(tt.data)); !errors.Is(err, tt.wantErr) {
+				t.Fatalf("ReadFrom() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestMessages_writeInvalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		msg     io.WriterTo
+		wantErr error
+	}{
+		{
+			name:    "no methods",
+			msg:     AuthRequest{},
+			wantErr: ErrInvalidLength,
+		},
+		{
+			name:    "short ipv4",
+			msg:     CommandRequest{Command: CommandConnect, Address: Address{Type: AddressIPv4, Addr: []byte{1, 2}}},
+			wantErr: ErrInvalidAddress,
+		},
+		{
+			name:    "long domain",
+			msg:     CommandReply{Address: Address{Type: AddressDomainName, Addr: make([]byte, MaxDomainSize+1)}},
+			wantErr: ErrInvalidAddress,
+		},
+		{
+			name:    "unknown address type",
+			msg:     CommandReply{Address: Address{Type: 2, Addr: []byte{1}}},
+			wantErr: ErrInvalidAddressType,
+		},
+		{
+			name:    "long username",
+			msg:     LoginRequest{Username: make([]byte, MaxCredentialLen+1)},
+			wantErr: ErrInvalidLength,
+		},
+		{
+			name:    "long token",
+			msg:     GSSAPIMessage{Type: GSSAuthentication, Token: make([]byte, MaxTokenSize+1)},
+			wantErr: ErrInvalidLength,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if _, err := tt.msg.WriteTo(&buf); !errors.Is(err, tt.wantErr) {
+				t.Fatalf("WriteTo() error = %v, want %v", err, tt.wantErr)
+			}
+			if buf.Len() != 0 {
+				t.Fatalf("WriteTo() wrote %d bytes of invalid message", buf.Len())
+			}
+		})
+	}
+}
+
+func TestAddressFrom(t *testing.T) {
+	tests := []struct {
+		name    string
+		addr    net.Addr
+		want    Address
+		wantErr bool
+	}{
+		{
+			name: "tcp ipv4",
+			addr: &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1080},
+			want: Address{Type: AddressIPv4, Addr: []byte{10, 0, 0, 1}, Port: 1080},
+		},
+		{
+			name: "udp ipv6",
+			addr: &net.UDPAddr{IP: net.IPv6loopback, Port: 53},
+			want: Address{Type: AddressIPv6, Addr: net.IPv6loopback, Port: 53},
+		},
+		{
+			name:    "unix",
+			addr:    &net.UnixAddr{Name: "/tmp/sock", Net: "unix"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := AddressFrom(tt.addr)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("AddressFrom() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("AddressFrom() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseDatagram(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    []byte
+		want    Datagram
+		wantErr error
+	}{
+		{
+			name: "ipv4",
+			data: []byte{0, 0, 0, 1, 127, 0, 0, 1, 0, 53, 'h', 'i'},
+			want: Datagram{
+				Address: Address{Type: AddressIPv4, Addr: []byte{127, 0, 0, 1}, Port: 53},
+				Data:    []byte("hi"),
+			},
+		},
+		{
+			name: "domain fragment",
+			data: []byte{0, 0, 2, 3, 4, 'a', '.', 'i', 'o', 1, 187},
+			want: Datagram{
+				Frag:    2,
+				Address: Address{Type: AddressDomainName, Addr: []byte("a.io"), Port: 443},
+				Data:    []byte{},
+			},
+		},
+		{
+			name:    "short header",
+			data:    []byte{0, 0, 0},
+			wantErr: ErrInvalidLength,
+		},
+		{
+			name:    "reserved",
+			data:    []byte{0, 1, 0, 1, 127, 0, 0, 1, 0, 53},
+			wantErr: ErrInvalidReserved,
+		},
+		{
+			name:    "truncated ipv6",
+			data:    []byte{0, 0, 0, 4, 0, 0, 0, 0},
+			wantErr: ErrInvalidLength,
+		},
+		{
+			name:    "missing domain length",
+			data:    []byte{0, 0, 0, 3},
+			wantErr: ErrInvalidLength,
+		},
+		{
+			name:    "empty domain",
+			data:    []byte{0, 0, 0, 3, 0, 0, 53},
+			wantErr: ErrInvalidAddress,
+		},
+		{
+			name:    "unknown address type",
+			data:    []byte{0, 0, 0, 2, 1, 0, 53},
+			wantErr: ErrInvalidAddressType,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseDatagram(tt.data)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("ParseDatagram() error = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("ParseDatagram() = %+v, want %+v", got, tt.want)
+			}
+
+			b, err := got.AppendTo(nil)
+			if err != nil || !bytes.Equal(b, tt.data) {
+				t.Fatalf("AppendTo() = %v, error %v, want %v", b, err, tt.data)
+			}
+		})
+	}
+}
@@ -0,0 +1,165 @@
+// Package wire provides SOCKS5 protocol constants and messages as defined in RFC 1928, 1929 and 1961.
+//
+// Messages implement io.ReaderFrom and io.WriterTo: decoders validate the input while reading,
+// encoders refuse messages that can't be represented on the wire. Use it to implement clients,
+// tests and interop tooling talking to the proxyme server (or any other SOCKS5 server).
+package wire
+
+import (
+	"errors"
+	"strconv"
+)
+
+var (
+	ErrInvalidVersion     = errors.New("invalid version")
+	ErrInvalidAddressType = errors.New("invalid address type")
+	ErrInvalidAddress     = errors.New("invalid address")
+	ErrInvalidLength      = errors.New("invalid length")
+	ErrInvalidReserved    = errors.New("invalid reserved field")
+)
+
+const (
+	// Version is SOCKS protocol version.
+	Version uint8 = 5
+	// SubnegotiationVersion is version of username/password and GSSAPI subnegotiation.
+	SubnegotiationVersion uint8 = 1
+)
+
+const (
+	MaxMethods       = 1<<8 - 1  // max number of methods in AuthRequest
+	MaxDomainSize    = 1<<8 - 1  // max length of domain name address
+	MaxCredentialLen = 1<<8 - 1  // max length of username and password
+	MaxTokenSize     = 1<<16 - 1 // max length of GSSAPI token
+)
+
+// Method is authentication method.
+type Method uint8
+
+const (
+	MethodNoAuth       Method = 0
+	MethodGSSAPI       Method = 1
+	MethodLogin        Method = 2
+	MethodNoAcceptable Method = 0xff
+)
+
+func (m Method) String() string {
+	switch m {
+	case MethodNoAuth:
+		return "no auth"
+	case MethodGSSAPI:
+		return "gssapi"
+	case MethodLogin:
+		return "login"
+	case MethodNoAcceptable:
+		return "no acceptable methods"
+	}
+
+	return "method(" + strconv.Itoa(int(m)) + ")"
+}
+
+// Command is SOCKS5 request command.
+type Command uint8
+
+const (
+	CommandConnect      Command = 1
+	CommandBind         Command = 2
+	CommandUDPAssociate Command = 3
+
+	// Tor extensions: resolve domain name (DST.ADDR) to BND.ADDR and vice versa.
+	CommandResolve    Command = 0xF0
+	CommandResolvePTR Command = 0xF1
+)
+
+func (c Command) String() string {
+	switch c {
+	case CommandConnect:
+		return "connect"
+	case CommandBind:
+		return "bind"
+	case CommandUDPAssociate:
+		return "udp associate"
+	case CommandResolve:
+		return "resolve"
+	case CommandResolvePTR:
+		return "resolve ptr"
+	}
+
+	return "command(" + strconv.Itoa(int(c)) + ")"
+}
+
+// AddressType is ATYP field of requests and replies.
+type AddressType uint8
+
+const (
+	AddressIPv4       AddressType = 1
+	AddressDomainName AddressType = 3
+	AddressIPv6       AddressType = 4
+)
+
+func (a AddressType) String() string {
+	switch a {
+	case AddressIPv4:
+		return "ipv4"
+	case AddressDomainName:
+		return "domain name"
+	case AddressIPv6:
+		return "ipv6"
+	}
+
+	return "address type(" + strconv.Itoa(int(a)) + ")"
+}
+
+// Status is REP field of command replies.
+type Status uint8
+
+const (
+	StatusSucceeded           Status = 0
+	StatusFailure             Status = 1 // general SOCKS server failure
+	StatusNotAllowed          Status = 2 // connection not allowed by ruleset
+	StatusNetworkUnreachable  Status = 3 // network unreachable
+	StatusHostUnreachable     Status = 4 // host unreachable
+	StatusConnectionRefused   Status = 5 // connection refused
+	StatusTTLExpired          Status = 6 // ttl expired
+	StatusNotSupported        Status = 7 // command not supported
+	StatusAddressNotSupported Status = 8 // address type not supported
+)
+
+func (s Status) String() string {
+	switch s {
+	case StatusSucceeded:
+		return "succeeded"
+	case StatusFailure:
+		return "general failure"
+	case StatusNotAllowed:
+		return "not allowed by ruleset"
+	case StatusNetworkUnreachable:
+		return "network unreachable"
+	case StatusHostUnreachable:
+		return "host unreachable"
+	case StatusConnectionRefused:
+		return "connection refused"
+	case StatusTTLExpired:
+		return "ttl expired"
+	case StatusNotSupported:
+		return "command not supported"
+	case StatusAddressNotSupported:
+		return "address type not supported"
+	}
+
+	return "status(" + strconv.Itoa(int(s)) + ")"
+}
+
+const (
+	// LoginSucceeded is LoginReply status on successful authentication,
+	// any other value is failure.
+	LoginSucceeded uint8 = 0
+	LoginFailure   uint8 = 0xff
+)
+
+// GSSAPI subnegotiation message types.
+const (
+	GSSAuthentication uint8 = 1
+	GSSProtection     uint8 = 2
+	GSSEncapsulation  uint8 = 3
+	GSSAbort          uint8 = 0xff
+)